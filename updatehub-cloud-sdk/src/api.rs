@@ -2,7 +2,11 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use serde::Serialize;
+use openssl::{
+    pkey::{PKey, Public},
+    rsa::Rsa,
+};
+use serde::{Deserialize, Serialize};
 use std::{collections::BTreeMap, fs, path::Path};
 
 #[derive(Debug)]
@@ -12,15 +16,120 @@ pub enum ProbeResponse {
     ExtraPoll(i64),
 }
 
+/// Response of the server to a request forwarded on behalf of a device
+/// which has no access to it.
+#[derive(Debug)]
+pub struct Forwarded {
+    pub status: u16,
+    pub headers: Vec<(String, String)>,
+    pub body: Vec<u8>,
+}
+
+/// How an object has been sent by the server.
+#[derive(Debug, PartialEq)]
+pub enum ObjectDownload {
+    /// The object itself, which was already downloaded so it hasn't
+    /// been verified.
+    Full,
+    /// The object itself, whose sha256sum has been verified while it was
+    /// downloaded.
+    Verified,
+    /// A patch, stored as `<object>.delta`, to be applied over the
+    /// installed object whose sha256sum is `base`.
+    Delta { base: String },
+}
+
 #[derive(Debug, PartialEq)]
 pub struct UpdatePackage {
     pub inner: pkg_schema::UpdatePackage,
     pub raw: Vec<u8>,
+    /// Position of the package in the chain of packages to be installed
+    /// in sequence, when the server sends a stepping-stone release.
+    pub chain: Option<UpdateChain>,
+    /// Signature the package has been validated with, kept so the package
+    /// can be validated again by the processes it is handed to.
+    pub signature: Option<Signature>,
+}
+
+/// Step of a chain of packages, installed one after the other across
+/// reboots, as a migration release required before the newest one.
+#[derive(Clone, Copy, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct UpdateChain {
+    /// Position of the package in the chain, starting at one.
+    pub step: usize,
+    pub length: usize,
+}
+
+/// Settings the server has pushed to the device, kept along their raw
+/// form which the signature is checked against.
+#[derive(Debug, PartialEq)]
+pub struct SettingsDelta {
+    /// Values of the settings, by their key as `polling.interval`.
+    pub settings: BTreeMap<String, String>,
+    pub raw: Vec<u8>,
 }
 
 #[derive(Debug, PartialEq)]
 pub struct Signature(Vec<u8>);
 
+/// Resources used by the agent while handling an update.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct ResourceUsage {
+    /// Peak resident set size, in bytes.
+    pub peak_rss: u64,
+    /// User and system CPU time, in milliseconds.
+    pub cpu_time: u64,
+    /// Bytes written to the storage.
+    pub bytes_written: u64,
+}
+
+/// What the device was doing when the update has failed, so the failure
+/// causes can be aggregated over the devices.
+#[derive(Clone, Debug, Default, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct ErrorDetails {
+    /// State the update has failed in.
+    pub state: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub object_index: Option<usize>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub object_mode: Option<String>,
+    /// Error number of the system call which has failed.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub errno: Option<i32>,
+    /// Exit code of the script, or tool, which has failed.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub exit_code: Option<i32>,
+    /// Class of the failure, as `timeout`.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub class: Option<String>,
+    /// Last lines logged before the failure.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub log: Vec<String>,
+    /// Bytes available for the update to be downloaded to.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub free_space: Option<u64>,
+    /// Charge of the battery, in percent.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub battery: Option<u8>,
+}
+
+/// Progress of the object being downloaded, or installed.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct Progress {
+    pub object: String,
+    pub mode: String,
+    pub index: usize,
+    pub count: usize,
+    /// Bytes of the object handled so far.
+    pub done: u64,
+    pub total: u64,
+    pub percentage: u8,
+}
+
 #[derive(Serialize)]
 #[serde(rename_all = "kebab-case")]
 pub struct FirmwareMetadata<'a> {
@@ -29,6 +138,33 @@ pub struct FirmwareMetadata<'a> {
     pub hardware: &'a str,
     pub device_identity: MetadataValue<'a>,
     pub device_attributes: MetadataValue<'a>,
+    /// Identity the device had before it has changed, until the change
+    /// is confirmed.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub previous_device_identity: Option<MetadataValue<'a>>,
+    /// Update channel the device follows, as `beta`.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub channel: Option<&'a str>,
+}
+
+/// Request of a device registering itself with the server, optionally
+/// with the one-time token it has been given for it.
+#[derive(Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct Enrollment<'a> {
+    #[serde(flatten)]
+    pub firmware: FirmwareMetadata<'a>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub enrollment_token: Option<&'a str>,
+}
+
+/// Credentials the server has issued to an enrolled device, which it
+/// sends along its requests.
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct Credentials {
+    /// Sent as a bearer token in the `Authorization` header.
+    pub token: String,
 }
 
 pub struct MetadataValue<'a>(pub &'a BTreeMap<String, Vec<String>>);
@@ -55,7 +191,12 @@ impl<'a> serde::ser::Serialize for MetadataValue<'a> {
 impl UpdatePackage {
     pub fn parse(content: &[u8]) -> crate::Result<Self> {
         let update_package = serde_json::from_slice(content)?;
-        Ok(UpdatePackage { inner: update_package, raw: content.to_vec() })
+        Ok(UpdatePackage {
+            inner: update_package,
+            raw: content.to_vec(),
+            chain: None,
+            signature: None,
+        })
     }
 
     pub fn package_uid(&self) -> String {
@@ -63,17 +204,148 @@ impl UpdatePackage {
     }
 }
 
+impl SettingsDelta {
+    pub fn parse(content: &[u8]) -> crate::Result<Self> {
+        let settings = serde_json::from_slice::<BTreeMap<String, serde_json::Value>>(content)?
+            .into_iter()
+            .map(|(key, value)| match value {
+                serde_json::Value::String(value) => (key, value),
+                value => (key, value.to_string()),
+            })
+            .collect();
+        Ok(SettingsDelta { settings, raw: content.to_vec() })
+    }
+}
+
 impl Signature {
     pub fn from_base64_str(bytes: &str) -> crate::Result<Self> {
         Ok(Signature(openssl::base64::decode_block(bytes)?.to_vec()))
     }
 
+    pub fn to_base64(&self) -> String {
+        openssl::base64::encode_block(&self.0)
+    }
+
+    /// Signs the `package` metadata with the private `key`, which may be
+    /// a RSA, ECDSA or Ed25519 key.
+    pub fn sign(key: &Path, package: &UpdatePackage) -> crate::Result<Self> {
+        use openssl::{hash::MessageDigest, pkey::Id, sign::Signer};
+        let key = PKey::private_key_from_pem(&fs::read(key)?)?;
+        let mut signer = match key.id() {
+            Id::ED25519 => Signer::new_without_digest(&key)?,
+            _ => Signer::new(MessageDigest::sha256(), &key)?,
+        };
+        Ok(Signature(signer.sign_oneshot_to_vec(&package.raw)?))
+    }
+
     pub fn validate(&self, key: &Path, package: &UpdatePackage) -> crate::Result<()> {
-        use openssl::{hash::MessageDigest, pkey::PKey, rsa::Rsa, sign::Verifier};
-        let key = PKey::from_rsa(Rsa::public_key_from_pem(&fs::read(key)?)?)?;
-        if Verifier::new(MessageDigest::sha256(), &key)?.verify_oneshot(&self.0, &package.raw)? {
-            return Ok(());
+        self.verify(key, &package.raw)
+    }
+
+    pub fn validate_settings(&self, key: &Path, settings: &SettingsDelta) -> crate::Result<()> {
+        self.verify(key, &settings.raw)
+    }
+
+    /// Validates the signature of the raw `data`, as the package metadata
+    /// before it is parsed. The key file may hold several keys, as while
+    /// they are rotated, and the signature is valid if made by any of
+    /// them. A signature made by another key type fails to be parsed,
+    /// which is taken as a mismatch. The key may also be kept in a token,
+    /// being referred to by its URI.
+    pub fn verify(&self, key: &Path, data: &[u8]) -> crate::Result<()> {
+        use openssl::{hash::MessageDigest, pkey::Id, sign::Verifier};
+        let keys = match key.to_str().filter(|key| crate::is_token_uri(key)) {
+            Some(uri) => vec![crate::keystore::load_public_key(uri)?],
+            None => public_keys(&fs::read(key)?)?,
+        };
+        for key in keys {
+            let mut verifier = match key.id() {
+                Id::ED25519 => Verifier::new_without_digest(&key)?,
+                _ => Verifier::new(MessageDigest::sha256(), &key)?,
+            };
+            if verifier.verify_oneshot(&self.0, data).unwrap_or(false) {
+                return Ok(());
+            }
         }
         Err(crate::Error::InvalidSignature)
     }
 }
+
+/// Public keys of the PEM blocks in `pem`, of any type, as RSA keys in
+/// PKCS#1 format or RSA, ECDSA and Ed25519 keys in SubjectPublicKeyInfo
+/// format.
+fn public_keys(pem: &[u8]) -> crate::Result<Vec<PKey<Public>>> {
+    let pem = String::from_utf8_lossy(pem);
+    let mut keys = Vec::new();
+    let mut block = String::new();
+    for line in pem.lines().map(str::trim) {
+        if line.starts_with("-----BEGIN") {
+            block.clear();
+        }
+        block.push_str(line);
+        block.push('\n');
+        if line.starts_with("-----END") {
+            keys.push(match line {
+                "-----END RSA PUBLIC KEY-----" => {
+                    PKey::from_rsa(Rsa::public_key_from_pem_pkcs1(block.as_bytes())?)?
+                }
+                _ => PKey::public_key_from_pem(block.as_bytes())?,
+            });
+        }
+    }
+
+    if keys.is_empty() {
+        return Err(crate::Error::MissingPublicKey);
+    }
+    Ok(keys)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use openssl::{
+        ec::{EcGroup, EcKey},
+        nid::Nid,
+        pkey::Private,
+    };
+
+    fn write_keys(dir: &Path, name: &str, key: &PKey<Private>) -> std::path::PathBuf {
+        fs::write(dir.join(name), key.private_key_to_pem_pkcs8().unwrap()).unwrap();
+        let public = dir.join(format!("{}.pub", name));
+        fs::write(&public, key.public_key_to_pem().unwrap()).unwrap();
+        public
+    }
+
+    #[test]
+    fn sign_and_validate_key_types() {
+        let dir = tempfile::tempdir().unwrap();
+        let package = UpdatePackage::parse(
+            br#"{"product": "0123456789", "version": "1.0", "objects": [[], []]}"#,
+        )
+        .unwrap();
+        let ecdsa = PKey::from_ec_key(
+            EcKey::generate(&EcGroup::from_curve_name(Nid::X9_62_PRIME256V1).unwrap()).unwrap(),
+        )
+        .unwrap();
+        let ed25519 = PKey::generate_ed25519().unwrap();
+        let ecdsa_pub = write_keys(dir.path(), "ecdsa", &ecdsa);
+        let ed25519_pub = write_keys(dir.path(), "ed25519", &ed25519);
+
+        let ecdsa_sign = Signature::sign(&dir.path().join("ecdsa"), &package).unwrap();
+        let ed25519_sign = Signature::sign(&dir.path().join("ed25519"), &package).unwrap();
+        ecdsa_sign.validate(&ecdsa_pub, &package).unwrap();
+        ed25519_sign.validate(&ed25519_pub, &package).unwrap();
+        assert!(ecdsa_sign.validate(&ed25519_pub, &package).is_err());
+        assert!(ed25519_sign.validate(&ecdsa_pub, &package).is_err());
+
+        // Any of the trusted keys validates the signature
+        let trusted = dir.path().join("trusted.pub");
+        fs::write(
+            &trusted,
+            [fs::read(&ecdsa_pub).unwrap(), fs::read(&ed25519_pub).unwrap()].concat(),
+        )
+        .unwrap();
+        ecdsa_sign.validate(&trusted, &package).unwrap();
+        ed25519_sign.validate(&trusted, &package).unwrap();
+    }
+}
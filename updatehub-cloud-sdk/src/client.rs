@@ -2,29 +2,62 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::{api, Error, Result};
+use crate::{api, report, Error, RateLimit, Result};
 use awc::{
     http::{
-        header::{self, HeaderName, CONTENT_TYPE, RANGE, USER_AGENT},
+        header::{
+            self, HeaderName, HttpDate, AUTHORIZATION, CONTENT_ENCODING, CONTENT_TYPE, ETAG,
+            IF_MODIFIED_SINCE, IF_NONE_MATCH, IF_RANGE, LAST_MODIFIED, RANGE, RETRY_AFTER,
+            USER_AGENT,
+        },
         StatusCode,
     },
     ClientBuilder,
 };
+use lazy_static::lazy_static;
+use openssl::sha::{sha256, Sha256};
 use serde::Serialize;
 use slog_scope::{debug, error};
 use std::{
+    collections::HashMap,
     convert::{TryFrom, TryInto},
     path::Path,
-    time::Duration,
+    sync::{Mutex, RwLock},
+    time::{Duration, Instant, SystemTime},
 };
 use tokio::{
-    io::{self, AsyncWriteExt},
+    io::{self, AsyncReadExt, AsyncWriteExt},
     stream::StreamExt,
 };
 
+const API_DELTA_BASES: &str = "api-delta-bases";
+const UH_DELTA_BASE: &str = "uh-delta-base";
+const UH_CHAIN_STEP: &str = "uh-chain-step";
+const UH_CHAIN_LENGTH: &str = "uh-chain-length";
+
+lazy_static! {
+    // Validators of the last "no update" answer of each server, so an
+    // unchanged answer is sent as a bodyless 304.
+    static ref PROBE_VALIDATORS: Mutex<HashMap<String, ProbeValidators>> = Mutex::default();
+    static ref CREDENTIALS: RwLock<Option<api::Credentials>> = RwLock::new(None);
+}
+
+/// Validators of a probe answer, along the hash of the request they
+/// were answered to, as they only hold for the same device metadata.
+#[derive(Clone, Debug)]
+struct ProbeValidators {
+    request: [u8; 32],
+    etag: Option<String>,
+    last_modified: Option<String>,
+}
+
 pub struct Client<'a> {
     client: awc::Client,
     server: &'a str,
+    rate_limit: RateLimit,
+    delta_bases: Vec<String>,
+    update_chain: Option<api::UpdateChain>,
+    package_server: Option<&'a str>,
 }
 
 impl From<awc::error::SendRequestError> for Error {
@@ -40,31 +73,152 @@ pub async fn get<W>(url: &str, handle: &mut W) -> Result<()>
 where
     W: io::AsyncWrite + Unpin,
 {
-    let req = awc::Client::new().get(url);
+    let req = connected_builder().finish().get(url);
     save_body_to(req, handle).await
 }
 
+// Builder of the clients connecting through the configured proxy, if
+// any, and with the configured TLS settings, including the pinned
+// certificates. Every request to the server goes through it.
+fn connected_builder() -> ClientBuilder {
+    let builder = ClientBuilder::new();
+    match (crate::proxy::tunnel(), crate::tls::connector()) {
+        (Some(tunnel), Some(tls)) => {
+            builder.connector(awc::Connector::new().connector(tunnel).ssl(tls).finish())
+        }
+        (Some(tunnel), None) => builder.connector(awc::Connector::new().connector(tunnel).finish()),
+        (None, Some(tls)) => builder.connector(awc::Connector::new().ssl(tls).finish()),
+        (None, None) => builder,
+    }
+}
+
+/// Sets the `credentials` the device has been enrolled with, sent along
+/// the requests to the server.
+pub fn configure_credentials(credentials: Option<api::Credentials>) {
+    *CREDENTIALS.write().expect("poisoned credentials lock") = credentials;
+}
+
+/// Tries to acquire the lock served at `url` on behalf of the device,
+/// returning `false` if it is currently held by someone else.
+pub async fn acquire_lock(url: &str, firmware: api::FirmwareMetadata<'_>) -> Result<bool> {
+    let response = connected_builder().finish().post(url).send_json(&firmware).await?;
+
+    match response.status() {
+        s if s.is_success() => Ok(true),
+        StatusCode::CONFLICT | StatusCode::LOCKED => Ok(false),
+        s => Err(Error::InvalidStatusResponse(s)),
+    }
+}
+
+/// Releases the lock served at `url` held by the device.
+pub async fn release_lock(url: &str, firmware: api::FirmwareMetadata<'_>) -> Result<()> {
+    let response = connected_builder().finish().delete(url).send_json(&firmware).await?;
+
+    match response.status() {
+        s if s.is_success() => Ok(()),
+        s => Err(Error::InvalidStatusResponse(s)),
+    }
+}
+
+/// Asks the peer served at `url` to take over the device's duties, so
+/// the device can be updated while its peer keeps operating.
+pub async fn request_takeover(url: &str, firmware: api::FirmwareMetadata<'_>) -> Result<()> {
+    let response = connected_builder().finish().post(url).send_json(&firmware).await?;
+
+    match response.status() {
+        s if s.is_success() => Ok(()),
+        s => Err(Error::InvalidStatusResponse(s)),
+    }
+}
+
+/// Posts the `payload`, as JSON, to the `url` of a service watching the
+/// device, as the webhook of an external scheduler.
+pub async fn notify<T: Serialize>(url: &str, payload: &T) -> Result<()> {
+    let response = connected_builder().finish().post(url).send_json(payload).await?;
+
+    match response.status() {
+        s if s.is_success() => Ok(()),
+        s => Err(Error::InvalidStatusResponse(s)),
+    }
+}
+
 async fn save_body_to<W>(req: awc::ClientRequest, handle: &mut W) -> Result<()>
 where
     W: io::AsyncWrite + Unpin,
 {
-    use std::str::FromStr;
-
     let mut rep = req.send().await?;
     if !rep.status().is_success() {
         return Err(Error::InvalidStatusResponse(rep.status()));
     }
 
-    let mut written: f32 = 0.;
-    let mut threshold = 10;
-    let length = match rep.headers().get(header::CONTENT_LENGTH) {
+    let length = content_length(rep.headers())?;
+    write_body_to(&mut rep, length, &RateLimit::default(), handle, None).await
+}
+
+async fn hash_file(hasher: &mut Sha256, path: &Path) -> Result<()> {
+    let mut file = tokio::fs::File::open(path).await?;
+    let mut buf = vec![0; 64 * 1024];
+    loop {
+        match file.read(&mut buf).await? {
+            0 => return Ok(()),
+            len => hasher.update(&buf[..len]),
+        }
+    }
+}
+
+fn content_length(headers: &header::HeaderMap) -> Result<usize> {
+    use std::str::FromStr;
+
+    Ok(match headers.get(header::CONTENT_LENGTH) {
         Some(v) => usize::from_str(v.to_str()?)?,
         None => 0,
-    };
+    })
+}
+
+async fn write_body_to<R, B, E, W>(
+    body: &mut R,
+    length: usize,
+    rate_limit: &RateLimit,
+    handle: &mut W,
+    mut hasher: Option<&mut Sha256>,
+) -> Result<()>
+where
+    R: tokio::stream::Stream<Item = std::result::Result<B, E>> + Unpin,
+    B: AsRef<[u8]>,
+    Error: From<E>,
+    W: io::AsyncWrite + Unpin,
+{
+    let mut written: f32 = 0.;
+    let mut threshold = 10;
+    let mut total = 0;
+    let mut started = Instant::now();
+    let mut current_rate = rate_limit.get();
+    while let Some(chunk) = body.next().await {
+        let chunk = chunk?;
+        let chunk = chunk.as_ref();
+        crate::traffic::add_downloaded(chunk.len());
+        handle.write_all(chunk).await?;
+        if let Some(ref mut hasher) = hasher {
+            hasher.update(chunk);
+        }
+
+        // Hold the next read for as long as the download is ahead of the
+        // allowed rate, which is measured again whenever it changes.
+        let rate = rate_limit.get();
+        if rate != current_rate {
+            current_rate = rate;
+            started = Instant::now();
+            total = 0;
+        }
+        total += chunk.len() as u64;
+        if let Some(rate) = rate {
+            let expected = Duration::from_secs_f64(total as f64 / rate as f64);
+            let elapsed = started.elapsed();
+            if expected > elapsed {
+                tokio::time::delay_for(expected - elapsed).await;
+            }
+        }
 
-    while let Some(chunk) = rep.next().await {
-        let chunk = &chunk?;
-        handle.write_all(&chunk).await?;
         if length > 0 {
             written += chunk.len() as f32 / (length / 100) as f32;
             if written as usize >= threshold {
@@ -80,7 +234,11 @@ where
 
 impl<'a> Client<'a> {
     pub fn new(server: &'a str) -> Self {
-        let client = ClientBuilder::new()
+        let mut builder = connected_builder();
+        if let Some(credentials) = CREDENTIALS.read().expect("poisoned credentials lock").as_ref() {
+            builder = builder.header(AUTHORIZATION, format!("Bearer {}", credentials.token));
+        }
+        let client = builder
             .timeout(Duration::from_secs(10))
             .header(USER_AGENT, "updatehub/next")
             .header(CONTENT_TYPE, "application/json")
@@ -89,7 +247,40 @@ impl<'a> Client<'a> {
                 "application/vnd.updatehub-v1+json",
             )
             .finish();
-        Self { server, client }
+        Self {
+            server,
+            client,
+            rate_limit: RateLimit::default(),
+            delta_bases: Vec::default(),
+            update_chain: None,
+            package_server: None,
+        }
+    }
+
+    /// Limits the object downloads to `rate_limit` bytes per second.
+    pub fn with_rate_limit(mut self, rate_limit: impl Into<RateLimit>) -> Self {
+        self.rate_limit = rate_limit.into();
+        self
+    }
+
+    /// Advertises the sha256sum of the installed objects, so the server
+    /// can send deltas against them instead of the whole objects.
+    pub fn with_delta_bases(mut self, delta_bases: Vec<String>) -> Self {
+        self.delta_bases = delta_bases;
+        self
+    }
+
+    /// Reports the step of the update chain being installed, if any.
+    pub fn with_update_chain(mut self, update_chain: Option<api::UpdateChain>) -> Self {
+        self.update_chain = update_chain;
+        self
+    }
+
+    /// Reports the server the package has been found on, when the device
+    /// has more than one to choose from.
+    pub fn with_package_server(mut self, package_server: Option<&'a str>) -> Self {
+        self.package_server = package_server;
+        self
     }
 
     pub async fn probe(
@@ -97,15 +288,45 @@ impl<'a> Client<'a> {
         num_retries: u64,
         firmware: api::FirmwareMetadata<'_>,
     ) -> Result<api::ProbeResponse> {
-        let mut response = self
+        let mut request = self
             .client
             .post(&format!("{}/upgrades", &self.server))
-            .header(HeaderName::from_static("api-retries"), num_retries)
-            .send_json(&firmware)
-            .await?;
+            .header(HeaderName::from_static("api-retries"), num_retries);
+        if !self.delta_bases.is_empty() {
+            request = request.header(API_DELTA_BASES, self.delta_bases.join(","));
+        }
+        let body = serde_json::to_vec(&firmware)?;
+        let request_hash = sha256(&body);
+        let validators = PROBE_VALIDATORS.lock().unwrap().get(self.server).cloned();
+        if let Some(validators) = validators.filter(|v| v.request == request_hash) {
+            if let Some(etag) = validators.etag {
+                request = request.header(IF_NONE_MATCH, etag);
+            }
+            if let Some(last_modified) = validators.last_modified {
+                request = request.header(IF_MODIFIED_SINCE, last_modified);
+            }
+        }
+        crate::traffic::add_uploaded(body.len());
+        let mut response = request.send_body(body).await?;
+        if response.status() == StatusCode::OK || response.status() == StatusCode::NOT_FOUND {
+            report::set_report_support(report::ReportSupport::from_headers(response.headers()));
+        }
+        if response.status() != StatusCode::NOT_MODIFIED {
+            PROBE_VALIDATORS.lock().unwrap().remove(self.server);
+        }
 
         match response.status() {
-            StatusCode::NOT_FOUND => Ok(api::ProbeResponse::NoUpdate),
+            StatusCode::NOT_MODIFIED => Ok(api::ProbeResponse::NoUpdate),
+            StatusCode::NOT_FOUND => {
+                keep_probe_validators(self.server, request_hash, response.headers());
+                Ok(api::ProbeResponse::NoUpdate)
+            }
+            StatusCode::TOO_MANY_REQUESTS | StatusCode::SERVICE_UNAVAILABLE => {
+                match retry_after(response.headers(), SystemTime::now()) {
+                    Some(delay) => Err(Error::RetryAfter(delay)),
+                    None => Err(Error::InvalidStatusResponse(response.status())),
+                }
+            }
             StatusCode::OK => {
                 match response
                     .headers()
@@ -120,10 +341,12 @@ impl<'a> Client<'a> {
                             .get("UH-Signature")
                             .map(TryInto::try_into)
                             .transpose()?;
-                        Ok(api::ProbeResponse::Update(
-                            api::UpdatePackage::parse(&response.body().await?)?,
-                            signature,
-                        ))
+                        let chain = update_chain(response.headers());
+                        let body = response.body().await?;
+                        crate::traffic::add_downloaded(body.len());
+                        let mut package = api::UpdatePackage::parse(&body)?;
+                        package.chain = chain;
+                        Ok(api::ProbeResponse::Update(package, signature))
                     }
                 }
             }
@@ -131,14 +354,86 @@ impl<'a> Client<'a> {
         }
     }
 
+    /// Registers the device with the server, which issues the credentials
+    /// it sends along its later requests. The server may require the
+    /// one-time `enrollment_token` the device has been given.
+    pub async fn enroll(
+        &self,
+        firmware: api::FirmwareMetadata<'_>,
+        enrollment_token: Option<&str>,
+    ) -> Result<api::Credentials> {
+        let body = serde_json::to_vec(&api::Enrollment { firmware, enrollment_token })?;
+        crate::traffic::add_uploaded(body.len());
+        let mut response =
+            self.client.post(&format!("{}/enrollment", &self.server)).send_body(body).await?;
+
+        match response.status() {
+            StatusCode::OK | StatusCode::CREATED => {
+                let body = response.body().await?;
+                crate::traffic::add_downloaded(body.len());
+                Ok(serde_json::from_slice(&body)?)
+            }
+            s => Err(Error::InvalidStatusResponse(s)),
+        }
+    }
+
+    /// Fetches the settings the server has pushed to the device, if
+    /// any, along their signature.
+    pub async fn settings(
+        &self,
+        firmware: api::FirmwareMetadata<'_>,
+    ) -> Result<Option<(api::SettingsDelta, Option<api::Signature>)>> {
+        let body = serde_json::to_vec(&firmware)?;
+        crate::traffic::add_uploaded(body.len());
+        let mut response =
+            self.client.post(&format!("{}/settings", &self.server)).send_body(body).await?;
+
+        match response.status() {
+            StatusCode::NOT_FOUND => Ok(None),
+            StatusCode::OK => {
+                let signature =
+                    response.headers().get("UH-Signature").map(TryInto::try_into).transpose()?;
+                let body = response.body().await?;
+                crate::traffic::add_downloaded(body.len());
+                Ok(Some((api::SettingsDelta::parse(&body)?, signature)))
+            }
+            s => Err(Error::InvalidStatusResponse(s)),
+        }
+    }
+
+    /// Forwards the request of a device which has no access to the
+    /// server to its `path`, along with the request `headers` and `body`.
+    pub async fn forward(
+        &self,
+        path: &str,
+        headers: &[(String, String)],
+        body: Vec<u8>,
+    ) -> Result<api::Forwarded> {
+        let mut request = self.client.post(&format!("{}{}", &self.server, path));
+        for (name, value) in headers {
+            request = request.set_header(name.as_str(), value.as_str());
+        }
+        crate::traffic::add_uploaded(body.len());
+        let mut response = request.send_body(body).await?;
+        let body = response.body().await?;
+        crate::traffic::add_downloaded(body.len());
+
+        let headers = response
+            .headers()
+            .iter()
+            .filter_map(|(name, value)| Some((name.to_string(), value.to_str().ok()?.to_owned())))
+            .collect();
+        Ok(api::Forwarded { status: response.status().as_u16(), headers, body: body.to_vec() })
+    }
+
     pub async fn download_object(
         &self,
         product_uid: &str,
         package_uid: &str,
         download_dir: &Path,
         object: &str,
-    ) -> Result<()> {
-        use tokio::fs::{create_dir_all, OpenOptions};
+    ) -> Result<api::ObjectDownload> {
+        use tokio::fs::{create_dir_all, read_to_string, remove_file, write, OpenOptions};
 
         // FIXME: Discuss the need of packages inside the route
         let mut request = self.client.get(&format!(
@@ -153,15 +448,189 @@ impl<'a> Client<'a> {
             })?;
         }
 
+        // A partially downloaded object is resumed from where it has
+        // stopped. The validator of the previous response is sent along so
+        // the server sends the whole object again if it has changed since.
         let file = download_dir.join(object);
-        if file.exists() {
-            request = request
-                .header(RANGE, format!("bytes={}-", file.metadata()?.len().saturating_sub(1)));
+        let validator = download_dir.join(format!("{}.etag", object));
+        let offset = if file.exists() { file.metadata()?.len() } else { 0 };
+        if offset > 0 {
+            request = request.header(RANGE, format!("bytes={}-", offset));
+            if let Ok(etag) = read_to_string(&validator).await {
+                request = request.header(IF_RANGE, etag.trim());
+            }
+        } else if !self.delta_bases.is_empty() {
+            request = request.header(API_DELTA_BASES, self.delta_bases.join(","));
         }
 
-        let mut file = OpenOptions::new().create(true).append(true).open(&file).await?;
+        let mut rep = request.send().await?;
+        let append = match rep.status() {
+            StatusCode::PARTIAL_CONTENT => {
+                debug!("resuming download of {} from byte {}", object, offset);
+                true
+            }
+            StatusCode::RANGE_NOT_SATISFIABLE if offset > 0 => {
+                debug!("object {} has already been fully downloaded", object);
+                return Ok(api::ObjectDownload::Full);
+            }
+            s if s.is_success() => false,
+            s => return Err(Error::InvalidStatusResponse(s)),
+        };
+
+        // The server may send a patch against one of the advertised
+        // objects, which is stored apart from the object itself.
+        let delta_base = match rep.headers().get(UH_DELTA_BASE) {
+            Some(base) if !append => Some(base.to_str()?.to_owned()),
+            _ => None,
+        };
+        if let Some(base) = delta_base {
+            debug!("receiving {} as a delta against {}", object, base);
+            let mut patch = OpenOptions::new()
+                .create(true)
+                .write(true)
+                .truncate(true)
+                .open(download_dir.join(format!("{}.delta", object)))
+                .await?;
+            let length = content_length(rep.headers())?;
+            write_body_to(&mut rep, length, &self.rate_limit, &mut patch, None).await?;
+            return Ok(api::ObjectDownload::Delta { base });
+        }
 
-        save_body_to(request, &mut file).await
+        match rep.headers().get(ETAG) {
+            Some(etag) => write(&validator, etag.as_bytes()).await?,
+            None if validator.exists() => remove_file(&validator).await?,
+            None => {}
+        }
+
+        // The sha256sum is computed while the object is written, so it is
+        // verified without reading it back. The bytes of a resumed
+        // download are hashed first.
+        let mut hasher = Sha256::new();
+        if append {
+            hash_file(&mut hasher, &file).await?;
+        }
+
+        let mut handle = OpenOptions::new()
+            .create(true)
+            .write(true)
+            .append(append)
+            .truncate(!append)
+            .open(&file)
+            .await?;
+
+        let length = content_length(rep.headers())?;
+        write_body_to(&mut rep, length, &self.rate_limit, &mut handle, Some(&mut hasher)).await?;
+
+        let sha256sum = hasher.finish().iter().map(|c| format!("{:02x}", c)).collect::<String>();
+        if sha256sum != object {
+            error!("object {} has been downloaded with sha256sum {}", object, sha256sum);
+            remove_file(&file).await?;
+            if validator.exists() {
+                remove_file(&validator).await?;
+            }
+            return Err(Error::ChecksumMismatch(object.to_owned()));
+        }
+
+        Ok(api::ObjectDownload::Verified)
+    }
+
+    /// Streams the object to `handle` as it is downloaded, so it doesn't
+    /// need to be kept anywhere. The sha256sum is only known once the
+    /// last byte has been written, so the receiving end must be able to
+    /// discard what it has been given on errors.
+    pub async fn stream_object<W>(
+        &self,
+        product_uid: &str,
+        package_uid: &str,
+        object: &str,
+        handle: &mut W,
+    ) -> Result<()>
+    where
+        W: io::AsyncWrite + Unpin,
+    {
+        let mut rep = self
+            .client
+            .get(&format!(
+                "{}/products/{}/packages/{}/objects/{}",
+                &self.server, product_uid, package_uid, object
+            ))
+            .send()
+            .await?;
+        if rep.status() != StatusCode::OK {
+            return Err(Error::InvalidStatusResponse(rep.status()));
+        }
+
+        let mut hasher = Sha256::new();
+        let length = content_length(rep.headers())?;
+        write_body_to(&mut rep, length, &self.rate_limit, handle, Some(&mut hasher)).await?;
+        handle.flush().await?;
+
+        let sha256sum = hasher.finish().iter().map(|c| format!("{:02x}", c)).collect::<String>();
+        if sha256sum != object {
+            error!("object {} has been streamed with sha256sum {}", object, sha256sum);
+            return Err(Error::ChecksumMismatch(object.to_owned()));
+        }
+
+        Ok(())
+    }
+
+    /// Downloads the `start..=end` byte range of the object to `file`,
+    /// resuming from the bytes already written to it as long as the
+    /// object hasn't changed since, which is told by the validator kept
+    /// along the file.
+    pub async fn download_object_range(
+        &self,
+        product_uid: &str,
+        package_uid: &str,
+        object: &str,
+        start: u64,
+        end: u64,
+        file: &Path,
+    ) -> Result<()> {
+        use tokio::fs::{read_to_string, remove_file, write, OpenOptions};
+
+        let written = if file.exists() { file.metadata()?.len() } else { 0 };
+        let start = start + written;
+        if start > end {
+            return Ok(());
+        }
+
+        let mut validator = file.as_os_str().to_owned();
+        validator.push(".etag");
+        let mut request = self
+            .client
+            .get(&format!(
+                "{}/products/{}/packages/{}/objects/{}",
+                &self.server, product_uid, package_uid, object
+            ))
+            .header(RANGE, format!("bytes={}-{}", start, end));
+        if written > 0 {
+            if let Ok(etag) = read_to_string(&validator).await {
+                request = request.header(IF_RANGE, etag.trim());
+            }
+        }
+
+        let mut rep = request.send().await?;
+        if rep.status() != StatusCode::PARTIAL_CONTENT {
+            // The whole object is sent instead when it has changed since
+            // the range was started, so what has been written is dropped
+            // and the range is started over on the next attempt.
+            if rep.status() == StatusCode::OK && written > 0 {
+                debug!("object {} has changed, dropping the {:?} range", object, file);
+                remove_file(file).await?;
+            }
+            return Err(Error::InvalidStatusResponse(rep.status()));
+        }
+
+        match rep.headers().get(ETAG) {
+            Some(etag) => write(&validator, etag.as_bytes()).await?,
+            None if Path::new(&validator).exists() => remove_file(&validator).await?,
+            None => {}
+        }
+
+        let mut handle = OpenOptions::new().create(true).append(true).open(file).await?;
+        let length = content_length(rep.headers())?;
+        write_body_to(&mut rep, length, &self.rate_limit, &mut handle, None).await
     }
 
     pub async fn report(
@@ -172,29 +641,174 @@ impl<'a> Client<'a> {
         previous_state: Option<&str>,
         error_message: Option<String>,
         current_log: Option<String>,
+        resource_usage: Option<api::ResourceUsage>,
     ) -> Result<()> {
-        #[derive(Serialize)]
-        #[serde(rename_all = "kebab-case")]
-        struct Payload<'a> {
-            #[serde(rename = "status")]
-            state: &'a str,
-            #[serde(flatten)]
-            firmware: api::FirmwareMetadata<'a>,
-            package_uid: &'a str,
-            #[serde(skip_serializing_if = "Option::is_none")]
-            previous_state: Option<&'a str>,
-            #[serde(skip_serializing_if = "Option::is_none")]
-            error_message: Option<String>,
-            #[serde(skip_serializing_if = "Option::is_none")]
-            current_log: Option<String>,
-        }
-
-        let payload =
-            Payload { state, firmware, package_uid, previous_state, error_message, current_log };
-
-        self.client.post(&format!("{}/report", &self.server)).send_json(&payload).await?;
-        Ok(())
+        self.send_report(
+            &ReportPayload {
+                state,
+                firmware,
+                package_uid,
+                previous_state,
+                error_message,
+                current_log,
+                resource_usage,
+                error_details: None,
+                progress: None,
+                update_chain: self.update_chain.as_ref(),
+                package_server: self.package_server,
+            },
+            true,
+        )
+        .await
+    }
+
+    /// Reports the update as failed in the `previous_state`, along with
+    /// the `details` of the failure.
+    pub async fn report_error(
+        &self,
+        firmware: api::FirmwareMetadata<'_>,
+        package_uid: &str,
+        previous_state: &str,
+        error_message: String,
+        current_log: Option<String>,
+        resource_usage: Option<api::ResourceUsage>,
+        details: &api::ErrorDetails,
+    ) -> Result<()> {
+        self.send_report(
+            &ReportPayload {
+                state: "error",
+                firmware,
+                package_uid,
+                previous_state: Some(previous_state),
+                error_message: Some(error_message),
+                current_log,
+                resource_usage,
+                error_details: Some(details),
+                progress: None,
+                update_chain: self.update_chain.as_ref(),
+                package_server: self.package_server,
+            },
+            true,
+        )
+        .await
+    }
+
+    /// Reports the progress of the object being handled while the agent
+    /// stays in the `state`.
+    pub async fn report_progress(
+        &self,
+        state: &str,
+        firmware: api::FirmwareMetadata<'_>,
+        package_uid: &str,
+        progress: &api::Progress,
+    ) -> Result<()> {
+        self.send_report(
+            &ReportPayload {
+                state,
+                firmware,
+                package_uid,
+                previous_state: None,
+                error_message: None,
+                current_log: None,
+                resource_usage: None,
+                error_details: None,
+                progress: Some(progress),
+                update_chain: self.update_chain.as_ref(),
+                package_server: self.package_server,
+            },
+            false,
+        )
+        .await
+    }
+
+    // The progress reports are batched, when the server supports it, and
+    // sent along the next state report, which is sent right away.
+    async fn send_report(&self, payload: &ReportPayload<'_>, flush: bool) -> Result<()> {
+        let support = report::report_support();
+        let (path, body) = if support.batch_size > 0 {
+            match report::queue_report(serde_json::to_value(payload)?, support.batch_size, flush) {
+                Some(reports) => ("report/batch", serde_json::to_vec(&reports)?),
+                None => return Ok(()),
+            }
+        } else {
+            ("report", serde_json::to_vec(payload)?)
+        };
+
+        let mut request = self.client.post(&format!("{}/{}", &self.server, path));
+        let body = match support.encoding {
+            Some(encoding) => {
+                request = request.header(CONTENT_ENCODING, encoding.name());
+                encoding.encode(&body)?
+            }
+            None => body,
+        };
+        crate::traffic::add_uploaded(body.len());
+        let rep = request.send_body(body).await?;
+        match rep.status() {
+            s if s.is_success() => Ok(()),
+            s => Err(Error::InvalidStatusResponse(s)),
+        }
+    }
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "kebab-case")]
+struct ReportPayload<'a> {
+    #[serde(rename = "status")]
+    state: &'a str,
+    #[serde(flatten)]
+    firmware: api::FirmwareMetadata<'a>,
+    package_uid: &'a str,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    previous_state: Option<&'a str>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error_message: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    current_log: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    resource_usage: Option<api::ResourceUsage>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    error_details: Option<&'a api::ErrorDetails>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    progress: Option<&'a api::Progress>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    update_chain: Option<&'a api::UpdateChain>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    package_server: Option<&'a str>,
+}
+
+// The chain is only taken into account when both its step and its
+// length are valid.
+fn update_chain(headers: &header::HeaderMap) -> Option<api::UpdateChain> {
+    let parse = |name| headers.get(name)?.to_str().ok()?.parse::<usize>().ok();
+    match (parse(UH_CHAIN_STEP), parse(UH_CHAIN_LENGTH)) {
+        (Some(step), Some(length)) if step >= 1 && step <= length => {
+            Some(api::UpdateChain { step, length })
+        }
+        _ => None,
+    }
+}
+
+// Only the "no update" answers are kept, as an update package is never
+// probed again once received.
+fn keep_probe_validators(server: &str, request: [u8; 32], headers: &header::HeaderMap) {
+    let header = |name| headers.get(name).and_then(|v| v.to_str().ok()).map(str::to_owned);
+    let validators =
+        ProbeValidators { request, etag: header(ETAG), last_modified: header(LAST_MODIFIED) };
+    if validators.etag.is_some() || validators.last_modified.is_some() {
+        PROBE_VALIDATORS.lock().unwrap().insert(server.to_owned(), validators);
+    }
+}
+
+/// Delay the server has asked the requests to be held for, given as
+/// seconds or as an HTTP date in the `Retry-After` header.
+fn retry_after(headers: &header::HeaderMap, now: SystemTime) -> Option<Duration> {
+    let value = headers.get(RETRY_AFTER)?.to_str().ok()?.trim();
+    if let Ok(secs) = value.parse::<u64>() {
+        return Some(Duration::from_secs(secs));
     }
+    let date = SystemTime::from(value.parse::<HttpDate>().ok()?);
+    Some(date.duration_since(now).unwrap_or_default())
 }
 
 impl TryFrom<&header::HeaderValue> for api::Signature {
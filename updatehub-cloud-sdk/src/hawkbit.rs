@@ -0,0 +1,268 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Client of the Eclipse hawkBit Direct Device Integration API, which
+//! the deployments are received from and their feedback is sent to.
+
+use crate::{Error, Result};
+use awc::{
+    http::{
+        header::{AUTHORIZATION, CONTENT_TYPE},
+        StatusCode,
+    },
+    ClientBuilder,
+};
+use serde::{Deserialize, Serialize};
+use std::{collections::BTreeMap, time::Duration};
+
+/// Marker of the feedback sent once the deployment is accepted, which is
+/// read back from the action history to know it is in progress.
+const ACCEPTED_MARKER: &str = "updatehub accepted at ";
+
+/// Deployment the device has been assigned to.
+#[derive(Clone, Debug, PartialEq)]
+pub struct Deployment {
+    pub action_id: String,
+    pub artifacts: Vec<Artifact>,
+    /// When the device has accepted the deployment, in seconds since
+    /// epoch, if it has already done so.
+    pub accepted_at: Option<i64>,
+}
+
+#[derive(Clone, Debug, PartialEq)]
+pub struct Artifact {
+    pub filename: String,
+    pub url: String,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Execution {
+    Proceeding,
+    Closed,
+    Rejected,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Finished {
+    Success,
+    Failure,
+    None,
+}
+
+pub struct Client {
+    client: awc::Client,
+    base: String,
+}
+
+#[derive(Deserialize)]
+struct Controller {
+    #[serde(rename = "_links", default)]
+    links: BTreeMap<String, Link>,
+}
+
+#[derive(Deserialize)]
+struct Link {
+    href: String,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct DeploymentBase {
+    id: String,
+    deployment: DeploymentInfo,
+    #[serde(default)]
+    action_history: Option<ActionHistory>,
+}
+
+#[derive(Deserialize)]
+struct DeploymentInfo {
+    #[serde(default)]
+    chunks: Vec<Chunk>,
+}
+
+#[derive(Deserialize)]
+struct Chunk {
+    #[serde(default)]
+    artifacts: Vec<ChunkArtifact>,
+}
+
+#[derive(Deserialize)]
+struct ChunkArtifact {
+    filename: String,
+    #[serde(rename = "_links", default)]
+    links: BTreeMap<String, Link>,
+}
+
+#[derive(Deserialize)]
+struct ActionHistory {
+    #[serde(default)]
+    messages: Vec<String>,
+}
+
+#[derive(Serialize)]
+struct Feedback<'a> {
+    id: &'a str,
+    status: FeedbackStatus<'a>,
+}
+
+#[derive(Serialize)]
+struct FeedbackStatus<'a> {
+    execution: Execution,
+    result: FeedbackResult,
+    #[serde(skip_serializing_if = "<[String]>::is_empty")]
+    details: &'a [String],
+}
+
+#[derive(Serialize)]
+struct FeedbackResult {
+    finished: Finished,
+}
+
+impl Client {
+    /// Creates a client for the `controller_id` target of the tenant at
+    /// `endpoint`, as `https://hawkbit.example.com/DEFAULT`. The device is
+    /// authenticated by its target `token`, when given, or else by the
+    /// client certificate of the TLS settings.
+    pub fn new(endpoint: &str, controller_id: &str, token: Option<&str>) -> Self {
+        let mut builder = ClientBuilder::new();
+        if let Some(connector) = crate::tls::connector() {
+            builder = builder.connector(awc::Connector::new().ssl(connector).finish());
+        }
+        builder = builder.timeout(Duration::from_secs(10)).header(CONTENT_TYPE, "application/json");
+        if let Some(token) = token {
+            builder = builder.header(AUTHORIZATION, format!("TargetToken {}", token));
+        }
+        Self {
+            client: builder.finish(),
+            base: format!("{}/controller/v1/{}", endpoint.trim_end_matches('/'), controller_id),
+        }
+    }
+
+    /// Polls for the deployment the device has to handle, if any.
+    pub async fn poll(&self) -> Result<Option<Deployment>> {
+        let mut rep = self.client.get(&self.base).send().await?;
+        let controller = match rep.status() {
+            StatusCode::OK => rep.json::<Controller>().await?,
+            s => return Err(Error::InvalidStatusResponse(s)),
+        };
+        let href = match controller.links.get("deploymentBase") {
+            Some(link) => link.href.clone(),
+            None => return Ok(None),
+        };
+
+        // The history holds the feedback sent for the action.
+        let separator = if href.contains('?') { '&' } else { '?' };
+        let mut rep =
+            self.client.get(&format!("{}{}actionHistory=1", href, separator)).send().await?;
+        match rep.status() {
+            StatusCode::OK => Ok(Some(rep.json::<DeploymentBase>().await?.into())),
+            s => Err(Error::InvalidStatusResponse(s)),
+        }
+    }
+
+    /// Sends the feedback of the `action_id` deployment, along with the
+    /// `details` of it.
+    pub async fn feedback(
+        &self,
+        action_id: &str,
+        execution: Execution,
+        finished: Finished,
+        details: &[String],
+    ) -> Result<()> {
+        let rep = self
+            .client
+            .post(&format!("{}/deploymentBase/{}/feedback", self.base, action_id))
+            .send_json(&Feedback {
+                id: action_id,
+                status: FeedbackStatus { execution, result: FeedbackResult { finished }, details },
+            })
+            .await?;
+        match rep.status() {
+            s if s.is_success() => Ok(()),
+            s => Err(Error::InvalidStatusResponse(s)),
+        }
+    }
+}
+
+/// Details of the feedback sent once the deployment is accepted.
+pub fn accepted_details(accepted_at: i64) -> String {
+    format!("{}{}", ACCEPTED_MARKER, accepted_at)
+}
+
+impl From<DeploymentBase> for Deployment {
+    fn from(base: DeploymentBase) -> Self {
+        let artifacts = base
+            .deployment
+            .chunks
+            .into_iter()
+            .flat_map(|chunk| chunk.artifacts)
+            .filter_map(|artifact| {
+                let link = artifact
+                    .links
+                    .get("download")
+                    .or_else(|| artifact.links.get("download-http"))?;
+                Some(Artifact { url: link.href.clone(), filename: artifact.filename })
+            })
+            .collect();
+        let accepted_at = base.action_history.and_then(|history| {
+            history.messages.iter().find_map(|message| {
+                let index = message.find(ACCEPTED_MARKER)?;
+                message[index + ACCEPTED_MARKER.len()..]
+                    .split(|c: char| !c.is_ascii_digit())
+                    .next()?
+                    .parse()
+                    .ok()
+            })
+        });
+        Deployment { action_id: base.id, artifacts, accepted_at }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn parse_deployment() {
+        let base = serde_json::from_value::<DeploymentBase>(json!({
+            "id": "8",
+            "deployment": {
+                "download": "forced",
+                "update": "forced",
+                "chunks": [{
+                    "part": "os",
+                    "version": "1.0",
+                    "name": "firmware",
+                    "artifacts": [{
+                        "filename": "update.uhupkg",
+                        "size": 1024,
+                        "_links": {
+                            "download-http": { "href": "http://hawkbit/update.uhupkg" }
+                        }
+                    }]
+                }]
+            },
+            "actionHistory": {
+                "status": "RUNNING",
+                "messages": ["Assignment initiated by user", "updatehub accepted at 1600000000"]
+            }
+        }))
+        .unwrap();
+
+        assert_eq!(
+            Deployment::from(base),
+            Deployment {
+                action_id: "8".to_owned(),
+                artifacts: vec![Artifact {
+                    filename: "update.uhupkg".to_owned(),
+                    url: "http://hawkbit/update.uhupkg".to_owned(),
+                }],
+                accepted_at: Some(1_600_000_000),
+            }
+        );
+    }
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Client of the AWS IoT Jobs HTTPS API for devices, which the update
+//! jobs are received from and reported back to.
+
+use crate::{Error, Result};
+use awc::{
+    http::{header::CONTENT_TYPE, StatusCode},
+    ClientBuilder,
+};
+use serde::{Deserialize, Serialize};
+use std::{collections::BTreeMap, time::Duration};
+
+/// Execution of a job by the device.
+#[derive(Clone, Debug, Deserialize, PartialEq)]
+#[serde(rename_all = "camelCase")]
+pub struct JobExecution {
+    pub job_id: String,
+    pub status: JobStatus,
+    /// Document describing the job, as provided when it was created.
+    pub job_document: String,
+    /// When the execution has last been updated, in seconds since epoch.
+    pub last_updated_at: i64,
+}
+
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "SCREAMING_SNAKE_CASE")]
+pub enum JobStatus {
+    Queued,
+    InProgress,
+    Succeeded,
+    Failed,
+    Rejected,
+}
+
+pub struct Client {
+    client: awc::Client,
+    endpoint: String,
+    thing_name: String,
+}
+
+#[derive(Deserialize)]
+struct NextExecution {
+    execution: Option<JobExecution>,
+}
+
+#[derive(Serialize)]
+#[serde(rename_all = "camelCase")]
+struct UpdateExecution<'a> {
+    status: JobStatus,
+    #[serde(skip_serializing_if = "BTreeMap::is_empty")]
+    status_details: &'a BTreeMap<String, String>,
+}
+
+impl Client {
+    /// Creates a client for the `thing_name` jobs, using the client
+    /// certificate of the TLS settings to authenticate the device.
+    pub fn new(endpoint: &str, thing_name: &str) -> Self {
+        let mut builder = ClientBuilder::new();
+        if let Some(connector) = crate::tls::connector() {
+            builder = builder.connector(awc::Connector::new().ssl(connector).finish());
+        }
+        let client = builder
+            .timeout(Duration::from_secs(10))
+            .header(CONTENT_TYPE, "application/json")
+            .finish();
+        Self {
+            client,
+            endpoint: endpoint.trim_end_matches('/').to_owned(),
+            thing_name: thing_name.to_owned(),
+        }
+    }
+
+    /// Gets the next job execution the device has to handle, being either
+    /// queued or already in progress.
+    pub async fn next(&self) -> Result<Option<JobExecution>> {
+        let mut rep = self
+            .client
+            .get(&format!("{}/things/{}/jobs/$next", self.endpoint, self.thing_name))
+            .send()
+            .await?;
+        match rep.status() {
+            StatusCode::OK => Ok(rep.json::<NextExecution>().await?.execution),
+            s => Err(Error::InvalidStatusResponse(s)),
+        }
+    }
+
+    /// Updates the status of the `job_id` execution, along with the
+    /// `details` of it.
+    pub async fn update(
+        &self,
+        job_id: &str,
+        status: JobStatus,
+        details: &BTreeMap<String, String>,
+    ) -> Result<()> {
+        let rep = self
+            .client
+            .post(&format!("{}/things/{}/jobs/{}", self.endpoint, self.thing_name, job_id))
+            .send_json(&UpdateExecution { status, status_details: details })
+            .await?;
+        match rep.status() {
+            s if s.is_success() => Ok(()),
+            s => Err(Error::InvalidStatusResponse(s)),
+        }
+    }
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Keys kept in hardware tokens, so they are never stored as files. The
+//! keys are loaded through the OpenSSL engines, being referred to as:
+//!
+//! - `pkcs11:...`: RFC 7512 URI of an object of a PKCS#11 token, loaded through
+//!   the `pkcs11` engine;
+//! - `tpm2:<key>`: TPM 2.0 key, as its persistent handle or the path of its key
+//!   blob, loaded through the `tpm2tss` engine.
+
+use crate::{Error, Result};
+use foreign_types::ForeignType;
+use lazy_static::lazy_static;
+use openssl::pkey::{PKey, Private, Public};
+use slog_scope::debug;
+use std::{
+    ffi::CString,
+    os::raw::{c_char, c_int, c_void},
+    ptr,
+    sync::RwLock,
+};
+
+const PKCS11_URI_PREFIX: &str = "pkcs11:";
+const TPM2_URI_PREFIX: &str = "tpm2:";
+
+lazy_static! {
+    static ref PIN: RwLock<Option<String>> = RwLock::new(None);
+}
+
+/// Sets the `pin` the tokens are unlocked with, as the user PIN of the
+/// PKCS#11 token or the authorization value of the TPM keys. A PIN in
+/// the PKCS#11 URI takes precedence over it.
+pub fn configure_token_pin(pin: Option<String>) {
+    *PIN.write().expect("poisoned token pin lock") = pin;
+}
+
+/// Whether the `key` refers to a key kept in a token, instead of a file.
+pub fn is_token_uri(key: &str) -> bool {
+    key.starts_with(PKCS11_URI_PREFIX) || key.starts_with(TPM2_URI_PREFIX)
+}
+
+pub(crate) fn load_private_key(uri: &str) -> Result<PKey<Private>> {
+    debug!("loading private key from token: {}", uri);
+    let key = load(uri, |engine, key_id| unsafe {
+        ENGINE_load_private_key(engine, key_id, ptr::null_mut(), ptr::null_mut())
+    })?;
+    Ok(unsafe { PKey::from_ptr(key) })
+}
+
+pub(crate) fn load_public_key(uri: &str) -> Result<PKey<Public>> {
+    debug!("loading public key from token: {}", uri);
+    let key = load(uri, |engine, key_id| unsafe {
+        ENGINE_load_public_key(engine, key_id, ptr::null_mut(), ptr::null_mut())
+    })?;
+    Ok(unsafe { PKey::from_ptr(key) })
+}
+
+// The engine is only kept while the key is loaded, as the key holds its
+// own reference to it.
+fn load(
+    uri: &str,
+    load_key: impl FnOnce(*mut c_void, *const c_char) -> *mut openssl_sys::EVP_PKEY,
+) -> Result<*mut openssl_sys::EVP_PKEY> {
+    let (engine_id, key_id) = if uri.starts_with(TPM2_URI_PREFIX) {
+        ("tpm2tss", &uri[TPM2_URI_PREFIX.len()..])
+    } else {
+        ("pkcs11", uri)
+    };
+    let engine_id = CString::new(engine_id).expect("engine id has no nul byte");
+    let key_id = CString::new(key_id).map_err(|_| Error::InvalidKeyUri)?;
+    let pin = PIN
+        .read()
+        .expect("poisoned token pin lock")
+        .as_deref()
+        .map(CString::new)
+        .transpose()
+        .map_err(|_| Error::InvalidKeyUri)?;
+
+    unsafe {
+        let engine = ENGINE_by_id(engine_id.as_ptr());
+        if engine.is_null() {
+            return Err(openssl::error::ErrorStack::get().into());
+        }
+        if ENGINE_init(engine) == 0 {
+            ENGINE_free(engine);
+            return Err(openssl::error::ErrorStack::get().into());
+        }
+
+        // The engines not taking the PIN command ignore it.
+        if let Some(pin) = pin {
+            let cmd = CString::new("PIN").expect("command has no nul byte");
+            ENGINE_ctrl_cmd_string(engine, cmd.as_ptr(), pin.as_ptr(), 1);
+        }
+
+        let key = load_key(engine, key_id.as_ptr());
+        ENGINE_finish(engine);
+        ENGINE_free(engine);
+        if key.is_null() {
+            return Err(openssl::error::ErrorStack::get().into());
+        }
+        Ok(key)
+    }
+}
+
+// The engine API is not covered by the openssl crate, so it is used
+// directly from libcrypto.
+extern "C" {
+    fn ENGINE_by_id(id: *const c_char) -> *mut c_void;
+    fn ENGINE_init(e: *mut c_void) -> c_int;
+    fn ENGINE_finish(e: *mut c_void) -> c_int;
+    fn ENGINE_free(e: *mut c_void) -> c_int;
+    fn ENGINE_ctrl_cmd_string(
+        e: *mut c_void,
+        cmd_name: *const c_char,
+        arg: *const c_char,
+        cmd_optional: c_int,
+    ) -> c_int;
+    fn ENGINE_load_private_key(
+        e: *mut c_void,
+        key_id: *const c_char,
+        ui_method: *mut c_void,
+        callback_data: *mut c_void,
+    ) -> *mut openssl_sys::EVP_PKEY;
+    fn ENGINE_load_public_key(
+        e: *mut c_void,
+        key_id: *const c_char,
+        ui_method: *mut c_void,
+        callback_data: *mut c_void,
+    ) -> *mut openssl_sys::EVP_PKEY;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn token_uris() {
+        assert!(is_token_uri("pkcs11:object=device;type=private"));
+        assert!(is_token_uri("tpm2:0x81000001"));
+        assert!(!is_token_uri("/etc/updatehub/key.pem"));
+        assert!(load_private_key("tpm2:0x81\0").is_err());
+    }
+}
@@ -4,8 +4,26 @@
 
 pub mod api;
 mod client;
+pub mod hawkbit;
+pub mod jobs;
+mod keystore;
+pub mod net;
+mod proxy;
+pub mod push;
+mod rate_limit;
+mod report;
+mod tls;
+mod traffic;
 
-pub use client::{get, Client};
+pub use client::{
+    acquire_lock, configure_credentials, get, notify, release_lock, request_takeover, Client,
+};
+pub use keystore::{configure_token_pin, is_token_uri};
+pub use proxy::configure_proxy;
+pub use rate_limit::RateLimit;
+pub use report::{report_support, Encoding, ReportSupport};
+pub use tls::{configure_tls, Revocation};
+pub use traffic::{take_traffic, Traffic};
 
 use derive_more::{Display, Error, From};
 
@@ -15,8 +33,24 @@ pub type Result<T> = std::result::Result<T, Error>;
 pub enum Error {
     #[display("Package's signature validation has failed")]
     InvalidSignature,
+    #[display("No public key has been found in the key file")]
+    MissingPublicKey,
     #[display("Http response is missing Content Length")]
     MissingContentLength,
+    #[display("Object {} doesn't match its sha256sum", _0)]
+    #[from(ignore)]
+    ChecksumMismatch(#[error(not(source))] String),
+    #[display("Key URI, or the token PIN, has a nul byte")]
+    InvalidKeyUri,
+    #[display("Proxy {} is invalid, or of an unsupported protocol", _0)]
+    #[from(ignore)]
+    InvalidProxy(#[error(not(source))] String),
+    #[display("MQTT error: {}", _0)]
+    #[from(ignore)]
+    Mqtt(#[error(not(source))] String),
+    #[display("Server is busy, asking to retry after {:?}", _0)]
+    #[from(ignore)]
+    RetryAfter(#[error(not(source))] std::time::Duration),
 
     Io(std::io::Error),
     JsonParsing(serde_json::Error),
@@ -35,3 +69,19 @@ pub enum Error {
     InvalidHeader(awc::http::header::InvalidHeaderValue),
     NonStrHeader(awc::http::header::ToStrError),
 }
+
+impl Error {
+    /// Whether the request may succeed if retried, as for network and
+    /// server errors. Client errors (4xx) are not transient.
+    pub fn is_transient(&self) -> bool {
+        match self {
+            Error::InvalidStatusResponse(s) => !s.is_client_error(),
+            Error::SendRequestError(_)
+            | Error::ConnectError(_)
+            | Error::PayloadError(_)
+            | Error::MissingContentLength
+            | Error::RetryAfter(_) => true,
+            _ => false,
+        }
+    }
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Connections to hosts which may only be reachable through one of the
+//! address families, as on IPv6-only networks.
+
+use std::{
+    io,
+    net::{SocketAddr, TcpStream, ToSocketAddrs},
+    num::ParseIntError,
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        mpsc, Arc,
+    },
+    thread,
+    time::Duration,
+};
+
+/// Delay before the next address is tried, while the previous attempts
+/// are still pending, as recommended by RFC 8305.
+const ATTEMPT_DELAY: Duration = Duration::from_millis(250);
+
+/// Splits the `address`, as `host:port`, `[2001:db8::1]:port` or a bare
+/// host, into its host, without brackets, and port.
+pub fn split_host_port(address: &str, default_port: u16) -> Result<(&str, u16), ParseIntError> {
+    if address.starts_with('[') {
+        return match address[1..].splitn(2, ']').collect::<Vec<_>>()[..] {
+            [host, ""] => Ok((host, default_port)),
+            [host, port] => Ok((host, port.trim_start_matches(':').parse()?)),
+            _ => Ok((address, default_port)),
+        };
+    }
+
+    match address.rsplitn(2, ':').collect::<Vec<_>>()[..] {
+        // Unbracketed IPv6 literals have no port.
+        [_, host] if host.contains(':') => Ok((address, default_port)),
+        [port, host] => Ok((host, port.parse()?)),
+        _ => Ok((address, default_port)),
+    }
+}
+
+/// Resolves the `host`, alternating the address families, starting from
+/// IPv6, so a family which isn't routed doesn't delay the other.
+pub fn resolve(host: &str, port: u16) -> io::Result<Vec<SocketAddr>> {
+    let (v6, v4): (Vec<_>, Vec<_>) = (host, port).to_socket_addrs()?.partition(SocketAddr::is_ipv6);
+    let mut addrs = Vec::with_capacity(v6.len() + v4.len());
+    let (mut v6, mut v4) = (v6.into_iter(), v4.into_iter());
+    loop {
+        match (v6.next(), v4.next()) {
+            (None, None) => break,
+            (a, b) => addrs.extend(a.into_iter().chain(b)),
+        }
+    }
+
+    if addrs.is_empty() {
+        return Err(io::Error::new(
+            io::ErrorKind::NotFound,
+            format!("no address found for {}", host),
+        ));
+    }
+    Ok(addrs)
+}
+
+/// Connects to the `host` racing its addresses, as happy eyeballs does:
+/// each address is tried shortly after the previous one, without waiting
+/// for it to fail, and the first connection established is taken.
+pub fn connect(host: &str, port: u16, timeout: Duration) -> io::Result<TcpStream> {
+    let addrs = resolve(host, port)?;
+    let connected = Arc::new(AtomicBool::new(false));
+    let (tx, rx) = mpsc::channel();
+    for (i, addr) in addrs.iter().cloned().enumerate() {
+        let (tx, connected) = (tx.clone(), connected.clone());
+        thread::spawn(move || {
+            thread::sleep(ATTEMPT_DELAY * i as u32);
+            if connected.load(Ordering::Relaxed) {
+                return;
+            }
+            let _ = tx.send(TcpStream::connect_timeout(&addr, timeout));
+        });
+    }
+    drop(tx);
+
+    let mut last_error = None;
+    for res in rx {
+        match res {
+            Ok(stream) => {
+                connected.store(true, Ordering::Relaxed);
+                return Ok(stream);
+            }
+            Err(e) => last_error = Some(e),
+        }
+    }
+    Err(last_error.unwrap_or_else(|| io::Error::from(io::ErrorKind::NotConnected)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::TcpListener;
+
+    #[test]
+    fn host_and_port() {
+        assert_eq!(split_host_port("example.com:8883", 1883), Ok(("example.com", 8883)));
+        assert_eq!(split_host_port("example.com", 1883), Ok(("example.com", 1883)));
+        assert_eq!(split_host_port("[2001:db8::1]:8883", 1883), Ok(("2001:db8::1", 8883)));
+        assert_eq!(split_host_port("[2001:db8::1]", 1883), Ok(("2001:db8::1", 1883)));
+        assert_eq!(split_host_port("2001:db8::1", 1883), Ok(("2001:db8::1", 1883)));
+        assert!(split_host_port("example.com:port", 1883).is_err());
+    }
+
+    #[test]
+    fn alternating_families() {
+        let addrs = resolve("::1", 80).unwrap();
+        assert_eq!(addrs, vec!["[::1]:80".parse().unwrap()]);
+        assert!(resolve("127.0.0.1", 80).unwrap().iter().all(SocketAddr::is_ipv4));
+    }
+
+    #[test]
+    fn connect_to_listener() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let port = listener.local_addr().unwrap().port();
+
+        let stream = connect("127.0.0.1", port, Duration::from_secs(1)).unwrap();
+        assert_eq!(stream.peer_addr().unwrap(), listener.local_addr().unwrap());
+    }
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::{net, tls, Error, Result};
+use openssl::ssl::{SslConnector, SslMethod};
+use slog_scope::debug;
+use std::{
+    io::{self, Read, Write},
+    time::{Duration, Instant},
+};
+
+const CONNECT: u8 = 0x10;
+const CONNACK: u8 = 0x20;
+const PUBLISH: u8 = 0x30;
+const SUBSCRIBE: u8 = 0x82;
+const SUBACK: u8 = 0x90;
+const PINGREQ: u8 = 0xc0;
+const PINGRESP: u8 = 0xd0;
+
+const MQTT_PORT: u16 = 1883;
+const MQTTS_PORT: u16 = 8883;
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+
+trait Stream: Read + Write + Send {}
+impl<T: Read + Write + Send> Stream for T {}
+
+/// Subscription to a topic of a MQTT broker, through which the server
+/// pushes its notifications.
+///
+/// Only what the agent needs of MQTT 3.1.1 is implemented: the messages
+/// are received at QoS 0, with a clean session, so the ones published
+/// while disconnected are lost.
+pub struct Subscription {
+    stream: Box<dyn Stream>,
+    keep_alive: Duration,
+    last_sent: Instant,
+}
+
+impl Subscription {
+    /// Connects to the `broker`, as `mqtt://host[:port]` or
+    /// `mqtts://host[:port]`, subscribing to the `topic`. The TLS
+    /// connections use the TLS settings of the server, when configured.
+    pub fn connect(
+        broker: &str,
+        client_id: &str,
+        topic: &str,
+        keep_alive: Duration,
+    ) -> Result<Self> {
+        let (secure, address) = match broker.splitn(2, "://").collect::<Vec<_>>()[..] {
+            ["mqtts", address] => (true, address),
+            ["mqtt", address] => (false, address),
+            _ => return Err(Error::Mqtt(format!("unsupported broker address: {}", broker))),
+        };
+        let (host, port) =
+            net::split_host_port(address, if secure { MQTTS_PORT } else { MQTT_PORT })?;
+
+        debug!("connecting to mqtt broker {}", broker);
+        let tcp = net::connect(host, port, CONNECT_TIMEOUT)?;
+        // Woken up in time to keep the connection alive while idle.
+        tcp.set_read_timeout(Some(keep_alive / 2))?;
+        let stream: Box<dyn Stream> = if secure {
+            let connector = match tls::connector() {
+                Some(connector) => connector,
+                None => SslConnector::builder(SslMethod::tls())?.build(),
+            };
+            Box::new(
+                connector
+                    .connect(host, tcp)
+                    .map_err(|e| Error::Mqtt(format!("tls handshake has failed: {}", e)))?,
+            )
+        } else {
+            Box::new(tcp)
+        };
+
+        let mut subscription = Subscription { stream, keep_alive, last_sent: Instant::now() };
+        subscription.handshake(client_id, topic)?;
+        Ok(subscription)
+    }
+
+    /// Waits for the next message published to the topic, returning its
+    /// payload.
+    pub fn next_message(&mut self) -> Result<Vec<u8>> {
+        loop {
+            let (header, body) = match self.read_packet() {
+                Ok(packet) => packet,
+                Err(Error::Io(e))
+                    if e.kind() == io::ErrorKind::WouldBlock
+                        || e.kind() == io::ErrorKind::TimedOut =>
+                {
+                    if self.last_sent.elapsed() >= self.keep_alive / 2 {
+                        self.send(PINGREQ, &[])?;
+                    }
+                    continue;
+                }
+                Err(e) => return Err(e),
+            };
+
+            match header & 0xf0 {
+                PUBLISH => return publish_payload(header, &body),
+                PINGRESP => {}
+                _ => debug!("ignoring mqtt packet {:#x}", header),
+            }
+        }
+    }
+
+    fn handshake(&mut self, client_id: &str, topic: &str) -> Result<()> {
+        let mut connect = Vec::new();
+        put_string(&mut connect, "MQTT");
+        // Protocol level 4, with a clean session.
+        connect.extend_from_slice(&[4, 0x02]);
+        connect.extend_from_slice(&(self.keep_alive.as_secs() as u16).to_be_bytes());
+        put_string(&mut connect, client_id);
+        self.send(CONNECT, &connect)?;
+        match self.read_packet()? {
+            (CONNACK, body) if body.len() == 2 && body[1] == 0 => {}
+            (CONNACK, body) => {
+                return Err(Error::Mqtt(format!(
+                    "connection refused with code {}",
+                    body.get(1).copied().unwrap_or_default()
+                )))
+            }
+            (header, _) => return Err(Error::Mqtt(format!("unexpected packet {:#x}", header))),
+        }
+
+        let mut subscribe = vec![0, 1];
+        put_string(&mut subscribe, topic);
+        subscribe.push(0);
+        self.send(SUBSCRIBE, &subscribe)?;
+        match self.read_packet()? {
+            (SUBACK, body) if body.len() == 3 && body[2] != 0x80 => Ok(()),
+            (SUBACK, _) => Err(Error::Mqtt(format!("subscription to {} refused", topic))),
+            (header, _) => Err(Error::Mqtt(format!("unexpected packet {:#x}", header))),
+        }
+    }
+
+    fn send(&mut self, header: u8, body: &[u8]) -> Result<()> {
+        let mut packet = vec![header];
+        put_length(&mut packet, body.len());
+        packet.extend_from_slice(body);
+        self.stream.write_all(&packet)?;
+        self.last_sent = Instant::now();
+        Ok(())
+    }
+
+    fn read_packet(&mut self) -> Result<(u8, Vec<u8>)> {
+        let mut byte = [0];
+        self.stream.read_exact(&mut byte)?;
+        let header = byte[0];
+
+        let (mut length, mut shift) = (0, 0);
+        loop {
+            self.stream.read_exact(&mut byte)?;
+            length |= usize::from(byte[0] & 0x7f) << shift;
+            if byte[0] & 0x80 == 0 {
+                break;
+            }
+            shift += 7;
+            if shift > 21 {
+                return Err(Error::Mqtt("malformed packet length".to_owned()));
+            }
+        }
+
+        let mut body = vec![0; length];
+        self.stream.read_exact(&mut body)?;
+        Ok((header, body))
+    }
+}
+
+fn publish_payload(header: u8, body: &[u8]) -> Result<Vec<u8>> {
+    let malformed = || Error::Mqtt("malformed publish packet".to_owned());
+    let topic_len = usize::from(u16::from_be_bytes([
+        *body.get(0).ok_or_else(malformed)?,
+        *body.get(1).ok_or_else(malformed)?,
+    ]));
+    // The packet id is only present for QoS above 0.
+    let offset = 2 + topic_len + if header & 0x06 != 0 { 2 } else { 0 };
+    body.get(offset..).map(<[u8]>::to_vec).ok_or_else(malformed)
+}
+
+fn put_string(buf: &mut Vec<u8>, s: &str) {
+    buf.extend_from_slice(&(s.len() as u16).to_be_bytes());
+    buf.extend_from_slice(s.as_bytes());
+}
+
+fn put_length(buf: &mut Vec<u8>, mut length: usize) {
+    loop {
+        let mut byte = (length % 128) as u8;
+        length /= 128;
+        if length > 0 {
+            byte |= 0x80;
+        }
+        buf.push(byte);
+        if length == 0 {
+            break;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::net::TcpListener;
+
+    #[test]
+    fn encode_length() {
+        let mut buf = Vec::new();
+        put_length(&mut buf, 321);
+        assert_eq!(buf, vec![0xc1, 0x02]);
+    }
+
+    #[test]
+    fn receive_message() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let broker = format!("mqtt://{}", listener.local_addr().unwrap());
+        std::thread::spawn(move || {
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut buf = [0; 256];
+            let _ = stream.read(&mut buf).unwrap();
+            stream.write_all(&[CONNACK, 2, 0, 0]).unwrap();
+            let _ = stream.read(&mut buf).unwrap();
+            stream.write_all(&[SUBACK, 3, 0, 1, 0]).unwrap();
+
+            let mut publish = vec![PUBLISH, 0];
+            put_string(&mut publish, "updates");
+            publish.extend_from_slice(b"probe");
+            publish[1] = (publish.len() - 2) as u8;
+            stream.write_all(&publish).unwrap();
+        });
+
+        let mut subscription =
+            Subscription::connect(&broker, "device", "updates", Duration::from_secs(60)).unwrap();
+        assert_eq!(subscription.next_message().unwrap(), b"probe");
+    }
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use std::sync::{
+    atomic::{AtomicU64, Ordering},
+    Arc,
+};
+
+/// Download rate limit, in bytes per second. It can be changed while
+/// the downloads using it are running, as when a scheduled window
+/// starts or ends.
+#[derive(Clone, Debug)]
+pub struct RateLimit {
+    // Zero stands for no limit.
+    rate: Arc<AtomicU64>,
+    shares: u64,
+}
+
+impl RateLimit {
+    pub fn new(rate: Option<u64>) -> Self {
+        RateLimit { rate: Arc::new(AtomicU64::new(rate.unwrap_or(0))), shares: 1 }
+    }
+
+    /// Changes the rate of all the downloads using it.
+    pub fn set(&self, rate: Option<u64>) {
+        self.rate.store(rate.unwrap_or(0), Ordering::Relaxed);
+    }
+
+    /// Rate allowed to each of the downloads sharing it, which is never
+    /// rounded down to no limit.
+    pub fn get(&self) -> Option<u64> {
+        match self.rate.load(Ordering::Relaxed) {
+            0 => None,
+            rate => Some((rate + self.shares - 1) / self.shares),
+        }
+    }
+
+    /// Splits the rate among `shares` concurrent downloads, which follow
+    /// the changes made to it.
+    pub fn shared_by(&self, shares: usize) -> Self {
+        RateLimit { rate: self.rate.clone(), shares: self.shares * std::cmp::max(shares, 1) as u64 }
+    }
+}
+
+impl Default for RateLimit {
+    fn default() -> Self {
+        RateLimit::new(None)
+    }
+}
+
+impl From<Option<u64>> for RateLimit {
+    fn from(rate: Option<u64>) -> Self {
+        RateLimit::new(rate)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn shared_rate() {
+        let rate_limit = RateLimit::new(Some(10));
+        let shared = rate_limit.shared_by(3);
+        assert_eq!(shared.get(), Some(4));
+
+        rate_limit.set(Some(2));
+        assert_eq!(shared.get(), Some(1));
+
+        rate_limit.set(None);
+        assert_eq!(shared.get(), None);
+    }
+}
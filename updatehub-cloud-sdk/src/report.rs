@@ -0,0 +1,152 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::Result;
+use awc::http::header::HeaderMap;
+use flate2::{write::GzEncoder, Compression};
+use lazy_static::lazy_static;
+use std::{io::Write, sync::Mutex};
+
+const API_REPORT_ENCODING: &str = "api-report-encoding";
+const API_REPORT_BATCH: &str = "api-report-batch";
+
+lazy_static! {
+    // Only known once the server is probed, so the reports are sent as
+    // plain json, one by one, until then.
+    static ref SUPPORT: Mutex<ReportSupport> = Mutex::default();
+    static ref PENDING: Mutex<Batch> = Mutex::default();
+}
+
+/// Encoding the report bodies are compressed with.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Encoding {
+    Gzip,
+}
+
+impl Encoding {
+    fn parse(name: &str) -> Option<Self> {
+        match name.trim() {
+            "gzip" => Some(Encoding::Gzip),
+            _ => None,
+        }
+    }
+
+    pub(crate) fn name(self) -> &'static str {
+        match self {
+            Encoding::Gzip => "gzip",
+        }
+    }
+
+    pub(crate) fn encode(self, body: &[u8]) -> Result<Vec<u8>> {
+        match self {
+            Encoding::Gzip => {
+                let mut encoder = GzEncoder::new(Vec::new(), Compression::default());
+                encoder.write_all(body)?;
+                Ok(encoder.finish()?)
+            }
+        }
+    }
+}
+
+/// How the server accepts the reports, as advertised on the probe
+/// response.
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+pub struct ReportSupport {
+    pub encoding: Option<Encoding>,
+    /// Reports sent at once, when the server accepts them in batches.
+    pub batch_size: usize,
+}
+
+impl ReportSupport {
+    pub(crate) fn from_headers(headers: &HeaderMap) -> Self {
+        let header = |name| headers.get(name).and_then(|value| value.to_str().ok());
+        ReportSupport {
+            // The encodings are listed in the server preference order.
+            encoding: header(API_REPORT_ENCODING)
+                .and_then(|encodings| encodings.split(',').find_map(Encoding::parse)),
+            batch_size: header(API_REPORT_BATCH).and_then(|size| size.parse().ok()).unwrap_or(0),
+        }
+    }
+}
+
+/// How the server has last advertised to accept the reports.
+pub fn report_support() -> ReportSupport {
+    *SUPPORT.lock().unwrap()
+}
+
+pub(crate) fn set_report_support(support: ReportSupport) {
+    *SUPPORT.lock().unwrap() = support;
+}
+
+/// Queues the report to be sent in a batch, returning the batch once
+/// it is full, or right away when it is to be flushed.
+pub(crate) fn queue_report(
+    report: serde_json::Value,
+    batch_size: usize,
+    flush: bool,
+) -> Option<Vec<serde_json::Value>> {
+    PENDING.lock().unwrap().push(report, batch_size, flush)
+}
+
+#[derive(Debug, Default)]
+struct Batch(Vec<serde_json::Value>);
+
+impl Batch {
+    fn push(
+        &mut self,
+        report: serde_json::Value,
+        size: usize,
+        flush: bool,
+    ) -> Option<Vec<serde_json::Value>> {
+        self.0.push(report);
+        if flush || self.0.len() >= size {
+            return Some(std::mem::take(&mut self.0));
+        }
+        None
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use awc::http::header::{HeaderName, HeaderValue};
+    use flate2::read::GzDecoder;
+    use serde_json::json;
+    use std::io::Read;
+
+    #[test]
+    fn parse_support() {
+        let mut headers = HeaderMap::new();
+        assert_eq!(ReportSupport::from_headers(&headers), ReportSupport::default());
+
+        headers.insert(
+            HeaderName::from_static(API_REPORT_ENCODING),
+            HeaderValue::from_static("zstd, gzip"),
+        );
+        headers.insert(HeaderName::from_static(API_REPORT_BATCH), HeaderValue::from_static("8"));
+        assert_eq!(
+            ReportSupport::from_headers(&headers),
+            ReportSupport { encoding: Some(Encoding::Gzip), batch_size: 8 }
+        );
+    }
+
+    #[test]
+    fn gzip_encoding() {
+        let body = br#"{"status":"downloading"}"#;
+        let encoded = Encoding::Gzip.encode(body).unwrap();
+        let mut decoded = Vec::new();
+        GzDecoder::new(&encoded[..]).read_to_end(&mut decoded).unwrap();
+        assert_eq!(decoded, &body[..]);
+    }
+
+    #[test]
+    fn batch_reports() {
+        let mut batch = Batch::default();
+        assert_eq!(batch.push(json!(1), 3, false), None);
+        assert_eq!(batch.push(json!(2), 3, false), None);
+        assert_eq!(batch.push(json!(3), 3, false), Some(vec![json!(1), json!(2), json!(3)]));
+        assert_eq!(batch.push(json!(4), 3, true), Some(vec![json!(4)]));
+        assert!(batch.0.is_empty());
+    }
+}
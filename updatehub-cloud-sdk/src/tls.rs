@@ -0,0 +1,325 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::{keystore, Result};
+use foreign_types::ForeignTypeRef;
+use lazy_static::lazy_static;
+use openssl::{
+    hash::MessageDigest,
+    ocsp::{OcspCertId, OcspCertStatus, OcspFlag, OcspResponse, OcspResponseStatus},
+    ssl::{SslConnector, SslConnectorBuilder, SslFiletype, SslMethod, SslRef, SslVerifyMode},
+    x509::X509StoreContextRef,
+};
+use slog_scope::{error, info};
+use std::{
+    os::raw::{c_int, c_long, c_ulong},
+    path::{Path, PathBuf},
+    ptr,
+    sync::RwLock,
+    time::SystemTime,
+};
+
+// Leeway for the clock skew when checking the OCSP response validity.
+const OCSP_MAX_SKEW_SECS: u32 = 300;
+
+/// How the revocation of the server certificate chain is checked.
+#[derive(Clone, Debug, Default)]
+pub struct Revocation {
+    /// PEM file with the CRLs of every CA in the server chain, which is
+    /// rejected if any of its certificates has been revoked.
+    pub crl_file: Option<PathBuf>,
+    /// Require the server to staple a valid OCSP response, attesting its
+    /// certificate has not been revoked.
+    pub require_ocsp_stapling: bool,
+}
+
+lazy_static! {
+    static ref TLS: RwLock<Option<Tls>> = RwLock::new(None);
+}
+
+// Files the connector is built from, so it is rebuilt when they are
+// replaced by the certificate rotation.
+#[derive(Clone, Debug)]
+struct Config {
+    ca_bundle: Option<PathBuf>,
+    identity: Option<(PathBuf, String)>,
+    pinned_public_keys: Vec<String>,
+    revocation: Revocation,
+}
+
+struct Tls {
+    config: Config,
+    stamps: Vec<Option<SystemTime>>,
+    connector: SslConnector,
+}
+
+/// Configures the TLS connections to the server.
+///
+/// The `ca_bundle` is used to verify the server certificate, instead of
+/// the system CA store.
+///
+/// The `identity` is the client certificate, and its private key,
+/// presented by the device. The key is either a file path or the URI of
+/// a key kept in a PKCS#11 token or in the TPM.
+///
+/// When `pinned_public_keys` is not empty, the server is only trusted if
+/// its certificate chain has a certificate whose SubjectPublicKeyInfo
+/// sha256sum, in hex, is one of them.
+///
+/// The `revocation` sets how the revocation of the server certificates
+/// is checked, besides the chain verification.
+///
+/// The files are reloaded once they change, before the next request, so
+/// the certificates can be rotated without restarting the agent.
+pub fn configure_tls(
+    ca_bundle: Option<&Path>,
+    identity: Option<(&Path, &str)>,
+    pinned_public_keys: &[String],
+    revocation: &Revocation,
+) -> Result<()> {
+    let config = Config {
+        ca_bundle: ca_bundle.map(Path::to_owned),
+        identity: identity.map(|(certificate, key)| (certificate.to_owned(), key.to_owned())),
+        pinned_public_keys: pinned_public_keys.iter().map(|p| p.to_lowercase()).collect(),
+        revocation: revocation.clone(),
+    };
+    let stamps = config.stamps();
+    let connector = config.build()?;
+
+    *TLS.write().expect("poisoned tls connector lock") = Some(Tls { config, stamps, connector });
+    Ok(())
+}
+
+pub(crate) fn connector() -> Option<SslConnector> {
+    let mut tls = TLS.write().expect("poisoned tls connector lock");
+    let tls = tls.as_mut()?;
+
+    let stamps = tls.config.stamps();
+    if stamps != tls.stamps {
+        info!("tls certificates have changed, reloading them");
+        match tls.config.build() {
+            Ok(connector) => {
+                tls.connector = connector;
+                tls.stamps = stamps;
+            }
+            // The files may be halfway replaced, so the previous connector
+            // is kept and they are reloaded again on the next request.
+            Err(e) => error!("failed to reload tls certificates, keeping the previous ones: {}", e),
+        }
+    }
+
+    Some(tls.connector.clone())
+}
+
+impl Config {
+    fn files(&self) -> Vec<&Path> {
+        let mut files = Vec::new();
+        if let Some(ca_bundle) = &self.ca_bundle {
+            files.push(ca_bundle.as_path());
+        }
+        if let Some((certificate, key)) = &self.identity {
+            files.push(certificate.as_path());
+            if !keystore::is_token_uri(key) {
+                files.push(Path::new(key));
+            }
+        }
+        if let Some(crl_file) = &self.revocation.crl_file {
+            files.push(crl_file.as_path());
+        }
+        files
+    }
+
+    fn stamps(&self) -> Vec<Option<SystemTime>> {
+        self.files().into_iter().map(|f| f.metadata().and_then(|m| m.modified()).ok()).collect()
+    }
+
+    fn build(&self) -> Result<SslConnector> {
+        let mut builder = SslConnector::builder(SslMethod::tls())?;
+        if let Some(ca_bundle) = &self.ca_bundle {
+            builder.set_ca_file(ca_bundle)?;
+        }
+        if let Some((certificate, key)) = &self.identity {
+            builder.set_certificate_chain_file(certificate)?;
+            if keystore::is_token_uri(key) {
+                info!("loading client key from token");
+                builder.set_private_key(&keystore::load_private_key(key)?)?;
+            } else {
+                builder.set_private_key_file(key, SslFiletype::PEM)?;
+            }
+            builder.check_private_key()?;
+        }
+        if !self.pinned_public_keys.is_empty() {
+            let pins = self.pinned_public_keys.clone();
+            builder.set_verify_callback(SslVerifyMode::PEER, move |preverify_ok, ctx| {
+                // The chain is only complete once the leaf is verified.
+                if !preverify_ok || ctx.error_depth() != 0 {
+                    return preverify_ok;
+                }
+                is_pinned(ctx, &pins)
+            });
+        }
+        if let Some(crl_file) = &self.revocation.crl_file {
+            enable_crl_check(&mut builder, crl_file)?;
+        }
+        if self.revocation.require_ocsp_stapling {
+            require_ocsp_stapling(&mut builder)?;
+        }
+        builder.set_alpn_protos(b"\x02h2\x08http/1.1")?;
+
+        Ok(builder.build())
+    }
+}
+
+fn enable_crl_check(builder: &mut SslConnectorBuilder, crl_file: &Path) -> Result<()> {
+    // The CRLs in the file are added to the certificate store along with
+    // the trusted certificates.
+    builder.set_ca_file(crl_file)?;
+    unsafe {
+        if X509_STORE_set_flags(
+            builder.cert_store_mut().as_ptr(),
+            X509_V_FLAG_CRL_CHECK | X509_V_FLAG_CRL_CHECK_ALL,
+        ) == 0
+        {
+            return Err(openssl::error::ErrorStack::get().into());
+        }
+    }
+    Ok(())
+}
+
+fn require_ocsp_stapling(builder: &mut SslConnectorBuilder) -> Result<()> {
+    unsafe {
+        openssl_sys::SSL_CTX_ctrl(
+            builder.as_ptr(),
+            SSL_CTRL_SET_TLSEXT_STATUS_REQ_TYPE,
+            TLSEXT_STATUSTYPE_OCSP,
+            ptr::null_mut(),
+        );
+    }
+    builder.set_status_callback(|ssl| Ok(is_ocsp_good(ssl)))?;
+    Ok(())
+}
+
+// Checks the stapled OCSP response is valid and attests the server
+// certificate is good.
+fn is_ocsp_good(ssl: &mut SslRef) -> bool {
+    let response = match ssl.ocsp_status().map(OcspResponse::from_der) {
+        Some(Ok(response)) => response,
+        Some(Err(e)) => {
+            error!("invalid stapled ocsp response: {}", e);
+            return false;
+        }
+        None => {
+            error!("server has not stapled an ocsp response");
+            return false;
+        }
+    };
+    if response.status() != OcspResponseStatus::SUCCESSFUL {
+        error!("stapled ocsp response is not successful");
+        return false;
+    }
+
+    let (chain, store) = match (ssl.peer_cert_chain(), ssl.ssl_context().cert_store()) {
+        (Some(chain), store) if chain.len() > 1 => (chain, store),
+        _ => {
+            error!("server certificate chain has no issuer to check the ocsp response");
+            return false;
+        }
+    };
+    let status = response.basic().and_then(|basic| {
+        basic.verify(chain, store, OcspFlag::empty())?;
+        let id = OcspCertId::from_cert(MessageDigest::sha1(), &chain[0], &chain[1])?;
+        Ok(basic.find_status(&id).map(|status| {
+            status.status == OcspCertStatus::GOOD
+                && status.check_validity(OCSP_MAX_SKEW_SECS, None).is_ok()
+        }))
+    });
+
+    match status {
+        Ok(Some(true)) => true,
+        Ok(Some(false)) => {
+            error!("stapled ocsp response reports the server certificate as not good");
+            false
+        }
+        Ok(None) => {
+            error!("stapled ocsp response has no status for the server certificate");
+            false
+        }
+        Err(e) => {
+            error!("failed to verify the stapled ocsp response: {}", e);
+            false
+        }
+    }
+}
+
+fn is_pinned(ctx: &X509StoreContextRef, pins: &[String]) -> bool {
+    let pinned = ctx.chain().map_or(false, |chain| {
+        chain.iter().any(|cert| {
+            cert.public_key()
+                .and_then(|key| key.public_key_to_der())
+                .map(|der| pins.contains(&spki_sha256sum(&der)))
+                .unwrap_or(false)
+        })
+    });
+    if !pinned {
+        error!("server certificate chain doesn't match any of the pinned public keys");
+    }
+    pinned
+}
+
+fn spki_sha256sum(der: &[u8]) -> String {
+    openssl::sha::sha256(der).iter().map(|c| format!("{:02x}", c)).collect()
+}
+
+// From https://github.com/openssl/openssl/blob/master/include/openssl/ssl.h
+// and x509_vfy.h
+const SSL_CTRL_SET_TLSEXT_STATUS_REQ_TYPE: c_int = 65;
+const TLSEXT_STATUSTYPE_OCSP: c_long = 1;
+const X509_V_FLAG_CRL_CHECK: c_ulong = 0x4;
+const X509_V_FLAG_CRL_CHECK_ALL: c_ulong = 0x8;
+
+// The store flags are not covered by the openssl crate, so they are
+// set directly from libcrypto.
+extern "C" {
+    fn X509_STORE_set_flags(store: *mut openssl_sys::X509_STORE, flags: c_ulong) -> c_int;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use openssl::{asn1::Asn1Time, hash::MessageDigest, rsa::Rsa, x509::X509};
+
+    fn gen_certificate() -> Vec<u8> {
+        let key = PKey::from_rsa(Rsa::generate(2048).unwrap()).unwrap();
+        let mut builder = X509::builder().unwrap();
+        builder.set_pubkey(&key).unwrap();
+        builder.set_not_before(&Asn1Time::days_from_now(0).unwrap()).unwrap();
+        builder.set_not_after(&Asn1Time::days_from_now(1).unwrap()).unwrap();
+        builder.sign(&key, MessageDigest::sha256()).unwrap();
+        builder.build().to_pem().unwrap()
+    }
+
+    fn is_stale() -> bool {
+        let tls = TLS.read().unwrap();
+        let tls = tls.as_ref().unwrap();
+        tls.stamps != tls.config.stamps()
+    }
+
+    #[test]
+    fn reload_changed_certificates() {
+        let dir = tempfile::tempdir().unwrap();
+        let ca_bundle = dir.path().join("ca.pem");
+        std::fs::write(&ca_bundle, gen_certificate()).unwrap();
+        configure_tls(Some(&ca_bundle), None, &[], &Revocation::default()).unwrap();
+        assert!(!is_stale());
+
+        // A broken bundle keeps the previous connector in use
+        std::fs::write(&ca_bundle, "broken").unwrap();
+        assert!(connector().is_some());
+        assert!(is_stale());
+
+        std::fs::write(&ca_bundle, gen_certificate()).unwrap();
+        assert!(connector().is_some());
+        assert!(!is_stale());
+    }
+}
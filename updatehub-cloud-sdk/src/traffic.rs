@@ -0,0 +1,31 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use std::sync::atomic::{AtomicU64, Ordering};
+
+static DOWNLOADED: AtomicU64 = AtomicU64::new(0);
+static UPLOADED: AtomicU64 = AtomicU64::new(0);
+
+/// Bytes transferred by the requests to the server.
+#[derive(Clone, Copy, Debug, Default, PartialEq)]
+pub struct Traffic {
+    pub downloaded: u64,
+    pub uploaded: u64,
+}
+
+/// Takes the bytes transferred since the last time it was called.
+pub fn take_traffic() -> Traffic {
+    Traffic {
+        downloaded: DOWNLOADED.swap(0, Ordering::Relaxed),
+        uploaded: UPLOADED.swap(0, Ordering::Relaxed),
+    }
+}
+
+pub(crate) fn add_downloaded(bytes: usize) {
+    DOWNLOADED.fetch_add(bytes as u64, Ordering::Relaxed);
+}
+
+pub(crate) fn add_uploaded(bytes: usize) {
+    UPLOADED.fetch_add(bytes as u64, Ordering::Relaxed);
+}
@@ -8,14 +8,38 @@ use mockito::{mock, Mock};
 use serde_json::json;
 use std::collections::BTreeMap;
 
+// sha256sum of the objects, as they are verified while downloaded
+const OBJECT: &str = "c775e7b757ede630cd0aa1113bd102661ab38829ca52a6422ab782862f268646";
+const CHANGED_OBJECT: &str = "72399361da6a7754fec986dca5b7cbaf1c810a28ded4abaf56b2106d06cb78b0";
+
 enum FakeServer {
     NoUpdate,
     HasUpdate,
+    HasChainedUpdate,
     ExtraPoll,
+    NotModified,
+    Busy,
     WithRetry,
     ReportSuccess,
     ReportError,
+    ReportErrorDetails,
+    ReportRejected,
+    ReportProgress,
     DownloadInParts,
+    DownloadCorrupted,
+    DownloadChanged,
+    DownloadRange,
+    DownloadDelta,
+    Stream,
+    Lock,
+    LockBusy,
+    Takeover,
+    Jobs,
+    Hawkbit,
+    Forward,
+    Channel,
+    Settings,
+    Enrollment,
 }
 
 fn create_mock_server(server: FakeServer) -> (String, Vec<Mock>) {
@@ -77,6 +101,13 @@ fn create_mock_server(server: FakeServer) -> (String, Vec<Mock>) {
             .with_header("UH-Signature", &openssl::base64::encode_block(b"some_signature"))
             .with_body(&json_update.to_string())
             .create()],
+        FakeServer::HasChainedUpdate => vec![mock("POST", "/upgrades")
+            .match_body(reply_body)
+            .with_status(200)
+            .with_header("UH-Chain-Step", "1")
+            .with_header("UH-Chain-Length", "3")
+            .with_body(&json_update.to_string())
+            .create()],
         FakeServer::ExtraPoll => vec![mock("POST", "/upgrades")
             .match_header("Content-Type", "application/json")
             .match_header("Api-Content-Type", "application/vnd.updatehub-v1+json")
@@ -84,6 +115,25 @@ fn create_mock_server(server: FakeServer) -> (String, Vec<Mock>) {
             .with_status(200)
             .with_header("Add-Extra-Poll", "10")
             .create()],
+        // Served under their own paths, as the validators are kept for
+        // each server.
+        FakeServer::NotModified => vec![
+            mock("POST", "/not-modified/upgrades")
+                .match_header("If-None-Match", Matcher::Missing)
+                .match_body(reply_body.clone())
+                .with_status(404)
+                .with_header("ETag", "\"no-update\"")
+                .create(),
+            mock("POST", "/not-modified/upgrades")
+                .match_header("If-None-Match", "\"no-update\"")
+                .match_body(reply_body)
+                .with_status(304)
+                .create(),
+        ],
+        FakeServer::Busy => vec![mock("POST", "/busy/upgrades")
+            .with_status(503)
+            .with_header("Retry-After", "120")
+            .create()],
         FakeServer::WithRetry => vec![mock("POST", "/upgrades")
             .match_header("Content-Type", "application/json")
             .match_header("Api-Content-Type", "application/vnd.updatehub-v1+json")
@@ -113,6 +163,7 @@ fn create_mock_server(server: FakeServer) -> (String, Vec<Mock>) {
             )))
             .with_status(200)
             .create()],
+        FakeServer::ReportRejected => vec![mock("POST", "/report").with_status(400).create()],
         FakeServer::ReportError => vec![mock("POST", "/report")
             .match_header("Content-Type", "application/json")
             .match_header("Api-Content-Type", "application/vnd.updatehub-v1+json")
@@ -137,34 +188,256 @@ fn create_mock_server(server: FakeServer) -> (String, Vec<Mock>) {
             )))
             .with_status(200)
             .create()],
-        FakeServer::DownloadInParts => vec![
-            mock(
-                "GET",
-                format!(
-                    "/products/{}/packages/{}/objects/{}",
-                    FakeMetadata::PRODUCT_UID, "package_id", "object"
-                )
-                    .as_str(),
+        FakeServer::ReportErrorDetails => vec![mock("POST", "/report")
+            .match_header("Content-Type", "application/json")
+            .match_body(Matcher::PartialJson(json!(
+                {
+                    "status": "error",
+                    "package-uid": "package-uid",
+                    "previous-state": "installing",
+                    "error-message": "Script failed: exit status: 2",
+                    "error-details": {
+                        "state": "install",
+                        "object-index": 1,
+                        "object-mode": "raw",
+                        "exit-code": 2,
+                        "log": ["installing rootfs.img"],
+                        "free-space": 1048576
+                    }
+                }
+            )))
+            .with_status(200)
+            .create()],
+        FakeServer::ReportProgress => vec![mock("POST", "/report")
+            .match_header("Content-Type", "application/json")
+            .match_body(Matcher::PartialJson(json!(
+                {
+                    "status": "downloading",
+                    "package-uid": "package-uid",
+                    "progress": {
+                        "object": "rootfs.img",
+                        "mode": "raw",
+                        "index": 0,
+                        "count": 1,
+                        "done": 512,
+                        "total": 1024,
+                        "percentage": 50
+                    }
+                }
+            )))
+            .with_status(200)
+            .create()],
+        FakeServer::DownloadInParts => vec![mock(
+            "GET",
+            format!(
+                "/products/{}/packages/{}/objects/{}",
+                FakeMetadata::PRODUCT_UID,
+                "package_id",
+                OBJECT
             )
-                .match_header("Content-Type", "application/json")
-                .match_header("Api-Content-Type", "application/vnd.updatehub-v1+json")
+            .as_str(),
+        )
+        .match_header("Content-Type", "application/json")
+        .match_header("Api-Content-Type", "application/vnd.updatehub-v1+json")
+        .match_header("Range", "bytes=4-")
+        .match_header("If-Range", "\"v1\"")
+        .with_status(206)
+        .with_header("ETag", "\"v1\"")
+        .with_body("567890")
+        .create()],
+        FakeServer::DownloadCorrupted => vec![mock(
+            "GET",
+            format!(
+                "/products/{}/packages/{}/objects/{}",
+                FakeMetadata::PRODUCT_UID,
+                "package_id",
+                OBJECT
+            )
+            .as_str(),
+        )
+        .with_status(200)
+        .with_header("ETag", "\"v1\"")
+        .with_body("corrupted!")
+        .create()],
+        FakeServer::DownloadChanged => vec![mock(
+            "GET",
+            format!(
+                "/products/{}/packages/{}/objects/{}",
+                FakeMetadata::PRODUCT_UID,
+                "package_id",
+                CHANGED_OBJECT
+            )
+            .as_str(),
+        )
+        .match_header("Range", "bytes=4-")
+        .match_header("If-Range", "\"v1\"")
+        .with_status(200)
+        .with_header("ETag", "\"v2\"")
+        .with_body("abcdefghij")
+        .create()],
+        FakeServer::DownloadRange => vec![mock(
+            "GET",
+            format!(
+                "/products/{}/packages/{}/objects/{}",
+                FakeMetadata::PRODUCT_UID,
+                "package_id",
+                "object"
+            )
+            .as_str(),
+        )
+        .match_header("Range", "bytes=6-9")
+        .with_status(206)
+        .with_body("7890")
+        .create()],
+        FakeServer::Stream => vec![mock(
+            "GET",
+            format!(
+                "/products/{}/packages/{}/objects/{}",
+                FakeMetadata::PRODUCT_UID,
+                "package_id",
+                OBJECT
+            )
+            .as_str(),
+        )
+        .with_status(200)
+        .with_body("1234567890")
+        .create()],
+        FakeServer::DownloadDelta => vec![mock(
+            "GET",
+            format!(
+                "/products/{}/packages/{}/objects/{}",
+                FakeMetadata::PRODUCT_UID,
+                "package_id",
+                "object"
+            )
+            .as_str(),
+        )
+        .match_header("Api-Delta-Bases", "base1,base2")
+        .with_status(200)
+        .with_header("UH-Delta-Base", "base2")
+        .with_body("patch")
+        .create()],
+        FakeServer::Lock => vec![
+            mock("POST", "/lock").match_body(reply_body.clone()).with_status(200).create(),
+            mock("DELETE", "/lock").match_body(reply_body).with_status(200).create(),
+        ],
+        FakeServer::LockBusy => {
+            vec![mock("POST", "/lock-busy").match_body(reply_body).with_status(423).create()]
+        }
+        FakeServer::Forward => vec![mock("POST", "/upgrades")
+            .match_header("Api-Retries", "2")
+            .match_body("{}")
+            .with_status(200)
+            .with_header("UH-Signature", "c2lnbmF0dXJl")
+            .with_body(&json_update.to_string())
+            .create()],
+        FakeServer::Channel => vec![mock("POST", "/upgrades")
+            .match_body(Matcher::PartialJson(json!({ "channel": "beta" })))
+            .with_status(404)
+            .create()],
+        FakeServer::Settings => vec![mock("POST", "/settings")
+            .with_status(200)
+            .with_header("UH-Signature", "c2lnbmF0dXJl")
+            .with_body(&json!({ "polling.interval": "2h", "polling.enabled": false }).to_string())
+            .create()],
+        FakeServer::Enrollment => vec![
+            mock("POST", "/enrollment/enrollment")
+                .match_body(Matcher::PartialJson(json!({ "enrollment-token": "one-time" })))
+                .with_status(201)
+                .with_body(&json!({ "token": "device-secret" }).to_string())
+                .create(),
+            mock("POST", "/enrollment/upgrades")
+                .match_header("Authorization", "Bearer device-secret")
+                .with_status(404)
+                .create(),
+        ],
+        FakeServer::Takeover => {
+            vec![mock("POST", "/takeover").match_body(reply_body).with_status(200).create()]
+        }
+        FakeServer::Jobs => vec![
+            mock("GET", "/things/device/jobs/$next")
+                .with_status(200)
+                .with_header("Content-Type", "application/json")
+                .with_body(
+                    json!({
+                        "execution": {
+                            "jobId": "job",
+                            "thingName": "device",
+                            "status": "QUEUED",
+                            "jobDocument": "{\"url\":\"https://example.com/update.uhupkg\"}",
+                            "queuedAt": 1_588_000_000,
+                            "lastUpdatedAt": 1_588_000_000,
+                            "versionNumber": 1,
+                            "executionNumber": 1
+                        }
+                    })
+                    .to_string(),
+                )
+                .create(),
+            mock("POST", "/things/device/jobs/job")
+                .match_body(Matcher::Json(json!({
+                    "status": "IN_PROGRESS",
+                    "statusDetails": { "state": "accepted" }
+                })))
                 .with_status(200)
-                .with_body("1234")
                 .create(),
-            mock(
-                "GET",
-                format!(
-                    "/products/{}/packages/{}/objects/{}",
-                    FakeMetadata::PRODUCT_UID, "package_id", "object"
+        ],
+        FakeServer::Hawkbit => vec![
+            mock("GET", "/DEFAULT/controller/v1/device")
+                .match_header("Authorization", "TargetToken token")
+                .with_status(200)
+                .with_header("Content-Type", "application/json")
+                .with_body(
+                    json!({
+                        "config": { "polling": { "sleep": "00:05:00" } },
+                        "_links": {
+                            "deploymentBase": {
+                                "href": format!(
+                                    "{}/DEFAULT/controller/v1/device/deploymentBase/8?c=1",
+                                    mockito::server_url()
+                                )
+                            }
+                        }
+                    })
+                    .to_string(),
                 )
-                    .as_str(),
-            )
-                .match_header("Content-Type", "application/json")
-                .match_header("Api-Content-Type", "application/vnd.updatehub-v1+json")
-                .match_header("Range", "bytes=3-")
+                .create(),
+            mock("GET", "/DEFAULT/controller/v1/device/deploymentBase/8?c=1&actionHistory=1")
+                .with_status(200)
+                .with_header("Content-Type", "application/json")
+                .with_body(
+                    json!({
+                        "id": "8",
+                        "deployment": {
+                            "download": "forced",
+                            "update": "forced",
+                            "chunks": [{
+                                "part": "os",
+                                "version": "1.0",
+                                "name": "firmware",
+                                "artifacts": [{
+                                    "filename": "update.uhupkg",
+                                    "_links": {
+                                        "download": { "href": "https://example.com/update.uhupkg" }
+                                    }
+                                }]
+                            }]
+                        }
+                    })
+                    .to_string(),
+                )
+                .create(),
+            mock("POST", "/DEFAULT/controller/v1/device/deploymentBase/8/feedback")
+                .match_body(Matcher::Json(json!({
+                    "id": "8",
+                    "status": {
+                        "execution": "proceeding",
+                        "result": { "finished": "none" },
+                        "details": ["updatehub accepted at 1588000000"]
+                    }
+                })))
                 .with_status(200)
-                .with_body("567890")
-                .create()
+                .create(),
         ],
     };
 
@@ -197,6 +470,8 @@ impl FakeMetadata {
             hardware: "board",
             device_identity: sdk::api::MetadataValue(&self.identity),
             device_attributes: sdk::api::MetadataValue(&self.attributes),
+            previous_device_identity: None,
+            channel: None,
         }
     }
 }
@@ -208,6 +483,19 @@ async fn probe_requirements() {
     mocks.iter().for_each(Mock::assert);
 }
 
+#[actix_rt::test]
+async fn account_traffic() {
+    let (url, mocks) = create_mock_server(FakeServer::HasUpdate);
+    sdk::Client::new(&url).probe(0, FakeMetadata::new().get()).await.unwrap();
+    mocks.iter().for_each(Mock::assert);
+
+    // Other tests may be running in parallel, so only the lower bound is
+    // known.
+    let traffic = sdk::take_traffic();
+    assert!(traffic.uploaded > 0);
+    assert!(traffic.downloaded > 0);
+}
+
 #[actix_rt::test]
 async fn probe_with_retry() {
     let (url, mocks) = create_mock_server(FakeServer::WithRetry);
@@ -232,6 +520,20 @@ async fn probe_response_with_signature() {
     mocks.iter().for_each(Mock::assert);
 }
 
+#[actix_rt::test]
+async fn probe_response_with_chain() {
+    use sdk::api::{ProbeResponse, UpdateChain};
+    let (url, mocks) = create_mock_server(FakeServer::HasChainedUpdate);
+    let response = sdk::Client::new(&url).probe(0, FakeMetadata::new().get()).await.unwrap();
+    match response {
+        ProbeResponse::Update(package, _) => {
+            assert_eq!(package.chain, Some(UpdateChain { step: 1, length: 3 }))
+        }
+        r => panic!("Unexpected probe response: {:?}", r),
+    }
+    mocks.iter().for_each(Mock::assert);
+}
+
 #[actix_rt::test]
 async fn probe_response_with_extra_poll() {
     use sdk::api::ProbeResponse;
@@ -244,11 +546,38 @@ async fn probe_response_with_extra_poll() {
     mocks.iter().for_each(Mock::assert);
 }
 
+#[actix_rt::test]
+async fn probe_not_modified() {
+    use sdk::api::ProbeResponse;
+    let (url, mocks) = create_mock_server(FakeServer::NotModified);
+    let server = format!("{}/not-modified", url);
+    for _ in 0..2 {
+        match sdk::Client::new(&server).probe(0, FakeMetadata::new().get()).await.unwrap() {
+            ProbeResponse::NoUpdate => {}
+            r => panic!("Unexpected probe response: {:?}", r),
+        }
+    }
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn probe_retry_after() {
+    let (url, mocks) = create_mock_server(FakeServer::Busy);
+    let server = format!("{}/busy", url);
+    match sdk::Client::new(&server).probe(0, FakeMetadata::new().get()).await {
+        Err(sdk::Error::RetryAfter(delay)) => {
+            assert_eq!(delay, std::time::Duration::from_secs(120))
+        }
+        r => panic!("Unexpected probe response: {:?}", r),
+    }
+    mocks.iter().for_each(Mock::assert);
+}
+
 #[actix_rt::test]
 async fn report_success() {
     let (url, mocks) = create_mock_server(FakeServer::ReportSuccess);
     sdk::Client::new(&url)
-        .report("state", FakeMetadata::new().get(), "package-uid", None, None, None)
+        .report("state", FakeMetadata::new().get(), "package-uid", None, None, None, None)
         .await
         .unwrap();
     mocks.iter().for_each(Mock::assert);
@@ -265,37 +594,365 @@ async fn report_error() {
             Some("previous-state"),
             Some("errorMessage".into()),
             None,
+            None,
         )
         .await
         .unwrap();
     mocks.iter().for_each(Mock::assert);
 }
 
+#[actix_rt::test]
+async fn report_error_details() {
+    let (url, mocks) = create_mock_server(FakeServer::ReportErrorDetails);
+    let details = sdk::api::ErrorDetails {
+        state: "install".to_owned(),
+        object_index: Some(1),
+        object_mode: Some("raw".to_owned()),
+        exit_code: Some(2),
+        log: vec!["installing rootfs.img".to_owned()],
+        free_space: Some(1_048_576),
+        ..sdk::api::ErrorDetails::default()
+    };
+    sdk::Client::new(&url)
+        .report_error(
+            FakeMetadata::new().get(),
+            "package-uid",
+            "installing",
+            "Script failed: exit status: 2".to_owned(),
+            None,
+            None,
+            &details,
+        )
+        .await
+        .unwrap();
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn report_rejected() {
+    let (url, mocks) = create_mock_server(FakeServer::ReportRejected);
+    let err = sdk::Client::new(&url)
+        .report("state", FakeMetadata::new().get(), "package-uid", None, None, None, None)
+        .await
+        .unwrap_err();
+    assert!(!err.is_transient());
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn report_progress() {
+    let (url, mocks) = create_mock_server(FakeServer::ReportProgress);
+    let progress = sdk::api::Progress {
+        object: "rootfs.img".to_owned(),
+        mode: "raw".to_owned(),
+        index: 0,
+        count: 1,
+        done: 512,
+        total: 1024,
+        percentage: 50,
+    };
+    sdk::Client::new(&url)
+        .report_progress("downloading", FakeMetadata::new().get(), "package-uid", &progress)
+        .await
+        .unwrap();
+    mocks.iter().for_each(Mock::assert);
+}
+
 #[actix_rt::test]
 async fn download_object() {
     use tokio::fs;
 
     let (url, mocks) = create_mock_server(FakeServer::DownloadInParts);
     let dir = tempfile::tempdir().unwrap();
-    let file_path = dir.path().join("object");
+    let file_path = dir.path().join(OBJECT);
+    fs::write(&file_path, "1234").await.unwrap();
+    fs::write(dir.path().join(format!("{}.etag", OBJECT)), "\"v1\"").await.unwrap();
 
-    // Download the object.
+    // Download the remaining bytes of the object.
+    let download = sdk::Client::new(&url)
+        .download_object(&FakeMetadata::PRODUCT_UID, "package_id", &dir.path(), OBJECT)
+        .await
+        .unwrap();
+
+    // Verify it has been fully downloaded.
+    assert_eq!(download, sdk::api::ObjectDownload::Verified);
+    assert_eq!(fs::read_to_string(&file_path).await.unwrap(), "1234567890".to_string());
+    mocks.iter().for_each(Mock::assert);
+    dir.close().unwrap();
+}
+
+#[actix_rt::test]
+async fn download_corrupted_object() {
+    let (url, mocks) = create_mock_server(FakeServer::DownloadCorrupted);
+    let dir = tempfile::tempdir().unwrap();
+
+    match sdk::Client::new(&url)
+        .download_object(&FakeMetadata::PRODUCT_UID, "package_id", &dir.path(), OBJECT)
+        .await
+    {
+        Err(sdk::Error::ChecksumMismatch(object)) => assert_eq!(object, OBJECT),
+        r => panic!("Unexpected download result: {:?}", r),
+    }
+    assert!(!dir.path().join(OBJECT).exists());
+    assert!(!dir.path().join(format!("{}.etag", OBJECT)).exists());
+    mocks.iter().for_each(Mock::assert);
+    dir.close().unwrap();
+}
+
+#[actix_rt::test]
+async fn download_object_range() {
+    use tokio::fs;
+
+    let (url, mocks) = create_mock_server(FakeServer::DownloadRange);
+    let dir = tempfile::tempdir().unwrap();
+    let file_path = dir.path().join("object.part1");
+    fs::write(&file_path, "56").await.unwrap();
+
+    // Resume the segment after the bytes already written.
     sdk::Client::new(&url)
-        .download_object(&FakeMetadata::PRODUCT_UID, "package_id", &dir.path(), "object")
+        .download_object_range(&FakeMetadata::PRODUCT_UID, "package_id", "object", 4, 9, &file_path)
         .await
         .unwrap();
 
-    // Verify it has been downloaded successfully.
-    assert_eq!(fs::read_to_string(&file_path).await.unwrap(), "1234".to_string());
+    assert_eq!(fs::read_to_string(&file_path).await.unwrap(), "567890".to_string());
+    mocks.iter().for_each(Mock::assert);
+    dir.close().unwrap();
+}
+
+#[actix_rt::test]
+async fn stream_object() {
+    let (url, mocks) = create_mock_server(FakeServer::Stream);
+    let mut output = Vec::new();
 
-    // Download the remaining bytes of the object.
     sdk::Client::new(&url)
+        .stream_object(&FakeMetadata::PRODUCT_UID, "package_id", OBJECT, &mut output)
+        .await
+        .unwrap();
+
+    assert_eq!(output, b"1234567890");
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn stream_corrupted_object() {
+    let (url, mocks) = create_mock_server(FakeServer::DownloadCorrupted);
+    let mut output = Vec::new();
+
+    match sdk::Client::new(&url)
+        .stream_object(&FakeMetadata::PRODUCT_UID, "package_id", OBJECT, &mut output)
+        .await
+    {
+        Err(sdk::Error::ChecksumMismatch(object)) => assert_eq!(object, OBJECT),
+        r => panic!("Unexpected stream result: {:?}", r),
+    }
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn download_object_delta() {
+    use tokio::fs;
+
+    let (url, mocks) = create_mock_server(FakeServer::DownloadDelta);
+    let dir = tempfile::tempdir().unwrap();
+
+    let download = sdk::Client::new(&url)
+        .with_delta_bases(vec!["base1".to_string(), "base2".to_string()])
         .download_object(&FakeMetadata::PRODUCT_UID, "package_id", &dir.path(), "object")
         .await
         .unwrap();
 
-    // Verify it has been fully downloaded.
-    assert_eq!(fs::read_to_string(&file_path).await.unwrap(), "1234567890".to_string());
+    assert_eq!(download, sdk::api::ObjectDownload::Delta { base: "base2".to_string() });
+    assert_eq!(fs::read_to_string(dir.path().join("object.delta")).await.unwrap(), "patch");
+    assert!(!dir.path().join("object").exists());
+    mocks.iter().for_each(Mock::assert);
+    dir.close().unwrap();
+}
+
+#[actix_rt::test]
+async fn download_changed_object() {
+    use tokio::fs;
+
+    let (url, mocks) = create_mock_server(FakeServer::DownloadChanged);
+    let dir = tempfile::tempdir().unwrap();
+    let file_path = dir.path().join(CHANGED_OBJECT);
+    fs::write(&file_path, "1234").await.unwrap();
+    fs::write(dir.path().join(format!("{}.etag", CHANGED_OBJECT)), "\"v1\"").await.unwrap();
+
+    // The object has changed on the server so it is downloaded again.
+    sdk::Client::new(&url)
+        .download_object(&FakeMetadata::PRODUCT_UID, "package_id", &dir.path(), CHANGED_OBJECT)
+        .await
+        .unwrap();
+
+    assert_eq!(fs::read_to_string(&file_path).await.unwrap(), "abcdefghij".to_string());
+    assert_eq!(
+        fs::read_to_string(dir.path().join(format!("{}.etag", CHANGED_OBJECT))).await.unwrap(),
+        "\"v2\"".to_string()
+    );
     mocks.iter().for_each(Mock::assert);
     dir.close().unwrap();
 }
+
+#[actix_rt::test]
+async fn acquire_and_release_lock() {
+    let (url, mocks) = create_mock_server(FakeServer::Lock);
+    let url = format!("{}/lock", url);
+    assert!(sdk::acquire_lock(&url, FakeMetadata::new().get()).await.unwrap());
+    sdk::release_lock(&url, FakeMetadata::new().get()).await.unwrap();
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn acquire_busy_lock() {
+    let (url, mocks) = create_mock_server(FakeServer::LockBusy);
+    let url = format!("{}/lock-busy", url);
+    assert!(!sdk::acquire_lock(&url, FakeMetadata::new().get()).await.unwrap());
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn handle_job() {
+    use sdk::jobs::{Client, JobStatus};
+
+    let (url, mocks) = create_mock_server(FakeServer::Jobs);
+    let client = Client::new(&url, "device");
+    let execution = client.next().await.unwrap().unwrap();
+    assert_eq!(execution.job_id, "job");
+    assert_eq!(execution.status, JobStatus::Queued);
+    assert_eq!(execution.last_updated_at, 1_588_000_000);
+
+    let mut details = BTreeMap::new();
+    details.insert("state".to_owned(), "accepted".to_owned());
+    client.update(&execution.job_id, JobStatus::InProgress, &details).await.unwrap();
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn handle_hawkbit_deployment() {
+    use sdk::hawkbit::{accepted_details, Client, Execution, Finished};
+
+    let (url, mocks) = create_mock_server(FakeServer::Hawkbit);
+    let client = Client::new(&format!("{}/DEFAULT", url), "device", Some("token"));
+    let deployment = client.poll().await.unwrap().unwrap();
+    assert_eq!(deployment.action_id, "8");
+    assert_eq!(deployment.artifacts[0].url, "https://example.com/update.uhupkg");
+    assert_eq!(deployment.accepted_at, None);
+
+    client
+        .feedback(
+            &deployment.action_id,
+            Execution::Proceeding,
+            Finished::None,
+            &[accepted_details(1_588_000_000)],
+        )
+        .await
+        .unwrap();
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn request_takeover() {
+    let (url, mocks) = create_mock_server(FakeServer::Takeover);
+    let url = format!("{}/takeover", url);
+    sdk::request_takeover(&url, FakeMetadata::new().get()).await.unwrap();
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[test]
+fn client_identity() {
+    use openssl::{asn1::Asn1Time, hash::MessageDigest, pkey::PKey, rsa::Rsa, x509::X509};
+
+    let dir = tempfile::tempdir().unwrap();
+    let gen_key = || PKey::from_rsa(Rsa::generate(2048).unwrap()).unwrap();
+    let key = gen_key();
+    let mut builder = X509::builder().unwrap();
+    builder.set_pubkey(&key).unwrap();
+    builder.set_not_before(&Asn1Time::days_from_now(0).unwrap()).unwrap();
+    builder.set_not_after(&Asn1Time::days_from_now(1).unwrap()).unwrap();
+    builder.sign(&key, MessageDigest::sha256()).unwrap();
+
+    let (cert, key_file, other_key) =
+        (dir.path().join("cert"), dir.path().join("key"), dir.path().join("other"));
+    std::fs::write(&cert, builder.build().to_pem().unwrap()).unwrap();
+    std::fs::write(&key_file, key.private_key_to_pem_pkcs8().unwrap()).unwrap();
+    std::fs::write(&other_key, gen_key().private_key_to_pem_pkcs8().unwrap()).unwrap();
+
+    let revocation = sdk::Revocation::default();
+
+    sdk::configure_tls(None, Some((&cert, key_file.to_str().unwrap())), &[], &revocation).unwrap();
+    assert!(sdk::configure_tls(None, Some((&cert, other_key.to_str().unwrap())), &[], &revocation)
+        .is_err());
+    sdk::configure_tls(None, None, &["00".repeat(32)], &revocation).unwrap();
+}
+
+#[test]
+fn revocation_checking() {
+    let dir = tempfile::tempdir().unwrap();
+    let missing_crl_file = dir.path().join("crl.pem");
+
+    let revocation = sdk::Revocation { crl_file: Some(missing_crl_file), ..Default::default() };
+    assert!(sdk::configure_tls(None, None, &[], &revocation).is_err());
+
+    let revocation = sdk::Revocation { require_ocsp_stapling: true, ..Default::default() };
+    sdk::configure_tls(None, None, &[], &revocation).unwrap();
+}
+
+#[actix_rt::test]
+async fn forward_request() {
+    let (url, mocks) = create_mock_server(FakeServer::Forward);
+    let response = sdk::Client::new(&url)
+        .forward("/upgrades", &[("api-retries".to_owned(), "2".to_owned())], b"{}".to_vec())
+        .await
+        .unwrap();
+    assert_eq!(response.status, 200);
+    assert!(response.headers.contains(&("uh-signature".to_owned(), "c2lnbmF0dXJl".to_owned())));
+    assert_eq!(
+        serde_json::from_slice::<serde_json::Value>(&response.body).unwrap()["product"],
+        "0123456789"
+    );
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn probe_channel() {
+    let (url, mocks) = create_mock_server(FakeServer::Channel);
+    let metadata = FakeMetadata::new();
+    let firmware = sdk::api::FirmwareMetadata { channel: Some("beta"), ..metadata.get() };
+    match sdk::Client::new(&url).probe(0, firmware).await.unwrap() {
+        sdk::api::ProbeResponse::NoUpdate => {}
+        r => panic!("Unexpected response: {:?}", r),
+    }
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn settings_pushed() {
+    let (url, mocks) = create_mock_server(FakeServer::Settings);
+    let metadata = FakeMetadata::new();
+    let (delta, signature) =
+        sdk::Client::new(&url).settings(metadata.get()).await.unwrap().unwrap();
+    assert_eq!(delta.settings["polling.interval"], "2h");
+    assert_eq!(delta.settings["polling.enabled"], "false");
+    assert_eq!(signature, Some(sdk::api::Signature::from_base64_str("c2lnbmF0dXJl").unwrap()));
+    mocks.iter().for_each(Mock::assert);
+}
+
+#[actix_rt::test]
+async fn enroll_device() {
+    let (url, mocks) = create_mock_server(FakeServer::Enrollment);
+    let server = format!("{}/enrollment", url);
+    let credentials = sdk::Client::new(&server)
+        .enroll(FakeMetadata::new().get(), Some("one-time"))
+        .await
+        .unwrap();
+    assert_eq!(credentials.token, "device-secret");
+
+    sdk::configure_credentials(Some(credentials));
+    let probe = sdk::Client::new(&server).probe(0, FakeMetadata::new().get()).await;
+    sdk::configure_credentials(None);
+    match probe.unwrap() {
+        sdk::api::ProbeResponse::NoUpdate => {}
+        r => panic!("Unexpected probe response: {:?}", r),
+    }
+    mocks.iter().for_each(Mock::assert);
+}
@@ -0,0 +1,39 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use serde::Deserialize;
+
+/// Object holding a new binary of the agent itself, which replaces the
+/// running one once it has proven to work.
+#[derive(Deserialize, PartialEq, Debug)]
+#[serde(rename_all = "kebab-case")]
+pub struct Agent {
+    pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
+    pub size: u64,
+    pub sha256sum: String,
+}
+
+#[test]
+fn deserialize() {
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    assert_eq!(
+        Agent {
+            filename: "updatehub".to_string(),
+            roles: Vec::default(),
+            size: 1024,
+            sha256sum: "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
+                .to_string(),
+        },
+        serde_json::from_value::<Agent>(json!({
+            "filename": "updatehub",
+            "size": 1024,
+            "sha256sum": "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
+        }))
+        .unwrap()
+    );
+}
@@ -3,7 +3,7 @@
 // SPDX-License-Identifier: Apache-2.0
 
 use crate::definitions::{
-    Filesystem, InstallIfDifferent, TargetFormat, TargetPermissions, TargetType,
+    Filesystem, InstallIfDifferent, ReadOnly, TargetFormat, TargetPermissions, TargetType,
 };
 use serde::Deserialize;
 use std::path::PathBuf;
@@ -12,6 +12,8 @@ use std::path::PathBuf;
 #[serde(rename_all = "kebab-case")]
 pub struct Copy {
     pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
     pub filesystem: Filesystem,
     pub size: u64,
     pub sha256sum: String,
@@ -30,6 +32,12 @@ pub struct Copy {
     pub target_format: TargetFormat,
     #[serde(default)]
     pub mount_options: String,
+    #[serde(default)]
+    pub read_only: Option<ReadOnly>,
+    /// Whether only the blocks of the target file which differ are
+    /// rewritten, rather than the whole file.
+    #[serde(default)]
+    pub differential: bool,
 }
 
 #[test]
@@ -40,6 +48,7 @@ fn deserialize() {
     assert_eq!(
         Copy {
             filename: "etc/passwd".to_string(),
+            roles: Vec::default(),
             filesystem: Filesystem::Btrfs,
             size: 1024,
             sha256sum: "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
@@ -53,6 +62,8 @@ fn deserialize() {
             required_uncompressed_size: 0,
             target_format: TargetFormat::default(),
             mount_options: String::default(),
+            read_only: None,
+            differential: true,
         },
         serde_json::from_value::<Copy>(json!({
             "filename": "etc/passwd",
@@ -62,7 +73,8 @@ fn deserialize() {
             "filesystem": "btrfs",
             "target-type": "device",
             "target": "/dev/sda",
-            "target-path": "/etc/passwd"
+            "target-path": "/etc/passwd",
+            "differential": true
         }))
         .unwrap()
     );
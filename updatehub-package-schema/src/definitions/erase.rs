@@ -0,0 +1,38 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use serde::Deserialize;
+
+/// How the range of the target the object is written over is erased
+/// before it is written, so no stale data of the previous content is
+/// left in it.
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq)]
+#[serde(rename_all = "kebab-case")]
+pub enum Erase {
+    /// The range is written over as it is.
+    None,
+    /// The range is discarded, as TRIM does, which also speeds the writes
+    /// up on flash storage.
+    Discard,
+    /// Zeroes are written over the range, which the storage may do
+    /// without transferring them.
+    WriteZeroes,
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn deserialize() {
+        assert_eq!(serde_json::from_value::<Erase>(json!("discard")).ok(), Some(Erase::Discard));
+        assert_eq!(
+            serde_json::from_value::<Erase>(json!("write-zeroes")).ok(),
+            Some(Erase::WriteZeroes)
+        );
+        assert!(serde_json::from_value::<Erase>(json!("secure")).is_err());
+    }
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use serde::Deserialize;
+
+/// Flash geometry an image has been built for, as given to mkfs.ubifs
+/// and ubinize. Only the given sizes are checked against the target.
+#[derive(PartialEq, Debug, Default, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct FlashGeometry {
+    /// Physical eraseblock size, in bytes.
+    #[serde(default)]
+    pub peb_size: Option<u64>,
+    /// Logical eraseblock size, in bytes.
+    #[serde(default)]
+    pub leb_size: Option<u64>,
+    /// Minimum input/output unit size, in bytes.
+    #[serde(default)]
+    pub min_io_size: Option<u64>,
+    /// Sub-page size, in bytes.
+    #[serde(default)]
+    pub sub_page_size: Option<u64>,
+    /// Logical eraseblocks the image may grow to, which the target
+    /// volume must be able to hold.
+    #[serde(default)]
+    pub max_leb_count: Option<u64>,
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn deserialize() {
+        assert_eq!(
+            serde_json::from_value::<FlashGeometry>(json!({
+                "peb-size": 131_072,
+                "leb-size": 126_976,
+                "min-io-size": 2048,
+                "max-leb-count": 2048
+            }))
+            .unwrap(),
+            FlashGeometry {
+                peb_size: Some(131_072),
+                leb_size: Some(126_976),
+                min_io_size: Some(2048),
+                sub_page_size: None,
+                max_leb_count: Some(2048),
+            }
+        );
+    }
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use serde::Deserialize;
+use std::path::PathBuf;
+
+/// Where the FPGA bitstream is installed: programmed into the FPGA right
+/// away, or written to the config flash it is loaded from on boot.
+#[derive(Clone, Debug, Deserialize, PartialEq)]
+#[serde(rename_all = "lowercase", tag = "target-type", content = "target")]
+pub enum FpgaTarget {
+    /// Linux FPGA manager the bitstream is programmed through, as
+    /// `fpga0`.
+    FpgaManager(String),
+    /// Config flash partition, as a QSPI one, given by its device.
+    Device(PathBuf),
+    /// Config flash partition, given by its MTD name.
+    MTDName(String),
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn deserialize() {
+        assert_eq!(
+            FpgaTarget::FpgaManager("fpga0".to_string()),
+            serde_json::from_value::<FpgaTarget>(json!({
+                "target-type": "fpgamanager",
+                "target": "fpga0",
+            }))
+            .unwrap()
+        );
+        assert_eq!(
+            FpgaTarget::MTDName("qspi-bitstream".to_string()),
+            serde_json::from_value::<FpgaTarget>(json!({
+                "target-type": "mtdname",
+                "target": "qspi-bitstream",
+            }))
+            .unwrap()
+        );
+        assert!(serde_json::from_value::<FpgaTarget>(json!({
+            "target-type": "ubivolume",
+            "target": "bitstream",
+        }))
+        .is_err());
+    }
+}
@@ -4,20 +4,32 @@
 
 mod chunk_size;
 mod count;
+mod erase;
 mod filesystem;
+mod flash_geometry;
+mod fpga_target;
 pub mod install_if_different;
+mod partition;
+mod read_only;
 mod skip;
 mod target_format;
 pub mod target_permissions;
 mod target_type;
 mod truncate;
+mod verity;
 
 pub use chunk_size::ChunkSize;
 pub use count::Count;
+pub use erase::Erase;
 pub use filesystem::Filesystem;
+pub use flash_geometry::FlashGeometry;
+pub use fpga_target::FpgaTarget;
 pub use install_if_different::InstallIfDifferent;
+pub use partition::Partition;
+pub use read_only::ReadOnly;
 pub use skip::Skip;
 pub use target_format::TargetFormat;
 pub use target_permissions::TargetPermissions;
 pub use target_type::TargetType;
 pub use truncate::Truncate;
+pub use verity::Verity;
@@ -0,0 +1,38 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use serde::Deserialize;
+
+/// Partition of a disk, given by its number, as `3`, or by its GPT
+/// partition name, as `"data"`.
+#[derive(Clone, Debug, Deserialize, PartialEq)]
+#[serde(untagged)]
+pub enum Partition {
+    Number(u32),
+    Name(String),
+}
+
+impl std::fmt::Display for Partition {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        match self {
+            Partition::Number(n) => write!(f, "{}", n),
+            Partition::Name(s) => write!(f, "{:?}", s),
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn deserialize() {
+        assert_eq!(
+            vec![Partition::Number(3), Partition::Name("data".to_string())],
+            serde_json::from_value::<Vec<Partition>>(json!([3, "data"])).unwrap()
+        );
+    }
+}
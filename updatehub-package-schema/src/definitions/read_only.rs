@@ -0,0 +1,41 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use serde::Deserialize;
+
+/// How the object is written to a target which is mounted read-only, as
+/// the root filesystem of the device, possibly under an overlay.
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq)]
+#[serde(rename_all = "kebab-case")]
+pub enum ReadOnly {
+    /// The target is remounted read-write while the object is written,
+    /// and back read-only afterwards.
+    Remount,
+    /// The object is written to the upper directory of the overlay the
+    /// target is the lower directory of, leaving the target untouched.
+    UpperDir,
+    /// The object is staged in the pending directory, and only applied
+    /// to the target once the device has rebooted.
+    Pending,
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn deserialize() {
+        assert_eq!(
+            serde_json::from_value::<ReadOnly>(json!("remount")).ok(),
+            Some(ReadOnly::Remount)
+        );
+        assert_eq!(
+            serde_json::from_value::<ReadOnly>(json!("upper-dir")).ok(),
+            Some(ReadOnly::UpperDir)
+        );
+        assert!(serde_json::from_value::<ReadOnly>(json!("overlay")).is_err());
+    }
+}
@@ -12,6 +12,8 @@ pub enum TargetType {
     Device(PathBuf),
     UBIVolume(String),
     MTDName(String),
+    /// LVM logical volume, as `vg/lv`.
+    LVMVolume(String),
 }
 
 #[cfg(test)]
@@ -38,5 +40,13 @@ mod test {
             }))
             .unwrap()
         );
+        assert_eq!(
+            TargetType::LVMVolume("vg0/rootfs_b".to_string()),
+            serde_json::from_value::<TargetType>(json!({
+                "target-type": "lvmvolume",
+                "target": "vg0/rootfs_b",
+            }))
+            .unwrap()
+        );
     }
 }
@@ -0,0 +1,69 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use serde::Deserialize;
+use std::path::PathBuf;
+
+/// dm-verity information of an object used as a verified root
+/// filesystem.
+#[derive(PartialEq, Debug, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct Verity {
+    /// The expected root hash of the hash tree.
+    pub root_hash: String,
+    /// Device holding the hash tree. When not set, the hash tree is
+    /// expected to be appended to the data device.
+    #[serde(default)]
+    pub hash_device: Option<PathBuf>,
+    /// Offset, in bytes, where the hash tree starts in the hash device.
+    #[serde(default)]
+    pub hash_offset: u64,
+    /// Bootloader environment variable used to hand off the root hash.
+    #[serde(default)]
+    pub root_hash_variable: Option<String>,
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn deserialize() {
+        assert_eq!(
+            serde_json::from_value::<Verity>(json!({
+                "root-hash": "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076",
+                "hash-device": "/dev/sdb3",
+                "root-hash-variable": "verity_root_hash"
+            }))
+            .unwrap(),
+            Verity {
+                root_hash: "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076"
+                    .to_string(),
+                hash_device: Some(PathBuf::from("/dev/sdb3")),
+                hash_offset: 0,
+                root_hash_variable: Some("verity_root_hash".to_string()),
+            }
+        );
+    }
+
+    #[test]
+    fn deserialize_appended_hash_tree() {
+        assert_eq!(
+            serde_json::from_value::<Verity>(json!({
+                "root-hash": "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076",
+                "hash-offset": 1_048_576
+            }))
+            .unwrap(),
+            Verity {
+                root_hash: "4392712ba01368efdf14b05c76f9e4df0d53664630b5d48632ed17a137f39076"
+                    .to_string(),
+                hash_device: None,
+                hash_offset: 1_048_576,
+                root_hash_variable: None,
+            }
+        );
+    }
+}
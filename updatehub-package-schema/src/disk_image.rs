@@ -0,0 +1,54 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::definitions::{Partition, TargetType};
+use serde::Deserialize;
+
+/// Image of a whole disk, along with its GPT or MBR partition table,
+/// reflashing the device as a recovery would while keeping some of its
+/// partitions, as the one holding the user data.
+#[derive(Deserialize, PartialEq, Debug)]
+#[serde(rename_all = "kebab-case")]
+pub struct DiskImage {
+    pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
+    pub size: u64,
+    pub sha256sum: String,
+    #[serde(flatten)]
+    pub target: TargetType,
+
+    /// Partitions of the disk which are kept as they are. They must be
+    /// laid out in the image as they are in the disk.
+    #[serde(default)]
+    pub preserve_partitions: Vec<Partition>,
+}
+
+#[test]
+fn deserialize() {
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    assert_eq!(
+        DiskImage {
+            filename: "disk.img".to_string(),
+            roles: Vec::default(),
+            size: 1024,
+            sha256sum: "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
+                .to_string(),
+            target: TargetType::Device(std::path::PathBuf::from("/dev/mmcblk0")),
+
+            preserve_partitions: vec![Partition::Name("data".to_string())],
+        },
+        serde_json::from_value::<DiskImage>(json!({
+            "filename": "disk.img",
+            "size": 1024,
+            "sha256sum": "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722",
+            "target-type": "device",
+            "target": "/dev/mmcblk0",
+            "preserve-partitions": ["data"],
+        }))
+        .unwrap()
+    );
+}
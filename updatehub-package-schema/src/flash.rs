@@ -2,19 +2,29 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::definitions::{InstallIfDifferent, TargetType};
+use crate::definitions::{FlashGeometry, InstallIfDifferent, TargetType};
 use serde::Deserialize;
 
 #[derive(Deserialize, PartialEq, Debug)]
 #[serde(rename_all = "kebab-case")]
 pub struct Flash {
     pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
     pub size: u64,
     pub sha256sum: String,
     #[serde(flatten)]
     pub target: TargetType,
 
     pub install_if_different: Option<InstallIfDifferent>,
+    /// Geometry the image has been built for, checked against the target
+    /// before installing.
+    #[serde(default)]
+    pub geometry: Option<FlashGeometry>,
+    /// Whether the whole target is erased before being written, the
+    /// device default being taken when unset.
+    #[serde(default)]
+    pub erase: Option<bool>,
 }
 
 #[test]
@@ -25,12 +35,15 @@ fn deserialize() {
     assert_eq!(
         Flash {
             filename: "etc/passwd".to_string(),
+            roles: Vec::default(),
             size: 1024,
             sha256sum: "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
                 .to_string(),
             target: TargetType::Device(std::path::PathBuf::from("/dev/sda")),
 
             install_if_different: None,
+            geometry: None,
+            erase: None,
         },
         serde_json::from_value::<Flash>(json!({
             "filename": "etc/passwd",
@@ -0,0 +1,54 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::definitions::FpgaTarget;
+use serde::Deserialize;
+
+/// FPGA bitstream, as the programmable logic of the Zynq or Cyclone
+/// SoCs, updated along with the rest of the device.
+#[derive(Deserialize, PartialEq, Debug)]
+#[serde(rename_all = "kebab-case")]
+pub struct Fpga {
+    pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
+    pub size: u64,
+    pub sha256sum: String,
+    #[serde(flatten)]
+    pub target: FpgaTarget,
+
+    /// Whether the bitstream only reconfigures a region of the FPGA,
+    /// leaving the rest of the logic running. Only taken when it is
+    /// programmed through the FPGA manager.
+    #[serde(default)]
+    pub partial: bool,
+}
+
+#[test]
+fn deserialize() {
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    assert_eq!(
+        Fpga {
+            filename: "system.bit.bin".to_string(),
+            roles: Vec::default(),
+            size: 1024,
+            sha256sum: "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
+                .to_string(),
+            target: FpgaTarget::FpgaManager("fpga0".to_string()),
+
+            partial: true,
+        },
+        serde_json::from_value::<Fpga>(json!({
+            "filename": "system.bit.bin",
+            "size": 1024,
+            "sha256sum": "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722",
+            "target-type": "fpgamanager",
+            "target": "fpga0",
+            "partial": true,
+        }))
+        .unwrap()
+    );
+}
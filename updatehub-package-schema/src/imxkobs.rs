@@ -9,6 +9,8 @@ use std::path::PathBuf;
 #[derive(Deserialize, PartialEq, Debug)]
 pub struct Imxkobs {
     pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
     pub size: u64,
     pub sha256sum: String,
 
@@ -32,6 +34,7 @@ fn deserialize() {
     assert_eq!(
         Imxkobs {
             filename: "imxkobs-filename".to_string(),
+            roles: Vec::default(),
             size: 1024,
             sha256sum: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
                 .to_string(),
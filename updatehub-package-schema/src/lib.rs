@@ -2,11 +2,15 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
+mod agent;
 mod copy;
+mod disk_image;
 mod flash;
+mod fpga;
 mod imxkobs;
 mod mender;
 mod raw;
+mod script;
 mod tarball;
 mod test;
 mod ubifs;
@@ -19,11 +23,14 @@ pub mod definitions;
 /// Objects representing each possible install mode
 pub mod objects {
     pub use crate::{
-        copy::Copy, flash::Flash, imxkobs::Imxkobs, raw::Raw, tarball::Tarball, test::Test,
-        ubifs::Ubifs,
+        agent::Agent, copy::Copy, disk_image::DiskImage, flash::Flash, fpga::Fpga,
+        imxkobs::Imxkobs, raw::Raw, script::Script, tarball::Tarball, test::Test, ubifs::Ubifs,
     };
 }
-pub use update_package::{SupportedHardware, UpdatePackage};
+pub use update_package::{
+    EncryptedObject, Encryption, EncryptionAlgorithm, Hardware, SupportedHardware, Target,
+    UpdatePackage,
+};
 
 use serde::Deserialize;
 
@@ -32,10 +39,15 @@ use serde::Deserialize;
 #[serde(tag = "mode")]
 #[serde(rename_all = "lowercase")]
 pub enum Object {
+    Agent(Box<objects::Agent>),
     Copy(Box<objects::Copy>),
+    #[serde(rename = "disk-image")]
+    DiskImage(Box<objects::DiskImage>),
     Flash(Box<objects::Flash>),
+    Fpga(Box<objects::Fpga>),
     Imxkobs(Box<objects::Imxkobs>),
     Raw(Box<objects::Raw>),
+    Script(Box<objects::Script>),
     Tarball(Box<objects::Tarball>),
     Test(Box<objects::Test>),
     Ubifs(Box<objects::Ubifs>),
@@ -2,13 +2,18 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::definitions::{ChunkSize, Count, InstallIfDifferent, Skip, TargetType, Truncate};
+use crate::definitions::{
+    ChunkSize, Count, Erase, InstallIfDifferent, Skip, TargetType, Truncate, Verity,
+};
 use serde::Deserialize;
+use std::path::PathBuf;
 
 #[derive(Deserialize, PartialEq, Debug)]
 #[serde(rename_all = "kebab-case")]
 pub struct Raw {
     pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
     pub size: u64,
     pub sha256sum: String,
     #[serde(flatten)]
@@ -29,17 +34,31 @@ pub struct Raw {
     pub count: Count,
     #[serde(default)]
     pub truncate: Truncate,
+    #[serde(default)]
+    pub verity: Option<Verity>,
+    /// Enable the target eMMC boot partition to be used for booting
+    /// after it has been successfully written.
+    #[serde(default)]
+    pub enable_boot_partition: bool,
+    /// Devices the object is also written to, in the same pass, as the
+    /// mirror partitions or the redundant bootloader copies.
+    #[serde(default)]
+    pub mirror_targets: Vec<PathBuf>,
+    /// How the range of the target the object is written over is erased
+    /// before it is written. By default, it is written over as it is.
+    #[serde(default)]
+    pub erase: Option<Erase>,
 }
 
 #[test]
 fn deserialize() {
     use pretty_assertions::assert_eq;
     use serde_json::json;
-    use std::path::PathBuf;
 
     assert_eq!(
         Raw {
             filename: "etc/passwd".to_string(),
+            roles: Vec::default(),
             size: 1024,
             sha256sum: "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
                 .to_string(),
@@ -53,6 +72,10 @@ fn deserialize() {
             seek: u64::default(),
             count: Count::default(),
             truncate: Truncate::default(),
+            verity: None,
+            enable_boot_partition: false,
+            mirror_targets: Vec::default(),
+            erase: Some(Erase::Discard),
         },
         serde_json::from_value::<Raw>(json!({
             "filename": "etc/passwd",
@@ -62,7 +85,8 @@ fn deserialize() {
             "target-type": "device",
             "target": "/dev/sdb",
             "compressed": true,
-            "required-uncompressed-size": 2048
+            "required-uncompressed-size": 2048,
+            "erase": "discard"
         }))
         .unwrap()
     );
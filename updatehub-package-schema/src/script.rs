@@ -0,0 +1,61 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use serde::Deserialize;
+
+/// Object installed by a vendor provided executable, which runs inside a
+/// restricted environment receiving the object's content on its standard
+/// input.
+#[derive(Deserialize, PartialEq, Debug)]
+#[serde(rename_all = "kebab-case")]
+pub struct Script {
+    pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
+    pub size: u64,
+    pub sha256sum: String,
+    /// The sha256sum of the package object holding the executable, which
+    /// must be in the same installation set.
+    pub executable: String,
+    /// Extra arguments passed to the executable.
+    #[serde(default)]
+    pub args: Vec<String>,
+
+    /// Maximum address space, in bytes, the executable can use.
+    #[serde(default)]
+    pub memory_limit: Option<u64>,
+    /// Maximum CPU time, in seconds, the executable can use.
+    #[serde(default)]
+    pub cpu_time_limit: Option<u64>,
+}
+
+#[test]
+fn deserialize() {
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    assert_eq!(
+        Script {
+            filename: "firmware.bin".to_string(),
+            roles: Vec::default(),
+            size: 1024,
+            sha256sum: "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
+                .to_string(),
+            executable: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+                .to_string(),
+            args: vec!["--bank".to_string(), "b".to_string()],
+            memory_limit: Some(67_108_864),
+            cpu_time_limit: None,
+        },
+        serde_json::from_value::<Script>(json!({
+            "filename": "firmware.bin",
+            "size": 1024,
+            "sha256sum": "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722",
+            "executable": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+            "args": ["--bank", "b"],
+            "memory-limit": 67_108_864
+        }))
+        .unwrap()
+    );
+}
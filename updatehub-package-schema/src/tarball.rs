@@ -2,7 +2,7 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::definitions::{Filesystem, TargetFormat, TargetType};
+use crate::definitions::{Filesystem, ReadOnly, TargetFormat, TargetType};
 use serde::Deserialize;
 use std::path::PathBuf;
 
@@ -10,6 +10,8 @@ use std::path::PathBuf;
 #[serde(rename_all = "kebab-case")]
 pub struct Tarball {
     pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
     pub filesystem: Filesystem,
     pub size: u64,
     pub sha256sum: String,
@@ -25,6 +27,8 @@ pub struct Tarball {
     pub target_format: TargetFormat,
     #[serde(default)]
     pub mount_options: String,
+    #[serde(default)]
+    pub read_only: Option<ReadOnly>,
 }
 
 #[test]
@@ -35,6 +39,7 @@ fn deserialize() {
     assert_eq!(
         Tarball {
             filename: "etc/passwd".to_string(),
+            roles: Vec::default(),
             filesystem: Filesystem::Ext4,
             size: 1024,
             sha256sum: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
@@ -46,6 +51,7 @@ fn deserialize() {
             required_uncompressed_size: 0,
             target_format: TargetFormat::default(),
             mount_options: String::default(),
+            read_only: None,
         },
         serde_json::from_value::<Tarball>(json!({
             "filename": "etc/passwd",
@@ -8,6 +8,8 @@ use serde::Deserialize;
 #[serde(rename_all = "kebab-case")]
 pub struct Test {
     pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
     pub sha256sum: String,
     pub target: String,
     pub size: u64,
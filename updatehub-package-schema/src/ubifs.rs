@@ -2,13 +2,16 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::definitions::TargetType;
+use crate::definitions::{FlashGeometry, TargetType};
 use serde::Deserialize;
+use std::path::PathBuf;
 
 #[derive(Deserialize, PartialEq, Debug)]
 #[serde(rename_all = "kebab-case")]
 pub struct Ubifs {
     pub filename: String,
+    #[serde(default)]
+    pub roles: Vec<String>,
     pub size: u64,
     pub sha256sum: String,
     #[serde(flatten)]
@@ -18,6 +21,17 @@ pub struct Ubifs {
     pub compressed: bool,
     #[serde(default)]
     pub required_uncompressed_size: u64,
+    /// Size, in bytes, the target volume must have. When set, the
+    /// volume is created, or resized, before installing if needed.
+    #[serde(default)]
+    pub volume_size: Option<u64>,
+    /// UBI device used to create the volume when it does not exist.
+    #[serde(default)]
+    pub ubi_device: Option<PathBuf>,
+    /// Geometry the image has been built for, checked against the target
+    /// before installing.
+    #[serde(default)]
+    pub geometry: Option<FlashGeometry>,
 }
 
 #[test]
@@ -28,6 +42,7 @@ fn deserialize() {
     assert_eq!(
         Ubifs {
             filename: "ubifs".to_string(),
+            roles: Vec::default(),
             size: 1024,
             sha256sum: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
                 .to_string(),
@@ -35,6 +50,9 @@ fn deserialize() {
 
             compressed: true,
             required_uncompressed_size: 2048,
+            volume_size: Some(4096),
+            ubi_device: Some(PathBuf::from("/dev/ubi1")),
+            geometry: Some(FlashGeometry { leb_size: Some(126_976), ..FlashGeometry::default() }),
         },
         serde_json::from_value::<Ubifs>(json!({
             "filename": "ubifs",
@@ -43,7 +61,10 @@ fn deserialize() {
             "target-type": "ubivolume",
             "target": "home",
             "compressed": true,
-            "required-uncompressed-size": 2048
+            "required-uncompressed-size": 2048,
+            "volume-size": 4096,
+            "ubi-device": "/dev/ubi1",
+            "geometry": { "leb-size": 126_976 }
         }))
         .unwrap()
     );
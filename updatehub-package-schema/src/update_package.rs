@@ -2,7 +2,8 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use serde::Deserialize;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
 
 #[derive(Debug, PartialEq, Deserialize)]
 pub struct UpdatePackage {
@@ -11,15 +12,110 @@ pub struct UpdatePackage {
     pub version: String,
     #[serde(default, rename = "supported-hardware")]
     pub supported_hardware: SupportedHardware,
+    #[serde(default, rename = "requires-agent")]
+    pub requires_agent: Option<String>,
+    /// Whether the package must be downloaded even when the device has
+    /// exceeded its data quota.
+    #[serde(default)]
+    pub mandatory: bool,
+    /// Security version of the firmware, which the device refuses to be
+    /// downgraded from.
+    #[serde(default, rename = "security-version")]
+    pub security_version: u64,
+    /// Whether the package may be installed over a firmware of a higher
+    /// security version, as for an authorized downgrade.
+    #[serde(default, rename = "allow-downgrade")]
+    pub allow_downgrade: bool,
+    /// How the objects payloads are encrypted, when the package isn't
+    /// shipped in plain text.
+    #[serde(default)]
+    pub encryption: Option<Encryption>,
+    /// Parts of the device updated by the package, installed in a single
+    /// transaction, in the order they are declared after.
+    #[serde(default)]
+    pub targets: Vec<Target>,
+    /// Time, in seconds, the objects are given to be downloaded, after
+    /// which the update fails.
+    #[serde(default, rename = "download-timeout")]
+    pub download_timeout: Option<u64>,
+    /// Time, in seconds, each object is given to be installed, unless the
+    /// object sets its own `install-timeout`.
+    #[serde(default, rename = "install-timeout")]
+    pub install_timeout: Option<u64>,
     pub objects: (Vec<crate::Object>, Vec<crate::Object>),
 }
 
+/// Part of the device updated by the package, as the root filesystem
+/// slot, the bootloader, the firmware of a microcontroller or a FPGA
+/// bitstream.
+#[derive(Debug, PartialEq, Deserialize)]
+pub struct Target {
+    pub name: String,
+    /// Filenames of the objects installing the target.
+    pub objects: Vec<String>,
+    /// Targets which are installed before this one.
+    #[serde(default)]
+    pub after: Vec<String>,
+    /// Whether the target is backed up before it is written, so it is
+    /// restored when a later target fails.
+    #[serde(default)]
+    pub reversible: bool,
+}
+
+/// Encryption of the objects payloads. The payloads are encrypted with
+/// a content key of the package, which is wrapped for the key of the
+/// devices.
+#[derive(Debug, PartialEq, Deserialize)]
+pub struct Encryption {
+    pub algorithm: EncryptionAlgorithm,
+    /// Content key, encrypted with RSA-OAEP for the public key of the
+    /// device or of its fleet, in hex.
+    #[serde(rename = "wrapped-key")]
+    pub wrapped_key: String,
+    /// Parameters of each encrypted object, by its sha256sum. The objects
+    /// not listed are in plain text.
+    pub objects: BTreeMap<String, EncryptedObject>,
+}
+
+#[derive(Debug, PartialEq, Deserialize)]
+pub enum EncryptionAlgorithm {
+    #[serde(rename = "aes-256-gcm")]
+    Aes256Gcm,
+}
+
+#[derive(Debug, PartialEq, Deserialize)]
+pub struct EncryptedObject {
+    /// Initialization vector, in hex.
+    pub iv: String,
+    /// Authentication tag, in hex.
+    pub tag: String,
+}
+
 #[derive(Debug, PartialEq, Deserialize)]
 #[serde(untagged)]
 pub enum SupportedHardware {
     #[serde(deserialize_with = "any")]
     Any,
-    HardwareList(Vec<String>),
+    HardwareList(Vec<Hardware>),
+}
+
+/// Hardware the package supports.
+#[derive(Debug, PartialEq, Deserialize, Serialize)]
+#[serde(untagged)]
+pub enum Hardware {
+    /// Name of the hardware, which may be a glob pattern, or a regular
+    /// expression when enclosed in slashes.
+    Name(String),
+    /// Revisions of the hardware, the device hardware being named as
+    /// `<hardware>-rev<revision>`. A revision may be a numeric range, as
+    /// `2-4`.
+    Revisions { hardware: String, revisions: Vec<String> },
+}
+
+impl From<&str> for Hardware {
+    fn from(name: &str) -> Self {
+        Hardware::Name(name.to_owned())
+    }
 }
 
 impl Default for SupportedHardware {
@@ -58,7 +154,7 @@ mod tests {
     #[test]
     fn one_hardware() {
         assert_eq!(
-            SupportedHardware::HardwareList(vec!["hw".to_string()]),
+            SupportedHardware::HardwareList(vec!["hw".into()]),
             serde_json::from_str::<SupportedHardware>(&json!(["hw"]).to_string()).unwrap()
         );
     }
@@ -71,4 +167,66 @@ mod tests {
                 .unwrap()
         );
     }
+
+    #[test]
+    fn hardware_revisions() {
+        assert_eq!(
+            SupportedHardware::HardwareList(vec![
+                "hw-*".into(),
+                Hardware::Revisions {
+                    hardware: "board".to_owned(),
+                    revisions: vec!["1".to_owned(), "3-5".to_owned()]
+                }
+            ]),
+            serde_json::from_str::<SupportedHardware>(
+                &json!(["hw-*", { "hardware": "board", "revisions": ["1", "3-5"] }]).to_string()
+            )
+            .unwrap()
+        );
+    }
+
+    #[test]
+    fn targets() {
+        assert_eq!(
+            Target {
+                name: "bootloader".to_owned(),
+                objects: vec!["u-boot.imx".to_owned()],
+                after: vec!["mcu".to_owned()],
+                reversible: true,
+            },
+            serde_json::from_str::<Target>(
+                &json!({
+                    "name": "bootloader",
+                    "objects": ["u-boot.imx"],
+                    "after": ["mcu"],
+                    "reversible": true
+                })
+                .to_string()
+            )
+            .unwrap()
+        );
+    }
+
+    #[test]
+    fn encryption() {
+        let encryption = serde_json::from_str::<Encryption>(
+            &json!({
+                "algorithm": "aes-256-gcm",
+                "wrapped-key": "00ff",
+                "objects": { "sha256sum": { "iv": "01", "tag": "02" } }
+            })
+            .to_string(),
+        )
+        .unwrap();
+        assert_eq!(encryption.algorithm, EncryptionAlgorithm::Aes256Gcm);
+        assert_eq!(encryption.wrapped_key, "00ff");
+        assert_eq!(
+            encryption.objects["sha256sum"],
+            EncryptedObject { iv: "01".to_owned(), tag: "02".to_owned() }
+        );
+
+        assert!(
+            serde_json::from_str::<EncryptionAlgorithm>(&json!("aes-128-cbc").to_string()).is_err()
+        );
+    }
 }
@@ -31,12 +31,21 @@ pub struct Metadata {
     pub version: String,
     /// Hardware where the firmware is running
     pub hardware: String,
-    /// Path for the pub key beeing used
+    /// Path for the pub key beeing used, which may hold several RSA,
+    /// ECDSA or Ed25519 keys while they are rotated, or the URI of the
+    /// key when it is kept in a token
     pub pub_key: Option<PathBuf>,
     /// Device Identity
     pub device_identity: MetadataValue,
     /// Device Attributes
     pub device_attributes: MetadataValue,
+    /// Identity the device had before it has changed, reported along the
+    /// current one until the change is confirmed.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub previous_device_identity: Option<MetadataValue>,
+    /// Update channel the device follows, if set.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub channel: Option<String>,
 }
 
 #[derive(Clone, Debug, Default, PartialEq)]
@@ -3,6 +3,7 @@
 // SPDX-License-Identifier: Apache-2.0
 
 use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
 
 pub mod firmware;
 pub mod runtime_settings;
@@ -16,4 +17,15 @@ pub struct Response {
     pub config: settings::Settings,
     pub firmware: firmware::Metadata,
     pub runtime_settings: runtime_settings::RuntimeSettings,
+    #[serde(default)]
+    pub capabilities: BTreeMap<String, Capability>,
+}
+
+/// Availability of the requirements of an install mode, as tools and
+/// kernel features.
+#[derive(Clone, Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Capability {
+    pub available: bool,
+    pub missing: Vec<String>,
 }
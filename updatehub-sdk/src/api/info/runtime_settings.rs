@@ -2,9 +2,10 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
+use super::firmware::MetadataValue;
 use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
-use std::path::PathBuf;
+use std::{collections::BTreeMap, path::PathBuf};
 
 #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
 #[serde(deny_unknown_fields)]
@@ -13,6 +14,124 @@ pub struct RuntimeSettings {
     pub update: RuntimeUpdate,
     pub path: PathBuf,
     pub persistent: bool,
+    /// Bytes written by the agent to each target device over its
+    /// lifetime, to help predicting the flash wear-out.
+    #[serde(default)]
+    pub device_writes: BTreeMap<PathBuf, DeviceWrites>,
+    /// Bytes transferred by the agent to and from the server in each
+    /// calendar month, as `2020-05`, for the devices on metered links.
+    #[serde(default)]
+    pub bandwidth: BTreeMap<String, Bandwidth>,
+    /// Counters kept over the device lifetime, across reboots.
+    #[serde(default)]
+    pub counters: Counters,
+    /// Update being handled, kept so it is resumed when the agent is
+    /// restarted in the middle of it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub transaction: Option<Transaction>,
+    /// Update packages requested while another one was being handled,
+    /// in the order they are going to be installed.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub pending_packages: Vec<PendingPackage>,
+    /// Settings changed through the agent API, by their dotted key, which
+    /// are applied over the configuration file.
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub settings: BTreeMap<String, String>,
+    /// Device identity last seen, kept to detect it changing.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub device_identity: Option<MetadataValue>,
+    /// Change of the device identity awaiting to be confirmed.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub identity_change: Option<IdentityChange>,
+    /// What has been last installed into each installation set, kept so
+    /// the inactive one can be checked before rolling back into it.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub installations: Vec<InstallationRecord>,
+    /// Activations of each installation set which have failed since an
+    /// image was last installed into it.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub activation_failures: Vec<ActivationFailures>,
+    /// Objects written by the install in progress, kept so an install
+    /// interrupted by a failure or a power loss is reverted or resumed.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub journal: Option<Journal>,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Journal {
+    /// Update package metadata the objects are taken from.
+    pub package: String,
+    /// Base64 encoded signature of the update package, if any.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub signature: Option<String>,
+    pub installation_set: InstallationSet,
+    #[serde(default)]
+    pub objects: Vec<JournalObject>,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct JournalObject {
+    /// Index of the object in the objects of the installation set.
+    pub index: usize,
+    pub sha256sum: String,
+    /// Device the object is written into, if any.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub target: Option<PathBuf>,
+    /// sha256sum of the target region before the object was written,
+    /// for the reversible targets, whose pre-image is kept.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub previous_sha256sum: Option<String>,
+    /// Whether the object has been completely written.
+    pub completed: bool,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct ActivationFailures {
+    pub installation_set: InstallationSet,
+    pub count: u32,
+    /// Package which has last failed to be activated, if known.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub package_uid: Option<String>,
+    /// When the set has been quarantined, so it is no longer activated
+    /// until an image is installed into it again.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub quarantined_at: Option<DateTime<Utc>>,
+    /// Whether the quarantine has been reported to the server.
+    #[serde(default)]
+    pub reported: bool,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct InstallationRecord {
+    pub installation_set: InstallationSet,
+    pub package_uid: String,
+    pub version: String,
+    pub time: DateTime<Utc>,
+    /// Regions written into the devices of the set, which can be checked
+    /// for changes afterwards.
+    #[serde(default)]
+    pub regions: Vec<InstalledRegion>,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct InstalledRegion {
+    pub target: PathBuf,
+    pub offset: u64,
+    pub size: u64,
+    pub sha256sum: String,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct IdentityChange {
+    /// Identity the device had before the change.
+    pub previous: MetadataValue,
+    pub time: DateTime<Utc>,
 }
 
 #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
@@ -22,6 +141,23 @@ pub struct RuntimePolling {
     pub retries: usize,
     pub now: bool,
     pub server_address: ServerAddress,
+    /// Server which has last answered the probe, the update is then
+    /// downloaded from and reported to.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub active_server: Option<String>,
+    /// Boot clock reading at the last polling, so the time elapsed since
+    /// it isn't thrown off by the wall clock being stepped.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_boottime: Option<BootTime>,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct BootTime {
+    /// Id of the boot the clock has been read in.
+    pub boot_id: String,
+    /// Milliseconds elapsed since the boot, suspended time included.
+    pub elapsed_ms: i64,
 }
 
 #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
@@ -38,6 +174,80 @@ pub struct RuntimeUpdate {
     pub upgrade_to_installation: Option<InstallationSet>,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub applied_package_uid: Option<String>,
+    /// Step of the update chain being installed, when the server sends
+    /// packages to be installed in sequence across reboots.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub chain: Option<UpdateChain>,
+    /// Outcome of the last update handled by the agent.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_result: Option<UpdateResult>,
+    /// Package the server has last offered, unset once the server reports
+    /// the device as up to date.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub desired: Option<DesiredPackage>,
+    /// Security version of the firmware the device runs. Packages with a
+    /// lower one are refused, unless they allow the downgrade.
+    #[serde(default)]
+    pub security_version: u64,
+    /// Security version of the package installed, which becomes the one
+    /// of the device once it is booted into.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pending_security_version: Option<u64>,
+    /// Update package the pending security version is taken from, so the
+    /// privileged installer takes it from the package itself.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pending_security_package: Option<SignedPackage>,
+    /// Update attempt being handled, recorded to the audit trail once
+    /// its outcome is known, which may be after rebooting into it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub attempt: Option<crate::api::audit::Attempt>,
+    /// Boot id of the device when the update has been installed, set
+    /// while the device awaits the application to reboot it.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub reboot_required: Option<String>,
+    /// Boot clock reading the installation booted into must be confirmed
+    /// by, kept so restarting the agent doesn't give it more time.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub confirmation_deadline: Option<BootTime>,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct DesiredPackage {
+    pub package_uid: String,
+    pub version: String,
+}
+
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct UpdateChain {
+    /// Position of the package in the chain, starting at one.
+    pub step: usize,
+    pub length: usize,
+}
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct UpdateResult {
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub package_uid: Option<String>,
+    pub outcome: UpdateOutcome,
+    pub time: DateTime<Utc>,
+    /// Why the update has failed, if it has.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+#[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum UpdateOutcome {
+    /// The update has been booted into and validated.
+    Installed,
+    /// The update has been rolled back, after booted into.
+    RolledBack,
+    /// The update has failed before the device was rebooted into it.
+    Failed,
+    Canceled,
 }
 
 #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
@@ -46,3 +256,72 @@ pub enum InstallationSet {
     A,
     B,
 }
+
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Transaction {
+    /// Update package metadata, as received from the server.
+    pub package: String,
+    /// Base64 encoded signature of the update package, if any.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub signature: Option<String>,
+    /// Last state the update has entered.
+    pub state: String,
+    /// Objects already installed, by their sha256sum.
+    #[serde(default)]
+    pub installed_objects: Vec<String>,
+    /// How many times the update has been resumed after being
+    /// interrupted.
+    #[serde(default)]
+    pub attempts: u32,
+}
+
+/// Update package metadata along with its signature, which the privileged
+/// installer validates before taking anything from it.
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct SignedPackage {
+    pub package: String,
+    /// Base64 encoded signature of the update package, if any.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub signature: Option<String>,
+}
+
+/// Update package to be installed once the current one is done with.
+#[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum PendingPackage {
+    File(PathBuf),
+    Url(String),
+}
+
+#[derive(Clone, Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct DeviceWrites {
+    /// Size of the objects installed into the device.
+    pub object_bytes: u64,
+    /// Bytes the device reported as written while the objects were
+    /// installed, only known for block devices. Compared to the objects
+    /// size, it gives the write amplification.
+    pub device_bytes: u64,
+}
+
+#[derive(Clone, Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Counters {
+    /// Updates handled, whatever their outcome.
+    pub updates_attempted: u64,
+    /// Updates booted into and validated.
+    pub updates_succeeded: u64,
+    /// Updates rolled back after booted into.
+    pub rollbacks: u64,
+    /// Bytes downloaded from the server.
+    pub bytes_downloaded: u64,
+}
+
+#[derive(Clone, Debug, Default, Deserialize, PartialEq, Serialize)]
+#[serde(deny_unknown_fields)]
+pub struct Bandwidth {
+    pub downloaded: u64,
+    pub uploaded: u64,
+}
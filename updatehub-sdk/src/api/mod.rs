@@ -50,6 +50,10 @@ pub mod state {
     pub struct Response {
         pub busy: bool,
         pub current_state: String,
+        /// Position of the request in the queue of pending packages, when
+        /// it is queued as the agent is busy.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub queue_position: Option<usize>,
     }
 }
 
@@ -69,9 +73,589 @@ pub mod abort_download {
     }
 }
 
+pub mod pause_download {
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod resume_download {
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod cancel_update {
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod confirm_update {
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod approve_update {
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod deny_update {
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod go_ahead {
+    use chrono::{DateTime, Utc};
+    use serde::{Deserialize, Serialize};
+
+    /// Go-ahead of an external scheduler to install the update the agent
+    /// has announced as ready, by the `token` of the announcement. It is
+    /// refused once `expires_at` has passed.
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Request {
+        pub token: String,
+        pub expires_at: DateTime<Utc>,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod confirm_identity {
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod dry_run {
+    use serde::{Deserialize, Serialize};
+    use std::path::PathBuf;
+
+    /// Package to be checked, either a local file or an URL to download
+    /// it from.
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(rename_all = "lowercase")]
+    pub enum Request {
+        File(PathBuf),
+        Url(String),
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        /// Whether the package would be installed.
+        pub installable: bool,
+        pub package_uid: String,
+        pub version: String,
+        /// Reasons for the whole package to be refused.
+        pub issues: Vec<String>,
+        pub objects: Vec<Object>,
+        pub estimated_downtime: Downtime,
+    }
+
+    /// Estimate, in seconds, of how long the device is unavailable while
+    /// the package is installed and activated.
+    #[derive(Clone, Copy, Debug, Default, Deserialize, PartialEq, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Downtime {
+        /// Install of the objects which aren't installed live.
+        pub install: u64,
+        pub reboot: u64,
+        /// Time the new installation has to be confirmed in, once booted.
+        pub soak: u64,
+        pub total: u64,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Object {
+        pub filename: String,
+        pub sha256sum: String,
+        pub mode: String,
+        pub target: Option<PathBuf>,
+        pub action: Action,
+        /// Reasons for the object to fail to be installed.
+        pub issues: Vec<String>,
+    }
+
+    /// What would be done with the object.
+    #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(rename_all = "snake_case")]
+    pub enum Action {
+        Install,
+        /// Skipped as its install if different rule matches the target.
+        Skip,
+        /// The install if different rule can't be evaluated without
+        /// mounting the target, so it is only known on install.
+        Undetermined,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod rollback {
+    use super::info::runtime_settings::{InstallationRecord, InstallationSet};
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Default, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Request {
+        /// Whether the device is rolled back into the inactive set once
+        /// it passes the checks, instead of only checking it.
+        #[serde(default)]
+        pub execute: bool,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        /// Installation set the device would be rolled back into.
+        pub installation_set: InstallationSet,
+        /// What has been last installed into the set, if known.
+        pub record: Option<InstallationRecord>,
+        pub checks: Vec<Check>,
+        /// Whether the set has passed all checks.
+        pub ready: bool,
+        /// Whether the rollback has been started, rebooting the device.
+        pub executed: bool,
+    }
+
+    #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Check {
+        pub name: String,
+        pub status: CheckStatus,
+        pub detail: Option<String>,
+    }
+
+    #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(rename_all = "lowercase")]
+    pub enum CheckStatus {
+        Passed,
+        Failed,
+        /// The check can't be run for the set, as when the device has no
+        /// bootability probe.
+        Skipped,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod config {
+    use serde::{Deserialize, Serialize};
+
+    /// Setting to be changed, by its dotted key, as `polling.interval`,
+    /// and the value as it would be written in the configuration file.
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Request {
+        pub key: String,
+        pub value: String,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub message: String,
+        /// Whether the setting only takes effect once the agent is
+        /// restarted.
+        pub restart_required: bool,
+    }
+
+    /// Settings changed in the configuration file, by their dotted keys,
+    /// once it is reloaded.
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct ReloadResponse {
+        /// Settings applied right away.
+        pub applied: Vec<String>,
+        /// Settings only taking effect once the agent is restarted.
+        pub restart_required: Vec<String>,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod jobs {
+    use serde::{Deserialize, Serialize};
+
+    /// Operation run as a job, once the jobs submitted before it are done.
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(rename_all = "snake_case")]
+    pub enum Request {
+        Probe {
+            #[serde(default)]
+            custom_server: Option<String>,
+        },
+        LocalInstall(super::local_install::Request),
+        DryRun(super::dry_run::Request),
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Job {
+        pub id: u64,
+        pub request: Request,
+        pub status: Status,
+        /// What the operation has resulted in, once the job is finished.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub outcome: Option<Outcome>,
+    }
+
+    #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(rename_all = "snake_case")]
+    pub enum Status {
+        Queued,
+        Running,
+        Finished,
+        Canceled,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(rename_all = "snake_case")]
+    pub enum Outcome {
+        Probe(super::probe::Response),
+        /// The agent has been busy, or has accepted the package.
+        State(super::state::Response),
+        DryRun(super::dry_run::Response),
+        Error(String),
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Refused {
+        pub error: String,
+    }
+}
+
+pub mod firmware {
+    use super::info::{
+        firmware::Metadata,
+        runtime_settings::{InstallationSet, UpdateResult},
+    };
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub metadata: Metadata,
+        /// Installation set the device has booted from.
+        pub active_installation_set: InstallationSet,
+        /// Installation set the updates are installed into.
+        pub inactive_installation_set: InstallationSet,
+        /// Outcome of the last update handled by the agent, if any.
+        pub last_update: Option<UpdateResult>,
+        /// Whether the installation booted from awaits to be confirmed.
+        pub awaiting_confirmation: bool,
+        /// Installation sets which are no longer activated, as they have
+        /// repeatedly failed to be.
+        #[serde(default)]
+        pub quarantined_installation_sets: Vec<InstallationSet>,
+    }
+}
+
+pub mod twin {
+    use super::info::runtime_settings::{DesiredPackage, UpdateResult};
+    use serde::{Deserialize, Serialize};
+
+    /// Update state of the device, as the desired and the reported state
+    /// of a device twin.
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        /// Package the server wants the device to run, unset when the
+        /// device is up to date.
+        pub desired: Option<DesiredPackage>,
+        pub reported: Reported,
+        /// Whether the device runs the desired package.
+        pub in_sync: bool,
+    }
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Reported {
+        /// Firmware version the device runs.
+        pub version: String,
+        /// State the agent is in.
+        pub state: String,
+        pub last_update: Option<UpdateResult>,
+    }
+}
+
+pub mod enrollment {
+    use chrono::{DateTime, Utc};
+    use serde::{Deserialize, Serialize};
+
+    /// Enrollment of the device with the server, which issues the
+    /// credentials of its requests.
+    #[derive(Clone, Debug, Default, Deserialize, PartialEq, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        pub status: Status,
+        /// When the device has been enrolled.
+        pub enrolled_at: Option<DateTime<Utc>>,
+        /// Why the last enrollment attempt has failed, if it has.
+        pub error: Option<String>,
+    }
+
+    #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(rename_all = "lowercase")]
+    pub enum Status {
+        /// The device isn't enrolled by the agent.
+        Disabled,
+        /// The device is enrolled before it is next probed.
+        Pending,
+        Enrolled,
+    }
+
+    impl Default for Status {
+        fn default() -> Self {
+            Status::Disabled
+        }
+    }
+}
+
+pub mod progress {
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Response {
+        /// Object being handled, if an update is downloaded or installed.
+        pub current: Option<Progress>,
+    }
+
+    #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Progress {
+        pub stage: Stage,
+        pub object: String,
+        pub mode: String,
+        /// Position of the object in the package, starting at zero.
+        pub index: usize,
+        pub count: usize,
+        /// Bytes of the object handled so far.
+        pub done: u64,
+        pub total: u64,
+        pub percentage: u8,
+    }
+
+    #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(rename_all = "lowercase")]
+    pub enum Stage {
+        Download,
+        Install,
+    }
+}
+
+pub mod events {
+    use serde::{Deserialize, Serialize};
+
+    /// Event streamed by the agent, as Server-Sent Events, to the clients
+    /// of the events endpoint.
+    #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(tag = "event", rename_all = "kebab-case")]
+    pub enum Event {
+        /// The agent has moved into the `state`.
+        State { state: String },
+        /// Progress of the object being downloaded or installed.
+        Progress { progress: super::progress::Progress },
+        /// The update has failed with the error `message`.
+        Error { message: String },
+        /// The update is downloaded and verified, waiting for the
+        /// go-ahead of an external scheduler, given with the `token`.
+        ReadyToInstall { package_uid: String, version: String, token: String },
+    }
+}
+
+pub mod audit {
+    use super::info::runtime_settings::UpdateOutcome;
+    use chrono::{DateTime, Utc};
+    use serde::{Deserialize, Serialize};
+
+    #[derive(Clone, Debug, Default, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Request {
+        /// Update package the entries are of.
+        pub package_uid: Option<String>,
+        /// Most recent entries to return, all of them when unset.
+        pub limit: Option<usize>,
+    }
+
+    /// Update attempt, as recorded to the audit trail once it is over.
+    #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+    pub struct Entry {
+        #[serde(flatten)]
+        pub attempt: Attempt,
+        pub outcome: UpdateOutcome,
+        pub finished_at: DateTime<Utc>,
+        /// Milliseconds from the attempt start to its outcome.
+        pub duration: u64,
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub error: Option<String>,
+    }
+
+    /// Update attempt being handled.
+    #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Attempt {
+        pub package_uid: String,
+        /// Firmware version the device was running.
+        pub version_from: String,
+        pub version_to: String,
+        pub trigger: Trigger,
+        pub started_at: DateTime<Utc>,
+        #[serde(default)]
+        pub objects: Vec<ObjectResult>,
+    }
+
+    #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(rename_all = "kebab-case")]
+    pub enum Trigger {
+        /// The server has offered the update when polled.
+        Poll,
+        /// The server has offered the update when probed through the
+        /// agent API.
+        ApiProbe,
+        LocalInstall,
+        RemoteInstall,
+        /// The update has been requested while another one was being
+        /// handled.
+        Queued,
+        /// The update has been installed by the `install` command, as from
+        /// removable media or at the factory.
+        Command,
+    }
+
+    #[derive(Clone, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct ObjectResult {
+        pub sha256sum: String,
+        pub filename: String,
+        pub mode: String,
+        pub status: ObjectStatus,
+        /// Milliseconds the object has taken to be installed.
+        #[serde(default, skip_serializing_if = "Option::is_none")]
+        pub duration: Option<u64>,
+    }
+
+    #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
+    #[serde(rename_all = "kebab-case")]
+    pub enum ObjectStatus {
+        /// The object was being installed when the update was left.
+        Started,
+        Installed,
+        Failed,
+    }
+}
+
 pub mod log {
     use serde::{Deserialize, Serialize};
-    use std::collections::HashMap;
+    use std::{collections::HashMap, fmt};
+
+    #[derive(Clone, Debug, Default, Deserialize, Serialize)]
+    #[serde(deny_unknown_fields)]
+    pub struct Request {
+        /// Least severe level of the entries to return.
+        pub level: Option<Level>,
+    }
 
     #[derive(Clone, Debug, Deserialize, Serialize)]
     #[serde(deny_unknown_fields)]
@@ -82,7 +666,7 @@ pub mod log {
         pub data: HashMap<String, String>,
     }
 
-    #[derive(Clone, Debug, Deserialize, Serialize)]
+    #[derive(Clone, Copy, Debug, Deserialize, PartialEq, Serialize)]
     #[serde(rename_all = "lowercase")]
     pub enum Level {
         Critical,
@@ -92,4 +676,17 @@ pub mod log {
         Debug,
         Trace,
     }
+
+    impl fmt::Display for Level {
+        fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+            f.write_str(match self {
+                Level::Critical => "critical",
+                Level::Error => "error",
+                Level::Warning => "warning",
+                Level::Info => "info",
+                Level::Debug => "debug",
+                Level::Trace => "trace",
+            })
+        }
+    }
 }
@@ -23,6 +23,13 @@ impl Client {
         Client { server_address: format!("http://{}", server_address), ..Self::default() }
     }
 
+    /// Sends the `token` as a bearer token, as required by the agent to
+    /// handle the control requests, and the info, log and events ones,
+    /// when authentication is enabled.
+    pub fn with_token(self, token: &str) -> Self {
+        Client { client: awc::Client::build().bearer_auth(token).finish(), ..self }
+    }
+
     pub async fn info(&self) -> Result<api::info::Response> {
         let mut response = self.client.get(&format!("{}/info", self.server_address)).send().await?;
 
@@ -65,6 +72,25 @@ impl Client {
         }
     }
 
+    /// Uploads the package `file` to the agent to be installed, for
+    /// devices the package isn't available on.
+    pub async fn upload(&self, file: &Path) -> Result<api::state::Response> {
+        let mut response = self
+            .client
+            .post(&format!("{}/upload", self.server_address))
+            .content_type("application/octet-stream")
+            .send_body(std::fs::read(file)?)
+            .await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::UNPROCESSABLE_ENTITY => {
+                Err(Error::AgentIsBusy(response.json::<api::state::Response>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
     pub async fn remote_install(&self, url: &str) -> Result<api::state::Response> {
         let mut response = self
             .client
@@ -94,8 +120,299 @@ impl Client {
         }
     }
 
-    pub async fn log(&self) -> Result<Vec<api::log::Entry>> {
-        let mut response = self.client.get(&format!("{}/log", self.server_address)).send().await?;
+    pub async fn pause_download(&self) -> Result<api::pause_download::Response> {
+        let mut response = self
+            .client
+            .post(&format!("{}/update/download/pause", self.server_address))
+            .send()
+            .await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => Err(Error::PauseDownloadRefused(
+                response.json::<api::pause_download::Refused>().await?,
+            )),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn resume_download(&self) -> Result<api::resume_download::Response> {
+        let mut response = self
+            .client
+            .post(&format!("{}/update/download/resume", self.server_address))
+            .send()
+            .await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => Err(Error::ResumeDownloadRefused(
+                response.json::<api::resume_download::Refused>().await?,
+            )),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn cancel_update(&self) -> Result<api::cancel_update::Response> {
+        let mut response =
+            self.client.post(&format!("{}/update/cancel", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => Err(Error::CancelUpdateRefused(
+                response.json::<api::cancel_update::Refused>().await?,
+            )),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn confirm_update(&self) -> Result<api::confirm_update::Response> {
+        let mut response =
+            self.client.post(&format!("{}/update/confirm", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => Err(Error::ConfirmUpdateRefused(
+                response.json::<api::confirm_update::Refused>().await?,
+            )),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn approve_update(&self) -> Result<api::approve_update::Response> {
+        let mut response =
+            self.client.post(&format!("{}/update/approve", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => Err(Error::ApproveUpdateRefused(
+                response.json::<api::approve_update::Refused>().await?,
+            )),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    /// Gives the go-ahead to install the update announced as ready with
+    /// the `token`, as an external scheduler, valid until `expires_at`.
+    pub async fn go_ahead(
+        &self,
+        token: &str,
+        expires_at: chrono::DateTime<chrono::Utc>,
+    ) -> Result<api::go_ahead::Response> {
+        let mut response = self
+            .client
+            .post(&format!("{}/update/go-ahead", self.server_address))
+            .send_json(&api::go_ahead::Request { token: token.to_owned(), expires_at })
+            .await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => {
+                Err(Error::GoAheadRefused(response.json::<api::go_ahead::Refused>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    /// Confirms the device identity change, so the previous identity is
+    /// no longer reported.
+    pub async fn confirm_identity(&self) -> Result<api::confirm_identity::Response> {
+        let mut response =
+            self.client.post(&format!("{}/identity/confirm", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => Err(Error::ConfirmIdentityRefused(
+                response.json::<api::confirm_identity::Refused>().await?,
+            )),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn deny_update(&self) -> Result<api::deny_update::Response> {
+        let mut response =
+            self.client.post(&format!("{}/update/deny", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => {
+                Err(Error::DenyUpdateRefused(response.json::<api::deny_update::Refused>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn dry_run(&self, request: &api::dry_run::Request) -> Result<api::dry_run::Response> {
+        let mut response = self
+            .client
+            .post(&format!("{}/update/dry-run", self.server_address))
+            .send_json(request)
+            .await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => {
+                Err(Error::DryRunFailed(response.json::<api::dry_run::Refused>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    /// Checks the inactive installation set, rolling the device back into
+    /// it when `execute` is set and it passes the checks.
+    pub async fn rollback(&self, execute: bool) -> Result<api::rollback::Response> {
+        let mut response = self
+            .client
+            .post(&format!("{}/update/rollback", self.server_address))
+            .send_json(&api::rollback::Request { execute })
+            .await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => {
+                Err(Error::RollbackRefused(response.json::<api::rollback::Refused>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    /// Changes the setting at the dotted `key`, which is kept across
+    /// the agent restarts.
+    pub async fn set_config(&self, key: &str, value: &str) -> Result<api::config::Response> {
+        let request = api::config::Request { key: key.to_owned(), value: value.to_owned() };
+        let mut response = self
+            .client
+            .post(&format!("{}/config", self.server_address))
+            .send_json(&request)
+            .await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => {
+                Err(Error::ConfigRefused(response.json::<api::config::Refused>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    /// Reloads the configuration file of the agent, applying the settings
+    /// changed in it which don't require the agent to be restarted.
+    pub async fn reload_config(&self) -> Result<api::config::ReloadResponse> {
+        let mut response =
+            self.client.post(&format!("{}/config/reload", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST => {
+                Err(Error::ConfigRefused(response.json::<api::config::Refused>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    /// Submits the `request` as a job, which is run once the jobs
+    /// submitted before it are done.
+    pub async fn submit_job(&self, request: &api::jobs::Request) -> Result<api::jobs::Job> {
+        let mut response =
+            self.client.post(&format!("{}/jobs", self.server_address)).send_json(request).await?;
+
+        match response.status() {
+            StatusCode::ACCEPTED => Ok(response.json().await?),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn job(&self, id: u64) -> Result<api::jobs::Job> {
+        let mut response =
+            self.client.get(&format!("{}/jobs/{}", self.server_address, id)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::NOT_FOUND => {
+                Err(Error::JobRefused(response.json::<api::jobs::Refused>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn cancel_job(&self, id: u64) -> Result<api::jobs::Job> {
+        let mut response =
+            self.client.post(&format!("{}/jobs/{}/cancel", self.server_address, id)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            StatusCode::BAD_REQUEST | StatusCode::NOT_FOUND => {
+                Err(Error::JobRefused(response.json::<api::jobs::Refused>().await?))
+            }
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn firmware(&self) -> Result<api::firmware::Response> {
+        let mut response =
+            self.client.get(&format!("{}/firmware", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn twin(&self) -> Result<api::twin::Response> {
+        let mut response = self.client.get(&format!("{}/twin", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn enrollment(&self) -> Result<api::enrollment::Response> {
+        let mut response =
+            self.client.get(&format!("{}/enrollment", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn progress(&self) -> Result<api::progress::Response> {
+        let mut response =
+            self.client.get(&format!("{}/progress", self.server_address)).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn audit(&self, request: &api::audit::Request) -> Result<Vec<api::audit::Entry>> {
+        let mut query = Vec::default();
+        if let Some(ref package_uid) = request.package_uid {
+            query.push(format!("package_uid={}", package_uid));
+        }
+        if let Some(limit) = request.limit {
+            query.push(format!("limit={}", limit));
+        }
+        let url = if query.is_empty() {
+            format!("{}/audit", self.server_address)
+        } else {
+            format!("{}/audit?{}", self.server_address, query.join("&"))
+        };
+        let mut response = self.client.get(&url).send().await?;
+
+        match response.status() {
+            StatusCode::OK => Ok(response.json().await?),
+            s => Err(Error::UnexpectedResponse(s)),
+        }
+    }
+
+    pub async fn log(&self, level: Option<api::log::Level>) -> Result<Vec<api::log::Entry>> {
+        let url = match level {
+            Some(level) => format!("{}/log?level={}", self.server_address, level),
+            None => format!("{}/log", self.server_address),
+        };
+        let mut response = self.client.get(&url).send().await?;
 
         match response.status() {
             StatusCode::OK => Ok(response.json().await?),
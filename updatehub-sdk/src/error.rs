@@ -14,6 +14,42 @@ pub enum Error {
     #[error("Abort download was refused: {0:?}")]
     AbortDownloadRefused(crate::api::abort_download::Refused),
 
+    #[error("Pause download was refused: {0:?}")]
+    PauseDownloadRefused(crate::api::pause_download::Refused),
+
+    #[error("Resume download was refused: {0:?}")]
+    ResumeDownloadRefused(crate::api::resume_download::Refused),
+
+    #[error("Cancel update was refused: {0:?}")]
+    CancelUpdateRefused(crate::api::cancel_update::Refused),
+
+    #[error("Confirm update was refused: {0:?}")]
+    ConfirmUpdateRefused(crate::api::confirm_update::Refused),
+
+    #[error("Approve update was refused: {0:?}")]
+    ApproveUpdateRefused(crate::api::approve_update::Refused),
+
+    #[error("Go-ahead was refused: {0:?}")]
+    GoAheadRefused(crate::api::go_ahead::Refused),
+
+    #[error("Deny update was refused: {0:?}")]
+    DenyUpdateRefused(crate::api::deny_update::Refused),
+
+    #[error("Config change was refused: {0:?}")]
+    ConfigRefused(crate::api::config::Refused),
+
+    #[error("Confirm identity was refused: {0:?}")]
+    ConfirmIdentityRefused(crate::api::confirm_identity::Refused),
+
+    #[error("Job request was refused: {0:?}")]
+    JobRefused(crate::api::jobs::Refused),
+
+    #[error("Dry run has failed: {0:?}")]
+    DryRunFailed(crate::api::dry_run::Refused),
+
+    #[error("Rollback was refused: {0:?}")]
+    RollbackRefused(crate::api::rollback::Refused),
+
     #[error("Unexpected response: {0:?}")]
     UnexpectedResponse(awc::http::StatusCode),
 
@@ -28,4 +64,7 @@ pub enum Error {
 
     #[error(transparent)]
     JsonPayloadError(#[from] awc::error::JsonPayloadError),
+
+    #[error(transparent)]
+    Io(#[from] std::io::Error),
 }
@@ -83,6 +83,20 @@ async fn local_install() {
     }
 }
 
+#[actix_rt::test]
+async fn upload() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let file = tempfile::NamedTempFile::new().unwrap();
+    let response = client.upload(file.path()).await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::AgentIsBusy(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
 #[actix_rt::test]
 async fn remote_install() {
     let mock = MockServer::new();
@@ -109,11 +123,223 @@ async fn abort_download() {
     }
 }
 
+#[actix_rt::test]
+async fn pause_download() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.pause_download().await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::PauseDownloadRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn resume_download() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.resume_download().await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::ResumeDownloadRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn cancel_update() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.cancel_update().await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::CancelUpdateRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn confirm_update() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.confirm_update().await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::ConfirmUpdateRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn confirm_identity() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.confirm_identity().await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::ConfirmIdentityRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn approve_update() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.approve_update().await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::ApproveUpdateRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn deny_update() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.deny_update().await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::DenyUpdateRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn go_ahead() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.go_ahead("5d41402abc4b2a76b9719d911017c592", chrono::Utc::now()).await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::GoAheadRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn dry_run() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response =
+        client.dry_run(&sdk::api::dry_run::Request::File("/tmp/update.uhupkg".into())).await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::DryRunFailed(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn rollback() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.rollback(false).await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::RollbackRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn config() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.set_config("polling.interval", "1h").await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::ConfigRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn config_reload() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.reload_config().await;
+    match dbg!(response) {
+        Ok(_) => {}
+        Err(sdk::Error::ConfigRefused(_)) => {}
+        Err(e) => panic!("Unexpected Error response: {}", e),
+    }
+}
+
+#[actix_rt::test]
+async fn firmware() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.firmware().await;
+    assert!(dbg!(response).is_ok());
+}
+
+#[actix_rt::test]
+async fn twin() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.twin().await;
+    assert!(dbg!(response).is_ok());
+}
+
+#[actix_rt::test]
+async fn progress() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.progress().await;
+    assert!(dbg!(response).is_ok());
+}
+
 #[actix_rt::test]
 async fn log() {
     let mock = MockServer::new();
     let (addr, _guard) = &mock.start();
     let client = sdk::Client::new(&addr);
-    let response = client.log().await;
+    let response = client.log(None).await;
+    assert!(dbg!(response).is_ok());
+
+    let response = client.log(Some(sdk::api::log::Level::Warning)).await;
+    assert!(dbg!(response).is_ok());
+}
+
+#[actix_rt::test]
+async fn audit() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.audit(&sdk::api::audit::Request::default()).await;
+    assert!(dbg!(response).is_ok());
+
+    let request = sdk::api::audit::Request { package_uid: None, limit: Some(10) };
+    let response = client.audit(&request).await;
+    assert!(dbg!(response).is_ok());
+}
+
+#[actix_rt::test]
+async fn jobs() {
+    let mock = MockServer::new();
+    let (addr, _guard) = &mock.start();
+    let client = sdk::Client::new(&addr);
+    let response = client.submit_job(&sdk::api::jobs::Request::Probe { custom_server: None }).await;
+    assert!(dbg!(response).is_ok());
+
+    let response = client.job(1).await;
     assert!(dbg!(response).is_ok());
 }
@@ -0,0 +1,143 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::utils;
+use pkg_schema::Object;
+use sdk::api::info::Capability;
+use slog_scope::{info, warn};
+use std::{collections::BTreeMap, path::Path};
+
+/// Availability of each install mode requirements, by the mode name.
+pub(crate) type Capabilities = BTreeMap<String, Capability>;
+
+/// Something an install mode depends on to work.
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Requirement {
+    /// Executable which must be found in the `PATH`.
+    Tool(&'static str),
+    /// Kernel feature, available when its interface `path` exists.
+    Kernel { name: &'static str, path: &'static str },
+}
+
+const MTD: Requirement = Requirement::Kernel { name: "mtd", path: "/proc/mtd" };
+const UBI: Requirement = Requirement::Kernel { name: "ubi", path: "/sys/class/ubi" };
+
+// The requirements of each install mode. The modes not listed here have
+// no requirements besides the agent itself.
+const REGISTRY: &[(&str, &[Requirement])] = &[
+    (
+        "flash",
+        &[
+            Requirement::Tool("nandwrite"),
+            Requirement::Tool("flashcp"),
+            Requirement::Tool("flash_erase"),
+            MTD,
+        ],
+    ),
+    ("imxkobs", &[Requirement::Tool("kobs-ng"), MTD]),
+    ("script", &[Requirement::Tool("prlimit"), Requirement::Tool("unshare")]),
+    ("ubifs", &[Requirement::Tool("ubiupdatevol"), UBI]),
+];
+
+impl Requirement {
+    fn name(self) -> &'static str {
+        match self {
+            Requirement::Tool(name) | Requirement::Kernel { name, .. } => name,
+        }
+    }
+
+    fn is_available(self) -> bool {
+        match self {
+            Requirement::Tool(name) => utils::fs::is_executable_in_path(name).is_ok(),
+            Requirement::Kernel { path, .. } => Path::new(path).exists(),
+        }
+    }
+}
+
+/// Checks the requirements of the `modes` and of the ones in the
+/// registry, so the packages needing missing ones are refused.
+pub(crate) fn discover(modes: &[String]) -> Capabilities {
+    let mut capabilities = Capabilities::new();
+    for mode in modes.iter().map(String::as_str).chain(REGISTRY.iter().map(|(mode, _)| *mode)) {
+        if capabilities.contains_key(mode) {
+            continue;
+        }
+
+        let capability = check(requirements(mode));
+        if capability.available {
+            info!("'{}' install mode is available", mode);
+        } else {
+            warn!(
+                "'{}' install mode is unavailable, missing: {}",
+                mode,
+                capability.missing.join(", ")
+            );
+        }
+        capabilities.insert(mode.to_owned(), capability);
+    }
+
+    capabilities
+}
+
+/// Finds the first of the `objects` whose install mode has missing
+/// requirements, returning the mode along with the missing ones.
+pub(crate) fn find_missing<'a>(
+    capabilities: &Capabilities,
+    objects: impl IntoIterator<Item = &'a Object>,
+) -> Option<(String, Vec<String>)> {
+    objects.into_iter().find_map(|object| {
+        let mode = crate::object::mode(object);
+        capabilities
+            .get(mode)
+            .filter(|capability| !capability.available)
+            .map(|capability| (mode.to_owned(), capability.missing.clone()))
+    })
+}
+
+fn requirements(mode: &str) -> &'static [Requirement] {
+    REGISTRY.iter().find(|(m, _)| *m == mode).map(|(_, r)| *r).unwrap_or_default()
+}
+
+fn check(requirements: &[Requirement]) -> Capability {
+    let missing = requirements
+        .iter()
+        .filter(|r| !r.is_available())
+        .map(|r| r.name().to_owned())
+        .collect::<Vec<_>>();
+
+    Capability { available: missing.is_empty(), missing }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn missing_requirements() {
+        let capability = check(&[
+            Requirement::Tool("sh"),
+            Requirement::Tool("updatehub-missing-tool"),
+            Requirement::Kernel { name: "root", path: "/" },
+            Requirement::Kernel { name: "missing", path: "/updatehub-missing-feature" },
+        ]);
+
+        assert_eq!(
+            capability,
+            Capability {
+                available: false,
+                missing: vec!["updatehub-missing-tool".to_owned(), "missing".to_owned()]
+            }
+        );
+    }
+
+    #[test]
+    fn discover_modes() {
+        let capabilities = discover(&["copy".to_owned(), "raw".to_owned()]);
+
+        assert!(capabilities["copy"].available);
+        assert!(capabilities["raw"].available);
+        assert!(REGISTRY.iter().all(|(mode, _)| capabilities.contains_key(*mode)));
+    }
+}
@@ -13,6 +13,10 @@ std::thread_local! {
     static OBJECT_DATA: RefCell<Option<Vec<u8>>> = RefCell::new(Option::None);
 }
 
+std::thread_local! {
+    static SETTINGS_DELTA: RefCell<Option<Vec<u8>>> = RefCell::new(Option::None);
+}
+
 pub(crate) enum FakeResponse {
     NoUpdate,
     HasUpdate,
@@ -32,11 +36,39 @@ pub(crate) fn set_download_data(data: Vec<u8>) {
     OBJECT_DATA.with(|conf| conf.borrow_mut().replace(data));
 }
 
+pub(crate) fn set_settings_delta(data: Vec<u8>) {
+    SETTINGS_DELTA.with(|conf| conf.borrow_mut().replace(data));
+}
+
 impl<'a> Client<'a> {
     pub(crate) fn new(_server: &'a str) -> Self {
         Self { _phantom: PhantomData }
     }
 
+    pub(crate) fn with_rate_limit(self, _rate_limit: impl Into<cloud::RateLimit>) -> Self {
+        self
+    }
+
+    pub(crate) fn with_delta_bases(self, _delta_bases: Vec<String>) -> Self {
+        self
+    }
+
+    pub(crate) fn with_update_chain(self, _update_chain: Option<api::UpdateChain>) -> Self {
+        self
+    }
+
+    pub(crate) fn with_package_server(self, _package_server: Option<&'a str>) -> Self {
+        self
+    }
+
+    pub(crate) async fn enroll(
+        &self,
+        _firmware: api::FirmwareMetadata<'_>,
+        _enrollment_token: Option<&str>,
+    ) -> Result<api::Credentials> {
+        Ok(api::Credentials { token: "token".to_owned() })
+    }
+
     pub(crate) async fn probe(
         &self,
         _num_retries: u64,
@@ -56,15 +88,85 @@ impl<'a> Client<'a> {
         })
     }
 
+    pub(crate) async fn settings(
+        &self,
+        _firmware: api::FirmwareMetadata<'_>,
+    ) -> Result<Option<(api::SettingsDelta, Option<api::Signature>)>> {
+        SETTINGS_DELTA
+            .with(|conf| conf.borrow().clone())
+            .map(|data| Ok((api::SettingsDelta::parse(&data)?, None)))
+            .transpose()
+    }
+
+    pub(crate) async fn forward(
+        &self,
+        _path: &str,
+        _headers: &[(String, String)],
+        _body: Vec<u8>,
+    ) -> Result<api::Forwarded> {
+        Ok(api::Forwarded { status: 404, headers: Vec::default(), body: Vec::default() })
+    }
+
     pub(crate) async fn download_object(
         &self,
         _product_uid: &str,
         _package_uid: &str,
         download_dir: &Path,
         object: &str,
-    ) -> Result<()> {
+    ) -> Result<api::ObjectDownload> {
         if let Some(data) = OBJECT_DATA.with(|conf| conf.borrow_mut().take()) {
-            tokio::fs::write(download_dir.join(object), data).await?
+            let file = download_dir.join(object);
+            tokio::fs::write(&file, &data).await?;
+            if crate::utils::sha256sum(&data) != object {
+                tokio::fs::remove_file(file).await?;
+                return Err(Error::ChecksumMismatch(object.to_owned()));
+            }
+            return Ok(api::ObjectDownload::Verified);
+        }
+
+        Ok(api::ObjectDownload::Full)
+    }
+
+    pub(crate) async fn stream_object<W>(
+        &self,
+        _product_uid: &str,
+        _package_uid: &str,
+        object: &str,
+        handle: &mut W,
+    ) -> Result<()>
+    where
+        W: tokio::io::AsyncWrite + Unpin,
+    {
+        use tokio::io::AsyncWriteExt;
+
+        if let Some(data) = OBJECT_DATA.with(|conf| conf.borrow_mut().take()) {
+            handle.write_all(&data).await?;
+            if crate::utils::sha256sum(&data) != object {
+                return Err(Error::ChecksumMismatch(object.to_owned()));
+            }
+        }
+
+        Ok(())
+    }
+
+    pub(crate) async fn download_object_range(
+        &self,
+        _product_uid: &str,
+        _package_uid: &str,
+        _object: &str,
+        start: u64,
+        end: u64,
+        file: &Path,
+    ) -> Result<()> {
+        use std::io::Write;
+
+        // What has been written is kept, as the range is resumed.
+        let written = if file.exists() { file.metadata()?.len() } else { 0 };
+        let start = start + written;
+        if let Some(data) = OBJECT_DATA.with(|conf| conf.borrow().clone()).filter(|_| start <= end)
+        {
+            let mut handle = std::fs::OpenOptions::new().create(true).append(true).open(file)?;
+            handle.write_all(&data[start as usize..=end as usize])?
         }
 
         Ok(())
@@ -78,6 +180,30 @@ impl<'a> Client<'a> {
         _previous_state: Option<&str>,
         _error_message: Option<String>,
         _current_log: Option<String>,
+        _resource_usage: Option<api::ResourceUsage>,
+    ) -> Result<()> {
+        Ok(())
+    }
+
+    pub(crate) async fn report_error(
+        &self,
+        _firmware: api::FirmwareMetadata<'_>,
+        _package_uid: &str,
+        _previous_state: &str,
+        _error_message: String,
+        _current_log: Option<String>,
+        _resource_usage: Option<api::ResourceUsage>,
+        _details: &api::ErrorDetails,
+    ) -> Result<()> {
+        Ok(())
+    }
+
+    pub(crate) async fn report_progress(
+        &self,
+        _state: &str,
+        _firmware: api::FirmwareMetadata<'_>,
+        _package_uid: &str,
+        _progress: &api::Progress,
     ) -> Result<()> {
         Ok(())
     }
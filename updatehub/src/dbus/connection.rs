@@ -0,0 +1,166 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::message::{Body, Message, ERROR, METHOD_RETURN};
+use slog_scope::debug;
+use std::{
+    io::{self, BufRead, BufReader, Write},
+    os::unix::net::UnixStream,
+    sync::{
+        atomic::{AtomicU32, Ordering},
+        Arc, Mutex,
+    },
+};
+
+const BUS_NAME: &str = "org.freedesktop.DBus";
+const BUS_PATH: &str = "/org/freedesktop/DBus";
+
+/// The name is only taken when no one else owns it.
+const DO_NOT_QUEUE: u32 = 0x4;
+const PRIMARY_OWNER: u32 = 1;
+
+/// Connection to a message bus, which the messages are sent through from
+/// any thread, while they are received by a single one.
+#[derive(Clone)]
+pub(super) struct Connection {
+    writer: Arc<Mutex<UnixStream>>,
+    serial: Arc<AtomicU32>,
+}
+
+/// Receiving end of the connection.
+pub(super) struct Receiver(BufReader<UnixStream>);
+
+impl Connection {
+    /// Connects to the bus at `address`, as `unix:path=/run/dbus/...`,
+    /// owning the `name` on it.
+    pub(super) fn open(address: &str, name: &str) -> io::Result<(Self, Receiver)> {
+        let path = socket_path(address)?;
+        debug!("connecting to d-bus at {}", path);
+        let stream = UnixStream::connect(path)?;
+        let mut receiver = Receiver(BufReader::new(stream.try_clone()?));
+        let connection =
+            Connection { writer: Arc::new(Mutex::new(stream)), serial: Arc::new(AtomicU32::new(1)) };
+
+        connection.authenticate(&mut receiver)?;
+        let hello = Message::method_call(BUS_NAME, BUS_PATH, BUS_NAME, "Hello");
+        let unique_name = connection.call(&mut receiver, hello)?.args("s")?.string()?;
+        debug!("connected to d-bus as {}", unique_name);
+
+        let mut body = Body::default();
+        body.string(name);
+        body.u32(DO_NOT_QUEUE);
+        let request = Message::method_call(BUS_NAME, BUS_PATH, BUS_NAME, "RequestName")
+            .with_body("su", body);
+        if connection.call(&mut receiver, request)?.args("u")?.u32()? != PRIMARY_OWNER {
+            return Err(io::Error::new(
+                io::ErrorKind::AddrInUse,
+                format!("d-bus name {} is already owned", name),
+            ));
+        }
+
+        Ok((connection, receiver))
+    }
+
+    /// Sends the `message`, returning the serial it has been sent with.
+    pub(super) fn send(&self, message: &Message) -> io::Result<u32> {
+        let serial = self.serial.fetch_add(1, Ordering::Relaxed);
+        let mut writer = self.writer.lock().expect("poisoned d-bus connection lock");
+        message.write_to(&mut *writer, serial)?;
+        Ok(serial)
+    }
+
+    // The bus only accepts the messages once the client is authenticated
+    // as the user it runs as, which it knows from the socket.
+    fn authenticate(&self, receiver: &mut Receiver) -> io::Result<()> {
+        let uid = nix::unistd::getuid().to_string();
+        let uid = uid.bytes().map(|b| format!("{:02x}", b)).collect::<String>();
+        let mut writer = self.writer.lock().expect("poisoned d-bus connection lock");
+        writer.write_all(format!("\0AUTH EXTERNAL {}\r\n", uid).as_bytes())?;
+
+        let mut line = String::new();
+        receiver.0.read_line(&mut line)?;
+        if !line.starts_with("OK ") {
+            return Err(io::Error::new(
+                io::ErrorKind::PermissionDenied,
+                format!("d-bus authentication has failed: {}", line.trim()),
+            ));
+        }
+        writer.write_all(b"BEGIN\r\n")
+    }
+
+    // Calls a method of the bus, while nothing else is received.
+    fn call(&self, receiver: &mut Receiver, message: Message) -> io::Result<Message> {
+        let serial = self.send(&message)?;
+        loop {
+            let reply = receiver.next()?;
+            if reply.reply_serial != Some(serial) {
+                continue;
+            }
+            match reply.kind {
+                METHOD_RETURN => return Ok(reply),
+                ERROR => {
+                    let description =
+                        reply.args("s").and_then(|mut args| args.string()).unwrap_or_default();
+                    return Err(io::Error::new(
+                        io::ErrorKind::Other,
+                        format!(
+                            "{} has failed: {} {}",
+                            message.member.unwrap_or_default(),
+                            reply.error_name.unwrap_or_default(),
+                            description
+                        ),
+                    ));
+                }
+                _ => continue,
+            }
+        }
+    }
+}
+
+impl Receiver {
+    pub(super) fn next(&mut self) -> io::Result<Message> {
+        Message::read_from(&mut self.0)
+    }
+}
+
+fn socket_path(address: &str) -> io::Result<&str> {
+    // The first of the addresses which can be connected to is taken.
+    address
+        .split(';')
+        .find_map(|address| {
+            let params = match address.splitn(2, ':').collect::<Vec<_>>()[..] {
+                ["unix", params] => params,
+                _ => return None,
+            };
+            params.split(',').find_map(|param| match param.splitn(2, '=').collect::<Vec<_>>()[..] {
+                ["path", path] => Some(path),
+                _ => None,
+            })
+        })
+        .ok_or_else(|| {
+            io::Error::new(
+                io::ErrorKind::InvalidInput,
+                format!("unsupported d-bus address: {}", address),
+            )
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn bus_socket_path() {
+        assert_eq!(
+            socket_path("unix:path=/run/dbus/system_bus_socket").unwrap(),
+            "/run/dbus/system_bus_socket"
+        );
+        assert_eq!(
+            socket_path("tcp:host=localhost,port=1;unix:guid=1234,path=/tmp/bus").unwrap(),
+            "/tmp/bus"
+        );
+        assert!(socket_path("unix:abstract=/tmp/dbus-1234").is_err());
+    }
+}
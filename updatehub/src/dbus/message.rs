@@ -0,0 +1,401 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use std::io::{self, Read, Write};
+
+pub(super) const METHOD_CALL: u8 = 1;
+pub(super) const METHOD_RETURN: u8 = 2;
+pub(super) const ERROR: u8 = 3;
+pub(super) const SIGNAL: u8 = 4;
+
+pub(super) const NO_REPLY_EXPECTED: u8 = 0x1;
+
+const PATH: u8 = 1;
+const INTERFACE: u8 = 2;
+const MEMBER: u8 = 3;
+const ERROR_NAME: u8 = 4;
+const REPLY_SERIAL: u8 = 5;
+const DESTINATION: u8 = 6;
+const SENDER: u8 = 7;
+const SIGNATURE: u8 = 8;
+
+/// Messages bigger than this are refused, as the specification does.
+const MAX_MESSAGE_SIZE: usize = 128 * 1024 * 1024;
+
+/// D-Bus message, holding the header fields the agent makes use of. The
+/// body is kept marshalled, as described by its signature.
+#[derive(Debug, Default, PartialEq)]
+pub(super) struct Message {
+    pub(super) kind: u8,
+    pub(super) flags: u8,
+    pub(super) serial: u32,
+    pub(super) path: Option<String>,
+    pub(super) interface: Option<String>,
+    pub(super) member: Option<String>,
+    pub(super) error_name: Option<String>,
+    pub(super) reply_serial: Option<u32>,
+    pub(super) destination: Option<String>,
+    pub(super) sender: Option<String>,
+    pub(super) signature: String,
+    pub(super) body: Vec<u8>,
+    big_endian: bool,
+}
+
+impl Message {
+    pub(super) fn method_call(destination: &str, path: &str, interface: &str, member: &str) -> Self {
+        Message {
+            kind: METHOD_CALL,
+            path: Some(path.to_owned()),
+            interface: Some(interface.to_owned()),
+            member: Some(member.to_owned()),
+            destination: Some(destination.to_owned()),
+            ..Message::default()
+        }
+    }
+
+    pub(super) fn signal(path: &str, interface: &str, member: &str) -> Self {
+        Message {
+            kind: SIGNAL,
+            path: Some(path.to_owned()),
+            interface: Some(interface.to_owned()),
+            member: Some(member.to_owned()),
+            ..Message::default()
+        }
+    }
+
+    /// Reply to the method `call`.
+    pub(super) fn method_return(call: &Message) -> Self {
+        Message {
+            kind: METHOD_RETURN,
+            reply_serial: Some(call.serial),
+            destination: call.sender.clone(),
+            ..Message::default()
+        }
+    }
+
+    /// Error reply to the method `call`, named `name`, with the
+    /// `description` for the humans.
+    pub(super) fn error(call: &Message, name: &str, description: &str) -> Self {
+        let mut body = Body::default();
+        body.string(description);
+        Message {
+            kind: ERROR,
+            error_name: Some(name.to_owned()),
+            reply_serial: Some(call.serial),
+            destination: call.sender.clone(),
+            ..Message::default()
+        }
+        .with_body("s", body)
+    }
+
+    pub(super) fn with_body(mut self, signature: &str, body: Body) -> Self {
+        self.signature = signature.to_owned();
+        self.body = body.0;
+        self
+    }
+
+    pub(super) fn expects_reply(&self) -> bool {
+        self.kind == METHOD_CALL && self.flags & NO_REPLY_EXPECTED == 0
+    }
+
+    /// Reader of the body arguments, which must be of the `signature`.
+    pub(super) fn args(&self, signature: &str) -> io::Result<Args<'_>> {
+        if self.signature != signature {
+            return Err(invalid(format!(
+                "arguments of signature '{}' expected, got '{}'",
+                signature, self.signature
+            )));
+        }
+        Ok(Args { buf: &self.body, pos: 0, big_endian: self.big_endian })
+    }
+
+    /// Marshals the message, as little endian, with the `serial`.
+    pub(super) fn write_to<W: Write>(&self, output: &mut W, serial: u32) -> io::Result<()> {
+        let mut header = Body::default();
+        header.0.extend_from_slice(&[b'l', self.kind, self.flags, 1]);
+        header.u32(self.body.len() as u32);
+        header.u32(serial);
+        header.array(8, |fields| {
+            let strings = [
+                (PATH, "o", &self.path),
+                (INTERFACE, "s", &self.interface),
+                (MEMBER, "s", &self.member),
+                (ERROR_NAME, "s", &self.error_name),
+                (DESTINATION, "s", &self.destination),
+                (SENDER, "s", &self.sender),
+            ];
+            for (code, signature, value) in strings.iter() {
+                if let Some(value) = value {
+                    fields.field(*code, signature, |v| v.string(value));
+                }
+            }
+            if let Some(reply_serial) = self.reply_serial {
+                fields.field(REPLY_SERIAL, "u", |v| v.u32(reply_serial));
+            }
+            if !self.signature.is_empty() {
+                fields.field(SIGNATURE, "g", |v| v.signature(&self.signature));
+            }
+        });
+        header.align(8);
+
+        output.write_all(&header.0)?;
+        output.write_all(&self.body)?;
+        output.flush()
+    }
+
+    pub(super) fn read_from<R: Read>(input: &mut R) -> io::Result<Self> {
+        let mut fixed = [0; 16];
+        input.read_exact(&mut fixed)?;
+        let big_endian = match fixed[0] {
+            b'l' => false,
+            b'B' => true,
+            e => return Err(invalid(format!("unknown endianness {:#x}", e))),
+        };
+        let u32_at = |pos: usize| {
+            let mut bytes = [0; 4];
+            bytes.copy_from_slice(&fixed[pos..pos + 4]);
+            if big_endian { u32::from_be_bytes(bytes) } else { u32::from_le_bytes(bytes) }
+        };
+        let body_len = u32_at(4) as usize;
+        let fields_len = u32_at(12) as usize;
+        let header_len = padded(16 + fields_len, 8);
+        if header_len + body_len > MAX_MESSAGE_SIZE {
+            return Err(invalid("message is too big".to_owned()));
+        }
+
+        let mut buf = vec![0; header_len + body_len];
+        buf[..16].copy_from_slice(&fixed);
+        input.read_exact(&mut buf[16..])?;
+
+        let mut message = Message {
+            kind: fixed[1],
+            flags: fixed[2],
+            serial: u32_at(8),
+            body: buf.split_off(header_len),
+            big_endian,
+            ..Message::default()
+        };
+        let mut fields = Args { buf: &buf, pos: 12, big_endian };
+        let end = fields.u32()? as usize + 16;
+        while fields.pos < end {
+            fields.align(8)?;
+            let code = fields.u8()?;
+            let signature = fields.signature()?;
+            match (code, signature.as_str()) {
+                (PATH, "o") => message.path = Some(fields.string()?),
+                (INTERFACE, "s") => message.interface = Some(fields.string()?),
+                (MEMBER, "s") => message.member = Some(fields.string()?),
+                (ERROR_NAME, "s") => message.error_name = Some(fields.string()?),
+                (REPLY_SERIAL, "u") => message.reply_serial = Some(fields.u32()?),
+                (DESTINATION, "s") => message.destination = Some(fields.string()?),
+                (SENDER, "s") => message.sender = Some(fields.string()?),
+                (SIGNATURE, "g") => message.signature = fields.signature()?,
+                // Only the file descriptors count is left, which is
+                // ignored as no descriptors are accepted.
+                (_, "u") => {
+                    fields.u32()?;
+                }
+                (code, signature) => {
+                    return Err(invalid(format!(
+                        "unexpected header field {} of signature '{}'",
+                        code, signature
+                    )))
+                }
+            }
+        }
+
+        Ok(message)
+    }
+}
+
+/// Marshalled body, or part of it, which the values are appended to.
+/// The offsets are aligned as if it started at the beginning of the
+/// message, which holds for bodies as they start at a multiple of 8.
+#[derive(Default)]
+pub(super) struct Body(Vec<u8>);
+
+impl Body {
+    pub(super) fn u8(&mut self, value: u8) {
+        self.0.push(value);
+    }
+
+    pub(super) fn u32(&mut self, value: u32) {
+        self.align(4);
+        self.0.extend_from_slice(&value.to_le_bytes());
+    }
+
+    pub(super) fn u64(&mut self, value: u64) {
+        self.align(8);
+        self.0.extend_from_slice(&value.to_le_bytes());
+    }
+
+    /// Appends a string, or an object path.
+    pub(super) fn string(&mut self, value: &str) {
+        self.u32(value.len() as u32);
+        self.0.extend_from_slice(value.as_bytes());
+        self.0.push(0);
+    }
+
+    pub(super) fn signature(&mut self, value: &str) {
+        self.0.push(value.len() as u8);
+        self.0.extend_from_slice(value.as_bytes());
+        self.0.push(0);
+    }
+
+    pub(super) fn variant(&mut self, signature: &str, value: impl FnOnce(&mut Body)) {
+        self.signature(signature);
+        value(self);
+    }
+
+    /// Appends an array, whose elements are aligned to `alignment` and
+    /// appended by `elements`.
+    pub(super) fn array(&mut self, alignment: usize, elements: impl FnOnce(&mut Body)) {
+        self.u32(0);
+        let len_pos = self.0.len() - 4;
+        self.align(alignment);
+        let start = self.0.len();
+        elements(self);
+        let len = (self.0.len() - start) as u32;
+        self.0[len_pos..len_pos + 4].copy_from_slice(&len.to_le_bytes());
+    }
+
+    /// Appends a dictionary entry, as the ones of `a{sv}`.
+    pub(super) fn entry(&mut self, key: &str, signature: &str, value: impl FnOnce(&mut Body)) {
+        self.align(8);
+        self.string(key);
+        self.variant(signature, value);
+    }
+
+    fn field(&mut self, code: u8, signature: &str, value: impl FnOnce(&mut Body)) {
+        self.align(8);
+        self.u8(code);
+        self.variant(signature, value);
+    }
+
+    fn align(&mut self, alignment: usize) {
+        self.0.resize(padded(self.0.len(), alignment), 0);
+    }
+}
+
+/// Reader of the arguments of a message body.
+pub(super) struct Args<'a> {
+    buf: &'a [u8],
+    pos: usize,
+    big_endian: bool,
+}
+
+impl<'a> Args<'a> {
+    pub(super) fn string(&mut self) -> io::Result<String> {
+        let len = self.u32()? as usize;
+        let bytes = self.take(len + 1)?;
+        String::from_utf8(bytes[..len].to_vec()).map_err(|_| invalid("invalid string".to_owned()))
+    }
+
+    fn signature(&mut self) -> io::Result<String> {
+        let len = self.u8()? as usize;
+        let bytes = self.take(len + 1)?;
+        String::from_utf8(bytes[..len].to_vec())
+            .map_err(|_| invalid("invalid signature".to_owned()))
+    }
+
+    fn u8(&mut self) -> io::Result<u8> {
+        Ok(self.take(1)?[0])
+    }
+
+    pub(super) fn u32(&mut self) -> io::Result<u32> {
+        self.align(4)?;
+        let mut bytes = [0; 4];
+        bytes.copy_from_slice(self.take(4)?);
+        Ok(if self.big_endian { u32::from_be_bytes(bytes) } else { u32::from_le_bytes(bytes) })
+    }
+
+    fn align(&mut self, alignment: usize) -> io::Result<()> {
+        let len = padded(self.pos, alignment) - self.pos;
+        self.take(len).map(|_| ())
+    }
+
+    fn take(&mut self, len: usize) -> io::Result<&'a [u8]> {
+        let bytes = self
+            .buf
+            .get(self.pos..self.pos + len)
+            .ok_or_else(|| invalid("message is truncated".to_owned()))?;
+        self.pos += len;
+        Ok(bytes)
+    }
+}
+
+fn padded(len: usize, alignment: usize) -> usize {
+    (len + alignment - 1) / alignment * alignment
+}
+
+fn invalid(message: String) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, message)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn marshal_round_trip() {
+        let mut body = Body::default();
+        body.string("org.updatehub.Agent");
+        body.string("State");
+        let mut message = Message::method_call(
+            "org.updatehub.Agent",
+            "/org/updatehub/Agent",
+            "org.freedesktop.DBus.Properties",
+            "Get",
+        )
+        .with_body("ss", body);
+        message.sender = Some(":1.42".to_owned());
+
+        let mut buf = Vec::new();
+        message.write_to(&mut buf, 7).unwrap();
+        assert_eq!(buf.len() % 8, (message.body.len() % 8));
+
+        let read = Message::read_from(&mut buf.as_slice()).unwrap();
+        message.serial = 7;
+        assert_eq!(read, message);
+
+        let mut args = read.args("ss").unwrap();
+        assert_eq!(args.string().unwrap(), "org.updatehub.Agent");
+        assert_eq!(args.string().unwrap(), "State");
+        assert!(read.args("s").is_err());
+    }
+
+    #[test]
+    fn marshal_array_of_dict_entries() {
+        let mut body = Body::default();
+        body.u8(1);
+        body.array(8, |entries| {
+            entries.entry("State", "s", |v| v.string("idle"));
+            entries.entry("Index", "u", |v| v.u32(0));
+        });
+
+        assert_eq!(
+            body.0,
+            vec![
+                1, 0, 0, 0, // byte, padded to the array length
+                48, 0, 0, 0, // array length, without the padding after it
+                5, 0, 0, 0, b'S', b't', b'a', b't', b'e', 0, // key
+                1, b's', 0, 0, 0, 0, 4, 0, 0, 0, b'i', b'd', b'l', b'e', 0, // variant
+                0, 0, 0, 0, 0, 0, 0, // entry padding
+                5, 0, 0, 0, b'I', b'n', b'd', b'e', b'x', 0, // key
+                1, b'u', 0, 0, 0, 0, 0, 0, // variant
+            ]
+        );
+    }
+
+    #[test]
+    fn refuse_truncated_message() {
+        let mut buf = Vec::new();
+        Message::signal("/org/updatehub/Agent", "org.updatehub.Agent", "StateChanged")
+            .write_to(&mut buf, 1)
+            .unwrap();
+        buf.truncate(buf.len() - 4);
+        assert!(Message::read_from(&mut buf.as_slice()).is_err());
+    }
+}
@@ -0,0 +1,366 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Exposes the agent on the system D-Bus, as `org.updatehub.Agent`, so
+//! the HMIs can drive it, and follow its state and progress, without
+//! an HTTP client.
+//!
+//! Only what the agent needs of the D-Bus wire protocol is implemented:
+//! the bus is reached through a unix socket path, authenticated as the
+//! agent user, and the messages carry no file descriptors.
+
+mod connection;
+mod message;
+
+use self::{
+    connection::Connection,
+    message::{Body, Message, METHOD_CALL},
+};
+use crate::states::machine::{self, CancelUpdateResponse, ProbeResponse, StateResponse};
+use async_std::{prelude::FutureExt, sync};
+use sdk::api::{events::Event, info::settings::DBus};
+use slog_scope::{debug, info, warn};
+use std::{path::PathBuf, time::Duration};
+
+const NAME: &str = "org.updatehub.Agent";
+const PATH: &str = "/org/updatehub/Agent";
+const INTERFACE: &str = "org.updatehub.Agent";
+
+const PROPERTIES: &str = "org.freedesktop.DBus.Properties";
+const INTROSPECTABLE: &str = "org.freedesktop.DBus.Introspectable";
+const PEER: &str = "org.freedesktop.DBus.Peer";
+
+const ERROR_BUSY: &str = "org.updatehub.Agent.Error.Busy";
+const ERROR_INVALID_STATE: &str = "org.updatehub.Agent.Error.InvalidState";
+const ERROR_FAILED: &str = "org.updatehub.Agent.Error.Failed";
+const ERROR_UNKNOWN_METHOD: &str = "org.freedesktop.DBus.Error.UnknownMethod";
+const ERROR_UNKNOWN_PROPERTY: &str = "org.freedesktop.DBus.Error.UnknownProperty";
+const ERROR_INVALID_ARGS: &str = "org.freedesktop.DBus.Error.InvalidArgs";
+const ERROR_READ_ONLY: &str = "org.freedesktop.DBus.Error.PropertyReadOnly";
+
+/// Time waited before connecting again to the bus, once the connection
+/// has been lost.
+const RECONNECT_INTERVAL: Duration = Duration::from_secs(30);
+
+const INTROSPECTION: &str = r#"<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="org.updatehub.Agent">
+    <method name="Probe">
+      <arg name="result" type="s" direction="out"/>
+    </method>
+    <method name="Install">
+      <arg name="source" type="s" direction="in"/>
+      <arg name="state" type="s" direction="out"/>
+    </method>
+    <method name="Abort"/>
+    <property name="State" type="s" access="read"/>
+    <property name="Version" type="s" access="read"/>
+    <property name="FirmwareVersion" type="s" access="read"/>
+    <signal name="StateChanged">
+      <arg name="state" type="s"/>
+    </signal>
+    <signal name="Progress">
+      <arg name="stage" type="s"/>
+      <arg name="object" type="s"/>
+      <arg name="index" type="u"/>
+      <arg name="count" type="u"/>
+      <arg name="done" type="t"/>
+      <arg name="total" type="t"/>
+      <arg name="percentage" type="y"/>
+    </signal>
+    <signal name="Error">
+      <arg name="message" type="s"/>
+    </signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Properties">
+    <method name="Get">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="property" type="s" direction="in"/>
+      <arg name="value" type="v" direction="out"/>
+    </method>
+    <method name="GetAll">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="properties" type="a{sv}" direction="out"/>
+    </method>
+    <signal name="PropertiesChanged">
+      <arg name="interface" type="s"/>
+      <arg name="changed_properties" type="a{sv}"/>
+      <arg name="invalidated_properties" type="as"/>
+    </signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect">
+      <arg name="data" type="s" direction="out"/>
+    </method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Peer">
+    <method name="Ping"/>
+  </interface>
+</node>
+"#;
+
+/// Serves the agent on the bus for as long as it runs, connecting again
+/// whenever the bus goes away, as when it is restarted.
+pub(crate) async fn run(settings: DBus, addr: machine::Addr) {
+    info!("serving the agent on d-bus as {}", NAME);
+
+    let events = addr.events();
+    loop {
+        match Connection::open(&settings.bus_address, NAME) {
+            Ok((connection, mut receiver)) => {
+                // The messages are read from the socket, which blocks, on
+                // their own thread.
+                let (sender, calls) = sync::channel(10);
+                std::thread::spawn(move || loop {
+                    match receiver.next() {
+                        Ok(message) if message.kind == METHOD_CALL => {
+                            async_std::task::block_on(sender.send(message))
+                        }
+                        Ok(_) => {}
+                        Err(e) => {
+                            warn!("lost connection to d-bus: {}", e);
+                            break;
+                        }
+                    }
+                });
+
+                // The state is read as the service starts, so the events
+                // received while disconnected are left behind.
+                while events.try_recv().is_ok() {}
+                let mut service = Service::new(connection, &addr).await;
+                if let Err(e) = service.serve(&calls, &events).await {
+                    warn!("failed to reply on d-bus: {}", e);
+                }
+            }
+            Err(e) => warn!("failed to connect to d-bus: {}", e),
+        }
+        crate::utils::boottime::sleep(RECONNECT_INTERVAL).await;
+    }
+}
+
+enum Input {
+    Call(Message),
+    Event(Event),
+}
+
+struct Service<'a> {
+    connection: Connection,
+    addr: &'a machine::Addr,
+    state: String,
+    firmware_version: String,
+}
+
+impl<'a> Service<'a> {
+    async fn new(connection: Connection, addr: &'a machine::Addr) -> Service<'a> {
+        let info = addr.request_info().await;
+        Service { connection, addr, state: info.state, firmware_version: info.firmware.version }
+    }
+
+    // Handles the method calls, and signals the agent events, until the
+    // connection is lost.
+    async fn serve(
+        &mut self,
+        calls: &sync::Receiver<Message>,
+        events: &sync::Receiver<Event>,
+    ) -> std::io::Result<()> {
+        loop {
+            let input = async { calls.recv().await.ok().map(Input::Call) }
+                .race(async { events.recv().await.ok().map(Input::Event) })
+                .await;
+            match input {
+                Some(Input::Call(call)) => {
+                    let reply = self.handle_call(&call).await;
+                    if call.expects_reply() {
+                        self.connection.send(&reply)?;
+                    }
+                }
+                Some(Input::Event(event)) => {
+                    for signal in self.signals(event) {
+                        self.connection.send(&signal)?;
+                    }
+                }
+                None => return Ok(()),
+            }
+        }
+    }
+
+    async fn handle_call(&self, call: &Message) -> Message {
+        let interface = call.interface.as_deref().unwrap_or(INTERFACE);
+        let member = call.member.as_deref().unwrap_or_default();
+        debug!("receiving d-bus call of {}.{}", interface, member);
+
+        if call.path.as_deref() != Some(PATH) {
+            return Message::error(call, ERROR_UNKNOWN_METHOD, "unknown object path");
+        }
+        let reply = match (interface, member) {
+            (INTERFACE, "Probe") => self.probe(call).await,
+            (INTERFACE, "Install") => self.install(call).await,
+            (INTERFACE, "Abort") => self.abort(call).await,
+            (PROPERTIES, "Get") => self.get(call),
+            (PROPERTIES, "GetAll") => self.get_all(call),
+            (PROPERTIES, "Set") => Err(Message::error(
+                call,
+                ERROR_READ_ONLY,
+                "the agent properties are read only",
+            )),
+            (INTROSPECTABLE, "Introspect") => {
+                let mut body = Body::default();
+                body.string(INTROSPECTION);
+                Ok(Message::method_return(call).with_body("s", body))
+            }
+            (PEER, "Ping") => Ok(Message::method_return(call)),
+            _ => Err(Message::error(
+                call,
+                ERROR_UNKNOWN_METHOD,
+                &format!("unknown method {}.{}", interface, member),
+            )),
+        };
+        reply.unwrap_or_else(|error| error)
+    }
+
+    async fn probe(&self, call: &Message) -> Result<Message, Message> {
+        let result = match self.addr.request_probe(None).await {
+            Ok(ProbeResponse::Available) => "available",
+            Ok(ProbeResponse::Unavailable) => "unavailable",
+            Ok(ProbeResponse::Delayed(_)) => "delayed",
+            Ok(ProbeResponse::Busy(state)) => {
+                return Err(Message::error(
+                    call,
+                    ERROR_BUSY,
+                    &format!("agent is busy in the '{}' state", state),
+                ))
+            }
+            Err(e) => return Err(Message::error(call, ERROR_FAILED, &e.to_string())),
+        };
+        let mut body = Body::default();
+        body.string(result);
+        Ok(Message::method_return(call).with_body("s", body))
+    }
+
+    // The source is either the URL of the package or its path.
+    async fn install(&self, call: &Message) -> Result<Message, Message> {
+        let source = call
+            .args("s")
+            .and_then(|mut args| args.string())
+            .map_err(|e| Message::error(call, ERROR_INVALID_ARGS, &e.to_string()))?;
+        let response = if source.starts_with("http://") || source.starts_with("https://") {
+            self.addr.request_remote_install(source).await
+        } else {
+            self.addr.request_local_install(PathBuf::from(source)).await
+        };
+        let state = match response {
+            StateResponse::RequestAccepted(state) | StateResponse::Queued(state, _) => state,
+            StateResponse::InvalidState(state) => {
+                return Err(Message::error(
+                    call,
+                    ERROR_INVALID_STATE,
+                    &format!("the package can't be installed in the '{}' state", state),
+                ))
+            }
+        };
+        let mut body = Body::default();
+        body.string(&state);
+        Ok(Message::method_return(call).with_body("s", body))
+    }
+
+    async fn abort(&self, call: &Message) -> Result<Message, Message> {
+        match self.addr.request_cancel_update().await {
+            CancelUpdateResponse::RequestAccepted => Ok(Message::method_return(call)),
+            CancelUpdateResponse::InvalidState => Err(Message::error(
+                call,
+                ERROR_INVALID_STATE,
+                "there is no update to be aborted",
+            )),
+        }
+    }
+
+    fn get(&self, call: &Message) -> Result<Message, Message> {
+        let (interface, property) = call
+            .args("ss")
+            .and_then(|mut args| Ok((args.string()?, args.string()?)))
+            .map_err(|e| Message::error(call, ERROR_INVALID_ARGS, &e.to_string()))?;
+        let value = match self.property(&interface, &property) {
+            Some(value) => value,
+            None => {
+                return Err(Message::error(
+                    call,
+                    ERROR_UNKNOWN_PROPERTY,
+                    &format!("unknown property {}.{}", interface, property),
+                ))
+            }
+        };
+        let mut body = Body::default();
+        body.variant("s", |v| v.string(value));
+        Ok(Message::method_return(call).with_body("v", body))
+    }
+
+    fn get_all(&self, call: &Message) -> Result<Message, Message> {
+        let interface = call
+            .args("s")
+            .and_then(|mut args| args.string())
+            .map_err(|e| Message::error(call, ERROR_INVALID_ARGS, &e.to_string()))?;
+        let mut body = Body::default();
+        body.array(8, |entries| {
+            for property in &["State", "Version", "FirmwareVersion"] {
+                if let Some(value) = self.property(&interface, property) {
+                    entries.entry(property, "s", |v| v.string(value));
+                }
+            }
+        });
+        Ok(Message::method_return(call).with_body("a{sv}", body))
+    }
+
+    fn property(&self, interface: &str, property: &str) -> Option<&str> {
+        match (interface, property) {
+            (INTERFACE, "State") => Some(self.state.as_str()),
+            (INTERFACE, "Version") => Some(crate::version()),
+            (INTERFACE, "FirmwareVersion") => Some(self.firmware_version.as_str()),
+            _ => None,
+        }
+    }
+
+    fn signals(&mut self, event: Event) -> Vec<Message> {
+        match event {
+            Event::State { state } => {
+                self.state = state;
+                let mut body = Body::default();
+                body.string(&self.state);
+                let state_changed = Message::signal(PATH, INTERFACE, "StateChanged")
+                    .with_body("s", body);
+
+                // The bindings of Qt and GLib follow the properties
+                // through this signal.
+                let mut body = Body::default();
+                body.string(INTERFACE);
+                body.array(8, |entries| entries.entry("State", "s", |v| v.string(&self.state)));
+                body.array(4, |_| {});
+                let properties_changed = Message::signal(PATH, PROPERTIES, "PropertiesChanged")
+                    .with_body("sa{sv}as", body);
+
+                vec![state_changed, properties_changed]
+            }
+            Event::Progress { progress } => {
+                let mut body = Body::default();
+                body.string(match progress.stage {
+                    sdk::api::progress::Stage::Download => "download",
+                    sdk::api::progress::Stage::Install => "install",
+                });
+                body.string(&progress.object);
+                body.u32(progress.index as u32);
+                body.u32(progress.count as u32);
+                body.u64(progress.done);
+                body.u64(progress.total);
+                body.u8(progress.percentage);
+                vec![Message::signal(PATH, INTERFACE, "Progress").with_body("ssuutty", body)]
+            }
+            Event::Error { message } => {
+                let mut body = Body::default();
+                body.string(&message);
+                vec![Message::signal(PATH, INTERFACE, "Error").with_body("s", body)]
+            }
+            Event::ReadyToInstall { .. } => Vec::default(),
+        }
+    }
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Enrollment of the device with the server, which replaces provisioning
+//! its credentials out of band. A device which hasn't been enrolled yet
+//! registers itself before it is next probed, optionally with a one-time
+//! token, and keeps the credentials it is issued, which are sent along
+//! its later requests.
+
+use crate::{firmware::Metadata, utils};
+use chrono::{DateTime, Utc};
+use sdk::api::{
+    enrollment::{Response, Status},
+    info::settings::Enrollment,
+};
+use serde::{Deserialize, Serialize};
+use slog_scope::{error, info};
+use std::{
+    fs,
+    io::{self, Write},
+    os::unix::fs::OpenOptionsExt,
+    path::Path,
+};
+
+/// Credentials kept once the device has been enrolled.
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+struct Stored {
+    credentials: cloud::api::Credentials,
+    enrolled_at: DateTime<Utc>,
+}
+
+/// Loads the credentials the device has been enrolled with, if any, so
+/// they are sent along the requests to the server.
+pub(crate) fn load(settings: &Enrollment) -> Response {
+    if !settings.enabled {
+        return Response::default();
+    }
+
+    match read(&settings.credentials) {
+        Ok(Some(stored)) => {
+            cloud::configure_credentials(Some(stored.credentials));
+            Response {
+                status: Status::Enrolled,
+                enrolled_at: Some(stored.enrolled_at),
+                error: None,
+            }
+        }
+        Ok(None) => Response { status: Status::Pending, ..Response::default() },
+        Err(e) => {
+            error!("failed to load the enrollment credentials: {}", e);
+            Response { status: Status::Pending, enrolled_at: None, error: Some(e.to_string()) }
+        }
+    }
+}
+
+/// Enrolls the device with the `server`, unless it has already been,
+/// keeping the credentials it is issued. The `status` is updated along,
+/// holding the error when the enrollment fails.
+pub(crate) async fn enroll(
+    settings: &Enrollment,
+    server: &str,
+    firmware: &Metadata,
+    status: &mut Response,
+) -> crate::states::Result<()> {
+    if status.status != Status::Pending {
+        return Ok(());
+    }
+
+    info!("enrolling the device with {}", server);
+    let res = async {
+        let token = settings.token.as_deref().map(utils::secret::resolve).transpose()?;
+        let credentials = crate::CloudClient::new(server)
+            .enroll(firmware.as_cloud_metadata(), token.as_deref())
+            .await?;
+        let stored = Stored { credentials, enrolled_at: Utc::now() };
+        write(&settings.credentials, &stored)?;
+        Ok::<_, crate::states::TransitionError>(stored)
+    }
+    .await;
+
+    match res {
+        Ok(stored) => {
+            info!("device has been enrolled");
+            *status = Response {
+                status: Status::Enrolled,
+                enrolled_at: Some(stored.enrolled_at),
+                error: None,
+            };
+            cloud::configure_credentials(Some(stored.credentials));
+            Ok(())
+        }
+        Err(e) => {
+            status.error = Some(e.to_string());
+            Err(e)
+        }
+    }
+}
+
+fn read(path: &Path) -> io::Result<Option<Stored>> {
+    match fs::read(path) {
+        Ok(content) => Ok(Some(serde_json::from_slice(&content)?)),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e),
+    }
+}
+
+// The credentials are only readable by the agent, and replaced at once,
+// so an interrupted write doesn't leave the device without them.
+fn write(path: &Path, stored: &Stored) -> io::Result<()> {
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    let staging = path.with_extension("new");
+    let mut file = fs::OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .mode(0o600)
+        .open(&staging)?;
+    file.write_all(&serde_json::to_vec(stored)?)?;
+    file.sync_all()?;
+    fs::rename(&staging, path)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn stored_credentials() {
+        let dir = tempfile::tempdir().unwrap();
+        let settings = Enrollment {
+            enabled: true,
+            credentials: dir.path().join("credentials.json"),
+            ..Enrollment::default()
+        };
+        assert_eq!(load(&Enrollment::default()).status, Status::Disabled);
+        assert_eq!(load(&settings).status, Status::Pending);
+
+        let stored = Stored {
+            credentials: cloud::api::Credentials { token: "secret".to_owned() },
+            enrolled_at: Utc::now(),
+        };
+        write(&settings.credentials, &stored).unwrap();
+        assert_eq!(read(&settings.credentials).unwrap(), Some(stored));
+        assert_eq!(load(&settings).status, Status::Enrolled);
+        cloud::configure_credentials(None);
+    }
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Barebox bootchooser state, read and written through `barebox-state`
+//! from dt-utils, which keeps the redundant copies of the state storage
+//! and their checksums.
+
+use super::hook::run_script;
+use std::{fs, path::Path};
+
+const STATE_TOOL: &str = "barebox-state";
+const PREFIX: &str = "bootstate";
+const CMDLINE: &str = "/proc/cmdline";
+// Set by the bootchooser to the target it has booted.
+const ACTIVE_ARG: &str = "bootchooser.active=";
+
+const PRIMARY_PRIORITY: u32 = 20;
+const SECONDARY_PRIORITY: u32 = 10;
+
+/// Index of the booted target, as told by the kernel command line or,
+/// when missing, as the one of highest priority.
+pub(crate) fn booted(targets: &[String]) -> super::Result<usize> {
+    if let Some(idx) = booted_from_cmdline(&fs::read_to_string(Path::new(CMDLINE))?, targets) {
+        return Ok(idx);
+    }
+
+    let mut priorities = Vec::with_capacity(targets.len());
+    for target in targets {
+        priorities.push(
+            run_script(&format!("{} -g {}.{}.priority", STATE_TOOL, PREFIX, target))?
+                .parse::<u32>()?,
+        );
+    }
+    Ok(priorities.iter().enumerate().max_by_key(|(_, p)| **p).map(|(idx, _)| idx).unwrap_or(0))
+}
+
+/// Makes the `primary` target the one barebox boots, with its attempts
+/// reset, keeping the others as fallback.
+pub(crate) fn set_primary(targets: &[String], primary: usize, attempts: u32) -> super::Result<()> {
+    set(&primary_vars(targets, primary, attempts))
+}
+
+/// Resets the attempts of the `target`, as it has booted fine.
+pub(crate) fn mark_good(target: &str, attempts: u32) -> super::Result<()> {
+    set(&[remaining_attempts(target, attempts)])
+}
+
+// All the variables are given at once, so the state is written once.
+fn set(vars: &[(String, String)]) -> super::Result<()> {
+    let args =
+        vars.iter().map(|(name, value)| format!("-s {}={}", name, value)).collect::<Vec<_>>();
+    let _ = run_script(&format!("{} {}", STATE_TOOL, args.join(" ")))?;
+    Ok(())
+}
+
+fn booted_from_cmdline(cmdline: &str, targets: &[String]) -> Option<usize> {
+    let arg = cmdline.split_whitespace().find(|arg| arg.starts_with(ACTIVE_ARG))?;
+    targets.iter().position(|target| *target == arg[ACTIVE_ARG.len()..])
+}
+
+fn primary_vars(targets: &[String], primary: usize, attempts: u32) -> Vec<(String, String)> {
+    let mut vars = Vec::default();
+    for (idx, target) in targets.iter().enumerate() {
+        let priority = if idx == primary { PRIMARY_PRIORITY } else { SECONDARY_PRIORITY };
+        vars.push((format!("{}.{}.priority", PREFIX, target), priority.to_string()));
+    }
+    vars.push(remaining_attempts(&targets[primary], attempts));
+    vars
+}
+
+fn remaining_attempts(target: &str, attempts: u32) -> (String, String) {
+    (format!("{}.{}.remaining_attempts", PREFIX, target), attempts.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn targets() -> Vec<String> {
+        vec!["system0".to_owned(), "system1".to_owned()]
+    }
+
+    #[test]
+    fn booted_target() {
+        let cmdline = "console=ttymxc0 bootchooser.active=system1 rootwait\n";
+        assert_eq!(booted_from_cmdline(cmdline, &targets()), Some(1));
+        assert_eq!(booted_from_cmdline("bootchooser.active=recovery", &targets()), None);
+        assert_eq!(booted_from_cmdline("root=/dev/mmcblk0p2", &targets()), None);
+    }
+
+    #[test]
+    fn primary_target() {
+        let vars = primary_vars(&targets(), 1, 3);
+        let vars = vars.iter().map(|(n, v)| format!("{}={}", n, v)).collect::<Vec<_>>();
+        assert_eq!(
+            vars,
+            [
+                "bootstate.system0.priority=10",
+                "bootstate.system1.priority=20",
+                "bootstate.system1.remaining_attempts=3"
+            ]
+        );
+    }
+}
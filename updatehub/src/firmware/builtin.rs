@@ -0,0 +1,91 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Device information found by the agent itself, from the device tree or
+//! the SMBIOS tables, for the devices which have no metadata hooks for it.
+
+use sdk::api::info::firmware::MetadataValue;
+use std::{fs, path::Path};
+
+const DEVICE_TREE: &str = "proc/device-tree";
+const DMI: &str = "sys/class/dmi/id";
+
+// Values the SMBIOS tables are commonly left with by the vendors.
+const PLACEHOLDERS: &[&str] =
+    &["To Be Filled By O.E.M.", "Default string", "Not Specified", "System Product Name"];
+
+/// Hardware of the device, as its device tree model or SMBIOS product
+/// name.
+pub(crate) fn hardware(root: &Path) -> Option<String> {
+    read(&root.join(DEVICE_TREE).join("model"))
+        .or_else(|| read(&root.join(DMI).join("product_name")))
+}
+
+/// Identity of the device, as its device tree serial number or its
+/// SMBIOS product UUID and serial number.
+pub(crate) fn identity(root: &Path) -> MetadataValue {
+    let mut identity = MetadataValue::default();
+    let sources = [
+        ("serial-number", root.join(DEVICE_TREE).join("serial-number")),
+        ("product-uuid", root.join(DMI).join("product_uuid")),
+        ("product-serial", root.join(DMI).join("product_serial")),
+    ];
+    for (key, path) in sources.iter() {
+        if let Some(value) = read(path) {
+            identity.0.insert((*key).to_owned(), vec![value]);
+            // The device tree serial number is enough by itself.
+            if *key == "serial-number" {
+                break;
+            }
+        }
+    }
+    identity
+}
+
+// The device tree properties are terminated by a nul byte.
+fn read(path: &Path) -> Option<String> {
+    let value = fs::read(path).ok()?;
+    let value = String::from_utf8_lossy(&value).trim_end_matches('\0').trim().to_owned();
+    if value.is_empty() || PLACEHOLDERS.contains(&value.as_str()) {
+        return None;
+    }
+    Some(value)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn read_device_tree() {
+        let root = tempfile::tempdir().unwrap();
+        let device_tree = root.path().join(DEVICE_TREE);
+        fs::create_dir_all(&device_tree).unwrap();
+        fs::write(device_tree.join("model"), b"Board rev 2\0").unwrap();
+        fs::write(device_tree.join("serial-number"), b"0123456789\0").unwrap();
+
+        assert_eq!(hardware(root.path()), Some("Board rev 2".to_owned()));
+        assert_eq!(identity(root.path())["serial-number"], ["0123456789"]);
+        assert_eq!(identity(root.path()).len(), 1);
+    }
+
+    #[test]
+    fn read_smbios() {
+        let root = tempfile::tempdir().unwrap();
+        assert_eq!(hardware(root.path()), None);
+        assert!(identity(root.path()).is_empty());
+
+        let dmi = root.path().join(DMI);
+        fs::create_dir_all(&dmi).unwrap();
+        fs::write(dmi.join("product_name"), "Gateway 3000\n").unwrap();
+        fs::write(dmi.join("product_uuid"), "4c4c4544-0042-3510-8052-b3c04f4d4432\n").unwrap();
+        fs::write(dmi.join("product_serial"), "To Be Filled By O.E.M.\n").unwrap();
+
+        assert_eq!(hardware(root.path()), Some("Gateway 3000".to_owned()));
+        let identity = identity(root.path());
+        assert_eq!(identity["product-uuid"], ["4c4c4544-0042-3510-8052-b3c04f4d4432"]);
+        assert_eq!(identity.len(), 1);
+    }
+}
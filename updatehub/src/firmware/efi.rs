@@ -0,0 +1,330 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! EFI boot manager variables, read and written through efivarfs, as
+//! `efibootmgr` does.
+
+use sdk::api::info::settings::EfiBootEntry;
+use slog_scope::{debug, info};
+use std::{
+    fs::{self, File, OpenOptions},
+    io::{self, Write},
+    os::{raw::c_int, unix::io::AsRawFd},
+    path::{Path, PathBuf},
+};
+
+const EFIVARS: &str = "/sys/firmware/efi/efivars";
+const GLOBAL_GUID: &str = "8be4df61-93ca-11d2-aa0d-00e098032b8c";
+// Non volatile, with boot service and runtime access.
+const ATTRIBUTES: u32 = 0x7;
+const LOAD_OPTION_ACTIVE: u32 = 0x1;
+const FS_IMMUTABLE_FL: c_int = 0x10;
+const SECTOR_SIZE: u64 = 512;
+
+/// EFI global variables kept under a directory.
+pub(crate) struct EfiVars(PathBuf);
+
+impl EfiVars {
+    pub(crate) fn system() -> Self {
+        EfiVars(EFIVARS.into())
+    }
+
+    fn path(&self, name: &str) -> PathBuf {
+        self.0.join(format!("{}-{}", name, GLOBAL_GUID))
+    }
+
+    // The variables start with their attributes.
+    fn read(&self, name: &str) -> io::Result<Option<Vec<u8>>> {
+        match fs::read(self.path(name)) {
+            Ok(data) if data.len() >= 4 => Ok(Some(data[4..].to_vec())),
+            Ok(_) => Err(invalid(&format!("{} is too short", name))),
+            Err(e) if e.kind() == io::ErrorKind::NotFound => Ok(None),
+            Err(e) => Err(e),
+        }
+    }
+
+    // efivarfs keeps the variables immutable, and takes the attributes
+    // along with the data in a single write.
+    fn write(&self, name: &str, data: &[u8]) -> io::Result<()> {
+        let path = self.path(name);
+        if let Ok(file) = File::open(&path) {
+            clear_immutable(&file)?;
+        }
+        let mut buf = ATTRIBUTES.to_le_bytes().to_vec();
+        buf.extend_from_slice(data);
+        OpenOptions::new().write(true).create(true).open(&path)?.write_all(&buf)
+    }
+
+    /// Boot entry the system has been booted from.
+    pub(crate) fn boot_current(&self) -> io::Result<Option<u16>> {
+        Ok(self.read("BootCurrent")?.and_then(|data| to_u16s(&data).first().copied()))
+    }
+
+    pub(crate) fn boot_order(&self) -> io::Result<Vec<u16>> {
+        Ok(self.read("BootOrder")?.map(|data| to_u16s(&data)).unwrap_or_default())
+    }
+
+    pub(crate) fn set_boot_order(&self, order: &[u16]) -> io::Result<()> {
+        self.write("BootOrder", &from_u16s(order))
+    }
+
+    /// Boots the `entry` on the next boot only, the boot order being
+    /// followed again afterwards.
+    pub(crate) fn set_boot_next(&self, entry: u16) -> io::Result<()> {
+        self.write("BootNext", &entry.to_le_bytes())
+    }
+
+    /// Finds the boot entry of the `description`.
+    pub(crate) fn find_entry(&self, description: &str) -> io::Result<Option<u16>> {
+        for entry in fs::read_dir(&self.0)? {
+            let name = entry?.file_name();
+            let name = name.to_string_lossy();
+            let number = match boot_entry_number(&name) {
+                Some(number) => number,
+                None => continue,
+            };
+            let option = self.read(&boot_entry_name(number))?.unwrap_or_default();
+            if load_option_description(&option).as_deref() == Some(description) {
+                return Ok(Some(number));
+            }
+        }
+        Ok(None)
+    }
+
+    /// Creates a boot entry, at the end of the boot order, booting the
+    /// `device_path`.
+    pub(crate) fn create_entry(&self, description: &str, device_path: &[u8]) -> io::Result<u16> {
+        let number = (0..=u16::MAX)
+            .find(|n| !self.path(&boot_entry_name(*n)).exists())
+            .ok_or_else(|| invalid("no boot entry is free"))?;
+        info!("creating EFI boot entry {} for {}", boot_entry_name(number), description);
+        self.write(&boot_entry_name(number), &load_option(description, device_path))?;
+
+        let mut order = self.boot_order()?;
+        order.push(number);
+        self.set_boot_order(&order)?;
+        Ok(number)
+    }
+}
+
+/// Finds the boot entry of the installation set, creating it when
+/// missing.
+pub(crate) fn entry(efivars: &EfiVars, entry: &EfiBootEntry) -> io::Result<u16> {
+    if let Some(number) = efivars.find_entry(&entry.description)? {
+        return Ok(number);
+    }
+    let partition = Partition::from_device(&entry.partition)?;
+    efivars.create_entry(&entry.description, &device_path(&partition, &entry.loader))
+}
+
+fn boot_entry_name(number: u16) -> String {
+    format!("Boot{:04X}", number)
+}
+
+fn boot_entry_number(name: &str) -> Option<u16> {
+    let suffix = format!("-{}", GLOBAL_GUID);
+    if !name.starts_with("Boot") || !name.ends_with(&suffix) {
+        return None;
+    }
+    let number = &name[4..name.len() - suffix.len()];
+    if number.len() != 4 || !number.chars().all(|c| c.is_ascii_hexdigit()) {
+        return None;
+    }
+    u16::from_str_radix(number, 16).ok()
+}
+
+fn to_u16s(data: &[u8]) -> Vec<u16> {
+    data.chunks_exact(2).map(|c| u16::from_le_bytes([c[0], c[1]])).collect()
+}
+
+fn from_u16s(values: &[u16]) -> Vec<u8> {
+    values.iter().flat_map(|v| v.to_le_bytes().to_vec()).collect()
+}
+
+fn ucs2(s: &str) -> Vec<u8> {
+    from_u16s(&s.encode_utf16().chain(std::iter::once(0)).collect::<Vec<_>>())
+}
+
+// EFI_LOAD_OPTION: the attributes, the size of the device path, the
+// description and the device path.
+fn load_option(description: &str, device_path: &[u8]) -> Vec<u8> {
+    let mut option = LOAD_OPTION_ACTIVE.to_le_bytes().to_vec();
+    option.extend_from_slice(&(device_path.len() as u16).to_le_bytes());
+    option.extend(ucs2(description));
+    option.extend_from_slice(device_path);
+    option
+}
+
+fn load_option_description(option: &[u8]) -> Option<String> {
+    let chars = to_u16s(option.get(6..)?);
+    let end = chars.iter().position(|c| *c == 0)?;
+    String::from_utf16(&chars[..end]).ok()
+}
+
+/// GPT partition, as the hard drive media device path refers to it.
+#[derive(Debug, PartialEq)]
+struct Partition {
+    number: u32,
+    start: u64,
+    size: u64,
+    guid: [u8; 16],
+}
+
+impl Partition {
+    fn from_device(device: &Path) -> io::Result<Self> {
+        let device = device.canonicalize()?;
+        let name = device.file_name().ok_or_else(|| invalid("invalid partition"))?;
+        let sys = Path::new("/sys/class/block").join(name).canonicalize()?;
+        let attr = |path: &Path| -> io::Result<u64> {
+            fs::read_to_string(path)?
+                .trim()
+                .parse()
+                .map_err(|_| invalid(&format!("invalid value in {:?}", path)))
+        };
+        // The sizes are given in sectors, while the device path takes
+        // the logical blocks of the disk.
+        let disk = sys.parent().ok_or_else(|| invalid("partition has no disk"))?;
+        let block_size = attr(&disk.join("queue/logical_block_size"))?.max(1);
+
+        let mut guid = None;
+        for link in fs::read_dir("/dev/disk/by-partuuid")? {
+            let link = link?;
+            if link.path().canonicalize().ok().as_ref() == Some(&device) {
+                guid = parse_guid(&link.file_name().to_string_lossy());
+                break;
+            }
+        }
+        debug!("found partition {:?} with guid {:?}", device, guid);
+
+        Ok(Partition {
+            number: attr(&sys.join("partition"))? as u32,
+            start: attr(&sys.join("start"))? * SECTOR_SIZE / block_size,
+            size: attr(&sys.join("size"))? * SECTOR_SIZE / block_size,
+            guid: guid.ok_or_else(|| invalid(&format!("{:?} is not a GPT partition", device)))?,
+        })
+    }
+}
+
+// The first three fields of the GUID are kept in little endian.
+fn parse_guid(s: &str) -> Option<[u8; 16]> {
+    let hex = s.replace('-', "");
+    if hex.len() != 32 || s.len() != 36 {
+        return None;
+    }
+    let bytes = crate::utils::hex_decode(&hex)?;
+    let mut guid = [0; 16];
+    guid.copy_from_slice(&bytes);
+    guid[0..4].reverse();
+    guid[4..6].reverse();
+    guid[6..8].reverse();
+    Some(guid)
+}
+
+// Hard drive media node, followed by the file path node of the loader.
+fn device_path(partition: &Partition, loader: &str) -> Vec<u8> {
+    let mut path = vec![0x04, 0x01, 42, 0];
+    path.extend_from_slice(&partition.number.to_le_bytes());
+    path.extend_from_slice(&partition.start.to_le_bytes());
+    path.extend_from_slice(&partition.size.to_le_bytes());
+    path.extend_from_slice(&partition.guid);
+    // GPT partition, identified by its GUID.
+    path.extend_from_slice(&[0x02, 0x02]);
+
+    let file = ucs2(&loader.replace('/', "\\"));
+    path.extend_from_slice(&[0x04, 0x04]);
+    path.extend_from_slice(&(4 + file.len() as u16).to_le_bytes());
+    path.extend(file);
+
+    path.extend_from_slice(&[0x7f, 0xff, 0x04, 0x00]);
+    path
+}
+
+// Filesystems other than efivarfs may not support the flags.
+fn clear_immutable(file: &File) -> io::Result<()> {
+    let mut flags: c_int = 0;
+    match unsafe { ffi::get_flags(file.as_raw_fd(), &mut flags) } {
+        Ok(_) => {}
+        Err(nix::Error::Sys(nix::errno::Errno::ENOTTY))
+        | Err(nix::Error::Sys(nix::errno::Errno::EOPNOTSUPP)) => return Ok(()),
+        Err(e) => return Err(io::Error::new(io::ErrorKind::Other, e)),
+    }
+    if flags & FS_IMMUTABLE_FL != 0 {
+        flags &= !FS_IMMUTABLE_FL;
+        unsafe { ffi::set_flags(file.as_raw_fd(), &flags) }
+            .map_err(|e| io::Error::new(io::ErrorKind::Other, e))?;
+    }
+    Ok(())
+}
+
+fn invalid(msg: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, msg.to_owned())
+}
+
+mod ffi {
+    use nix::{ioctl_read_bad, ioctl_write_ptr_bad, request_code_read, request_code_write};
+    use std::os::raw::{c_int, c_long};
+
+    // From https://github.com/torvalds/linux/blob/master/include/uapi/linux/fs.h
+    // The flags are an int, despite being encoded as a long.
+    ioctl_read_bad!(get_flags, request_code_read!(b'f', 1, std::mem::size_of::<c_long>()), c_int);
+    ioctl_write_ptr_bad!(
+        set_flags,
+        request_code_write!(b'f', 2, std::mem::size_of::<c_long>()),
+        c_int
+    );
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn partition() -> Partition {
+        Partition {
+            number: 2,
+            start: 2048,
+            size: 1_048_576,
+            guid: parse_guid("2a9c2b8e-5ec6-4a5b-9d0c-4c6b2f1e7a01").unwrap(),
+        }
+    }
+
+    #[test]
+    fn build_device_path() {
+        let path = device_path(&partition(), "/EFI/Linux/a.efi");
+        assert_eq!(&path[..4], &[0x04, 0x01, 42, 0]);
+        assert_eq!(&path[4..8], &2u32.to_le_bytes());
+        assert_eq!(&path[24..28], &[0x8e, 0x2b, 0x9c, 0x2a]);
+        assert_eq!(&path[40..42], &[0x02, 0x02]);
+        assert_eq!(&path[42..44], &[0x04, 0x04]);
+        assert_eq!(&path[46..48], &[b'\\', 0]);
+        assert_eq!(&path[path.len() - 4..], &[0x7f, 0xff, 0x04, 0x00]);
+        assert_eq!(parse_guid("not-a-guid"), None);
+    }
+
+    #[test]
+    fn manage_boot_entries() {
+        let dir = tempfile::tempdir().unwrap();
+        let efivars = EfiVars(dir.path().to_owned());
+        assert_eq!(efivars.boot_current().unwrap(), None);
+        assert_eq!(efivars.find_entry("UpdateHub A").unwrap(), None);
+
+        efivars.write("Boot0000", &load_option("Shell", &[0x7f, 0xff, 0x04, 0x00])).unwrap();
+        efivars.set_boot_order(&[0]).unwrap();
+        let path = device_path(&partition(), "/EFI/Linux/a.efi");
+        let a = efivars.create_entry("UpdateHub A", &path).unwrap();
+        let b = efivars.create_entry("UpdateHub B", &path).unwrap();
+        assert_eq!((a, b), (1, 2));
+        assert_eq!(efivars.boot_order().unwrap(), vec![0, 1, 2]);
+        assert_eq!(efivars.find_entry("UpdateHub B").unwrap(), Some(2));
+        assert_eq!(
+            fs::read(efivars.path("Boot0001")).unwrap()[..8],
+            [0x07, 0, 0, 0, 0x01, 0, 0, 0]
+        );
+
+        efivars.set_boot_next(b).unwrap();
+        assert_eq!(efivars.read("BootNext").unwrap(), Some(vec![2, 0]));
+        efivars.write("BootCurrent", &b.to_le_bytes()).unwrap();
+        assert_eq!(efivars.boot_current().unwrap(), Some(2));
+    }
+}
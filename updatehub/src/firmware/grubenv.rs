@@ -0,0 +1,135 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! GRUB environment block, read and written as `grub-editenv` does: a
+//! 1024 bytes file of `name=value` lines, after its header, padded with
+//! `#`. The backslashes and new lines of the values are escaped.
+
+use std::{
+    collections::BTreeMap,
+    fs,
+    io::{self, Write},
+    path::Path,
+};
+
+const HEADER: &str = "# GRUB Environment Block\n";
+const SIZE: usize = 1024;
+
+/// Variables of the GRUB environment block.
+#[derive(Debug, Default, PartialEq)]
+pub(crate) struct GrubEnv(pub(crate) BTreeMap<String, String>);
+
+impl GrubEnv {
+    pub(crate) fn load(path: &Path) -> io::Result<Self> {
+        Self::parse(&fs::read(path)?)
+    }
+
+    fn parse(data: &[u8]) -> io::Result<Self> {
+        let data = String::from_utf8_lossy(data);
+        if !data.starts_with(HEADER) {
+            return Err(invalid("missing the environment block header"));
+        }
+
+        let mut vars = BTreeMap::default();
+        let mut line = String::default();
+        let mut chars = data[HEADER.len()..].chars();
+        while let Some(c) = chars.next() {
+            match c {
+                '\\' => line.extend(chars.next()),
+                '\n' => {
+                    parse_line(&line, &mut vars);
+                    line.clear();
+                }
+                c => line.push(c),
+            }
+        }
+        parse_line(&line, &mut vars);
+
+        Ok(GrubEnv(vars))
+    }
+
+    /// Writes the environment block to `path`, replacing it once it has
+    /// been fully written, so a power cut doesn't leave GRUB without it.
+    pub(crate) fn save(&self, path: &Path) -> io::Result<()> {
+        let data = self.serialize()?;
+        let dir = match path.parent() {
+            Some(dir) if !dir.as_os_str().is_empty() => dir,
+            _ => Path::new("."),
+        };
+        let mut file = tempfile::NamedTempFile::new_in(dir)?;
+        file.write_all(&data)?;
+        file.as_file().sync_all()?;
+        file.persist(path).map_err(|e| e.error)?;
+        Ok(())
+    }
+
+    fn serialize(&self) -> io::Result<Vec<u8>> {
+        let mut data = String::from(HEADER);
+        for (name, value) in self.0.iter() {
+            data.push_str(name);
+            data.push('=');
+            for c in value.chars() {
+                if c == '\\' || c == '\n' {
+                    data.push('\\');
+                }
+                data.push(c);
+            }
+            data.push('\n');
+        }
+        if data.len() > SIZE {
+            return Err(invalid("variables don't fit in the environment block"));
+        }
+
+        let mut data = data.into_bytes();
+        data.resize(SIZE, b'#');
+        Ok(data)
+    }
+}
+
+// The padding, as the comments, have no `=` and are skipped.
+fn parse_line(line: &str, vars: &mut BTreeMap<String, String>) {
+    if line.starts_with('#') {
+        return;
+    }
+    let mut parts = line.splitn(2, '=');
+    if let (Some(name), Some(value)) = (parts.next(), parts.next()) {
+        vars.insert(name.to_owned(), value.to_owned());
+    }
+}
+
+fn invalid(msg: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, format!("invalid GRUB environment block: {}", msg))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn read_and_write() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("grubenv");
+        // As written by `grub-editenv grubenv set updatehub_active=1`
+        let mut data = format!("{}saved_entry=0\nupdatehub_active=1\n", HEADER).into_bytes();
+        data.resize(SIZE, b'#');
+        fs::write(&path, &data).unwrap();
+
+        let mut env = GrubEnv::load(&path).unwrap();
+        assert_eq!(env.0["updatehub_active"], "1");
+        assert_eq!(env.0["saved_entry"], "0");
+        assert_eq!(env.serialize().unwrap(), data);
+
+        env.0.insert("updatehub_active".to_owned(), "0".to_owned());
+        env.0.insert("cmdline".to_owned(), "a\\b\nc".to_owned());
+        env.save(&path).unwrap();
+        let data = fs::read(&path).unwrap();
+        assert_eq!(data.len(), SIZE);
+        assert_eq!(GrubEnv::load(&path).unwrap(), env);
+
+        env.0.insert("big".to_owned(), "x".repeat(SIZE));
+        assert!(env.save(&path).is_err());
+        assert!(GrubEnv::parse(b"updatehub_active=1\n").is_err());
+    }
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Active/inactive backend implemented by an executable shipped along the
+//! board support, so custom slot switching, as an EEPROM or PMIC register
+//! or a proprietary bootloader, doesn't require changes to the agent.
+//!
+//! The helper is run with the command as its only argument, `get-active`,
+//! `set-active` or `validate`, and is given the request in JSON on its
+//! standard input:
+//!
+//! ```json
+//! {"version": 1, "command": "set-active", "installation_set": "b"}
+//! ```
+//!
+//! It answers in JSON on its standard output, with the active
+//! installation set for `get-active`, and exits with success:
+//!
+//! ```json
+//! {"installation_set": "a"}
+//! ```
+//!
+//! A failure is told by a non-zero exit status, with the reason given as
+//! `{"error": "..."}` on the standard output. The standard error is only
+//! logged.
+
+use super::{hook::run_with_input, Error, Result};
+use sdk::api::info::{runtime_settings::InstallationSet, settings::ActiveInactive};
+use serde::{Deserialize, Serialize};
+use slog_scope::debug;
+use std::fmt;
+
+/// Version of the protocol the agent speaks.
+const PROTOCOL_VERSION: u32 = 1;
+
+#[derive(Debug, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+enum Command {
+    GetActive,
+    SetActive,
+    Validate,
+}
+
+impl fmt::Display for Command {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}",
+            match self {
+                Command::GetActive => "get-active",
+                Command::SetActive => "set-active",
+                Command::Validate => "validate",
+            }
+        )
+    }
+}
+
+#[derive(Debug, Serialize)]
+struct Request {
+    version: u32,
+    command: Command,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    installation_set: Option<InstallationSet>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct Response {
+    #[serde(default)]
+    version: Option<u32>,
+    #[serde(default)]
+    installation_set: Option<InstallationSet>,
+    #[serde(default)]
+    error: Option<String>,
+}
+
+/// Installation set the helper reports as active.
+pub(crate) fn get_active(settings: &ActiveInactive) -> Result<InstallationSet> {
+    run(settings, Command::GetActive, None)?.installation_set.ok_or_else(|| {
+        Error::HelperFailed("get-active has not answered the installation set".to_owned())
+    })
+}
+
+/// Makes the helper boot the `set` from the next boot on.
+pub(crate) fn set_active(settings: &ActiveInactive, set: InstallationSet) -> Result<()> {
+    run(settings, Command::SetActive, Some(set)).map(|_| ())
+}
+
+/// Tells the helper the installation set booted into is working.
+pub(crate) fn validate(settings: &ActiveInactive) -> Result<()> {
+    run(settings, Command::Validate, None).map(|_| ())
+}
+
+fn run(
+    settings: &ActiveInactive,
+    command: Command,
+    installation_set: Option<InstallationSet>,
+) -> Result<Response> {
+    let arg = command.to_string();
+    let input =
+        serde_json::to_vec(&Request { version: PROTOCOL_VERSION, command, installation_set })?;
+    debug!("running {:?} {}", settings.helper, arg);
+
+    let timeout = settings.helper_timeout.to_std().unwrap_or_default();
+    let (status, stdout, stderr) =
+        run_with_input(&settings.helper, &[&arg], Some(&input), timeout)?;
+    let response = parse_response(&arg, &stdout)?;
+    if !status.success() {
+        return Err(Error::HookFailed(settings.helper.clone(), status, stderr));
+    }
+    Ok(response)
+}
+
+fn parse_response(command: &str, output: &str) -> Result<Response> {
+    // Commands which have nothing to answer may leave the output empty.
+    if output.is_empty() {
+        return Ok(Response::default());
+    }
+
+    let response = serde_json::from_str::<Response>(output).map_err(|e| {
+        Error::HelperFailed(format!("{} has answered an invalid response: {}", command, e))
+    })?;
+    if let Some(version) = response.version.filter(|v| *v != PROTOCOL_VERSION) {
+        return Err(Error::HelperFailed(format!(
+            "{} has answered with the unsupported protocol version {}",
+            command, version
+        )));
+    }
+    if let Some(ref e) = response.error {
+        return Err(Error::HelperFailed(format!("{} has failed: {}", command, e)));
+    }
+    Ok(response)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use std::{fs, os::unix::fs::PermissionsExt};
+
+    // The helper keeps the active installation set in a file along it and
+    // records the requests it is given.
+    fn fake_helper(dir: &std::path::Path) -> ActiveInactive {
+        let helper = dir.join("helper");
+        fs::write(
+            &helper,
+            format!(
+                r#"#!/bin/sh
+cd {dir:?}
+request=$(cat)
+echo "$request" >> requests
+case "$1" in
+    get-active) echo "{{\"version\": 1, \"installation_set\": \"$(cat active)\"}}" ;;
+    set-active) echo "$request" | sed 's/.*"installation_set":"\(.\)".*/\1/' > active ;;
+    validate) echo '{{"error": "not booted yet"}}'; exit 1 ;;
+esac
+"#,
+                dir = dir
+            ),
+        )
+        .unwrap();
+        fs::set_permissions(&helper, fs::Permissions::from_mode(0o755)).unwrap();
+        fs::write(dir.join("active"), "a").unwrap();
+        ActiveInactive { helper, ..ActiveInactive::default() }
+    }
+
+    #[test]
+    fn protocol() {
+        let dir = tempfile::tempdir().unwrap();
+        let settings = fake_helper(dir.path());
+
+        assert_eq!(get_active(&settings).unwrap(), InstallationSet::A);
+        set_active(&settings, InstallationSet::B).unwrap();
+        assert_eq!(get_active(&settings).unwrap(), InstallationSet::B);
+        assert_eq!(
+            fs::read_to_string(dir.path().join("requests")).unwrap().lines().collect::<Vec<_>>(),
+            vec![
+                r#"{"version":1,"command":"get-active"}"#,
+                r#"{"version":1,"command":"set-active","installation_set":"b"}"#,
+                r#"{"version":1,"command":"get-active"}"#,
+            ]
+        );
+
+        match validate(&settings) {
+            Err(Error::HelperFailed(e)) => assert_eq!(e, "validate has failed: not booted yet"),
+            res => panic!("Unexpected result: {:?}", res),
+        }
+    }
+
+    #[test]
+    fn responses() {
+        assert_eq!(
+            parse_response("get-active", r#"{"installation_set": "b"}"#).unwrap().installation_set,
+            Some(InstallationSet::B)
+        );
+        assert_eq!(parse_response("validate", "").unwrap().installation_set, None);
+        assert!(parse_response("get-active", r#"{"installation_set": "c"}"#).is_err());
+        assert!(parse_response("get-active", r#"{"version": 2}"#).is_err());
+        assert!(parse_response("get-active", "a").is_err());
+    }
+}
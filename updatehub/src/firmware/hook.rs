@@ -2,18 +2,140 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::firmware::Result;
-use sdk::api::info::firmware::MetadataValue;
-use slog_scope::error;
-use std::{io, path::Path};
+use crate::firmware::{Error, Result};
+use lazy_static::lazy_static;
+use sdk::api::info::{firmware::MetadataValue, settings::Firmware};
+use slog_scope::{debug, error};
+use std::{
+    collections::HashMap,
+    io::{self, Read, Write},
+    path::{Path, PathBuf},
+    process::{Command, ExitStatus, Stdio},
+    sync::{Mutex, RwLock},
+    thread,
+    time::{Duration, Instant},
+};
 use walkdir::WalkDir;
 
+// How often a running hook is checked for having finished.
+const POLL_INTERVAL: Duration = Duration::from_millis(10);
+
+lazy_static! {
+    static ref CONFIG: RwLock<(Duration, Duration)> =
+        RwLock::new((Duration::from_secs(30), Duration::default()));
+    static ref CACHE: Mutex<HashMap<PathBuf, (Instant, String)>> = Mutex::new(HashMap::new());
+}
+
+/// Sets the time the metadata hooks are given to finish and the time
+/// their outputs are cached for, dropping the outputs cached so far.
+pub(crate) fn configure(settings: &Firmware) {
+    let timeout = settings.metadata_timeout.to_std().unwrap_or_default();
+    let cache = settings.metadata_cache.to_std().unwrap_or_default();
+    *CONFIG.write().expect("poisoned hooks configuration lock") = (timeout, cache);
+    CACHE.lock().expect("poisoned hooks cache lock").clear();
+}
+
 pub(crate) fn run_hook(path: &Path) -> Result<String> {
     if !path.exists() {
         return Ok("".into());
     }
 
-    Ok(run_script(path.to_str().expect("invalid path for hook"))?)
+    let (timeout, cache) = *CONFIG.read().expect("poisoned hooks configuration lock");
+    cached(&mut CACHE.lock().expect("poisoned hooks cache lock"), path, cache, || {
+        run_with_timeout(path, timeout)
+    })
+}
+
+// Only the outputs of the hooks which have succeeded are kept.
+fn cached(
+    cache: &mut HashMap<PathBuf, (Instant, String)>,
+    path: &Path,
+    ttl: Duration,
+    run: impl FnOnce() -> Result<String>,
+) -> Result<String> {
+    if let Some((at, output)) = cache.get(path) {
+        if at.elapsed() < ttl {
+            debug!("using the cached output of {:?}", path);
+            return Ok(output.clone());
+        }
+    }
+
+    let output = run()?;
+    if ttl > Duration::default() {
+        cache.insert(path.to_owned(), (Instant::now(), output.clone()));
+    }
+    Ok(output)
+}
+
+fn run_with_timeout(path: &Path, timeout: Duration) -> Result<String> {
+    let (status, stdout, stderr) = run_with_input(path, &[], None, timeout)?;
+    if !status.success() {
+        return Err(Error::HookFailed(path.to_owned(), status, stderr));
+    }
+
+    Ok(stdout)
+}
+
+// Runs the executable with the `args`, writing the `input` to its
+// standard input, and returns its exit status along with its trimmed
+// standard output and error. The outputs are read from other threads, so
+// the executable doesn't block writing to a full pipe while it is waited
+// for.
+pub(super) fn run_with_input(
+    path: &Path,
+    args: &[&str],
+    input: Option<&[u8]>,
+    timeout: Duration,
+) -> Result<(ExitStatus, String, String)> {
+    let mut child = Command::new(path)
+        .args(args)
+        .stdin(if input.is_some() { Stdio::piped() } else { Stdio::null() })
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+    if let Some(input) = input {
+        // A hook which exits without reading its input is left to be
+        // judged by its exit status.
+        let mut stdin = child.stdin.take().expect("stdin is piped");
+        if let Err(e) = stdin.write_all(input) {
+            if e.kind() != io::ErrorKind::BrokenPipe {
+                let _ = child.kill();
+                let _ = child.wait();
+                return Err(e.into());
+            }
+        }
+    }
+    let read = |mut pipe: Box<dyn Read + Send>| {
+        thread::spawn(move || {
+            let mut output = String::default();
+            let _ = pipe.read_to_string(&mut output);
+            output
+        })
+    };
+    let stdout = read(Box::new(child.stdout.take().expect("stdout is piped")));
+    let stderr = read(Box::new(child.stderr.take().expect("stderr is piped")));
+
+    let deadline = Instant::now() + timeout;
+    let status = loop {
+        if let Some(status) = child.try_wait()? {
+            break status;
+        }
+        if Instant::now() >= deadline {
+            // The readers are left behind, as processes spawned by the
+            // hook may keep the pipes open.
+            error!("{:?} has not finished within {:?}, killing it", path, timeout);
+            let _ = child.kill();
+            let _ = child.wait();
+            return Err(Error::HookTimeout(path.to_owned(), timeout));
+        }
+        thread::sleep(POLL_INTERVAL);
+    };
+
+    let stdout = stdout.join().unwrap_or_default();
+    let stderr = stderr.join().unwrap_or_default();
+    stderr.lines().for_each(|err| error!("{:?} (stderr): {}", path, err));
+
+    Ok((status, stdout.trim().into(), stderr.trim().into()))
 }
 
 pub(crate) fn run_hooks_from_dir(path: &Path) -> Result<MetadataValue> {
@@ -74,3 +196,52 @@ fn invalid() {
     assert!(metadata_value_from_str("\n").is_err());
     assert!(metadata_value_from_str("key").is_err());
 }
+
+#[test]
+fn hook_timeout_and_failure() {
+    use crate::firmware::tests::create_hook;
+    use pretty_assertions::assert_eq;
+
+    let dir = tempfile::tempdir().unwrap();
+    let hook = dir.path().join("hook");
+    create_hook(hook.clone(), "#!/bin/sh\necho board");
+    assert_eq!(run_with_timeout(&hook, Duration::from_secs(5)).unwrap(), "board");
+
+    create_hook(hook.clone(), "#!/bin/sh\nsleep 10");
+    let started = Instant::now();
+    match run_with_timeout(&hook, Duration::from_millis(100)) {
+        Err(Error::HookTimeout(..)) => assert!(started.elapsed() < Duration::from_secs(5)),
+        res => panic!("Unexpected result: {:?}", res),
+    }
+
+    create_hook(hook.clone(), "#!/bin/sh\necho 'no hardware' >&2\nexit 1");
+    match run_with_timeout(&hook, Duration::from_secs(5)) {
+        Err(Error::HookFailed(_, _, stderr)) => assert_eq!(stderr, "no hardware"),
+        res => panic!("Unexpected result: {:?}", res),
+    }
+}
+
+#[test]
+fn cache_hook_outputs() {
+    use pretty_assertions::assert_eq;
+    use std::cell::Cell;
+
+    let mut cache = HashMap::default();
+    let runs = Cell::new(0);
+    let run = || {
+        runs.set(runs.get() + 1);
+        Ok(format!("run {}", runs.get()))
+    };
+    let path = Path::new("/hook");
+
+    assert_eq!(cached(&mut cache, path, Duration::default(), run).unwrap(), "run 1");
+    assert_eq!(cached(&mut cache, path, Duration::default(), run).unwrap(), "run 2");
+    assert_eq!(cached(&mut cache, path, Duration::from_secs(60), run).unwrap(), "run 3");
+    assert_eq!(cached(&mut cache, path, Duration::from_secs(60), run).unwrap(), "run 3");
+
+    // Failures aren't cached
+    cache.clear();
+    assert!(cached(&mut cache, path, Duration::from_secs(60), || Err(Error::MissingProductUid))
+        .is_err());
+    assert_eq!(cached(&mut cache, path, Duration::from_secs(60), run).unwrap(), "run 4");
+}
@@ -2,14 +2,42 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::firmware::hook::run_script;
-use sdk::api::info::runtime_settings::InstallationSet;
-use std::{fmt, str::FromStr};
+use crate::firmware::{
+    barebox,
+    efi::{self, EfiVars},
+    grubenv::GrubEnv,
+    helper,
+    hook::run_script,
+};
+use lazy_static::lazy_static;
+use sdk::api::info::{
+    runtime_settings::InstallationSet,
+    settings::{ActiveInactive, ActiveInactiveBackend},
+};
+use slog_scope::warn;
+use std::{fmt, str::FromStr, sync::RwLock};
 
 const GET_SCRIPT: &str = "updatehub-active-get";
 const SET_SCRIPT: &str = "updatehub-active-set";
 const VALIDATE_SCRIPT: &str = "updatehub-active-validated";
 
+// GRUB variable set while the installation set booted into hasn't been
+// validated yet, so the GRUB configuration can fall back to the other.
+const GRUB_UPGRADE_AVAILABLE: &str = "upgrade_available";
+
+lazy_static! {
+    static ref BACKEND: RwLock<ActiveInactive> = RwLock::new(ActiveInactive::default());
+}
+
+/// Sets how the active installation set is read and changed.
+pub(crate) fn configure(settings: &ActiveInactive) {
+    *BACKEND.write().expect("poisoned active/inactive backend lock") = settings.clone();
+}
+
+fn backend() -> ActiveInactive {
+    BACKEND.read().expect("poisoned active/inactive backend lock").clone()
+}
+
 #[derive(PartialEq, Debug, Copy, Clone)]
 pub struct Set(pub InstallationSet);
 
@@ -40,23 +68,123 @@ impl fmt::Display for Set {
 }
 
 pub fn active() -> super::Result<Set> {
-    Ok(run_script(GET_SCRIPT)?.parse()?)
+    active_in(&backend())
 }
 
 pub fn inactive() -> super::Result<Set> {
-    match active()? {
+    inactive_in(&backend())
+}
+
+pub fn swap_active() -> super::Result<()> {
+    swap_active_in(&backend())
+}
+
+pub fn validate() -> super::Result<()> {
+    validate_in(&backend())
+}
+
+fn active_in(backend: &ActiveInactive) -> super::Result<Set> {
+    match backend.backend {
+        ActiveInactiveBackend::Scripts => Ok(run_script(GET_SCRIPT)?.parse()?),
+        // The first installation set is booted until the variable is set.
+        ActiveInactiveBackend::Grub => {
+            match GrubEnv::load(&backend.grub_env)?.0.get(&backend.grub_variable) {
+                Some(value) => Ok(value.parse()?),
+                None => Ok(Set(InstallationSet::A)),
+            }
+        }
+        // Boots from other entries, as a removable media, are taken as
+        // the first installation set.
+        ActiveInactiveBackend::Efi => {
+            let efivars = EfiVars::system();
+            let current = efivars.boot_current()?;
+            for (idx, set) in [InstallationSet::A, InstallationSet::B].iter().enumerate() {
+                let entry = &backend.efi_entries[idx];
+                if current.is_some() && efivars.find_entry(&entry.description)? == current {
+                    return Ok(Set(*set));
+                }
+            }
+            warn!("booted EFI entry {:?} isn't of any installation set", current);
+            Ok(Set(InstallationSet::A))
+        }
+        ActiveInactiveBackend::Barebox => match barebox::booted(&backend.barebox_targets)? {
+            0 => Ok(Set(InstallationSet::A)),
+            _ => Ok(Set(InstallationSet::B)),
+        },
+        ActiveInactiveBackend::Helper => Ok(Set(helper::get_active(backend)?)),
+    }
+}
+
+fn inactive_in(backend: &ActiveInactive) -> super::Result<Set> {
+    match active_in(backend)? {
         Set(InstallationSet::A) => Ok(Set(InstallationSet::B)),
         Set(InstallationSet::B) => Ok(Set(InstallationSet::A)),
     }
 }
 
-pub fn swap_active() -> super::Result<()> {
-    let _ = run_script(&format!("{} {}", SET_SCRIPT, inactive()?))?;
+fn swap_active_in(backend: &ActiveInactive) -> super::Result<()> {
+    let inactive = inactive_in(backend)?;
+    match backend.backend {
+        ActiveInactiveBackend::Scripts => {
+            let _ = run_script(&format!("{} {}", SET_SCRIPT, inactive))?;
+        }
+        ActiveInactiveBackend::Grub => {
+            let mut env = GrubEnv::load(&backend.grub_env)?;
+            env.0.insert(backend.grub_variable.clone(), inactive.to_string());
+            env.0.insert(GRUB_UPGRADE_AVAILABLE.to_owned(), "1".to_owned());
+            env.save(&backend.grub_env)?;
+        }
+        // The inactive installation set is booted only once, so a failed
+        // boot falls back to the boot order.
+        ActiveInactiveBackend::Efi => {
+            let efivars = EfiVars::system();
+            let entry = efi::entry(&efivars, &backend.efi_entries[inactive.0 as usize])?;
+            efivars.set_boot_next(entry)?;
+        }
+        // The remaining attempts let barebox fall back to the active
+        // installation set when the inactive one fails to boot.
+        ActiveInactiveBackend::Barebox => barebox::set_primary(
+            &backend.barebox_targets,
+            inactive.0 as usize,
+            backend.barebox_attempts,
+        )?,
+        ActiveInactiveBackend::Helper => helper::set_active(backend, inactive.0)?,
+    }
     Ok(())
 }
 
-pub fn validate() -> super::Result<()> {
-    let _ = run_script(VALIDATE_SCRIPT)?;
+fn validate_in(backend: &ActiveInactive) -> super::Result<()> {
+    match backend.backend {
+        ActiveInactiveBackend::Scripts => {
+            let _ = run_script(VALIDATE_SCRIPT)?;
+        }
+        ActiveInactiveBackend::Grub => {
+            let mut env = GrubEnv::load(&backend.grub_env)?;
+            if env.0.remove(GRUB_UPGRADE_AVAILABLE).is_some() {
+                env.save(&backend.grub_env)?;
+            }
+        }
+        // The booted entry becomes the first of the boot order.
+        ActiveInactiveBackend::Efi => {
+            let efivars = EfiVars::system();
+            if let Some(current) = efivars.boot_current()? {
+                let mut order = efivars.boot_order()?;
+                if order.first() != Some(&current) {
+                    order.retain(|entry| *entry != current);
+                    order.insert(0, current);
+                    efivars.set_boot_order(&order)?;
+                }
+            }
+        }
+        ActiveInactiveBackend::Barebox => {
+            let active = active_in(backend)?;
+            barebox::mark_good(
+                &backend.barebox_targets[active.0 as usize],
+                backend.barebox_attempts,
+            )?;
+        }
+        ActiveInactiveBackend::Helper => helper::validate(backend)?,
+    }
     Ok(())
 }
 
@@ -99,3 +227,28 @@ fn works() {
     assert_eq!(inactive().unwrap(), Set(InstallationSet::A));
     assert!(swap_active().is_ok());
 }
+
+#[test]
+fn grub_backend() {
+    use pretty_assertions::assert_eq;
+
+    let dir = tempfile::tempdir().unwrap();
+    let grub_env = dir.path().join("grubenv");
+    GrubEnv::default().save(&grub_env).unwrap();
+    let backend = ActiveInactive {
+        backend: ActiveInactiveBackend::Grub,
+        grub_env: grub_env.clone(),
+        grub_variable: "updatehub_active".to_owned(),
+        ..ActiveInactive::default()
+    };
+
+    assert_eq!(active_in(&backend).unwrap(), Set(InstallationSet::A));
+    swap_active_in(&backend).unwrap();
+    assert_eq!(active_in(&backend).unwrap(), Set(InstallationSet::B));
+    let env = GrubEnv::load(&grub_env).unwrap();
+    assert_eq!(env.0["updatehub_active"], "1");
+    assert_eq!(env.0[GRUB_UPGRADE_AVAILABLE], "1");
+
+    validate_in(&backend).unwrap();
+    assert!(!GrubEnv::load(&grub_env).unwrap().0.contains_key(GRUB_UPGRADE_AVAILABLE));
+}
@@ -2,29 +2,41 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
+mod barebox;
+mod builtin;
+mod efi;
+pub(crate) mod grubenv;
+mod helper;
 mod hook;
 pub mod installation_set;
 
 #[cfg(feature = "test-env")]
 pub mod tests;
 
+pub(crate) use self::hook::configure as configure_hooks;
 use self::hook::{run_hook, run_hooks_from_dir};
 use derive_more::{Deref, DerefMut};
 pub use sdk::api::info::firmware as api;
+use sdk::api::info::settings::{DeviceAttributes, Simulation};
 use slog_scope::{error, trace};
-use std::{io, path::Path};
+use std::{
+    io,
+    path::{Path, PathBuf},
+};
 use thiserror::Error;
 
 const PRODUCT_UID_HOOK: &str = "product-uid";
 const VERSION_HOOK: &str = "version";
 const HARDWARE_HOOK: &str = "hardware";
 const PUB_KEY: &str = "key.pub";
+const DECRYPTION_KEY: &str = "key.pem";
 const DEVICE_IDENTITY_DIR: &str = "device-identity.d";
 const DEVICE_ATTRIBUTES_DIR: &str = "device-attributes.d";
 const STATE_CHANGE_CALLBACK: &str = "state-change-callback";
 const VALIDATE_CALLBACK: &str = "validate-callback";
 const ROLLBACK_CALLBACK: &str = "rollback-callback";
 const ERROR_CALLBACK: &str = "error-callback";
+const BOOTABILITY_PROBE: &str = "bootability-probe";
 
 pub type Result<T> = std::result::Result<T, Error>;
 
@@ -42,12 +54,24 @@ pub enum Error {
     #[error("{0} is a invalid value. The only know ones are 0 or 1")]
     InvalidInstallSet(u8),
 
+    #[error("{0:?} has not finished within {1:?}")]
+    HookTimeout(PathBuf, std::time::Duration),
+
+    #[error("{0:?} has failed with {1}: {2}")]
+    HookFailed(PathBuf, std::process::ExitStatus, String),
+
+    #[error("active/inactive helper: {0}")]
+    HelperFailed(String),
+
     #[error(transparent)]
     ParseInt(#[from] std::num::ParseIntError),
 
     #[error(transparent)]
     Walkdir(#[from] walkdir::Error),
 
+    #[error(transparent)]
+    Json(#[from] serde_json::Error),
+
     #[error(transparent)]
     Io(#[from] std::io::Error),
 
@@ -71,15 +95,19 @@ impl Metadata {
         let hardware_hook = path.join(HARDWARE_HOOK);
         let device_identity_dir = path.join(DEVICE_IDENTITY_DIR);
         let device_attributes_dir = path.join(DEVICE_ATTRIBUTES_DIR);
-        let pub_key_path = path.join(PUB_KEY);
 
         let metadata = Metadata(api::Metadata {
             product_uid: run_hook(&product_uid_hook)?,
             version: run_hook(&version_hook)?,
-            hardware: run_hook(&hardware_hook)?,
-            pub_key: if pub_key_path.exists() { Some(pub_key_path) } else { None },
-            device_identity: run_hooks_from_dir(&device_identity_dir)?,
+            hardware: match hardware_hook.exists() {
+                true => run_hook(&hardware_hook)?,
+                false => builtin::hardware(Path::new("/")).unwrap_or_default(),
+            },
+            pub_key: pub_key(path),
+            device_identity: identity_from_dir(&device_identity_dir)?,
             device_attributes: run_hooks_from_dir(&device_attributes_dir).unwrap_or_default(),
+            previous_device_identity: None,
+            channel: None,
         });
 
         if metadata.product_uid.is_empty() {
@@ -97,6 +125,38 @@ impl Metadata {
         Ok(metadata)
     }
 
+    /// Metadata of the simulated device, as it is set in the `settings`.
+    /// The public key is still taken from the metadata `path`, so the
+    /// signed packages can be tested too.
+    pub(crate) fn simulated(settings: &Simulation, path: &Path) -> Result<Self> {
+        let metadata = Metadata(api::Metadata {
+            product_uid: settings.product_uid.clone(),
+            version: settings.version.clone(),
+            hardware: settings.hardware.clone(),
+            pub_key: pub_key(path),
+            device_identity: api::MetadataValue(
+                settings
+                    .device_identity
+                    .iter()
+                    .map(|(key, value)| (key.clone(), vec![value.clone()]))
+                    .collect(),
+            ),
+            device_attributes: api::MetadataValue::default(),
+            previous_device_identity: None,
+            channel: None,
+        });
+
+        if metadata.product_uid.len() != 64 {
+            return Err(Error::InvalidProductUid);
+        }
+
+        if metadata.device_identity.is_empty() {
+            return Err(Error::MissingDeviceIdentity);
+        }
+
+        Ok(metadata)
+    }
+
     pub(crate) fn as_cloud_metadata(&self) -> cloud::api::FirmwareMetadata<'_> {
         cloud::api::FirmwareMetadata {
             product_uid: &self.0.product_uid,
@@ -104,8 +164,58 @@ impl Metadata {
             hardware: &self.0.hardware,
             device_identity: cloud::api::MetadataValue(&self.0.device_identity.0),
             device_attributes: cloud::api::MetadataValue(&self.0.device_attributes.0),
+            previous_device_identity: self
+                .0
+                .previous_device_identity
+                .as_ref()
+                .map(|identity| cloud::api::MetadataValue(&identity.0)),
+            channel: self.0.channel.as_deref(),
+        }
+    }
+}
+
+/// Collects the device attributes from the hooks, the settings and the
+/// environment, as they may change while the agent runs.
+pub(crate) fn device_attributes(path: &Path, settings: &DeviceAttributes) -> api::MetadataValue {
+    let hooks = run_hooks_from_dir(&path.join(DEVICE_ATTRIBUTES_DIR)).unwrap_or_default();
+    merge_attributes(hooks, settings, std::env::vars())
+}
+
+fn merge_attributes(
+    mut attributes: api::MetadataValue,
+    settings: &DeviceAttributes,
+    vars: impl Iterator<Item = (String, String)>,
+) -> api::MetadataValue {
+    for (key, value) in settings.values.iter() {
+        attributes.entry(key.clone()).or_default().push(value.clone());
+    }
+    if let Some(prefix) = settings.env_prefix.as_deref().filter(|prefix| !prefix.is_empty()) {
+        for (key, value) in
+            vars.filter(|(key, _)| key.len() > prefix.len() && key.starts_with(prefix))
+        {
+            attributes.entry(key[prefix.len()..].to_lowercase()).or_default().push(value);
         }
     }
+    attributes
+}
+
+/// Runs the device identity hooks, as the identity may change while
+/// the agent runs.
+pub(crate) fn device_identity(path: &Path) -> Result<api::MetadataValue> {
+    let identity = identity_from_dir(&path.join(DEVICE_IDENTITY_DIR))?;
+    if identity.is_empty() {
+        return Err(Error::MissingDeviceIdentity);
+    }
+    Ok(identity)
+}
+
+// The devices without identity hooks are identified by the device tree
+// or the SMBIOS tables.
+fn identity_from_dir(dir: &Path) -> Result<api::MetadataValue> {
+    if !dir.exists() {
+        return Ok(builtin::identity(Path::new("/")));
+    }
+    run_hooks_from_dir(dir)
 }
 
 pub(crate) fn state_change_callback(path: &Path, state: &str) -> Result<Transition> {
@@ -157,6 +267,45 @@ pub(crate) fn error_callback(path: &Path) -> Result<()> {
     run_callback("error callback", &path.join(ERROR_CALLBACK))
 }
 
+/// Public key the update packages are validated with, if the device has
+/// one.
+pub(crate) fn pub_key(path: &Path) -> Option<PathBuf> {
+    let key = path.join(PUB_KEY);
+    if key.exists() {
+        Some(key)
+    } else {
+        None
+    }
+}
+
+/// Private key the encrypted update packages are decrypted with, if the
+/// device has one.
+pub(crate) fn decryption_key(path: &Path) -> Option<PathBuf> {
+    let key = path.join(DECRYPTION_KEY);
+    if key.exists() {
+        Some(key)
+    } else {
+        None
+    }
+}
+
+/// Runs the bootability probe of the device for the installation `set`,
+/// if the device has one, which fails when the set can't be booted.
+pub(crate) fn bootability_probe(path: &Path, set: installation_set::Set) -> Option<Result<()>> {
+    let probe = path.join(BOOTABILITY_PROBE);
+    if !probe.exists() {
+        return None;
+    }
+
+    Some(match easy_process::run(&format!("{} {}", probe.to_string_lossy(), set)) {
+        Ok(_) => Ok(()),
+        Err(e) => {
+            error!("bootability probe has failed for installation set {}: {}", set, e);
+            Err(e.into())
+        }
+    })
+}
+
 fn run_callback(name: &str, path: &Path) -> Result<()> {
     let callback = path.join(path);
     if !callback.exists() {
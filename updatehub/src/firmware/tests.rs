@@ -200,6 +200,25 @@ fn check_load_metadata() {
     }
 }
 
+#[test]
+fn merge_device_attributes() {
+    let (metadata_dir, _guard) = create_fake_metadata();
+    let mut settings = DeviceAttributes::default();
+    settings.values.insert("attr1".to_owned(), "config".to_owned());
+    settings.values.insert("customer".to_owned(), "acme".to_owned());
+    assert_eq!(device_attributes(&metadata_dir, &settings)["attr1"], ["attrvalue1", "config"]);
+
+    settings.env_prefix = Some("UPDATEHUB_ATTRIBUTE_".to_owned());
+    let vars = vec![
+        ("UPDATEHUB_ATTRIBUTE_REGION".to_owned(), "eu".to_owned()),
+        ("UPDATEHUB_ATTRIBUTE_".to_owned(), "ignored".to_owned()),
+        ("PATH".to_owned(), "/bin".to_owned()),
+    ];
+    let attributes = merge_attributes(api::MetadataValue::default(), &settings, vars.into_iter());
+    assert_eq!(attributes.0.keys().collect::<Vec<_>>(), ["attr1", "customer", "region"]);
+    assert_eq!(attributes["region"], ["eu"]);
+}
+
 #[cfg(test)]
 const CALLBACK_STATE_NAME: &str = "test_state";
 
@@ -0,0 +1,213 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::{mirror::ObjectStream, object::Info as _, utils};
+use actix_web::{http::StatusCode, web, HttpRequest, HttpResponse};
+use async_std::sync::Mutex;
+use slog_scope::{debug, info, warn};
+use std::{
+    collections::HashSet,
+    fs,
+    path::{Path, PathBuf},
+    sync::Arc,
+};
+
+/// Time the devices are asked to wait for an object which is still
+/// being cached.
+const RETRY_AFTER_SECS: u64 = 10;
+
+// Headers which only apply to a single connection, so they aren't
+// forwarded.
+const HOP_HEADERS: &[&str] = &["connection", "content-length", "host", "transfer-encoding"];
+
+/// Serves the server API to the devices of the LAN which have no access
+/// to the server. The probes and reports are forwarded to the server,
+/// while the objects are downloaded once and served from the cache to
+/// every device. It is shared by all workers of the HTTP server.
+#[derive(Clone)]
+pub(crate) struct Gateway {
+    server: String,
+    cache_dir: PathBuf,
+    cached: Arc<std::sync::Mutex<HashSet<String>>>,
+    // Held while an object is downloaded, so no object is written twice
+    // at once.
+    downloading: Arc<Mutex<()>>,
+}
+
+impl Gateway {
+    pub(crate) fn new(server: String, cache_dir: PathBuf) -> Self {
+        Gateway { server, cache_dir, cached: Arc::default(), downloading: Arc::new(Mutex::new(())) }
+    }
+
+    pub(crate) fn configure(cfg: &mut web::ServiceConfig, gateway: Gateway) {
+        cfg.data(gateway)
+            .route("/upgrades", web::post().to(Gateway::forward))
+            .route("/report", web::post().to(Gateway::forward))
+            .route("/report/batch", web::post().to(Gateway::forward))
+            .route(
+                "/products/{product_uid}/packages/{package_uid}/objects/{object}",
+                web::get().to(Gateway::object),
+            );
+    }
+
+    async fn forward(
+        gateway: web::Data<Gateway>,
+        req: HttpRequest,
+        body: web::Bytes,
+    ) -> HttpResponse {
+        let headers = req
+            .headers()
+            .iter()
+            .filter(|(name, _)| !HOP_HEADERS.contains(&name.as_str()))
+            .filter_map(|(name, value)| Some((name.to_string(), value.to_str().ok()?.to_owned())))
+            .collect::<Vec<_>>();
+        let response = match crate::CloudClient::new(&gateway.server)
+            .forward(req.path(), &headers, body.to_vec())
+            .await
+        {
+            Ok(response) => response,
+            Err(e) => {
+                warn!("failed to forward {} to the server: {}", req.path(), e);
+                return HttpResponse::BadGateway().finish();
+            }
+        };
+
+        // The objects of the update are cached right away, as the device
+        // is about to download them.
+        if req.path() == "/upgrades" && response.status == 200 {
+            Gateway::prefetch(gateway.clone(), &response.body);
+        }
+
+        let mut builder = HttpResponse::build(
+            StatusCode::from_u16(response.status).unwrap_or(StatusCode::BAD_GATEWAY),
+        );
+        for (name, value) in response.headers.iter() {
+            if !HOP_HEADERS.contains(&name.as_str()) {
+                builder.header(name.as_str(), value.as_str());
+            }
+        }
+        builder.body(response.body)
+    }
+
+    async fn object(
+        gateway: web::Data<Gateway>,
+        path: web::Path<(String, String, String)>,
+    ) -> HttpResponse {
+        let (product_uid, package_uid, object) = path.into_inner();
+
+        // Only sha256sums are served, so no path can escape the cache
+        // directory.
+        if object.len() != 64 || !object.chars().all(|c| c.is_ascii_hexdigit()) {
+            return HttpResponse::BadRequest().finish();
+        }
+
+        // The device retries the download later, instead of waiting for
+        // the whole object to be cached.
+        if !gateway.is_cached(&object) {
+            let gateway = gateway.clone();
+            actix_rt::spawn(async move {
+                if let Err(e) = gateway.cache(&product_uid, &package_uid, &object).await {
+                    warn!("failed to cache object {}: {}", object, e);
+                }
+            });
+            return HttpResponse::ServiceUnavailable()
+                .header("Retry-After", RETRY_AFTER_SECS.to_string())
+                .finish();
+        }
+
+        match fs::File::open(gateway.cache_dir.join(&object)) {
+            Ok(file) => {
+                debug!("serving object {} to device", object);
+                HttpResponse::Ok().streaming(ObjectStream::new(file))
+            }
+            Err(_) => HttpResponse::NotFound().finish(),
+        }
+    }
+
+    fn prefetch(gateway: web::Data<Gateway>, metadata: &[u8]) {
+        let package = match cloud::api::UpdatePackage::parse(metadata) {
+            Ok(package) => package,
+            Err(e) => {
+                debug!("not caching the objects of the update: {}", e);
+                return;
+            }
+        };
+        let package_uid = package.package_uid();
+        let product_uid = package.inner.product_uid.clone();
+        let mut objects = package
+            .inner
+            .objects
+            .0
+            .iter()
+            .chain(package.inner.objects.1.iter())
+            .map(|object| object.sha256sum().to_owned())
+            .collect::<Vec<_>>();
+        objects.sort();
+        objects.dedup();
+
+        actix_rt::spawn(async move {
+            for object in objects {
+                if let Err(e) = gateway.cache(&product_uid, &package_uid, &object).await {
+                    warn!("failed to cache object {}: {}", object, e);
+                }
+            }
+        });
+    }
+
+    fn is_cached(&self, object: &str) -> bool {
+        self.cached.lock().unwrap().contains(object)
+    }
+
+    /// Downloads the `object` to the cache, unless it is already there.
+    /// It is only kept if its content matches the sha256sum.
+    async fn cache(&self, product_uid: &str, package_uid: &str, object: &str) -> crate::Result<()> {
+        let _downloading = self.downloading.lock().await;
+        if self.is_cached(object) {
+            return Ok(());
+        }
+
+        let file = self.cache_dir.join(object);
+        if !is_valid(&file, object) {
+            info!("caching object {} from the server", object);
+            crate::CloudClient::new(&self.server)
+                .download_object(product_uid, package_uid, &self.cache_dir, object)
+                .await?;
+            if !is_valid(&file, object) {
+                let _ = fs::remove_file(&file);
+                return Err(cloud::Error::ChecksumMismatch(object.to_owned()).into());
+            }
+        }
+
+        self.cached.lock().unwrap().insert(object.to_owned());
+        Ok(())
+    }
+}
+
+fn is_valid(file: &Path, object: &str) -> bool {
+    utils::sha256sum_file(file).map(|s| s == object).unwrap_or(false)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::cloud_mock::set_download_data;
+
+    #[actix_rt::test]
+    async fn cache_objects() {
+        let dir = tempfile::tempdir().unwrap();
+        let gateway = Gateway::new("http://server".to_owned(), dir.path().to_owned());
+
+        let object = utils::sha256sum(b"object");
+        set_download_data(b"object".to_vec());
+        gateway.cache("product", "package", &object).await.unwrap();
+        assert!(gateway.is_cached(&object));
+        assert_eq!(fs::read(dir.path().join(&object)).unwrap(), b"object");
+
+        let corrupted = utils::sha256sum(b"expected");
+        set_download_data(b"corrupted".to_vec());
+        assert!(gateway.cache("product", "package", &corrupted).await.is_err());
+        assert!(!gateway.is_cached(&corrupted));
+        assert!(!dir.path().join(&corrupted).exists());
+    }
+}
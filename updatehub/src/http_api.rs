@@ -2,10 +2,32 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::states::machine;
-use actix_web::{http::StatusCode, web, HttpRequest, HttpResponse, Responder};
-use sdk::api;
-use slog_scope::debug;
+use crate::{
+    job_queue::{CancelJobResponse, JobQueue},
+    states::machine,
+};
+use actix_web::{
+    dev::{Service, ServiceRequest},
+    http::{
+        header::{self, HeaderMap, HeaderValue},
+        Method, StatusCode,
+    },
+    web, FromRequest, HttpRequest, HttpResponse, Responder,
+};
+use async_std::stream::StreamExt;
+use sdk::api::{self, info::settings::LocalApi};
+use serde::Serialize;
+use slog_scope::{debug, info, warn};
+use std::{
+    collections::HashMap,
+    fs,
+    future::Future,
+    io::Write,
+    path::{Path, PathBuf},
+    pin::Pin,
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
 use thiserror::Error;
 
 pub(crate) struct API(machine::Addr);
@@ -16,24 +38,133 @@ type Result<T> = std::result::Result<T, Error>;
 enum Error {
     #[error("State has failed to handle the request: {0}")]
     State(#[from] crate::states::TransitionError),
+
+    #[error("Io error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Failed to receive the request payload: {0}")]
+    Payload(#[from] actix_web::error::PayloadError),
 }
 
 impl API {
-    pub(crate) fn configure(cfg: &mut web::ServiceConfig, addr: machine::Addr) {
-        cfg.data(Self(addr))
-            .route("/info", web::get().to(API::info))
-            .route("/log", web::get().to(API::log))
-            .route("/probe", web::post().to(API::probe))
-            .route("/local_install", web::post().to(API::local_install))
-            .route("/remote_install", web::post().to(API::remote_install))
-            .route("/update/download/abort", web::post().to(API::download_abort));
+    pub(crate) fn configure(
+        cfg: &mut web::ServiceConfig,
+        addr: machine::Addr,
+        jobs: JobQueue,
+        settings: &LocalApi,
+    ) {
+        let local_api = settings.clone();
+        let rate_limiter = RateLimiter::new(settings.rate_limit);
+        let scope = web::scope(&base_path(&settings.base_path)).wrap_fn(move |req, srv| {
+            let origin =
+                allowed_origin(&local_api.cors_allowed_origins, req.headers().get(header::ORIGIN));
+            let client = client_address(&req, local_api.trust_forwarded_headers);
+            debug!("receiving {} {} from {}", req.method(), req.path(), client);
+
+            // Only the control requests are audited, as the other ones
+            // don't change the agent.
+            let audit = match (&local_api.audit_log, req.method() == Method::POST) {
+                (Some(file), true) => Some(AuditEntry {
+                    file: file.clone(),
+                    time: chrono::Utc::now().to_rfc3339(),
+                    method: req.method().to_string(),
+                    path: req.path().to_owned(),
+                    client: client.clone(),
+                }),
+                _ => None,
+            };
+
+            // The preflight requests are answered right away, as there are
+            // no routes for them.
+            let response = if is_preflight(&req) {
+                Err(req.into_response(HttpResponse::NoContent().finish()))
+            } else if !rate_limiter.allow(&client) {
+                warn!("refusing request from {} as it is over the rate limit", client);
+                Err(req.into_response(
+                    HttpResponse::TooManyRequests()
+                        .header(header::RETRY_AFTER, RATE_LIMIT_WINDOW.as_secs().to_string())
+                        .finish(),
+                ))
+            } else if req.method() == Method::POST
+                && !authorized(local_api.auth_token.as_deref(), req.headers())
+            {
+                warn!("refusing unauthenticated {} request from {}", req.path(), client);
+                Err(req.into_response(
+                    HttpResponse::Unauthorized()
+                        .header(header::WWW_AUTHENTICATE, "Bearer")
+                        .finish(),
+                ))
+            } else {
+                Ok(srv.call(req))
+            };
+            async move {
+                let mut res = match response {
+                    Ok(res) => res.await?,
+                    Err(res) => res,
+                };
+                if let Some(origin) = origin {
+                    set_cors_headers(res.headers_mut(), origin);
+                }
+                if let Some(audit) = audit {
+                    audit.record(res.status());
+                }
+                Ok::<_, actix_web::Error>(res)
+            }
+        });
+
+        cfg.data(Self(addr)).data(jobs).data(ApiToken(settings.auth_token.clone())).service(
+            scope
+                .route("/info", web::get().to(API::info))
+                .route("/firmware", web::get().to(API::firmware))
+                .route("/twin", web::get().to(API::twin))
+                .route("/enrollment", web::get().to(API::enrollment))
+                .route("/log", web::get().to(API::log))
+                .route("/audit", web::get().to(API::audit))
+                .route("/progress", web::get().to(API::progress))
+                .route("/events", web::get().to(API::events))
+                .route("/probe", web::post().to(API::probe))
+                .route("/local_install", web::post().to(API::local_install))
+                .route("/remote_install", web::post().to(API::remote_install))
+                .route("/upload", web::post().to(API::upload))
+                .route("/update/download/abort", web::post().to(API::download_abort))
+                .route("/update/download/pause", web::post().to(API::download_pause))
+                .route("/update/download/resume", web::post().to(API::download_resume))
+                .route("/update/cancel", web::post().to(API::update_cancel))
+                .route("/update/confirm", web::post().to(API::update_confirm))
+                .route("/identity/confirm", web::post().to(API::identity_confirm))
+                .route("/update/approve", web::post().to(API::update_approve))
+                .route("/update/deny", web::post().to(API::update_deny))
+                .route("/update/go-ahead", web::post().to(API::update_go_ahead))
+                .route("/update/dry-run", web::post().to(API::update_dry_run))
+                .route("/update/rollback", web::post().to(API::update_rollback))
+                .route("/config", web::post().to(API::config))
+                .route("/config/reload", web::post().to(API::config_reload))
+                .route("/jobs", web::post().to(API::submit_job))
+                .route("/jobs/{id}", web::get().to(API::job))
+                .route("/jobs/{id}/cancel", web::post().to(API::cancel_job)),
+        );
     }
 
-    async fn info(agent: web::Data<API>) -> HttpResponse {
+    async fn info(agent: web::Data<API>, _: Authorized) -> HttpResponse {
         debug!("receiving info request");
         HttpResponse::Ok().json(agent.0.request_info().await)
     }
 
+    async fn firmware(agent: web::Data<API>) -> Result<HttpResponse> {
+        debug!("receiving firmware request");
+        Ok(HttpResponse::Ok().json(agent.0.request_firmware().await?))
+    }
+
+    async fn twin(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving twin request");
+        HttpResponse::Ok().json(agent.0.request_twin().await)
+    }
+
+    async fn enrollment(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving enrollment request");
+        HttpResponse::Ok().json(agent.0.request_enrollment().await)
+    }
+
     async fn probe(
         agent: web::Data<API>,
         server_address: Option<web::Json<api::probe::Request>>,
@@ -59,15 +190,283 @@ impl API {
         agent.0.request_remote_install(req.into_inner().url).await
     }
 
-    async fn log() -> HttpResponse {
+    // The package is streamed into a file, as it may not fit in memory,
+    // and then installed as a local package.
+    async fn upload(
+        agent: web::Data<API>,
+        mut payload: web::Payload,
+    ) -> Result<machine::StateResponse> {
+        debug!("receiving upload request");
+        let dir = crate::states::upload_dir();
+        fs::create_dir_all(&dir)?;
+
+        let (mut file, path) = tempfile::Builder::new()
+            .suffix(".uhupkg")
+            .tempfile_in(&dir)?
+            .keep()
+            .map_err(|e| e.error)?;
+        while let Some(chunk) = payload.next().await {
+            file.write_all(&chunk?)?;
+        }
+
+        info!("update package uploaded to {}", path.display());
+        Ok(agent.0.request_local_install(path).await)
+    }
+
+    async fn log(req: web::Query<api::log::Request>, _: Authorized) -> HttpResponse {
         debug!("receiving log request");
-        HttpResponse::Ok().json(crate::logger::buffer())
+        let level = req.level.map_or(slog::Level::Trace, crate::logger::slog_level);
+        HttpResponse::Ok().json(crate::logger::history(level))
+    }
+
+    async fn audit(req: web::Query<api::audit::Request>) -> Result<HttpResponse> {
+        debug!("receiving audit request");
+        Ok(HttpResponse::Ok().json(crate::utils::audit_trail::entries(&req)?))
+    }
+
+    async fn progress(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving progress request");
+        HttpResponse::Ok().json(agent.0.progress())
+    }
+
+    // The events are streamed as Server-Sent Events until the client
+    // disconnects.
+    async fn events(agent: web::Data<API>, _: Authorized) -> HttpResponse {
+        debug!("receiving events request");
+        let events = agent.0.events().map(|event| {
+            serde_json::to_string(&event)
+                .map(|data| web::Bytes::from(format!("data: {}\n\n", data)))
+        });
+
+        HttpResponse::Ok()
+            .content_type("text/event-stream")
+            .header(header::CACHE_CONTROL, "no-cache")
+            .streaming(events)
     }
 
     async fn download_abort(agent: web::Data<API>) -> machine::AbortDownloadResponse {
         debug!("receiving abort download request");
         agent.0.request_abort_download().await
     }
+
+    async fn download_pause(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving pause download request");
+        match agent.0.request_pause_download().await {
+            machine::DownloadControlResponse::RequestAccepted => {
+                HttpResponse::Ok().json(api::pause_download::Response {
+                    message: "request accepted, download paused".to_owned(),
+                })
+            }
+            machine::DownloadControlResponse::InvalidState => {
+                HttpResponse::BadRequest().json(api::pause_download::Refused {
+                    error: "there is no download to be paused".to_owned(),
+                })
+            }
+        }
+    }
+
+    async fn download_resume(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving resume download request");
+        match agent.0.request_resume_download().await {
+            machine::DownloadControlResponse::RequestAccepted => {
+                HttpResponse::Ok().json(api::resume_download::Response {
+                    message: "request accepted, download resumed".to_owned(),
+                })
+            }
+            machine::DownloadControlResponse::InvalidState => {
+                HttpResponse::BadRequest().json(api::resume_download::Refused {
+                    error: "there is no paused download to be resumed".to_owned(),
+                })
+            }
+        }
+    }
+
+    async fn update_cancel(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving cancel update request");
+        match agent.0.request_cancel_update().await {
+            machine::CancelUpdateResponse::RequestAccepted => {
+                HttpResponse::Ok().json(api::cancel_update::Response {
+                    message: "request accepted, update canceled".to_owned(),
+                })
+            }
+            machine::CancelUpdateResponse::InvalidState => {
+                HttpResponse::BadRequest().json(api::cancel_update::Refused {
+                    error: "there is no update to be canceled".to_owned(),
+                })
+            }
+        }
+    }
+
+    async fn update_confirm(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving confirm update request");
+        match agent.0.request_confirm_update().await {
+            machine::ConfirmUpdateResponse::RequestAccepted => {
+                HttpResponse::Ok().json(api::confirm_update::Response {
+                    message: "request accepted, update confirmed".to_owned(),
+                })
+            }
+            machine::ConfirmUpdateResponse::InvalidState => {
+                HttpResponse::BadRequest().json(api::confirm_update::Refused {
+                    error: "there is no update to be confirmed".to_owned(),
+                })
+            }
+        }
+    }
+
+    async fn identity_confirm(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving confirm identity request");
+        match agent.0.request_confirm_identity().await {
+            machine::ConfirmIdentityResponse::RequestAccepted => {
+                HttpResponse::Ok().json(api::confirm_identity::Response {
+                    message: "request accepted, identity change confirmed".to_owned(),
+                })
+            }
+            machine::ConfirmIdentityResponse::InvalidState => {
+                HttpResponse::BadRequest().json(api::confirm_identity::Refused {
+                    error: "there is no identity change to be confirmed".to_owned(),
+                })
+            }
+        }
+    }
+
+    async fn update_approve(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving approve update request");
+        match agent.0.request_approve_update(true).await {
+            machine::ApproveUpdateResponse::RequestAccepted => {
+                HttpResponse::Ok().json(api::approve_update::Response {
+                    message: "request accepted, update approved".to_owned(),
+                })
+            }
+            machine::ApproveUpdateResponse::InvalidState => {
+                HttpResponse::BadRequest().json(api::approve_update::Refused {
+                    error: "there is no update awaiting approval".to_owned(),
+                })
+            }
+        }
+    }
+
+    async fn update_deny(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving deny update request");
+        match agent.0.request_approve_update(false).await {
+            machine::ApproveUpdateResponse::RequestAccepted => {
+                HttpResponse::Ok().json(api::deny_update::Response {
+                    message: "request accepted, update denied".to_owned(),
+                })
+            }
+            machine::ApproveUpdateResponse::InvalidState => {
+                HttpResponse::BadRequest().json(api::deny_update::Refused {
+                    error: "there is no update awaiting approval".to_owned(),
+                })
+            }
+        }
+    }
+
+    async fn update_go_ahead(
+        agent: web::Data<API>,
+        req: web::Json<api::go_ahead::Request>,
+    ) -> HttpResponse {
+        debug!("receiving go-ahead request with {:?}", req);
+        let error = match agent.0.request_go_ahead(req.into_inner()).await {
+            machine::GoAheadResponse::RequestAccepted => {
+                return HttpResponse::Ok().json(api::go_ahead::Response {
+                    message: "request accepted, installing the update".to_owned(),
+                })
+            }
+            machine::GoAheadResponse::UnknownToken => {
+                "token is not of the update ready to be installed"
+            }
+            machine::GoAheadResponse::Expired => "go-ahead has expired",
+            machine::GoAheadResponse::InvalidState => "there is no update waiting for the go-ahead",
+        };
+        HttpResponse::BadRequest().json(api::go_ahead::Refused { error: error.to_owned() })
+    }
+
+    async fn update_dry_run(
+        agent: web::Data<API>,
+        req: web::Json<api::dry_run::Request>,
+    ) -> HttpResponse {
+        debug!("receiving dry run request with {:?}", req);
+        match agent.0.request_dry_run(req.into_inner()).await {
+            Ok(response) => HttpResponse::Ok().json(response),
+            Err(e) => HttpResponse::BadRequest().json(api::dry_run::Refused {
+                error: format!("unable to check the package: {}", e),
+            }),
+        }
+    }
+
+    async fn update_rollback(
+        agent: web::Data<API>,
+        req: web::Json<api::rollback::Request>,
+    ) -> HttpResponse {
+        debug!("receiving rollback request with {:?}", req);
+        match agent.0.request_rollback(req.execute).await {
+            Ok(response) => HttpResponse::Ok().json(response),
+            Err(e) => HttpResponse::BadRequest()
+                .json(api::rollback::Refused { error: format!("unable to roll back: {}", e) }),
+        }
+    }
+
+    async fn config(agent: web::Data<API>, req: web::Json<api::config::Request>) -> HttpResponse {
+        debug!("receiving config request with {:?}", req);
+        let api::config::Request { key, value } = req.into_inner();
+        match agent.0.request_set_config(key.clone(), value).await {
+            Ok(machine::SetConfigResponse::Applied) => {
+                HttpResponse::Ok().json(api::config::Response {
+                    message: format!("{} setting changed", key),
+                    restart_required: false,
+                })
+            }
+            Ok(machine::SetConfigResponse::RestartRequired) => {
+                HttpResponse::Ok().json(api::config::Response {
+                    message: format!("{} setting changed, restart the agent to apply it", key),
+                    restart_required: true,
+                })
+            }
+            Err(e) => HttpResponse::BadRequest()
+                .json(api::config::Refused { error: format!("unable to change {}: {}", key, e) }),
+        }
+    }
+
+    async fn config_reload(agent: web::Data<API>) -> HttpResponse {
+        debug!("receiving config reload request");
+        match agent.0.request_reload_config().await {
+            Ok(response) => HttpResponse::Ok().json(response),
+            Err(e) => HttpResponse::BadRequest().json(api::config::Refused {
+                error: format!("unable to reload the configuration: {}", e),
+            }),
+        }
+    }
+
+    async fn submit_job(
+        jobs: web::Data<JobQueue>,
+        req: web::Json<api::jobs::Request>,
+    ) -> HttpResponse {
+        debug!("receiving job request with {:?}", req);
+        HttpResponse::Accepted().json(jobs.submit(req.into_inner()).await)
+    }
+
+    async fn job(jobs: web::Data<JobQueue>, id: web::Path<u64>) -> HttpResponse {
+        debug!("receiving job {} request", id);
+        match jobs.get(*id) {
+            Some(job) => HttpResponse::Ok().json(job),
+            None => HttpResponse::NotFound()
+                .json(api::jobs::Refused { error: format!("there is no job {}", id) }),
+        }
+    }
+
+    async fn cancel_job(jobs: web::Data<JobQueue>, id: web::Path<u64>) -> HttpResponse {
+        debug!("receiving cancel job {} request", id);
+        match jobs.cancel(*id) {
+            CancelJobResponse::Canceled(job) => HttpResponse::Ok().json(job),
+            CancelJobResponse::NotFound => HttpResponse::NotFound()
+                .json(api::jobs::Refused { error: format!("there is no job {}", id) }),
+            CancelJobResponse::InvalidStatus(status) => {
+                HttpResponse::BadRequest().json(api::jobs::Refused {
+                    error: format!("job {} can't be canceled as it is {:?}", id, status),
+                })
+            }
+        }
+    }
 }
 
 impl Responder for machine::AbortDownloadResponse {
@@ -90,6 +489,175 @@ impl Responder for machine::AbortDownloadResponse {
     }
 }
 
+const RATE_LIMIT_WINDOW: Duration = Duration::from_secs(60);
+
+/// Limits the requests each client may do within a window.
+#[derive(Clone)]
+struct RateLimiter {
+    limit: Option<u32>,
+    clients: Arc<Mutex<HashMap<String, (Instant, u32)>>>,
+}
+
+impl RateLimiter {
+    fn new(limit: Option<u32>) -> Self {
+        RateLimiter { limit, clients: Arc::default() }
+    }
+
+    fn allow(&self, client: &str) -> bool {
+        let limit = match self.limit {
+            Some(limit) => limit,
+            None => return true,
+        };
+
+        let now = Instant::now();
+        let mut clients = self.clients.lock().unwrap();
+        // The clients whose window has passed are dropped, so the map
+        // doesn't grow with every client ever seen.
+        clients.retain(|_, (start, _)| now.duration_since(*start) < RATE_LIMIT_WINDOW);
+
+        let (_, count) = clients.entry(client.to_owned()).or_insert((now, 0));
+        if *count >= limit {
+            return false;
+        }
+        *count += 1;
+        true
+    }
+}
+
+/// Control request recorded to the audit log, as a json line.
+#[derive(Serialize)]
+struct AuditEntry {
+    #[serde(skip)]
+    file: PathBuf,
+    time: String,
+    client: String,
+    method: String,
+    path: String,
+}
+
+impl AuditEntry {
+    fn record(self, status: StatusCode) {
+        info!("{} {} requested by {}: {}", self.method, self.path, self.client, status);
+        if let Err(e) = self.append(status) {
+            warn!("failed to record the request to the audit log: {}", e);
+        }
+    }
+
+    fn append(&self, status: StatusCode) -> std::io::Result<()> {
+        #[derive(Serialize)]
+        struct Line<'a> {
+            #[serde(flatten)]
+            entry: &'a AuditEntry,
+            status: u16,
+        }
+
+        let mut line = serde_json::to_vec(&Line { entry: self, status: status.as_u16() })?;
+        line.push(b'\n');
+        audit_file(&self.file)?.write_all(&line)
+    }
+}
+
+fn audit_file(path: &Path) -> std::io::Result<fs::File> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    fs::OpenOptions::new().create(true).append(true).open(path)
+}
+
+// The base path is normalized, so it is accepted with or without the
+// leading and trailing slashes.
+fn base_path(path: &str) -> String {
+    match path.trim_matches('/') {
+        "" => String::default(),
+        path => format!("/{}", path),
+    }
+}
+
+fn allowed_origin(allowed: &[String], origin: Option<&HeaderValue>) -> Option<HeaderValue> {
+    let origin = origin?;
+    let value = origin.to_str().ok()?;
+    if allowed.iter().any(|allowed| allowed == "*" || allowed == value) {
+        return Some(origin.clone());
+    }
+    None
+}
+
+fn is_preflight(req: &ServiceRequest) -> bool {
+    req.method() == Method::OPTIONS
+        && req.headers().contains_key(header::ACCESS_CONTROL_REQUEST_METHOD)
+}
+
+// Token the requests must carry, as set in the local API settings.
+struct ApiToken(Option<String>);
+
+// Besides the control requests, the token guards the requests exposing
+// the agent configuration, its log and its events. Their handlers take
+// it as a parameter, so the check follows the resource the request has
+// been routed to.
+struct Authorized;
+
+impl FromRequest for Authorized {
+    type Config = ();
+    type Error = actix_web::Error;
+    type Future = Pin<Box<dyn Future<Output = std::result::Result<Self, Self::Error>>>>;
+
+    fn from_request(req: &HttpRequest, _: &mut actix_web::dev::Payload) -> Self::Future {
+        let req = req.clone();
+        Box::pin(async move {
+            let token = web::Data::<ApiToken>::extract(&req).await?;
+            if authorized(token.0.as_deref(), req.headers()) {
+                return Ok(Authorized);
+            }
+
+            warn!("refusing unauthenticated {} request", req.path());
+            Err(actix_web::error::InternalError::from_response(
+                "missing or invalid API token",
+                HttpResponse::Unauthorized().header(header::WWW_AUTHENTICATE, "Bearer").finish(),
+            )
+            .into())
+        })
+    }
+}
+
+// The requests are authorized when no token is set, or when
+// they carry it as a bearer token.
+fn authorized(token: Option<&str>, headers: &HeaderMap) -> bool {
+    let token = match token {
+        Some(token) => token.as_bytes(),
+        None => return true,
+    };
+
+    headers
+        .get(header::AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .filter(|value| value.starts_with("Bearer "))
+        .map(|value| value["Bearer ".len()..].as_bytes())
+        // The comparison takes the same time whatever the token, so it
+        // can't be guessed a byte at a time.
+        .map_or(false, |given| given.len() == token.len() && openssl::memcmp::eq(given, token))
+}
+
+fn set_cors_headers(headers: &mut HeaderMap, origin: HeaderValue) {
+    headers.insert(header::ACCESS_CONTROL_ALLOW_ORIGIN, origin);
+    headers.insert(header::ACCESS_CONTROL_ALLOW_METHODS, HeaderValue::from_static("GET, POST"));
+    headers.insert(
+        header::ACCESS_CONTROL_ALLOW_HEADERS,
+        HeaderValue::from_static("authorization, content-type"),
+    );
+    headers.insert(header::VARY, HeaderValue::from_static("origin"));
+}
+
+// The address of the client behind the reverse proxy is only used when
+// the proxy is trusted, as the headers can be set by anyone otherwise.
+fn client_address(req: &ServiceRequest, trust_forwarded_headers: bool) -> String {
+    if trust_forwarded_headers {
+        if let Some(address) = req.connection_info().realip_remote_addr() {
+            return address.to_owned();
+        }
+    }
+    req.peer_addr().map(|addr| addr.to_string()).unwrap_or_else(|| "unknown".to_owned())
+}
+
 impl Responder for machine::ProbeResponse {
     type Error = actix_web::Error;
     type Future = HttpResponse;
@@ -102,9 +670,8 @@ impl Responder for machine::ProbeResponse {
                 .json(api::probe::Response { update_available: false, try_again_in: None }),
             machine::ProbeResponse::Delayed(d) => HttpResponse::Ok()
                 .json(api::probe::Response { update_available: false, try_again_in: Some(d) }),
-            machine::ProbeResponse::Busy(current_state) => {
-                HttpResponse::Ok().json(api::state::Response { busy: true, current_state })
-            }
+            machine::ProbeResponse::Busy(current_state) => HttpResponse::Ok()
+                .json(api::state::Response { busy: true, current_state, queue_position: None }),
         }
     }
 }
@@ -115,12 +682,21 @@ impl Responder for machine::StateResponse {
 
     fn respond_to(self, _: &HttpRequest) -> Self::Future {
         match self {
-            machine::StateResponse::RequestAccepted(current_state) => {
-                HttpResponse::Ok().json(api::state::Response { busy: false, current_state })
+            machine::StateResponse::RequestAccepted(current_state) => HttpResponse::Ok()
+                .json(api::state::Response { busy: false, current_state, queue_position: None }),
+            machine::StateResponse::Queued(current_state, position) => {
+                HttpResponse::Ok().json(api::state::Response {
+                    busy: true,
+                    current_state,
+                    queue_position: Some(position),
+                })
             }
             machine::StateResponse::InvalidState(current_state) => {
-                HttpResponse::UnprocessableEntity()
-                    .json(api::state::Response { busy: true, current_state })
+                HttpResponse::UnprocessableEntity().json(api::state::Response {
+                    busy: true,
+                    current_state,
+                    queue_position: None,
+                })
             }
         }
     }
@@ -135,3 +711,107 @@ impl actix_web::ResponseError for Error {
         HttpResponse::InternalServerError().finish()
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn limit_requests_per_client() {
+        let limiter = RateLimiter::new(Some(2));
+        assert!(limiter.allow("foo"));
+        assert!(limiter.allow("foo"));
+        assert!(!limiter.allow("foo"));
+        assert!(limiter.allow("bar"));
+
+        let unlimited = RateLimiter::new(None);
+        assert!((0..100).all(|_| unlimited.allow("foo")));
+    }
+
+    #[test]
+    fn record_audit_entry() {
+        let dir = tempfile::tempdir().unwrap();
+        let file = dir.path().join("audit.log");
+        let entry = |path: &str| AuditEntry {
+            file: file.clone(),
+            time: "2020-01-01T00:00:00+00:00".to_owned(),
+            client: "127.0.0.1:4242".to_owned(),
+            method: "POST".to_owned(),
+            path: path.to_owned(),
+        };
+        entry("/local_install").record(StatusCode::OK);
+        entry("/update/download/abort").record(StatusCode::BAD_REQUEST);
+
+        let lines = fs::read_to_string(&file).unwrap();
+        let lines = lines.lines().collect::<Vec<_>>();
+        assert_eq!(
+            lines,
+            vec![
+                r#"{"time":"2020-01-01T00:00:00+00:00","client":"127.0.0.1:4242","method":"POST","path":"/local_install","status":200}"#,
+                r#"{"time":"2020-01-01T00:00:00+00:00","client":"127.0.0.1:4242","method":"POST","path":"/update/download/abort","status":400}"#,
+            ]
+        );
+    }
+
+    #[test]
+    fn authorize_bearer_token() {
+        let headers = |value: &'static str| {
+            let mut headers = HeaderMap::new();
+            headers.insert(header::AUTHORIZATION, HeaderValue::from_static(value));
+            headers
+        };
+
+        assert!(authorized(None, &HeaderMap::new()));
+        assert!(authorized(Some("secret"), &headers("Bearer secret")));
+        assert!(!authorized(Some("secret"), &HeaderMap::new()));
+        assert!(!authorized(Some("secret"), &headers("Bearer secre")));
+        assert!(!authorized(Some("secret"), &headers("Basic secret")));
+    }
+
+    #[actix_rt::test]
+    async fn guard_encoded_paths() {
+        let mut app = actix_web::test::init_service(
+            actix_web::App::new().data(ApiToken(Some("secret".to_owned()))).route(
+                "/info",
+                web::get().to(|_: Authorized| async { HttpResponse::Ok().finish() }),
+            ),
+        )
+        .await;
+
+        for uri in &["/info", "/%69nfo"] {
+            let req = actix_web::test::TestRequest::get().uri(uri).to_request();
+            let res = actix_web::test::call_service(&mut app, req).await;
+            assert_eq!(res.status(), StatusCode::UNAUTHORIZED, "{} not guarded", uri);
+
+            let req = actix_web::test::TestRequest::get()
+                .uri(uri)
+                .header(header::AUTHORIZATION, "Bearer secret")
+                .to_request();
+            let res = actix_web::test::call_service(&mut app, req).await;
+            assert_eq!(res.status(), StatusCode::OK);
+        }
+    }
+
+    #[test]
+    fn normalize_base_path() {
+        assert_eq!(base_path(""), "");
+        assert_eq!(base_path("/"), "");
+        assert_eq!(base_path("updatehub"), "/updatehub");
+        assert_eq!(base_path("/updatehub/"), "/updatehub");
+    }
+
+    #[test]
+    fn allow_configured_origins() {
+        let origin = HeaderValue::from_static("http://device.local:8000");
+        let allowed = vec!["http://device.local:8000".to_owned()];
+        assert_eq!(allowed_origin(&allowed, Some(&origin)), Some(origin.clone()));
+        assert_eq!(allowed_origin(&["*".to_owned()], Some(&origin)), Some(origin.clone()));
+        assert_eq!(allowed_origin(&[], Some(&origin)), None);
+        assert_eq!(allowed_origin(&allowed, None), None);
+        assert_eq!(
+            allowed_origin(&allowed, Some(&HeaderValue::from_static("http://other.local"))),
+            None
+        );
+    }
+}
@@ -0,0 +1,307 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::{
+    states::machine::{self, StateResponse},
+    utils,
+};
+use cloud::{
+    hawkbit::{self, Deployment, Execution, Finished},
+    jobs::{Client, JobExecution, JobStatus},
+};
+use sdk::api::info::{
+    runtime_settings::{UpdateOutcome, UpdateResult},
+    settings::{JobBridge, JobProvider},
+};
+use serde::Deserialize;
+use slog_scope::{debug, error, info, warn};
+use std::collections::BTreeMap;
+
+/// Document of the update jobs, as created at the device management
+/// service.
+#[derive(Debug, Deserialize)]
+struct JobDocument {
+    /// Where the update package is downloaded from.
+    url: String,
+}
+
+/// Receives the update jobs from the device management service,
+/// installing their packages as remote installs and reporting the
+/// outcome back, for as long as the agent runs.
+pub(crate) async fn run(settings: JobBridge, addr: machine::Addr) {
+    info!("receiving update jobs from {}", settings.endpoint);
+    let interval = settings.poll_interval.to_std().unwrap_or_default();
+
+    match settings.provider {
+        Some(JobProvider::AwsIotJobs) => {
+            let client = Client::new(&settings.endpoint, &settings.device_name);
+            loop {
+                if let Err(e) = poll(&client, &addr).await {
+                    warn!("failed to poll for update jobs: {}", e);
+                }
+                async_std::task::sleep(interval).await;
+            }
+        }
+        Some(JobProvider::Hawkbit) => {
+            let token = match settings.token.as_deref().map(utils::secret::resolve).transpose() {
+                Ok(token) => token,
+                Err(e) => {
+                    error!("failed to read the hawkbit token: {}", e);
+                    return;
+                }
+            };
+            let client =
+                hawkbit::Client::new(&settings.endpoint, &settings.device_name, token.as_deref());
+            loop {
+                if let Err(e) = poll_hawkbit(&client, &addr).await {
+                    warn!("failed to poll for hawkbit deployments: {}", e);
+                }
+                async_std::task::sleep(interval).await;
+            }
+        }
+        None => {}
+    }
+}
+
+async fn poll(client: &Client, addr: &machine::Addr) -> cloud::Result<()> {
+    let execution = match client.next().await? {
+        Some(execution) => execution,
+        None => return Ok(()),
+    };
+
+    match execution.status {
+        JobStatus::Queued => start(client, addr, &execution).await,
+        // The agent may have rebooted since the job has been started, so
+        // its outcome is taken from the last update result.
+        JobStatus::InProgress => {
+            let last_update = match last_update(addr).await {
+                Some(last_update) => last_update,
+                None => return Ok(()),
+            };
+            match outcome(&execution, last_update.as_ref()) {
+                Some((status, details)) => {
+                    info!("update job {} has finished: {:?}", execution.job_id, status);
+                    client.update(&execution.job_id, status, &details).await
+                }
+                None => Ok(()),
+            }
+        }
+        status => {
+            debug!("ignoring update job {} in {:?} status", execution.job_id, status);
+            Ok(())
+        }
+    }
+}
+
+async fn start(
+    client: &Client,
+    addr: &machine::Addr,
+    execution: &JobExecution,
+) -> cloud::Result<()> {
+    let document = match serde_json::from_str::<JobDocument>(&execution.job_document) {
+        Ok(document) => document,
+        Err(e) => {
+            warn!("rejecting update job {}: {}", execution.job_id, e);
+            let details = details("rejected", Some(format!("invalid job document: {}", e)));
+            return client.update(&execution.job_id, JobStatus::Rejected, &details).await;
+        }
+    };
+
+    // The jobs refused by the agent are kept queued, so they are retried
+    // once it is done with what it is handling.
+    match addr.request_remote_install(document.url).await {
+        StateResponse::RequestAccepted(_) | StateResponse::Queued(..) => {
+            info!("update job {} has been accepted", execution.job_id);
+            client
+                .update(&execution.job_id, JobStatus::InProgress, &details("accepted", None))
+                .await
+        }
+        StateResponse::InvalidState(state) => {
+            debug!("update job {} can't be started while in {}", execution.job_id, state);
+            Ok(())
+        }
+    }
+}
+
+/// Polls for the hawkBit deployment, installing its update package as a
+/// remote install and sending the feedback of it. The deployment is only
+/// known to be in progress from the feedback sent once accepted, as the
+/// agent may have rebooted since.
+async fn poll_hawkbit(client: &hawkbit::Client, addr: &machine::Addr) -> cloud::Result<()> {
+    let deployment = match client.poll().await? {
+        Some(deployment) => deployment,
+        None => return Ok(()),
+    };
+
+    if let Some(accepted_at) = deployment.accepted_at {
+        let last_update = match last_update(addr).await {
+            Some(last_update) => last_update,
+            None => return Ok(()),
+        };
+        return match finished_since(last_update.as_ref(), accepted_at) {
+            Some(result) => {
+                let (finished, details) = hawkbit_outcome(result);
+                info!("deployment {} has finished: {:?}", deployment.action_id, finished);
+                client.feedback(&deployment.action_id, Execution::Closed, finished, &details).await
+            }
+            None => Ok(()),
+        };
+    }
+
+    let url = match package_url(&deployment) {
+        Some(url) => url,
+        None => {
+            warn!("rejecting deployment {}: no update package", deployment.action_id);
+            let details = ["no update package among the artifacts".to_owned()];
+            return client
+                .feedback(&deployment.action_id, Execution::Closed, Finished::Failure, &details)
+                .await;
+        }
+    };
+
+    match addr.request_remote_install(url).await {
+        StateResponse::RequestAccepted(_) | StateResponse::Queued(..) => {
+            info!("deployment {} has been accepted", deployment.action_id);
+            let details = [hawkbit::accepted_details(chrono::Utc::now().timestamp())];
+            client
+                .feedback(&deployment.action_id, Execution::Proceeding, Finished::None, &details)
+                .await
+        }
+        StateResponse::InvalidState(state) => {
+            debug!("deployment {} can't be started while in {}", deployment.action_id, state);
+            Ok(())
+        }
+    }
+}
+
+async fn last_update(addr: &machine::Addr) -> Option<Option<UpdateResult>> {
+    match addr.request_firmware().await {
+        Ok(firmware) => Some(firmware.last_update),
+        Err(e) => {
+            warn!("failed to get the last update result: {}", e);
+            None
+        }
+    }
+}
+
+/// The update package is the artifact named as one, or else the only
+/// artifact of the deployment.
+fn package_url(deployment: &Deployment) -> Option<String> {
+    let artifacts = &deployment.artifacts;
+    artifacts
+        .iter()
+        .find(|artifact| artifact.filename.ends_with(".uhupkg"))
+        .or_else(|| if artifacts.len() == 1 { artifacts.first() } else { None })
+        .map(|artifact| artifact.url.clone())
+}
+
+fn finished_since(last_update: Option<&UpdateResult>, since: i64) -> Option<&UpdateResult> {
+    last_update.filter(|r| r.time.timestamp() >= since)
+}
+
+fn hawkbit_outcome(result: &UpdateResult) -> (Finished, Vec<String>) {
+    let (finished, state) = match result.outcome {
+        UpdateOutcome::Installed => (Finished::Success, "installed"),
+        UpdateOutcome::RolledBack => (Finished::Failure, "rolled-back"),
+        UpdateOutcome::Failed => (Finished::Failure, "failed"),
+        UpdateOutcome::Canceled => (Finished::Failure, "canceled"),
+    };
+    let mut details = vec![state.to_owned()];
+    details.extend(result.error.clone());
+    (finished, details)
+}
+
+/// Status the `execution` has finished with, when the `last_update` has
+/// been handled after the execution was started.
+fn outcome(
+    execution: &JobExecution,
+    last_update: Option<&UpdateResult>,
+) -> Option<(JobStatus, BTreeMap<String, String>)> {
+    let result = finished_since(last_update, execution.last_updated_at)?;
+    let (status, state) = match result.outcome {
+        UpdateOutcome::Installed => (JobStatus::Succeeded, "installed"),
+        UpdateOutcome::RolledBack => (JobStatus::Failed, "rolled-back"),
+        UpdateOutcome::Failed => (JobStatus::Failed, "failed"),
+        UpdateOutcome::Canceled => (JobStatus::Failed, "canceled"),
+    };
+    Some((status, details(state, result.error.clone())))
+}
+
+fn details(state: &str, error: Option<String>) -> BTreeMap<String, String> {
+    let mut details = BTreeMap::new();
+    details.insert("state".to_owned(), state.to_owned());
+    if let Some(error) = error {
+        details.insert("error".to_owned(), error);
+    }
+    details
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn execution(last_updated_at: i64) -> JobExecution {
+        JobExecution {
+            job_id: "job".to_owned(),
+            status: JobStatus::InProgress,
+            job_document: r#"{"url":"https://example.com/update.uhupkg"}"#.to_owned(),
+            last_updated_at,
+        }
+    }
+
+    fn result(outcome: UpdateOutcome, timestamp: i64) -> UpdateResult {
+        use chrono::TimeZone;
+
+        UpdateResult {
+            package_uid: None,
+            outcome,
+            time: chrono::Utc.timestamp(timestamp, 0),
+            error: None,
+        }
+    }
+
+    #[test]
+    fn job_outcome() {
+        assert_eq!(outcome(&execution(100), None), None);
+        assert_eq!(outcome(&execution(100), Some(&result(UpdateOutcome::Installed, 50))), None);
+        assert_eq!(
+            outcome(&execution(100), Some(&result(UpdateOutcome::Installed, 150))),
+            Some((JobStatus::Succeeded, details("installed", None)))
+        );
+
+        let mut failed = result(UpdateOutcome::Failed, 150);
+        failed.error = Some("invalid signature".to_owned());
+        assert_eq!(
+            outcome(&execution(100), Some(&failed)),
+            Some((JobStatus::Failed, details("failed", Some("invalid signature".to_owned()))))
+        );
+    }
+
+    #[test]
+    fn hawkbit_package() {
+        let artifact = |filename: &str| hawkbit::Artifact {
+            filename: filename.to_owned(),
+            url: format!("https://hawkbit/{}", filename),
+        };
+        let mut deployment = Deployment {
+            action_id: "8".to_owned(),
+            artifacts: vec![artifact("notes.txt"), artifact("update.uhupkg")],
+            accepted_at: None,
+        };
+        assert_eq!(package_url(&deployment).unwrap(), "https://hawkbit/update.uhupkg");
+
+        deployment.artifacts = vec![artifact("notes.txt"), artifact("image.bin")];
+        assert_eq!(package_url(&deployment), None);
+        deployment.artifacts = vec![artifact("image.bin")];
+        assert_eq!(package_url(&deployment).unwrap(), "https://hawkbit/image.bin");
+
+        let mut failed = result(UpdateOutcome::RolledBack, 150);
+        failed.error = Some("boot failed".to_owned());
+        assert_eq!(
+            hawkbit_outcome(&failed),
+            (Finished::Failure, vec!["rolled-back".to_owned(), "boot failed".to_owned()])
+        );
+    }
+}
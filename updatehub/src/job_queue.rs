@@ -0,0 +1,230 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::states::machine::{self, ProbeResponse, StateResponse};
+use async_std::sync;
+use sdk::api::{
+    self,
+    jobs::{Job, Outcome, Request, Status},
+};
+use slog_scope::{debug, info};
+use std::{
+    collections::BTreeMap,
+    sync::{Arc, Mutex},
+};
+
+/// Number of finished jobs kept, so their outcome can still be fetched.
+const FINISHED_JOBS: usize = 32;
+
+/// Runs the operations requested through the local API one at a time, in
+/// the order they were submitted, so the clients don't wait for them.
+#[derive(Clone)]
+pub(crate) struct JobQueue {
+    jobs: Arc<Mutex<Jobs>>,
+    waker: sync::Sender<()>,
+}
+
+#[derive(Default)]
+struct Jobs {
+    last_id: u64,
+    // Kept by id, which is the order they are run in.
+    jobs: BTreeMap<u64, Job>,
+}
+
+#[derive(Debug)]
+pub(crate) enum CancelJobResponse {
+    Canceled(Job),
+    NotFound,
+    /// The job is already running, or done with.
+    InvalidStatus(Status),
+}
+
+impl JobQueue {
+    pub(crate) fn start(addr: machine::Addr) -> Self {
+        let (waker, receiver) = sync::channel(1);
+        let queue = JobQueue { jobs: Arc::default(), waker };
+        actix_rt::spawn(queue.clone().run(addr, receiver));
+        queue
+    }
+
+    pub(crate) async fn submit(&self, request: Request) -> Job {
+        let job = self.jobs.lock().unwrap().push(request);
+        info!("job {} has been queued: {:?}", job.id, job.request);
+
+        // The queued jobs are all run once it is woken up, so a pending
+        // wake up is enough.
+        if !self.waker.is_full() {
+            self.waker.send(()).await;
+        }
+        job
+    }
+
+    pub(crate) fn get(&self, id: u64) -> Option<Job> {
+        self.jobs.lock().unwrap().jobs.get(&id).cloned()
+    }
+
+    pub(crate) fn cancel(&self, id: u64) -> CancelJobResponse {
+        self.jobs.lock().unwrap().cancel(id)
+    }
+
+    async fn run(self, addr: machine::Addr, waker: sync::Receiver<()>) {
+        while waker.recv().await.is_ok() {
+            loop {
+                let job = match self.jobs.lock().unwrap().next() {
+                    Some(job) => job,
+                    None => break,
+                };
+                debug!("running job {}", job.id);
+                let outcome = execute(&addr, job.request).await;
+                self.jobs.lock().unwrap().finish(job.id, outcome);
+            }
+        }
+    }
+}
+
+impl Jobs {
+    fn push(&mut self, request: Request) -> Job {
+        self.last_id += 1;
+        let job = Job { id: self.last_id, request, status: Status::Queued, outcome: None };
+        self.jobs.insert(job.id, job.clone());
+        self.prune();
+        job
+    }
+
+    // Takes the oldest queued job, marking it as running.
+    fn next(&mut self) -> Option<Job> {
+        let job = self.jobs.values_mut().find(|job| job.status == Status::Queued)?;
+        job.status = Status::Running;
+        Some(job.clone())
+    }
+
+    // Only the queued jobs are canceled, as the running ones are
+    // already handled by the agent.
+    fn cancel(&mut self, id: u64) -> CancelJobResponse {
+        match self.jobs.get_mut(&id) {
+            Some(job) if job.status == Status::Queued => {
+                info!("job {} has been canceled", id);
+                job.status = Status::Canceled;
+                CancelJobResponse::Canceled(job.clone())
+            }
+            Some(job) => CancelJobResponse::InvalidStatus(job.status),
+            None => CancelJobResponse::NotFound,
+        }
+    }
+
+    fn finish(&mut self, id: u64, outcome: Outcome) {
+        if let Some(job) = self.jobs.get_mut(&id) {
+            debug!("job {} has finished: {:?}", id, outcome);
+            job.status = Status::Finished;
+            job.outcome = Some(outcome);
+        }
+        self.prune();
+    }
+
+    // Drops the oldest finished, or canceled, jobs beyond the ones kept.
+    fn prune(&mut self) {
+        let done = self
+            .jobs
+            .values()
+            .filter(|job| job.status == Status::Finished || job.status == Status::Canceled)
+            .map(|job| job.id)
+            .collect::<Vec<_>>();
+        for id in done.iter().take(done.len().saturating_sub(FINISHED_JOBS)) {
+            self.jobs.remove(id);
+        }
+    }
+}
+
+async fn execute(addr: &machine::Addr, request: Request) -> Outcome {
+    match request {
+        Request::Probe { custom_server } => match addr.request_probe(custom_server).await {
+            Ok(ProbeResponse::Available) => {
+                Outcome::Probe(api::probe::Response { update_available: true, try_again_in: None })
+            }
+            Ok(ProbeResponse::Unavailable) => {
+                Outcome::Probe(api::probe::Response { update_available: false, try_again_in: None })
+            }
+            Ok(ProbeResponse::Delayed(d)) => Outcome::Probe(api::probe::Response {
+                update_available: false,
+                try_again_in: Some(d),
+            }),
+            Ok(ProbeResponse::Busy(current_state)) => Outcome::State(api::state::Response {
+                busy: true,
+                current_state,
+                queue_position: None,
+            }),
+            Err(e) => Outcome::Error(e.to_string()),
+        },
+        Request::LocalInstall(request) => {
+            Outcome::State(match addr.request_local_install(request.file).await {
+                StateResponse::RequestAccepted(current_state) => {
+                    api::state::Response { busy: false, current_state, queue_position: None }
+                }
+                StateResponse::Queued(current_state, position) => api::state::Response {
+                    busy: true,
+                    current_state,
+                    queue_position: Some(position),
+                },
+                StateResponse::InvalidState(current_state) => {
+                    api::state::Response { busy: true, current_state, queue_position: None }
+                }
+            })
+        }
+        Request::DryRun(request) => match addr.request_dry_run(request).await {
+            Ok(response) => Outcome::DryRun(response),
+            Err(e) => Outcome::Error(format!("unable to check the package: {}", e)),
+        },
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn probe() -> Request {
+        Request::Probe { custom_server: None }
+    }
+
+    #[test]
+    fn run_in_submission_order() {
+        let mut jobs = Jobs::default();
+        let first = jobs.push(probe());
+        let second = jobs.push(probe());
+        assert_eq!((first.id, second.id), (1, 2));
+
+        assert_eq!(jobs.next().map(|job| job.id), Some(1));
+        assert_eq!(jobs.jobs[&1].status, Status::Running);
+        jobs.finish(1, Outcome::Error("failed".to_owned()));
+        assert_eq!(jobs.jobs[&1].status, Status::Finished);
+
+        let third = jobs.push(probe());
+        match jobs.cancel(third.id) {
+            CancelJobResponse::Canceled(job) => assert_eq!(job.status, Status::Canceled),
+            res => panic!("unexpected response: {:?}", res),
+        }
+        match jobs.cancel(1) {
+            CancelJobResponse::InvalidStatus(status) => assert_eq!(status, Status::Finished),
+            res => panic!("unexpected response: {:?}", res),
+        }
+
+        assert_eq!(jobs.next().map(|job| job.id), Some(2));
+        assert!(jobs.next().is_none());
+    }
+
+    #[test]
+    fn keep_last_finished_jobs() {
+        let mut jobs = Jobs::default();
+        for _ in 0..FINISHED_JOBS + 2 {
+            let job = jobs.push(probe());
+            jobs.next();
+            jobs.finish(job.id, Outcome::Error("failed".to_owned()));
+        }
+        let queued = jobs.push(probe());
+
+        assert_eq!(jobs.jobs.len(), FINISHED_JOBS + 1);
+        assert!(!jobs.jobs.contains_key(&1));
+        assert_eq!(jobs.jobs[&queued.id].status, Status::Queued);
+    }
+}
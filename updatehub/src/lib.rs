@@ -3,13 +3,26 @@
 // SPDX-License-Identifier: Apache-2.0
 
 mod build_info;
+mod capabilities;
+mod dbus;
+mod enrollment;
 mod firmware;
+mod gateway;
 mod http_api;
+mod job_bridge;
+mod job_queue;
+mod log_sink;
 pub mod logger;
 mod mem_drain;
+mod mirror;
 mod object;
+pub mod pkg;
+mod push;
+mod removable_media;
 mod runtime_settings;
+mod self_test;
 mod settings;
+mod simulation;
 mod states;
 mod update_package;
 mod utils;
@@ -25,7 +38,13 @@ pub(crate) use crate::cloud_mock::Client as CloudClient;
 #[cfg(not(test))]
 pub(crate) use cloud::Client as CloudClient;
 
-pub use crate::{build_info::version, states::run};
+pub use crate::{
+    build_info::version,
+    states::{install, run},
+    utils::{
+        agent_update::handshake_reply as agent_check_reply, privsep::serve as serve_installer,
+    },
+};
 use thiserror::Error;
 
 pub type Result<T> = std::result::Result<T, Error>;
@@ -46,4 +65,19 @@ pub enum Error {
 
     #[error("Process error: {0}")]
     Process(#[from] easy_process::Error),
+
+    #[error("Utils error: {0}")]
+    Utils(#[from] crate::utils::Error),
+
+    #[error("Cloud client error: {0}")]
+    Cloud(#[from] cloud::Error),
+
+    #[error("Package tooling error: {0}")]
+    Pkg(#[from] crate::pkg::Error),
+
+    #[error("Update has failed: {0}")]
+    UpdateFailed(String),
+
+    #[error("Agent request has failed: {0}")]
+    Agent(#[from] sdk::Error),
 }
@@ -0,0 +1,373 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! System loggers the messages are sent to, besides the standard error:
+//! the systemd journal, through its native protocol, and syslog, in the
+//! RFC 5424 format.
+
+use crate::mem_drain::KVSerializer;
+use lazy_static::lazy_static;
+use openssl::ssl::{SslConnector, SslMethod};
+use sdk::api::info::settings::{Log, Syslog, SyslogTransport};
+use slog::{Drain, OwnedKVList, Record, KV};
+use std::{
+    collections::HashMap,
+    fmt, fs,
+    io::{self, Write},
+    net::UdpSocket,
+    os::unix::net::UnixDatagram,
+    sync::{Mutex, RwLock},
+    time::Duration,
+};
+
+const JOURNAL_SOCKET: &str = "/run/systemd/journal/socket";
+const SYSLOG_SOCKET: &str = "/dev/log";
+const SYSLOG_PORT: u16 = 514;
+const SYSLOG_TLS_PORT: u16 = 6514;
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+const IDENTIFIER: &str = "updatehub";
+// No enterprise number has been registered for the agent, so the one
+// reserved for documentation is taken for its structured data.
+const SD_ID: &str = "updatehub@32473";
+
+lazy_static! {
+    static ref SINKS: RwLock<Sinks> = RwLock::default();
+}
+
+#[derive(Default)]
+struct Sinks {
+    journal: Option<Journal>,
+    syslog: Option<SyslogSink>,
+}
+
+/// Opens the system loggers of the `settings`, keeping the ones already
+/// open when they are unchanged.
+pub(crate) fn configure(settings: &Log) {
+    let mut sinks = SINKS.write().unwrap();
+
+    if settings.journald != sinks.journal.is_some() {
+        sinks.journal = if settings.journald {
+            Journal::connect()
+                .map_err(|e| eprintln!("failed to connect to the systemd journal: {}", e))
+                .ok()
+        } else {
+            None
+        };
+    }
+
+    if settings.syslog.as_ref() != sinks.syslog.as_ref().map(|sink| &sink.settings) {
+        sinks.syslog = settings.syslog.clone().map(SyslogSink::new);
+    }
+}
+
+/// Message, along with what the agent was doing when it was logged.
+struct Entry {
+    level: slog::Level,
+    subsystem: &'static str,
+    state: Option<&'static str>,
+    package_uid: Option<String>,
+    msg: String,
+    data: HashMap<String, String>,
+}
+
+/// Sends the messages to the system loggers which have been configured.
+pub(crate) struct SinkDrain;
+
+impl Drain for SinkDrain {
+    type Err = io::Error;
+    type Ok = ();
+
+    fn log(&self, record: &Record, kvs: &OwnedKVList) -> io::Result<()> {
+        let sinks = SINKS.read().unwrap();
+        if sinks.journal.is_none() && sinks.syslog.is_none() {
+            return Ok(());
+        }
+
+        let mut kv = KVSerializer::default();
+        record.kv().serialize(record, &mut kv)?;
+        kvs.serialize(record, &mut kv)?;
+        let (state, package_uid) = crate::logger::context();
+        let entry = Entry {
+            level: record.level(),
+            subsystem: crate::logger::subsystem(record.module()),
+            state,
+            package_uid,
+            msg: fmt::format(*record.msg()),
+            data: kv.0,
+        };
+
+        // A logger failing doesn't keep the others from being written.
+        let journal = sinks.journal.as_ref().map_or(Ok(()), |journal| journal.send(&entry));
+        let syslog = sinks.syslog.as_ref().map_or(Ok(()), |syslog| syslog.send(&entry));
+        journal.and(syslog)
+    }
+}
+
+fn priority(level: slog::Level) -> u8 {
+    match level {
+        slog::Level::Critical => 2,
+        slog::Level::Error => 3,
+        slog::Level::Warning => 4,
+        slog::Level::Info => 6,
+        slog::Level::Debug | slog::Level::Trace => 7,
+    }
+}
+
+struct Journal(UnixDatagram);
+
+impl Journal {
+    fn connect() -> io::Result<Self> {
+        let socket = UnixDatagram::unbound()?;
+        socket.connect(JOURNAL_SOCKET)?;
+        Ok(Journal(socket))
+    }
+
+    fn send(&self, entry: &Entry) -> io::Result<()> {
+        self.0.send(&journal_message(entry)).map(|_| ())
+    }
+}
+
+// Each field is a `NAME=value` line, but for the values with new lines,
+// which are given by their size instead.
+fn journal_message(entry: &Entry) -> Vec<u8> {
+    let mut fields = vec![
+        ("MESSAGE".to_owned(), entry.msg.clone()),
+        ("PRIORITY".to_owned(), priority(entry.level).to_string()),
+        ("SYSLOG_IDENTIFIER".to_owned(), IDENTIFIER.to_owned()),
+        ("UPDATEHUB_SUBSYSTEM".to_owned(), entry.subsystem.to_owned()),
+    ];
+    if let Some(state) = entry.state {
+        fields.push(("UPDATEHUB_STATE".to_owned(), state.to_owned()));
+    }
+    if let Some(ref package_uid) = entry.package_uid {
+        fields.push(("UPDATEHUB_PACKAGE_UID".to_owned(), package_uid.clone()));
+    }
+    for (key, value) in entry.data.iter() {
+        fields.push((format!("UPDATEHUB_{}", journal_field_name(key)), value.clone()));
+    }
+
+    let mut message = Vec::default();
+    for (name, value) in fields {
+        message.extend_from_slice(name.as_bytes());
+        if value.contains('\n') {
+            message.push(b'\n');
+            message.extend_from_slice(&(value.len() as u64).to_le_bytes());
+        } else {
+            message.push(b'=');
+        }
+        message.extend_from_slice(value.as_bytes());
+        message.push(b'\n');
+    }
+    message
+}
+
+// The journal takes upper case letters, digits and underscores.
+fn journal_field_name(key: &str) -> String {
+    key.chars()
+        .map(|c| if c.is_ascii_alphanumeric() { c.to_ascii_uppercase() } else { '_' })
+        .collect()
+}
+
+enum Connection {
+    Local(UnixDatagram),
+    Udp(UdpSocket),
+    Stream(Box<dyn Write + Send>),
+}
+
+impl Connection {
+    fn open(settings: &Syslog) -> io::Result<Self> {
+        let server = match settings.server {
+            Some(ref server) => server,
+            None => {
+                let socket = UnixDatagram::unbound()?;
+                socket.connect(SYSLOG_SOCKET)?;
+                return Ok(Connection::Local(socket));
+            }
+        };
+
+        // The port defaults to the one assigned to the transport.
+        let default_port = match settings.transport {
+            SyslogTransport::Tls => SYSLOG_TLS_PORT,
+            _ => SYSLOG_PORT,
+        };
+        let (host, port) = cloud::net::split_host_port(server, default_port)
+            .map_err(|e| io::Error::new(io::ErrorKind::InvalidInput, e.to_string()))?;
+
+        match settings.transport {
+            SyslogTransport::Udp => {
+                // The addresses of a family which isn't routed fail to be
+                // connected to right away.
+                let mut last_error = None;
+                for addr in cloud::net::resolve(host, port)? {
+                    let socket =
+                        UdpSocket::bind(if addr.is_ipv4() { "0.0.0.0:0" } else { "[::]:0" })?;
+                    match socket.connect(addr) {
+                        Ok(()) => return Ok(Connection::Udp(socket)),
+                        Err(e) => last_error = Some(e),
+                    }
+                }
+                Err(last_error.unwrap_or_else(|| io::Error::from(io::ErrorKind::NotConnected)))
+            }
+            SyslogTransport::Tcp => {
+                let stream = cloud::net::connect(host, port, CONNECT_TIMEOUT)?;
+                Ok(Connection::Stream(Box::new(stream)))
+            }
+            SyslogTransport::Tls => {
+                let mut connector = SslConnector::builder(SslMethod::tls())?;
+                if let Some(ref ca_certificate) = settings.ca_certificate {
+                    connector.set_ca_file(ca_certificate)?;
+                }
+                let stream = connector
+                    .build()
+                    .connect(host, cloud::net::connect(host, port, CONNECT_TIMEOUT)?)
+                    .map_err(|e| io::Error::new(io::ErrorKind::Other, e.to_string()))?;
+                Ok(Connection::Stream(Box::new(stream)))
+            }
+        }
+    }
+
+    // The messages sent over streams are prefixed by their size.
+    fn send(&mut self, message: &str) -> io::Result<()> {
+        match self {
+            Connection::Local(socket) => socket.send(message.as_bytes()).map(|_| ()),
+            Connection::Udp(socket) => socket.send(message.as_bytes()).map(|_| ()),
+            Connection::Stream(stream) => {
+                write!(stream, "{} {}", message.len(), message)?;
+                stream.flush()
+            }
+        }
+    }
+}
+
+struct SyslogSink {
+    settings: Syslog,
+    hostname: String,
+    // Opened on the first message, and again after failing.
+    connection: Mutex<Option<Connection>>,
+}
+
+impl SyslogSink {
+    fn new(settings: Syslog) -> Self {
+        let hostname = fs::read_to_string("/proc/sys/kernel/hostname")
+            .map(|hostname| hostname.trim().to_owned())
+            .unwrap_or_default();
+        SyslogSink { settings, hostname, connection: Mutex::default() }
+    }
+
+    fn send(&self, entry: &Entry) -> io::Result<()> {
+        let message = syslog_message(entry, self.settings.facility, &self.hostname);
+        let mut connection = self.connection.lock().unwrap();
+        if connection.is_none() {
+            *connection = Some(Connection::open(&self.settings)?);
+        }
+
+        let res = connection.as_mut().map_or(Ok(()), |connection| connection.send(&message));
+        if res.is_err() {
+            *connection = None;
+        }
+        res
+    }
+}
+
+// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+fn syslog_message(entry: &Entry, facility: u8, hostname: &str) -> String {
+    let mut params = Vec::default();
+    if let Some(state) = entry.state {
+        params.push(("state".to_owned(), state.to_owned()));
+    }
+    if let Some(ref package_uid) = entry.package_uid {
+        params.push(("package_uid".to_owned(), package_uid.clone()));
+    }
+    let mut data = entry.data.iter().collect::<Vec<_>>();
+    data.sort();
+    params.extend(data.into_iter().map(|(key, value)| (sd_param_name(key), value.clone())));
+
+    let structured_data = if params.is_empty() {
+        "-".to_owned()
+    } else {
+        let params = params
+            .iter()
+            .map(|(name, value)| format!(" {}=\"{}\"", name, sd_param_value(value)))
+            .collect::<String>();
+        format!("[{}{}]", SD_ID, params)
+    };
+
+    format!(
+        "<{}>1 {} {} {} {} {} {} {}",
+        u16::from(facility) * 8 + u16::from(priority(entry.level)),
+        chrono::Utc::now().to_rfc3339(),
+        if hostname.is_empty() { "-" } else { hostname },
+        IDENTIFIER,
+        std::process::id(),
+        entry.subsystem,
+        structured_data,
+        entry.msg
+    )
+}
+
+// The names are up to 32 printable characters, but `=`, ` `, `]` and `"`.
+fn sd_param_name(key: &str) -> String {
+    key.chars()
+        .map(|c| if c.is_ascii_graphic() && !"=]\"".contains(c) { c } else { '_' })
+        .take(32)
+        .collect()
+}
+
+fn sd_param_value(value: &str) -> String {
+    let mut escaped = String::with_capacity(value.len());
+    for c in value.chars() {
+        if c == '"' || c == '\\' || c == ']' {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn entry() -> Entry {
+        let mut data = HashMap::new();
+        data.insert("object-path".to_owned(), "a \"b\"]".to_owned());
+        Entry {
+            level: slog::Level::Error,
+            subsystem: "installer",
+            state: Some("install"),
+            package_uid: None,
+            msg: "install has failed\nat rootfs".to_owned(),
+            data,
+        }
+    }
+
+    #[test]
+    fn journal_fields() {
+        let message = journal_message(&entry());
+        let expected = [
+            &b"MESSAGE\n"[..],
+            &28u64.to_le_bytes(),
+            b"install has failed\nat rootfs\n",
+            b"PRIORITY=3\n",
+            b"SYSLOG_IDENTIFIER=updatehub\n",
+            b"UPDATEHUB_SUBSYSTEM=installer\n",
+            b"UPDATEHUB_STATE=install\n",
+            b"UPDATEHUB_OBJECT_PATH=a \"b\"]\n",
+        ]
+        .concat();
+        assert_eq!(message, expected);
+    }
+
+    #[test]
+    fn syslog_format() {
+        let message = syslog_message(&entry(), 3, "device");
+        assert!(message.starts_with("<27>1 "));
+        assert!(message.ends_with(&format!(
+            " device updatehub {} installer [updatehub@32473 state=\"install\" \
+             object-path=\"a \\\"b\\\"\\]\"] install has failed\nat rootfs",
+            std::process::id()
+        )));
+    }
+}
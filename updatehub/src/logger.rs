@@ -2,35 +2,225 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::mem_drain::MemDrain;
+use crate::{
+    log_sink::{self, SinkDrain},
+    mem_drain::{level_name, KVSerializer, LogRecord, MemDrain},
+};
 use lazy_static::lazy_static;
-use slog::{o, Drain, Logger};
+use sdk::api::info::settings::{Log, LogFormat};
+use slog::{o, Drain, Logger, OwnedKVList, Record, KV};
 use std::{
     boxed::Box,
-    sync::{Arc, Mutex},
+    collections::HashMap,
+    fmt,
+    io::{self, Write},
+    sync::{
+        atomic::{AtomicBool, AtomicUsize, Ordering},
+        Arc, Mutex, RwLock,
+    },
 };
 
 lazy_static! {
     static ref BUFFER: Arc<Mutex<MemDrain>> = Arc::new(Mutex::new(MemDrain::default()));
+    // State the agent is in, and the update package it is handling, told
+    // by the structured messages.
+    static ref CONTEXT: RwLock<(Option<&'static str>, Option<String>)> = RwLock::default();
+}
+
+// Verbosity the agent has been started with, and the level the messages
+// are currently logged at, which the settings may change at runtime.
+static VERBOSITY: AtomicUsize = AtomicUsize::new(0);
+static LEVEL: AtomicUsize = AtomicUsize::new(0);
+static JSON: AtomicBool = AtomicBool::new(false);
+static CONSOLE: AtomicBool = AtomicBool::new(true);
+
+// Levels of the subsystems, when set apart from the one above.
+const UNSET: usize = usize::MAX;
+static SUBSYSTEM_LEVELS: [AtomicUsize; 4] = [
+    AtomicUsize::new(UNSET),
+    AtomicUsize::new(UNSET),
+    AtomicUsize::new(UNSET),
+    AtomicUsize::new(UNSET),
+];
+
+/// Part of the agent a message comes from, as told by its module.
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Subsystem {
+    Downloader,
+    Installer,
+    Api,
+    States,
+    Agent,
+}
+
+impl Subsystem {
+    fn of(module: &str) -> Self {
+        let is_in = |prefix: &str| module.starts_with(prefix);
+        if is_in("updatehub_cloud_sdk") || is_in("updatehub::states::download") {
+            Subsystem::Downloader
+        } else if is_in("updatehub::object") || is_in("updatehub::utils::privsep") {
+            Subsystem::Installer
+        } else if is_in("updatehub::http_api") || is_in("updatehub::job_bridge") {
+            Subsystem::Api
+        } else if is_in("updatehub::states") {
+            Subsystem::States
+        } else {
+            Subsystem::Agent
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            Subsystem::Downloader => "downloader",
+            Subsystem::Installer => "installer",
+            Subsystem::Api => "api",
+            Subsystem::States => "states",
+            Subsystem::Agent => "agent",
+        }
+    }
+
+    fn level(self) -> Option<slog::Level> {
+        let slot = match self {
+            Subsystem::Downloader => 0,
+            Subsystem::Installer => 1,
+            Subsystem::Api => 2,
+            Subsystem::States => 3,
+            Subsystem::Agent => return None,
+        };
+        slog::Level::from_usize(SUBSYSTEM_LEVELS[slot].load(Ordering::Relaxed))
+    }
 }
 
 pub fn init(level: slog::Level) {
-    let buffer_drain = buffer().filter_level(level).fuse();
+    VERBOSITY.store(level.as_usize(), Ordering::Relaxed);
+    LEVEL.store(level.as_usize(), Ordering::Relaxed);
+
+    let buffer_drain = buffer().filter(is_logged).fuse();
     let terminal_drain = Mutex::new(
         slog_term::FullFormat::new(slog_term::TermDecorator::new().force_plain().build())
             .build()
-            .filter_level(level),
+            .filter(|record| is_console(false) && is_logged(record)),
     )
     .fuse();
-    let terminal_drain = slog_async::Async::new(terminal_drain).build().fuse();
+    let json_drain = JsonDrain.filter(|record| is_console(true) && is_logged(record)).fuse();
+    let sink_drain = SinkDrain.filter(is_logged).ignore_res();
+    let output_drain =
+        slog::Duplicate::new(slog::Duplicate::new(terminal_drain, json_drain).fuse(), sink_drain)
+            .fuse();
+    let output_drain = slog_async::Async::new(output_drain).build().fuse();
 
-    let log = Logger::root(slog::Duplicate::new(buffer_drain, terminal_drain).fuse(), o!());
+    let log = Logger::root(slog::Duplicate::new(buffer_drain, output_drain).fuse(), o!());
 
     // FIXME: Drop the use of Box::leak here (issue #23).
     let guard = slog_scope::set_global_logger(log);
     Box::leak(Box::new(guard));
 }
 
+/// Applies the log `settings`: the level, the format and the levels of
+/// each subsystem.
+pub fn configure(settings: &Log) {
+    set_level(settings.level.map(slog_level));
+    JSON.store(settings.format == LogFormat::Json, Ordering::Relaxed);
+    CONSOLE.store(settings.console, Ordering::Relaxed);
+    log_sink::configure(settings);
+
+    let subsystems = &settings.subsystems;
+    let levels = [subsystems.downloader, subsystems.installer, subsystems.api, subsystems.states];
+    for (slot, level) in SUBSYSTEM_LEVELS.iter().zip(levels.iter()) {
+        slot.store(level.map_or(UNSET, |level| slog_level(level).as_usize()), Ordering::Relaxed);
+    }
+}
+
+/// Changes the level the messages are logged at, back to the verbosity
+/// the agent has been started with when `level` is unset.
+pub fn set_level(level: Option<slog::Level>) {
+    let level = level.map_or_else(|| VERBOSITY.load(Ordering::Relaxed), slog::Level::as_usize);
+    LEVEL.store(level, Ordering::Relaxed);
+}
+
+/// Sets the state, and the update package, the next messages are logged
+/// within.
+pub(crate) fn set_context(state: &'static str, package_uid: Option<String>) {
+    *CONTEXT.write().unwrap() = (Some(state), package_uid);
+}
+
+/// State, and update package, the messages are being logged within.
+pub(crate) fn context() -> (Option<&'static str>, Option<String>) {
+    CONTEXT.read().unwrap().clone()
+}
+
+/// Subsystem the messages of the `module` are told to come from.
+pub(crate) fn subsystem(module: &str) -> &'static str {
+    Subsystem::of(module).name()
+}
+
+pub(crate) fn slog_level(level: sdk::api::log::Level) -> slog::Level {
+    match level {
+        sdk::api::log::Level::Critical => slog::Level::Critical,
+        sdk::api::log::Level::Error => slog::Level::Error,
+        sdk::api::log::Level::Warning => slog::Level::Warning,
+        sdk::api::log::Level::Info => slog::Level::Info,
+        sdk::api::log::Level::Debug => slog::Level::Debug,
+        sdk::api::log::Level::Trace => slog::Level::Trace,
+    }
+}
+
+// The messages are written to the standard error in a single format.
+fn is_console(json: bool) -> bool {
+    CONSOLE.load(Ordering::Relaxed) && JSON.load(Ordering::Relaxed) == json
+}
+
+fn is_logged(record: &slog::Record) -> bool {
+    Subsystem::of(record.module())
+        .level()
+        .or_else(|| slog::Level::from_usize(LEVEL.load(Ordering::Relaxed)))
+        .map_or(true, |level| record.level().is_at_least(level))
+}
+
+/// Writes the messages as JSON lines.
+struct JsonDrain;
+
+impl JsonDrain {
+    fn entry(
+        level: slog::Level,
+        module: &str,
+        msg: String,
+        data: HashMap<String, String>,
+    ) -> serde_json::Value {
+        let mut entry = serde_json::Map::new();
+        entry.insert("ts".into(), chrono::Utc::now().to_rfc3339().into());
+        entry.insert("level".into(), level_name(level).into());
+        entry.insert("subsystem".into(), Subsystem::of(module).name().into());
+        entry.insert("msg".into(), msg.into());
+
+        let (state, package_uid) = context();
+        if let Some(state) = state {
+            entry.insert("state".into(), state.into());
+        }
+        if let Some(package_uid) = package_uid {
+            entry.insert("package_uid".into(), package_uid.into());
+        }
+        if !data.is_empty() {
+            entry.insert("data".into(), data.into_iter().collect());
+        }
+        entry.into()
+    }
+}
+
+impl Drain for JsonDrain {
+    type Err = io::Error;
+    type Ok = ();
+
+    fn log(&self, record: &Record, kvs: &OwnedKVList) -> io::Result<()> {
+        let mut kv = KVSerializer::default();
+        record.kv().serialize(record, &mut kv)?;
+        kvs.serialize(record, &mut kv)?;
+
+        let entry = Self::entry(record.level(), record.module(), fmt::format(*record.msg()), kv.0);
+        writeln!(io::stderr().lock(), "{}", entry)
+    }
+}
+
 pub fn buffer() -> Arc<Mutex<MemDrain>> {
     BUFFER.clone()
 }
@@ -46,3 +236,41 @@ pub fn stop_memory_logging() {
 pub fn get_memory_log() -> String {
     BUFFER.lock().unwrap().to_string()
 }
+
+/// Recent log entries of the agent, at least as severe as `level`.
+pub fn history(level: slog::Level) -> Vec<LogRecord> {
+    BUFFER.lock().unwrap().history(level)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn subsystems() {
+        assert_eq!(Subsystem::of("updatehub_cloud_sdk::client"), Subsystem::Downloader);
+        assert_eq!(Subsystem::of("updatehub::states::download"), Subsystem::Downloader);
+        assert_eq!(Subsystem::of("updatehub::object::installer::raw"), Subsystem::Installer);
+        assert_eq!(Subsystem::of("updatehub::http_api"), Subsystem::Api);
+        assert_eq!(Subsystem::of("updatehub::states::install"), Subsystem::States);
+        assert_eq!(Subsystem::of("updatehub::firmware"), Subsystem::Agent);
+    }
+
+    #[test]
+    fn json_entry() {
+        let mut data = HashMap::new();
+        data.insert("object".to_owned(), "rootfs".to_owned());
+        let entry = JsonDrain::entry(
+            slog::Level::Warning,
+            "updatehub::object::installer",
+            "install has failed".to_owned(),
+            data,
+        );
+        assert_eq!(entry["level"], "warning");
+        assert_eq!(entry["subsystem"], "installer");
+        assert_eq!(entry["msg"], "install has failed");
+        assert_eq!(entry["data"]["object"], "rootfs");
+        assert!(entry["ts"].is_string());
+    }
+}
@@ -2,12 +2,19 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 use argh::FromArgs;
+use serde::Serialize;
+use serde_json::Value;
 use slog_scope::info;
 use std::path::PathBuf;
 
 #[derive(FromArgs)]
 /// Top-level command.
 struct TopLevel {
+    /// format the results are printed in, json, yaml or table (defaults to
+    /// table)
+    #[argh(option, default = "Format::Table")]
+    output: Format,
+
     #[argh(subcommand)]
     entry_point: EntryPoints,
 }
@@ -17,12 +24,46 @@ struct TopLevel {
 enum EntryPoints {
     Client(ClientOptions),
     Server(ServerOptions),
+    Installer(InstallerOptions),
+    AgentCheck(AgentCheckOptions),
+    Pkg(PkgOptions),
+    Install(InstallOptions),
+    Status(StatusOptions),
+    Probe(ProbeOptions),
+    Abort(AbortOptions),
+    Config(ConfigOptions),
+    Completions(CompletionsOptions),
+}
+
+/// Format the command results are printed in.
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Format {
+    Json,
+    Yaml,
+    Table,
+}
+
+impl std::str::FromStr for Format {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "json" => Ok(Format::Json),
+            "yaml" => Ok(Format::Yaml),
+            "table" => Ok(Format::Table),
+            _ => Err(format!("unknown output format: {}", s)),
+        }
+    }
 }
 
 #[derive(FromArgs)]
 /// Client subcommand
 #[argh(subcommand, name = "client")]
 struct ClientOptions {
+    /// token used to authenticate to the agent
+    #[argh(option)]
+    token: Option<String>,
+
     #[argh(subcommand)]
     commands: ClientCommands,
 }
@@ -31,10 +72,24 @@ struct ClientOptions {
 #[argh(subcommand)]
 enum ClientCommands {
     Info(Info),
+    Firmware(Firmware),
+    Twin(Twin),
     Log(Log),
+    Progress(Progress),
     Probe(Probe),
     AbortDownload(AbortDownload),
+    PauseDownload(PauseDownload),
+    ResumeDownload(ResumeDownload),
+    CancelUpdate(CancelUpdate),
+    ConfirmUpdate(ConfirmUpdate),
+    ConfirmIdentity(ConfirmIdentity),
+    ApproveUpdate(ApproveUpdate),
+    DenyUpdate(DenyUpdate),
+    GoAhead(GoAhead),
+    DryRun(DryRun),
+    Rollback(Rollback),
     LocalInstall(LocalInstall),
+    Upload(Upload),
     RemoteInstall(RemoteInstall),
 }
 
@@ -44,9 +99,28 @@ enum ClientCommands {
 struct Info {}
 
 #[derive(FromArgs)]
-/// Fetches the available log entries for the last update cycle
+/// Fetches the installed firmware and installation sets state
+#[argh(subcommand, name = "firmware")]
+struct Firmware {}
+
+#[derive(FromArgs)]
+/// Fetches the package desired by the server and the one reported by the device
+#[argh(subcommand, name = "twin")]
+struct Twin {}
+
+#[derive(FromArgs)]
+/// Fetches the recent log entries of the agent
 #[argh(subcommand, name = "log")]
-struct Log {}
+struct Log {
+    /// least severe level of the entries to fetch
+    #[argh(option, from_str_fn(log_level))]
+    level: Option<sdk::api::log::Level>,
+}
+
+#[derive(FromArgs)]
+/// Fetches the progress of the object being downloaded or installed
+#[argh(subcommand, name = "progress")]
+struct Progress {}
 
 #[derive(FromArgs)]
 /// Checks if the server has a new update for this device.
@@ -64,6 +138,79 @@ struct Probe {
 #[argh(subcommand, name = "abort-download")]
 struct AbortDownload {}
 
+#[derive(FromArgs)]
+/// Pause current running download, keeping the downloaded data
+#[argh(subcommand, name = "pause-download")]
+struct PauseDownload {}
+
+#[derive(FromArgs)]
+/// Resume the paused download
+#[argh(subcommand, name = "resume-download")]
+struct ResumeDownload {}
+
+#[derive(FromArgs)]
+/// Cancel the update being downloaded or installed
+#[argh(subcommand, name = "cancel-update")]
+struct CancelUpdate {}
+
+#[derive(FromArgs)]
+/// Confirm the installation just booted into, so it is not rolled back
+#[argh(subcommand, name = "confirm-update")]
+struct ConfirmUpdate {}
+
+#[derive(FromArgs)]
+/// Confirm the device identity change, so the previous identity is no
+/// longer reported
+#[argh(subcommand, name = "confirm-identity")]
+struct ConfirmIdentity {}
+
+#[derive(FromArgs)]
+/// Approve the update awaiting approval, so it proceeds
+#[argh(subcommand, name = "approve-update")]
+struct ApproveUpdate {}
+
+#[derive(FromArgs)]
+/// Deny the update awaiting approval, so it is not installed
+#[argh(subcommand, name = "deny-update")]
+struct DenyUpdate {}
+
+#[derive(FromArgs)]
+/// Check what installing an update package would do, without installing it
+#[argh(subcommand, name = "dry-run")]
+struct DryRun {
+    /// path to the update package, or the URL to get it from
+    #[argh(positional)]
+    package: String,
+}
+
+#[derive(FromArgs)]
+/// Give the go-ahead to install the update announced as ready, as an
+/// external scheduler
+#[argh(subcommand, name = "go-ahead")]
+struct GoAhead {
+    /// token of the announcement of the update
+    #[argh(positional)]
+    token: String,
+
+    /// seconds the go-ahead is valid for
+    #[argh(option, default = "60")]
+    valid_for: i64,
+}
+
+#[derive(FromArgs)]
+/// Check the inactive installation set can be rolled back into, rolling
+/// the device back into it when requested
+#[argh(subcommand, name = "rollback")]
+struct Rollback {
+    /// only check the installation set, which is the default
+    #[argh(switch)]
+    dry_run: bool,
+
+    /// roll the device back once the installation set passes the checks
+    #[argh(switch)]
+    execute: bool,
+}
+
 #[derive(FromArgs)]
 /// Request agent to install a local update package
 #[argh(subcommand, name = "local-install")]
@@ -73,6 +220,15 @@ struct LocalInstall {
     file: PathBuf,
 }
 
+#[derive(FromArgs)]
+/// Upload a package to the agent and request it to be installed
+#[argh(subcommand, name = "upload")]
+struct Upload {
+    /// path to the update package
+    #[argh(positional)]
+    file: PathBuf,
+}
+
 #[derive(FromArgs)]
 /// Request agent to download and install a package from a direct URL
 #[argh(subcommand, name = "remote-install")]
@@ -95,11 +251,412 @@ struct ServerOptions {
     config: PathBuf,
 }
 
+#[derive(FromArgs)]
+/// Privileged installer the agent delegates to once its privileges are
+/// dropped, started by the agent itself
+#[argh(subcommand, name = "installer")]
+struct InstallerOptions {
+    /// increase the verboseness level
+    #[argh(option, short = 'v', from_str_fn(verbosity_level), default = "slog::Level::Info")]
+    verbosity: slog::Level,
+
+    /// configuration file to use (defaults to "/etc/updatehub.conf")
+    #[argh(option, short = 'c', default = "PathBuf::from(\"/etc/updatehub.conf\")")]
+    config: PathBuf,
+}
+
+#[derive(FromArgs)]
+/// Answers the handshake of the running agent, which checks this binary
+/// works before it is replaced by it
+#[argh(subcommand, name = "agent-check")]
+struct AgentCheckOptions {
+    /// nonce sent back to the running agent
+    #[argh(positional)]
+    nonce: String,
+}
+
+#[derive(FromArgs)]
+/// Installs a local update package through the running agent, or by
+/// itself when the agent isn't running
+#[argh(subcommand, name = "install")]
+struct InstallOptions {
+    /// token used to authenticate to the agent
+    #[argh(option)]
+    token: Option<String>,
+
+    /// increase the verboseness level
+    #[argh(option, short = 'v', from_str_fn(verbosity_level), default = "slog::Level::Info")]
+    verbosity: slog::Level,
+
+    /// configuration file to use when the agent isn't running (defaults
+    /// to "/etc/updatehub.conf")
+    #[argh(option, short = 'c', default = "PathBuf::from(\"/etc/updatehub.conf\")")]
+    config: PathBuf,
+
+    /// reboot into the new installation when the agent isn't running
+    #[argh(switch)]
+    reboot: bool,
+
+    /// path to the update package
+    #[argh(positional)]
+    package: PathBuf,
+}
+
+#[derive(FromArgs)]
+/// Shows the state of the running agent and the update it is handling
+#[argh(subcommand, name = "status")]
+struct StatusOptions {
+    /// token used to authenticate to the agent
+    #[argh(option)]
+    token: Option<String>,
+
+    /// print the status as json, as --output json
+    #[argh(switch)]
+    json: bool,
+}
+
+#[derive(FromArgs)]
+/// Requests the running agent to probe the server for an update
+#[argh(subcommand, name = "probe")]
+struct ProbeOptions {
+    /// token used to authenticate to the agent
+    #[argh(option)]
+    token: Option<String>,
+
+    /// server to probe instead of the configured one
+    #[argh(option)]
+    server: Option<String>,
+
+    /// print the response as json, as --output json
+    #[argh(switch)]
+    json: bool,
+}
+
+#[derive(FromArgs)]
+/// Requests the running agent to cancel the update it is handling
+#[argh(subcommand, name = "abort")]
+struct AbortOptions {
+    /// token used to authenticate to the agent
+    #[argh(option)]
+    token: Option<String>,
+
+    /// print the response as json, as --output json
+    #[argh(switch)]
+    json: bool,
+}
+
+#[derive(FromArgs)]
+/// Changes the settings of the running agent
+#[argh(subcommand, name = "config")]
+struct ConfigOptions {
+    #[argh(subcommand)]
+    commands: ConfigCommands,
+}
+
+#[derive(FromArgs)]
+#[argh(subcommand)]
+enum ConfigCommands {
+    Set(ConfigSet),
+    Reload(ConfigReload),
+}
+
+#[derive(FromArgs)]
+/// Changes a setting, which is kept across the agent restarts
+#[argh(subcommand, name = "set")]
+struct ConfigSet {
+    /// token used to authenticate to the agent
+    #[argh(option)]
+    token: Option<String>,
+
+    /// print the response as json, as --output json
+    #[argh(switch)]
+    json: bool,
+
+    /// dotted key of the setting, as polling.interval
+    #[argh(positional)]
+    key: String,
+
+    /// value as written in the configuration file, as json for the
+    /// values other than strings
+    #[argh(positional)]
+    value: String,
+}
+
+#[derive(FromArgs)]
+/// Reloads the configuration file, applying the settings which don't
+/// require the agent to be restarted
+#[argh(subcommand, name = "reload")]
+struct ConfigReload {
+    /// token used to authenticate to the agent
+    #[argh(option)]
+    token: Option<String>,
+
+    /// print the response as json, as --output json
+    #[argh(switch)]
+    json: bool,
+}
+
+#[derive(FromArgs)]
+/// Prints the completion script of a shell, bash, zsh or fish
+#[argh(subcommand, name = "completions")]
+struct CompletionsOptions {
+    /// shell the script is written for
+    #[argh(positional)]
+    shell: Shell,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Shell {
+    Bash,
+    Zsh,
+    Fish,
+}
+
+impl std::str::FromStr for Shell {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "bash" => Ok(Shell::Bash),
+            "zsh" => Ok(Shell::Zsh),
+            "fish" => Ok(Shell::Fish),
+            _ => Err(format!("unsupported shell: {}", s)),
+        }
+    }
+}
+
+/// Subcommands and options completed after each command, which must be
+/// kept in sync with the commands above.
+const COMPLETIONS: &[(&str, &[&str])] = &[
+    (
+        "",
+        &[
+            "client",
+            "server",
+            "pkg",
+            "install",
+            "status",
+            "probe",
+            "abort",
+            "config",
+            "completions",
+            "--output",
+            "--help",
+        ],
+    ),
+    (
+        "client",
+        &[
+            "info",
+            "firmware",
+            "twin",
+            "log",
+            "progress",
+            "probe",
+            "abort-download",
+            "pause-download",
+            "resume-download",
+            "cancel-update",
+            "confirm-update",
+            "confirm-identity",
+            "approve-update",
+            "deny-update",
+            "go-ahead",
+            "dry-run",
+            "rollback",
+            "local-install",
+            "upload",
+            "remote-install",
+            "--token",
+            "--help",
+        ],
+    ),
+    ("client log", &["--level", "--help"]),
+    ("client probe", &["--server", "--help"]),
+    ("client go-ahead", &["--valid-for", "--help"]),
+    ("client rollback", &["--dry-run", "--execute", "--help"]),
+    ("server", &["--verbosity", "--config", "--help"]),
+    ("pkg", &["build", "create", "compress", "delta", "info", "convert", "--help"]),
+    ("pkg build", &["--metadata", "--signature", "--output", "--help"]),
+    ("pkg create", &["--key", "--output", "--help"]),
+    ("pkg compress", &["--profile", "--dry-run", "--help"]),
+    ("pkg delta", &["--method", "--help"]),
+    ("pkg info", &["--key", "--help"]),
+    (
+        "pkg convert",
+        &["--product", "--selection", "--skip-unsupported", "--key", "--output", "--help"],
+    ),
+    ("install", &["--token", "--verbosity", "--config", "--reboot", "--help"]),
+    ("status", &["--token", "--json", "--help"]),
+    ("probe", &["--token", "--server", "--json", "--help"]),
+    ("abort", &["--token", "--json", "--help"]),
+    ("config", &["set", "reload", "--help"]),
+    ("config set", &["--token", "--json", "--help"]),
+    ("config reload", &["--token", "--json", "--help"]),
+    ("completions", &["bash", "zsh", "fish", "--help"]),
+];
+
+#[derive(FromArgs)]
+/// Package builder tooling subcommand
+#[argh(subcommand, name = "pkg")]
+struct PkgOptions {
+    #[argh(subcommand)]
+    commands: PkgCommands,
+}
+
+#[derive(FromArgs)]
+#[argh(subcommand)]
+enum PkgCommands {
+    Build(Build),
+    Create(Create),
+    Compress(Compress),
+    Delta(Delta),
+    Info(PkgInfo),
+    Convert(Convert),
+}
+
+#[derive(FromArgs)]
+/// Creates an update package, which is byte-identical for identical
+/// inputs
+#[argh(subcommand, name = "build")]
+struct Build {
+    /// package metadata file
+    #[argh(option, short = 'm')]
+    metadata: PathBuf,
+
+    /// package signature file
+    #[argh(option, short = 's')]
+    signature: Option<PathBuf>,
+
+    /// where the package is written
+    #[argh(option, short = 'o')]
+    output: PathBuf,
+
+    /// objects included in the package
+    #[argh(positional)]
+    objects: Vec<PathBuf>,
+}
+
+#[derive(FromArgs)]
+/// Creates an update package from a manifest, which is the package
+/// metadata with the objects filename set to their path, relative to
+/// the manifest
+#[argh(subcommand, name = "create")]
+struct Create {
+    /// private key the package is signed with
+    #[argh(option, short = 'k')]
+    key: Option<PathBuf>,
+
+    /// where the package is written
+    #[argh(option, short = 'o')]
+    output: PathBuf,
+
+    /// package manifest file
+    #[argh(positional)]
+    manifest: PathBuf,
+}
+
+#[derive(FromArgs)]
+/// Compresses an object using the filter which suits it best for the
+/// target CPU, writing its metadata alongside it
+#[argh(subcommand, name = "compress")]
+struct Compress {
+    /// CPU power of the target device, low, medium or high (defaults to
+    /// medium)
+    #[argh(option, short = 'p', default = "updatehub::pkg::compression::CpuProfile::Medium")]
+    profile: updatehub::pkg::compression::CpuProfile,
+
+    /// only print the recommended compression
+    #[argh(switch)]
+    dry_run: bool,
+
+    /// object to be compressed
+    #[argh(positional)]
+    object: PathBuf,
+
+    /// where the compressed object is written
+    #[argh(positional)]
+    output: PathBuf,
+}
+
+#[derive(FromArgs)]
+/// Generates the delta between two releases of an object, writing its
+/// metadata alongside it
+#[argh(subcommand, name = "delta")]
+struct Delta {
+    /// method used to generate the delta, zstd or bsdiff (defaults to zstd)
+    #[argh(option, short = 'm', default = "updatehub::pkg::delta::Method::Zstd")]
+    method: updatehub::pkg::delta::Method,
+
+    /// object of the installed release
+    #[argh(positional)]
+    base: PathBuf,
+
+    /// object of the new release
+    #[argh(positional)]
+    target: PathBuf,
+
+    /// where the delta is written
+    #[argh(positional)]
+    output: PathBuf,
+}
+
+#[derive(FromArgs)]
+/// Prints the metadata, objects and signature status of an update
+/// package
+#[argh(subcommand, name = "info")]
+struct PkgInfo {
+    /// public key used to validate the package signature
+    #[argh(option, short = 'k')]
+    key: Option<PathBuf>,
+
+    /// update package to be inspected
+    #[argh(positional)]
+    package: PathBuf,
+}
+
+#[derive(FromArgs)]
+/// Converts an SWUpdate package into an update package, mapping its
+/// entries onto the matching install modes
+#[argh(subcommand, name = "convert")]
+struct Convert {
+    /// product the update package is built for
+    #[argh(option, short = 'p')]
+    product: String,
+
+    /// board or selection to be converted, as a dotted path inside the
+    /// software section (e.g. myboard.stable)
+    #[argh(option, short = 'e')]
+    selection: Option<String>,
+
+    /// leave out the entries without a matching install mode, instead of
+    /// failing
+    #[argh(switch)]
+    skip_unsupported: bool,
+
+    /// private key the package is signed with
+    #[argh(option, short = 'k')]
+    key: Option<PathBuf>,
+
+    /// where the package is written
+    #[argh(option, short = 'o')]
+    output: PathBuf,
+
+    /// SWUpdate package (.swu) to be converted
+    #[argh(positional)]
+    swu: PathBuf,
+}
+
 fn verbosity_level(value: &str) -> Result<slog::Level, String> {
     use std::str::FromStr;
     slog::Level::from_str(value).map_err(|_| format!("failed to parse verbosity level: {}", value))
 }
 
+fn log_level(value: &str) -> Result<sdk::api::log::Level, String> {
+    serde_json::from_value(serde_json::Value::String(value.to_owned()))
+        .map_err(|_| format!("failed to parse log level: {}", value))
+}
+
 async fn server_main(cmd: ServerOptions) -> updatehub::Result<()> {
     updatehub::logger::init(cmd.verbosity);
     info!("starting UpdateHub Agent {}", updatehub::version());
@@ -109,34 +666,539 @@ async fn server_main(cmd: ServerOptions) -> updatehub::Result<()> {
     Ok(())
 }
 
-async fn client_main(cmd: ClientCommands) -> updatehub::Result<()> {
-    let client = sdk::Client::new("localhost:8080");
+fn installer_main(cmd: InstallerOptions) -> updatehub::Result<()> {
+    updatehub::logger::init(cmd.verbosity);
+    info!("starting the privileged installer");
+
+    updatehub::serve_installer(&cmd.config)
+}
+
+fn agent_check_main(cmd: AgentCheckOptions) -> updatehub::Result<()> {
+    println!("{}", updatehub::agent_check_reply(&cmd.nonce));
+    Ok(())
+}
+
+async fn client_main(
+    cmd: ClientCommands,
+    token: Option<String>,
+    output: Format,
+) -> updatehub::Result<()> {
+    let mut client = sdk::Client::new("localhost:8080");
+    if let Some(token) = token {
+        client = client.with_token(&token);
+    }
 
     match cmd {
-        ClientCommands::Info(_) => println!("{:#?}", client.info().await),
-        ClientCommands::Log(_) => println!("{:#?}", client.log().await),
-        ClientCommands::Probe(Probe { server }) => println!("{:#?}", client.probe(server).await),
-        ClientCommands::AbortDownload(_) => println!("{:#?}", client.abort_download().await),
+        ClientCommands::Info(_) => print(output, &client.info().await?),
+        ClientCommands::Firmware(_) => print(output, &client.firmware().await?),
+        ClientCommands::Twin(_) => print(output, &client.twin().await?),
+        ClientCommands::Log(Log { level }) => print(output, &client.log(level).await?),
+        ClientCommands::Progress(_) => print(output, &client.progress().await?),
+        ClientCommands::Probe(Probe { server }) => print(output, &client.probe(server).await?),
+        ClientCommands::AbortDownload(_) => print(output, &client.abort_download().await?),
+        ClientCommands::PauseDownload(_) => print(output, &client.pause_download().await?),
+        ClientCommands::ResumeDownload(_) => print(output, &client.resume_download().await?),
+        ClientCommands::CancelUpdate(_) => print(output, &client.cancel_update().await?),
+        ClientCommands::ConfirmUpdate(_) => print(output, &client.confirm_update().await?),
+        ClientCommands::ConfirmIdentity(_) => print(output, &client.confirm_identity().await?),
+        ClientCommands::ApproveUpdate(_) => print(output, &client.approve_update().await?),
+        ClientCommands::DenyUpdate(_) => print(output, &client.deny_update().await?),
+        ClientCommands::GoAhead(GoAhead { token, valid_for }) => {
+            let expires_at = chrono::Utc::now() + chrono::Duration::seconds(valid_for);
+            print(output, &client.go_ahead(&token, expires_at).await?)
+        }
+        ClientCommands::DryRun(DryRun { package }) => {
+            let request = if package.starts_with("http://") || package.starts_with("https://") {
+                sdk::api::dry_run::Request::Url(package)
+            } else {
+                let file = PathBuf::from(package);
+                let file = if file.is_absolute() {
+                    file
+                } else {
+                    std::env::current_dir().unwrap().join(file)
+                };
+                sdk::api::dry_run::Request::File(file)
+            };
+            print(output, &client.dry_run(&request).await?)
+        }
+        ClientCommands::Rollback(Rollback { dry_run, execute }) => {
+            if dry_run && execute {
+                return Err(std::io::Error::new(
+                    std::io::ErrorKind::InvalidInput,
+                    "--dry-run and --execute can't be used together",
+                )
+                .into());
+            }
+            print(output, &client.rollback(execute).await?)
+        }
         ClientCommands::LocalInstall(LocalInstall { file }) => {
             let file =
                 if file.is_absolute() { file } else { std::env::current_dir().unwrap().join(file) };
-            println!("{:#?}", client.local_install(&file).await)
+            print(output, &client.local_install(&file).await?)
         }
+        ClientCommands::Upload(Upload { file }) => print(output, &client.upload(&file).await?),
         ClientCommands::RemoteInstall(RemoteInstall { url }) => {
-            println!("{:#?}", client.remote_install(&url).await)
+            print(output, &client.remote_install(&url).await?)
+        }
+    }
+
+    Ok(())
+}
+
+async fn install_main(cmd: InstallOptions, output: Format) -> updatehub::Result<()> {
+    let package = if cmd.package.is_absolute() {
+        cmd.package
+    } else {
+        std::env::current_dir().unwrap().join(cmd.package)
+    };
+    let client = agent_client(cmd.token);
+
+    // The running agent installs the package itself, so both don't
+    // handle the device at once.
+    if client.info().await.is_err() {
+        updatehub::logger::init(cmd.verbosity);
+        info!("agent isn't running, installing {:?} by itself", package);
+        return updatehub::install(&cmd.config, &package, cmd.reboot).await;
+    }
+
+    let started = chrono::Utc::now();
+    let state = client.local_install(&package).await?;
+    if state.busy && state.queue_position.is_none() {
+        return Err(updatehub::Error::UpdateFailed(format!(
+            "agent is busy in {} state",
+            state.current_state
+        )));
+    }
+
+    let mut last_progress = None;
+    loop {
+        async_std::task::sleep(std::time::Duration::from_secs(1)).await;
+
+        let progress = client.progress().await?.current;
+        if let Some(progress) = progress.filter(|p| Some(p) != last_progress.as_ref()) {
+            if output == Format::Table {
+                println!(
+                    "{:?} {} ({}/{}): {}%",
+                    progress.stage,
+                    progress.object,
+                    progress.index + 1,
+                    progress.count,
+                    progress.percentage
+                );
+            } else {
+                print(output, &progress);
+            }
+            last_progress = Some(progress);
+        }
+
+        let state = client.info().await?.state;
+        if state == "await_reboot_lock" || state == "await_reboot" || state == "reboot" {
+            if output == Format::Table {
+                println!("{:?} has been installed", package);
+            }
+            return Ok(());
+        }
+        let last_update = client.firmware().await?.last_update;
+        if let Some(result) = last_update.filter(|r| r.time >= started) {
+            return Err(updatehub::Error::UpdateFailed(
+                result.error.unwrap_or_else(|| format!("{:?}", result.outcome)),
+            ));
+        }
+    }
+}
+
+fn agent_client(token: Option<String>) -> sdk::Client {
+    let client = sdk::Client::new("localhost:8080");
+    match token {
+        Some(token) => client.with_token(&token),
+        None => client,
+    }
+}
+
+async fn status_main(cmd: StatusOptions, output: Format) -> updatehub::Result<()> {
+    let client = agent_client(cmd.token);
+    let info = client.info().await?;
+    let progress = client.progress().await?.current;
+
+    let output = if cmd.json { Format::Json } else { output };
+    if output != Format::Table {
+        let status = serde_json::json!({
+            "state": info.state,
+            "version": info.version,
+            "progress": progress,
+            "last_update": info.runtime_settings.update.last_result,
+        });
+        print(output, &status);
+        return Ok(());
+    }
+
+    println!("state: {}", info.state);
+    println!("version: {}", info.version);
+    if let Some(progress) = progress {
+        println!(
+            "progress: {:?} {} ({}/{}): {}%",
+            progress.stage,
+            progress.object,
+            progress.index + 1,
+            progress.count,
+            progress.percentage
+        );
+    }
+    if let Some(result) = info.runtime_settings.update.last_result {
+        println!("last update: {:?} at {}", result.outcome, result.time.to_rfc3339());
+        if let Some(error) = result.error {
+            println!("last update error: {}", error);
+        }
+    }
+    Ok(())
+}
+
+async fn probe_main(cmd: ProbeOptions, output: Format) -> updatehub::Result<()> {
+    let response = agent_client(cmd.token).probe(cmd.server).await?;
+    let output = if cmd.json { Format::Json } else { output };
+    if output != Format::Table {
+        print(output, &response);
+    } else if response.update_available {
+        println!("update available");
+    } else {
+        match response.try_again_in {
+            Some(secs) => println!("no update available, try again in {} seconds", secs),
+            None => println!("no update available"),
+        }
+    }
+    Ok(())
+}
+
+async fn abort_main(cmd: AbortOptions, output: Format) -> updatehub::Result<()> {
+    let response = agent_client(cmd.token).cancel_update().await?;
+    let output = if cmd.json { Format::Json } else { output };
+    if output != Format::Table {
+        print(output, &response);
+    } else {
+        println!("{}", response.message);
+    }
+    Ok(())
+}
+
+async fn config_main(cmd: ConfigCommands, output: Format) -> updatehub::Result<()> {
+    match cmd {
+        ConfigCommands::Set(cmd) => {
+            let response = agent_client(cmd.token).set_config(&cmd.key, &cmd.value).await?;
+            let output = if cmd.json { Format::Json } else { output };
+            if output != Format::Table {
+                print(output, &response);
+            } else {
+                println!("{}", response.message);
+            }
+        }
+        ConfigCommands::Reload(cmd) => {
+            let response = agent_client(cmd.token).reload_config().await?;
+            let output = if cmd.json { Format::Json } else { output };
+            if output != Format::Table {
+                print(output, &response);
+            } else {
+                println!("applied: {}", response.applied.join(", "));
+                println!("restart required: {}", response.restart_required.join(", "));
+            }
+        }
+    }
+    Ok(())
+}
+
+fn pkg_main(cmd: PkgCommands, format: Format) -> updatehub::Result<()> {
+    updatehub::logger::init(slog::Level::Info);
+
+    match cmd {
+        PkgCommands::Build(Build { metadata, signature, output, objects }) => {
+            let mut builder = updatehub::pkg::package::Builder::new(std::fs::read(metadata)?);
+            if let Some(signature) = signature {
+                builder = builder.signature(std::fs::read(signature)?);
+            }
+            for object in objects {
+                builder = builder.object(&object)?;
+            }
+            builder.write(&output)?;
+        }
+        PkgCommands::Create(Create { key, output, manifest }) => {
+            updatehub::pkg::manifest::create(&manifest, key.as_deref(), &output)?;
+        }
+        PkgCommands::Compress(Compress { profile, dry_run, object, output }) => {
+            let advice = updatehub::pkg::compression::analyze(&object, profile)?;
+            if dry_run {
+                print(format, &advice);
+            } else {
+                print(format, &updatehub::pkg::compression::compress(&object, &advice, &output)?);
+            }
+        }
+        PkgCommands::Delta(Delta { method, base, target, output }) => {
+            print(format, &updatehub::pkg::delta::generate(method, &base, &target, &output)?)
+        }
+        PkgCommands::Info(PkgInfo { key, package }) => {
+            print(format, &updatehub::pkg::info::inspect(&package, key.as_deref())?)
+        }
+        PkgCommands::Convert(Convert {
+            product,
+            selection,
+            skip_unsupported,
+            key,
+            output,
+            swu,
+        }) => {
+            let options =
+                updatehub::pkg::swupdate::Options { product, selection, skip_unsupported };
+            print(
+                format,
+                &updatehub::pkg::swupdate::convert(&swu, &options, key.as_deref(), &output)?,
+            )
         }
     }
 
     Ok(())
 }
 
+fn completions_main(cmd: CompletionsOptions) -> updatehub::Result<()> {
+    match cmd.shell {
+        Shell::Bash => print!("{}", bash_completion()),
+        // The bash completion is reused through the zsh emulation of it.
+        Shell::Zsh => print!(
+            "#compdef updatehub\n\nautoload -U +X bashcompinit && bashcompinit\n\n{}",
+            bash_completion()
+        ),
+        Shell::Fish => print!("{}", fish_completion()),
+    }
+    Ok(())
+}
+
+/// Prints the `value` in the `format`, so the scripts don't have to
+/// scrape the text meant for humans.
+fn print<T: Serialize>(format: Format, value: &T) {
+    let value = serde_json::to_value(value).unwrap_or_default();
+    match format {
+        Format::Json => println!("{}", value),
+        Format::Yaml => print!("{}", yaml(&value, 0)),
+        Format::Table => print!("{}", table(&value)),
+    }
+}
+
+/// Renders the `value` as aligned columns: a row per item for lists of
+/// objects, or else a row per field, with the nested ones named after
+/// their dotted path.
+fn table(value: &Value) -> String {
+    let rows = match value {
+        Value::Array(items) if !items.is_empty() && items.iter().all(Value::is_object) => {
+            let items = items.iter().map(|item| flatten("", item)).collect::<Vec<_>>();
+            let mut columns = Vec::new();
+            for (key, _) in items.iter().flatten() {
+                if !columns.contains(key) {
+                    columns.push(key.clone());
+                }
+            }
+
+            let mut rows = vec![columns.iter().map(|c| c.to_uppercase()).collect::<Vec<_>>()];
+            rows.extend(items.iter().map(|item| {
+                columns
+                    .iter()
+                    .map(|c| {
+                        item.iter()
+                            .find(|(k, _)| k == c)
+                            .map(|(_, v)| v.clone())
+                            .unwrap_or_default()
+                    })
+                    .collect()
+            }));
+            rows
+        }
+        value => flatten("", value)
+            .into_iter()
+            .map(|(key, value)| if key.is_empty() { vec![value] } else { vec![key, value] })
+            .collect(),
+    };
+
+    let mut widths = Vec::new();
+    for row in &rows {
+        for (i, cell) in row.iter().enumerate() {
+            if widths.len() <= i {
+                widths.push(0);
+            }
+            widths[i] = widths[i].max(cell.chars().count());
+        }
+    }
+    rows.iter()
+        .map(|row| {
+            let line = row
+                .iter()
+                .zip(&widths)
+                .map(|(cell, width)| format!("{:width$}", cell, width = width))
+                .collect::<Vec<_>>()
+                .join("  ");
+            format!("{}\n", line.trim_end())
+        })
+        .collect()
+}
+
+/// Renders the `value` as a YAML block, indented by `indent` spaces.
+fn yaml(value: &Value, indent: usize) -> String {
+    let pad = " ".repeat(indent);
+    match value {
+        Value::Object(map) if !map.is_empty() => map
+            .iter()
+            .map(|(key, value)| match value {
+                Value::Object(m) if !m.is_empty() => {
+                    format!("{}{}:\n{}", pad, yaml_scalar(key), yaml(value, indent + 2))
+                }
+                Value::Array(a) if !a.is_empty() => {
+                    format!("{}{}:\n{}", pad, yaml_scalar(key), yaml(value, indent + 2))
+                }
+                value => format!("{}{}: {}", pad, yaml_scalar(key), yaml(value, 0)),
+            })
+            .collect(),
+        Value::Array(items) if !items.is_empty() => items
+            .iter()
+            .map(|item| {
+                // The item is rendered nested, and its first line takes the
+                // dash in place of the indentation.
+                let item = yaml(item, indent + 2);
+                format!("{}- {}", pad, item.trim_start())
+            })
+            .collect(),
+        Value::Object(_) => format!("{}{{}}\n", pad),
+        Value::Array(_) => format!("{}[]\n", pad),
+        Value::String(s) => format!("{}{}\n", pad, yaml_scalar(s)),
+        value => format!("{}{}\n", pad, value),
+    }
+}
+
+// Strings are left unquoted unless they would be read as something else,
+// in which case they are quoted as json, which YAML reads the same way.
+fn yaml_scalar(s: &str) -> String {
+    let plain = s.starts_with(|c: char| c.is_ascii_alphabetic() || c == '/')
+        && !s.ends_with(' ')
+        && s.chars().all(|c| c.is_ascii_alphanumeric() || " _-./@".contains(c))
+        && !["true", "false", "null", "yes", "no", "on", "off", "y", "n"]
+            .contains(&s.to_lowercase().as_str());
+    if plain {
+        s.to_owned()
+    } else {
+        Value::String(s.to_owned()).to_string()
+    }
+}
+
+fn flatten(prefix: &str, value: &Value) -> Vec<(String, String)> {
+    let key = |name: String| if prefix.is_empty() { name } else { format!("{}.{}", prefix, name) };
+    match value {
+        Value::Object(map) => {
+            map.iter().flat_map(|(name, value)| flatten(&key(name.clone()), value)).collect()
+        }
+        Value::Array(items) => items
+            .iter()
+            .enumerate()
+            .flat_map(|(i, value)| flatten(&key(i.to_string()), value))
+            .collect(),
+        Value::Null => vec![(prefix.to_owned(), String::new())],
+        Value::String(s) => vec![(prefix.to_owned(), s.clone())],
+        value => vec![(prefix.to_owned(), value.to_string())],
+    }
+}
+
+// Words after which the command goes down to a subcommand, as
+// `"client/info"`.
+fn subcommand_patterns() -> Vec<String> {
+    COMPLETIONS
+        .iter()
+        .flat_map(|(path, words)| {
+            words.iter().filter(|w| !w.starts_with('-')).map(move |w| format!("\"{}/{}\"", path, w))
+        })
+        .collect()
+}
+
+fn bash_completion() -> String {
+    let cases = COMPLETIONS
+        .iter()
+        .map(|(path, words)| format!("        \"{}\") words=\"{}\" ;;\n", path, words.join(" ")))
+        .collect::<String>();
+
+    format!(
+        r#"_updatehub() {{
+    local cur="${{COMP_WORDS[COMP_CWORD]}}" prev="${{COMP_WORDS[COMP_CWORD-1]}}"
+    local path="" words i
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        case "$path/${{COMP_WORDS[i]}}" in
+            {patterns}) path="${{path:+$path }}${{COMP_WORDS[i]}}" ;;
+        esac
+    done
+
+    if [ -z "$path" ] && [ "$prev" = "--output" ]; then
+        COMPREPLY=($(compgen -W "json yaml table" -- "$cur"))
+        return
+    fi
+    case "$path" in
+{cases}        *) words="--help" ;;
+    esac
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}}
+complete -o default -F _updatehub updatehub
+"#,
+        patterns = subcommand_patterns().join("|"),
+        cases = cases
+    )
+}
+
+fn fish_completion() -> String {
+    let mut script = format!(
+        r#"function __updatehub_path
+    set -l words (commandline -opc)
+    set -e words[1]
+    set -l path ""
+    for word in $words
+        switch "$path/$word"
+            case {patterns}
+                set path (string trim -- "$path $word")
+        end
+    end
+    test "$path" = "$argv[1]"
+end
+
+complete -c updatehub -n '__updatehub_path ""' -l output -x -a "json yaml table"
+"#,
+        patterns = subcommand_patterns().join(" ")
+    );
+    for (path, words) in COMPLETIONS {
+        for word in words.iter() {
+            // Completed with its values above.
+            if path.is_empty() && *word == "--output" {
+                continue;
+            }
+            let word = if word.starts_with("--") {
+                format!("-l {}", &word[2..])
+            } else {
+                format!("-a {}", word)
+            };
+            script.push_str(&format!(
+                "complete -c updatehub -n '__updatehub_path \"{}\"' {}\n",
+                path, word
+            ));
+        }
+    }
+    script
+}
+
 #[actix_rt::main]
 async fn main() {
     let cmd: TopLevel = argh::from_env();
 
+    let output = cmd.output;
     let res = match cmd.entry_point {
-        EntryPoints::Client(client) => client_main(client.commands).await,
+        EntryPoints::Client(client) => client_main(client.commands, client.token, output).await,
         EntryPoints::Server(cmd) => server_main(cmd).await,
+        EntryPoints::Installer(cmd) => installer_main(cmd),
+        EntryPoints::AgentCheck(cmd) => agent_check_main(cmd),
+        EntryPoints::Pkg(pkg) => pkg_main(pkg.commands, output),
+        EntryPoints::Install(cmd) => install_main(cmd, output).await,
+        EntryPoints::Status(cmd) => status_main(cmd, output).await,
+        EntryPoints::Probe(cmd) => probe_main(cmd, output).await,
+        EntryPoints::Abort(cmd) => abort_main(cmd, output).await,
+        EntryPoints::Config(config) => config_main(config.commands, output).await,
+        EntryPoints::Completions(cmd) => completions_main(cmd),
     };
 
     if let Err(e) = res {
@@ -144,3 +1206,65 @@ async fn main() {
         std::process::exit(1);
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn render_table() {
+        let status =
+            json!({ "state": "idle", "progress": null, "last_update": { "outcome": "success" } });
+        assert_eq!(
+            table(&status),
+            "last_update.outcome  success\nprogress\nstate                idle\n"
+        );
+
+        let entries = json!([
+            { "level": "info", "message": "probing" },
+            { "level": "error", "message": "failed", "data": { "code": 1 } }
+        ]);
+        assert_eq!(
+            table(&entries),
+            "LEVEL  MESSAGE  DATA.CODE\ninfo   probing\nerror  failed   1\n"
+        );
+    }
+
+    #[test]
+    fn render_yaml() {
+        let status = json!({
+            "state": "idle",
+            "progress": null,
+            "version": "1.0",
+            "objects": [{ "mode": "copy", "size": 10 }, { "mode": "raw", "size": 20 }],
+            "channels": ["stable", "true"],
+            "hooks": {}
+        });
+        assert_eq!(
+            yaml(&status, 0),
+            "channels:\n  - stable\n  - \"true\"\nhooks: {}\nobjects:\n  - mode: copy\n    size: 10\n  \
+             - mode: raw\n    size: 20\nprogress: null\nstate: idle\nversion: \"1.0\"\n"
+        );
+        assert_eq!(yaml(&json!("idle"), 0), "idle\n");
+    }
+
+    #[test]
+    fn reachable_completions() {
+        for (path, _) in COMPLETIONS.iter().filter(|(path, _)| !path.is_empty()) {
+            let (parent, name) = match path.rfind(' ') {
+                Some(i) => (&path[..i], &path[i + 1..]),
+                None => ("", *path),
+            };
+            assert!(
+                COMPLETIONS.iter().any(|(p, words)| *p == parent && words.contains(&name)),
+                "{} isn't completed",
+                path
+            );
+        }
+        assert!(bash_completion().contains("\"client/info\""));
+        assert!(fish_completion()
+            .contains("complete -c updatehub -n '__updatehub_path \"pkg\"' -a info"));
+    }
+}
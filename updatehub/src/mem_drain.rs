@@ -5,20 +5,27 @@
 use serde::Serialize;
 use slog::{Drain, Key, OwnedKVList, Record, KV};
 use std::{
-    collections::HashMap,
+    collections::{HashMap, VecDeque},
     fmt::{self, Write},
     io,
     sync::Mutex,
 };
 
+/// Number of entries kept in the log history.
+const HISTORY_SIZE: usize = 500;
+
 #[derive(Debug, Default)]
 pub struct MemDrain {
     records: Mutex<Vec<LogRecord>>,
     logging: bool,
+    /// Last entries logged by the agent, kept across the update cycles.
+    history: Mutex<VecDeque<LogRecord>>,
 }
 
-#[derive(Debug, Serialize)]
-struct LogRecord {
+#[derive(Clone, Debug, Serialize)]
+pub struct LogRecord {
+    #[serde(skip)]
+    severity: slog::Level,
     level: String,
     message: String,
     time: String,
@@ -34,6 +41,29 @@ impl MemDrain {
     pub fn stop_logging(&mut self) {
         self.logging = false;
     }
+
+    /// Entries of the log history which are at least as severe as
+    /// `level`, from the oldest to the newest.
+    pub fn history(&self, level: slog::Level) -> Vec<LogRecord> {
+        self.history
+            .lock()
+            .unwrap()
+            .iter()
+            .filter(|r| r.severity.is_at_least(level))
+            .cloned()
+            .collect()
+    }
+}
+
+pub(crate) fn level_name(level: slog::Level) -> &'static str {
+    match level {
+        slog::Level::Critical => "critical",
+        slog::Level::Error => "error",
+        slog::Level::Warning => "warning",
+        slog::Level::Info => "info",
+        slog::Level::Debug => "debug",
+        slog::Level::Trace => "trace",
+    }
 }
 
 impl Serialize for MemDrain {
@@ -67,27 +97,34 @@ impl Drain for MemDrain {
     type Ok = ();
 
     fn log(&self, record: &Record, kvs: &OwnedKVList) -> io::Result<()> {
+        let mut kv = KVSerializer::default();
+        record.kv().serialize(record, &mut kv)?;
+        kvs.serialize(record, &mut kv)?;
+
+        let l = LogRecord {
+            severity: record.level(),
+            level: level_name(record.level()).to_owned(),
+            message: fmt::format(*record.msg()),
+            time: chrono::Local::now().format("%F %H:%M:%S%.9f %z").to_string(),
+            data: kv.0,
+        };
+
         if self.logging {
-            let mut kv = KVSerializer::default();
-            record.kv().serialize(record, &mut kv)?;
-            kvs.serialize(record, &mut kv)?;
-
-            let l = LogRecord {
-                level: record.level().as_str().to_lowercase(),
-                message: fmt::format(*record.msg()),
-                time: chrono::Local::now().format("%F %H:%M:%S%.9f %z").to_string(),
-                data: kv.0,
-            };
-
-            self.records.lock().unwrap().push(l);
+            self.records.lock().unwrap().push(l.clone());
         }
 
+        let mut history = self.history.lock().unwrap();
+        if history.len() == HISTORY_SIZE {
+            history.pop_front();
+        }
+        history.push_back(l);
+
         Ok(())
     }
 }
 
 #[derive(Default)]
-struct KVSerializer(HashMap<String, String>);
+pub(crate) struct KVSerializer(pub(crate) HashMap<String, String>);
 
 impl slog::ser::Serializer for KVSerializer {
     fn emit_arguments(&mut self, key: Key, val: &fmt::Arguments) -> slog::Result {
@@ -100,7 +137,7 @@ impl slog::ser::Serializer for KVSerializer {
 #[cfg(test)]
 mod tests {
     use super::*;
-    use slog::{o, slog_debug, slog_error, slog_info, Logger};
+    use slog::{o, slog_debug, slog_error, slog_info, slog_warn, Logger};
     use std::sync::Arc;
 
     fn eq_without_time(s1: &str, s2: &str) -> bool {
@@ -204,4 +241,28 @@ mod tests {
             format!("Expected:\n{}\n\nResult:\n{}", expected, result)
         );
     }
+
+    #[test]
+    fn history() {
+        let drain = Arc::new(Mutex::new(MemDrain::default()));
+        let log = Logger::root(drain.clone().fuse(), o!());
+        slog_debug!(log, "debug");
+        slog_warn!(log, "warning");
+        slog_error!(log, "error");
+
+        // The history is kept even when not logging the update cycle.
+        let messages = |level| {
+            drain.lock().unwrap().history(level).into_iter().map(|r| r.message).collect::<Vec<_>>()
+        };
+        assert_eq!(messages(slog::Level::Trace), ["debug", "warning", "error"]);
+        assert_eq!(messages(slog::Level::Warning), ["warning", "error"]);
+        assert!(drain.lock().unwrap().to_string().is_empty());
+
+        for i in 0..HISTORY_SIZE {
+            slog_info!(log, "{}", i);
+        }
+        let history = drain.lock().unwrap().history(slog::Level::Trace);
+        assert_eq!(history.len(), HISTORY_SIZE);
+        assert_eq!(history[0].message, "0");
+    }
 }
@@ -0,0 +1,221 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::utils;
+use actix_web::{web, HttpResponse};
+use async_std::{io::Read, stream::Stream};
+use slog_scope::{debug, info, warn};
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    pin::Pin,
+    process::{Child, Command, Stdio},
+    task::{Context, Poll},
+};
+
+const SERVICE_TYPE: &str = "_updatehub-mirror._tcp";
+// Directory, inside the download directory, the objects are downloaded
+// to from the mirrors.
+const MIRROR_DIR: &str = "mirror";
+
+/// Serves the downloaded objects to the other devices of the LAN, using
+/// the same routes of the server, so they can be fetched by peers
+/// instead of hitting the upstream server.
+pub(crate) struct Mirror(PathBuf);
+
+impl Mirror {
+    pub(crate) fn configure(cfg: &mut web::ServiceConfig, download_dir: PathBuf) {
+        cfg.data(Self(download_dir)).route(
+            "/products/{product_uid}/packages/{package_uid}/objects/{object}",
+            web::get().to(Mirror::object),
+        );
+    }
+
+    async fn object(
+        mirror: web::Data<Mirror>,
+        path: web::Path<(String, String, String)>,
+    ) -> HttpResponse {
+        let object = &path.2;
+
+        // Only sha256sums are served, so no path can escape the download
+        // directory.
+        if object.len() != 64 || !object.chars().all(|c| c.is_ascii_hexdigit()) {
+            return HttpResponse::BadRequest().finish();
+        }
+
+        match fs::File::open(mirror.0.join(object)) {
+            Ok(file) => {
+                debug!("serving object {} to peer", object);
+                HttpResponse::Ok().streaming(ObjectStream::new(file))
+            }
+            Err(_) => HttpResponse::NotFound().finish(),
+        }
+    }
+}
+
+/// Streams a file as it is read, without blocking the server while
+/// reading it.
+pub(crate) struct ObjectStream {
+    file: async_std::fs::File,
+    buf: Vec<u8>,
+}
+
+impl ObjectStream {
+    pub(crate) fn new(file: fs::File) -> Self {
+        ObjectStream { file: file.into(), buf: vec![0; 64 * 1024] }
+    }
+}
+
+impl Stream for ObjectStream {
+    type Item = Result<web::Bytes, actix_web::Error>;
+
+    fn poll_next(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Option<Self::Item>> {
+        let ObjectStream { file, buf } = &mut *self;
+        match Pin::new(file).poll_read(cx, buf) {
+            Poll::Pending => Poll::Pending,
+            Poll::Ready(Ok(0)) => Poll::Ready(None),
+            Poll::Ready(Ok(len)) => Poll::Ready(Some(Ok(web::Bytes::copy_from_slice(&buf[..len])))),
+            Poll::Ready(Err(e)) => Poll::Ready(Some(Err(e.into()))),
+        }
+    }
+}
+
+/// Advertises the mirror on the LAN, using Avahi, for as long as it is
+/// held.
+pub(crate) struct Advertiser(Child);
+
+impl Advertiser {
+    pub(crate) fn start(port: u16) -> utils::Result<Self> {
+        utils::fs::is_executable_in_path("avahi-publish-service")?;
+
+        let mut hostname = [0u8; 64];
+        let hostname = nix::unistd::gethostname(&mut hostname)?.to_string_lossy().into_owned();
+        info!("advertising objects mirror on port {}", port);
+        let child = Command::new("avahi-publish-service")
+            .args(&[&format!("updatehub-{}", hostname), SERVICE_TYPE, &port.to_string()])
+            .stdout(Stdio::null())
+            .spawn()?;
+
+        Ok(Advertiser(child))
+    }
+}
+
+impl Drop for Advertiser {
+    fn drop(&mut self) {
+        let _ = self.0.kill();
+        let _ = self.0.wait();
+    }
+}
+
+/// Looks for mirrors advertised on the LAN, returning their addresses.
+pub(crate) fn discover() -> Vec<String> {
+    match easy_process::run(&format!(
+        "avahi-browse --resolve --parsable --terminate {}",
+        SERVICE_TYPE
+    )) {
+        Ok(output) => parse_browse_output(&output.stdout),
+        Err(e) => {
+            warn!("failed to discover mirrors: {}", e);
+            Vec::default()
+        }
+    }
+}
+
+// The resolved services are reported on lines as:
+// =;eth0;IPv4;updatehub-device;_updatehub-mirror._tcp;local;device.local;192.
+// 168.1.2;8081;
+// The IPv6 link-local addresses are skipped, as they can't be used
+// without the interface being part of the URL.
+fn parse_browse_output(output: &str) -> Vec<String> {
+    let mut mirrors: Vec<String> = output
+        .lines()
+        .map(|l| l.split(';').collect::<Vec<_>>())
+        .filter(|f| f.len() >= 9 && f[0] == "=")
+        .filter_map(|f| match f[2] {
+            "IPv4" => Some(format!("http://{}:{}", f[7], f[8])),
+            "IPv6" if !f[7].to_ascii_lowercase().starts_with("fe80:") => {
+                Some(format!("http://[{}]:{}", f[7], f[8]))
+            }
+            _ => None,
+        })
+        .collect();
+    mirrors.dedup();
+    mirrors
+}
+
+/// Tries to download the `object` from the mirrors, which is only kept
+/// if its content matches the sha256sum. The object is downloaded aside
+/// of the download directory, so a partial download from the server is
+/// kept to be resumed if no mirror has the object.
+pub(crate) async fn download_object(
+    mirrors: &[String],
+    product_uid: &str,
+    package_uid: &str,
+    download_dir: &Path,
+    object: &str,
+) -> bool {
+    let mirror_dir = download_dir.join(MIRROR_DIR);
+    let file = mirror_dir.join(object);
+    for mirror in mirrors {
+        let downloaded = match crate::CloudClient::new(mirror)
+            .download_object(product_uid, package_uid, &mirror_dir, object)
+            .await
+        {
+            Ok(cloud::api::ObjectDownload::Verified) => true,
+            Ok(cloud::api::ObjectDownload::Full)
+                if utils::sha256sum_file(&file).map(|s| s == object).unwrap_or(false) =>
+            {
+                true
+            }
+            Ok(_) => {
+                warn!("object {} from mirror {} does not match, ignoring it", object, mirror);
+                false
+            }
+            Err(e) => {
+                debug!("unable to download object {} from mirror {}: {}", object, mirror, e);
+                false
+            }
+        };
+
+        if downloaded {
+            match fs::rename(&file, download_dir.join(object)) {
+                Ok(()) => {
+                    info!("object {} downloaded from mirror {}", object, mirror);
+                    let _ = fs::remove_file(download_dir.join(format!("{}.etag", object)));
+                    let _ = fs::remove_dir_all(&mirror_dir);
+                    return true;
+                }
+                Err(e) => warn!("failed to move object {} from mirror: {}", object, e),
+            }
+        }
+
+        let _ = fs::remove_dir_all(&mirror_dir);
+    }
+
+    false
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn parse_resolved_services() {
+        let output = "+;eth0;IPv4;updatehub-a;_updatehub-mirror._tcp;local\n\
+                      =;eth0;IPv4;updatehub-a;_updatehub-mirror._tcp;local;a.local;192.168.1.2;8081;\n\
+                      =;eth0;IPv6;updatehub-a;_updatehub-mirror._tcp;local;a.local;fe80::1;8081;\n\
+                      =;wlan0;IPv4;updatehub-b;_updatehub-mirror._tcp;local;b.local;192.168.1.3;8081;\n\
+                      =;wlan0;IPv6;updatehub-c;_updatehub-mirror._tcp;local;c.local;2001:db8::3;8081;\n";
+
+        assert_eq!(
+            parse_browse_output(output),
+            vec![
+                "http://192.168.1.2:8081".to_string(),
+                "http://192.168.1.3:8081".to_string(),
+                "http://[2001:db8::3]:8081".to_string()
+            ]
+        );
+    }
+}
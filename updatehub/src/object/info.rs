@@ -4,13 +4,8 @@
 
 use super::Result;
 use crate::utils;
-use openssl::sha::Sha256;
 use pkg_schema::{objects, Object};
-use std::{
-    fs::File,
-    io::{BufReader, Read},
-    path::Path,
-};
+use std::path::Path;
 
 #[derive(PartialEq, Debug)]
 pub(crate) enum Status {
@@ -23,12 +18,18 @@ pub(crate) enum Status {
 impl_compressed_object_info!(objects::Copy);
 impl_compressed_object_info!(objects::Raw);
 impl_compressed_object_info!(objects::Ubifs);
+impl_object_info!(objects::Agent);
+impl_object_info!(objects::DiskImage);
 impl_object_info!(objects::Flash);
+impl_object_info!(objects::Fpga);
 impl_object_info!(objects::Imxkobs);
+impl_object_info!(objects::Script);
 impl_object_info!(objects::Tarball);
 impl_object_info!(objects::Test);
 
-impl_object_for_object_types!(Copy, Flash, Imxkobs, Tarball, Ubifs, Raw, Test);
+impl_object_for_object_types!(
+    Agent, Copy, DiskImage, Flash, Fpga, Imxkobs, Tarball, Ubifs, Raw, Script, Test
+);
 
 pub(crate) trait Info {
     fn status(&self, download_dir: &Path) -> Result<Status> {
@@ -42,25 +43,23 @@ pub(crate) trait Info {
             return Ok(Status::Incomplete);
         }
 
-        let mut buf = [0; 1024];
-        let mut reader = BufReader::new(File::open(object)?);
-        let mut hasher = Sha256::new();
-        loop {
-            let len = reader.read(&mut buf)?;
-            hasher.update(&buf[..len]);
-
-            if len == 0 {
-                break;
-            }
-        }
-
-        if utils::hex_encode(&hasher.finish()) != self.sha256sum() {
+        if !utils::verification::verify(&object, self.sha256sum())? {
             return Ok(Status::Corrupted);
         }
 
         Ok(Status::Ready)
     }
 
+    /// Whether the object has been completely downloaded. Its content
+    /// isn't hashed, as it is verified while downloaded.
+    fn is_downloaded(&self, download_dir: &Path) -> bool {
+        download_dir
+            .join(self.sha256sum())
+            .metadata()
+            .map(|m| m.len() >= self.len())
+            .unwrap_or(false)
+    }
+
     fn filename(&self) -> &str;
     fn len(&self) -> u64;
     fn sha256sum(&self) -> &str;
@@ -0,0 +1,21 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use crate::{
+    object::{Info, Installer},
+    utils,
+};
+use pkg_schema::objects;
+use slog_scope::info;
+use std::path::Path;
+
+impl Installer for objects::Agent {
+    fn install(&self, download_dir: &Path) -> Result<()> {
+        info!("'agent' handler Install {} ({})", self.filename, self.sha256sum);
+
+        utils::agent_update::replace(&download_dir.join(self.sha256sum()))?;
+        Ok(())
+    }
+}
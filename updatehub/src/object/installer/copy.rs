@@ -7,6 +7,7 @@ use crate::{
     object::{Info, Installer},
     utils::{self, definitions::TargetTypeExt},
 };
+use nix::fcntl::OFlag;
 use pkg_schema::{definitions, objects};
 use slog_scope::info;
 use std::{
@@ -20,12 +21,39 @@ impl Installer for objects::Copy {
     fn check_requirements(&self) -> Result<()> {
         info!("'copy' handle checking requirements");
 
-        if let definitions::TargetType::Device(dev) = self.target_type.valid()? {
-            utils::fs::ensure_disk_space(&dev, self.required_install_size())?;
-            return Ok(());
+        if self.read_only.is_some() && self.target_format.should_format {
+            return Err(Error::ReadOnlyFormat(self.filename.clone()));
         }
 
-        Err(Error::InvalidTargetType(self.target_type.clone()))
+        match self.target_type.valid()? {
+            definitions::TargetType::Device(_) | definitions::TargetType::LVMVolume(_) => {
+                utils::fs::ensure_disk_space(
+                    &self.target_type.get_target()?,
+                    self.required_install_size(),
+                )?;
+                Ok(())
+            }
+            _ => Err(Error::InvalidTargetType(self.target_type.clone())),
+        }
+    }
+
+    fn verify(&self, download_dir: &Path) -> Result<()> {
+        let source = download_dir.join(self.sha256sum());
+        let (sha256sum, _) =
+            super::written_content(&source, self.sha256sum(), self.size, self.compressed)?;
+        let device = self.target_type.get_target()?;
+        let target_path = self.target_path.strip_prefix("/").unwrap_or(&self.target_path);
+
+        utils::read_only::read_map(
+            &device,
+            self.filesystem,
+            &self.mount_options,
+            self.read_only,
+            |path| {
+                let dest = path.join(&target_path);
+                super::check_read_back(&dest, &sha256sum, &utils::sha256sum_file(&dest)?)
+            },
+        )?
     }
 
     fn install(&self, download_dir: &Path) -> Result<()> {
@@ -34,6 +62,7 @@ impl Installer for objects::Copy {
         let device = self.target_type.get_target()?;
         let filesystem = self.filesystem;
         let mount_options = &self.mount_options;
+        let read_only = self.read_only;
         let format_options = &self.target_format.format_options;
         let chunk_size = definitions::ChunkSize::default().0;
         let sha256sum = self.sha256sum();
@@ -41,7 +70,7 @@ impl Installer for objects::Copy {
         let source = download_dir.join(sha256sum);
 
         handle_install_if_different!(self.install_if_different, sha256sum, {
-            utils::fs::mount_map(&device, filesystem, mount_options, |path| {
+            utils::read_only::read_map(&device, filesystem, mount_options, read_only, |path| {
                 fs::File::open(&path.join(&target_path)).map_err(Error::from)
             })
             .map_err(Error::from)
@@ -52,18 +81,20 @@ impl Installer for objects::Copy {
             utils::fs::format(&device, filesystem, &format_options)?;
         }
 
-        utils::fs::mount_map(&device, filesystem, mount_options, |path| {
+        // Created when the object is written aside of a read-only target.
+        let dir = target_path.parent().unwrap_or_else(|| Path::new(""));
+        utils::read_only::write_map(&device, filesystem, mount_options, read_only, dir, |path| {
             let dest = path.join(&target_path);
-            let mut input = utils::io::timed_buf_reader(chunk_size, fs::File::open(source)?);
-            let mut output = utils::io::timed_buf_writer(
-                chunk_size,
-                fs::OpenOptions::new()
-                    .read(true)
-                    .write(true)
-                    .create(true)
-                    .truncate(true)
-                    .open(&dest)?,
-            );
+            let mut input = utils::io::timed_buf_reader(chunk_size, fs::File::open(&source)?);
+            // The differential writes compare the content with the one
+            // of the file, which is then kept.
+            let flags = if self.differential {
+                OFlag::O_RDWR | OFlag::O_CREAT
+            } else {
+                OFlag::O_RDWR | OFlag::O_CREAT | OFlag::O_TRUNC
+            };
+            let output = utils::fs::open_beneath(path, target_path, flags)?;
+            utils::fs::preallocate(&output, self.required_install_size())?;
 
             // File's access mode is changed here as we might not have write permission over
             // it. It will be restored or overwritten later on by the target_mode parameter
@@ -71,12 +102,16 @@ impl Installer for objects::Copy {
             let orig_mode = metadata.permissions().mode();
             metadata.permissions().set_mode(0o100_666);
 
-            if self.compressed {
-                compress_tools::uncompress_data(&mut input, &mut output)?;
+            if self.differential {
+                let mut output = utils::io::DifferentialWriter::new(output);
+                write_content(self.compressed, &source, &mut input, &mut output)?;
+                output.finish()?;
+                let (blocks, rewritten) = output.stats();
+                info!("'copy' handler rewrote {} of {} blocks of {:?}", rewritten, blocks, dest);
             } else {
-                io::copy(&mut input, &mut output)?;
+                let mut output = utils::io::timed_buf_writer(chunk_size, output);
+                write_content(self.compressed, &source, &mut input, &mut output)?;
             }
-            output.flush()?;
             metadata.permissions().set_mode(orig_mode);
 
             if let Some(mode) = self.target_permissions.target_mode {
@@ -96,6 +131,21 @@ impl Installer for objects::Copy {
     }
 }
 
+fn write_content<R: io::Read, W: Write>(
+    compressed: bool,
+    source: &Path,
+    mut input: R,
+    output: &mut W,
+) -> Result<()> {
+    if compressed {
+        utils::archive::uncompress_data(source, &mut input, &mut *output)?;
+    } else {
+        io::copy(&mut input, output)?;
+    }
+    output.flush()?;
+    Ok(())
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -173,6 +223,7 @@ mod tests {
         // Generate base copy object
         let mut obj = objects::Copy {
             filename: "".to_string(),
+            roles: Vec::default(),
             filesystem: definitions::Filesystem::Ext4,
             size: FILE_SIZE as u64,
             sha256sum: source.path().to_string_lossy().to_string(),
@@ -184,6 +235,8 @@ mod tests {
             required_uncompressed_size: 0,
             target_format: definitions::TargetFormat::default(),
             mount_options: String::default(),
+            read_only: None,
+            differential: false,
         };
 
         // Change copy object to be used on current test
@@ -266,6 +319,17 @@ mod tests {
         .unwrap();
     }
 
+    #[test]
+    #[ignore]
+    fn copy_differential_over_existing_file() {
+        exec_test_with_copy(
+            |obj| obj.differential = true,
+            Some(definitions::TargetPermissions::default()),
+            false,
+        )
+        .unwrap();
+    }
+
     #[test]
     #[ignore]
     fn copy_change_uid() {
@@ -0,0 +1,164 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use crate::{
+    object::{Info, Installer},
+    utils::{
+        self,
+        definitions::TargetTypeExt,
+        partition_table::{self, PartitionTable},
+    },
+};
+use pkg_schema::objects;
+use slog_scope::info;
+use std::{fs::File, ops::Range, path::Path};
+
+// Regions of the disk kept as they are, checked to be laid out in the
+// image as in the disk, so the new table still refers to them.
+fn preserved_regions(
+    obj: &objects::DiskImage,
+    image: &PartitionTable,
+    disk: &mut File,
+) -> Result<Vec<Range<u64>>> {
+    if obj.preserve_partitions.is_empty() {
+        return Ok(Vec::default());
+    }
+
+    let current = partition_table::read(disk)?;
+    obj.preserve_partitions
+        .iter()
+        .map(|selector| -> Result<Range<u64>> {
+            let mismatch = || utils::Error::PartitionMismatch(selector.to_string());
+            let target = current.find(selector).ok_or_else(mismatch)?;
+            let expected = image.find(selector).ok_or_else(mismatch)?;
+            if target.range() != expected.range() {
+                return Err(mismatch().into());
+            }
+            info!("'disk-image' handler preserving partition {}", selector);
+            Ok(target.range())
+        })
+        .collect()
+}
+
+impl Installer for objects::DiskImage {
+    fn check_requirements(&self) -> Result<()> {
+        info!("'disk-image' handle checking requirements");
+        self.target.valid()?;
+        Ok(())
+    }
+
+    fn install(&self, download_dir: &Path) -> Result<()> {
+        info!("'disk-image' handler Install {} ({})", self.filename, self.sha256sum);
+
+        let target = self.target.target()?;
+        let mut source = File::open(download_dir.join(self.sha256sum()))?;
+        let image = partition_table::read(&mut source)?;
+
+        let _lock = target.lock()?;
+        let mut disk = target.open()?;
+        let disk_size = target.size()?;
+        let preserved = preserved_regions(self, &image, &mut disk)?;
+
+        // The GPT backup is at the end of the image, being moved to the
+        // end of the disk instead, so it must fit after the partitions.
+        let mut skip = preserved;
+        skip.push(image.primary_region());
+        let (len, backup_len) = match image.backup_region() {
+            Some(backup) => {
+                skip.push(backup.clone());
+                (std::cmp::min(self.size, backup.start), backup.end - backup.start)
+            }
+            None => (self.size, 0),
+        };
+        if len + backup_len > disk_size {
+            return Err(utils::Error::NotEnoughSpace.into());
+        }
+
+        partition_table::copy_regions(&mut source, &mut disk, len, &skip)?;
+        target.sync(&disk)?;
+
+        info!("'disk-image' handler updating partition table of {:?}", target.path());
+        image.write(&mut disk, disk_size)?;
+        partition_table::reread(&disk);
+
+        Ok(())
+    }
+
+    fn verify(&self, download_dir: &Path) -> Result<()> {
+        let image = partition_table::read(&mut File::open(download_dir.join(self.sha256sum()))?)?;
+        let device = self.target.get_target()?;
+        utils::verification::drop_cache(&device)?;
+        let disk = partition_table::read(&mut File::open(&device)?)?;
+        if disk.partitions != image.partitions {
+            return Err(Error::ReadBackMismatch(device));
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::utils::partition_table::tests::gpt_image;
+    use pkg_schema::definitions::{Partition, TargetType};
+    use pretty_assertions::assert_eq;
+    use std::fs;
+
+    fn fake_disk_image_obj(
+        target: &Path,
+        preserve_partitions: Vec<Partition>,
+    ) -> objects::DiskImage {
+        objects::DiskImage {
+            filename: "disk.img".to_string(),
+            roles: Vec::default(),
+            size: 128 * 512,
+            sha256sum: "cfe2be1c64b03875008".to_string(),
+            target: TargetType::Device(target.to_owned()),
+
+            preserve_partitions,
+        }
+    }
+
+    #[test]
+    fn install_preserving_partitions() {
+        let download_dir = tempfile::tempdir().unwrap();
+        let mut image = gpt_image(128, &[("rootfs", 34, 63), ("data", 64, 94)]);
+        image[34 * 512..95 * 512].iter_mut().for_each(|b| *b = 0xaa);
+        fs::write(download_dir.path().join("cfe2be1c64b03875008"), &image).unwrap();
+
+        let disk = download_dir.path().join("disk");
+        let mut content = gpt_image(256, &[("rootfs", 34, 63), ("data", 64, 94)]);
+        content[64 * 512..95 * 512].iter_mut().for_each(|b| *b = 0x55);
+        fs::write(&disk, &content).unwrap();
+
+        let obj = fake_disk_image_obj(&disk, vec![Partition::Name("data".to_string())]);
+        obj.check_requirements().unwrap();
+        obj.install(download_dir.path()).unwrap();
+        obj.verify(download_dir.path()).unwrap();
+
+        let written = fs::read(&disk).unwrap();
+        assert_eq!(written.len(), 256 * 512);
+        assert!(written[34 * 512..64 * 512].iter().all(|b| *b == 0xaa));
+        assert!(written[64 * 512..95 * 512].iter().all(|b| *b == 0x55));
+    }
+
+    #[test]
+    fn refuse_mismatching_preserved_partition() {
+        let download_dir = tempfile::tempdir().unwrap();
+        let image = gpt_image(128, &[("rootfs", 34, 79), ("data", 80, 94)]);
+        fs::write(download_dir.path().join("cfe2be1c64b03875008"), &image).unwrap();
+
+        let disk = download_dir.path().join("disk");
+        let content = gpt_image(256, &[("rootfs", 34, 63), ("data", 64, 94)]);
+        fs::write(&disk, &content).unwrap();
+
+        let obj = fake_disk_image_obj(&disk, vec![Partition::Number(2)]);
+        match obj.install(download_dir.path()) {
+            Err(Error::Utils(utils::Error::PartitionMismatch(_))) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+        assert_eq!(fs::read(&disk).unwrap(), content);
+    }
+}
@@ -25,6 +25,10 @@ impl Installer for objects::Flash {
                     &self.target.get_target()?,
                     self.required_install_size(),
                 )?;
+                if let Some(geometry) = &self.geometry {
+                    let target = utils::mtd::geometry(&self.target.get_target()?)?;
+                    utils::mtd::check_geometry(geometry, &target)?;
+                }
                 Ok(())
             }
             _ => Err(Error::InvalidTargetType(self.target.clone())),
@@ -34,16 +38,21 @@ impl Installer for objects::Flash {
     fn install(&self, download_dir: &std::path::Path) -> Result<()> {
         info!("'flash' handler Install {} ({})", self.filename, self.sha256sum);
 
-        let target = self.target.get_target()?;
+        let target = self.target.target()?;
         let source = download_dir.join(self.sha256sum());
 
         handle_install_if_different!(self.install_if_different, &self.sha256sum, {
-            std::fs::File::open(&target).map_err(Error::from)
+            std::fs::File::open(target.path()).map_err(Error::from)
         });
 
-        let is_nand = utils::mtd::is_nand(&target)?;
+        let _lock = target.lock()?;
+        let is_nand = utils::mtd::is_nand(target.path())?;
+        // The blocks written by flashcp are erased by it anyway.
+        if self.erase.unwrap_or(true) {
+            target.discard()?;
+        }
 
-        easy_process::run(&format!("flash_erase {:?} 0 0", target))?;
+        let target = target.path();
 
         if is_nand {
             easy_process::run(&format!("nandwrite -p {:?} {:?}", target, source))?;
@@ -68,11 +77,14 @@ mod tests {
     fn fake_flash_obj(target: &str) -> objects::Flash {
         objects::Flash {
             filename: "etc/passwd".to_string(),
+            roles: Vec::default(),
             size: 1024,
             sha256sum: "cfe2be1c64b03875008".to_string(),
             target: definitions::TargetType::MTDName(target.to_string()),
 
             install_if_different: None,
+            geometry: None,
+            erase: None,
         }
     }
 
@@ -0,0 +1,140 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use crate::{
+    object::{Info, Installer},
+    utils::{self, definitions::TargetTypeExt},
+};
+use pkg_schema::{
+    definitions::{FpgaTarget, TargetType},
+    objects,
+};
+use slog_scope::info;
+use std::path::Path;
+
+// The config flash partitions are written as any other flash target.
+fn flash_target(target: &FpgaTarget) -> Option<TargetType> {
+    match target {
+        FpgaTarget::FpgaManager(_) => None,
+        FpgaTarget::Device(p) => Some(TargetType::Device(p.clone())),
+        FpgaTarget::MTDName(n) => Some(TargetType::MTDName(n.clone())),
+    }
+}
+
+impl Installer for objects::Fpga {
+    fn check_requirements(&self) -> Result<()> {
+        info!("'fpga' handle checking requirements");
+
+        match flash_target(&self.target) {
+            None => {
+                if let FpgaTarget::FpgaManager(manager) = &self.target {
+                    utils::fpga::manager_dir(manager)?;
+                }
+                Ok(())
+            }
+            Some(target) => {
+                utils::fs::is_executable_in_path("flashcp")?;
+                target.valid()?;
+                utils::fs::ensure_disk_space(&target.get_target()?, self.required_install_size())?;
+                Ok(())
+            }
+        }
+    }
+
+    fn install(&self, download_dir: &Path) -> Result<()> {
+        info!("'fpga' handler Install {} ({})", self.filename, self.sha256sum);
+
+        let source = download_dir.join(self.sha256sum());
+        match (&self.target, flash_target(&self.target)) {
+            (FpgaTarget::FpgaManager(manager), _) => {
+                utils::fpga::program(manager, &source, &self.sha256sum, self.partial)?;
+            }
+            (_, Some(target)) => {
+                let target = target.target()?;
+                let _lock = target.lock()?;
+                easy_process::run(&format!("flashcp {:?} {:?}", source, target.path()))?;
+            }
+            (_, None) => unreachable!("only the FPGA manager has no flash target"),
+        }
+
+        Ok(())
+    }
+
+    fn verify(&self, _download_dir: &Path) -> Result<()> {
+        // The FPGA manager is checked to be operating once programmed, as
+        // the bitstream can't be read back from it.
+        let target = match flash_target(&self.target) {
+            Some(target) => target.get_target()?,
+            None => return Ok(()),
+        };
+        utils::verification::drop_cache(&target)?;
+        super::check_read_back(
+            &target,
+            &self.sha256sum,
+            &utils::sha256sum_region(&target, 0, self.size)?,
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use pretty_assertions::assert_eq;
+    use std::{env, fs};
+
+    fn fake_fpga_obj(target: FpgaTarget) -> objects::Fpga {
+        objects::Fpga {
+            filename: "system.bit.bin".to_string(),
+            roles: Vec::default(),
+            size: 9,
+            sha256sum: utils::sha256sum(b"bitstream"),
+            target,
+
+            partial: false,
+        }
+    }
+
+    #[test]
+    fn check_requirements_with_missing_binaries() {
+        let fpga_obj = fake_fpga_obj(FpgaTarget::MTDName("qspi-bitstream".to_string()));
+
+        env::set_var("PATH", "");
+        assert!(fpga_obj.check_requirements().is_err());
+    }
+
+    #[test]
+    fn check_requirements_with_missing_manager() {
+        let fpga_obj = fake_fpga_obj(FpgaTarget::FpgaManager("../../../tmp".to_string()));
+        match fpga_obj.check_requirements() {
+            Err(Error::Utils(utils::Error::NoFpgaManager(_))) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+    }
+
+    #[test]
+    fn install_and_verify_device() {
+        let dir = tempfile::tempdir().unwrap();
+        let device = dir.path().join("qspi");
+        let fpga_obj = fake_fpga_obj(FpgaTarget::Device(device.clone()));
+        let source = dir.path().join(&fpga_obj.sha256sum);
+        fs::write(&source, b"bitstream").unwrap();
+        fs::write(&device, b"bitstream").unwrap();
+
+        let (_handle, calls) = create_echo_bins(&["flashcp"]).unwrap();
+        fpga_obj.install(dir.path()).unwrap();
+        assert_eq!(
+            fs::read_to_string(calls).unwrap(),
+            format!("flashcp {} {}\n", source.display(), device.display())
+        );
+        fpga_obj.verify(dir.path()).unwrap();
+
+        fs::write(&device, b"corrupted").unwrap();
+        match fpga_obj.verify(dir.path()) {
+            Err(Error::ReadBackMismatch(_)) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+    }
+}
@@ -72,6 +72,7 @@ mod tests {
     fn fake_imxkobs_obj() -> objects::Imxkobs {
         objects::Imxkobs {
             filename: "imxkobs-filename".to_string(),
+            roles: Vec::default(),
             size: 1024,
             sha256sum: "e3b0c44298fc1c149afb".to_string(),
 
@@ -2,20 +2,26 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
+mod agent;
 mod copy;
+mod disk_image;
 mod flash;
+mod fpga;
 mod imxkobs;
 mod raw;
+mod script;
 mod tarball;
 mod test;
 mod ubifs;
 
+pub(crate) use raw::StreamInstaller;
+
 use super::{Error, Result};
 use crate::utils;
 use find_binary_version::{self as fbv, BinaryKind};
 use pkg_schema::{definitions, Object};
-use slog_scope::debug;
-use std::io;
+use slog_scope::{debug, error};
+use std::{fs, io, path::Path};
 
 pub(crate) trait Installer {
     fn check_requirements(&self) -> Result<()> {
@@ -34,6 +40,14 @@ pub(crate) trait Installer {
     }
 
     fn install(&self, download_dir: &std::path::Path) -> Result<()>;
+
+    /// Reads the installed object back from its target, checking it
+    /// matches the package, to catch the write failures the storage
+    /// doesn't report.
+    fn verify(&self, _download_dir: &std::path::Path) -> Result<()> {
+        debug!("running default verify");
+        Ok(())
+    }
 }
 
 impl Installer for Object {
@@ -52,9 +66,40 @@ impl Installer for Object {
     fn cleanup(&mut self) -> Result<()> {
         for_any_object!(self, o, { o.cleanup() })
     }
+
+    fn verify(&self, download_dir: &std::path::Path) -> Result<()> {
+        for_any_object!(self, o, { o.verify(download_dir) })
+    }
+}
+
+/// sha256sum and size of the content the object in `source` is written
+/// into the target as, which is the object itself unless it is
+/// decompressed while installed.
+fn written_content(
+    source: &Path,
+    sha256sum: &str,
+    size: u64,
+    compressed: bool,
+) -> Result<(String, u64)> {
+    if !compressed {
+        return Ok((sha256sum.to_owned(), size));
+    }
+
+    let mut hasher = utils::verification::HashWriter::new();
+    let size = utils::archive::uncompress_data(source, fs::File::open(source)?, &mut hasher)?;
+    Ok((hasher.finish(), size as u64))
+}
+
+fn check_read_back(target: &Path, expected: &str, actual: &str) -> Result<()> {
+    if expected != actual {
+        error!("object read back from {:?} doesn't match the package", target);
+        return Err(Error::ReadBackMismatch(target.to_owned()));
+    }
+    debug!("object read back from {:?} matches the package", target);
+    Ok(())
 }
 
-fn check_if_different<R: io::Read + io::Seek>(
+pub(crate) fn check_if_different<R: io::Read + io::Seek>(
     handle: &mut R,
     rule: &definitions::InstallIfDifferent,
     sha256sum: &str,
@@ -94,7 +139,7 @@ fn check_if_different<R: io::Read + io::Seek>(
 }
 
 #[cfg(test)]
-mod tests {
+pub(crate) mod tests {
     use super::*;
     use lazy_static::lazy_static;
     use std::{
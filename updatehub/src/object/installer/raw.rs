@@ -8,10 +8,10 @@
 use super::{Error, Result};
 use crate::{
     object::{Info, Installer},
-    utils::{self, definitions::TargetTypeExt},
+    utils::{self, definitions::TargetTypeExt, emmc::BootPartition},
 };
 use pkg_schema::{definitions, objects};
-use slog_scope::info;
+use slog_scope::{info, warn};
 use std::{
     fs,
     io::{BufRead, Read, Seek, SeekFrom, Write},
@@ -22,27 +22,65 @@ impl Installer for objects::Raw {
     fn check_requirements(&self) -> Result<()> {
         info!("'raw' handle checking requirements");
 
-        if let definitions::TargetType::Device(dev) = self.target_type.valid()? {
-            utils::fs::ensure_disk_space(&dev, self.required_install_size())?;
+        if let Some(ref verity) = self.verity {
+            utils::fs::is_executable_in_path("veritysetup")?;
+        }
+
+        if self.mirror_targets.iter().any(|mirror| !mirror.exists()) {
+            return Err(utils::Error::DeviceDoesNotExist.into());
+        }
+
+        match self.target_type.valid()? {
+            definitions::TargetType::Device(dev) => {
+                if self.enable_boot_partition {
+                    utils::fs::is_executable_in_path("mmc")?;
+                    if BootPartition::from_target(&dev).is_none() {
+                        return Err(Error::InvalidTargetType(self.target_type.clone()));
+                    }
+                }
+                utils::fs::ensure_disk_space(&dev, self.required_install_size())?;
+                Ok(())
+            }
+            definitions::TargetType::LVMVolume(_) if !self.enable_boot_partition => {
+                utils::fs::ensure_disk_space(
+                    &self.target_type.get_target()?,
+                    self.required_install_size(),
+                )?;
+                Ok(())
+            }
+            _ => Err(Error::InvalidTargetType(self.target_type.clone())),
+        }
+    }
+
+    fn verify(&self, download_dir: &Path) -> Result<()> {
+        // The target only holds the object as is when it is written whole.
+        if self.skip.0 != 0 || self.count != definitions::Count::All {
+            info!("'raw' handler skipping read-back of partially written {}", self.filename);
             return Ok(());
         }
 
-        Err(Error::InvalidTargetType(self.target_type.clone()))
+        let source = download_dir.join(self.sha256sum());
+        let (sha256sum, size) =
+            super::written_content(&source, self.sha256sum(), self.size, self.compressed)?;
+        let device = self.target_type.get_target()?;
+        let offset = self.seek * self.chunk_size.0 as u64;
+        utils::verification::drop_cache(&device)?;
+        super::check_read_back(
+            &device,
+            &sha256sum,
+            &utils::sha256sum_region(&device, offset, size)?,
+        )
     }
 
     fn install(&self, download_dir: &Path) -> Result<()> {
         info!("'raw' handler Install {} ({})", self.filename, self.sha256sum);
 
-        let device = match self.target_type {
-            definitions::TargetType::Device(ref p) => p,
-            _ => unreachable!("device should be secured by check_requirements"),
-        };
+        let target = self.target_type.target()?;
+        let device = target.path();
         let source = download_dir.join(self.sha256sum());
         let chunk_size = self.chunk_size.0;
         let seek = self.seek * chunk_size as u64;
         let skip = self.skip.0 * chunk_size as u64;
-        let truncate = self.truncate.0;
-        let count = self.count.clone();
 
         handle_install_if_different!(self.install_if_different, &self.sha256sum, {
             fs::OpenOptions::new()
@@ -56,39 +94,151 @@ impl Installer for objects::Raw {
                 .map_err(Error::from)
         });
 
-        let mut input = utils::io::timed_buf_reader(chunk_size, fs::File::open(source)?);
+        let mut input = utils::io::timed_buf_reader(chunk_size, fs::File::open(&source)?);
         input.seek(SeekFrom::Start(skip))?;
-        let mut output = utils::io::timed_buf_writer(
-            chunk_size,
-            fs::OpenOptions::new().read(true).write(true).truncate(truncate).open(device)?,
-        );
-        output.seek(SeekFrom::Start(seek))?;
+        write_target(self, &source, input)
+    }
+}
 
-        if self.compressed {
-            match count {
-                definitions::Count::All => compress_tools::uncompress_data(&mut input, &mut output),
-                definitions::Count::Limited(n) => {
-                    compress_tools::uncompress_data(&mut input.take(n as u64), &mut output)
-                }
-            }?;
-        } else {
-            for _ in count {
-                let buf = input.fill_buf()?;
-                let len = buf.len();
-
-                // We break the loop in case we have no bytes left for
-                // read (EOF is reached).
-                if len == 0 {
-                    break;
-                }
+/// Installation of the objects as they are read, as when they are
+/// streamed from the server, so they are never kept as a whole.
+pub(crate) trait StreamInstaller {
+    fn install_stream<R: Read>(&self, input: R) -> Result<()>;
+}
 
-                output.write_all(&buf)?;
-                input.consume(len);
+impl StreamInstaller for objects::Raw {
+    fn install_stream<R: Read>(&self, input: R) -> Result<()> {
+        info!("'raw' handler streaming {} ({})", self.filename, self.sha256sum);
+        let input = std::io::BufReader::with_capacity(self.chunk_size.0, input);
+        write_target(self, Path::new(&self.filename), input)
+    }
+}
+
+fn write_target<R: BufRead>(raw: &objects::Raw, source: &Path, mut input: R) -> Result<()> {
+    let target = raw.target_type.target()?;
+    let device = target.path();
+    let chunk_size = raw.chunk_size.0;
+    let seek = raw.seek * chunk_size as u64;
+    let skip = raw.skip.0 * chunk_size as u64;
+    let truncate = raw.truncate.0;
+    let count = raw.count.clone();
+    let boot_partition = BootPartition::from_target(device);
+
+    // eMMC boot partitions are read-only by default, so the protection
+    // is disabled while the object is written.
+    let _unlocked = boot_partition.as_ref().map(BootPartition::unlock).transpose()?;
+    let _lock = target.lock()?;
+
+    let device_file = target.open()?;
+    if truncate && device_file.metadata()?.is_file() {
+        device_file.set_len(0)?;
+    }
+    // The previous content is only dropped when the object is written
+    // whole over it.
+    if skip == 0 && count == definitions::Count::All {
+        let len = raw.required_install_size();
+        match raw.erase {
+            Some(definitions::Erase::None) => {}
+            Some(method) => target.erase(&device_file, seek, len, method)?,
+            None if utils::io::is_direct_io() => target.reserve(&device_file, seek, len)?,
+            None => {}
+        }
+    }
+    let primary = writer(&device_file, device, seek, chunk_size)?;
+
+    // The object is decompressed once, being written to the mirrors as
+    // it is written to the target.
+    let mut mirror_files = Vec::with_capacity(raw.mirror_targets.len());
+    let mut mirrors = Vec::with_capacity(raw.mirror_targets.len());
+    for path in &raw.mirror_targets {
+        let file = fs::OpenOptions::new().write(true).open(path)?;
+        let mirror = writer(&file, path, seek, chunk_size)?;
+        mirror_files.push((path, file));
+        mirrors.push((path.clone(), mirror));
+    }
+    let mut output = utils::io::TeeWriter::new(primary, mirrors);
+
+    if raw.compressed {
+        match count {
+            definitions::Count::All => {
+                utils::archive::uncompress_data(source, &mut input, &mut output)
             }
+            definitions::Count::Limited(n) => {
+                utils::archive::uncompress_data(source, &mut input.take(n as u64), &mut output)
+            }
+        }?;
+    } else {
+        for _ in count {
+            let buf = input.fill_buf()?;
+            let len = buf.len();
+
+            // We break the loop in case we have no bytes left for
+            // read (EOF is reached).
+            if len == 0 {
+                break;
+            }
+
+            output.write_all(&buf)?;
+            input.consume(len);
         }
+    }
+    output.flush()?;
+    target.sync(&device_file)?;
 
-        Ok(())
+    let failed = output.failed_mirrors();
+    for (path, file) in mirror_files.iter().filter(|(path, _)| !failed.contains(path)) {
+        if let Err(e) = file.sync_all() {
+            warn!("failed to sync mirror {:?}: {}", path, e);
+        }
+    }
+    if !failed.is_empty() {
+        warn!("object has not been written to the mirrors {:?}", failed);
     }
+
+    if let Some(ref verity) = raw.verity {
+        verify_root_hash(device, verity)?;
+    }
+
+    if raw.enable_boot_partition {
+        if let Some(ref boot_partition) = boot_partition {
+            boot_partition.enable()?;
+        }
+    }
+
+    Ok(())
+}
+
+// The objects are written bypassing the page cache when direct I/O is
+// enabled and the target takes it.
+fn writer(file: &fs::File, path: &Path, seek: u64, chunk_size: usize) -> Result<Box<dyn Write>> {
+    if utils::io::is_direct_io() {
+        if let Some(writer) = utils::io::DirectWriter::open(path, seek, chunk_size)? {
+            return Ok(Box::new(writer));
+        }
+    }
+    let mut writer = utils::io::timed_buf_writer(chunk_size, file.try_clone()?);
+    writer.seek(SeekFrom::Start(seek))?;
+    Ok(Box::new(writer))
+}
+
+fn verify_root_hash(device: &Path, verity: &definitions::Verity) -> Result<()> {
+    let hash_device = verity.hash_device.as_deref().unwrap_or(device);
+
+    info!("verifying dm-verity root hash of {:?} ({})", device, verity.root_hash);
+    easy_process::run(&format!(
+        "veritysetup verify --hash-offset={} {} {} {}",
+        verity.hash_offset,
+        device.display(),
+        hash_device.display(),
+        verity.root_hash
+    ))?;
+
+    if let Some(ref variable) = verity.root_hash_variable {
+        info!("handing off dm-verity root hash to bootloader using '{}'", variable);
+        utils::uboot_env::set(variable, &verity.root_hash)?;
+    }
+
+    Ok(())
 }
 
 #[cfg(test)]
@@ -132,6 +282,7 @@ mod tests {
         Ok((
             objects::Raw {
                 filename: "".to_string(),
+                roles: Vec::default(),
                 size,
                 sha256sum: source.path().to_string_lossy().to_string(),
                 target_type: definitions::TargetType::Device(dest.path().into()),
@@ -144,6 +295,10 @@ mod tests {
                 seek,
                 count,
                 truncate: definitions::Truncate(truncate),
+                verity: None,
+                enable_boot_partition: false,
+                mirror_targets: Vec::default(),
+                erase: None,
             },
             download_dir,
             source,
@@ -218,6 +373,90 @@ mod tests {
             .unwrap();
     }
 
+    #[test]
+    fn raw_stream_compressed() {
+        let size = 2048;
+        let chunk_size = 8;
+        let count = definitions::Count::All;
+
+        let (obj, _download_dir, mut source_guard, mut target_guard, original_data) =
+            fake_raw_object(size, chunk_size, 0, 0, count.clone(), false, true).unwrap();
+        obj.check_requirements().unwrap();
+        obj.install_stream(source_guard.as_file_mut()).unwrap();
+
+        validate_file(original_data, target_guard.as_file_mut(), chunk_size, 0, 0, count).unwrap();
+    }
+
+    #[test]
+    fn raw_direct_io() {
+        let size = 3 * 4096 + 100;
+        let chunk_size = 4096;
+        let count = definitions::Count::All;
+
+        let (mut obj, download_dir, _source_guard, mut target_guard, original_data) =
+            fake_raw_object(size, chunk_size, 0, 1, count.clone(), false, false).unwrap();
+        // The filesystems without direct I/O are written as usual, so the
+        // content is the same either way.
+        utils::io::set_direct_io(true);
+        obj.check_requirements().unwrap();
+        obj.setup().unwrap();
+        let res = obj.install(download_dir.path());
+        utils::io::set_direct_io(false);
+        res.unwrap();
+
+        validate_file(original_data, target_guard.as_file_mut(), chunk_size, 0, 1, count).unwrap();
+        check_unwritten_blocks(target_guard.as_file_mut(), 0, chunk_size as u64).unwrap();
+    }
+
+    #[test]
+    fn raw_read_back() {
+        let (mut obj, download_dir, _source_guard, mut target_guard, _) =
+            fake_raw_object(2048, 8, 0, 2, definitions::Count::All, false, true).unwrap();
+        obj.check_requirements().unwrap();
+        obj.setup().unwrap();
+        obj.install(download_dir.path()).unwrap();
+        obj.verify(download_dir.path()).unwrap();
+
+        // A byte failing to be written is caught
+        let file = target_guard.as_file_mut();
+        file.seek(SeekFrom::Start(100)).unwrap();
+        file.write_all(&[DEFAULT_BYTE]).unwrap();
+        file.sync_all().unwrap();
+        match obj.verify(download_dir.path()) {
+            Err(Error::ReadBackMismatch(_)) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+    }
+
+    #[test]
+    fn raw_copy_to_mirrors() {
+        let size = 2048;
+        let chunk_size = 8;
+        let count = definitions::Count::All;
+
+        let (mut obj, download_dir, _source_guard, mut target_guard, original_data) =
+            fake_raw_object(size, chunk_size, 0, 0, count.clone(), false, true).unwrap();
+        let mut mirror = NamedTempFile::new_in(download_dir.path()).unwrap();
+        obj.mirror_targets = vec![mirror.path().to_owned()];
+        obj.check_requirements().unwrap();
+        obj.setup().unwrap();
+        obj.install(download_dir.path()).unwrap();
+
+        validate_file(
+            original_data.clone(),
+            target_guard.as_file_mut(),
+            chunk_size,
+            0,
+            0,
+            count.clone(),
+        )
+        .unwrap();
+        validate_file(original_data, mirror.as_file_mut(), chunk_size, 0, 0, count).unwrap();
+
+        obj.mirror_targets = vec![download_dir.path().join("missing")];
+        assert!(obj.check_requirements().is_err());
+    }
+
     #[test]
     fn raw_full_copy() {
         let size = 2048;
@@ -304,4 +543,35 @@ mod tests {
             .unwrap();
         check_unwritten_blocks(target_guard.as_file_mut(), 1024, 1024).unwrap();
     }
+
+    #[test]
+    fn raw_verity_root_hash_handoff() {
+        utils::uboot_env::tests::fake_env();
+        let (_handle, calls) =
+            crate::object::installer::tests::create_echo_bins(&["veritysetup"]).unwrap();
+        let (mut obj, download_dir, _source_guard, target_guard, _) =
+            fake_raw_object(2048, 8, 0, 0, definitions::Count::All, false, false).unwrap();
+        obj.verity = Some(definitions::Verity {
+            root_hash: "4392712ba01368efdf14b05c76f9e4df".to_string(),
+            hash_device: None,
+            hash_offset: 2048,
+            root_hash_variable: Some("verity_root_hash".to_string()),
+        });
+        obj.check_requirements().unwrap();
+        obj.setup().unwrap();
+        obj.install(download_dir.path()).unwrap();
+
+        let device = target_guard.path().display();
+        assert_eq!(
+            fs::read_to_string(calls).unwrap(),
+            format!(
+                "veritysetup verify --hash-offset=2048 {} {} 4392712ba01368efdf14b05c76f9e4df\n",
+                device, device
+            )
+        );
+        assert_eq!(
+            utils::uboot_env::get("verity_root_hash").unwrap().as_deref(),
+            Some("4392712ba01368efdf14b05c76f9e4df")
+        );
+    }
 }
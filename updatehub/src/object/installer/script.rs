@@ -0,0 +1,201 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use crate::{
+    object::{self, Info, Installer},
+    utils,
+};
+use pkg_schema::objects;
+use slog_scope::{debug, info};
+use std::{
+    fs,
+    io::{self, BufRead},
+    path::Path,
+    process::{Command, Stdio},
+};
+
+impl Installer for objects::Script {
+    fn check_requirements(&self) -> Result<()> {
+        info!("'script' handle checking requirements");
+
+        utils::fs::is_executable_in_path("prlimit")?;
+        utils::fs::is_executable_in_path("unshare")?;
+
+        Ok(())
+    }
+
+    fn install(&self, download_dir: &Path) -> Result<()> {
+        info!("'script' handler Install {} ({})", self.filename, self.sha256sum);
+
+        // The executable is run from a private copy, checked against the
+        // package as it is copied, so it can't be replaced once checked.
+        let private = tempfile::Builder::new().prefix(".script-").tempdir_in(download_dir)?;
+        let executable = private.path().join("executable");
+        copy_executable(&download_dir.join(&self.executable), &executable, &self.executable)?;
+        let source = download_dir.join(self.sha256sum());
+
+        let mut child = sandboxed_command(self, &executable)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .spawn()?;
+
+        // The object is fed on a separate thread so the output can be
+        // consumed while the executable runs.
+        let mut stdin = child.stdin.take().expect("stdin is piped");
+        let mut source = fs::File::open(source)?;
+        let feeder = std::thread::spawn(move || io::copy(&mut source, &mut stdin));
+
+        let stdout = child.stdout.take().expect("stdout is piped");
+        for line in io::BufReader::new(stdout).lines() {
+            handle_output_line(&line?);
+        }
+
+        if let Ok(Err(e)) = feeder.join() {
+            debug!("executable has not consumed the whole object: {}", e);
+        }
+
+        let status = child.wait()?;
+        if !status.success() {
+            return Err(Error::ScriptFailed(status));
+        }
+
+        Ok(())
+    }
+}
+
+// Copies the executable in `source` to `target`, failing unless its
+// content matches the `sha256sum` the object refers to it by.
+fn copy_executable(source: &Path, target: &Path, sha256sum: &str) -> Result<()> {
+    let content = fs::read(source)?;
+    if utils::sha256sum(&content) != sha256sum {
+        return Err(Error::ScriptExecutableMismatch(sha256sum.to_owned()));
+    }
+    fs::write(target, content)?;
+    utils::fs::chmod(target, 0o700)?;
+    Ok(())
+}
+
+// The executable runs on its own mount, pid, network, ipc and uts
+// namespaces, so it has no network access and can't interfere with the
+// running processes, bounded by the object resource limits.
+fn sandboxed_command(obj: &objects::Script, executable: &Path) -> Command {
+    let mut cmd = Command::new("prlimit");
+    if let Some(limit) = obj.memory_limit {
+        cmd.arg(format!("--as={}", limit));
+    }
+    if let Some(limit) = obj.cpu_time_limit {
+        cmd.arg(format!("--cpu={}", limit));
+    }
+    cmd.args(&[
+        "--",
+        "unshare",
+        "--mount",
+        "--pid",
+        "--net",
+        "--ipc",
+        "--uts",
+        "--fork",
+        "--kill-child",
+        "--mount-proc",
+    ]);
+    cmd.arg(executable).args(&obj.args);
+    cmd
+}
+
+// The executable reports its progress writing `progress <percent>`
+// lines to its standard output, which is reported as the progress of the
+// object. Any other line is logged as is.
+fn handle_output_line(line: &str) {
+    let progress = line.trim();
+    if progress.starts_with("progress ") {
+        if let Ok(progress) = progress["progress ".len()..].parse::<u8>() {
+            debug!("'script' handler progress: {}%", progress);
+            object::report_progress(progress);
+            return;
+        }
+    }
+
+    info!("'script' handler output: {}", line);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use pretty_assertions::assert_eq;
+
+    fn fake_script_obj() -> objects::Script {
+        objects::Script {
+            filename: "firmware.bin".to_string(),
+            roles: Vec::default(),
+            size: 1024,
+            sha256sum: "cfe2be1c64b0387500853de0f48303e3de7b1c6f1508dc719eeafa0d41c36722"
+                .to_string(),
+            executable: "1ac3ee52fb9c409ff2c50b982c961490539b085c061f1ad6c0bb4bd1caf28d50"
+                .to_string(),
+            args: vec!["--bank".to_string(), "b".to_string()],
+            memory_limit: Some(1024),
+            cpu_time_limit: Some(60),
+        }
+    }
+
+    #[test]
+    fn install_runs_sandboxed() {
+        let (_handle, calls) = create_echo_bins(&["prlimit", "unshare"]).unwrap();
+        let download_dir = tempfile::tempdir().unwrap();
+        let obj = fake_script_obj();
+        let executable = download_dir.path().join(&obj.executable);
+        fs::write(download_dir.path().join(&obj.sha256sum), b"firmware").unwrap();
+        fs::write(&executable, b"#!/bin/sh\ncat > /dev/null\n").unwrap();
+
+        obj.check_requirements().unwrap();
+        obj.install(download_dir.path()).unwrap();
+
+        // The executable is run from a private copy of it
+        let calls = fs::read_to_string(calls).unwrap();
+        let prefix = "prlimit --as=1024 --cpu=60 -- unshare --mount --pid --net --ipc --uts \
+                      --fork --kill-child --mount-proc ";
+        assert!(calls.starts_with(prefix), "unexpected calls: {}", calls);
+        let copy = Path::new(calls[prefix.len()..].split(' ').next().unwrap());
+        assert_ne!(copy, executable);
+        assert!(copy.starts_with(download_dir.path()));
+        assert!(calls.ends_with(" --bank b\n"));
+    }
+
+    #[test]
+    fn install_refuses_unknown_executable() {
+        let (_handle, calls) = create_echo_bins(&["prlimit", "unshare"]).unwrap();
+        let download_dir = tempfile::tempdir().unwrap();
+        let mut obj = fake_script_obj();
+        fs::write(download_dir.path().join(&obj.sha256sum), b"firmware").unwrap();
+        fs::write(download_dir.path().join(&obj.executable), b"#!/bin/sh\nrm -rf /\n").unwrap();
+
+        match obj.install(download_dir.path()) {
+            Err(Error::ScriptExecutableMismatch(sha256sum)) => {
+                assert_eq!(sha256sum, obj.executable)
+            }
+            res => panic!("Unexpected result: {:?}", res),
+        }
+
+        // Neither are the paths out of the download directory run
+        obj.executable = "../../bin/sh".to_string();
+        assert!(obj.install(download_dir.path()).is_err());
+        assert!(!calls.exists());
+    }
+
+    #[test]
+    fn report_output_progress() {
+        let reported = std::sync::Arc::new(std::sync::Mutex::new(Vec::new()));
+        let sink = reported.clone();
+        object::set_progress_sink(Some(Box::new(move |p| sink.lock().unwrap().push(p))));
+
+        handle_output_line("progress 42");
+        handle_output_line("writing bank b");
+        handle_output_line(" progress 100 ");
+        object::set_progress_sink(None);
+
+        assert_eq!(*reported.lock().unwrap(), vec![42, 100]);
+    }
+}
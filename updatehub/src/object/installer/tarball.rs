@@ -2,19 +2,24 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use super::Result;
+use super::{Error, Result};
 use crate::{
     object::{Info, Installer},
     utils::{self, definitions::TargetTypeExt},
 };
+use nix::fcntl::OFlag;
 use pkg_schema::{definitions, objects};
-use slog_scope::info;
+use slog_scope::{error, info};
 use std::path::Path;
 
 impl Installer for objects::Tarball {
     fn check_requirements(&self) -> Result<()> {
         info!("'tarball' handle checking requirements");
 
+        if self.read_only.is_some() && self.target_format.should_format {
+            return Err(Error::ReadOnlyFormat(self.filename.clone()));
+        }
+
         match self.target {
             definitions::TargetType::Device(_)
             | definitions::TargetType::UBIVolume(_)
@@ -26,9 +31,46 @@ impl Installer for objects::Tarball {
                 self.target.valid()?;
                 Ok(())
             }
+            definitions::TargetType::LVMVolume(_) => {
+                Err(Error::InvalidTargetType(self.target.clone()))
+            }
         }
     }
 
+    // The archive is extracted again aside, as its files are only known
+    // once extracted, and the tree on the target is compared with it.
+    fn verify(&self, download_dir: &Path) -> Result<()> {
+        let source = download_dir.join(self.sha256sum());
+        let expected = tempfile::tempdir_in(download_dir)?;
+        utils::archive::uncompress_archive(
+            &source,
+            expected.path(),
+            compress_tools::Ownership::Ignore,
+        )?;
+        let device = self.target.get_target()?;
+        let target_path = self.target_path.strip_prefix("/").unwrap_or(&self.target_path);
+
+        utils::read_only::read_map(
+            &device,
+            self.filesystem,
+            &self.mount_options,
+            self.read_only,
+            |path| {
+                let dest = path.join(target_path);
+                match utils::verification::compare_trees(expected.path(), &dest)? {
+                    Some(mismatch) => {
+                        error!(
+                            "{:?} read back from the target doesn't match the archive",
+                            mismatch
+                        );
+                        Err(Error::ReadBackMismatch(dest.join(mismatch)))
+                    }
+                    None => Ok(()),
+                }
+            },
+        )?
+    }
+
     fn install(&self, download_dir: &Path) -> Result<()> {
         info!("'tarball' handler Install {} ({})", self.filename, self.sha256sum);
 
@@ -44,16 +86,25 @@ impl Installer for objects::Tarball {
             utils::fs::format(&device, filesystem, format_options)?;
         }
 
-        Ok(utils::fs::mount_map(&device, filesystem, mount_options, |path| {
-            let dest = path.join(target_path);
-            let mut source = std::fs::File::open(source)?;
-            compress_tools::uncompress_archive(
-                &mut source,
-                &dest,
-                compress_tools::Ownership::Preserve,
-            )?;
-            utils::Result::Ok(())
-        })??)
+        Ok(utils::read_only::write_map(
+            &device,
+            filesystem,
+            mount_options,
+            self.read_only,
+            target_path,
+            |path| {
+                // The target directory may be reached through symlinks on the
+                // target filesystem, which must not lead outside of it.
+                utils::fs::open_beneath(path, target_path, OFlag::O_PATH | OFlag::O_DIRECTORY)?;
+                let dest = path.join(target_path);
+                utils::archive::uncompress_archive(
+                    &source,
+                    &dest,
+                    compress_tools::Ownership::Preserve,
+                )?;
+                utils::Result::Ok(())
+            },
+        )??)
     }
 }
 
@@ -97,6 +148,7 @@ mod tests {
         // Generate base copy object
         let mut obj = objects::Tarball {
             filename: "".to_string(),
+            roles: Vec::default(),
             filesystem: definitions::Filesystem::Ext4,
             size: CONTENT_SIZE as u64,
             sha256sum: "tree.tar".to_string(),
@@ -107,6 +159,7 @@ mod tests {
             required_uncompressed_size: CONTENT_SIZE as u64,
             target_format: definitions::TargetFormat::default(),
             mount_options: String::default(),
+            read_only: None,
         };
         f(&mut obj);
 
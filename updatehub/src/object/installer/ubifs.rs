@@ -9,6 +9,7 @@ use crate::{
 };
 use pkg_schema::{definitions, objects};
 use slog_scope::info;
+use std::path::Path;
 
 impl Installer for objects::Ubifs {
     fn check_requirements(&self) -> Result<()> {
@@ -17,6 +18,16 @@ impl Installer for objects::Ubifs {
         utils::fs::is_executable_in_path("ubiupdatevol")?;
         utils::fs::is_executable_in_path("ubinfo")?;
 
+        if let Some(geometry) = &self.geometry {
+            check_geometry(self, geometry)?;
+        }
+
+        // The volume is going to be created, or resized, during setup
+        // so its current state is not relevant.
+        if let (Some(_), definitions::TargetType::UBIVolume(_)) = (self.volume_size, &self.target) {
+            return Ok(());
+        }
+
         if let definitions::TargetType::UBIVolume(_) = self.target.valid()? {
             utils::fs::ensure_disk_space(&self.target.get_target()?, self.required_install_size())?;
             return Ok(());
@@ -25,18 +36,40 @@ impl Installer for objects::Ubifs {
         Err(Error::InvalidTargetType(self.target.clone()))
     }
 
+    fn setup(&mut self) -> Result<()> {
+        if let (Some(size), definitions::TargetType::UBIVolume(volume)) =
+            (self.volume_size, &self.target)
+        {
+            let ubi_device = self.ubi_device.as_deref().unwrap_or_else(|| Path::new("/dev/ubi0"));
+            utils::mtd::ensure_ubi_volume(volume, size, ubi_device)?;
+        }
+
+        Ok(())
+    }
+
+    // A volume holds the object followed by the rest of its LEBs, so only
+    // the object size is read back.
+    fn verify(&self, download_dir: &Path) -> Result<()> {
+        let source = download_dir.join(self.sha256sum());
+        let (sha256sum, size) =
+            super::written_content(&source, self.sha256sum(), self.size, self.compressed)?;
+        let target = self.target.get_target()?;
+        super::check_read_back(&target, &sha256sum, &utils::sha256sum_region(&target, 0, size)?)
+    }
+
     fn install(&self, download_dir: &std::path::Path) -> Result<()> {
         info!("'ubifs' handler Install {} ({})", self.filename, self.sha256sum);
 
-        let target = self.target.get_target()?;
+        let target = self.target.target()?;
+        let target = target.path();
         let source = download_dir.join(self.sha256sum());
 
         if self.compressed {
             easy_process::run_with_stdin(
                 &format!("ubiupdatevol {} -", target.display()),
                 |stdin| {
-                    let mut file = std::fs::File::open(source)?;
-                    compress_tools::uncompress_data(&mut file, stdin)?;
+                    let file = std::fs::File::open(&source)?;
+                    utils::archive::uncompress_data(&source, file, stdin)?;
                     Result::Ok(())
                 },
             )?;
@@ -48,6 +81,22 @@ impl Installer for objects::Ubifs {
     }
 }
 
+fn check_geometry(object: &objects::Ubifs, expected: &definitions::FlashGeometry) -> Result<()> {
+    let geometry = match (object.volume_size, &object.target) {
+        // The volume may not exist yet, so the geometry of the UBI device
+        // it is going to be created on is checked instead.
+        (Some(size), definitions::TargetType::UBIVolume(_)) => {
+            let ubi_device = object.ubi_device.as_deref().unwrap_or_else(|| Path::new("/dev/ubi0"));
+            let mut geometry = utils::mtd::geometry(ubi_device)?;
+            geometry.leb_count = geometry.leb_size.filter(|leb| *leb > 0).map(|leb| size / leb);
+            geometry
+        }
+        _ => utils::mtd::geometry(&object.target.get_target()?)?,
+    };
+
+    Ok(utils::mtd::check_geometry(expected, &geometry)?)
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -61,12 +110,16 @@ mod tests {
     fn fake_ubifs_obj(name: &str) -> objects::Ubifs {
         objects::Ubifs {
             filename: "ubifs-filename".to_string(),
+            roles: Vec::default(),
             size: 1024,
             sha256sum: "e3b0c44298fc1c149afb".to_string(),
             target: definitions::TargetType::UBIVolume(name.to_string()),
 
             compressed: false,
             required_uncompressed_size: 2048,
+            volume_size: None,
+            ubi_device: None,
+            geometry: None,
         }
     }
 
@@ -104,4 +157,21 @@ mod tests {
         let expected = format!("ubiupdatevol {} {}\n", target.display(), source.display());
         assert_eq!(std::fs::read_to_string(calls).unwrap(), expected);
     }
+
+    #[test]
+    #[ignore]
+    fn setup_creates_missing_volume() {
+        let _mtd_lock = SERIALIZE.lock();
+        let _ubi = FakeUbi::new(&[], MtdKind::Nor).unwrap();
+        let mut ubifs_obj = fake_ubifs_obj("data");
+        ubifs_obj.volume_size = Some(1024 * 1024);
+
+        let (_handle, _) = create_echo_bins(&["ubinfo", "ubiupdatevol"]).unwrap();
+        ubifs_obj.check_requirements().unwrap();
+        assert!(ubifs_obj.target.get_target().is_err());
+
+        env::set_var("PATH", "/usr/sbin:/usr/bin:/sbin:/bin");
+        ubifs_obj.setup().unwrap();
+        assert_eq!(ubifs_obj.target.get_target().unwrap(), std::path::PathBuf::from("/dev/ubi0_0"));
+    }
 }
@@ -85,10 +85,14 @@ macro_rules! impl_compressed_object_info {
 macro_rules! for_any_object {
     ($mode:ident, $alias:ident, $code:block) => {
         match $mode {
+            Object::Agent($alias) => $code,
             Object::Copy($alias) => $code,
+            Object::DiskImage($alias) => $code,
             Object::Flash($alias) => $code,
+            Object::Fpga($alias) => $code,
             Object::Imxkobs($alias) => $code,
             Object::Raw($alias) => $code,
+            Object::Script($alias) => $code,
             Object::Tarball($alias) => $code,
             Object::Test($alias) => $code,
             Object::Ubifs($alias) => $code,
@@ -7,12 +7,33 @@ mod macros;
 
 pub(crate) mod info;
 pub(crate) mod installer;
+pub(crate) mod transaction;
 
-pub(crate) use self::{info::Info, installer::Installer};
+pub(crate) use self::{
+    info::Info,
+    installer::{Installer, StreamInstaller},
+};
+use crate::utils::{self, definitions::TargetTypeExt};
+use lazy_static::lazy_static;
+use pkg_schema::{
+    definitions::{Count, TargetType},
+    Object,
+};
+use sdk::api::info::{runtime_settings::InstalledRegion, settings::Extraction};
+use std::{
+    path::{Path, PathBuf},
+    sync::Mutex,
+};
 use thiserror::Error;
 
 pub type Result<T> = std::result::Result<T, Error>;
 
+type ProgressSink = Box<dyn Fn(u8) + Send>;
+
+lazy_static! {
+    static ref PROGRESS_SINK: Mutex<Option<ProgressSink>> = Mutex::new(None);
+}
+
 #[derive(Debug, Error)]
 pub enum Error {
     #[error("Invalid path formed")]
@@ -32,4 +53,157 @@ pub enum Error {
 
     #[error("Process error: {0}")]
     Process(#[from] easy_process::Error),
+
+    #[error("Script failed: {0}")]
+    ScriptFailed(std::process::ExitStatus),
+
+    #[error("Script executable {0} doesn't match its checksum")]
+    ScriptExecutableMismatch(String),
+
+    #[error("Object read back from {0:?} doesn't match the package")]
+    ReadBackMismatch(PathBuf),
+
+    #[error("Invalid targets: {0}")]
+    InvalidTargets(String),
+
+    #[error("Object {0} of a reversible target can't be backed up")]
+    IrreversibleObject(String),
+
+    #[error("Object {0} of a read-only target can't format it")]
+    ReadOnlyFormat(String),
+}
+
+/// Sets the `sink` the installers report the percentage of the object
+/// installed so far to, as they only report it when they know it.
+pub(crate) fn set_progress_sink(sink: Option<ProgressSink>) {
+    *PROGRESS_SINK.lock().expect("poisoned progress sink lock") = sink;
+}
+
+/// Reports the `percentage` of the object being installed.
+pub(crate) fn report_progress(percentage: u8) {
+    if let Some(sink) = PROGRESS_SINK.lock().expect("poisoned progress sink lock").as_ref() {
+        sink(percentage.min(100));
+    }
+}
+
+/// Checks the compressed objects are within the extraction `limits`.
+/// The tarballs are checked as they are extracted.
+pub(crate) fn check_extraction_limits(
+    object: &Object,
+    download_dir: &Path,
+    limits: &Extraction,
+) -> Result<()> {
+    // The objects are only expanded to be checked against the limits.
+    if limits.max_uncompressed_size.is_none() && limits.max_expansion_ratio.is_none() {
+        return Ok(());
+    }
+
+    let source = download_dir.join(object.sha256sum());
+    match object {
+        Object::Copy(o) if o.compressed => {
+            utils::archive::check_compressed(limits, &source)?;
+        }
+        Object::Raw(o) if o.compressed => {
+            utils::archive::check_compressed(limits, &source)?;
+        }
+        Object::Ubifs(o) if o.compressed => {
+            utils::archive::check_compressed(limits, &source)?;
+        }
+        _ => {}
+    }
+
+    Ok(())
+}
+
+/// Whether the object can be installed as it is read, in a single pass,
+/// so it doesn't need to be downloaded first.
+pub(crate) fn is_streamable(object: &Object) -> bool {
+    match object {
+        Object::Raw(o) => {
+            o.install_if_different.is_none() && o.skip.0 == 0 && o.count == Count::All
+        }
+        _ => false,
+    }
+}
+
+/// Target the object is installed into, if it is installed into one.
+pub(crate) fn target_type(object: &Object) -> Option<&TargetType> {
+    match object {
+        Object::Copy(o) => Some(&o.target_type),
+        Object::Raw(o) => Some(&o.target_type),
+        Object::DiskImage(o) => Some(&o.target),
+        Object::Flash(o) => Some(&o.target),
+        Object::Tarball(o) => Some(&o.target),
+        Object::Ubifs(o) => Some(&o.target),
+        // The FPGA targets may not be devices, as the FPGA managers.
+        Object::Agent(_)
+        | Object::Fpga(_)
+        | Object::Imxkobs(_)
+        | Object::Script(_)
+        | Object::Test(_) => None,
+    }
+}
+
+/// Device the object is installed into, if it is installed into one.
+pub(crate) fn target_device(object: &Object) -> Option<PathBuf> {
+    target_type(object)?.get_target().ok()
+}
+
+/// Region of the device the object is written verbatim into, which
+/// can be checked against the object afterwards. Only the raw objects
+/// written whole, without compression, have one.
+pub(crate) fn installed_region(object: &Object) -> Option<InstalledRegion> {
+    match object {
+        Object::Raw(o) if !o.compressed && o.skip.0 == 0 && o.count == Count::All => {
+            Some(InstalledRegion {
+                target: o.target_type.get_target().ok()?,
+                offset: o.seek * o.chunk_size.0 as u64,
+                size: o.size,
+                sha256sum: o.sha256sum.clone(),
+            })
+        }
+        _ => None,
+    }
+}
+
+/// Roles of the devices the object is installed on. An object without
+/// roles is installed on every device.
+pub(crate) fn roles(object: &Object) -> &[String] {
+    match object {
+        Object::Agent(o) => &o.roles,
+        Object::Copy(o) => &o.roles,
+        Object::DiskImage(o) => &o.roles,
+        Object::Flash(o) => &o.roles,
+        Object::Fpga(o) => &o.roles,
+        Object::Imxkobs(o) => &o.roles,
+        Object::Raw(o) => &o.roles,
+        Object::Script(o) => &o.roles,
+        Object::Tarball(o) => &o.roles,
+        Object::Test(o) => &o.roles,
+        Object::Ubifs(o) => &o.roles,
+    }
+}
+
+/// Whether the objects only replace the agent itself, so the device is
+/// kept as it is.
+pub(crate) fn is_agent_only(objects: &[Object]) -> bool {
+    !objects.is_empty()
+        && objects.iter().all(|object| if let Object::Agent(_) = object { true } else { false })
+}
+
+/// Name of the install mode of the object, as given in the package.
+pub(crate) fn mode(object: &Object) -> &'static str {
+    match object {
+        Object::Agent(_) => "agent",
+        Object::Copy(_) => "copy",
+        Object::DiskImage(_) => "disk-image",
+        Object::Flash(_) => "flash",
+        Object::Fpga(_) => "fpga",
+        Object::Imxkobs(_) => "imxkobs",
+        Object::Raw(_) => "raw",
+        Object::Script(_) => "script",
+        Object::Tarball(_) => "tarball",
+        Object::Test(_) => "test",
+        Object::Ubifs(_) => "ubifs",
+    }
 }
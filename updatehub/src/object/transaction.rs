@@ -0,0 +1,285 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Packages updating several targets of the device, as the root
+//! filesystem slot along with the bootloader or the firmware of the
+//! peripherals, which are installed as a single transaction. The targets
+//! declared reversible are backed up before they are written, so they
+//! can be restored when a later target fails. The LVM logical volumes are
+//! snapshotted instead, being reverted by merging the snapshot back.
+
+use super::{Error, Info, Result};
+use crate::utils::{self, definitions::TargetTypeExt};
+use pkg_schema::{
+    definitions::{Count, TargetType},
+    Object, Target,
+};
+use slog_scope::{debug, info};
+use std::{
+    fs::{self, File, OpenOptions},
+    io::{self, Read, Seek, SeekFrom},
+    path::{Path, PathBuf},
+};
+
+/// Region of the device an object overwrites.
+#[derive(Debug, PartialEq)]
+pub(crate) struct Region {
+    pub(crate) device: PathBuf,
+    pub(crate) offset: u64,
+    pub(crate) size: u64,
+}
+
+/// Target the object installs, if it has been declared.
+pub(crate) fn target_of<'a>(targets: &'a [Target], object: &Object) -> Option<&'a Target> {
+    targets.iter().find(|target| target.objects.iter().any(|f| f == object.filename()))
+}
+
+/// Order the objects are installed in: the objects of no target come
+/// first, in the package order, followed by the targets, each one after
+/// the targets it is declared after.
+///
+/// The objects a target refers to which aren't in the package are left
+/// out, as the ones of other roles.
+pub(crate) fn install_order(objects: &[Object], targets: &[Target]) -> Result<Vec<usize>> {
+    let mut order = (0..objects.len())
+        .filter(|&i| target_of(targets, &objects[i]).is_none())
+        .collect::<Vec<_>>();
+
+    let mut installed: Vec<&str> = Vec::with_capacity(targets.len());
+    while installed.len() < targets.len() {
+        let target = targets
+            .iter()
+            .find(|t| {
+                !installed.contains(&t.name.as_str())
+                    && t.after.iter().all(|after| installed.contains(&after.as_str()))
+            })
+            .ok_or_else(|| {
+                Error::InvalidTargets(
+                    "targets are declared after unknown or circular targets".to_owned(),
+                )
+            })?;
+
+        for filename in &target.objects {
+            let idx = match (0..objects.len())
+                .find(|i| objects[*i].filename() == filename && !order.contains(i))
+            {
+                Some(idx) => idx,
+                None => {
+                    debug!("object {} of target {} isn't in the package", filename, target.name);
+                    continue;
+                }
+            };
+            if target.reversible && !is_reversible(&objects[idx]) {
+                return Err(Error::IrreversibleObject(filename.clone()));
+            }
+            order.push(idx);
+        }
+        installed.push(&target.name);
+    }
+
+    Ok(order)
+}
+
+/// Region of the device the object overwrites, which can be backed up.
+/// Only the raw objects written whole into a single device have one.
+pub(crate) fn backup_region(object: &Object) -> Option<Region> {
+    match object {
+        Object::Raw(o) if o.skip.0 == 0 && o.count == Count::All && o.mirror_targets.is_empty() => {
+            Some(Region {
+                device: o.target_type.get_target().ok()?,
+                offset: o.seek * o.chunk_size.0 as u64,
+                size: if o.compressed { o.required_uncompressed_size } else { o.size },
+            })
+        }
+        _ => None,
+    }
+}
+
+/// LVM logical volume the object is written into, as the copy and raw
+/// objects may be.
+pub(crate) fn lvm_volume(object: &Object) -> Option<&str> {
+    let target_type = match object {
+        Object::Copy(o) => &o.target_type,
+        Object::Raw(o) => &o.target_type,
+        _ => return None,
+    };
+    match target_type {
+        TargetType::LVMVolume(volume) => Some(volume),
+        _ => None,
+    }
+}
+
+/// Whether the target of the object can be backed up, so it can be
+/// restored when a later target fails.
+pub(crate) fn is_reversible(object: &Object) -> bool {
+    lvm_volume(object).is_some() || backup_region(object).is_some()
+}
+
+/// Backs the region the object overwrites up into `dir`. The logical
+/// volumes are snapshotted instead, the backup only naming the volume.
+pub(crate) fn backup(object: &Object, dir: &Path) -> Result<()> {
+    if let Some(volume) = lvm_volume(object) {
+        utils::lvm::create_snapshot(volume)?;
+        fs::write(backup_path(object, dir), volume)?;
+        return Ok(());
+    }
+
+    let region = backup_region(object)
+        .ok_or_else(|| Error::IrreversibleObject(object.filename().to_owned()))?;
+    info!("backing up {} bytes of {:?} at {}", region.size, region.device, region.offset);
+
+    let mut device = File::open(&region.device)?;
+    device.seek(SeekFrom::Start(region.offset))?;
+    let mut backup = File::create(backup_path(object, dir))?;
+    let copied = io::copy(&mut device.take(region.size), &mut backup)?;
+    if copied != region.size {
+        return Err(io::Error::from(io::ErrorKind::UnexpectedEof).into());
+    }
+    backup.sync_all()?;
+    Ok(())
+}
+
+/// Restores the region the object has overwritten from its backup in
+/// `dir`.
+pub(crate) fn restore(object: &Object, dir: &Path) -> Result<()> {
+    if let Some(volume) = lvm_volume(object) {
+        return Ok(utils::lvm::merge_snapshot(volume)?);
+    }
+
+    let region = backup_region(object)
+        .ok_or_else(|| Error::IrreversibleObject(object.filename().to_owned()))?;
+    info!("restoring {} bytes of {:?} at {}", region.size, region.device, region.offset);
+
+    let mut device = OpenOptions::new().write(true).open(&region.device)?;
+    device.seek(SeekFrom::Start(region.offset))?;
+    io::copy(&mut File::open(backup_path(object, dir))?, &mut device)?;
+    device.sync_all()?;
+    Ok(())
+}
+
+/// Drops the backup of the object in `dir`, once the install is done.
+pub(crate) fn drop_backup(object: &Object, dir: &Path) -> Result<()> {
+    if let Some(volume) = lvm_volume(object) {
+        utils::lvm::remove_snapshot(volume)?;
+    }
+    match fs::remove_file(backup_path(object, dir)) {
+        Err(e) if e.kind() != io::ErrorKind::NotFound => Err(e.into()),
+        _ => Ok(()),
+    }
+}
+
+/// Where the pre-image of the target of the object is kept in `dir`.
+pub(crate) fn backup_path(object: &Object, dir: &Path) -> PathBuf {
+    dir.join(format!("{}.backup", object.sha256sum()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    fn raw(filename: &str, target: &Path) -> Object {
+        serde_json::from_value(json!({
+            "mode": "raw",
+            "filename": filename,
+            "size": 4,
+            "sha256sum": filename,
+            "target-type": "device",
+            "target": target,
+            "seek": 1,
+            "chunk-size": 2
+        }))
+        .unwrap()
+    }
+
+    fn target(name: &str, objects: &[&str], after: &[&str]) -> Target {
+        Target {
+            name: name.to_owned(),
+            objects: objects.iter().map(|s| s.to_string()).collect(),
+            after: after.iter().map(|s| s.to_string()).collect(),
+            reversible: false,
+        }
+    }
+
+    #[test]
+    fn ordered_targets() {
+        let objects = ["rootfs", "bootloader", "mcu", "fpga"]
+            .iter()
+            .map(|f| raw(f, Path::new("/dev/null")))
+            .collect::<Vec<_>>();
+
+        assert_eq!(install_order(&objects, &[]).unwrap(), vec![0, 1, 2, 3]);
+        assert_eq!(
+            install_order(
+                &objects,
+                &[
+                    target("bootloader", &["bootloader"], &["mcu"]),
+                    target("mcu", &["mcu", "missing"], &["fpga"]),
+                    target("fpga", &["fpga"], &[]),
+                ]
+            )
+            .unwrap(),
+            vec![0, 3, 2, 1]
+        );
+        assert!(install_order(
+            &objects,
+            &[target("mcu", &["mcu"], &["fpga"]), target("fpga", &["fpga"], &["mcu"])]
+        )
+        .is_err());
+        assert!(install_order(&objects, &[target("mcu", &["mcu"], &["unknown"])]).is_err());
+    }
+
+    #[test]
+    fn reversible_targets() {
+        let tarball = serde_json::from_value::<Object>(json!({
+            "mode": "tarball",
+            "filename": "rootfs.tar",
+            "size": 4,
+            "sha256sum": "rootfs.tar",
+            "filesystem": "ext4",
+            "target-type": "device",
+            "target": "/dev/sda1",
+            "target-path": "/"
+        }))
+        .unwrap();
+        let targets = [Target { reversible: true, ..target("rootfs", &["rootfs.tar"], &[]) }];
+        match install_order(&[tarball], &targets) {
+            Err(Error::IrreversibleObject(..)) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+
+        let volume = serde_json::from_value::<Object>(json!({
+            "mode": "copy",
+            "filename": "rootfs.img",
+            "size": 4,
+            "sha256sum": "rootfs.img",
+            "filesystem": "ext4",
+            "target-type": "lvmvolume",
+            "target": "vg0/rootfs_b",
+            "target-path": "/"
+        }))
+        .unwrap();
+        assert_eq!(lvm_volume(&volume), Some("vg0/rootfs_b"));
+        let targets = [Target { reversible: true, ..target("rootfs", &["rootfs.img"], &[]) }];
+        assert_eq!(install_order(&[volume], &targets).unwrap(), vec![0]);
+    }
+
+    #[test]
+    fn backup_and_restore() {
+        let dir = tempfile::tempdir().unwrap();
+        let device = dir.path().join("device");
+        fs::write(&device, b"0123456789").unwrap();
+        let object = raw("bootloader", &device);
+        assert_eq!(
+            backup_region(&object),
+            Some(Region { device: device.clone(), offset: 2, size: 4 })
+        );
+
+        backup(&object, dir.path()).unwrap();
+        fs::write(&device, b"01abcd6789").unwrap();
+        restore(&object, dir.path()).unwrap();
+        assert_eq!(fs::read(&device).unwrap(), b"0123456789");
+    }
+}
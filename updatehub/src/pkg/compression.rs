@@ -0,0 +1,278 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use crate::utils;
+use serde::Serialize;
+use slog_scope::{debug, info};
+use std::{
+    fmt,
+    fs::{self, File},
+    io::{self, Read, Seek, SeekFrom, Write},
+    path::Path,
+    process::{Command, Stdio},
+    str::FromStr,
+};
+
+// The object is sampled at evenly spaced chunks, so huge objects are
+// analyzed in a bounded time.
+const SAMPLES: u64 = 8;
+const SAMPLE_SIZE: u64 = 256 * 1024;
+
+// Compression ratio above which compressing isn't worth the cost of
+// decompressing on the device.
+const MAX_RATIO: f64 = 0.9;
+
+/// Filter used to compress an object.
+#[derive(Clone, Copy, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Filter {
+    None,
+    Gzip,
+    Zstd,
+    Xz,
+}
+
+impl Filter {
+    fn tool(self) -> Option<&'static str> {
+        match self {
+            Filter::None => None,
+            Filter::Gzip => Some("gzip"),
+            Filter::Zstd => Some("zstd"),
+            Filter::Xz => Some("xz"),
+        }
+    }
+
+    // Arguments keeping the output stable for identical inputs, as gzip
+    // stores the file name and timestamp and multithreaded xz splits the
+    // input in blocks.
+    fn command(self, level: u32) -> Command {
+        let mut cmd = Command::new(self.tool().expect("filter has a tool"));
+        cmd.args(&[&format!("-{}", level), "-c"]);
+        match self {
+            Filter::Gzip => {
+                cmd.arg("-n");
+            }
+            Filter::Xz => {
+                cmd.arg("-T1");
+            }
+            Filter::None | Filter::Zstd => {}
+        }
+        cmd
+    }
+}
+
+/// CPU power of the target device, which bounds how costly the chosen
+/// filter can be to decompress.
+#[derive(Clone, Copy, Debug, PartialEq, PartialOrd)]
+pub enum CpuProfile {
+    Low,
+    Medium,
+    High,
+}
+
+impl FromStr for CpuProfile {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "low" => Ok(CpuProfile::Low),
+            "medium" => Ok(CpuProfile::Medium),
+            "high" => Ok(CpuProfile::High),
+            _ => Err(Error::UnsupportedCpuProfile(s.to_owned())),
+        }
+    }
+}
+
+impl fmt::Display for CpuProfile {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            CpuProfile::Low => "low",
+            CpuProfile::Medium => "medium",
+            CpuProfile::High => "high",
+        })
+    }
+}
+
+// Candidates in increasing order of decompression cost, along with the
+// lowest profile able to afford it.
+const CANDIDATES: &[(Filter, u32, CpuProfile)] = &[
+    (Filter::Gzip, 6, CpuProfile::Low),
+    (Filter::Zstd, 3, CpuProfile::Low),
+    (Filter::Zstd, 19, CpuProfile::Medium),
+    (Filter::Xz, 6, CpuProfile::High),
+];
+
+/// Compression chosen for an object.
+#[derive(Clone, Debug, PartialEq, Serialize)]
+pub struct Advice {
+    pub filter: Filter,
+    pub level: u32,
+    /// Compressed to uncompressed size ratio measured on the samples.
+    pub ratio: f64,
+}
+
+/// Metadata of a compressed object, ready to be merged into the object
+/// entry of the package metadata.
+#[derive(Debug, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct Metadata {
+    pub compressed: bool,
+    pub required_uncompressed_size: u64,
+    pub sha256sum: String,
+    pub size: u64,
+    pub compression: Advice,
+}
+
+/// Samples the `object` content, recommending the filter, among the ones
+/// the `profile` can afford, which compresses it best.
+pub fn analyze(object: &Path, profile: CpuProfile) -> Result<Advice> {
+    let sample = sample(object)?;
+    let mut advice = Advice { filter: Filter::None, level: 0, ratio: 1.0 };
+    if sample.is_empty() {
+        return Ok(advice);
+    }
+
+    for (filter, level, _) in CANDIDATES.iter().filter(|(_, _, min)| *min <= profile) {
+        let tool = filter.tool().expect("candidates have a tool");
+        if utils::fs::is_executable_in_path(tool).is_err() {
+            debug!("skipping {} as it is not available", tool);
+            continue;
+        }
+
+        let ratio = compressed_len(*filter, *level, &sample)? as f64 / sample.len() as f64;
+        debug!("{} -{} compresses the samples to {:.2}", tool, level, ratio);
+        if ratio < advice.ratio {
+            advice = Advice { filter: *filter, level: *level, ratio };
+        }
+    }
+
+    if advice.ratio > MAX_RATIO {
+        return Ok(Advice { filter: Filter::None, level: 0, ratio: 1.0 });
+    }
+
+    Ok(advice)
+}
+
+/// Compresses the `object` into `output` as `advice` recommends,
+/// returning its metadata which is also written alongside it, as
+/// `<output>.json`.
+pub fn compress(object: &Path, advice: &Advice, output: &Path) -> Result<Metadata> {
+    info!("compressing {:?} using {:?} (level {})", object, advice.filter, advice.level);
+    match advice.filter {
+        Filter::None => {
+            fs::copy(object, output)?;
+        }
+        filter => {
+            let status =
+                filter.command(advice.level).arg(object).stdout(File::create(output)?).status()?;
+            if !status.success() {
+                return Err(Error::CompressionFailed(status));
+            }
+        }
+    }
+
+    let metadata = Metadata {
+        compressed: advice.filter != Filter::None,
+        required_uncompressed_size: fs::metadata(object)?.len(),
+        sha256sum: utils::sha256sum_file(output)?,
+        size: fs::metadata(output)?.len(),
+        compression: advice.clone(),
+    };
+
+    let mut json = output.as_os_str().to_owned();
+    json.push(".json");
+    fs::write(json, serde_json::to_vec_pretty(&metadata)?)?;
+
+    Ok(metadata)
+}
+
+fn sample(object: &Path) -> io::Result<Vec<u8>> {
+    let mut file = File::open(object)?;
+    let len = file.metadata()?.len();
+    if len <= SAMPLES * SAMPLE_SIZE {
+        let mut buf = Vec::with_capacity(len as usize);
+        file.read_to_end(&mut buf)?;
+        return Ok(buf);
+    }
+
+    let stride = len / SAMPLES;
+    let mut buf = vec![0; (SAMPLES * SAMPLE_SIZE) as usize];
+    for (i, chunk) in buf.chunks_mut(SAMPLE_SIZE as usize).enumerate() {
+        file.seek(SeekFrom::Start(i as u64 * stride))?;
+        file.read_exact(chunk)?;
+    }
+
+    Ok(buf)
+}
+
+fn compressed_len(filter: Filter, level: u32, data: &[u8]) -> Result<usize> {
+    let mut child = filter.command(level).stdin(Stdio::piped()).stdout(Stdio::piped()).spawn()?;
+
+    // The input is fed from another thread so the tool doesn't block
+    // writing to a full stdout pipe.
+    let mut stdin = child.stdin.take().expect("stdin is piped");
+    let data = data.to_vec();
+    let writer = std::thread::spawn(move || stdin.write_all(&data));
+
+    let output = child.wait_with_output()?;
+    writer.join().expect("sample writer has panicked")?;
+    if !output.status.success() {
+        return Err(Error::CompressionFailed(output.status));
+    }
+
+    Ok(output.stdout.len())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn parse_profile() {
+        assert_eq!("low".parse::<CpuProfile>().unwrap(), CpuProfile::Low);
+        assert!("turbo".parse::<CpuProfile>().is_err());
+        assert!(CpuProfile::Low < CpuProfile::High);
+    }
+
+    #[test]
+    fn sample_large_object() {
+        let dir = tempfile::tempdir().unwrap();
+        let object = dir.path().join("object");
+        let file = File::create(&object).unwrap();
+        file.set_len(SAMPLES * SAMPLE_SIZE * 4).unwrap();
+
+        assert_eq!(sample(&object).unwrap().len() as u64, SAMPLES * SAMPLE_SIZE);
+    }
+
+    #[test]
+    fn recommend_compressing_redundant_content() {
+        if utils::fs::is_executable_in_path("gzip").is_err() {
+            return;
+        }
+        let dir = tempfile::tempdir().unwrap();
+        let object = dir.path().join("object");
+        fs::write(&object, vec![0; 1024 * 1024]).unwrap();
+
+        let advice = analyze(&object, CpuProfile::Low).unwrap();
+        assert_ne!(advice.filter, Filter::None);
+        assert_ne!(advice.filter, Filter::Xz);
+        assert!(advice.ratio < MAX_RATIO);
+    }
+
+    #[test]
+    fn keep_uncompressed_object() {
+        let dir = tempfile::tempdir().unwrap();
+        let (object, output) = (dir.path().join("object"), dir.path().join("output"));
+        fs::write(&object, b"content").unwrap();
+
+        let advice = Advice { filter: Filter::None, level: 0, ratio: 1.0 };
+        let metadata = compress(&object, &advice, &output).unwrap();
+        assert!(!metadata.compressed);
+        assert_eq!(metadata.required_uncompressed_size, 7);
+        assert_eq!(metadata.sha256sum, utils::sha256sum(b"content"));
+        assert!(dir.path().join("output.json").exists());
+    }
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use crate::utils;
+use serde::Serialize;
+use slog_scope::info;
+use std::{fmt, fs, path::Path, str::FromStr};
+
+/// Tool used to generate the delta between two objects.
+#[derive(Clone, Copy, Debug, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Method {
+    Zstd,
+    Bsdiff,
+}
+
+impl FromStr for Method {
+    type Err = Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "zstd" => Ok(Method::Zstd),
+            "bsdiff" => Ok(Method::Bsdiff),
+            _ => Err(Error::UnsupportedDeltaMethod(s.to_owned())),
+        }
+    }
+}
+
+impl fmt::Display for Method {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Method::Zstd => "zstd",
+            Method::Bsdiff => "bsdiff",
+        })
+    }
+}
+
+/// Describes a generated delta, so the server can offer it to the
+/// devices which have the `base` object installed.
+#[derive(Debug, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct Metadata {
+    pub method: Method,
+    /// sha256sum of the installed object the delta applies over.
+    pub base: String,
+    /// sha256sum of the object rebuilt by applying the delta.
+    pub sha256sum: String,
+    /// sha256sum and size of the delta itself.
+    pub delta_sha256sum: String,
+    pub delta_size: u64,
+}
+
+/// Generates the delta from the `base` to the `target` object into
+/// `output`, returning its metadata which is also written alongside
+/// it, as `<output>.json`.
+pub fn generate(method: Method, base: &Path, target: &Path, output: &Path) -> Result<Metadata> {
+    info!("generating {} delta from {:?} to {:?}", method, base, target);
+    match method {
+        Method::Zstd => {
+            utils::fs::is_executable_in_path("zstd")?;
+            easy_process::run(&format!(
+                "zstd -19 -f -q --long=31 --patch-from={} {} -o {}",
+                base.display(),
+                target.display(),
+                output.display()
+            ))?;
+        }
+        Method::Bsdiff => {
+            utils::fs::is_executable_in_path("bsdiff")?;
+            easy_process::run(&format!(
+                "bsdiff {} {} {}",
+                base.display(),
+                target.display(),
+                output.display()
+            ))?;
+        }
+    }
+
+    let metadata = Metadata {
+        method,
+        base: utils::sha256sum_file(base)?,
+        sha256sum: utils::sha256sum_file(target)?,
+        delta_sha256sum: utils::sha256sum_file(output)?,
+        delta_size: fs::metadata(output)?.len(),
+    };
+
+    let mut json = output.as_os_str().to_owned();
+    json.push(".json");
+    fs::write(json, serde_json::to_vec_pretty(&metadata)?)?;
+
+    Ok(metadata)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn parse_method() {
+        assert_eq!("zstd".parse::<Method>().unwrap(), Method::Zstd);
+        assert_eq!("bsdiff".parse::<Method>().unwrap(), Method::Bsdiff);
+        assert!("xdelta".parse::<Method>().is_err());
+    }
+
+    #[test]
+    fn generate_bsdiff() {
+        let (_handle, calls) = create_echo_bins(&["bsdiff"]).unwrap();
+        let dir = tempfile::tempdir().unwrap();
+        let (base, target, output) =
+            (dir.path().join("base"), dir.path().join("target"), dir.path().join("patch"));
+        fs::write(&base, b"base").unwrap();
+        fs::write(&target, b"target").unwrap();
+        // The echo bin doesn't write the patch, so it is faked here
+        fs::write(&output, b"patch").unwrap();
+
+        let metadata = generate(Method::Bsdiff, &base, &target, &output).unwrap();
+        assert_eq!(
+            fs::read_to_string(calls).unwrap(),
+            format!("bsdiff {} {} {}\n", base.display(), target.display(), output.display())
+        );
+        assert_eq!(metadata.base, utils::sha256sum(b"base"));
+        assert_eq!(metadata.sha256sum, utils::sha256sum(b"target"));
+        assert_eq!(metadata.delta_sha256sum, utils::sha256sum(b"patch"));
+        assert_eq!(metadata.delta_size, 5);
+        assert!(dir.path().join("patch.json").exists());
+    }
+}
@@ -0,0 +1,168 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use crate::{
+    object::{self, Info as _},
+    update_package::{Signature, UpdatePackage},
+    utils,
+};
+use pkg_schema::{definitions::TargetType, Object, SupportedHardware};
+use serde::{Serialize, Serializer};
+use slog_scope::debug;
+use std::{
+    fs::File,
+    io::{Seek, SeekFrom},
+    path::{Path, PathBuf},
+};
+
+/// What an update package holds, as read from its metadata.
+#[derive(Debug, Serialize)]
+pub struct PackageInfo {
+    pub package_uid: String,
+    pub product_uid: String,
+    pub version: String,
+    #[serde(serialize_with = "serialize_hardware")]
+    pub supported_hardware: SupportedHardware,
+    pub requires_agent: Option<String>,
+    pub mandatory: bool,
+    pub signature: SignatureStatus,
+    /// Objects of each installation set.
+    pub objects: (Vec<ObjectInfo>, Vec<ObjectInfo>),
+}
+
+#[derive(Debug, Serialize)]
+pub struct ObjectInfo {
+    pub filename: String,
+    pub mode: &'static str,
+    pub target: Option<String>,
+    /// Path the object is written to, inside the target.
+    pub target_path: Option<PathBuf>,
+    pub size: u64,
+    pub sha256sum: String,
+    pub compressed: bool,
+}
+
+#[derive(Debug, PartialEq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SignatureStatus {
+    Missing,
+    /// The package is signed, but no key has been given to validate it.
+    Unverified,
+    Valid,
+    Invalid(String),
+}
+
+/// Reads the metadata of the `package`, validating its signature with
+/// the public `key`, when given.
+pub fn inspect(package: &Path, key: Option<&Path>) -> Result<PackageInfo> {
+    debug!("inspecting package {:?}", package);
+    let mut source = File::open(package)?;
+    let mut metadata = Vec::with_capacity(1024);
+    utils::archive::uncompress_archive_file(package, &mut source, &mut metadata, "metadata")?;
+    let update_package = UpdatePackage::parse(&metadata)?;
+
+    let mut sign = Vec::with_capacity(512);
+    source.seek(SeekFrom::Start(0))?;
+    let signature =
+        match compress_tools::uncompress_archive_file(&mut source, &mut sign, "signature") {
+            Ok(_) => match key {
+                Some(key) => match String::from_utf8(sign)
+                    .map_err(|e| e.to_string())
+                    .and_then(|s| Signature::from_base64_str(&s).map_err(|e| e.to_string()))
+                    .and_then(|s| s.validate(key, &update_package).map_err(|e| e.to_string()))
+                {
+                    Ok(_) => SignatureStatus::Valid,
+                    Err(e) => SignatureStatus::Invalid(e),
+                },
+                None => SignatureStatus::Unverified,
+            },
+            Err(compress_tools::Error::FileNotFound) => SignatureStatus::Missing,
+            Err(e) => return Err(utils::Error::from(e).into()),
+        };
+
+    let package_uid = update_package.package_uid();
+    let inner = update_package.inner;
+    Ok(PackageInfo {
+        package_uid,
+        product_uid: inner.product_uid,
+        version: inner.version,
+        supported_hardware: inner.supported_hardware,
+        requires_agent: inner.requires_agent,
+        mandatory: inner.mandatory,
+        signature,
+        objects: (
+            inner.objects.0.iter().map(object_info).collect(),
+            inner.objects.1.iter().map(object_info).collect(),
+        ),
+    })
+}
+
+fn serialize_hardware<S: Serializer>(
+    hardware: &SupportedHardware,
+    serializer: S,
+) -> std::result::Result<S::Ok, S::Error> {
+    match hardware {
+        SupportedHardware::Any => serializer.serialize_str("any"),
+        SupportedHardware::HardwareList(list) => list.serialize(serializer),
+    }
+}
+
+fn object_info(object: &Object) -> ObjectInfo {
+    let (target_path, compressed) = match object {
+        Object::Copy(o) => (Some(o.target_path.clone()), o.compressed),
+        Object::Tarball(o) => (Some(o.target_path.clone()), false),
+        Object::Raw(o) => (None, o.compressed),
+        Object::Ubifs(o) => (None, o.compressed),
+        Object::Agent(_)
+        | Object::DiskImage(_)
+        | Object::Flash(_)
+        | Object::Fpga(_)
+        | Object::Imxkobs(_)
+        | Object::Script(_)
+        | Object::Test(_) => (None, false),
+    };
+
+    ObjectInfo {
+        filename: object.filename().to_owned(),
+        mode: object::mode(object),
+        target: object::target_type(object).map(|target| match target {
+            TargetType::Device(path) => path.display().to_string(),
+            TargetType::UBIVolume(volume) => format!("ubi volume {}", volume),
+            TargetType::MTDName(name) => format!("mtd {}", name),
+            TargetType::LVMVolume(volume) => format!("lvm volume {}", volume),
+        }),
+        target_path,
+        size: object.len(),
+        sha256sum: object.sha256sum().to_owned(),
+        compressed,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{pkg::package::Builder, update_package::tests::get_update_json};
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn inspect_package() {
+        let dir = tempfile::tempdir().unwrap();
+        let package = dir.path().join("package.uhupkg");
+        let metadata = get_update_json("sha256sum").to_string().into_bytes();
+        Builder::new(metadata.clone()).write(&package).unwrap();
+
+        let info = inspect(&package, None).unwrap();
+        assert_eq!(info.package_uid, UpdatePackage::parse(&metadata).unwrap().package_uid());
+        assert_eq!(info.version, "1.0");
+        assert_eq!(info.signature, SignatureStatus::Missing);
+        assert_eq!(info.objects.0.len(), 1);
+        assert_eq!(info.objects.0[0].mode, "test");
+        assert_eq!(info.objects.0[0].size, 10);
+        assert_eq!(info.objects.1[0].sha256sum, "sha256sum");
+
+        Builder::new(metadata).signature(b"c2lnbmF0dXJl".to_vec()).write(&package).unwrap();
+        assert_eq!(inspect(&package, None).unwrap().signature, SignatureStatus::Unverified);
+    }
+}
@@ -0,0 +1,123 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{package::Builder, Error, Result};
+use crate::{
+    update_package::{Signature, UpdatePackage},
+    utils,
+};
+use serde_json::Value;
+use slog_scope::debug;
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+/// Creates an update package from the `manifest`, signing it with the
+/// RSA private `key`, when given.
+///
+/// The manifest is the package metadata with each object `filename`
+/// set to the object path, relative to the manifest. Their sha256sum
+/// and size are filled in from the files, and the metadata is parsed
+/// as the agent does, so packages it would refuse aren't created.
+pub fn create(manifest: &Path, key: Option<&Path>, output: &Path) -> Result<()> {
+    let base = manifest.parent().unwrap_or_else(|| Path::new("."));
+    let mut metadata = serde_json::from_slice::<Value>(&fs::read(manifest)?)?;
+    let sets = metadata
+        .get_mut("objects")
+        .and_then(Value::as_array_mut)
+        .ok_or_else(|| Error::InvalidManifest("objects are missing".to_owned()))?;
+
+    let mut objects = Vec::new();
+    for set in sets.iter_mut() {
+        let set = set
+            .as_array_mut()
+            .ok_or_else(|| Error::InvalidManifest("installation set isn't a list".to_owned()))?;
+        for object in set.iter_mut() {
+            objects.push(fill_object(base, object)?);
+        }
+    }
+
+    let metadata = serde_json::to_vec(&metadata)?;
+    let package = UpdatePackage::parse(&metadata)?;
+    let mut builder = Builder::new(metadata);
+    if let Some(key) = key {
+        debug!("signing package with {:?}", key);
+        builder = builder.signature(Signature::sign(key, &package)?.to_base64().into_bytes());
+    }
+    for path in objects {
+        builder = builder.object(&path)?;
+    }
+    builder.write(output)
+}
+
+// Fills in the object checksum and size, returning the path it is
+// read from.
+fn fill_object(base: &Path, object: &mut Value) -> Result<PathBuf> {
+    let object = object
+        .as_object_mut()
+        .ok_or_else(|| Error::InvalidManifest("object isn't a map".to_owned()))?;
+    let path = object
+        .get("filename")
+        .and_then(Value::as_str)
+        .map(|filename| base.join(filename))
+        .ok_or_else(|| Error::InvalidManifest("object filename is missing".to_owned()))?;
+    let filename = path
+        .file_name()
+        .and_then(|name| name.to_str())
+        .ok_or_else(|| Error::InvalidManifest(format!("invalid object path {:?}", path)))?;
+
+    object.insert("filename".to_owned(), filename.into());
+    object.insert("sha256sum".to_owned(), utils::sha256sum_file(&path)?.into());
+    object.insert("size".to_owned(), fs::metadata(&path)?.len().into());
+    Ok(path)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::pkg::info::{inspect, SignatureStatus};
+    use openssl::rsa::Rsa;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn create_signed_package() {
+        let dir = tempfile::tempdir().unwrap();
+        let (manifest, package) = (dir.path().join("manifest.json"), dir.path().join("pkg"));
+        fs::create_dir(dir.path().join("images")).unwrap();
+        fs::write(dir.path().join("images/rootfs.img"), b"rootfs").unwrap();
+        let object = json!({
+            "mode": "raw",
+            "filename": "images/rootfs.img",
+            "target-type": "device",
+            "target": "/dev/sda1"
+        });
+        let content = json!({
+            "product": "0123456789",
+            "version": "1.0",
+            "supported-hardware": "any",
+            "objects": [[object], [object]]
+        });
+        fs::write(&manifest, content.to_string()).unwrap();
+
+        let rsa = Rsa::generate(2048).unwrap();
+        let (private, public) = (dir.path().join("key.pem"), dir.path().join("pub.pem"));
+        fs::write(&private, rsa.private_key_to_pem().unwrap()).unwrap();
+        fs::write(&public, rsa.public_key_to_pem().unwrap()).unwrap();
+
+        create(&manifest, Some(&private), &package).unwrap();
+        let info = inspect(&package, Some(&public)).unwrap();
+        assert_eq!(info.signature, SignatureStatus::Valid);
+        assert_eq!(info.objects.0[0].filename, "rootfs.img");
+        assert_eq!(info.objects.0[0].size, 6);
+        assert_eq!(
+            info.objects.0[0].sha256sum,
+            utils::sha256sum_file(&dir.path().join("images/rootfs.img")).unwrap()
+        );
+
+        fs::write(&manifest, json!({ "product": "0123456789" }).to_string()).unwrap();
+        assert!(create(&manifest, None, &package).is_err());
+    }
+}
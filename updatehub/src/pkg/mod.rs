@@ -0,0 +1,53 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Tooling used by package builders to prepare the objects served to
+//! the devices.
+
+pub mod compression;
+pub mod delta;
+pub mod info;
+pub mod manifest;
+pub mod package;
+pub mod swupdate;
+
+use thiserror::Error;
+
+pub type Result<T> = std::result::Result<T, Error>;
+
+#[derive(Debug, Error)]
+pub enum Error {
+    #[error("Io error: {0}")]
+    Io(#[from] std::io::Error),
+
+    #[error("Process error: {0}")]
+    Process(#[from] easy_process::Error),
+
+    #[error("Utils error: {0}")]
+    Utils(#[from] crate::utils::Error),
+
+    #[error("Update package error: {0}")]
+    UpdatePackage(#[from] cloud::Error),
+
+    #[error("Json error: {0}")]
+    Json(#[from] serde_json::Error),
+
+    #[error("Invalid manifest: {0}")]
+    InvalidManifest(String),
+
+    #[error("Unsupported delta method: {0}")]
+    UnsupportedDeltaMethod(String),
+
+    #[error("Unsupported CPU profile: {0}")]
+    UnsupportedCpuProfile(String),
+
+    #[error("Invalid sw-description: {0}")]
+    InvalidSwDescription(String),
+
+    #[error("SWUpdate entries without a matching install mode: {0}")]
+    UnsupportedSwEntries(String),
+
+    #[error("Compression has failed: {0}")]
+    CompressionFailed(std::process::ExitStatus),
+}
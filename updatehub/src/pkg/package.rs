@@ -0,0 +1,125 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use crate::utils;
+use slog_scope::{debug, info};
+use std::{
+    collections::BTreeMap,
+    fs::File,
+    io::{self, Read},
+    path::{Path, PathBuf},
+};
+
+/// Builds `.uhupkg` files which are byte-identical for identical inputs,
+/// so release artifacts can be independently verified. The entries are
+/// written in a fixed order, with the ownership, permissions and
+/// timestamps normalized.
+pub struct Builder {
+    metadata: Vec<u8>,
+    signature: Option<Vec<u8>>,
+    objects: BTreeMap<String, PathBuf>,
+    mtime: u64,
+}
+
+impl Builder {
+    /// Starts a package with the given `metadata`. The entries timestamp
+    /// is taken from `SOURCE_DATE_EPOCH`, when set, or zeroed.
+    pub fn new(metadata: Vec<u8>) -> Self {
+        let mtime =
+            std::env::var("SOURCE_DATE_EPOCH").ok().and_then(|s| s.parse().ok()).unwrap_or(0);
+        Builder { metadata, signature: None, objects: BTreeMap::default(), mtime }
+    }
+
+    pub fn signature(mut self, signature: Vec<u8>) -> Self {
+        self.signature = Some(signature);
+        self
+    }
+
+    /// Adds the object, which is stored named after its sha256sum.
+    pub fn object(mut self, path: &Path) -> Result<Self> {
+        let sha256sum = utils::sha256sum_file(path)?;
+        debug!("adding {:?} as {}", path, sha256sum);
+        self.objects.insert(sha256sum, path.to_owned());
+        Ok(self)
+    }
+
+    pub fn write(&self, output: &Path) -> Result<()> {
+        info!("writing package to {:?}", output);
+        let mut archive = tar::Builder::new(File::create(output)?);
+
+        self.append(&mut archive, "metadata", self.metadata.len() as u64, &self.metadata[..])?;
+        if let Some(ref signature) = self.signature {
+            self.append(&mut archive, "signature", signature.len() as u64, &signature[..])?;
+        }
+        // The objects are kept sorted by name, so their order doesn't
+        // depend on the order they were given.
+        for (name, path) in &self.objects {
+            let file = File::open(path)?;
+            self.append(&mut archive, name, file.metadata()?.len(), file)?;
+        }
+
+        archive.into_inner()?.sync_all()?;
+        Ok(())
+    }
+
+    fn append<W: io::Write, R: Read>(
+        &self,
+        archive: &mut tar::Builder<W>,
+        name: &str,
+        size: u64,
+        data: R,
+    ) -> io::Result<()> {
+        let mut header = tar::Header::new_ustar();
+        header.set_size(size);
+        header.set_mode(0o644);
+        header.set_uid(0);
+        header.set_gid(0);
+        header.set_mtime(self.mtime);
+        header.set_entry_type(tar::EntryType::Regular);
+        archive.append_data(&mut header, name, data)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use std::fs;
+
+    #[test]
+    fn reproducible_package() {
+        let dir = tempfile::tempdir().unwrap();
+        let (first, second) = (dir.path().join("first"), dir.path().join("second"));
+        let objects = ["a", "b"].iter().map(|n| dir.path().join(n)).collect::<Vec<_>>();
+        for object in &objects {
+            fs::write(object, object.to_string_lossy().as_bytes()).unwrap();
+        }
+
+        Builder::new(b"{}".to_vec())
+            .object(&objects[0])
+            .unwrap()
+            .object(&objects[1])
+            .unwrap()
+            .write(&first)
+            .unwrap();
+        Builder::new(b"{}".to_vec())
+            .object(&objects[1])
+            .unwrap()
+            .object(&objects[0])
+            .unwrap()
+            .write(&second)
+            .unwrap();
+        assert_eq!(fs::read(&first).unwrap(), fs::read(&second).unwrap());
+
+        let mut metadata = Vec::default();
+        compress_tools::uncompress_archive_file(
+            &mut File::open(&first).unwrap(),
+            &mut metadata,
+            "metadata",
+        )
+        .unwrap();
+        assert_eq!(metadata, b"{}");
+    }
+}
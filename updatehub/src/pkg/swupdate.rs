@@ -0,0 +1,685 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Conversion of SWUpdate `.swu` packages into update packages, so the
+//! build pipelines producing them can be migrated gradually.
+//!
+//! The `sw-description` entries are mapped onto the install modes whose
+//! semantics match: the raw images to `raw`, the UBI volumes to `ubifs`,
+//! the MTD images to `flash`, the archives to `tarball` and the raw files
+//! to `copy`. The others, as the scripts and the bootloader environment,
+//! have no counterpart and are reported as skipped.
+
+use super::{manifest, Error, Result};
+use crate::utils;
+use serde::Serialize;
+use serde_json::{json, Map};
+use slog_scope::{info, warn};
+use std::{
+    fs::{self, File},
+    io,
+    path::Path,
+};
+
+const DESCRIPTION: &str = "sw-description";
+const COLLECTIONS: &[&str] = &["images", "files", "scripts", "bootenv", "uboot", "partitions"];
+
+/// How the `.swu` package is converted.
+#[derive(Debug, Default)]
+pub struct Options {
+    /// Product the update package is built for, which SWUpdate has no
+    /// notion of.
+    pub product: String,
+    /// Dotted path, inside `software`, of the board or selection to be
+    /// converted, as `myboard.stable`.
+    pub selection: Option<String>,
+    /// Converts the package even when some entries have no matching
+    /// install mode, leaving them out.
+    pub skip_unsupported: bool,
+}
+
+/// Entry of the `sw-description` along with the install mode it has
+/// been converted to, or the reason it has been skipped.
+#[derive(Debug, PartialEq, Serialize)]
+#[serde(rename_all = "kebab-case")]
+pub struct Entry {
+    pub collection: String,
+    pub filename: String,
+    pub mode: Option<String>,
+    pub skipped: Option<String>,
+}
+
+/// Converts the `swu` package into an update package for the product,
+/// signing it with the RSA private `key`, when given. The entries of the
+/// `sw-description` are returned, so the result can be reviewed.
+///
+/// When the selection holds two software sets, as `copy1` and `copy2`,
+/// they become the installation sets, in order. A single set is used for
+/// both installation sets.
+pub fn convert(
+    swu: &Path,
+    options: &Options,
+    key: Option<&Path>,
+    output: &Path,
+) -> Result<Vec<Entry>> {
+    info!("converting SWUpdate package {:?}", swu);
+    let dir = tempfile::tempdir()?;
+    utils::archive::uncompress_archive(swu, dir.path(), compress_tools::Ownership::Ignore)?;
+    let description = parse(&fs::read_to_string(dir.path().join(DESCRIPTION))?)?;
+    let software =
+        description.get("software").ok_or_else(|| invalid("software section is missing"))?;
+
+    let mut path = vec![software];
+    for name in options.selection.iter().flat_map(|s| s.split('.')) {
+        let node = path[path.len() - 1]
+            .get(name)
+            .ok_or_else(|| invalid(&format!("selection {} is missing", name)))?;
+        path.push(node);
+    }
+    let sets = software_sets(path[path.len() - 1])?;
+
+    let mut entries = Vec::new();
+    let mut objects = Vec::new();
+    for (i, set) in sets.iter().enumerate() {
+        let mut set_objects = Vec::new();
+        for (collection, item) in COLLECTIONS
+            .iter()
+            .filter_map(|c| set.get(c).map(|items| (*c, items)))
+            .flat_map(|(c, items)| items.items().iter().map(move |item| (c, item)))
+        {
+            let (entry, object) = convert_entry(dir.path(), collection, item)?;
+            if let Some(object) = object {
+                set_objects.push(object);
+            }
+            // The entries of the duplicated set are only reported once.
+            if i == 0 || !std::ptr::eq(sets[0], sets[1]) {
+                entries.push(entry);
+            }
+        }
+        objects.push(serde_json::Value::Array(set_objects));
+    }
+
+    let skipped = entries
+        .iter()
+        .filter_map(|e| e.skipped.as_ref().map(|reason| format!("{} ({})", e.filename, reason)))
+        .collect::<Vec<_>>();
+    if !skipped.is_empty() {
+        if !options.skip_unsupported {
+            return Err(Error::UnsupportedSwEntries(skipped.join(", ")));
+        }
+        warn!("leaving out unsupported entries: {}", skipped.join(", "));
+    }
+
+    // The hardware compatibility closest to the selection prevails.
+    let hardware = path
+        .iter()
+        .rev()
+        .find_map(|node| node.get("hardware-compatibility"))
+        .map(|hw| json!(hw.items().iter().filter_map(Value::as_str).collect::<Vec<_>>()))
+        .unwrap_or_else(|| json!("any"));
+    let version = software
+        .get("version")
+        .or_else(|| description.get("version"))
+        .and_then(Value::as_str)
+        .ok_or_else(|| invalid("version is missing"))?;
+
+    let manifest = dir.path().join("manifest.json");
+    fs::write(
+        &manifest,
+        json!({
+            "product": options.product,
+            "version": version,
+            "supported-hardware": hardware,
+            "objects": objects,
+        })
+        .to_string(),
+    )?;
+    manifest::create(&manifest, key, output)?;
+
+    Ok(entries)
+}
+
+// The software sets are the groups holding the collections, either the
+// selected node itself or its children.
+fn software_sets(node: &Value) -> Result<[&Value; 2]> {
+    if is_software_set(node) {
+        return Ok([node, node]);
+    }
+
+    let sets =
+        node.settings().iter().map(|(_, v)| v).filter(|v| is_software_set(v)).collect::<Vec<_>>();
+    match sets[..] {
+        [set] => Ok([set, set]),
+        [first, second] => Ok([first, second]),
+        [] => Err(invalid("no images found, the selection may be missing")),
+        _ => Err(invalid("more than two software sets found, a selection is required")),
+    }
+}
+
+fn is_software_set(node: &Value) -> bool {
+    COLLECTIONS.iter().any(|c| node.get(c).is_some())
+}
+
+fn convert_entry(
+    dir: &Path,
+    collection: &str,
+    item: &Value,
+) -> Result<(Entry, Option<serde_json::Value>)> {
+    let filename = item.get("filename").and_then(Value::as_str);
+    let mut entry = Entry {
+        collection: collection.to_owned(),
+        filename: filename
+            .or_else(|| item.get("name").and_then(Value::as_str))
+            .unwrap_or_default()
+            .to_owned(),
+        mode: None,
+        skipped: None,
+    };
+
+    let filename = match filename {
+        Some(filename) => filename,
+        None => {
+            entry.skipped = Some(format!("{} entries have no counterpart", collection));
+            return Ok((entry, None));
+        }
+    };
+    let path = dir.join(filename);
+    if let Some(expected) = item.get("sha256").and_then(Value::as_str) {
+        if !expected.eq_ignore_ascii_case(&utils::sha256sum_file(&path)?) {
+            return Err(invalid(&format!("sha256 of {} doesn't match", filename)));
+        }
+    }
+
+    match object(collection, item)? {
+        Ok(mut object) => {
+            if is_compressed(item) {
+                let size = utils::archive::uncompress_data(&path, File::open(&path)?, io::sink())?;
+                object.insert("compressed".to_owned(), true.into());
+                object.insert("required-uncompressed-size".to_owned(), size.into());
+            }
+            object.insert("filename".to_owned(), filename.into());
+            entry.mode = object.get("mode").and_then(|m| m.as_str()).map(str::to_owned);
+            Ok((entry, Some(object.into())))
+        }
+        Err(reason) => {
+            entry.skipped = Some(reason);
+            Ok((entry, None))
+        }
+    }
+}
+
+// Maps the entry onto an object, or gives why it can't be.
+fn object(
+    collection: &str,
+    item: &Value,
+) -> Result<std::result::Result<Map<String, serde_json::Value>, String>> {
+    if item.get("encrypted").and_then(Value::as_bool).unwrap_or_default() {
+        return Ok(Err("encrypted entries aren't supported".to_owned()));
+    }
+    let string = |name| item.get(name).and_then(Value::as_str);
+    let kind = string("type");
+    let object = match (collection, kind) {
+        ("images", None) | ("images", Some("raw")) => match string("device") {
+            Some(_) if item.get("offset").is_some() => {
+                return Ok(Err("raw images written at an offset aren't supported".to_owned()))
+            }
+            Some(device) => json!({ "mode": "raw", "target-type": "device", "target": device }),
+            None => return Ok(Err("raw images need a device".to_owned())),
+        },
+        ("images", Some("ubivol")) => match string("volume") {
+            Some(volume) => {
+                json!({ "mode": "ubifs", "target-type": "ubivolume", "target": volume })
+            }
+            None => return Ok(Err("UBI volume images need a volume".to_owned())),
+        },
+        ("images", Some("flash")) => match string("device") {
+            Some(device) if device.starts_with('/') => {
+                json!({ "mode": "flash", "target-type": "device", "target": device })
+            }
+            Some(device) => json!({ "mode": "flash", "target-type": "mtdname", "target": device }),
+            None => return Ok(Err("flash images need a device".to_owned())),
+        },
+        ("images", Some("archive")) | ("files", Some("archive")) => {
+            match (string("device"), string("filesystem"), string("path")) {
+                (Some(device), Some(filesystem), Some(path)) => json!({
+                    "mode": "tarball",
+                    "target-type": "device",
+                    "target": device,
+                    "filesystem": filesystem,
+                    "target-path": path,
+                }),
+                _ => {
+                    return Ok(Err(
+                        "archives need a device, filesystem and path to be extracted to".to_owned(),
+                    ))
+                }
+            }
+        }
+        ("files", None) | ("files", Some("rawfile")) => {
+            match (string("device"), string("filesystem"), string("path")) {
+                (Some(device), Some(filesystem), Some(path)) => json!({
+                    "mode": "copy",
+                    "target-type": "device",
+                    "target": device,
+                    "filesystem": filesystem,
+                    "target-path": path,
+                }),
+                _ => {
+                    return Ok(Err(
+                        "files need a device, filesystem and path to be copied to".to_owned()
+                    ))
+                }
+            }
+        }
+        ("scripts", _) => {
+            return Ok(Err("scripts follow the SWUpdate calling convention".to_owned()))
+        }
+        (_, Some(kind)) => return Ok(Err(format!("{} handler has no counterpart", kind))),
+        (_, None) => return Ok(Err(format!("{} entries have no counterpart", collection))),
+    };
+
+    match object {
+        serde_json::Value::Object(object) => Ok(Ok(object)),
+        _ => unreachable!("objects are built as maps"),
+    }
+}
+
+// Compression is given as `true`, for zlib, or the compressor name.
+fn is_compressed(item: &Value) -> bool {
+    match item.get("compressed") {
+        Some(Value::Bool(compressed)) => *compressed,
+        Some(Value::Str(compressor)) => compressor != "false",
+        _ => false,
+    }
+}
+
+fn invalid(message: &str) -> Error {
+    Error::InvalidSwDescription(message.to_owned())
+}
+
+/// Value of the `sw-description`, which keeps the order of the settings
+/// so the software sets are taken in the order they are described.
+#[derive(Debug, PartialEq)]
+enum Value {
+    Bool(bool),
+    Int(i64),
+    Float(f64),
+    Str(String),
+    List(Vec<Value>),
+    Group(Vec<(String, Value)>),
+}
+
+impl Value {
+    fn get(&self, name: &str) -> Option<&Value> {
+        self.settings().iter().find(|(n, _)| n == name).map(|(_, v)| v)
+    }
+
+    fn settings(&self) -> &[(String, Value)] {
+        match self {
+            Value::Group(settings) => settings,
+            _ => &[],
+        }
+    }
+
+    fn items(&self) -> &[Value] {
+        match self {
+            Value::List(items) => items,
+            _ => &[],
+        }
+    }
+
+    fn as_str(&self) -> Option<&str> {
+        match self {
+            Value::Str(s) => Some(s),
+            _ => None,
+        }
+    }
+
+    fn as_bool(&self) -> Option<bool> {
+        match self {
+            Value::Bool(b) => Some(*b),
+            _ => None,
+        }
+    }
+}
+
+impl From<serde_json::Value> for Value {
+    fn from(value: serde_json::Value) -> Self {
+        match value {
+            serde_json::Value::Null => Value::List(Vec::default()),
+            serde_json::Value::Bool(b) => Value::Bool(b),
+            serde_json::Value::Number(n) => match n.as_i64() {
+                Some(n) => Value::Int(n),
+                None => Value::Float(n.as_f64().unwrap_or_default()),
+            },
+            serde_json::Value::String(s) => Value::Str(s),
+            serde_json::Value::Array(items) => {
+                Value::List(items.into_iter().map(Value::from).collect())
+            }
+            serde_json::Value::Object(settings) => {
+                Value::Group(settings.into_iter().map(|(n, v)| (n, Value::from(v))).collect())
+            }
+        }
+    }
+}
+
+// Parses the `sw-description`, which is written in the libconfig syntax
+// or, when SWUpdate is built with it, in JSON.
+fn parse(description: &str) -> Result<Value> {
+    if description.trim_start().starts_with('{') {
+        return Ok(serde_json::from_str::<serde_json::Value>(description)?.into());
+    }
+
+    let mut parser = Parser { input: description.as_bytes(), pos: 0 };
+    let settings = parser.settings(None)?;
+    Ok(Value::Group(settings))
+}
+
+struct Parser<'a> {
+    input: &'a [u8],
+    pos: usize,
+}
+
+impl<'a> Parser<'a> {
+    fn settings(&mut self, end: Option<u8>) -> Result<Vec<(String, Value)>> {
+        let mut settings = Vec::new();
+        loop {
+            match (self.peek(), end) {
+                (None, None) => return Ok(settings),
+                (Some(c), Some(end)) if c == end => {
+                    self.pos += 1;
+                    return Ok(settings);
+                }
+                (None, Some(_)) => return Err(self.error("unterminated group")),
+                _ => {}
+            }
+
+            let name = self.name()?;
+            match self.peek() {
+                Some(b'=') | Some(b':') => self.pos += 1,
+                _ => return Err(self.error("expected '=' or ':'")),
+            }
+            let value = self.value()?;
+            if let Some(b';') | Some(b',') = self.peek() {
+                self.pos += 1;
+            }
+            settings.push((name, value));
+        }
+    }
+
+    fn value(&mut self) -> Result<Value> {
+        match self.peek() {
+            Some(b'{') => {
+                self.pos += 1;
+                Ok(Value::Group(self.settings(Some(b'}'))?))
+            }
+            Some(b'(') => {
+                self.pos += 1;
+                Ok(Value::List(self.items(b')')?))
+            }
+            Some(b'[') => {
+                self.pos += 1;
+                Ok(Value::List(self.items(b']')?))
+            }
+            Some(b'"') => {
+                // Adjacent strings are concatenated.
+                let mut s = String::new();
+                while let Some(b'"') = self.peek() {
+                    s.push_str(&self.string()?);
+                }
+                Ok(Value::Str(s))
+            }
+            Some(_) => self.scalar(),
+            None => Err(self.error("expected a value")),
+        }
+    }
+
+    fn items(&mut self, end: u8) -> Result<Vec<Value>> {
+        let mut items = Vec::new();
+        loop {
+            match self.peek() {
+                Some(c) if c == end => {
+                    self.pos += 1;
+                    return Ok(items);
+                }
+                Some(b',') if !items.is_empty() => self.pos += 1,
+                None => return Err(self.error("unterminated list")),
+                _ => items.push(self.value()?),
+            }
+        }
+    }
+
+    fn string(&mut self) -> Result<String> {
+        self.pos += 1;
+        let mut s = Vec::new();
+        loop {
+            match self.input.get(self.pos) {
+                Some(b'"') => {
+                    self.pos += 1;
+                    return String::from_utf8(s).map_err(|_| self.error("invalid string"));
+                }
+                Some(b'\\') => {
+                    self.pos += 1;
+                    s.push(match self.input.get(self.pos) {
+                        Some(b'n') => b'\n',
+                        Some(b't') => b'\t',
+                        Some(b'r') => b'\r',
+                        Some(b'f') => 0x0c,
+                        Some(&c) => c,
+                        None => return Err(self.error("unterminated string")),
+                    });
+                    self.pos += 1;
+                }
+                Some(&c) => {
+                    s.push(c);
+                    self.pos += 1;
+                }
+                None => return Err(self.error("unterminated string")),
+            }
+        }
+    }
+
+    fn scalar(&mut self) -> Result<Value> {
+        let token = self.token(|c| c.is_ascii_alphanumeric() || b"+-._".contains(&c));
+        let lower = token.to_ascii_lowercase();
+        let number = lower.trim_end_matches('l');
+        if lower == "true" || lower == "false" {
+            Ok(Value::Bool(lower == "true"))
+        } else if number.starts_with("0x") {
+            i64::from_str_radix(&number[2..], 16)
+                .map(Value::Int)
+                .map_err(|_| self.error("invalid integer"))
+        } else if let Ok(n) = number.parse::<i64>() {
+            Ok(Value::Int(n))
+        } else {
+            token.parse::<f64>().map(Value::Float).map_err(|_| self.error("invalid value"))
+        }
+    }
+
+    fn name(&mut self) -> Result<String> {
+        let name = self.token(|c| c.is_ascii_alphanumeric() || b"-_*".contains(&c));
+        if name.is_empty() {
+            return Err(self.error("expected a setting name"));
+        }
+        Ok(name)
+    }
+
+    fn token(&mut self, allowed: impl Fn(u8) -> bool) -> String {
+        self.skip_blank();
+        let start = self.pos;
+        while self.input.get(self.pos).map_or(false, |&c| allowed(c)) {
+            self.pos += 1;
+        }
+        String::from_utf8_lossy(&self.input[start..self.pos]).into_owned()
+    }
+
+    // Returns the next character, after the blanks and comments.
+    fn peek(&mut self) -> Option<u8> {
+        self.skip_blank();
+        self.input.get(self.pos).copied()
+    }
+
+    fn skip_blank(&mut self) {
+        loop {
+            let rest = &self.input[self.pos..];
+            if rest.first().map_or(false, u8::is_ascii_whitespace) {
+                self.pos += 1;
+            } else if rest.starts_with(b"#") || rest.starts_with(b"//") {
+                self.pos += rest.iter().position(|&c| c == b'\n').unwrap_or(rest.len());
+            } else if rest.starts_with(b"/*") {
+                self.pos +=
+                    rest.windows(2).position(|w| w == b"*/").map_or(rest.len(), |end| end + 2);
+            } else {
+                return;
+            }
+        }
+    }
+
+    fn error(&self, message: &str) -> Error {
+        let line =
+            self.input[..self.pos.min(self.input.len())].iter().filter(|&&c| c == b'\n').count();
+        invalid(&format!("{} at line {}", message, line + 1))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::pkg::info::inspect;
+    use pretty_assertions::assert_eq;
+    use std::io::Write;
+
+    const DESCRIPTION: &str = r#"
+        software =
+        {
+            version = "0.1.0";
+            hardware-compatibility: [ "1.0", "1.2" ];
+
+            /* Two copies, one for each slot */
+            stable = {
+                copy1: {
+                    images: (
+                        {
+                            filename = "rootfs.ext4";
+                            device = "/dev/mmcblk0p2";
+                            type = "raw";
+                        },
+                        {
+                            filename = "data.ubifs";
+                            volume = "data";
+                            type = "ubivol";
+                        }
+                    );
+                    files: (
+                        {
+                            filename = "README";
+                            path = "/README";
+                            device = "/dev/mmcblk0p1";
+                            filesystem = "vfat";
+                        }
+                    );
+                    bootenv: ( { name = "bootpart"; value = "2"; } );
+                };
+                copy2: {
+                    images: (
+                        {
+                            filename = "rootfs.ext4";
+                            device = "/dev/mmcblk0p3";
+                        }
+                    );
+                };
+            };
+        }
+    "#;
+
+    // Writes the files as a cpio archive in the newc format, which is
+    // the one `.swu` packages use.
+    fn write_swu(path: &Path, files: &[(&str, &[u8])]) {
+        let mut swu = File::create(path).unwrap();
+        let trailer: (&str, &[u8]) = ("TRAILER!!!", b"");
+        for (i, (name, data)) in files.iter().chain(Some(&trailer)).enumerate() {
+            // inode, mode, uid, gid, nlink, mtime, filesize, devices,
+            // namesize and check
+            let fields = [i + 1, 0o100_644, 0, 0, 1, 0, data.len(), 0, 0, 0, 0, name.len() + 1, 0];
+            let header = fields.iter().fold("070701".to_owned(), |h, f| h + &format!("{:08x}", f));
+            swu.write_all(header.as_bytes()).unwrap();
+            swu.write_all(name.as_bytes()).unwrap();
+            swu.write_all(&vec![0; 4 - (header.len() + name.len()) % 4]).unwrap();
+            swu.write_all(data).unwrap();
+            swu.write_all(&vec![0; (4 - data.len() % 4) % 4]).unwrap();
+        }
+    }
+
+    #[test]
+    fn parse_libconfig() {
+        let description = parse(
+            r#"
+            # comment
+            software = {
+                version = "1." "0"; // concatenated
+                count = 0x10;
+                ratio = 1.5;
+                enabled = TRUE;
+                list = ( 1, 2 );
+            };
+            "#,
+        )
+        .unwrap();
+        let software = description.get("software").unwrap();
+        assert_eq!(software.get("version"), Some(&Value::Str("1.0".to_owned())));
+        assert_eq!(software.get("count"), Some(&Value::Int(16)));
+        assert_eq!(software.get("ratio"), Some(&Value::Float(1.5)));
+        assert_eq!(software.get("enabled"), Some(&Value::Bool(true)));
+        assert_eq!(software.get("list").unwrap().items(), &[Value::Int(1), Value::Int(2)]);
+
+        assert_eq!(
+            parse(r#"{ "software": { "version": "1.0" } }"#).unwrap(),
+            Value::Group(vec![(
+                "software".to_owned(),
+                Value::Group(vec![("version".to_owned(), Value::Str("1.0".to_owned()))])
+            )])
+        );
+        assert!(parse("software = { version = \"1.0\";").is_err());
+    }
+
+    #[test]
+    fn convert_swu() {
+        let dir = tempfile::tempdir().unwrap();
+        let (swu, package) = (dir.path().join("update.swu"), dir.path().join("update.uhupkg"));
+        write_swu(
+            &swu,
+            &[
+                ("sw-description", DESCRIPTION.as_bytes()),
+                ("rootfs.ext4", b"rootfs"),
+                ("data.ubifs", b"data"),
+                ("README", b"readme"),
+            ],
+        );
+        let mut options = Options {
+            product: "0123456789".to_owned(),
+            selection: Some("stable".to_owned()),
+            skip_unsupported: false,
+        };
+
+        match convert(&swu, &options, None, &package) {
+            Err(Error::UnsupportedSwEntries(entries)) => {
+                assert_eq!(entries, "bootpart (bootenv entries have no counterpart)")
+            }
+            res => panic!("Unexpected result: {:?}", res),
+        }
+
+        options.skip_unsupported = true;
+        let entries = convert(&swu, &options, None, &package).unwrap();
+        assert_eq!(
+            entries.iter().map(|e| e.mode.as_deref()).collect::<Vec<_>>(),
+            vec![Some("raw"), Some("ubifs"), Some("copy"), None, Some("raw")]
+        );
+
+        let info = inspect(&package, None).unwrap();
+        assert_eq!(info.version, "0.1.0");
+        assert_eq!(info.objects.0.len(), 3);
+        assert_eq!(info.objects.1.len(), 1);
+        assert_eq!(info.objects.1[0].target.as_deref(), Some("/dev/mmcblk0p3"));
+    }
+}
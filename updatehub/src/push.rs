@@ -0,0 +1,58 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::states::machine::{self, ProbeResponse};
+use async_std::sync;
+use cloud::push::Subscription;
+use sdk::api::info::settings::Push;
+use slog_scope::{debug, info, warn};
+use std::time::Duration;
+
+/// Time waited before connecting again to the broker, once the
+/// connection has been lost.
+const RECONNECT_INTERVAL: Duration = Duration::from_secs(30);
+
+/// Probes the server as soon as an update notification is received from
+/// the broker, for as long as the agent runs. The regular polling is
+/// kept, so the updates are still found while the broker can't be
+/// reached.
+pub(crate) async fn run(settings: Push, client_id: String, addr: machine::Addr) {
+    let broker = match settings.broker.clone() {
+        Some(broker) => broker,
+        None => return,
+    };
+    info!("receiving update notifications from {} on {}", broker, settings.topic);
+
+    // The subscription is blocking, so it is kept on its own thread.
+    let (sender, receiver) = sync::channel(1);
+    std::thread::spawn(move || {
+        let keep_alive = settings.keep_alive.to_std().unwrap_or_default();
+        loop {
+            match Subscription::connect(&broker, &client_id, &settings.topic, keep_alive) {
+                Ok(mut subscription) => loop {
+                    match subscription.next_message() {
+                        // A pending probe already covers the notification.
+                        Ok(_) if sender.is_full() => {}
+                        Ok(_) => async_std::task::block_on(sender.send(())),
+                        Err(e) => {
+                            warn!("lost connection to mqtt broker: {}", e);
+                            break;
+                        }
+                    }
+                },
+                Err(e) => warn!("failed to connect to mqtt broker: {}", e),
+            }
+            std::thread::sleep(RECONNECT_INTERVAL);
+        }
+    });
+
+    while receiver.recv().await.is_ok() {
+        info!("update notification received, probing the server");
+        match addr.request_probe(None).await {
+            Ok(ProbeResponse::Busy(state)) => debug!("not probing while in {}", state),
+            Ok(response) => debug!("probe has finished: {:?}", response),
+            Err(e) => warn!("failed to probe after update notification: {}", e),
+        }
+    }
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::{
+    states::machine::{self, StateResponse},
+    update_package::UpdatePackage,
+    utils,
+};
+use sdk::api::{dry_run, info::settings::RemovableMedia};
+use slog_scope::{debug, info, warn};
+use std::{
+    collections::HashSet,
+    fs,
+    path::{Path, PathBuf},
+    time::SystemTime,
+};
+
+const PACKAGE_EXTENSION: &str = "uhupkg";
+
+// Identifies a package file, so a different one copied over it is
+// handled again.
+#[derive(Clone, Debug, Eq, Hash, PartialEq)]
+struct Found {
+    path: PathBuf,
+    len: u64,
+    modified: SystemTime,
+}
+
+/// Installs the update packages found on the removable media, for as
+/// long as the agent runs. The mount points are looked into at every
+/// interval, so the media mounted by any means are seen. A package is
+/// handled once while its media stays mounted, and is skipped when the
+/// device already runs it or has last tried to install it, so a media
+/// left behind doesn't install it again on every boot.
+pub(crate) async fn run(settings: RemovableMedia, addr: machine::Addr) {
+    info!("watching removable media mounted at {:?} for update packages", settings.mount_points);
+    let interval = settings.interval.to_std().unwrap_or_default();
+    let mut seen = HashSet::new();
+
+    loop {
+        let found = find_packages(&settings.mount_points);
+        // The packages of the media removed are handled again once they
+        // are back.
+        seen.retain(|package| found.contains(package));
+        for package in found {
+            if seen.insert(package.clone()) {
+                if let Err(e) = handle(&addr, &package.path).await {
+                    warn!(
+                        "failed to install {} from removable media: {}",
+                        package.path.display(),
+                        e
+                    );
+                }
+            }
+        }
+        async_std::task::sleep(interval).await;
+    }
+}
+
+async fn handle(addr: &machine::Addr, path: &Path) -> crate::Result<()> {
+    info!("update package found on removable media: {}", path.display());
+    let mut metadata = Vec::with_capacity(1024);
+    utils::archive::uncompress_archive_file(
+        path,
+        fs::File::open(path)?,
+        &mut metadata,
+        "metadata",
+    )?;
+    let package = UpdatePackage::parse(&metadata)?;
+    let package_uid = package.package_uid();
+
+    let agent = addr.request_info().await;
+    if package.inner.product_uid != agent.firmware.product_uid {
+        warn!("ignoring {}, as it is for another product", path.display());
+        return Ok(());
+    }
+    if package.inner.version == agent.firmware.version {
+        info!("ignoring {}, as its version is already installed", path.display());
+        return Ok(());
+    }
+    if agent.runtime_settings.update.last_result.and_then(|result| result.package_uid).as_ref()
+        == Some(&package_uid)
+    {
+        info!("ignoring {}, as it has already been handled", path.display());
+        return Ok(());
+    }
+
+    // The signature and the hardware are checked before the package is
+    // accepted, so the device isn't left busy with an update it refuses.
+    let report = match addr.request_dry_run(dry_run::Request::File(path.to_owned())).await {
+        Ok(report) => report,
+        Err(e) => return Err(crate::Error::UpdateFailed(e.to_string())),
+    };
+    if !report.installable {
+        warn!(
+            "ignoring {}, as it can't be installed: {}",
+            path.display(),
+            report.issues.join(", ")
+        );
+        return Ok(());
+    }
+
+    match addr.request_local_install(path.to_owned()).await {
+        StateResponse::RequestAccepted(state) => {
+            info!("installing {} from removable media, requested in {}", path.display(), state)
+        }
+        StateResponse::Queued(state, position) => info!(
+            "installing {} from removable media once {} is done, at position {}",
+            path.display(),
+            state,
+            position
+        ),
+        StateResponse::InvalidState(state) => {
+            warn!("unable to install {} while in {}", path.display(), state)
+        }
+    }
+    Ok(())
+}
+
+/// Update packages at the top directory of the `mount_points`. The
+/// mount points without media mounted are empty, or don't exist.
+fn find_packages(mount_points: &[PathBuf]) -> HashSet<Found> {
+    mount_points
+        .iter()
+        .filter_map(|dir| fs::read_dir(dir).ok())
+        .flatten()
+        .filter_map(|entry| {
+            let entry = entry.ok()?;
+            let path = entry.path();
+            if path.extension()? != PACKAGE_EXTENSION {
+                return None;
+            }
+            let metadata = entry.metadata().ok().filter(fs::Metadata::is_file)?;
+            debug!("found update package at {}", path.display());
+            Some(Found { path, len: metadata.len(), modified: metadata.modified().ok()? })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn find_update_packages() {
+        let media = tempfile::tempdir().unwrap();
+        fs::write(media.path().join("update.uhupkg"), "package").unwrap();
+        fs::write(media.path().join("notes.txt"), "notes").unwrap();
+        fs::create_dir(media.path().join("nested.uhupkg")).unwrap();
+
+        let found = find_packages(&[media.path().to_owned(), PathBuf::from("/nonexistent")]);
+        assert_eq!(
+            found.iter().map(|f| f.path.clone()).collect::<Vec<_>>(),
+            vec![media.path().join("update.uhupkg")]
+        );
+    }
+}
@@ -2,19 +2,34 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-use crate::firmware::{
-    self,
-    installation_set::{self, Set},
+use crate::{
+    firmware::{
+        self,
+        api::MetadataValue,
+        installation_set::{self, Set},
+    },
+    utils,
 };
 use chrono::{DateTime, NaiveDateTime, Utc};
 use derive_more::{Deref, DerefMut};
-use sdk::api::info::runtime_settings as api;
-use slog_scope::{debug, warn};
-use std::{fs, io, path::Path};
+use sdk::api::{audit, info::runtime_settings as api};
+use slog_scope::{debug, info, warn};
+use std::{
+    collections::BTreeMap,
+    fs,
+    io::{self, Write},
+    path::{Path, PathBuf},
+};
 use thiserror::Error;
 
 pub type Result<T> = std::result::Result<T, Error>;
 
+// Months the bandwidth usage is kept for.
+const BANDWIDTH_HISTORY: usize = 12;
+
+// Line following the runtime settings with their checksum.
+const CHECKSUM_PREFIX: &str = "\nsha256:";
+
 #[derive(Debug, Error)]
 pub enum Error {
     #[error(transparent)]
@@ -26,6 +41,8 @@ pub enum Error {
 
     #[error("invalid runtime settings destination")]
     InvalidDestination,
+    #[error("runtime settings don't match their checksum")]
+    ChecksumMismatch,
 }
 
 #[derive(Clone, Debug, Deref, DerefMut, PartialEq)]
@@ -39,31 +56,62 @@ impl Default for RuntimeSettings {
                 retries: 0,
                 now: false,
                 server_address: api::ServerAddress::Default,
+                active_server: None,
+                last_boottime: None,
+            },
+            update: api::RuntimeUpdate {
+                upgrade_to_installation: None,
+                applied_package_uid: None,
+                chain: None,
+                last_result: None,
+                desired: None,
+                security_version: 0,
+                pending_security_version: None,
+                pending_security_package: None,
+                attempt: None,
+                reboot_required: None,
+                confirmation_deadline: None,
             },
-            update: api::RuntimeUpdate { upgrade_to_installation: None, applied_package_uid: None },
             path: std::path::PathBuf::new(),
             persistent: false,
+            device_writes: BTreeMap::default(),
+            bandwidth: BTreeMap::default(),
+            counters: api::Counters::default(),
+            transaction: None,
+            pending_packages: Vec::default(),
+            settings: BTreeMap::default(),
+            device_identity: None,
+            identity_change: None,
+            installations: Vec::default(),
+            activation_failures: Vec::default(),
+            journal: None,
         })
     }
 }
 
 impl RuntimeSettings {
     pub fn load(path: &Path) -> Result<Self> {
-        let mut this = if path.exists() {
+        let backup = sibling_path(path, "bak");
+        let mut this = if path.exists() || backup.exists() {
             debug!("loading runtime settings from {:?}...", path);
-            match fs::read_to_string(path).map_err(Error::from).and_then(|ref s| Self::parse(s)) {
+            match Self::read(path) {
                 Ok(v) => v,
                 Err(e) => {
                     warn!("failed to load current runtime settings: {}", e);
-                    let _ = fs::rename(
-                        path,
-                        path.with_file_name(format!(
-                            "{}.old",
-                            path.file_name().unwrap().to_str().unwrap()
-                        )),
-                    );
-                    debug!("using default runtime settings...");
-                    Self::default()
+                    let _ = fs::rename(path, sibling_path(path, "old"));
+                    // The backup holds the settings saved before the last
+                    // ones, which are better than losing them all.
+                    match Self::read(&backup) {
+                        Ok(v) => {
+                            info!("runtime settings recovered from {:?}", backup);
+                            v
+                        }
+                        Err(e) => {
+                            warn!("failed to load the runtime settings backup: {}", e);
+                            debug!("using default runtime settings...");
+                            Self::default()
+                        }
+                    }
                 }
             }
         } else {
@@ -75,7 +123,23 @@ impl RuntimeSettings {
         Ok(this)
     }
 
+    fn read(path: &Path) -> Result<Self> {
+        Self::parse(&fs::read_to_string(path)?)
+    }
+
+    // Files saved before the checksum has been added have none, while
+    // the ones cut short lose it along with the end of the settings.
     fn parse(content: &str) -> Result<Self> {
+        let content = match content.rfind(CHECKSUM_PREFIX) {
+            Some(idx) => {
+                let checksum = content[idx + CHECKSUM_PREFIX.len()..].trim();
+                if checksum != crate::utils::sha256sum(content[..idx].as_bytes()) {
+                    return Err(Error::ChecksumMismatch);
+                }
+                &content[..idx]
+            }
+            None => content,
+        };
         Ok(RuntimeSettings(serde_json::from_str::<api::RuntimeSettings>(&content)?))
     }
 
@@ -92,13 +156,18 @@ impl RuntimeSettings {
         }
 
         debug!("saving runtime settings from {:?}...", &self.path);
-        fs::write(&self.path, self.serialize()?)?;
+        if let Ok(current) = fs::read(&self.path) {
+            write_atomic(&sibling_path(&self.path, "bak"), &current)?;
+        }
+        write_atomic(&self.path, self.serialize()?.as_bytes())?;
 
         Ok(())
     }
 
     fn serialize(&self) -> Result<String> {
-        Ok(serde_json::to_string(&self.0)?)
+        let content = serde_json::to_string(&self.0)?;
+        let checksum = crate::utils::sha256sum(content.as_bytes());
+        Ok(format!("{}{}{}\n", content, CHECKSUM_PREFIX, checksum))
     }
 
     pub(crate) fn get_inactive_installation_set(&self) -> Result<Set> {
@@ -117,6 +186,12 @@ impl RuntimeSettings {
         self.persistent = true;
     }
 
+    /// Writes the settings only changed in memory, as the probe retries,
+    /// so they are kept once the agent is stopped.
+    pub(crate) fn flush(&self) -> Result<()> {
+        self.save()
+    }
+
     pub(crate) fn is_polling_forced(&self) -> bool {
         self.polling.now
     }
@@ -138,15 +213,47 @@ impl RuntimeSettings {
         self.polling.retries = 0;
     }
 
-    pub(crate) fn last_polling(&self) -> DateTime<Utc> {
-        self.polling.last
-    }
-
     pub(crate) fn set_last_polling(&mut self, last_polling: DateTime<Utc>) -> Result<()> {
         self.polling.last = last_polling;
+        self.polling.last_boottime = match (utils::boottime::boot_id(), utils::boottime::elapsed())
+        {
+            (Ok(boot_id), Ok(elapsed)) => {
+                Some(api::BootTime { boot_id, elapsed_ms: elapsed.num_milliseconds() })
+            }
+            _ => None,
+        };
         self.save()
     }
 
+    /// Time elapsed since the last polling. It is measured on the boot
+    /// clock while in the same boot, as the wall clock of the devices
+    /// without an RTC may be stepped by years once synchronized.
+    pub(crate) fn since_last_polling(&self, now: DateTime<Utc>) -> chrono::Duration {
+        let boottime = utils::boottime::boot_id()
+            .and_then(|boot_id| utils::boottime::elapsed().map(|elapsed| (boot_id, elapsed)));
+        match boottime {
+            Ok((boot_id, elapsed)) => self.since_last_polling_at(now, &boot_id, elapsed),
+            Err(e) => {
+                warn!("failed to read the boot clock, using the wall clock: {}", e);
+                now.signed_duration_since(self.polling.last)
+            }
+        }
+    }
+
+    fn since_last_polling_at(
+        &self,
+        now: DateTime<Utc>,
+        boot_id: &str,
+        elapsed: chrono::Duration,
+    ) -> chrono::Duration {
+        match &self.polling.last_boottime {
+            Some(last) if last.boot_id == boot_id => {
+                elapsed - chrono::Duration::milliseconds(last.elapsed_ms)
+            }
+            _ => now.signed_duration_since(self.polling.last),
+        }
+    }
+
     pub(crate) fn applied_package_uid(&self) -> Option<String> {
         self.update.applied_package_uid.clone()
     }
@@ -161,6 +268,41 @@ impl RuntimeSettings {
         self.save()
     }
 
+    pub(crate) fn security_version(&self) -> u64 {
+        self.update.security_version
+    }
+
+    pub(crate) fn set_security_version(&mut self, version: u64) -> Result<()> {
+        self.update.security_version = version;
+        self.save()
+    }
+
+    /// Keeps the security `version` of the `package` installed, which is
+    /// applied once it is booted into.
+    pub(crate) fn set_pending_security_version(
+        &mut self,
+        package: api::SignedPackage,
+        version: u64,
+    ) -> Result<()> {
+        self.update.pending_security_version = Some(version);
+        self.update.pending_security_package = Some(package);
+        self.save()
+    }
+
+    /// Makes the security version of the update just booted into the one
+    /// of the device, returning the package it is taken from, so it is
+    /// kept out of the runtime settings too.
+    pub(crate) fn commit_security_version(&mut self) -> Result<Option<api::SignedPackage>> {
+        let version = match self.update.pending_security_version.take() {
+            Some(version) => version,
+            None => return Ok(None),
+        };
+        self.update.security_version = version;
+        let package = self.update.pending_security_package.take();
+        self.save()?;
+        Ok(package)
+    }
+
     pub(crate) fn custom_server_address(&self) -> Option<&str> {
         match &self.polling.server_address {
             api::ServerAddress::Custom(s) => Some(s),
@@ -172,6 +314,447 @@ impl RuntimeSettings {
         self.polling.server_address = api::ServerAddress::Custom(server_address.to_owned());
     }
 
+    pub(crate) fn active_server(&self) -> Option<&str> {
+        self.polling.active_server.as_deref()
+    }
+
+    pub(crate) fn set_active_server(&mut self, server: &str) -> Result<()> {
+        if self.active_server() == Some(server) {
+            return Ok(());
+        }
+        self.polling.active_server = Some(server.to_owned());
+        self.save()
+    }
+
+    pub(crate) fn add_device_writes(
+        &mut self,
+        device: &Path,
+        object_bytes: u64,
+        device_bytes: u64,
+    ) -> Result<()> {
+        let writes = self.device_writes.entry(device.to_owned()).or_default();
+        writes.object_bytes += object_bytes;
+        writes.device_bytes += device_bytes;
+        self.save()
+    }
+
+    /// Accounts the bytes transferred to the calendar month of `now`,
+    /// keeping the months of the last year only, and to the lifetime
+    /// counters.
+    pub(crate) fn add_bandwidth(
+        &mut self,
+        downloaded: u64,
+        uploaded: u64,
+        now: DateTime<Utc>,
+    ) -> Result<()> {
+        let usage = self.bandwidth.entry(billing_period(now)).or_default();
+        usage.downloaded += downloaded;
+        usage.uploaded += uploaded;
+        self.counters.bytes_downloaded += downloaded;
+
+        while self.bandwidth.len() > BANDWIDTH_HISTORY {
+            let oldest = self.bandwidth.keys().next().cloned().unwrap_or_default();
+            self.bandwidth.remove(&oldest);
+        }
+        self.save()
+    }
+
+    /// Bytes transferred in the calendar month of `now`.
+    pub(crate) fn bandwidth_usage(&self, now: DateTime<Utc>) -> u64 {
+        self.bandwidth
+            .get(&billing_period(now))
+            .map_or(0, |usage| usage.downloaded + usage.uploaded)
+    }
+
+    pub(crate) fn transaction(&self) -> Option<&api::Transaction> {
+        self.transaction.as_ref()
+    }
+
+    /// Records the update being handled, until it is installed or fails.
+    /// The resume attempts are kept when the update is the one resumed.
+    pub(crate) fn begin_transaction(
+        &mut self,
+        package: &[u8],
+        signature: Option<String>,
+    ) -> Result<()> {
+        let package = String::from_utf8_lossy(package).into_owned();
+        let attempts = self
+            .transaction
+            .as_ref()
+            .filter(|transaction| transaction.package == package)
+            .map_or(0, |transaction| transaction.attempts);
+        self.transaction = Some(api::Transaction {
+            package,
+            signature,
+            state: "validation".to_owned(),
+            installed_objects: Vec::default(),
+            attempts,
+        });
+        self.save()
+    }
+
+    pub(crate) fn set_transaction_state(&mut self, state: &str) -> Result<()> {
+        match self.transaction {
+            Some(ref mut transaction) => transaction.state = state.to_owned(),
+            None => return Ok(()),
+        }
+        self.save()
+    }
+
+    pub(crate) fn add_transaction_object(&mut self, sha256sum: &str) -> Result<()> {
+        match self.transaction {
+            Some(ref mut transaction) => transaction.installed_objects.push(sha256sum.to_owned()),
+            None => return Ok(()),
+        }
+        self.save()
+    }
+
+    /// Counts an attempt of resuming the update being handled, returning
+    /// how many there have been, if there is one.
+    pub(crate) fn count_transaction_attempt(&mut self) -> Result<Option<u32>> {
+        let attempts = match self.transaction {
+            Some(ref mut transaction) => {
+                transaction.attempts += 1;
+                transaction.attempts
+            }
+            None => return Ok(None),
+        };
+        self.save()?;
+        Ok(Some(attempts))
+    }
+
+    pub(crate) fn end_transaction(&mut self) -> Result<()> {
+        if self.transaction.take().is_none() {
+            return Ok(());
+        }
+        self.save()
+    }
+
+    pub(crate) fn journal(&self) -> Option<&api::Journal> {
+        self.journal.as_ref()
+    }
+
+    /// Starts the journal of the objects installed from the `package`
+    /// into the `installation_set`, unless it is the one being resumed.
+    pub(crate) fn begin_journal(
+        &mut self,
+        package: &api::SignedPackage,
+        installation_set: Set,
+    ) -> Result<()> {
+        if self.journal.as_ref().map_or(false, |journal| {
+            journal.package == package.package && journal.installation_set == installation_set.0
+        }) {
+            return Ok(());
+        }
+        self.journal = Some(api::Journal {
+            package: package.package.clone(),
+            signature: package.signature.clone(),
+            installation_set: installation_set.0,
+            objects: Vec::default(),
+        });
+        self.save()
+    }
+
+    /// Records the object in the journal, replacing its previous entry.
+    pub(crate) fn journal_object(&mut self, object: api::JournalObject) -> Result<()> {
+        match self.journal {
+            Some(ref mut journal) => {
+                journal.objects.retain(|o| o.index != object.index);
+                journal.objects.push(object);
+            }
+            None => return Ok(()),
+        }
+        self.save()
+    }
+
+    /// Drops the objects of the journal which match the `filter`, and the
+    /// journal itself once it is left empty.
+    pub(crate) fn drop_journal_objects<F>(&mut self, filter: F) -> Result<()>
+    where
+        F: Fn(&api::JournalObject) -> bool,
+    {
+        match self.journal {
+            Some(ref mut journal) => journal.objects.retain(|o| !filter(o)),
+            None => return Ok(()),
+        }
+        if self.journal.as_ref().map_or(false, |journal| journal.objects.is_empty()) {
+            self.journal = None;
+        }
+        self.save()
+    }
+
+    pub(crate) fn end_journal(&mut self) -> Result<()> {
+        if self.journal.take().is_none() {
+            return Ok(());
+        }
+        self.save()
+    }
+
+    pub(crate) fn update_chain(&self) -> Option<api::UpdateChain> {
+        self.update.chain
+    }
+
+    pub(crate) fn set_update_chain(&mut self, chain: Option<api::UpdateChain>) -> Result<()> {
+        self.update.chain = chain;
+        self.save()
+    }
+
+    pub(crate) fn desired_package(&self) -> Option<&api::DesiredPackage> {
+        self.update.desired.as_ref()
+    }
+
+    pub(crate) fn set_desired_package(
+        &mut self,
+        desired: Option<api::DesiredPackage>,
+    ) -> Result<()> {
+        if self.update.desired == desired {
+            return Ok(());
+        }
+        self.update.desired = desired;
+        self.save()
+    }
+
+    pub(crate) fn last_update_result(&self) -> Option<&api::UpdateResult> {
+        self.update.last_result.as_ref()
+    }
+
+    pub(crate) fn update_attempt(&self) -> Option<&audit::Attempt> {
+        self.update.attempt.as_ref()
+    }
+
+    /// Records the update attempt being handled, which is kept over the
+    /// reboots until its outcome is known.
+    pub(crate) fn begin_attempt(&mut self, attempt: audit::Attempt) -> Result<()> {
+        if self.update.attempt.as_ref().map(|a| &a.package_uid) == Some(&attempt.package_uid) {
+            return Ok(());
+        }
+        self.update.attempt = Some(attempt);
+        self.save()
+    }
+
+    pub(crate) fn start_attempt_object(
+        &mut self,
+        sha256sum: &str,
+        filename: &str,
+        mode: &str,
+    ) -> Result<()> {
+        match self.update.attempt {
+            Some(ref mut attempt) => attempt.objects.push(audit::ObjectResult {
+                sha256sum: sha256sum.to_owned(),
+                filename: filename.to_owned(),
+                mode: mode.to_owned(),
+                status: audit::ObjectStatus::Started,
+                duration: None,
+            }),
+            None => return Ok(()),
+        }
+        self.save()
+    }
+
+    /// Marks the object last started as installed, in `duration`
+    /// milliseconds.
+    pub(crate) fn finish_attempt_object(&mut self, duration: u64) -> Result<()> {
+        match self.update.attempt.as_mut().and_then(|attempt| attempt.objects.last_mut()) {
+            Some(object) => {
+                object.status = audit::ObjectStatus::Installed;
+                object.duration = Some(duration);
+            }
+            None => return Ok(()),
+        }
+        self.save()
+    }
+
+    /// Records the outcome of the update, so it is available through the
+    /// agent API and in the audit trail, and accounts it to the lifetime
+    /// counters.
+    pub(crate) fn set_update_result(
+        &mut self,
+        outcome: api::UpdateOutcome,
+        package_uid: Option<String>,
+        error: Option<String>,
+    ) -> Result<()> {
+        self.counters.updates_attempted += 1;
+        match outcome {
+            api::UpdateOutcome::Installed => self.counters.updates_succeeded += 1,
+            api::UpdateOutcome::RolledBack => self.counters.rollbacks += 1,
+            api::UpdateOutcome::Failed | api::UpdateOutcome::Canceled => {}
+        }
+        let time = Utc::now();
+        if let Some(mut attempt) = self.update.attempt.take() {
+            for object in attempt.objects.iter_mut() {
+                if object.status == audit::ObjectStatus::Started {
+                    object.status = audit::ObjectStatus::Failed;
+                }
+            }
+            let duration = (time - attempt.started_at).num_milliseconds().max(0) as u64;
+            utils::audit_trail::record(&audit::Entry {
+                attempt,
+                outcome,
+                finished_at: time,
+                duration,
+                error: error.clone(),
+            });
+        }
+        self.update.last_result = Some(api::UpdateResult { package_uid, outcome, time, error });
+        self.save()
+    }
+
+    /// Drops the update chain once its last step is installed, or once a
+    /// step fails, as the server sends the chain again when probed.
+    pub(crate) fn finish_update_chain_step(&mut self, installed: bool) -> Result<()> {
+        let chain = match self.update.chain {
+            Some(chain) => chain,
+            None => return Ok(()),
+        };
+
+        if installed && chain.step < chain.length {
+            info!("update chain step {} of {} installed", chain.step, chain.length);
+            return Ok(());
+        }
+        self.set_update_chain(None)
+    }
+
+    /// Queues the package to be installed after the ones already pending,
+    /// returning its position in the queue.
+    pub(crate) fn queue_package(&mut self, package: api::PendingPackage) -> Result<usize> {
+        self.pending_packages.push(package);
+        self.save()?;
+        Ok(self.pending_packages.len())
+    }
+
+    pub(crate) fn take_pending_package(&mut self) -> Result<Option<api::PendingPackage>> {
+        if self.pending_packages.is_empty() {
+            return Ok(None);
+        }
+        let package = self.pending_packages.remove(0);
+        self.save()?;
+        Ok(Some(package))
+    }
+
+    /// Drops the pending packages, returning how many there were.
+    pub(crate) fn clear_pending_packages(&mut self) -> Result<usize> {
+        let count = self.pending_packages.len();
+        if count == 0 {
+            return Ok(0);
+        }
+        self.pending_packages.clear();
+        self.save()?;
+        Ok(count)
+    }
+
+    /// Keeps the setting changed through the agent API, so it is applied
+    /// again once the agent is restarted.
+    pub(crate) fn set_setting(&mut self, key: &str, value: &str) -> Result<()> {
+        self.settings.insert(key.to_owned(), value.to_owned());
+        self.save()
+    }
+
+    /// Records the `identity` the device has, returning whether it has
+    /// changed since last seen. The identity it had before the first
+    /// unconfirmed change is kept, so the server can tell the devices
+    /// apart until the change is confirmed.
+    pub(crate) fn track_identity(&mut self, identity: &MetadataValue) -> Result<bool> {
+        let previous = match self.device_identity {
+            Some(ref previous) if previous == identity => return Ok(false),
+            Some(ref previous) => previous.clone(),
+            None => {
+                self.device_identity = Some(identity.clone());
+                return self.save().map(|_| false);
+            }
+        };
+
+        if self.identity_change.is_none() {
+            self.identity_change = Some(api::IdentityChange { previous, time: Utc::now() });
+        }
+        self.device_identity = Some(identity.clone());
+        self.save()?;
+        Ok(true)
+    }
+
+    pub(crate) fn previous_identity(&self) -> Option<&MetadataValue> {
+        self.identity_change.as_ref().map(|change| &change.previous)
+    }
+
+    /// Drops the identity change, returning whether there was one.
+    pub(crate) fn confirm_identity_change(&mut self) -> Result<bool> {
+        if self.identity_change.take().is_none() {
+            return Ok(false);
+        }
+        self.save()?;
+        Ok(true)
+    }
+
+    /// Records what has been installed into the installation set of the
+    /// `record`, replacing what it had before.
+    pub(crate) fn record_installation(&mut self, record: api::InstallationRecord) -> Result<()> {
+        self.installations.retain(|r| r.installation_set != record.installation_set);
+        // A new image lifts the quarantine of the set.
+        self.activation_failures.retain(|f| f.installation_set != record.installation_set);
+        self.installations.push(record);
+        self.save()
+    }
+
+    pub(crate) fn installation_record(&self, set: Set) -> Option<&api::InstallationRecord> {
+        self.installations.iter().find(|r| r.installation_set == set.0)
+    }
+
+    /// Counts a failed activation of the installation `set` with the
+    /// `package_uid`, quarantining it once it has failed `limit` times.
+    pub(crate) fn add_activation_failure(
+        &mut self,
+        set: Set,
+        package_uid: Option<String>,
+        limit: u32,
+    ) -> Result<()> {
+        let failures =
+            match self.activation_failures.iter().position(|f| f.installation_set == set.0) {
+                Some(index) => &mut self.activation_failures[index],
+                None => {
+                    self.activation_failures.push(api::ActivationFailures {
+                        installation_set: set.0,
+                        count: 0,
+                        package_uid: None,
+                        quarantined_at: None,
+                        reported: false,
+                    });
+                    self.activation_failures.last_mut().expect("failures have just been added")
+                }
+            };
+        failures.count += 1;
+        failures.package_uid = package_uid;
+        if limit > 0 && failures.count >= limit && failures.quarantined_at.is_none() {
+            warn!(
+                "installation set {} quarantined after {} failed activations",
+                set, failures.count
+            );
+            failures.quarantined_at = Some(Utc::now());
+        }
+        self.save()
+    }
+
+    pub(crate) fn is_quarantined(&self, set: Set) -> bool {
+        self.activation_failures
+            .iter()
+            .any(|f| f.installation_set == set.0 && f.quarantined_at.is_some())
+    }
+
+    /// Quarantines yet to be reported to the server.
+    pub(crate) fn unreported_quarantines(&self) -> Vec<api::ActivationFailures> {
+        self.activation_failures
+            .iter()
+            .filter(|f| f.quarantined_at.is_some() && !f.reported)
+            .cloned()
+            .collect()
+    }
+
+    pub(crate) fn set_quarantine_reported(&mut self, set: Set) -> Result<()> {
+        for failures in self.activation_failures.iter_mut().filter(|f| f.installation_set == set.0)
+        {
+            failures.reported = true;
+        }
+        self.save()
+    }
+
     /// Reset settings that are only need through a single installation
     pub(crate) fn reset_transient_settings(&mut self) {
         // Server address is reset so it doesn't keep probing the last custom server
@@ -179,9 +762,60 @@ impl RuntimeSettings {
         self.polling.server_address = api::ServerAddress::Default;
     }
 
+    /// Records the device awaits the application to reboot it into the
+    /// update, installed in the boot `boot_id`.
+    pub(crate) fn set_reboot_required(&mut self, boot_id: String) -> Result<()> {
+        self.update.reboot_required = Some(boot_id);
+        self.save()
+    }
+
+    /// Whether the device still awaits to be rebooted into the update, as
+    /// it hasn't rebooted since the boot `boot_id` it was installed in.
+    pub(crate) fn is_reboot_required(&self, boot_id: &str) -> bool {
+        self.update.reboot_required.as_deref() == Some(boot_id)
+    }
+
+    /// Time left for the installation booted into to be confirmed, which
+    /// is `timeout` from the first time it is asked for in the boot. It is
+    /// measured on the boot clock, as the wall clock of the devices
+    /// without an RTC may be stepped by years once synchronized.
+    pub(crate) fn confirmation_remaining(
+        &mut self,
+        timeout: chrono::Duration,
+    ) -> Result<chrono::Duration> {
+        match (utils::boottime::boot_id(), utils::boottime::elapsed()) {
+            (Ok(boot_id), Ok(elapsed)) => self.confirmation_remaining_at(boot_id, elapsed, timeout),
+            (Err(e), _) | (_, Err(e)) => {
+                warn!("failed to read the boot clock, the confirmation deadline isn't kept: {}", e);
+                Ok(timeout)
+            }
+        }
+    }
+
+    fn confirmation_remaining_at(
+        &mut self,
+        boot_id: String,
+        elapsed: chrono::Duration,
+        timeout: chrono::Duration,
+    ) -> Result<chrono::Duration> {
+        if let Some(deadline) = &self.update.confirmation_deadline {
+            if deadline.boot_id == boot_id {
+                return Ok(chrono::Duration::milliseconds(deadline.elapsed_ms) - elapsed);
+            }
+        }
+        self.update.confirmation_deadline =
+            Some(api::BootTime { boot_id, elapsed_ms: (elapsed + timeout).num_milliseconds() });
+        self.save()?;
+        Ok(timeout)
+    }
+
     pub(crate) fn reset_installation_settings(&mut self) -> Result<()> {
         self.update.upgrade_to_installation = None;
         self.update.applied_package_uid = None;
+        self.update.pending_security_version = None;
+        self.update.pending_security_package = None;
+        self.update.reboot_required = None;
+        self.update.confirmation_deadline = None;
 
         // Ensure we do a probe as soon as possible so full update
         // cycle can be finished.
@@ -191,6 +825,31 @@ impl RuntimeSettings {
     }
 }
 
+fn sibling_path(path: &Path, extension: &str) -> PathBuf {
+    let mut name = path.file_name().unwrap_or_default().to_owned();
+    name.push(".");
+    name.push(extension);
+    path.with_file_name(name)
+}
+
+// The data is synced to a temporary file which then replaces the one at
+// `path`, so a power cut leaves either the old or the new content.
+fn write_atomic(path: &Path, data: &[u8]) -> io::Result<()> {
+    let dir = match path.parent() {
+        Some(dir) if !dir.as_os_str().is_empty() => dir,
+        _ => Path::new("."),
+    };
+    let mut file = tempfile::NamedTempFile::new_in(dir)?;
+    file.write_all(data)?;
+    file.as_file().sync_all()?;
+    file.persist(path).map_err(|e| e.error)?;
+    fs::File::open(dir)?.sync_all()
+}
+
+fn billing_period(now: DateTime<Utc>) -> String {
+    now.format("%Y-%m").to_string()
+}
+
 #[test]
 fn default() {
     use pretty_assertions::assert_eq;
@@ -201,15 +860,90 @@ fn default() {
             retries: 0,
             now: false,
             server_address: api::ServerAddress::Default,
+            active_server: None,
+            last_boottime: None,
+        },
+        update: api::RuntimeUpdate {
+            upgrade_to_installation: None,
+            applied_package_uid: None,
+            chain: None,
+            last_result: None,
+            desired: None,
+            security_version: 0,
+            pending_security_version: None,
+            pending_security_package: None,
+            attempt: None,
+            reboot_required: None,
+            confirmation_deadline: None,
         },
-        update: api::RuntimeUpdate { upgrade_to_installation: None, applied_package_uid: None },
         path: std::path::PathBuf::new(),
         persistent: false,
+        device_writes: std::collections::BTreeMap::default(),
+        bandwidth: std::collections::BTreeMap::default(),
+        counters: api::Counters::default(),
+        transaction: None,
+        pending_packages: Vec::default(),
+        settings: std::collections::BTreeMap::default(),
+        device_identity: None,
+        identity_change: None,
+        installations: Vec::default(),
+        activation_failures: Vec::default(),
+        journal: None,
     });
 
     assert_eq!(Some(settings), Some(expected));
 }
 
+#[test]
+fn elapsed_since_last_polling() {
+    let mut settings = RuntimeSettings::default();
+    let now = Utc::now();
+    settings.polling.last = now - chrono::Duration::days(365 * 50);
+    settings.polling.last_boottime =
+        Some(api::BootTime { boot_id: "boot".to_owned(), elapsed_ms: 60_000 });
+
+    // The wall clock has been stepped since the polling in the same boot.
+    let elapsed = settings.since_last_polling_at(now, "boot", chrono::Duration::minutes(11));
+    assert_eq!(elapsed, chrono::Duration::minutes(10));
+
+    // The boot clock is meaningless across boots.
+    let elapsed = settings.since_last_polling_at(now, "other", chrono::Duration::minutes(11));
+    assert_eq!(elapsed, chrono::Duration::days(365 * 50));
+}
+
+#[test]
+fn persist_journal() {
+    use pretty_assertions::assert_eq;
+
+    let tempfile = tempfile::NamedTempFile::new().unwrap();
+    std::fs::remove_file(tempfile.path()).unwrap();
+    let mut settings = RuntimeSettings::load(tempfile.path()).unwrap();
+    settings.enable_persistency();
+    let set = Set(api::InstallationSet::B);
+    let package = api::SignedPackage { package: "{}".to_owned(), signature: None };
+    let object = |index, completed| api::JournalObject {
+        index,
+        sha256sum: "e3b0c44298fc1c14".to_owned(),
+        target: None,
+        previous_sha256sum: None,
+        completed,
+    };
+
+    settings.begin_journal(&package, set).unwrap();
+    settings.journal_object(object(0, false)).unwrap();
+    settings.journal_object(object(0, true)).unwrap();
+    settings.journal_object(object(1, false)).unwrap();
+    // The journal being resumed is kept.
+    settings.begin_journal(&package, set).unwrap();
+    let journal = RuntimeSettings::load(tempfile.path()).unwrap().journal().cloned().unwrap();
+    assert_eq!(journal.objects, vec![object(0, true), object(1, false)]);
+
+    settings.drop_journal_objects(|o| !o.completed).unwrap();
+    assert_eq!(settings.journal().unwrap().objects, vec![object(0, true)]);
+    settings.drop_journal_objects(|_| true).unwrap();
+    assert_eq!(RuntimeSettings::load(tempfile.path()).unwrap().journal(), None);
+}
+
 #[test]
 fn load_and_save() {
     use pretty_assertions::assert_eq;
@@ -228,6 +962,92 @@ fn load_and_save() {
     assert_eq!(settings.update, new_settings.update);
 }
 
+#[test]
+fn keep_confirmation_deadline() {
+    let tempfile = tempfile::NamedTempFile::new().unwrap();
+    std::fs::remove_file(tempfile.path()).unwrap();
+
+    let timeout = chrono::Duration::minutes(5);
+    let mut settings = RuntimeSettings::load(tempfile.path()).unwrap();
+    settings.enable_persistency();
+    let remaining = settings
+        .confirmation_remaining_at("boot".to_owned(), chrono::Duration::minutes(1), timeout)
+        .unwrap();
+    assert_eq!(remaining, timeout);
+
+    // Restarting the agent doesn't move the deadline, even if the wall
+    // clock has been stepped in between
+    let mut new_settings = RuntimeSettings::load(tempfile.path()).unwrap();
+    let remaining = new_settings
+        .confirmation_remaining_at("boot".to_owned(), chrono::Duration::minutes(4), timeout)
+        .unwrap();
+    assert_eq!(remaining, chrono::Duration::minutes(2));
+
+    // Each boot into the installation is given the whole timeout
+    let remaining = new_settings
+        .confirmation_remaining_at("other".to_owned(), chrono::Duration::minutes(4), timeout)
+        .unwrap();
+    assert_eq!(remaining, timeout);
+
+    new_settings.reset_installation_settings().unwrap();
+    assert_eq!(new_settings.update.confirmation_deadline, None);
+}
+
+#[test]
+fn recover_from_backup() {
+    use pretty_assertions::assert_eq;
+
+    let dir = tempfile::tempdir().unwrap();
+    let settings_file = dir.path().join("runtime_settings.conf");
+    let mut settings = RuntimeSettings::load(&settings_file).unwrap();
+    settings.enable_persistency();
+    settings.set_security_version(1).unwrap();
+    settings.set_security_version(2).unwrap();
+    assert_eq!(RuntimeSettings::load(&settings_file).unwrap().security_version(), 2);
+
+    // A file cut short is refused and the backup taken instead
+    let content = fs::read_to_string(&settings_file).unwrap();
+    fs::write(&settings_file, &content[..content.len() / 2]).unwrap();
+    assert_eq!(RuntimeSettings::load(&settings_file).unwrap().security_version(), 1);
+
+    // So is a file whose content doesn't match its checksum
+    fs::write(&settings_file, content.replace("\"security_version\":2", "\"security_version\":3"))
+        .unwrap();
+    assert!(RuntimeSettings::read(&settings_file).is_err());
+}
+
+#[test]
+fn queue_pending_packages() {
+    use pretty_assertions::assert_eq;
+
+    let mut settings = RuntimeSettings::default();
+    let bootloader = api::PendingPackage::File("/tmp/bootloader.uhupkg".into());
+    let rootfs = api::PendingPackage::Url("http://foo.bar/rootfs.uhupkg".to_owned());
+    assert_eq!(settings.queue_package(bootloader.clone()).unwrap(), 1);
+    assert_eq!(settings.queue_package(rootfs.clone()).unwrap(), 2);
+
+    assert_eq!(settings.take_pending_package().unwrap(), Some(bootloader));
+    assert_eq!(settings.clear_pending_packages().unwrap(), 1);
+    assert_eq!(settings.take_pending_package().unwrap(), None);
+    assert!(!settings.pending_packages.contains(&rootfs));
+}
+
+#[test]
+fn finish_update_chain() {
+    use pretty_assertions::assert_eq;
+
+    let mut settings = RuntimeSettings::default();
+    settings.set_update_chain(Some(api::UpdateChain { step: 1, length: 2 })).unwrap();
+    settings.finish_update_chain_step(true).unwrap();
+    assert_eq!(settings.update_chain(), Some(api::UpdateChain { step: 1, length: 2 }));
+    settings.finish_update_chain_step(false).unwrap();
+    assert_eq!(settings.update_chain(), None);
+
+    settings.set_update_chain(Some(api::UpdateChain { step: 2, length: 2 })).unwrap();
+    settings.finish_update_chain_step(true).unwrap();
+    assert_eq!(settings.update_chain(), None);
+}
+
 #[test]
 fn load_bad_formated_file() {
     use pretty_assertions::assert_eq;
@@ -250,3 +1070,180 @@ fn load_bad_formated_file() {
     );
     fs::remove_file(old_file).unwrap();
 }
+
+#[test]
+fn accumulate_device_writes() {
+    use pretty_assertions::assert_eq;
+    use std::path::PathBuf;
+
+    let mut settings = RuntimeSettings::default();
+    settings.add_device_writes(Path::new("/dev/sda1"), 1024, 4096).unwrap();
+    settings.add_device_writes(Path::new("/dev/sda1"), 1024, 0).unwrap();
+
+    let writes = &settings.device_writes[&PathBuf::from("/dev/sda1")];
+    assert_eq!(writes.object_bytes, 2048);
+    assert_eq!(writes.device_bytes, 4096);
+}
+
+#[test]
+fn accumulate_bandwidth() {
+    use chrono::TimeZone;
+    use pretty_assertions::assert_eq;
+
+    let mut settings = RuntimeSettings::default();
+    let may = Utc.ymd(2020, 5, 10).and_hms(0, 0, 0);
+    settings.add_bandwidth(1024, 128, may).unwrap();
+    settings.add_bandwidth(1024, 128, may).unwrap();
+    assert_eq!(settings.bandwidth_usage(may), 2304);
+    assert_eq!(settings.bandwidth["2020-05"].downloaded, 2048);
+
+    // Only the last year is kept
+    for month in 6..=12 {
+        settings.add_bandwidth(1, 1, Utc.ymd(2020, month, 1).and_hms(0, 0, 0)).unwrap();
+    }
+    for month in 1..=5 {
+        settings.add_bandwidth(1, 1, Utc.ymd(2021, month, 1).and_hms(0, 0, 0)).unwrap();
+    }
+    assert_eq!(settings.bandwidth.len(), 12);
+    assert_eq!(settings.bandwidth_usage(may), 0);
+}
+
+#[test]
+fn persist_transaction() {
+    use pretty_assertions::assert_eq;
+    use tempfile::NamedTempFile;
+
+    let tempfile = NamedTempFile::new().unwrap();
+    std::fs::remove_file(tempfile.path()).unwrap();
+    let mut settings = RuntimeSettings::load(tempfile.path()).unwrap();
+    settings.enable_persistency();
+    settings.begin_transaction(b"{}", None).unwrap();
+    settings.set_transaction_state("install").unwrap();
+    settings.add_transaction_object("e3b0c44298fc1c14").unwrap();
+
+    let new_settings = RuntimeSettings::load(tempfile.path()).unwrap();
+    let transaction = new_settings.transaction().unwrap();
+    assert_eq!(transaction.package, "{}");
+    assert_eq!(transaction.state, "install");
+    assert_eq!(transaction.installed_objects, vec!["e3b0c44298fc1c14"]);
+
+    assert_eq!(settings.count_transaction_attempt().unwrap(), Some(1));
+    let new_settings = RuntimeSettings::load(tempfile.path()).unwrap();
+    assert_eq!(new_settings.transaction().unwrap().attempts, 1);
+    settings.begin_transaction(b"{}", None).unwrap();
+    assert_eq!(settings.transaction().unwrap().attempts, 1);
+
+    settings.end_transaction().unwrap();
+    assert_eq!(RuntimeSettings::load(tempfile.path()).unwrap().transaction(), None);
+}
+
+#[test]
+fn persist_counters() {
+    use chrono::TimeZone;
+    use pretty_assertions::assert_eq;
+    use tempfile::NamedTempFile;
+
+    let tempfile = NamedTempFile::new().unwrap();
+    std::fs::remove_file(tempfile.path()).unwrap();
+    let mut settings = RuntimeSettings::load(tempfile.path()).unwrap();
+    settings.enable_persistency();
+    settings.set_update_result(api::UpdateOutcome::Installed, None, None).unwrap();
+    settings.set_update_result(api::UpdateOutcome::RolledBack, None, None).unwrap();
+    settings.set_update_result(api::UpdateOutcome::Failed, None, None).unwrap();
+    settings.add_bandwidth(1024, 128, Utc.ymd(2020, 5, 10).and_hms(0, 0, 0)).unwrap();
+    // Unlike the bandwidth usage, the counters aren't dropped over time
+    settings.add_bandwidth(1024, 128, Utc.ymd(2022, 5, 10).and_hms(0, 0, 0)).unwrap();
+
+    let counters = RuntimeSettings::load(tempfile.path()).unwrap().counters.clone();
+    assert_eq!(
+        counters,
+        api::Counters {
+            updates_attempted: 3,
+            updates_succeeded: 1,
+            rollbacks: 1,
+            bytes_downloaded: 2048,
+        }
+    );
+}
+
+#[test]
+fn track_identity_change() {
+    use pretty_assertions::assert_eq;
+
+    let identity = |mac: &str| {
+        let mut identity = MetadataValue::default();
+        identity.entry("mac".to_owned()).or_default().push(mac.to_owned());
+        identity
+    };
+
+    let mut settings = RuntimeSettings::default();
+    assert!(!settings.track_identity(&identity("00:11")).unwrap());
+    assert!(!settings.track_identity(&identity("00:11")).unwrap());
+    assert_eq!(settings.previous_identity(), None);
+
+    // The identity before the first unconfirmed change is kept
+    assert!(settings.track_identity(&identity("00:22")).unwrap());
+    assert!(settings.track_identity(&identity("00:33")).unwrap());
+    assert_eq!(settings.previous_identity(), Some(&identity("00:11")));
+
+    assert!(settings.confirm_identity_change().unwrap());
+    assert!(!settings.confirm_identity_change().unwrap());
+    assert_eq!(settings.previous_identity(), None);
+    assert_eq!(settings.device_identity, Some(identity("00:33")));
+}
+
+#[test]
+fn record_installations() {
+    use pretty_assertions::assert_eq;
+
+    let record = |set, version: &str| api::InstallationRecord {
+        installation_set: set,
+        package_uid: format!("package-{}", version),
+        version: version.to_owned(),
+        time: Utc::now(),
+        regions: Vec::default(),
+    };
+
+    let mut settings = RuntimeSettings::default();
+    settings.record_installation(record(api::InstallationSet::A, "1.0")).unwrap();
+    settings.record_installation(record(api::InstallationSet::B, "1.1")).unwrap();
+    settings.record_installation(record(api::InstallationSet::A, "1.2")).unwrap();
+
+    assert_eq!(settings.installations.len(), 2);
+    assert_eq!(
+        settings.installation_record(Set(api::InstallationSet::A)).map(|r| r.version.as_str()),
+        Some("1.2")
+    );
+    assert_eq!(
+        settings.installation_record(Set(api::InstallationSet::B)).map(|r| r.version.as_str()),
+        Some("1.1")
+    );
+}
+
+#[test]
+fn quarantine_installation_set() {
+    let set = Set(api::InstallationSet::B);
+    let mut settings = RuntimeSettings::default();
+
+    settings.add_activation_failure(set, Some("package".to_owned()), 2).unwrap();
+    assert!(!settings.is_quarantined(set));
+    settings.add_activation_failure(set, Some("package".to_owned()), 2).unwrap();
+    assert!(settings.is_quarantined(set));
+    assert!(!settings.is_quarantined(Set(api::InstallationSet::A)));
+    assert_eq!(settings.unreported_quarantines().len(), 1);
+
+    settings.set_quarantine_reported(set).unwrap();
+    assert!(settings.unreported_quarantines().is_empty());
+
+    // Installing a new image into the set lifts the quarantine
+    settings
+        .record_installation(api::InstallationRecord {
+            installation_set: set.0,
+            package_uid: "new-package".to_owned(),
+            version: "1.1".to_owned(),
+            time: Utc::now(),
+            regions: Vec::default(),
+        })
+        .unwrap();
+    assert!(!settings.is_quarantined(set));
+}
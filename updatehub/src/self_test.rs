@@ -0,0 +1,161 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use crate::utils;
+use pkg_schema::definitions::Filesystem;
+use slog_scope::{debug, info, warn};
+use std::{
+    fs,
+    io::{self, Read, Seek, SeekFrom, Write},
+    path::{Path, PathBuf},
+};
+use thiserror::Error;
+
+// Size of the throwaway images attached to the loop devices, enough
+// to hold an ext4 filesystem.
+const IMAGE_SIZE: u64 = 8 * 1024 * 1024;
+const PATTERN: &[u8] = b"updatehub self-test pattern\n";
+
+type Result<T> = std::result::Result<T, Error>;
+
+#[derive(Debug, Error)]
+enum Error {
+    #[error("Utils error: {0}")]
+    Utils(#[from] utils::Error),
+
+    #[error("Io error: {0}")]
+    Io(#[from] io::Error),
+
+    #[error("Pattern read back from {0:?} does not match the written one")]
+    PatternMismatch(PathBuf),
+}
+
+/// Exercises each of the install `modes`, returning the non-functional
+/// ones along with the failure reason.
+pub(crate) fn run(modes: &[String]) -> Vec<(String, String)> {
+    modes
+        .iter()
+        .filter_map(|mode| {
+            info!("running self-test for '{}' install mode", mode);
+            match check(mode) {
+                Ok(()) => None,
+                Err(e) => {
+                    warn!("'{}' install mode is not functional: {}", mode, e);
+                    Some((mode.clone(), e.to_string()))
+                }
+            }
+        })
+        .collect()
+}
+
+fn check(mode: &str) -> Result<()> {
+    match mode {
+        "raw" => {
+            let device = LoopDevice::new()?;
+            write_and_verify(device.path())
+        }
+        // The ext4 filesystem is used as a representative of the ones the
+        // objects may be installed into.
+        "copy" | "tarball" => {
+            let device = LoopDevice::new()?;
+            utils::fs::format(device.path(), Filesystem::Ext4, &None)?;
+            utils::fs::mount_map(device.path(), Filesystem::Ext4, "", |dir| {
+                write_and_verify(&dir.join("self-test"))
+            })?
+        }
+        // The flash based modes can't be exercised without real hardware,
+        // so only their tools are checked.
+        "flash" => tools(&["nandwrite", "flashcp", "flash_erase"]),
+        "imxkobs" => tools(&["kobs-ng"]),
+        "ubifs" => tools(&["ubiupdatevol", "ubinfo"]),
+        "script" => tools(&["prlimit", "unshare"]),
+        _ => {
+            debug!("no self-test available for '{}' install mode", mode);
+            Ok(())
+        }
+    }
+}
+
+fn tools(names: &[&str]) -> Result<()> {
+    for name in names {
+        utils::fs::is_executable_in_path(name)?;
+    }
+    Ok(())
+}
+
+fn write_and_verify(target: &Path) -> Result<()> {
+    let mut file = fs::OpenOptions::new().read(true).write(true).create(true).open(target)?;
+    file.write_all(PATTERN)?;
+    file.sync_all()?;
+
+    let mut buf = vec![0; PATTERN.len()];
+    file.seek(SeekFrom::Start(0))?;
+    file.read_exact(&mut buf)?;
+    if buf != PATTERN {
+        return Err(Error::PatternMismatch(target.to_owned()));
+    }
+
+    Ok(())
+}
+
+/// Loop device backed by a throwaway image, which is detached when
+/// dropped.
+struct LoopDevice {
+    device: loopdev::LoopDevice,
+    path: PathBuf,
+    _image: tempfile::NamedTempFile,
+}
+
+impl LoopDevice {
+    fn new() -> Result<Self> {
+        let image = tempfile::NamedTempFile::new()?;
+        image.as_file().set_len(IMAGE_SIZE)?;
+
+        let device = loopdev::LoopControl::open()?.next_free()?;
+        device.attach_file(image.path())?;
+        let path = device
+            .path()
+            .ok_or_else(|| io::Error::new(io::ErrorKind::NotFound, "loop device has no path"))?;
+
+        Ok(LoopDevice { device, path, _image: image })
+    }
+
+    fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
+impl Drop for LoopDevice {
+    fn drop(&mut self) {
+        if let Err(e) = self.device.detach() {
+            warn!("failed to detach {:?}: {}", self.path, e);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn functional_modes() {
+        let (_handle, _) = create_echo_bins(&["kobs-ng"]).unwrap();
+        let modes = vec!["imxkobs".to_string(), "test".to_string()];
+        assert_eq!(run(&modes), vec![]);
+    }
+
+    #[test]
+    fn missing_tools() {
+        assert!(tools(&["updatehub-missing-tool"]).is_err());
+    }
+
+    #[test]
+    fn pattern_roundtrip() {
+        let dir = tempfile::tempdir().unwrap();
+        write_and_verify(&dir.path().join("file")).unwrap();
+        assert_eq!(fs::read(dir.path().join("file")).unwrap(), PATTERN);
+    }
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Simulated device, so the updates can be tested end to end without
+//! its hardware, as in a container running the CI of the packages. The
+//! device targets are files in the simulation directory, the active
+//! installation set is kept in a GRUB environment block there and the
+//! reboots restart the agent instead, which then goes through the boot
+//! of the updated installation set.
+
+use crate::{firmware::grubenv::GrubEnv, utils};
+use pkg_schema::{
+    definitions::{FpgaTarget, TargetType},
+    Object,
+};
+use sdk::api::info::settings::Simulation;
+use slog_scope::{debug, error, info, warn};
+use std::{
+    fs::{self, OpenOptions},
+    io::{self, Write},
+    path::{Path, PathBuf},
+};
+
+const DEVICES_DIR: &str = "devices";
+const GRUB_ENV: &str = "grubenv";
+const REBOOT_REQUESTS: &str = "reboot-requests";
+
+/// Creates the simulation directory, along with the environment block of
+/// the simulated bootloader, which boots the first installation set until
+/// it is changed.
+pub(crate) fn prepare(settings: &Simulation) -> io::Result<()> {
+    warn!("running on a simulated device kept in {:?}", settings.dir);
+    fs::create_dir_all(settings.dir.join(DEVICES_DIR))?;
+
+    let grub_env = settings.dir.join(GRUB_ENV);
+    if !grub_env.exists() {
+        GrubEnv::default().save(&grub_env)?;
+    }
+    Ok(())
+}
+
+/// Resolves the device targets of the `object` to the files standing for
+/// them, which are created on their first use.
+pub(crate) fn resolve_object_targets(settings: &Simulation, object: &mut Object) {
+    if !settings.enabled {
+        return;
+    }
+
+    let resolve_device = |p: &mut PathBuf| {
+        *p = device_path(settings, p);
+        debug!("device target simulated by {:?}", p);
+        if let Err(e) = create_device(settings, p) {
+            error!("failed to create simulated device {:?}: {}", p, e);
+        }
+    };
+    let resolve_target = |target: &mut TargetType| {
+        if let TargetType::Device(ref mut p) = target {
+            resolve_device(p);
+        }
+    };
+
+    match object {
+        Object::Copy(o) => resolve_target(&mut o.target_type),
+        Object::Raw(o) => resolve_target(&mut o.target_type),
+        Object::Tarball(o) => resolve_target(&mut o.target),
+        Object::DiskImage(o) => resolve_target(&mut o.target),
+        Object::Fpga(o) => {
+            if let FpgaTarget::Device(ref mut p) = o.target {
+                resolve_device(p);
+            }
+        }
+        Object::Agent(_)
+        | Object::Flash(_)
+        | Object::Imxkobs(_)
+        | Object::Script(_)
+        | Object::Test(_)
+        | Object::Ubifs(_) => {}
+    }
+}
+
+/// Records the reboot request, for the tests to check, restarting the
+/// agent instead of the device.
+pub(crate) fn reboot(settings: &Simulation) -> utils::Result<()> {
+    let mut requests =
+        OpenOptions::new().create(true).append(true).open(settings.dir.join(REBOOT_REQUESTS))?;
+    writeln!(requests, "{}", chrono::Utc::now().to_rfc3339())?;
+    requests.sync_all()?;
+
+    info!("simulating the reboot by restarting the agent");
+    utils::agent_update::restart()
+}
+
+fn device_path(settings: &Simulation, path: &Path) -> PathBuf {
+    settings.dir.join(DEVICES_DIR).join(path.strip_prefix("/").unwrap_or(path))
+}
+
+// The devices are sparse files, so only what is written to them takes
+// space.
+fn create_device(settings: &Simulation, path: &Path) -> io::Result<()> {
+    if path.exists() {
+        return Ok(());
+    }
+    if let Some(dir) = path.parent() {
+        fs::create_dir_all(dir)?;
+    }
+    fs::File::create(path)?.set_len(settings.device_size)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use serde_json::json;
+
+    #[test]
+    fn simulated_devices() {
+        let dir = tempfile::tempdir().unwrap();
+        let settings = Simulation {
+            enabled: true,
+            dir: dir.path().to_owned(),
+            device_size: 4096,
+            ..Simulation::default()
+        };
+        prepare(&settings).unwrap();
+        assert!(GrubEnv::load(&dir.path().join(GRUB_ENV)).unwrap().0.is_empty());
+
+        let mut object = serde_json::from_value::<Object>(json!({
+            "mode": "raw",
+            "filename": "rootfs",
+            "size": 4,
+            "sha256sum": "rootfs",
+            "target-type": "device",
+            "target": "/dev/mmcblk0p2"
+        }))
+        .unwrap();
+        resolve_object_targets(&settings, &mut object);
+
+        let device = dir.path().join("devices/dev/mmcblk0p2");
+        match object {
+            Object::Raw(o) => assert_eq!(o.target_type, TargetType::Device(device.clone())),
+            o => panic!("Unexpected object: {:?}", o),
+        }
+        assert_eq!(device.metadata().unwrap().len(), 4096);
+    }
+}
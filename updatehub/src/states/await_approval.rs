@@ -0,0 +1,259 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    machine::{self, SharedState},
+    AwaitGoAhead, AwaitNetwork, EntryPoint, Result, State, StateChangeImpl,
+};
+use crate::{
+    settings::Settings,
+    update_package::{UpdatePackage, UpdatePackageExt},
+};
+use slog_scope::{error, info, warn};
+use std::time::Instant;
+
+/// Decision taken by the operator, through the agent API.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub(crate) enum Approval {
+    Approved,
+    Denied,
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub(super) enum ApprovalStage {
+    Download,
+    Install,
+}
+
+/// Waits for the update to be approved before it is downloaded or
+/// installed, approving it on its own once the deadline is reached.
+#[derive(Debug, PartialEq)]
+pub(super) struct AwaitApproval {
+    pub(super) update_package: UpdatePackage,
+    pub(super) stage: ApprovalStage,
+    pub(super) deadline: Option<Instant>,
+    pub(super) reported: bool,
+}
+
+impl AwaitApproval {
+    /// State the update is downloaded from, once validated.
+    pub(super) fn download(update_package: UpdatePackage, settings: &Settings) -> State {
+        if !settings.approval.required || settings.approval.after_download {
+            return AwaitNetwork::download(update_package, settings);
+        }
+        Self::new(update_package, ApprovalStage::Download, settings)
+    }
+
+    /// State the update is installed from, once downloaded.
+    pub(super) fn install(update_package: UpdatePackage, settings: &Settings) -> State {
+        if !settings.approval.required || !settings.approval.after_download {
+            return AwaitGoAhead::install(update_package, settings);
+        }
+        Self::new(update_package, ApprovalStage::Install, settings)
+    }
+
+    fn new(update_package: UpdatePackage, stage: ApprovalStage, settings: &Settings) -> State {
+        let auto_approve_after = settings.approval.auto_approve_after;
+        let deadline = auto_approve_after
+            .to_std()
+            .ok()
+            .filter(|_| auto_approve_after > chrono::Duration::zero())
+            .map(|after| Instant::now() + after);
+
+        State::AwaitApproval(AwaitApproval { update_package, stage, deadline, reported: false })
+    }
+
+    fn approve(self, settings: &Settings) -> State {
+        match self.stage {
+            ApprovalStage::Download => AwaitNetwork::download(self.update_package, settings),
+            ApprovalStage::Install => AwaitGoAhead::install(self.update_package, settings),
+        }
+    }
+}
+
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for AwaitApproval {
+    fn name(&self) -> &'static str {
+        "await_approval"
+    }
+
+    fn is_preemptive_state(&self) -> bool {
+        self.stage == ApprovalStage::Download
+    }
+
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
+    async fn handle(
+        mut self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        let package_uid = self.update_package.package_uid();
+        if shared_state.update_cancel.is_requested() {
+            return super::cancel_update(shared_state, &package_uid, self.name()).await;
+        }
+
+        match shared_state.approval.take() {
+            Some(Approval::Approved) => {
+                info!("update approved");
+                return Ok((
+                    self.approve(&shared_state.settings),
+                    machine::StepTransition::Immediate,
+                ));
+            }
+            Some(Approval::Denied) => {
+                info!("update denied, returning to machine's entry point");
+                report(shared_state, "denied", &package_uid).await;
+                if let Err(e) = shared_state.runtime_settings.end_transaction() {
+                    error!("failed to drop the update transaction: {}", e);
+                }
+                return Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate));
+            }
+            None => {}
+        }
+
+        let now = Instant::now();
+        if self.deadline.map_or(false, |deadline| now >= deadline) {
+            info!("update has not been approved in time, approving it");
+            return Ok((self.approve(&shared_state.settings), machine::StepTransition::Immediate));
+        }
+
+        // Only the downloaded packages can be superseded, as a newer one
+        // is handled as usual before it is downloaded.
+        let interval = match self.stage {
+            ApprovalStage::Download => None,
+            ApprovalStage::Install => super::superseding_interval(&shared_state.settings),
+        };
+        if interval.is_some() {
+            if let Some(state) =
+                super::check_superseded(shared_state, &self.update_package, self.name()).await
+            {
+                return Ok((state, machine::StepTransition::Immediate));
+            }
+        }
+
+        if !self.reported {
+            info!("waiting for the update to be approved");
+            report(shared_state, "awaiting-approval", &package_uid).await;
+            self.reported = true;
+        }
+
+        // The approval wakes the state machine up, while it is awoken
+        // earlier to probe the server for a newer package.
+        let transition = match (self.deadline, interval) {
+            (Some(deadline), Some(interval)) => {
+                machine::StepTransition::Delayed((deadline - now).min(interval))
+            }
+            (Some(deadline), None) => machine::StepTransition::Delayed(deadline - now),
+            (None, Some(interval)) => machine::StepTransition::Delayed(interval),
+            (None, None) => machine::StepTransition::Never,
+        };
+        Ok((State::AwaitApproval(self), transition))
+    }
+}
+
+async fn report(shared_state: &SharedState, state: &str, package_uid: &str) {
+    let server = shared_state.server_address().to_owned();
+    if let Err(e) = crate::CloudClient::new(&server)
+        .report(
+            state,
+            shared_state.firmware.as_cloud_metadata(),
+            package_uid,
+            None,
+            None,
+            None,
+            None,
+        )
+        .await
+    {
+        warn!("report failed: {}", e);
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::update_package::tests::get_update_package;
+
+    fn require_approval(shared_state: &mut SharedState) {
+        shared_state.settings.approval.required = true;
+    }
+
+    #[actix_rt::test]
+    async fn skip_when_not_required() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let shared_state = setup.gen_shared_state();
+
+        let state = AwaitApproval::download(get_update_package(), &shared_state.settings);
+        assert_state!(state, PrepareDownload);
+    }
+
+    #[actix_rt::test]
+    async fn wait_for_approval() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        require_approval(&mut shared_state);
+
+        let state = AwaitApproval::download(get_update_package(), &shared_state.settings);
+        let (state, transition) = state.move_to_next_state(&mut shared_state).await.unwrap();
+        assert_state!(state, AwaitApproval);
+        match transition {
+            machine::StepTransition::Never => {}
+            t => panic!("Unexpected transition: {:?}", t),
+        }
+
+        shared_state.approval = Some(Approval::Approved);
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, PrepareDownload);
+    }
+
+    #[actix_rt::test]
+    async fn deny_update() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        require_approval(&mut shared_state);
+        shared_state.settings.approval.after_download = true;
+        shared_state.approval = Some(Approval::Denied);
+
+        let state = AwaitApproval::install(get_update_package(), &shared_state.settings);
+        assert_state!(state, AwaitApproval);
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, EntryPoint);
+    }
+
+    #[actix_rt::test]
+    async fn auto_approve() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        require_approval(&mut shared_state);
+
+        let state = State::AwaitApproval(AwaitApproval {
+            update_package: get_update_package(),
+            stage: ApprovalStage::Download,
+            deadline: Some(Instant::now()),
+            reported: true,
+        });
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, PrepareDownload);
+    }
+
+    #[actix_rt::test]
+    async fn supersede_downloaded_update() {
+        use crate::update_package::tests::get_update_package_with_shasum;
+        use sdk::api::info::settings::SupersedePolicy;
+
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        require_approval(&mut shared_state);
+        shared_state.settings.approval.after_download = true;
+        shared_state.settings.update.supersede_policy = SupersedePolicy::Replace;
+        crate::cloud_mock::setup_fake_response(crate::cloud_mock::FakeResponse::HasUpdate);
+
+        let stale = get_update_package_with_shasum(&crate::utils::sha256sum(b"stale"));
+        let state = AwaitApproval::install(stale, &shared_state.settings);
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, Validation);
+    }
+}
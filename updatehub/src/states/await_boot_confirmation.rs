@@ -0,0 +1,130 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    machine::{self, SharedState},
+    EntryPoint, Result, State, StateChangeImpl,
+};
+use crate::{
+    firmware,
+    utils::{
+        self,
+        health_check::{self, Verdict},
+    },
+};
+use sdk::api::info::runtime_settings::UpdateOutcome;
+use slog_scope::{error, info};
+use std::time::{Duration, Instant};
+
+// Interval between the health check runs.
+const CHECK_INTERVAL: Duration = Duration::from_secs(10);
+
+/// Waits for the installation just booted into to be confirmed, through
+/// the agent API or by passing the health checks, rolling it back if any
+/// check fails or it is not confirmed in time.
+#[derive(Debug, PartialEq)]
+pub(super) struct AwaitBootConfirmation {
+    pub(super) deadline: Instant,
+    pub(super) health: health_check::Report,
+}
+
+/// Confirms the installation, so the bootloader keeps booting into it.
+pub(super) fn confirm(shared_state: &mut SharedState) -> Result<()> {
+    info!("installation confirmed");
+    utils::privsep::validate()?;
+    if let Some(package) = shared_state.runtime_settings.commit_security_version()? {
+        utils::privsep::store_security_version(&shared_state.settings, &package)?;
+    }
+    let package_uid = shared_state.runtime_settings.applied_package_uid();
+    shared_state.runtime_settings.set_update_result(UpdateOutcome::Installed, package_uid, None)?;
+    shared_state.runtime_settings.finish_update_chain_step(true)?;
+    shared_state.runtime_settings.reset_installation_settings()?;
+    if let Err(e) = utils::kubernetes::uncordon(&shared_state.settings.kubernetes) {
+        error!("failed to uncordon the kubernetes node: {}", e);
+    }
+    Ok(())
+}
+
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for AwaitBootConfirmation {
+    fn name(&self) -> &'static str {
+        "await_boot_confirmation"
+    }
+
+    async fn handle(
+        mut self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        let checks = health_check::checks(&shared_state.settings.boot_confirmation);
+        let verdict =
+            if checks.is_empty() { Verdict::Pending } else { self.health.run(&checks).await };
+
+        let message = match verdict {
+            Verdict::Passed => {
+                info!("health checks have passed");
+                confirm(shared_state)?;
+                return Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate));
+            }
+            Verdict::Failed => {
+                error!("health checks have failed, rolling the installation back");
+                format!("health checks have failed: {}", self.health.summary())
+            }
+            Verdict::Pending => {
+                let now = Instant::now();
+                if now < self.deadline {
+                    let wait = std::cmp::min(CHECK_INTERVAL, self.deadline - now);
+                    return Ok((
+                        State::AwaitBootConfirmation(self),
+                        machine::StepTransition::Delayed(wait),
+                    ));
+                }
+
+                error!("installation has not been confirmed in time, rolling it back");
+                let mut message = format!(
+                    "installation not confirmed in {} seconds",
+                    shared_state.settings.boot_confirmation.timeout.num_seconds()
+                );
+                if !checks.is_empty() {
+                    message += &format!(", health checks: {}", self.health.summary());
+                }
+                message
+            }
+        };
+
+        let package_uid = shared_state.runtime_settings.applied_package_uid();
+        shared_state.runtime_settings.add_activation_failure(
+            firmware::installation_set::active()?,
+            package_uid.clone(),
+            shared_state.settings.boot_confirmation.max_failed_activations,
+        )?;
+        let package_uid = package_uid.unwrap_or_default();
+        super::rollback::rollback(shared_state, package_uid, message).await?;
+        Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+
+    #[actix_rt::test]
+    async fn wait_for_confirmation() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let state = AwaitBootConfirmation {
+            deadline: Instant::now() + Duration::from_secs(60),
+            health: health_check::Report::default(),
+        };
+
+        let (machine, transition) = State::AwaitBootConfirmation(state)
+            .move_to_next_state(&mut shared_state)
+            .await
+            .unwrap();
+        assert_state!(machine, AwaitBootConfirmation);
+        match transition {
+            machine::StepTransition::Delayed(wait) => assert_eq!(wait, CHECK_INTERVAL),
+            t => panic!("Unexpected transition: {:?}", t),
+        }
+    }
+}
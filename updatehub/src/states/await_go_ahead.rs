@@ -0,0 +1,169 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    machine::{self, SharedState},
+    AwaitMaintenanceWindow, Result, State, StateChangeImpl,
+};
+use crate::{
+    settings::Settings,
+    update_package::{UpdatePackage, UpdatePackageExt},
+};
+use sdk::api::events::Event;
+use slog_scope::{info, warn};
+
+/// Announces the downloaded update as ready to be installed and waits
+/// for the go-ahead of an external scheduler, so the updates can be
+/// sequenced across machines.
+#[derive(Debug, PartialEq)]
+pub(super) struct AwaitGoAhead {
+    pub(super) update_package: UpdatePackage,
+    /// Token of the announcement the go-ahead must carry, created once
+    /// the update is first announced.
+    pub(super) token: Option<String>,
+    pub(super) reported: bool,
+}
+
+impl AwaitGoAhead {
+    /// State the update is installed from, once downloaded and approved.
+    pub(super) fn install(update_package: UpdatePackage, settings: &Settings) -> State {
+        if !settings.scheduler.enabled {
+            return AwaitMaintenanceWindow::install(update_package, settings);
+        }
+        State::AwaitGoAhead(AwaitGoAhead { update_package, token: None, reported: false })
+    }
+}
+
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for AwaitGoAhead {
+    fn name(&self) -> &'static str {
+        "await_go_ahead"
+    }
+
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
+    async fn handle(
+        mut self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        let package_uid = self.update_package.package_uid();
+        if shared_state.update_cancel.is_requested() {
+            return super::cancel_update(shared_state, &package_uid, self.name()).await;
+        }
+
+        let token = match self.token {
+            Some(ref token) => token.clone(),
+            None => {
+                let token = new_token()?;
+                self.token = Some(token.clone());
+                token
+            }
+        };
+        if shared_state.go_ahead.take().as_ref() == Some(&token) {
+            info!("go-ahead given by the scheduler, installing the update");
+            return Ok((
+                AwaitMaintenanceWindow::install(self.update_package, &shared_state.settings),
+                machine::StepTransition::Immediate,
+            ));
+        }
+
+        if let Some(state) =
+            super::check_superseded(shared_state, &self.update_package, self.name()).await
+        {
+            return Ok((state, machine::StepTransition::Immediate));
+        }
+
+        info!("update is ready to be installed, waiting for the go-ahead");
+        let event = Event::ReadyToInstall {
+            package_uid: package_uid.clone(),
+            version: self.update_package.inner.version.clone(),
+            token,
+        };
+        if let Some(ref webhook) = shared_state.settings.scheduler.webhook {
+            if let Err(e) = cloud::notify(webhook, &event).await {
+                warn!("failed to notify the scheduler: {}", e);
+            }
+        }
+        shared_state.events.publish(event);
+
+        if !self.reported {
+            let server = shared_state.server_address().to_owned();
+            if let Err(e) = crate::CloudClient::new(&server)
+                .report(
+                    "awaiting-go-ahead",
+                    shared_state.firmware.as_cloud_metadata(),
+                    &package_uid,
+                    None,
+                    None,
+                    None,
+                    None,
+                )
+                .await
+            {
+                warn!("report failed: {}", e);
+            }
+            self.reported = true;
+        }
+
+        // The go-ahead wakes the state machine up, while the announcement
+        // is repeated in case the scheduler has missed it.
+        let interval = shared_state.settings.scheduler.interval.to_std().unwrap_or_default();
+        let interval = match super::superseding_interval(&shared_state.settings) {
+            Some(superseding) => interval.min(superseding),
+            None => interval,
+        };
+        Ok((State::AwaitGoAhead(self), machine::StepTransition::Delayed(interval)))
+    }
+}
+
+fn new_token() -> Result<String> {
+    let mut buf = [0; 16];
+    openssl::rand::rand_bytes(&mut buf).map_err(cloud::Error::from)?;
+    Ok(buf.iter().map(|b| format!("{:02x}", b)).collect())
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::update_package::tests::get_update_package;
+
+    #[actix_rt::test]
+    async fn skip_when_disabled() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let shared_state = setup.gen_shared_state();
+
+        let state = AwaitGoAhead::install(get_update_package(), &shared_state.settings);
+        assert_state!(state, Install);
+    }
+
+    #[actix_rt::test]
+    async fn wait_for_go_ahead() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.settings.scheduler.enabled = true;
+        let events = shared_state.events.subscribe();
+
+        let state = AwaitGoAhead::install(get_update_package(), &shared_state.settings);
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        let token = match events.try_recv().unwrap() {
+            Event::ReadyToInstall { token, .. } => token,
+            e => panic!("Unexpected event: {:?}", e),
+        };
+        match state {
+            State::AwaitGoAhead(ref s) => assert_eq!(s.token.as_ref(), Some(&token)),
+            ref s => panic!("Unexpected state: {:?}", s),
+        }
+
+        // A go-ahead for another announcement is ignored
+        shared_state.go_ahead = Some("stale".to_owned());
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, AwaitGoAhead);
+
+        shared_state.go_ahead = Some(token);
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, Install);
+    }
+}
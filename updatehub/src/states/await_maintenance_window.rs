@@ -0,0 +1,205 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    machine::{self, SharedState},
+    AwaitPower, AwaitReboot, AwaitRebootLock, Reboot, Result, State, StateChangeImpl,
+};
+use crate::{
+    settings::Settings,
+    update_package::{UpdatePackage, UpdatePackageExt},
+    utils,
+};
+use sdk::api::info::settings::RebootPolicy;
+use slog_scope::{info, warn};
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub(super) enum MaintenanceAction {
+    Install,
+    Reboot,
+}
+
+/// Defers the installation or the reboot of the update until one of the
+/// maintenance windows is open.
+#[derive(Debug, PartialEq)]
+pub(super) struct AwaitMaintenanceWindow {
+    pub(super) update_package: UpdatePackage,
+    pub(super) action: MaintenanceAction,
+}
+
+impl AwaitMaintenanceWindow {
+    /// State the update is installed from, once downloaded.
+    pub(super) fn install(update_package: UpdatePackage, settings: &Settings) -> State {
+        if settings.maintenance.install_windows.is_empty() {
+            return AwaitPower::install(update_package, settings);
+        }
+        State::AwaitMaintenanceWindow(AwaitMaintenanceWindow {
+            update_package,
+            action: MaintenanceAction::Install,
+        })
+    }
+
+    /// State the device is rebooted from, once the update is installed.
+    pub(super) fn reboot(update_package: UpdatePackage, settings: &Settings) -> State {
+        match settings.reboot.policy {
+            RebootPolicy::Application => {
+                return State::AwaitReboot(AwaitReboot { update_package: Some(update_package) })
+            }
+            RebootPolicy::MaintenanceWindow if !settings.maintenance.reboot_windows.is_empty() => {}
+            RebootPolicy::Immediate | RebootPolicy::MaintenanceWindow => {
+                return AwaitPower::reboot(update_package, settings)
+            }
+        }
+        State::AwaitMaintenanceWindow(AwaitMaintenanceWindow {
+            update_package,
+            action: MaintenanceAction::Reboot,
+        })
+    }
+}
+
+pub(super) fn reboot_state(update_package: UpdatePackage, settings: &Settings) -> State {
+    if settings.cluster.lock_url.is_some() {
+        State::AwaitRebootLock(AwaitRebootLock { update_package, reported: false })
+    } else {
+        State::Reboot(Reboot { update_package })
+    }
+}
+
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for AwaitMaintenanceWindow {
+    fn name(&self) -> &'static str {
+        "await_maintenance_window"
+    }
+
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
+    async fn handle(
+        self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        if shared_state.update_cancel.is_requested() {
+            let package_uid = self.update_package.package_uid();
+            return super::cancel_update(shared_state, &package_uid, self.name()).await;
+        }
+
+        // The windows are given in local time, which is only trusted
+        // once the clock has been corrected.
+        if let Err(e) = utils::time_sync::sync_clock(&shared_state.settings.time_sync) {
+            warn!("unable to sync the clock: {}", e);
+        }
+
+        let maintenance = &shared_state.settings.maintenance;
+        let windows = match self.action {
+            MaintenanceAction::Install => &maintenance.install_windows,
+            MaintenanceAction::Reboot => &maintenance.reboot_windows,
+        };
+
+        if let Some(wait) = utils::maintenance::until_window(maintenance, windows) {
+            info!("deferring the {:?} for {} seconds", self.action, wait.as_secs());
+            if self.action == MaintenanceAction::Install {
+                if let Some(state) =
+                    super::check_superseded(shared_state, &self.update_package, self.name()).await
+                {
+                    return Ok((state, machine::StepTransition::Immediate));
+                }
+            }
+
+            // Awoken earlier to probe the server for a newer package.
+            let wait = match super::superseding_interval(&shared_state.settings) {
+                Some(interval) if self.action == MaintenanceAction::Install => wait.min(interval),
+                _ => wait,
+            };
+            return Ok((
+                State::AwaitMaintenanceWindow(self),
+                machine::StepTransition::Delayed(wait),
+            ));
+        }
+
+        let state = match self.action {
+            MaintenanceAction::Install => {
+                AwaitPower::install(self.update_package, &shared_state.settings)
+            }
+            MaintenanceAction::Reboot => {
+                AwaitPower::reboot(self.update_package, &shared_state.settings)
+            }
+        };
+        Ok((state, machine::StepTransition::Immediate))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::{states::TransitionError, update_package::tests::get_update_package};
+    use sdk::api::info::settings::MaintenanceWindow;
+
+    #[actix_rt::test]
+    async fn install_within_window() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let now = chrono::Local::now().time();
+        shared_state.settings.maintenance.install_windows = vec![MaintenanceWindow {
+            start: now - chrono::Duration::hours(1),
+            end: now + chrono::Duration::hours(1),
+        }];
+
+        let state = AwaitMaintenanceWindow::install(get_update_package(), &shared_state.settings);
+        assert_state!(state, AwaitMaintenanceWindow);
+
+        let machine = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(machine, Install);
+    }
+
+    #[actix_rt::test]
+    async fn cancel_while_waiting() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let now = chrono::Local::now().time();
+        shared_state.settings.maintenance.install_windows = vec![MaintenanceWindow {
+            start: now + chrono::Duration::hours(1),
+            end: now + chrono::Duration::hours(2),
+        }];
+        shared_state.update_cancel.set_cancellable(true);
+        assert!(shared_state.update_cancel.request());
+
+        let state = AwaitMaintenanceWindow::install(get_update_package(), &shared_state.settings);
+        match state.move_to_next_state(&mut shared_state).await {
+            Err(TransitionError::Canceled) => {}
+            res => panic!("Unexpected transition: {:?}", res),
+        }
+    }
+
+    #[actix_rt::test]
+    async fn reboot_without_windows() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let shared_state = setup.gen_shared_state();
+
+        let state = AwaitMaintenanceWindow::reboot(get_update_package(), &shared_state.settings);
+        assert_state!(state, Reboot);
+    }
+
+    #[actix_rt::test]
+    async fn reboot_as_the_policy_asks() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let now = chrono::Local::now().time();
+        shared_state.settings.maintenance.reboot_windows = vec![MaintenanceWindow {
+            start: now + chrono::Duration::hours(1),
+            end: now + chrono::Duration::hours(2),
+        }];
+
+        let state = AwaitMaintenanceWindow::reboot(get_update_package(), &shared_state.settings);
+        assert_state!(state, AwaitMaintenanceWindow);
+
+        shared_state.settings.reboot.policy = RebootPolicy::Immediate;
+        let state = AwaitMaintenanceWindow::reboot(get_update_package(), &shared_state.settings);
+        assert_state!(state, Reboot);
+
+        shared_state.settings.reboot.policy = RebootPolicy::Application;
+        let state = AwaitMaintenanceWindow::reboot(get_update_package(), &shared_state.settings);
+        assert_state!(state, AwaitReboot);
+    }
+}
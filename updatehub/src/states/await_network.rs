@@ -0,0 +1,134 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    machine::{self, SharedState},
+    PrepareDownload, Result, State, StateChangeImpl,
+};
+use crate::{
+    settings::Settings,
+    update_package::{UpdatePackage, UpdatePackageExt},
+    utils,
+};
+use slog_scope::{info, warn};
+
+/// Holds the download of the update while the device is connected through
+/// a network the downloads aren't allowed on, as a cellular one.
+#[derive(Debug, PartialEq)]
+pub(super) struct AwaitNetwork {
+    pub(super) update_package: UpdatePackage,
+    pub(super) reported: bool,
+}
+
+impl AwaitNetwork {
+    /// State the update is downloaded from.
+    pub(super) fn download(update_package: UpdatePackage, settings: &Settings) -> State {
+        if settings.download.allowed_networks.is_empty() {
+            return State::PrepareDownload(PrepareDownload { update_package });
+        }
+        State::AwaitNetwork(AwaitNetwork { update_package, reported: false })
+    }
+}
+
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for AwaitNetwork {
+    fn name(&self) -> &'static str {
+        "await_network"
+    }
+
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
+    async fn handle(
+        self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        if shared_state.update_cancel.is_requested() {
+            let package_uid = self.update_package.package_uid();
+            return super::cancel_update(shared_state, &package_uid, self.name()).await;
+        }
+
+        let connection =
+            match utils::network::disallowed_connection(&shared_state.settings.download) {
+                Some(connection) => connection,
+                None => {
+                    return Ok((
+                        State::PrepareDownload(PrepareDownload {
+                            update_package: self.update_package,
+                        }),
+                        machine::StepTransition::Immediate,
+                    ))
+                }
+            };
+
+        // The server is still reachable through the disallowed network, so
+        // it is told why the update isn't being downloaded.
+        if !self.reported {
+            let server = shared_state.server_address().to_owned();
+            if let Err(e) = crate::CloudClient::new(&server)
+                .report(
+                    "waiting-network",
+                    shared_state.firmware.as_cloud_metadata(),
+                    &self.update_package.package_uid(),
+                    None,
+                    None,
+                    None,
+                    None,
+                )
+                .await
+            {
+                warn!("report failed: {}", e);
+            }
+        }
+
+        let interval = shared_state.settings.download.network_retry_interval;
+        info!(
+            "deferring the download, connected through {} ({:?}), retrying in {} seconds",
+            connection.interface.as_deref().unwrap_or("unknown interface"),
+            connection.kind,
+            interval.num_seconds()
+        );
+        Ok((
+            State::AwaitNetwork(AwaitNetwork {
+                update_package: self.update_package,
+                reported: true,
+            }),
+            machine::StepTransition::Delayed(interval.to_std().unwrap_or_default()),
+        ))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::{states::TransitionError, update_package::tests::get_update_package};
+    use sdk::api::info::settings::NetworkType;
+
+    #[actix_rt::test]
+    async fn download_on_any_network() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let shared_state = setup.gen_shared_state();
+
+        let state = AwaitNetwork::download(get_update_package(), &shared_state.settings);
+        assert_state!(state, PrepareDownload);
+    }
+
+    #[actix_rt::test]
+    async fn cancel_while_waiting() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.settings.download.allowed_networks = vec![NetworkType::Ethernet];
+
+        let state = AwaitNetwork::download(get_update_package(), &shared_state.settings);
+        assert_state!(state, AwaitNetwork);
+
+        shared_state.update_cancel.set_cancellable(true);
+        assert!(shared_state.update_cancel.request());
+        match state.move_to_next_state(&mut shared_state).await {
+            Err(TransitionError::Canceled) => {}
+            res => panic!("Unexpected transition: {:?}", res),
+        }
+    }
+}
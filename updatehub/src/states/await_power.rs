@@ -0,0 +1,122 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    await_maintenance_window::{reboot_state, MaintenanceAction},
+    machine::{self, SharedState},
+    Install, Result, State, StateChangeImpl,
+};
+use crate::{
+    settings::Settings,
+    update_package::{UpdatePackage, UpdatePackageExt},
+    utils,
+};
+use slog_scope::info;
+
+/// Defers the installation or the reboot of the update until the power
+/// condition passes, as the battery being charged enough.
+#[derive(Debug, PartialEq)]
+pub(super) struct AwaitPower {
+    pub(super) update_package: UpdatePackage,
+    pub(super) action: MaintenanceAction,
+}
+
+impl AwaitPower {
+    /// State the update is installed from, once its window is open.
+    pub(super) fn install(update_package: UpdatePackage, settings: &Settings) -> State {
+        if !utils::power::is_gated(&settings.power) {
+            return State::Install(Install { update_package });
+        }
+        State::AwaitPower(AwaitPower { update_package, action: MaintenanceAction::Install })
+    }
+
+    /// State the device is rebooted from, once its window is open.
+    pub(super) fn reboot(update_package: UpdatePackage, settings: &Settings) -> State {
+        if !utils::power::is_gated(&settings.power) {
+            return reboot_state(update_package, settings);
+        }
+        State::AwaitPower(AwaitPower { update_package, action: MaintenanceAction::Reboot })
+    }
+}
+
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for AwaitPower {
+    fn name(&self) -> &'static str {
+        "await_power"
+    }
+
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
+    async fn handle(
+        self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        if shared_state.update_cancel.is_requested() {
+            let package_uid = self.update_package.package_uid();
+            return super::cancel_update(shared_state, &package_uid, self.name()).await;
+        }
+
+        let action = match self.action {
+            MaintenanceAction::Install => "install",
+            MaintenanceAction::Reboot => "reboot",
+        };
+        if !utils::power::condition_passes(&shared_state.settings.power, action) {
+            let interval = shared_state.settings.power.retry_interval;
+            info!(
+                "deferring the {}, the power condition doesn't pass, retrying in {} seconds",
+                action,
+                interval.num_seconds()
+            );
+            return Ok((
+                State::AwaitPower(self),
+                machine::StepTransition::Delayed(interval.to_std().unwrap_or_default()),
+            ));
+        }
+
+        let state = match self.action {
+            MaintenanceAction::Install => {
+                State::Install(Install { update_package: self.update_package })
+            }
+            MaintenanceAction::Reboot => reboot_state(self.update_package, &shared_state.settings),
+        };
+        Ok((state, machine::StepTransition::Immediate))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::update_package::tests::get_update_package;
+    use std::fs;
+
+    #[actix_rt::test]
+    async fn install_without_power_condition() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let shared_state = setup.gen_shared_state();
+
+        let state = AwaitPower::install(get_update_package(), &shared_state.settings);
+        assert_state!(state, Install);
+    }
+
+    #[actix_rt::test]
+    async fn reboot_once_charged() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let dir = tempfile::tempdir().unwrap();
+        let capacity = dir.path().join("capacity");
+        fs::write(&capacity, "5\n").unwrap();
+        shared_state.settings.power.battery_capacity_path = Some(capacity.clone());
+        shared_state.settings.power.min_battery_level = 20;
+
+        let state = AwaitPower::reboot(get_update_package(), &shared_state.settings);
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, AwaitPower);
+
+        fs::write(&capacity, "80\n").unwrap();
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, Reboot);
+    }
+}
@@ -0,0 +1,97 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    machine::{self, SharedState},
+    Reboot, Result, State, StateChangeImpl,
+};
+use crate::{
+    firmware::installation_set,
+    object,
+    update_package::{UpdatePackage, UpdatePackageExt},
+    utils,
+};
+use slog_scope::{info, warn};
+
+/// Leaves the device for the application to reboot into the installed
+/// update, as it knows when it can be interrupted. The runtime settings
+/// tell the reboot is required until then, across the agent restarts.
+#[derive(Debug, PartialEq)]
+pub(super) struct AwaitReboot {
+    /// Update just installed, unset once the reboot is recorded as
+    /// required.
+    pub(super) update_package: Option<UpdatePackage>,
+}
+
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for AwaitReboot {
+    fn name(&self) -> &'static str {
+        "await_reboot"
+    }
+
+    async fn handle(
+        self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        if let Some(update_package) = self.update_package {
+            // The packages only updating the agent restart it instead,
+            // which doesn't concern the application.
+            let installation_set = installation_set::inactive()?;
+            if object::is_agent_only(update_package.objects(installation_set)) {
+                return Ok((
+                    State::Reboot(Reboot { update_package }),
+                    machine::StepTransition::Immediate,
+                ));
+            }
+
+            let boot_id = utils::boottime::boot_id()?;
+            shared_state.runtime_settings.set_reboot_required(boot_id)?;
+            info!("update installed, awaiting the application to reboot the device");
+
+            let server = shared_state.server_address().to_owned();
+            if let Err(e) = crate::CloudClient::new(&server)
+                .report(
+                    "awaiting-reboot",
+                    shared_state.firmware.as_cloud_metadata(),
+                    &update_package.package_uid(),
+                    None,
+                    None,
+                    None,
+                    None,
+                )
+                .await
+            {
+                warn!("report failed: {}", e);
+            }
+        }
+
+        Ok((
+            State::AwaitReboot(AwaitReboot { update_package: None }),
+            machine::StepTransition::Never,
+        ))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::update_package::tests::get_update_package;
+
+    #[actix_rt::test]
+    async fn record_reboot_required() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let state = AwaitReboot { update_package: Some(get_update_package()) };
+
+        match State::AwaitReboot(state).move_to_next_state(&mut shared_state).await.unwrap() {
+            (
+                State::AwaitReboot(AwaitReboot { update_package: None }),
+                machine::StepTransition::Never,
+            ) => {}
+            res => panic!("Unexpected transition: {:?}", res),
+        }
+        let boot_id = utils::boottime::boot_id().unwrap();
+        assert!(shared_state.runtime_settings.is_reboot_required(&boot_id));
+    }
+}
@@ -0,0 +1,98 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    machine::{self, SharedState},
+    Reboot, Result, State, StateChangeImpl,
+};
+use crate::update_package::UpdatePackage;
+use slog_scope::{info, warn};
+
+/// Waits for the cluster reboot lock, so devices sharing a site don't
+/// reboot at the same time.
+#[derive(Debug, PartialEq)]
+pub(super) struct AwaitRebootLock {
+    pub(super) update_package: UpdatePackage,
+    pub(super) reported: bool,
+}
+
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for AwaitRebootLock {
+    fn name(&self) -> &'static str {
+        "await_reboot_lock"
+    }
+
+    async fn handle(
+        self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        let url = match shared_state.settings.cluster.lock_url {
+            Some(ref url) => url.clone(),
+            None => {
+                return Ok((
+                    State::Reboot(Reboot { update_package: self.update_package }),
+                    machine::StepTransition::Immediate,
+                ))
+            }
+        };
+
+        match cloud::acquire_lock(&url, shared_state.firmware.as_cloud_metadata()).await {
+            Ok(true) => {
+                info!("reboot lock acquired");
+                return Ok((
+                    State::Reboot(Reboot { update_package: self.update_package }),
+                    machine::StepTransition::Immediate,
+                ));
+            }
+            Ok(false) => info!("reboot lock is held by another device"),
+            Err(e) => warn!("failed to acquire reboot lock: {}", e),
+        }
+
+        if !self.reported {
+            let server = shared_state.server_address().to_owned();
+            if let Err(e) = crate::CloudClient::new(&server)
+                .report(
+                    "waiting-reboot-lock",
+                    shared_state.firmware.as_cloud_metadata(),
+                    &self.update_package.package_uid(),
+                    None,
+                    None,
+                    None,
+                    None,
+                )
+                .await
+            {
+                warn!("report failed: {}", e);
+            }
+        }
+
+        let interval = shared_state.settings.cluster.lock_retry_interval;
+        info!("retrying to acquire the reboot lock in {} seconds", interval.num_seconds());
+        Ok((
+            State::AwaitRebootLock(AwaitRebootLock {
+                update_package: self.update_package,
+                reported: true,
+            }),
+            machine::StepTransition::Delayed(interval.to_std().unwrap_or_default()),
+        ))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::update_package::tests::get_update_package;
+
+    #[actix_rt::test]
+    async fn reboot_without_lock_url() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let state = AwaitRebootLock { update_package: get_update_package(), reported: false };
+
+        let machine =
+            State::AwaitRebootLock(state).move_to_next_state(&mut shared_state).await.unwrap().0;
+
+        assert_state!(machine, Reboot);
+    }
+}
@@ -19,6 +19,10 @@ impl StateChangeImpl for DirectDownload {
         "direct_download"
     }
 
+    fn is_inhibiting_suspend(&self) -> bool {
+        true
+    }
+
     async fn handle(
         self,
         shared_state: &mut SharedState,
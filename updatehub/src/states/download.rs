@@ -4,14 +4,29 @@
 
 use super::{
     machine::{self, SharedState},
-    Install, ProgressReporter, Result, State, StateChangeImpl, TransitionError,
+    AwaitApproval, DownloadPaused, ProgressReporter, Result, State, StateChangeImpl,
+    TransitionError,
 };
 use crate::{
     firmware::installation_set,
-    object::{self, Info},
+    object::Info,
     update_package::{UpdatePackage, UpdatePackageExt},
+    utils,
 };
-use std::fmt;
+use async_std::prelude::FutureExt;
+use pkg_schema::Object;
+use sdk::api::progress::Stage;
+use slog_scope::{info, warn};
+use std::{
+    fmt, fs,
+    path::Path,
+    time::{Duration, Instant},
+};
+
+// How often the progress of the object being downloaded is updated, and
+// reported to the server.
+const PROGRESS_INTERVAL: Duration = Duration::from_secs(1);
+const PROGRESS_REPORT_INTERVAL: Duration = Duration::from_secs(10);
 
 pub(super) struct Download {
     pub(super) update_package: UpdatePackage,
@@ -44,6 +59,10 @@ impl ProgressReporter for Download {
         self.update_package.package_uid()
     }
 
+    fn update_metadata(&self) -> &[u8] {
+        &self.update_package.raw
+    }
+
     fn report_enter_state_name(&self) -> &'static str {
         "downloading"
     }
@@ -59,16 +78,62 @@ impl StateChangeImpl for Download {
         "download"
     }
 
+    fn is_inhibiting_suspend(&self) -> bool {
+        true
+    }
+
     fn is_handling_download(&self) -> bool {
         true
     }
 
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
     async fn handle(
         mut self,
         shared_state: &mut SharedState,
     ) -> Result<(State, machine::StepTransition)> {
-        if let Some(vec) = self.download_chan.recv().await {
-            vec.into_iter().try_for_each(|res| res)?;
+        let control = shared_state.download_control.clone();
+        let objects = self.update_package.objects(self.installation_set);
+        let package_uid = self.update_package.package_uid();
+        let encrypted = self.update_package.inner.encryption.is_some();
+        let timeout = self.update_package.download_timeout(&shared_state.settings);
+        let download_chan = &mut self.download_chan;
+        let outcome = async { Outcome::Done(download_chan.recv().await) }
+            .race(async {
+                control.paused().await;
+                Outcome::Paused
+            })
+            .race(async {
+                // A zero timeout never expires.
+                if timeout == Duration::default() {
+                    async_std::future::pending::<()>().await;
+                }
+                utils::boottime::sleep(timeout).await;
+                Outcome::Expired
+            })
+            .race(track_progress(shared_state, &package_uid, objects, encrypted))
+            .await;
+        // The download task stops as soon as the update is canceled.
+        if shared_state.update_cancel.is_requested() {
+            return Err(TransitionError::Canceled);
+        }
+        match outcome {
+            Outcome::Done(Some(vec)) => vec.into_iter().try_for_each(|res| res)?,
+            Outcome::Done(None) => {}
+            Outcome::Expired => {
+                warn!("download has not finished within {:?}", timeout);
+                control.cancel();
+                return Err(TransitionError::DownloadTimeout(timeout));
+            }
+            Outcome::Paused => {
+                info!("download paused");
+                return Ok((
+                    State::DownloadPaused(DownloadPaused { download: self }),
+                    machine::StepTransition::Never,
+                ));
+            }
         }
 
         let download_dir = &shared_state.settings.update.download_dir;
@@ -76,10 +141,11 @@ impl StateChangeImpl for Download {
             .update_package
             .objects(self.installation_set)
             .iter()
-            .all(|o| o.status(download_dir).ok() == Some(object::info::Status::Ready))
+            .filter(|o| !super::is_streamed(&shared_state.settings, encrypted, o))
+            .all(|o| o.is_downloaded(download_dir))
         {
             Ok((
-                State::Install(Install { update_package: self.update_package }),
+                AwaitApproval::install(self.update_package, &shared_state.settings),
                 machine::StepTransition::Immediate,
             ))
         } else {
@@ -88,6 +154,77 @@ impl StateChangeImpl for Download {
     }
 }
 
+// How the wait for the download task has ended.
+enum Outcome {
+    Done(Option<Vec<cloud::Result<()>>>),
+    Paused,
+    Expired,
+}
+
+// Samples the size of the object being downloaded, as the download task
+// writes it, or its segments, straight to the download dir. It never
+// returns, so it must be raced with the download results.
+async fn track_progress<T>(
+    shared_state: &SharedState,
+    package_uid: &str,
+    objects: &[Object],
+    encrypted: bool,
+) -> T {
+    let download_dir = &shared_state.settings.update.download_dir;
+    let api = crate::CloudClient::new(shared_state.server_address());
+    let progress = &shared_state.progress;
+    let mut last_report = Instant::now();
+
+    loop {
+        if let Some((index, object)) = objects.iter().enumerate().find(|(_, o)| {
+            !o.is_downloaded(download_dir)
+                && !super::is_streamed(&shared_state.settings, encrypted, o)
+        }) {
+            if progress.current().map_or(true, |p| p.stage != Stage::Download || p.index != index) {
+                progress.start(Stage::Download, index, objects.len(), object);
+            }
+            progress.update(downloaded_bytes(download_dir, object.sha256sum()));
+
+            if last_report.elapsed() >= PROGRESS_REPORT_INTERVAL {
+                last_report = Instant::now();
+                if let Some(current) = progress.current_for_cloud() {
+                    if let Err(e) = api
+                        .report_progress(
+                            "downloading",
+                            shared_state.firmware.as_cloud_metadata(),
+                            package_uid,
+                            &current,
+                        )
+                        .await
+                    {
+                        warn!("progress report failed: {}", e);
+                    }
+                }
+            }
+        }
+
+        async_std::task::sleep(PROGRESS_INTERVAL).await;
+    }
+}
+
+// Bytes of the object written so far, either to the object file or to
+// its segments while they are downloaded.
+fn downloaded_bytes(download_dir: &Path, sha256sum: &str) -> u64 {
+    let part_prefix = format!("{}.part", sha256sum);
+    fs::read_dir(download_dir)
+        .into_iter()
+        .flatten()
+        .filter_map(|entry| entry.ok())
+        .filter(|entry| {
+            let name = entry.file_name();
+            let name = name.to_string_lossy();
+            name == sha256sum || name.starts_with(&part_prefix)
+        })
+        .filter_map(|entry| entry.metadata().ok())
+        .map(|metadata| metadata.len())
+        .sum()
+}
+
 #[cfg(test)]
 mod test {
     use super::*;
@@ -162,4 +299,15 @@ mod test {
     async fn download_large_object() {
         test_object_download(100_000_000).await
     }
+
+    #[test]
+    fn count_downloaded_segments() {
+        let dir = tempfile::tempdir().unwrap();
+        fs::write(dir.path().join("object.part0"), vec![0; 16]).unwrap();
+        fs::write(dir.path().join("object.part1"), vec![0; 8]).unwrap();
+        fs::write(dir.path().join("other"), vec![0; 32]).unwrap();
+
+        assert_eq!(downloaded_bytes(dir.path(), "object"), 24);
+        assert_eq!(downloaded_bytes(dir.path(), "missing"), 0);
+    }
 }
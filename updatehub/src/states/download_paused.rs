@@ -0,0 +1,105 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{
+    machine::{self, SharedState},
+    Download, EntryPoint, Result, State, StateChangeImpl,
+};
+use crate::update_package::UpdatePackageExt;
+use slog_scope::{debug, info};
+
+#[derive(Debug, PartialEq)]
+pub(super) struct DownloadPaused {
+    pub(super) download: Download,
+}
+
+/// Implements the state change for `State<DownloadPaused>`. It stays in
+/// `State<DownloadPaused>` until the download is resumed, keeping the
+/// partially downloaded objects.
+#[async_trait::async_trait(?Send)]
+impl StateChangeImpl for DownloadPaused {
+    fn name(&self) -> &'static str {
+        "download_paused"
+    }
+
+    fn is_handling_download(&self) -> bool {
+        true
+    }
+
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
+    async fn handle(
+        self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        if shared_state.update_cancel.is_requested() {
+            let package_uid = self.download.update_package.package_uid();
+            return super::cancel_update(shared_state, &package_uid, self.name()).await;
+        }
+
+        if shared_state.download_control.is_paused() {
+            debug!("staying on DownloadPaused state");
+            return Ok((State::DownloadPaused(self), machine::StepTransition::Never));
+        }
+
+        if shared_state.download_control.is_running() {
+            info!("resuming download");
+            return Ok((State::Download(self.download), machine::StepTransition::Immediate));
+        }
+
+        Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::{firmware::installation_set::Set, update_package::tests::get_update_package};
+    use sdk::api::info::runtime_settings::InstallationSet;
+
+    fn paused_state() -> DownloadPaused {
+        let (_, download_chan) = tokio::sync::mpsc::channel(1);
+        DownloadPaused {
+            download: Download {
+                update_package: get_update_package(),
+                installation_set: Set(InstallationSet::A),
+                download_chan,
+            },
+        }
+    }
+
+    #[actix_rt::test]
+    async fn resume_download() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.download_control.start();
+        shared_state.download_control.pause();
+
+        let machine = State::DownloadPaused(paused_state())
+            .move_to_next_state(&mut shared_state)
+            .await
+            .unwrap()
+            .0;
+        assert_state!(machine, DownloadPaused);
+
+        shared_state.download_control.resume();
+        let machine = machine.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(machine, Download);
+    }
+
+    #[actix_rt::test]
+    async fn cancelled_download() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+
+        let machine = State::DownloadPaused(paused_state())
+            .move_to_next_state(&mut shared_state)
+            .await
+            .unwrap()
+            .0;
+        assert_state!(machine, EntryPoint);
+    }
+}
@@ -0,0 +1,251 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{machine::SharedState, Result, TransitionError};
+use crate::{
+    firmware::installation_set,
+    object::{self, Info},
+    update_package::{Signature, UpdatePackage, UpdatePackageExt},
+    utils::{self, target::Target},
+};
+use pkg_schema::Object;
+use sdk::api::dry_run::{self, Action, Request, Response};
+use slog_scope::{debug, info};
+use std::{
+    fs,
+    io::{Seek, SeekFrom},
+    path::Path,
+};
+
+/// Checks what would happen if the package was installed, without
+/// writing anything to the targets or changing the agent state.
+pub(super) async fn check(shared_state: &SharedState, request: Request) -> Result<Response> {
+    match request {
+        Request::File(update_file) => check_file(shared_state, &update_file),
+        Request::Url(url) => {
+            info!("fetching update package for dry run from url: {:?}", url);
+            let download_dir = &shared_state.settings.update.download_dir;
+            fs::create_dir_all(download_dir)?;
+
+            // The package is removed as soon as it has been checked
+            let update_file = tempfile::NamedTempFile::new_in(download_dir)?;
+            let mut file = tokio::fs::File::create(update_file.path()).await?;
+            cloud::get(&url, &mut file).await?;
+            check_file(shared_state, update_file.path())
+        }
+    }
+}
+
+fn check_file(shared_state: &SharedState, update_file: &Path) -> Result<Response> {
+    info!("dry run of update package: {}", update_file.display());
+    let mut source = fs::File::open(update_file)?;
+    let mut metadata = Vec::with_capacity(1024);
+    compress_tools::uncompress_archive_file(&mut source, &mut metadata, "metadata")?;
+    let mut update_package = UpdatePackage::parse(&metadata)?;
+
+    let mut issues = Vec::new();
+    if let Some(key) = shared_state.firmware.pub_key.as_ref() {
+        let mut sign = Vec::with_capacity(512);
+        source.seek(SeekFrom::Start(0))?;
+        match compress_tools::uncompress_archive_file(&mut source, &mut sign, "signature") {
+            Ok(_) => {
+                if let Err(e) = Signature::from_base64_str(&String::from_utf8(sign)?)
+                    .and_then(|sign| sign.validate(key, &update_package))
+                {
+                    issues.push(format!("invalid signature: {}", e));
+                }
+            }
+            Err(compress_tools::Error::FileNotFound) => {
+                issues.push(TransitionError::SignatureNotFound.to_string())
+            }
+            Err(e) => return Err(e.into()),
+        }
+    }
+
+    if let Err(e) = update_package.compatible_with(&shared_state.firmware) {
+        issues.push(e.to_string());
+    }
+    if let Err(e) =
+        update_package.check_security_version(shared_state.runtime_settings.security_version())
+    {
+        issues.push(e.to_string());
+    }
+    update_package.retain_role_objects(shared_state.settings.update.role.as_deref());
+
+    let installation_set = installation_set::inactive()?;
+    let estimated_downtime =
+        update_package.estimated_downtime(&shared_state.settings, installation_set);
+    let objects = update_package.objects(installation_set);
+    if let Some(e) = check_download_space(&shared_state.settings.update.download_dir, objects) {
+        issues.push(e.to_string());
+    }
+
+    let objects = objects.iter().map(|o| check_object(shared_state, o)).collect::<Vec<_>>();
+    let installable = issues.is_empty() && objects.iter().all(|o| o.issues.is_empty());
+    debug!("dry run result: installable: {}, issues: {:?}", installable, issues);
+
+    Ok(Response {
+        installable,
+        package_uid: update_package.package_uid(),
+        version: update_package.inner.version.clone(),
+        issues,
+        objects,
+        estimated_downtime,
+    })
+}
+
+// The objects are extracted, or downloaded, into the download dir before
+// installed.
+fn check_download_space(download_dir: &Path, objects: &[Object]) -> Option<TransitionError> {
+    let required = objects.iter().map(Info::len).sum();
+    // The download dir is only created once the update is handled.
+    let available = download_dir
+        .ancestors()
+        .find(|dir| dir.exists())
+        .and_then(|dir| utils::fs::available_space(dir).ok())?;
+
+    if required > available {
+        return Some(TransitionError::NotEnoughDownloadSpace {
+            dir: download_dir.to_owned(),
+            required,
+            available,
+        });
+    }
+    None
+}
+
+fn check_object(shared_state: &SharedState, object: &Object) -> dry_run::Object {
+    let mode = object::mode(object);
+    let mut issues = Vec::new();
+
+    if let Some(capability) = shared_state.capabilities.get(mode).filter(|c| !c.available) {
+        issues.push(
+            TransitionError::MissingCapabilities {
+                mode: mode.to_owned(),
+                missing: capability.missing.clone(),
+            }
+            .to_string(),
+        );
+    }
+
+    let target = match object::target_type(object).map(utils::target::from_type) {
+        Some(Ok(target)) => Some(target),
+        Some(Err(e)) => {
+            issues.push(format!("target is unavailable: {}", e));
+            None
+        }
+        None => None,
+    };
+
+    // The objects written as is into the target must fit in it.
+    let written_as_is = match object {
+        Object::Raw(_) | Object::DiskImage(_) | Object::Flash(_) | Object::Ubifs(_) => true,
+        _ => false,
+    };
+    if let (Some(target), true) = (&target, written_as_is) {
+        match target.size() {
+            Ok(size) if size < object.required_install_size() => issues.push(format!(
+                "target is too small: {} bytes required, {} bytes available",
+                object.required_install_size(),
+                size
+            )),
+            Ok(_) => {}
+            Err(e) => issues.push(format!("unable to get the target size: {}", e)),
+        }
+    }
+
+    let geometry = match object {
+        Object::Flash(o) => o.geometry.as_ref(),
+        Object::Ubifs(o) => o.geometry.as_ref(),
+        _ => None,
+    };
+    if let (Some(expected), Some(target)) = (geometry, &target) {
+        if let Err(e) = utils::mtd::geometry(target.path())
+            .and_then(|geometry| utils::mtd::check_geometry(expected, &geometry))
+        {
+            issues.push(e.to_string());
+        }
+    }
+
+    dry_run::Object {
+        filename: object.filename().to_owned(),
+        sha256sum: object.sha256sum().to_owned(),
+        mode: mode.to_owned(),
+        target: target.as_ref().map(|t| t.path().to_owned()),
+        action: action(object, target.as_deref()),
+        issues,
+    }
+}
+
+// Evaluates the install if different rule of the objects written as is
+// into the target, as the other ones require the target to be mounted.
+fn action(object: &Object, target: Option<&dyn Target>) -> Action {
+    let (rule, sha256sum) = match object {
+        Object::Raw(o) => (&o.install_if_different, &o.sha256sum),
+        Object::Flash(o) => (&o.install_if_different, &o.sha256sum),
+        Object::Copy(o) if o.install_if_different.is_some() => return Action::Undetermined,
+        Object::Imxkobs(o) if o.install_if_different.is_some() => return Action::Undetermined,
+        _ => return Action::Install,
+    };
+
+    match (rule, target) {
+        (Some(rule), Some(target)) => match fs::File::open(target.path())
+            .map_err(object::Error::from)
+            .and_then(|mut file| object::installer::check_if_different(&mut file, rule, sha256sum))
+        {
+            Ok(true) => Action::Skip,
+            Ok(false) => Action::Install,
+            Err(e) => {
+                debug!("install if different check has failed: {}", e);
+                Action::Undetermined
+            }
+        },
+        _ => Action::Install,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::update_package::tests::get_update_package;
+    use pretty_assertions::assert_eq;
+
+    fn create_update_file(dir: &Path) -> std::path::PathBuf {
+        let update_file = dir.join("update.uhupkg");
+        fs::write(dir.join("metadata"), &get_update_package().raw).unwrap();
+        easy_process::run(&format!(
+            "tar -cf {} -C {} metadata",
+            update_file.display(),
+            dir.display()
+        ))
+        .unwrap();
+        update_file
+    }
+
+    #[actix_rt::test]
+    async fn check_local_package() {
+        let dir = tempfile::tempdir().unwrap();
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let shared_state = setup.gen_shared_state();
+        let update_file = create_update_file(dir.path());
+
+        let response = check(&shared_state, Request::File(update_file)).await.unwrap();
+        assert!(response.installable, "unexpected issues: {:?}", response);
+        assert_eq!(response.package_uid, get_update_package().package_uid());
+        assert!(response.objects.iter().all(|o| o.mode == "test" && o.action == Action::Install));
+    }
+
+    #[actix_rt::test]
+    async fn report_missing_signature() {
+        let dir = tempfile::tempdir().unwrap();
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.firmware.pub_key = Some("foo".into());
+        let update_file = create_update_file(dir.path());
+
+        let response = check(&shared_state, Request::File(update_file)).await.unwrap();
+        assert!(!response.installable);
+        assert_eq!(response.issues, vec![TransitionError::SignatureNotFound.to_string()]);
+    }
+}
@@ -4,17 +4,19 @@
 
 use super::{
     machine::{self, SharedState},
-    Park, Poll, Probe, Result, State, StateChangeImpl,
+    DirectDownload, Park, Poll, PrepareLocalInstall, Probe, Result, State, StateChangeImpl,
 };
+use sdk::api::{audit::Trigger, info::runtime_settings::PendingPackage};
 use slog_scope::{debug, info};
 
 #[derive(Debug, PartialEq)]
 pub(super) struct EntryPoint {}
 
-/// Implements the state change for `State<EntryPoint>`. It has two
+/// Implements the state change for `State<EntryPoint>`. It has three
 /// possibilities:
 ///
-/// If polling is disabled it stays in `State<EntryPoint>`, otherwise, it moves
+/// If there are pending update packages, the next one is installed. If
+/// polling is disabled it stays in `State<EntryPoint>`, otherwise, it moves
 /// to `State<Poll>` state.
 #[async_trait::async_trait(?Send)]
 impl StateChangeImpl for EntryPoint {
@@ -38,6 +40,20 @@ impl StateChangeImpl for EntryPoint {
 
         // Cleanup temporary settings from last installation
         shared_state.runtime_settings.reset_transient_settings();
+        shared_state.trigger = None;
+
+        if let Some(package) = shared_state.runtime_settings.take_pending_package()? {
+            info!("handling the next pending update package: {:?}", package);
+            crate::logger::start_memory_logging();
+            shared_state.trigger = Some(Trigger::Queued);
+            let state = match package {
+                PendingPackage::File(update_file) => {
+                    State::PrepareLocalInstall(PrepareLocalInstall { update_file })
+                }
+                PendingPackage::Url(url) => State::DirectDownload(DirectDownload { url }),
+            };
+            return Ok((state, machine::StepTransition::Immediate));
+        }
 
         if !shared_state.settings.polling.enabled {
             debug!("polling is disabled, parking the state machine.");
@@ -90,4 +106,20 @@ mod tests {
             _ => panic!("Unexpected StepTransition: {:?}", trans),
         }
     }
+
+    #[actix_rt::test]
+    async fn pending_package() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state
+            .runtime_settings
+            .queue_package(PendingPackage::Url("http://foo.bar/update.uhupkg".to_owned()))
+            .unwrap();
+
+        let machine =
+            State::EntryPoint(EntryPoint {}).move_to_next_state(&mut shared_state).await.unwrap().0;
+
+        assert_state!(machine, DirectDownload);
+        assert!(shared_state.runtime_settings.pending_packages.is_empty());
+    }
 }
@@ -7,7 +7,8 @@ use super::{
     EntryPoint, Result, State, StateChangeImpl, TransitionError,
 };
 
-use crate::firmware;
+use crate::{firmware, utils};
+use sdk::api::info::runtime_settings::UpdateOutcome;
 use slog_scope::{error, info};
 
 #[derive(Debug)]
@@ -29,12 +30,75 @@ impl StateChangeImpl for Error {
     }
 
     async fn handle(self, st: &mut SharedState) -> Result<(State, machine::StepTransition)> {
+        // Only the failures of an update being handled are recorded, as
+        // the ones while probing the server are not. The local installs
+        // have no transaction, but their attempt.
+        let package_uid = st
+            .runtime_settings
+            .transaction()
+            .map(|transaction| utils::sha256sum(transaction.package.as_bytes()))
+            .or_else(|| st.runtime_settings.update_attempt().map(|a| a.package_uid.clone()));
+        if let Some(package_uid) = package_uid {
+            let (outcome, error) = match self.error {
+                TransitionError::Canceled => (UpdateOutcome::Canceled, None),
+                ref e => (UpdateOutcome::Failed, Some(e.to_string())),
+            };
+            if let Err(err) =
+                st.runtime_settings.set_update_result(outcome, Some(package_uid), error)
+            {
+                error!("failed to record the update result: {}", err);
+            }
+        }
+
+        // A resumed install may fail before it is installed again, so the
+        // targets it had written are restored here. A timed out install
+        // may still be writing its target, so the journal is kept and
+        // reverted once the agent is restarted instead.
+        let stuck = if let TransitionError::InstallTimeout(..) = self.error { true } else { false };
+        if stuck {
+            info!("install is reverted once the agent is restarted");
+        } else if let Err(err) =
+            super::install::revert_journal(&st.settings, &mut st.runtime_settings, false)
+        {
+            error!("failed to revert the install: {}", err);
+        }
+        if let Err(err) = st.runtime_settings.end_transaction() {
+            error!("failed to drop the update transaction: {}", err);
+        }
+
+        // The pending packages may depend on the failed one, as they are
+        // installed in order.
+        match st.runtime_settings.clear_pending_packages() {
+            Ok(0) => {}
+            Ok(count) => info!("dropping {} pending update packages", count),
+            Err(err) => error!("failed to drop the pending update packages: {}", err),
+        }
+
+        // A failed step stops the update chain, which is sent again by the
+        // server once probed.
+        if let Err(err) = st.runtime_settings.finish_update_chain_step(false) {
+            error!("failed to drop the update chain: {}", err);
+        }
+
+        if let TransitionError::Canceled = self.error {
+            info!("update canceled, returning to machine's entry point");
+            return Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate));
+        }
+
         error!("error state reached: {}", self.error);
 
         if let Err(err) = firmware::error_callback(&st.settings.firmware.metadata) {
             error!("failed to run error callback script: {}", err);
         }
 
+        // The stuck install can't be interrupted, so the agent is started
+        // over, leaving it behind.
+        if stuck {
+            if let Err(err) = utils::agent_update::restart() {
+                error!("failed to restart the agent: {}", err);
+            }
+        }
+
         info!("returning to machine's entry point");
         Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate))
     }
@@ -45,3 +109,27 @@ impl From<TransitionError> for State {
         State::Error(Error { error })
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::update_package::tests::get_update_package;
+    use pretty_assertions::assert_eq;
+
+    #[actix_rt::test]
+    async fn record_failed_update() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let package = get_update_package();
+        shared_state.runtime_settings.begin_transaction(&package.raw, None).unwrap();
+
+        let state = State::from(TransitionError::ObjectsNotReady);
+        let state = state.move_to_next_state(&mut shared_state).await.unwrap().0;
+        assert_state!(state, EntryPoint);
+
+        let result = shared_state.runtime_settings.last_update_result().unwrap();
+        assert_eq!(result.outcome, UpdateOutcome::Failed);
+        assert_eq!(result.package_uid, Some(package.package_uid()));
+        assert_eq!(result.error, Some(TransitionError::ObjectsNotReady.to_string()));
+    }
+}
@@ -4,14 +4,39 @@
 
 use super::{
     machine::{self, SharedState},
-    ProgressReporter, Reboot, Result, State, StateChangeImpl,
+    AwaitMaintenanceWindow, ProgressReporter, Result, State, StateChangeImpl, TransitionError,
 };
 use crate::{
-    firmware::installation_set,
-    object::{self, Installer},
-    update_package::{UpdatePackage, UpdatePackageExt},
+    firmware::{self, installation_set::Set},
+    object::{self, Installer, StreamInstaller},
+    runtime_settings::RuntimeSettings,
+    settings::Settings,
+    update_package::{Signature, UpdatePackage, UpdatePackageExt},
+    utils::{
+        self,
+        encryption::{ContentKey, DECRYPTED_PREFIX},
+        privsep,
+    },
 };
-use slog_scope::{debug, info};
+use async_std::prelude::FutureExt;
+use pkg_schema::{Encryption, Object, Target};
+use sdk::api::{
+    audit::Trigger,
+    info::{
+        runtime_settings::{InstallationRecord, JournalObject, SignedPackage},
+        settings::EnvironmentAction,
+    },
+    progress::Stage,
+};
+use slog_scope::{debug, error, info, warn};
+use std::{
+    fs, io,
+    path::{Path, PathBuf},
+    time::{Duration, Instant},
+};
+
+// How often the progress the installers report is reported to the server.
+const PROGRESS_REPORT_INTERVAL: Duration = Duration::from_secs(10);
 
 #[derive(Debug, PartialEq)]
 pub(super) struct Install {
@@ -23,6 +48,10 @@ impl ProgressReporter for Install {
         self.update_package.package_uid()
     }
 
+    fn update_metadata(&self) -> &[u8] {
+        &self.update_package.raw
+    }
+
     fn report_enter_state_name(&self) -> &'static str {
         "installing"
     }
@@ -30,6 +59,15 @@ impl ProgressReporter for Install {
     fn report_leave_state_name(&self) -> &'static str {
         "installed"
     }
+
+    // Lets the hooks warn the users of how long the device is going to
+    // be unavailable.
+    fn hooks_environment(&self, shared_state: &SharedState) -> Result<Vec<(&'static str, String)>> {
+        let installation_set = shared_state.runtime_settings.get_inactive_installation_set()?;
+        let downtime =
+            self.update_package.estimated_downtime(&shared_state.settings, installation_set);
+        Ok(vec![("UPDATEHUB_ESTIMATED_DOWNTIME", downtime.total.to_string())])
+    }
 }
 
 pub(crate) trait ObjectInstaller {
@@ -57,47 +95,776 @@ impl StateChangeImpl for Install {
         "install"
     }
 
+    fn is_inhibiting_suspend(&self) -> bool {
+        true
+    }
+
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
     async fn handle(
         mut self,
         shared_state: &mut SharedState,
     ) -> Result<(State, machine::StepTransition)> {
         let package_uid = self.update_package.package_uid();
+        let version = self.update_package.inner.version.clone();
         info!("installing update: {}", &package_uid);
 
         let installation_set = shared_state.runtime_settings.get_inactive_installation_set()?;
         info!("using installation set as target {}", installation_set);
+        // The local installs start here, the others are already recorded.
+        shared_state.begin_attempt(package_uid.clone(), &version, Trigger::Command)?;
+
+        // The content key is unwrapped before the device is touched, so a
+        // package which isn't meant for it is refused early.
+        let decryption =
+            Decryption::new(self.update_package.inner.encryption.take(), &shared_state.settings)?;
 
         // FIXME: What is missing:
         //
         // - verify if the object needs to be installed, accordingly to the install if
         //   different rule.
 
+        // The installer, when the privileges are separated, validates the
+        // package and finds the objects in it itself.
+        let package = SignedPackage {
+            package: String::from_utf8_lossy(&self.update_package.raw).into_owned(),
+            signature: self.update_package.signature.as_ref().map(Signature::to_base64),
+        };
+        let transaction = Transaction::new(
+            std::mem::take(&mut self.update_package.inner.targets),
+            &shared_state.settings,
+        );
+        shared_state.runtime_settings.begin_journal(&package, installation_set)?;
+        let timeouts = self
+            .update_package
+            .objects(installation_set)
+            .iter()
+            .map(|obj| {
+                self.update_package.install_timeout(&shared_state.settings, installation_set, obj)
+            })
+            .collect::<Vec<_>>();
         let objs = self.update_package.objects_mut(installation_set);
+        objs.iter_mut().for_each(|obj| {
+            utils::container::resolve_object_targets(&shared_state.settings.container, obj);
+            crate::simulation::resolve_object_targets(&shared_state.settings.simulation, obj);
+        });
         objs.iter().try_for_each(object::Installer::check_requirements)?;
+        let order = object::transaction::install_order(objs, &transaction.targets)?;
+        let encrypted = decryption.is_some();
+        objs.iter()
+            .filter(|obj| !decryption.as_ref().map_or(false, |d| d.is_encrypted(obj)))
+            .filter(|obj| !super::is_streamed(&shared_state.settings, encrypted, obj))
+            .try_for_each(|obj| {
+                object::check_extraction_limits(
+                    obj,
+                    &shared_state.settings.update.download_dir,
+                    &shared_state.settings.extraction,
+                )
+            })?;
+
+        // The peer must be in charge before the device is touched.
+        if let Some(ref url) = shared_state.settings.failover.peer_url {
+            info!("requesting the standby peer to take over");
+            cloud::request_takeover(url, shared_state.firmware.as_cloud_metadata()).await?;
+        }
+
+        utils::fs::set_lenient_paths(shared_state.settings.extraction.lenient_paths);
+        utils::archive::set_limits(&shared_state.settings.extraction);
+        utils::io::set_direct_io(shared_state.settings.update.direct_io);
+        utils::read_only::set_pending_dir(&shared_state.settings.update.pending_dir);
         objs.iter_mut().try_for_each(object::Installer::setup)?;
-        objs.iter_mut().try_for_each(|obj| {
-            obj.install(&shared_state.settings.update.download_dir)?;
-            obj.cleanup()
-        })?;
+        let count = objs.len();
+        for (pos, &idx) in order.iter().enumerate() {
+            // The environment is only checked between the objects, as an
+            // object partially installed may leave its target unusable.
+            if let Err(e) = await_safe_environment(shared_state, &package_uid).await {
+                revert(shared_state);
+                order[pos..].iter().try_for_each(|&i| objs[i].cleanup())?;
+                return Err(e);
+            }
+
+            // The objects are installed in the inactive set, so cleaning
+            // up the ones left, and restoring the reversible targets
+            // written out of it, is enough to keep the device as it was.
+            if shared_state.update_cancel.is_requested() {
+                revert(shared_state);
+                order[pos..].iter().try_for_each(|&i| objs[i].cleanup())?;
+                return Err(TransitionError::Canceled);
+            }
+
+            // The agent is being stopped, so the objects left are installed
+            // once it is started again, as the install is resumed from the
+            // journal.
+            if shared_state.shutdown.is_requested() {
+                info!("install interrupted, {} of {} objects are left", count - pos, count);
+                order[pos..].iter().try_for_each(|&i| objs[i].cleanup())?;
+                return Ok((State::Install(self), machine::StepTransition::Never));
+            }
+
+            let obj = &mut objs[idx];
+            if transaction.is_installed(&shared_state.runtime_settings, idx, obj) {
+                info!(
+                    "{} was installed before the interruption, skipping it",
+                    object::Info::filename(obj)
+                );
+                obj.cleanup()?;
+                continue;
+            }
+
+            // The device counters are sampled around the install, so the
+            // write amplification of the device can be tracked.
+            let device = object::target_device(obj);
+            let written = device.as_deref().and_then(utils::fs::written_bytes);
+
+            shared_state.progress.start(Stage::Install, pos, count, obj);
+            shared_state.runtime_settings.start_attempt_object(
+                object::Info::sha256sum(obj),
+                object::Info::filename(obj),
+                object::mode(obj),
+            )?;
+            let started = Instant::now();
+            let download_dir = shared_state.settings.update.download_dir.clone();
+            let installed = async {
+                transaction.begin(
+                    &mut shared_state.runtime_settings,
+                    &package,
+                    installation_set,
+                    idx,
+                    obj,
+                )?;
+                // The installer decrypts the objects itself when the
+                // privileges are separated, not taking their plain text
+                // from the agent.
+                match decryption
+                    .as_ref()
+                    .filter(|_| !privsep::is_separated())
+                    .map(|d| d.decrypt(obj, &download_dir))
+                    .transpose()?
+                {
+                    Some(Some(decrypted)) => {
+                        let dir = decrypted.parent().expect("decrypted object has no parent");
+                        let res = match object::check_extraction_limits(
+                            obj,
+                            dir,
+                            &shared_state.settings.extraction,
+                        ) {
+                            Ok(()) => {
+                                install_object(
+                                    shared_state,
+                                    &package,
+                                    installation_set,
+                                    idx,
+                                    obj,
+                                    dir,
+                                    timeouts[idx],
+                                )
+                                .await
+                            }
+                            Err(e) => Err(e.into()),
+                        };
+                        // The plain text is only kept while it is installed.
+                        fs::remove_file(&decrypted)?;
+                        res?;
+                    }
+                    _ if super::is_streamed(&shared_state.settings, encrypted, obj) => {
+                        stream_object(shared_state, &package_uid, obj)?
+                    }
+                    _ => {
+                        install_object(
+                            shared_state,
+                            &package,
+                            installation_set,
+                            idx,
+                            obj,
+                            &download_dir,
+                            timeouts[idx],
+                        )
+                        .await?
+                    }
+                }
+                Ok(())
+            }
+            .await;
+            match installed {
+                Ok(()) => {}
+                // The stuck install may still be writing its target, so
+                // it is reverted once the agent is restarted instead.
+                Err(e @ TransitionError::InstallTimeout(..)) => return Err(e),
+                Err(e) => {
+                    // The slot switch doesn't happen, so the targets
+                    // written out of the inactive set are put back as they
+                    // were.
+                    revert(shared_state);
+                    return Err(e);
+                }
+            }
+            let obj = &mut objs[idx];
+            obj.cleanup()?;
+            transaction.complete(&mut shared_state.runtime_settings, idx, obj)?;
+            shared_state.runtime_settings.add_transaction_object(object::Info::sha256sum(obj))?;
+            shared_state
+                .runtime_settings
+                .finish_attempt_object(started.elapsed().as_millis() as u64)?;
+            shared_state.progress.finish();
+            report_progress(shared_state, &package_uid).await;
+
+            if let Some(device) = device {
+                let device_bytes = match (written, utils::fs::written_bytes(&device)) {
+                    (Some(before), Some(after)) => after.saturating_sub(before),
+                    _ => 0,
+                };
+                shared_state.runtime_settings.add_device_writes(
+                    &device,
+                    object::Info::required_install_size(obj),
+                    device_bytes,
+                )?;
+            }
+        }
+
+        if shared_state.update_cancel.is_requested() {
+            revert(shared_state);
+            return Err(TransitionError::Canceled);
+        }
 
         // Avoid installing same package twice.
         shared_state.runtime_settings.set_applied_package_uid(&package_uid)?;
 
-        // Set upgrading to the new installation set
-        shared_state.runtime_settings.set_upgrading_to(installation_set)?;
+        // The packages only updating the agent leave the installation
+        // sets alone, as the agent is restarted instead of the device.
+        if !object::is_agent_only(objs) {
+            // Kept so the set can be checked before rolling back into it.
+            shared_state.runtime_settings.record_installation(InstallationRecord {
+                installation_set: installation_set.0,
+                package_uid: package_uid.clone(),
+                version,
+                time: chrono::Utc::now(),
+                regions: objs.iter().filter_map(object::installed_region).collect(),
+            })?;
+
+            // The security version is only raised once the update is booted
+            // into, so a rollback leaves the device able to install it again.
+            shared_state.runtime_settings.set_pending_security_version(
+                package.clone(),
+                self.update_package.inner.security_version,
+            )?;
+
+            // Set upgrading to the new installation set
+            shared_state.runtime_settings.set_upgrading_to(installation_set)?;
 
-        // Swap installation set so it is used next device boot.
-        installation_set::swap_active()?;
-        info!("swapping active installation set");
+            // Swap installation set so it is used next device boot.
+            privsep::swap_active()?;
+            info!("swapping active installation set");
+        }
+        transaction.drop_backups(&shared_state.runtime_settings, &package, installation_set, objs);
+        shared_state.runtime_settings.end_transaction()?;
+        shared_state.runtime_settings.end_journal()?;
+        let _ = fs::remove_dir_all(journal_dir(&shared_state.settings));
+
+        if let Err(e) = utils::delta::retain_installed(
+            &shared_state.settings.delta,
+            &shared_state.settings.update.download_dir,
+            objs.iter()
+                .filter(|obj| !super::is_streamed(&shared_state.settings, encrypted, obj))
+                .map(object::Info::sha256sum),
+        ) {
+            warn!("failed to keep installed objects as delta bases: {}", e);
+        }
 
         info!("update installed successfully");
+        if let Some(usage) = utils::resource_usage::current() {
+            info!(
+                "update used {} bytes of peak rss, {} ms of cpu time and wrote {} bytes",
+                usage.peak_rss, usage.cpu_time, usage.bytes_written
+            );
+        }
+        if shared_state.settings.failover.peer_url.is_some() {
+            let server = shared_state.server_address().to_owned();
+            if let Err(e) = crate::CloudClient::new(&server)
+                .report(
+                    "standby-updated",
+                    shared_state.firmware.as_cloud_metadata(),
+                    &package_uid,
+                    None,
+                    None,
+                    None,
+                    None,
+                )
+                .await
+            {
+                warn!("report failed: {}", e);
+            }
+        }
+
         Ok((
-            State::Reboot(Reboot { update_package: self.update_package }),
+            AwaitMaintenanceWindow::reboot(self.update_package, &shared_state.settings),
             machine::StepTransition::Immediate,
         ))
     }
 }
 
+/// Transaction the objects of a package are installed in, which is
+/// journaled in the runtime settings. The reversible targets are backed
+/// up right before they are written, so they can be restored when a
+/// later object fails, even after a power loss.
+struct Transaction {
+    targets: Vec<Target>,
+    // Where the pre-images of the reversible targets are kept.
+    dir: PathBuf,
+}
+
+impl Transaction {
+    fn new(targets: Vec<Target>, settings: &Settings) -> Self {
+        Transaction { targets, dir: journal_dir(settings) }
+    }
+
+    // Whether the object has been installed before the install was
+    // interrupted, and is still in its target, so it isn't written again.
+    fn is_installed(&self, runtime_settings: &RuntimeSettings, idx: usize, obj: &Object) -> bool {
+        match (journaled(runtime_settings, idx, obj), object::installed_region(obj)) {
+            (Some(journaled), Some(region)) if journaled.completed => {
+                utils::sha256sum_region(&region.target, region.offset, region.size)
+                    .map_or(false, |sha256sum| sha256sum == region.sha256sum)
+            }
+            _ => false,
+        }
+    }
+
+    // Journals the object as being written, backing its target up first
+    // when it is reversible. A pre-image kept before an interruption is
+    // taken as it is, as the target may have been partially written.
+    fn begin(
+        &self,
+        runtime_settings: &mut RuntimeSettings,
+        package: &SignedPackage,
+        installation_set: Set,
+        idx: usize,
+        obj: &Object,
+    ) -> Result<()> {
+        let mut previous_sha256sum = journaled(runtime_settings, idx, obj)
+            .and_then(|journaled| journaled.previous_sha256sum.clone());
+        if previous_sha256sum.is_none()
+            && object::transaction::target_of(&self.targets, obj).map_or(false, |t| t.reversible)
+        {
+            fs::create_dir_all(&self.dir)?;
+            privsep::backup_object(package, installation_set, idx, obj, &self.dir)?;
+            previous_sha256sum =
+                Some(utils::sha256sum_file(&object::transaction::backup_path(obj, &self.dir))?);
+        }
+
+        Ok(runtime_settings.journal_object(JournalObject {
+            index: idx,
+            sha256sum: object::Info::sha256sum(obj).to_owned(),
+            target: object::target_device(obj),
+            previous_sha256sum,
+            completed: false,
+        })?)
+    }
+
+    // Drops the backups of the targets, once the package is installed,
+    // as the snapshots of the logical volumes are kept by LVM otherwise.
+    // The failures are only logged, as the update is installed anyway.
+    fn drop_backups(
+        &self,
+        runtime_settings: &RuntimeSettings,
+        package: &SignedPackage,
+        installation_set: Set,
+        objs: &[Object],
+    ) {
+        let journal = match runtime_settings.journal() {
+            Some(journal) => journal,
+            None => return,
+        };
+        for journaled in journal.objects.iter().filter(|j| j.previous_sha256sum.is_some()) {
+            let obj = match objs.get(journaled.index) {
+                Some(obj) => obj,
+                None => continue,
+            };
+            if let Err(e) =
+                privsep::drop_backup(package, installation_set, journaled.index, obj, &self.dir)
+            {
+                warn!("failed to drop the backup of {}: {}", object::Info::filename(obj), e);
+            }
+        }
+    }
+
+    fn complete(
+        &self,
+        runtime_settings: &mut RuntimeSettings,
+        idx: usize,
+        obj: &Object,
+    ) -> Result<()> {
+        let mut journaled = match journaled(runtime_settings, idx, obj) {
+            Some(journaled) => journaled.clone(),
+            None => return Ok(()),
+        };
+        journaled.completed = true;
+        Ok(runtime_settings.journal_object(journaled)?)
+    }
+}
+
+fn journaled<'a>(
+    runtime_settings: &'a RuntimeSettings,
+    idx: usize,
+    obj: &Object,
+) -> Option<&'a JournalObject> {
+    runtime_settings.journal()?.objects.iter().find(|journaled| {
+        journaled.index == idx && journaled.sha256sum == object::Info::sha256sum(obj)
+    })
+}
+
+fn journal_dir(settings: &Settings) -> PathBuf {
+    settings.update.download_dir.join("journal")
+}
+
+/// Restores the reversible targets written by the journaled install,
+/// the latest first, from their pre-images, dropping them from the
+/// journal. When `incomplete_only` is set, as for an install about to be
+/// resumed, only the objects left partially written are.
+///
+/// The failures to restore a target are only logged, so the others are
+/// still restored.
+pub(super) fn revert_journal(
+    settings: &Settings,
+    runtime_settings: &mut RuntimeSettings,
+    incomplete_only: bool,
+) -> Result<()> {
+    let journal = match runtime_settings.journal() {
+        Some(journal) => journal.clone(),
+        None => return Ok(()),
+    };
+    let reverted = |journaled: &JournalObject| !incomplete_only || !journaled.completed;
+
+    // The objects are taken as they have been installed.
+    let signed =
+        SignedPackage { package: journal.package.clone(), signature: journal.signature.clone() };
+    let mut package = UpdatePackage::parse(journal.package.as_bytes())?;
+    package.apply_install_mode_defaults(&settings.install_modes);
+    package.retain_role_objects(settings.update.role.as_deref());
+    let installation_set = Set(journal.installation_set);
+    let objs = package.objects_mut(installation_set);
+
+    let dir = journal_dir(settings);
+    let mut failed = false;
+    for journaled in journal.objects.iter().rev().filter(|journaled| reverted(journaled)) {
+        if journaled.previous_sha256sum.is_none() {
+            continue;
+        }
+        let obj = match objs.get_mut(journaled.index) {
+            Some(obj) if object::Info::sha256sum(obj) == journaled.sha256sum => obj,
+            _ => {
+                error!("journaled object {} isn't in the package", journaled.sha256sum);
+                failed = true;
+                continue;
+            }
+        };
+        utils::container::resolve_object_targets(&settings.container, obj);
+        crate::simulation::resolve_object_targets(&settings.simulation, obj);
+
+        info!("restoring the target of {}", object::Info::filename(obj));
+        if let Err(e) =
+            privsep::restore_object(&signed, installation_set, journaled.index, obj, &dir)
+        {
+            error!("failed to restore the target of {}: {}", object::Info::filename(obj), e);
+            failed = true;
+        }
+    }
+
+    // The objects staged for the read-only targets are never applied.
+    if !incomplete_only {
+        if let Err(e) = utils::read_only::drop_pending(&settings.update.pending_dir) {
+            error!("failed to drop the pending objects: {}", e);
+        }
+    }
+
+    runtime_settings.drop_journal_objects(reverted)?;
+    // The pre-images are kept when a target has failed to be restored,
+    // so it can still be restored by hand.
+    if runtime_settings.journal().is_none() && !failed {
+        let _ = fs::remove_dir_all(&dir);
+    }
+    Ok(())
+}
+
+// Reverts the install, only logging the failure, as the error which has
+// caused it is the one to be reported.
+fn revert(shared_state: &mut SharedState) {
+    if let Err(e) =
+        revert_journal(&shared_state.settings, &mut shared_state.runtime_settings, false)
+    {
+        error!("failed to revert the install: {}", e);
+    }
+}
+
+/// Decrypts the encrypted objects of a package, right before each of
+/// them is installed. The objects are decrypted into a private
+/// directory, which is removed along with it, or when the agent starts
+/// again if it is interrupted.
+struct Decryption {
+    encryption: Encryption,
+    key: ContentKey,
+    dir: tempfile::TempDir,
+}
+
+impl Decryption {
+    fn new(encryption: Option<Encryption>, settings: &Settings) -> Result<Option<Self>> {
+        let encryption = match encryption {
+            Some(encryption) => encryption,
+            None => return Ok(None),
+        };
+
+        let private_key =
+            firmware::decryption_key(&settings.firmware.metadata).ok_or_else(|| {
+                utils::Error::Decryption("package is encrypted but device has no key".to_owned())
+            })?;
+        let key = utils::encryption::unwrap_key(&encryption, &private_key)?;
+        let dir = tempfile::Builder::new()
+            .prefix(DECRYPTED_PREFIX)
+            .tempdir_in(&settings.update.download_dir)?;
+
+        Ok(Some(Decryption { encryption, key, dir }))
+    }
+
+    fn is_encrypted(&self, obj: &Object) -> bool {
+        self.encryption.objects.contains_key(object::Info::sha256sum(obj))
+    }
+
+    /// Decrypts the `obj`, if it is encrypted, returning the path of the
+    /// plain text.
+    fn decrypt(&self, obj: &Object, download_dir: &Path) -> Result<Option<PathBuf>> {
+        let sha256sum = object::Info::sha256sum(obj);
+        let params = match self.encryption.objects.get(sha256sum) {
+            Some(params) => params,
+            None => return Ok(None),
+        };
+
+        info!("decrypting object {}", sha256sum);
+        Ok(Some(utils::encryption::decrypt_object(
+            &self.key,
+            params,
+            sha256sum,
+            download_dir,
+            self.dir.path(),
+        )?))
+    }
+}
+
+/// Removes the objects left decrypted in the `download_dir` by an
+/// install interrupted before it has removed them, so their plain text
+/// isn't kept.
+pub(super) fn remove_decrypted_objects(download_dir: &Path) -> io::Result<()> {
+    let entries = match fs::read_dir(download_dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(()),
+        Err(e) => return Err(e),
+    };
+    for entry in entries {
+        let entry = entry?;
+        if entry.file_name().to_string_lossy().starts_with(DECRYPTED_PREFIX) {
+            warn!("removing the objects left decrypted in {:?}", entry.path());
+            fs::remove_dir_all(entry.path())?;
+        }
+    }
+    Ok(())
+}
+
+// The object is downloaded from another thread, running its own
+// runtime, while it is written to its target from this one. The pipe
+// between them holds the download back while the target is written,
+// so only a few chunks of the object are ever kept in memory. Closing
+// either end stops the other on errors.
+fn stream_object(shared_state: &SharedState, package_uid: &str, obj: &Object) -> Result<()> {
+    use std::os::unix::io::FromRawFd;
+
+    let raw = match obj {
+        Object::Raw(raw) => raw,
+        _ => unreachable!("only raw objects are streamed"),
+    };
+
+    let (reader, writer) = nix::unistd::pipe().map_err(utils::Error::from)?;
+    let (reader, writer) =
+        unsafe { (fs::File::from_raw_fd(reader), fs::File::from_raw_fd(writer)) };
+    let server = shared_state.server_address().to_owned();
+    let product_uid = shared_state.firmware.product_uid.clone();
+    let package_uid = package_uid.to_owned();
+    let sha256sum = object::Info::sha256sum(obj).to_owned();
+    let rate_limit = super::prepare_download::rate_limit_at(
+        &shared_state.settings.download,
+        chrono::Local::now().time(),
+    );
+
+    let download = std::thread::spawn(move || {
+        actix_rt::System::new("object-stream").block_on(async move {
+            let mut handle = tokio::fs::File::from_std(writer);
+            crate::CloudClient::new(&server)
+                .with_rate_limit(rate_limit)
+                .stream_object(&product_uid, &package_uid, &sha256sum, &mut handle)
+                .await
+                // The client errors can't be sent across threads.
+                .map_err(|e| match e {
+                    cloud::Error::Io(e) => e,
+                    e => std::io::Error::new(std::io::ErrorKind::Other, e.to_string()),
+                })
+        })
+    });
+
+    let installed = raw.install_stream(reader);
+    // A failed download leaves the object incomplete, even if it has
+    // been written as far as it has been received.
+    download.join().expect("object download has panicked")?;
+    Ok(installed?)
+}
+
+// The object is installed from a thread of its own, so the runtime keeps
+// serving the local API, and reporting the progress the installer
+// reports, while it is written. An install taking longer than `timeout`
+// is left behind, as it can't be interrupted.
+async fn install_object(
+    shared_state: &SharedState,
+    package: &SignedPackage,
+    installation_set: Set,
+    index: usize,
+    obj: &Object,
+    dir: &Path,
+    timeout: Duration,
+) -> Result<()> {
+    // The package uid is the checksum of its metadata.
+    let package_uid = utils::sha256sum(package.package.as_bytes());
+    let (progress, total) = (shared_state.progress.clone(), object::Info::len(obj));
+    object::set_progress_sink(Some(Box::new(move |percentage| {
+        progress.update(total * u64::from(percentage) / 100)
+    })));
+
+    let (sender, receiver) = async_std::sync::channel(1);
+    let (thread_settings, package, dir) =
+        (shared_state.settings.clone(), package.clone(), dir.to_owned());
+    std::thread::spawn(move || {
+        let res = privsep::install_object(
+            &thread_settings,
+            &package,
+            installation_set,
+            index,
+            &dir,
+            thread_settings.update.verify_written,
+        );
+        async_std::task::block_on(sender.send(res));
+    });
+
+    let installed = async { Some(receiver.recv().await) }
+        .race(track_install_progress(shared_state, &package_uid));
+    let res = if timeout == Duration::default() {
+        installed.await
+    } else {
+        installed
+            .race(async {
+                utils::boottime::sleep(timeout).await;
+                None
+            })
+            .await
+    };
+    object::set_progress_sink(None);
+    match res {
+        Some(Some(res)) => Ok(res?),
+        Some(None) => Err(std::io::Error::new(
+            std::io::ErrorKind::Other,
+            "object install has stopped unexpectedly",
+        )
+        .into()),
+        None => {
+            error!(
+                "install of {} has not finished within {:?}",
+                object::Info::filename(obj),
+                timeout
+            );
+            Err(TransitionError::InstallTimeout(object::Info::filename(obj).to_owned(), timeout))
+        }
+    }
+}
+
+/// Waits for the environment to be within limits, failing when the
+/// install is to be aborted. It returns early once the update is canceled.
+async fn await_safe_environment(shared_state: &SharedState, package_uid: &str) -> Result<()> {
+    let settings = &shared_state.settings.environment;
+    let max_pause = settings.max_pause.to_std().unwrap_or_default();
+    let interval = settings.check_interval.to_std().unwrap_or_default();
+    let paused_at = Instant::now();
+    let mut paused = false;
+
+    while let Some(reason) = utils::environment::check(settings)? {
+        if settings.on_alarm == EnvironmentAction::Abort || paused_at.elapsed() >= max_pause {
+            error!("aborting install: {}", reason);
+            return Err(TransitionError::EnvironmentAlarm(reason));
+        }
+        if shared_state.update_cancel.is_requested() {
+            return Ok(());
+        }
+
+        if !paused {
+            warn!("pausing install: {}", reason);
+            let server = shared_state.server_address().to_owned();
+            if let Err(e) = crate::CloudClient::new(&server)
+                .report(
+                    "install-paused",
+                    shared_state.firmware.as_cloud_metadata(),
+                    package_uid,
+                    Some("installing"),
+                    Some(reason),
+                    None,
+                    None,
+                )
+                .await
+            {
+                warn!("report failed: {}", e);
+            }
+            paused = true;
+        }
+        utils::boottime::sleep(interval).await;
+    }
+
+    if paused {
+        info!("environment is back within limits, resuming install");
+    }
+    Ok(())
+}
+
+// Reports the progress of the object being installed to the server, when
+// the installer has reported it has changed. It never returns, so it
+// must be raced with the install.
+async fn track_install_progress<T>(shared_state: &SharedState, package_uid: &str) -> T {
+    let mut reported = shared_state.progress.current().map(|p| p.percentage);
+    loop {
+        utils::boottime::sleep(PROGRESS_REPORT_INTERVAL).await;
+        let percentage = shared_state.progress.current().map(|p| p.percentage);
+        if percentage != reported {
+            reported = percentage;
+            report_progress(shared_state, package_uid).await;
+        }
+    }
+}
+
+// The progress is reported once each object is installed, and while it
+// is installed when its installer reports it.
+async fn report_progress(shared_state: &SharedState, package_uid: &str) {
+    let current = match shared_state.progress.current_for_cloud() {
+        Some(current) => current,
+        None => return,
+    };
+
+    let server = shared_state.server_address().to_owned();
+    if let Err(e) = crate::CloudClient::new(&server)
+        .report_progress(
+            "installing",
+            shared_state.firmware.as_cloud_metadata(),
+            package_uid,
+            &current,
+        )
+        .await
+    {
+        warn!("progress report failed: {}", e);
+    }
+}
+
 #[cfg(test)]
 mod test {
     use super::*;
@@ -120,4 +887,70 @@ mod test {
             s => panic!("Invalid success: {:?}", s),
         }
     }
+
+    #[test]
+    fn remove_leftover_decrypted_objects() {
+        let download_dir = tempfile::tempdir().unwrap();
+        let decrypted = download_dir.path().join("decrypted-1a2b3c");
+        fs::create_dir(&decrypted).unwrap();
+        fs::write(decrypted.join("object"), "plain text").unwrap();
+        fs::write(download_dir.path().join("object"), "cipher text").unwrap();
+
+        remove_decrypted_objects(download_dir.path()).unwrap();
+        assert!(!decrypted.exists());
+        assert!(download_dir.path().join("object").exists());
+        assert!(remove_decrypted_objects(&download_dir.path().join("missing")).is_ok());
+    }
+
+    #[actix_rt::test]
+    async fn abort_on_environment_alarm() {
+        use sdk::api::info::settings::EnvironmentAction;
+
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.settings.environment.check_script = Some("false".into());
+        shared_state.settings.environment.on_alarm = EnvironmentAction::Abort;
+        let state = Install { update_package: get_update_package() };
+
+        match State::Install(state).move_to_next_state(&mut shared_state).await {
+            Err(TransitionError::EnvironmentAlarm(_)) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+        assert_eq!(shared_state.runtime_settings.applied_package_uid(), None);
+    }
+
+    #[actix_rt::test]
+    async fn stop_before_next_object_on_shutdown() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.shutdown.request();
+        let state = Install { update_package: get_update_package() };
+
+        match State::Install(state).move_to_next_state(&mut shared_state).await {
+            Ok((State::Install(_), machine::StepTransition::Never)) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+        // The journal is kept, so the install is resumed.
+        assert!(shared_state.runtime_settings.journal().is_some());
+        assert_eq!(shared_state.runtime_settings.applied_package_uid(), None);
+    }
+
+    #[actix_rt::test]
+    async fn refuse_encrypted_without_key() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let mut update_package = get_update_package();
+        update_package.inner.encryption = Some(Encryption {
+            algorithm: pkg_schema::EncryptionAlgorithm::Aes256Gcm,
+            wrapped_key: "00".to_owned(),
+            objects: Default::default(),
+        });
+        let state = Install { update_package };
+
+        match State::Install(state).move_to_next_state(&mut shared_state).await {
+            Err(TransitionError::Utils(utils::Error::Decryption(_))) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+        assert_eq!(shared_state.runtime_settings.applied_package_uid(), None);
+    }
 }
@@ -9,13 +9,30 @@ use std::path::PathBuf;
 pub(crate) struct Addr {
     pub(super) message: sync::Sender<(Message, sync::Sender<Response>)>,
     pub(super) waker: sync::Sender<()>,
+    pub(super) busy_state: super::BusyState,
+    pub(super) download_control: super::DownloadControl,
+    pub(super) update_cancel: super::UpdateCancel,
+    pub(super) shutdown: super::Shutdown,
+    pub(super) progress: super::ProgressTracker,
+    pub(super) events: super::EventBus,
 }
 
 #[derive(Debug)]
 pub(super) enum Message {
     Info,
+    Firmware,
+    Twin,
+    Enrollment,
     Probe(Option<String>),
     AbortDownload,
+    ConfirmIdentity,
+    ConfirmUpdate,
+    ApproveUpdate(super::Approval),
+    GoAhead(sdk::api::go_ahead::Request),
+    DryRun(sdk::api::dry_run::Request),
+    Rollback(bool),
+    SetConfig(String, String),
+    ReloadConfig,
     LocalInstall(PathBuf),
     RemoteInstall(String),
 }
@@ -23,8 +40,19 @@ pub(super) enum Message {
 #[derive(Debug)]
 pub(super) enum Response {
     Info(sdk::api::info::Response),
+    Firmware(super::Result<sdk::api::firmware::Response>),
+    Twin(sdk::api::twin::Response),
+    Enrollment(sdk::api::enrollment::Response),
     Probe(super::Result<ProbeResponse>),
     AbortDownload(AbortDownloadResponse),
+    ConfirmIdentity(ConfirmIdentityResponse),
+    ConfirmUpdate(ConfirmUpdateResponse),
+    ApproveUpdate(ApproveUpdateResponse),
+    GoAhead(GoAheadResponse),
+    DryRun(super::Result<sdk::api::dry_run::Response>),
+    Rollback(super::Result<sdk::api::rollback::Response>),
+    SetConfig(super::Result<SetConfigResponse>),
+    ReloadConfig(super::Result<sdk::api::config::ReloadResponse>),
     LocalInstall(StateResponse),
     RemoteInstall(StateResponse),
 }
@@ -43,14 +71,69 @@ pub(crate) enum AbortDownloadResponse {
     InvalidState,
 }
 
+#[derive(Debug)]
+pub(crate) enum DownloadControlResponse {
+    RequestAccepted,
+    InvalidState,
+}
+
+#[derive(Debug)]
+pub(crate) enum CancelUpdateResponse {
+    RequestAccepted,
+    InvalidState,
+}
+
+#[derive(Debug)]
+pub(crate) enum ConfirmIdentityResponse {
+    RequestAccepted,
+    InvalidState,
+}
+
+#[derive(Debug)]
+pub(crate) enum ConfirmUpdateResponse {
+    RequestAccepted,
+    InvalidState,
+}
+
+#[derive(Debug)]
+pub(crate) enum ApproveUpdateResponse {
+    RequestAccepted,
+    InvalidState,
+}
+
+#[derive(Debug)]
+pub(crate) enum GoAheadResponse {
+    RequestAccepted,
+    /// The token isn't of the update announced as ready.
+    UnknownToken,
+    Expired,
+    InvalidState,
+}
+
+#[derive(Debug)]
+pub(crate) enum SetConfigResponse {
+    Applied,
+    /// The setting is kept, but only read once the agent is restarted.
+    RestartRequired,
+}
+
 #[derive(Debug)]
 pub(crate) enum StateResponse {
     RequestAccepted(String),
+    /// The package is installed once the current state and the packages
+    /// pending before it are done with.
+    Queued(String, usize),
     InvalidState(String),
 }
 
 impl Addr {
+    // The info is answered right away while the state machine is busy
+    // handling a state, as the download or the install of the update.
     pub(crate) async fn request_info(&self) -> sdk::api::info::Response {
+        if let Some(info) = self.busy_state.info() {
+            return info;
+        }
+
         let (sndr, recv) = sync::channel(1);
         self.message.send((Message::Info, sndr)).await;
         match recv.recv().await {
@@ -59,6 +142,33 @@ impl Addr {
         }
     }
 
+    pub(crate) async fn request_firmware(&self) -> super::Result<sdk::api::firmware::Response> {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::Firmware, sndr)).await;
+        match recv.recv().await {
+            Ok(Response::Firmware(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_twin(&self) -> sdk::api::twin::Response {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::Twin, sndr)).await;
+        match recv.recv().await {
+            Ok(Response::Twin(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_enrollment(&self) -> sdk::api::enrollment::Response {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::Enrollment, sndr)).await;
+        match recv.recv().await {
+            Ok(Response::Enrollment(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
     pub(crate) async fn request_probe(
         &self,
         custom_server: Option<String>,
@@ -71,7 +181,16 @@ impl Addr {
         }
     }
 
+    // The download being handled is canceled right away, as the state
+    // machine doesn't handle requests until it is done with it.
     pub(crate) async fn request_abort_download(&self) -> AbortDownloadResponse {
+        if self.busy_state.is_handling_download() {
+            return match self.request_cancel_update().await {
+                CancelUpdateResponse::RequestAccepted => AbortDownloadResponse::RequestAccepted,
+                CancelUpdateResponse::InvalidState => AbortDownloadResponse::InvalidState,
+            };
+        }
+
         let (sndr, recv) = sync::channel(1);
         self.message.send((Message::AbortDownload, sndr)).await;
         match recv.recv().await {
@@ -80,6 +199,146 @@ impl Addr {
         }
     }
 
+    pub(crate) async fn request_confirm_identity(&self) -> ConfirmIdentityResponse {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::ConfirmIdentity, sndr)).await;
+        match recv.recv().await {
+            Ok(Response::ConfirmIdentity(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_confirm_update(&self) -> ConfirmUpdateResponse {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::ConfirmUpdate, sndr)).await;
+        match recv.recv().await {
+            Ok(Response::ConfirmUpdate(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_approve_update(&self, approve: bool) -> ApproveUpdateResponse {
+        let approval = if approve { super::Approval::Approved } else { super::Approval::Denied };
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::ApproveUpdate(approval), sndr)).await;
+        match recv.recv().await {
+            Ok(Response::ApproveUpdate(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_go_ahead(
+        &self,
+        request: sdk::api::go_ahead::Request,
+    ) -> GoAheadResponse {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::GoAhead(request), sndr)).await;
+        match recv.recv().await {
+            Ok(Response::GoAhead(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_dry_run(
+        &self,
+        request: sdk::api::dry_run::Request,
+    ) -> super::Result<sdk::api::dry_run::Response> {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::DryRun(request), sndr)).await;
+        match recv.recv().await {
+            Ok(Response::DryRun(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_rollback(
+        &self,
+        execute: bool,
+    ) -> super::Result<sdk::api::rollback::Response> {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::Rollback(execute), sndr)).await;
+        match recv.recv().await {
+            Ok(Response::Rollback(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_set_config(
+        &self,
+        key: String,
+        value: String,
+    ) -> super::Result<SetConfigResponse> {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::SetConfig(key, value), sndr)).await;
+        match recv.recv().await {
+            Ok(Response::SetConfig(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    pub(crate) async fn request_reload_config(
+        &self,
+    ) -> super::Result<sdk::api::config::ReloadResponse> {
+        let (sndr, recv) = sync::channel(1);
+        self.message.send((Message::ReloadConfig, sndr)).await;
+        match recv.recv().await {
+            Ok(Response::ReloadConfig(resp)) => resp,
+            res => unreachable!("Unexpected response: {:?}", res),
+        }
+    }
+
+    // The download control requests are handled right away, instead of
+    // by the state machine, as it is busy while the objects are downloaded.
+    pub(crate) async fn request_pause_download(&self) -> DownloadControlResponse {
+        if self.download_control.pause() {
+            DownloadControlResponse::RequestAccepted
+        } else {
+            DownloadControlResponse::InvalidState
+        }
+    }
+
+    pub(crate) async fn request_resume_download(&self) -> DownloadControlResponse {
+        if self.download_control.resume() {
+            self.waker.send(()).await;
+            DownloadControlResponse::RequestAccepted
+        } else {
+            DownloadControlResponse::InvalidState
+        }
+    }
+
+    // The states check for the cancel request themselves, so the update
+    // is canceled even while it is downloaded or installed.
+    pub(crate) async fn request_cancel_update(&self) -> CancelUpdateResponse {
+        if self.update_cancel.request() {
+            self.download_control.cancel();
+            self.waker.send(()).await;
+            CancelUpdateResponse::RequestAccepted
+        } else {
+            CancelUpdateResponse::InvalidState
+        }
+    }
+
+    // The download is paused, keeping what has been downloaded so far,
+    // while the install is stopped by the state itself once the object
+    // being installed is done with.
+    pub(crate) async fn request_shutdown(&self) {
+        self.shutdown.request();
+        self.download_control.pause();
+        self.waker.send(()).await;
+    }
+
+    // The progress is updated by the states themselves, as the state
+    // machine is busy while the objects are downloaded or installed.
+    pub(crate) fn progress(&self) -> sdk::api::progress::Response {
+        sdk::api::progress::Response { current: self.progress.current() }
+    }
+
+    /// Subscribes to the agent events, which are published while the
+    /// state machine is busy as well.
+    pub(crate) fn events(&self) -> sync::Receiver<sdk::api::events::Event> {
+        self.events.subscribe()
+    }
+
     pub(crate) async fn request_local_install(&self, path: PathBuf) -> StateResponse {
         let (sndr, recv) = sync::channel(1);
         self.message.send((Message::LocalInstall(path), sndr)).await;
@@ -0,0 +1,39 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use sdk::api::info;
+use std::sync::{Arc, Mutex};
+
+/// State the state machine is busy handling, along with the agent info as
+/// it was when the state was entered. It is shared by the agent API, which
+/// answers the status queries from it, as the state machine doesn't handle
+/// requests while the update is downloaded or installed.
+#[derive(Clone, Debug, Default)]
+pub(crate) struct BusyState(Arc<Mutex<Option<Busy>>>);
+
+#[derive(Debug)]
+struct Busy {
+    info: info::Response,
+    handling_download: bool,
+}
+
+impl BusyState {
+    pub(crate) fn enter(&self, info: info::Response, handling_download: bool) {
+        *self.0.lock().unwrap() = Some(Busy { info, handling_download });
+    }
+
+    pub(crate) fn leave(&self) {
+        *self.0.lock().unwrap() = None;
+    }
+
+    /// Agent info as it was when the state being handled was entered, if
+    /// the state machine is busy.
+    pub(crate) fn info(&self) -> Option<info::Response> {
+        self.0.lock().unwrap().as_ref().map(|busy| busy.info.clone())
+    }
+
+    pub(crate) fn is_handling_download(&self) -> bool {
+        self.0.lock().unwrap().as_ref().map_or(false, |busy| busy.handling_download)
+    }
+}
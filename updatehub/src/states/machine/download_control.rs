@@ -0,0 +1,160 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use std::{
+    fmt,
+    sync::{Arc, Mutex},
+};
+use tokio::sync::watch;
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Status {
+    Idle,
+    Running,
+    Paused,
+}
+
+/// Pauses and resumes the objects download. It is shared by the agent
+/// API and the download task, as the state machine doesn't handle
+/// requests while the objects are downloaded.
+#[derive(Clone)]
+pub struct DownloadControl {
+    sender: Arc<Mutex<watch::Sender<Status>>>,
+    receiver: watch::Receiver<Status>,
+}
+
+impl Default for DownloadControl {
+    fn default() -> Self {
+        let (sender, receiver) = watch::channel(Status::Idle);
+        DownloadControl { sender: Arc::new(Mutex::new(sender)), receiver }
+    }
+}
+
+impl fmt::Debug for DownloadControl {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("DownloadControl").field("status", &self.status()).finish()
+    }
+}
+
+impl PartialEq for DownloadControl {
+    fn eq(&self, other: &Self) -> bool {
+        self.status() == other.status()
+    }
+}
+
+impl DownloadControl {
+    pub(crate) fn start(&self) {
+        self.set(None, Status::Running);
+    }
+
+    pub(crate) fn finish(&self) {
+        self.set(Some(Status::Running), Status::Idle);
+    }
+
+    /// Stops the download, so a paused download doesn't wait for being
+    /// resumed anymore.
+    pub(crate) fn cancel(&self) {
+        self.set(None, Status::Idle);
+    }
+
+    /// Pauses the running download, returning false if there is none.
+    pub(crate) fn pause(&self) -> bool {
+        self.set(Some(Status::Running), Status::Paused)
+    }
+
+    /// Resumes the paused download, returning false if there is none.
+    pub(crate) fn resume(&self) -> bool {
+        self.set(Some(Status::Paused), Status::Running)
+    }
+
+    pub(crate) fn is_paused(&self) -> bool {
+        self.status() == Status::Paused
+    }
+
+    pub(crate) fn is_running(&self) -> bool {
+        self.status() == Status::Running
+    }
+
+    /// Resolves once the download is paused.
+    pub(crate) async fn paused(&self) {
+        self.wait_for(|s| s == Status::Paused).await;
+    }
+
+    /// Resolves once the download is paused or cancelled.
+    pub(crate) async fn interrupted(&self) {
+        self.wait_for(|s| s != Status::Running).await;
+    }
+
+    /// Resolves once the paused download is resumed or cancelled,
+    /// returning whether it should go on.
+    pub(crate) async fn resumed(&self) -> bool {
+        self.wait_for(|s| s != Status::Paused).await == Status::Running
+    }
+
+    fn status(&self) -> Status {
+        *self.receiver.borrow()
+    }
+
+    fn set(&self, from: Option<Status>, to: Status) -> bool {
+        let sender = self.sender.lock().expect("download control lock is poisoned");
+        if from.map_or(false, |from| from != self.status()) {
+            return false;
+        }
+        // The receiver is kept alive by ourselves, so it never fails.
+        let _ = sender.broadcast(to);
+        true
+    }
+
+    async fn wait_for(&self, f: impl Fn(Status) -> bool) -> Status {
+        let mut receiver = self.receiver.clone();
+        loop {
+            let status = *receiver.borrow();
+            if f(status) {
+                return status;
+            }
+            if receiver.recv().await.is_none() {
+                return status;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn pause_only_running_download() {
+        let control = DownloadControl::default();
+        assert!(!control.pause());
+        assert!(!control.resume());
+
+        control.start();
+        assert!(control.pause());
+        assert!(control.is_paused());
+        assert!(!control.pause());
+        assert!(control.resume());
+        assert!(control.is_running());
+
+        control.finish();
+        assert!(!control.pause());
+    }
+
+    #[actix_rt::test]
+    async fn wait_for_resume() {
+        let control = DownloadControl::default();
+        control.start();
+        control.pause();
+
+        let resumer = control.clone();
+        actix_rt::spawn(async move {
+            resumer.resume();
+        });
+        assert!(control.resumed().await);
+
+        control.pause();
+        control.cancel();
+        assert!(!control.resumed().await);
+    }
+}
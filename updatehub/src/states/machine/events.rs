@@ -0,0 +1,66 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use async_std::sync;
+use sdk::api::events::Event;
+use std::sync::{Arc, Mutex};
+
+// Events buffered for each subscriber, the newer ones are dropped while
+// the buffer is full.
+const BUFFERED_EVENTS: usize = 64;
+
+/// Broadcasts the agent events to the local API clients subscribed to
+/// them.
+#[derive(Clone, Debug, Default)]
+pub struct EventBus {
+    subscribers: Arc<Mutex<Vec<sync::Sender<Event>>>>,
+}
+
+impl PartialEq for EventBus {
+    fn eq(&self, _other: &Self) -> bool {
+        // subscribers intentionally ignored
+        true
+    }
+}
+
+impl EventBus {
+    pub(crate) fn subscribe(&self) -> sync::Receiver<Event> {
+        let (sender, receiver) = sync::channel(BUFFERED_EVENTS);
+        self.subscribers.lock().unwrap().push(sender);
+        receiver
+    }
+
+    /// Sends the `event` to the subscribers, dropping the ones which are
+    /// gone.
+    pub(crate) fn publish(&self, event: Event) {
+        self.subscribers.lock().unwrap().retain(|subscriber| {
+            match subscriber.try_send(event.clone()) {
+                Err(sync::TrySendError::Disconnected(_)) => false,
+                _ => true,
+            }
+        });
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn publish_to_subscribers() {
+        let events = EventBus::default();
+        let first = events.subscribe();
+        let second = events.subscribe();
+
+        let event = Event::State { state: "idle".to_owned() };
+        events.publish(event.clone());
+        assert_eq!(first.try_recv().unwrap(), event);
+        assert_eq!(second.try_recv().unwrap(), event);
+
+        drop(second);
+        events.publish(event);
+        assert_eq!(events.subscribers.lock().unwrap().len(), 1);
+    }
+}
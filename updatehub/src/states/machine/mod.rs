@@ -3,15 +3,47 @@
 // SPDX-License-Identifier: Apache-2.0
 
 mod address;
+mod busy_state;
+mod download_control;
+mod events;
+mod progress;
+mod shutdown;
+mod update_cancel;
 
 use super::{
-    DirectDownload, EntryPoint, Metadata, PrepareLocalInstall, Result, RuntimeSettings, Settings,
-    State, StateChangeImpl, Validation,
+    await_approval::Approval, DirectDownload, EntryPoint, Metadata, PrepareLocalInstall, Result,
+    RuntimeSettings, Settings, State, StateChangeImpl, TransitionError, Validation,
+};
+use crate::{
+    capabilities::{self, Capabilities},
+    firmware::installation_set,
+    utils::{
+        self,
+        notifier::{self, Notifier},
+        suspend_inhibitor::SuspendInhibitor,
+    },
 };
 use async_std::{prelude::FutureExt, sync};
-use slog_scope::trace;
+use sdk::api::{
+    audit,
+    config::ReloadResponse,
+    events::Event,
+    info::runtime_settings::{PendingPackage, UpdateOutcome},
+};
+use slog_scope::{error, info, trace, warn};
+use std::path::PathBuf;
 
-pub(crate) use address::{AbortDownloadResponse, Addr, ProbeResponse, StateResponse};
+pub(crate) use address::{
+    AbortDownloadResponse, Addr, ApproveUpdateResponse, CancelUpdateResponse,
+    ConfirmIdentityResponse, ConfirmUpdateResponse, DownloadControlResponse, GoAheadResponse,
+    ProbeResponse, SetConfigResponse, StateResponse,
+};
+pub(crate) use busy_state::BusyState;
+pub(crate) use download_control::DownloadControl;
+pub(crate) use events::EventBus;
+pub(crate) use progress::ProgressTracker;
+pub(crate) use shutdown::Shutdown;
+pub(crate) use update_cancel::UpdateCancel;
 
 pub(super) struct StateMachine {
     state: State,
@@ -21,7 +53,13 @@ pub(super) struct StateMachine {
 pub(super) struct Context {
     communication: Channel<(address::Message, sync::Sender<address::Response>)>,
     waker: Channel<()>,
+    busy_state: BusyState,
     shared_state: SharedState,
+    /// Configuration file the settings are reloaded from.
+    config: PathBuf,
+    suspend_inhibitor: Option<SuspendInhibitor>,
+    notifiers: Vec<Box<dyn Notifier>>,
+    notified_state: Option<&'static str>,
 }
 
 #[derive(Debug, PartialEq)]
@@ -29,6 +67,18 @@ pub struct SharedState {
     pub settings: Settings,
     pub runtime_settings: RuntimeSettings,
     pub firmware: Metadata,
+    pub download_control: DownloadControl,
+    pub update_cancel: UpdateCancel,
+    pub shutdown: Shutdown,
+    pub progress: ProgressTracker,
+    pub events: EventBus,
+    pub capabilities: Capabilities,
+    pub approval: Option<Approval>,
+    /// Token of the go-ahead given by the external scheduler.
+    pub go_ahead: Option<String>,
+    /// What the update being handled has been started by.
+    pub trigger: Option<audit::Trigger>,
+    pub enrollment: sdk::api::enrollment::Response,
 }
 
 struct Channel<T> {
@@ -44,11 +94,151 @@ impl<T> Channel<T> {
 }
 
 impl SharedState {
+    /// Server the agent talks to: the custom one requested through the
+    /// API, or else the configured one which has last answered the probe.
     pub(super) fn server_address(&self) -> &str {
+        if let Some(server) = self.runtime_settings.custom_server_address() {
+            return server;
+        }
+        // The settings may have changed since it was last used.
         self.runtime_settings
-            .custom_server_address()
+            .active_server()
+            .filter(|active| self.settings.servers().any(|server| server == *active))
             .unwrap_or(&self.settings.network.server_address)
     }
+
+    /// Records the update attempt of the package to the runtime settings,
+    /// started by `trigger` unless the machine knows better.
+    pub(super) fn begin_attempt(
+        &mut self,
+        package_uid: String,
+        version_to: &str,
+        trigger: audit::Trigger,
+    ) -> Result<()> {
+        let attempt = audit::Attempt {
+            package_uid,
+            version_from: self.firmware.version.clone(),
+            version_to: version_to.to_owned(),
+            trigger: self.trigger.unwrap_or(trigger),
+            started_at: chrono::Utc::now(),
+            objects: Vec::default(),
+        };
+        self.runtime_settings.begin_attempt(attempt)?;
+        Ok(())
+    }
+
+    /// Probes the servers in order, the first to answer being kept to
+    /// download the update from and report it to. Only the custom server
+    /// is probed when one has been requested.
+    pub(super) async fn probe(&mut self) -> Result<cloud::api::ProbeResponse> {
+        let servers = match self.runtime_settings.custom_server_address() {
+            Some(server) => vec![server.to_owned()],
+            None => self.settings.servers().map(str::to_owned).collect::<Vec<_>>(),
+        };
+        let delta_bases = utils::delta::installed_objects(&self.settings.delta);
+
+        let mut last_error = None;
+        for server in &servers {
+            match crate::CloudClient::new(server)
+                .with_delta_bases(delta_bases.clone())
+                .probe(self.runtime_settings.retries() as u64, self.firmware.as_cloud_metadata())
+                .await
+            {
+                Ok(probe) => {
+                    if self.runtime_settings.custom_server_address().is_none() {
+                        self.runtime_settings.set_active_server(server)?;
+                    }
+                    return Ok(probe);
+                }
+                Err(cloud::Error::Http(e)) if e.is::<awc::http::uri::InvalidUri>() => {
+                    return Err(cloud::Error::Http(e).into());
+                }
+                Err(e) => {
+                    if servers.len() > 1 {
+                        warn!("probe to {} failed: {}", server, e);
+                    }
+                    last_error = Some(e);
+                }
+            }
+        }
+        Err(last_error.expect("there is always a server to probe").into())
+    }
+
+    /// Enrolls the device with the server it talks to, unless it has
+    /// already been or it isn't enrolled by the agent.
+    pub(super) async fn enroll(&mut self) -> Result<()> {
+        let server = self.server_address().to_owned();
+        crate::enrollment::enroll(
+            &self.settings.enrollment,
+            &server,
+            &self.firmware,
+            &mut self.enrollment,
+        )
+        .await
+    }
+
+    /// Reads the device identity again, so a change, as of a replaced
+    /// network card, is reported along the previous identity instead of
+    /// the device silently appearing as a new one.
+    pub(super) fn refresh_identity(&mut self) -> Result<()> {
+        // The simulated device keeps the identity of its settings.
+        if !self.settings.simulation.enabled {
+            match crate::firmware::device_identity(&self.settings.firmware.metadata) {
+                Ok(identity) => self.firmware.device_identity = identity,
+                Err(e) => warn!("failed to read the device identity, keeping the last one: {}", e),
+            }
+        }
+        if self.runtime_settings.track_identity(&self.firmware.device_identity)? {
+            warn!("device identity has changed, the previous one is reported until confirmed");
+        }
+        self.firmware.previous_device_identity = self.runtime_settings.previous_identity().cloned();
+        Ok(())
+    }
+
+    /// Applies the settings the server has pushed to the device, which
+    /// are kept in the runtime settings as the ones changed through the
+    /// agent API. They must be signed when the device has a public key.
+    pub(super) async fn apply_server_settings(&mut self) -> Result<()> {
+        let server = self.server_address().to_owned();
+        let (delta, signature) = match crate::CloudClient::new(&server)
+            .settings(self.firmware.as_cloud_metadata())
+            .await?
+        {
+            Some(settings) => settings,
+            None => return Ok(()),
+        };
+        if let Some(key) = self.firmware.pub_key.as_ref() {
+            signature.ok_or(TransitionError::SignatureNotFound)?.validate_settings(key, &delta)?;
+        }
+
+        // The server may send the same settings on every probe.
+        let changed = delta
+            .settings
+            .into_iter()
+            .filter(|(key, value)| self.runtime_settings.settings.get(key) != Some(value))
+            .collect::<std::collections::BTreeMap<_, _>>();
+        if changed.is_empty() {
+            return Ok(());
+        }
+
+        let mut settings = self.settings.clone();
+        settings.set_from_server(&changed)?;
+        for (key, value) in &changed {
+            info!("{} setting changed to {} by the server", key, value);
+            self.runtime_settings.set_setting(key, value)?;
+        }
+        self.settings = settings;
+        Ok(())
+    }
+
+    /// Collects the device attributes again, so the probe carries their
+    /// current values.
+    pub(super) fn refresh_device_attributes(&mut self) {
+        self.firmware.device_attributes = crate::firmware::device_attributes(
+            &self.settings.firmware.metadata,
+            &self.settings.device_attributes,
+        );
+    }
 }
 
 #[derive(Debug)]
@@ -58,19 +248,98 @@ pub(super) enum StepTransition {
     Never,
 }
 
+impl Context {
+    fn inhibit_suspend(&mut self, inhibit: bool) {
+        let settings = &self.shared_state.settings.update;
+        if !settings.inhibit_suspend {
+            return;
+        }
+
+        match (inhibit, self.suspend_inhibitor.is_some()) {
+            (true, false) => {
+                match SuspendInhibitor::acquire(settings.inhibit_suspend_hook.as_deref()) {
+                    Ok(inhibitor) => self.suspend_inhibitor = Some(inhibitor),
+                    Err(e) => warn!("failed to inhibit system suspend: {}", e),
+                }
+            }
+            (false, true) => self.suspend_inhibitor = None,
+            _ => {}
+        }
+    }
+}
+
+impl Context {
+    // The settings read by the states are taken as they run, while the
+    // ones kept elsewhere are updated here.
+    fn apply_settings(&mut self, settings: Settings) {
+        self.shared_state.firmware.channel = settings.update.channel.clone();
+        crate::logger::configure(&settings.log);
+        // The metadata hooks are run again, as they may have been changed
+        // along with the settings.
+        crate::firmware::configure_hooks(&settings.firmware);
+        self.shared_state.settings = settings;
+    }
+
+    fn notify(&mut self, state: &'static str) {
+        let package_uid = self
+            .shared_state
+            .runtime_settings
+            .transaction()
+            .map(|transaction| crate::utils::sha256sum(transaction.package.as_bytes()));
+        crate::logger::set_context(state, package_uid);
+
+        if self.notified_state == Some(state) {
+            return;
+        }
+        self.notified_state = Some(state);
+        self.shared_state.events.publish(Event::State { state: state.to_owned() });
+
+        for notifier in self.notifiers.iter_mut() {
+            if let Err(e) = notifier.notify(state) {
+                warn!("failed to notify state change: {}", e);
+            }
+        }
+    }
+}
+
 impl StateMachine {
     pub(super) fn new(
         state: State,
         settings: Settings,
         runtime_settings: RuntimeSettings,
         firmware: Metadata,
+        config: PathBuf,
     ) -> Self {
+        let notifiers = notifier::from_settings(&settings);
+        let capabilities = capabilities::discover(&settings.update.supported_install_modes);
+        let events = EventBus::default();
+        let enrollment = crate::enrollment::load(&settings.enrollment);
+
         StateMachine {
             state,
             context: Context {
                 communication: Channel::new(10),
                 waker: Channel::new(1),
-                shared_state: SharedState { settings, runtime_settings, firmware },
+                busy_state: BusyState::default(),
+                shared_state: SharedState {
+                    settings,
+                    runtime_settings,
+                    firmware,
+                    download_control: DownloadControl::default(),
+                    update_cancel: UpdateCancel::default(),
+                    shutdown: Shutdown::default(),
+                    progress: ProgressTracker::new(events.clone()),
+                    events,
+                    capabilities,
+                    approval: None,
+                    go_ahead: None,
+                    trigger: None,
+                    enrollment,
+                },
+                config,
+                suspend_inhibitor: None,
+                notifiers,
+                notified_state: None,
             },
         }
     }
@@ -79,29 +348,90 @@ impl StateMachine {
         Addr {
             message: self.context.communication.sender.clone(),
             waker: self.context.waker.sender.clone(),
+            busy_state: self.context.busy_state.clone(),
+            download_control: self.context.shared_state.download_control.clone(),
+            update_cancel: self.context.shared_state.update_cancel.clone(),
+            shutdown: self.context.shared_state.shutdown.clone(),
+            progress: self.context.shared_state.progress.clone(),
+            events: self.context.shared_state.events.clone(),
         }
     }
 
+    /// Runs the state machine until the agent is stopped.
     pub(super) async fn start(mut self) {
         loop {
             // Since the loop is already currently running, we can
             // discharges any wake message received.
             let _ = self.context.waker.receiver.try_recv();
 
-            self.consume_pending_communication().await;
+            // The states handling the update stop where it can be resumed
+            // from, so the agent is stopped in between them.
+            if self.context.shared_state.shutdown.is_requested() {
+                self.stop();
+                return;
+            }
 
-            let (state, transition) = self
-                .state
-                .move_to_next_state(&mut self.context.shared_state)
-                .await
-                .unwrap_or_else(|e| (State::from(e), StepTransition::Immediate));
+            self.consume_pending_communication().await;
+            self.context.inhibit_suspend(self.state.is_inhibiting_suspend());
+            self.context.notify(self.state.name());
+            self.context.shared_state.update_cancel.set_cancellable(self.state.is_cancellable());
+
+            // The status queries are answered from the info as it is now
+            // while the state is handled, as it may take long.
+            self.context.busy_state.enter(self.info(), self.state.is_handling_download());
+            let (state, transition) =
+                match self.state.move_to_next_state(&mut self.context.shared_state).await {
+                    Ok(next) => next,
+                    Err(e) => {
+                        self.context
+                            .shared_state
+                            .events
+                            .publish(Event::Error { message: e.to_string() });
+                        (State::from(e), StepTransition::Immediate)
+                    }
+                };
             self.state = state;
+            self.context.busy_state.leave();
+
+            // The traffic is accounted once each state is handled, so the
+            // runtime settings aren't written for every request.
+            let traffic = cloud::take_traffic();
+            if traffic != cloud::Traffic::default() {
+                if let Err(e) = self.context.shared_state.runtime_settings.add_bandwidth(
+                    traffic.downloaded,
+                    traffic.uploaded,
+                    chrono::Utc::now(),
+                ) {
+                    error!("failed to account the transferred bytes: {}", e);
+                }
+            }
+
+            // The progress is kept while the download is paused, and the
+            // install is handled in a single step.
+            if !self.state.is_handling_download() {
+                self.context.shared_state.progress.clear();
+            }
 
             match transition {
                 StepTransition::Immediate => {}
                 StepTransition::Delayed(t) => {
                     trace!("delaying transition for: {} seconds", t.as_secs());
-                    async_std::task::sleep(t).race(self.await_communication()).await;
+                    // Awoken earlier only when the update is canceled or the
+                    // agent is stopped, as the waker is also sent to the
+                    // states waiting to be awoken.
+                    let waker = self.context.waker.receiver.clone();
+                    let update_cancel = self.context.shared_state.update_cancel.clone();
+                    let shutdown = self.context.shared_state.shutdown.clone();
+                    utils::boottime::sleep(t)
+                        .race(async {
+                            while waker.recv().await.is_ok() {
+                                if update_cancel.is_requested() || shutdown.is_requested() {
+                                    break;
+                                }
+                            }
+                        })
+                        .race(self.await_communication())
+                        .await;
                 }
                 StepTransition::Never => {
                     trace!("stopping transition until awoken");
@@ -121,6 +451,58 @@ impl StateMachine {
         }
     }
 
+    fn stop(&mut self) {
+        info!("stopping on {} state", self.state.name());
+        if let Err(e) = self.context.shared_state.runtime_settings.flush() {
+            error!("failed to save the runtime settings: {}", e);
+        }
+        self.context.inhibit_suspend(false);
+    }
+
+    /// Handles the update until it is done with, for the packages
+    /// installed while the agent isn't running. The device is only
+    /// rebooted into the new installation when `reboot` is set. Returns
+    /// the error the update has failed with, if it has.
+    pub(super) async fn run_update(mut self, reboot: bool) -> Option<String> {
+        let mut failure = None;
+        loop {
+            match self.state {
+                State::Reboot(_) if !reboot => return None,
+                State::EntryPoint(_) | State::Park(_) | State::Poll(_) => return failure,
+                _ => {}
+            }
+            self.context.notify(self.state.name());
+
+            let (state, transition) =
+                match self.state.move_to_next_state(&mut self.context.shared_state).await {
+                    Ok(next) => next,
+                    Err(e) => {
+                        error!("update has failed: {}", e);
+                        failure = Some(e.to_string());
+                        (State::from(e), StepTransition::Immediate)
+                    }
+                };
+            self.state = state;
+
+            match transition {
+                StepTransition::Immediate => {}
+                StepTransition::Delayed(t) => utils::boottime::sleep(t).await,
+                StepTransition::Never => return failure,
+            }
+        }
+    }
+
+    fn info(&self) -> sdk::api::info::Response {
+        sdk::api::info::Response {
+            state: self.state.name().to_owned(),
+            version: crate::version().to_string(),
+            config: self.context.shared_state.settings.redacted(),
+            firmware: self.context.shared_state.firmware.0.clone(),
+            runtime_settings: self.context.shared_state.runtime_settings.0.clone(),
+            capabilities: self.context.shared_state.capabilities.clone(),
+        }
+    }
+
     async fn consume_pending_communication(&mut self) {
         while let Ok((msg, responder)) = self.context.communication.receiver.try_recv() {
             self.handle_communication(msg, responder).await;
@@ -133,6 +515,153 @@ impl StateMachine {
         }
     }
 
+    fn confirm_identity(&mut self) -> ConfirmIdentityResponse {
+        let shared_state = &mut self.context.shared_state;
+        match shared_state.runtime_settings.confirm_identity_change() {
+            Ok(true) => {
+                info!("device identity change has been confirmed");
+                shared_state.firmware.previous_device_identity = None;
+                ConfirmIdentityResponse::RequestAccepted
+            }
+            Ok(false) => ConfirmIdentityResponse::InvalidState,
+            Err(e) => {
+                error!("failed to confirm the device identity change: {}", e);
+                ConfirmIdentityResponse::InvalidState
+            }
+        }
+    }
+
+    // The setting is validated against the current settings, and kept in
+    // the runtime settings so it is applied again when the agent starts.
+    fn set_config(&mut self, key: &str, value: &str) -> Result<SetConfigResponse> {
+        let shared_state = &mut self.context.shared_state;
+        let mut settings = shared_state.settings.clone();
+        settings.set(key, value)?;
+        shared_state.runtime_settings.set_setting(key, value)?;
+
+        if Settings::requires_restart(key) {
+            info!("{} setting changed to {}, it applies once the agent is restarted", key, value);
+            return Ok(SetConfigResponse::RestartRequired);
+        }
+        info!("{} setting changed to {}", key, value);
+        self.context.apply_settings(settings);
+        Ok(SetConfigResponse::Applied)
+    }
+
+    // The configuration file is read again, along with the settings
+    // changed through the agent API on top of it, as when the agent starts.
+    fn reload_config(&mut self) -> Result<ReloadResponse> {
+        let context = &mut self.context;
+        let mut reloaded = Settings::load(&context.config)?;
+        for (key, value) in context.shared_state.runtime_settings.settings.iter() {
+            if let Err(e) = reloaded.set(key, value) {
+                warn!("ignoring the {} setting changed through the agent api: {}", key, e);
+            }
+        }
+
+        let mut settings = context.shared_state.settings.clone();
+        let mut response = ReloadResponse { applied: Vec::new(), restart_required: Vec::new() };
+        for (key, restart_required) in settings.reload(reloaded)? {
+            if restart_required {
+                info!("{} setting changed, it applies once the agent is restarted", key);
+                response.restart_required.push(key);
+            } else {
+                info!("{} setting changed", key);
+                response.applied.push(key);
+            }
+        }
+        context.apply_settings(settings);
+        Ok(response)
+    }
+
+    // The rollback is only started while no update is being handled, or
+    // the update booted into is yet to be confirmed.
+    async fn rollback(&mut self, execute: bool) -> Result<sdk::api::rollback::Response> {
+        let mut response = super::rollback::check(&self.context.shared_state)?;
+        if !execute || !response.ready {
+            return Ok(response);
+        }
+
+        let awaiting_confirmation = match self.state {
+            State::AwaitBootConfirmation(_) => true,
+            _ => false,
+        };
+        if !self.state.is_preemptive_state() && !awaiting_confirmation {
+            return Err(TransitionError::Busy(self.state.name().to_owned()));
+        }
+
+        info!(
+            "rolling back into installation set {} as requested",
+            installation_set::Set(response.installation_set)
+        );
+        let shared_state = &mut self.context.shared_state;
+        let package_uid = shared_state
+            .runtime_settings
+            .applied_package_uid()
+            .or_else(|| {
+                let active = installation_set::active().ok()?;
+                Some(shared_state.runtime_settings.installation_record(active)?.package_uid.clone())
+            })
+            .unwrap_or_default();
+        super::rollback::rollback(
+            shared_state,
+            package_uid,
+            "rollback requested by operator".to_owned(),
+        )
+        .await?;
+
+        self.state = State::EntryPoint(EntryPoint {});
+        response.executed = true;
+        Ok(response)
+    }
+
+    fn firmware_state(&self) -> Result<sdk::api::firmware::Response> {
+        let shared_state = &self.context.shared_state;
+        let awaiting_confirmation = match self.state {
+            State::AwaitBootConfirmation(_) => true,
+            _ => false,
+        };
+
+        Ok(sdk::api::firmware::Response {
+            metadata: shared_state.firmware.0.clone(),
+            active_installation_set: installation_set::active()?.0,
+            inactive_installation_set: installation_set::inactive()?.0,
+            last_update: shared_state.runtime_settings.last_update_result().cloned(),
+            awaiting_confirmation,
+            quarantined_installation_sets: shared_state
+                .runtime_settings
+                .activation_failures
+                .iter()
+                .filter(|failures| failures.quarantined_at.is_some())
+                .map(|failures| failures.installation_set)
+                .collect(),
+        })
+    }
+
+    fn twin_state(&self) -> sdk::api::twin::Response {
+        let runtime_settings = &self.context.shared_state.runtime_settings;
+        let desired = runtime_settings.desired_package().cloned();
+        let last_update = runtime_settings.last_update_result().cloned();
+
+        // The device is in sync once the desired package is installed.
+        let in_sync = desired.as_ref().map_or(true, |desired| {
+            last_update.as_ref().map_or(false, |result| {
+                result.outcome == UpdateOutcome::Installed
+                    && result.package_uid.as_ref() == Some(&desired.package_uid)
+            })
+        });
+
+        sdk::api::twin::Response {
+            desired,
+            reported: sdk::api::twin::Reported {
+                version: self.context.shared_state.firmware.version.clone(),
+                state: self.state.name().to_owned(),
+                last_update,
+            },
+            in_sync,
+        }
+    }
+
     async fn handle_communication(
         &mut self,
         msg: address::Message,
@@ -141,21 +670,18 @@ impl StateMachine {
         trace!("Received external request: {:?}", msg);
 
         let response = match msg {
-            address::Message::Info => {
-                let state = self.state.name().to_owned();
-                address::Response::Info(sdk::api::info::Response {
-                    state,
-                    version: crate::version().to_string(),
-                    config: self.context.shared_state.settings.0.clone(),
-                    firmware: self.context.shared_state.firmware.0.clone(),
-                    runtime_settings: self.context.shared_state.runtime_settings.0.clone(),
-                })
+            address::Message::Info => address::Response::Info(self.info()),
+            address::Message::Firmware => address::Response::Firmware(self.firmware_state()),
+            address::Message::Twin => address::Response::Twin(self.twin_state()),
+            address::Message::Enrollment => {
+                address::Response::Enrollment(self.context.shared_state.enrollment.clone())
             }
             address::Message::Probe(custom_server) => {
                 address::Response::Probe(self.handle_probe_request(custom_server).await)
             }
             address::Message::AbortDownload => {
                 if self.state.is_handling_download() {
+                    self.context.shared_state.download_control.cancel();
                     self.state = State::EntryPoint(EntryPoint {});
                     address::Response::AbortDownload(
                         address::AbortDownloadResponse::RequestAccepted,
@@ -164,6 +690,66 @@ impl StateMachine {
                     address::Response::AbortDownload(address::AbortDownloadResponse::InvalidState)
                 }
             }
+            address::Message::ConfirmIdentity => {
+                address::Response::ConfirmIdentity(self.confirm_identity())
+            }
+            address::Message::ConfirmUpdate => {
+                if let State::AwaitBootConfirmation(_) = self.state {
+                    match super::await_boot_confirmation::confirm(&mut self.context.shared_state) {
+                        Ok(()) => {
+                            self.context.waker.sender.send(()).await;
+                            self.state = State::EntryPoint(EntryPoint {});
+                        }
+                        Err(e) => {
+                            error!("failed to confirm the installation: {}", e);
+                            self.state = State::from(e);
+                        }
+                    }
+                    address::Response::ConfirmUpdate(
+                        address::ConfirmUpdateResponse::RequestAccepted,
+                    )
+                } else {
+                    address::Response::ConfirmUpdate(address::ConfirmUpdateResponse::InvalidState)
+                }
+            }
+            address::Message::ApproveUpdate(approval) => {
+                if let State::AwaitApproval(_) = self.state {
+                    self.context.shared_state.approval = Some(approval);
+                    self.context.waker.sender.send(()).await;
+                    address::Response::ApproveUpdate(
+                        address::ApproveUpdateResponse::RequestAccepted,
+                    )
+                } else {
+                    address::Response::ApproveUpdate(address::ApproveUpdateResponse::InvalidState)
+                }
+            }
+            address::Message::GoAhead(request) => {
+                let response = match self.state {
+                    State::AwaitGoAhead(ref s) if s.token.as_ref() != Some(&request.token) => {
+                        address::GoAheadResponse::UnknownToken
+                    }
+                    State::AwaitGoAhead(_) if request.expires_at <= chrono::Utc::now() => {
+                        address::GoAheadResponse::Expired
+                    }
+                    State::AwaitGoAhead(_) => {
+                        self.context.shared_state.go_ahead = Some(request.token);
+                        self.context.waker.sender.send(()).await;
+                        address::GoAheadResponse::RequestAccepted
+                    }
+                    _ => address::GoAheadResponse::InvalidState,
+                };
+                address::Response::GoAhead(response)
+            }
+            address::Message::DryRun(request) => address::Response::DryRun(
+                super::dry_run::check(&self.context.shared_state, request).await,
+            ),
+            address::Message::Rollback(execute) => {
+                address::Response::Rollback(self.rollback(execute).await)
+            }
+            address::Message::SetConfig(key, value) => {
+                address::Response::SetConfig(self.set_config(&key, &value))
+            }
+            address::Message::ReloadConfig => address::Response::ReloadConfig(self.reload_config()),
             address::Message::LocalInstall(update_file) => {
                 let state = self.state.name().to_owned();
 
@@ -171,11 +757,14 @@ impl StateMachine {
                     crate::logger::start_memory_logging();
                     self.context.waker.sender.send(()).await;
 
+                    self.context.shared_state.trigger = Some(audit::Trigger::LocalInstall);
                     self.state = State::PrepareLocalInstall(PrepareLocalInstall { update_file });
 
                     address::Response::LocalInstall(address::StateResponse::RequestAccepted(state))
                 } else {
-                    address::Response::LocalInstall(address::StateResponse::InvalidState(state))
+                    address::Response::LocalInstall(
+                        self.queue_package(state, PendingPackage::File(update_file)),
+                    )
                 }
             }
             address::Message::RemoteInstall(url) => {
@@ -185,11 +774,14 @@ impl StateMachine {
                     crate::logger::start_memory_logging();
                     self.context.waker.sender.send(()).await;
 
+                    self.context.shared_state.trigger = Some(audit::Trigger::RemoteInstall);
                     self.state = State::DirectDownload(DirectDownload { url });
 
                     address::Response::RemoteInstall(address::StateResponse::RequestAccepted(state))
                 } else {
-                    address::Response::RemoteInstall(address::StateResponse::InvalidState(state))
+                    address::Response::RemoteInstall(
+                        self.queue_package(state, PendingPackage::Url(url)),
+                    )
                 }
             }
         };
@@ -197,6 +789,21 @@ impl StateMachine {
         responder.send(response).await;
     }
 
+    // The pending packages are handled by the entry point, once the
+    // current update is done with.
+    fn queue_package(&mut self, state: String, package: PendingPackage) -> address::StateResponse {
+        match self.context.shared_state.runtime_settings.queue_package(package) {
+            Ok(position) => {
+                info!("update package queued at position {}", position);
+                address::StateResponse::Queued(state, position)
+            }
+            Err(e) => {
+                error!("failed to queue the update package: {}", e);
+                address::StateResponse::InvalidState(state)
+            }
+        }
+    }
+
     async fn handle_probe_request(
         &mut self,
         custom_server: Option<String>,
@@ -213,13 +820,7 @@ impl StateMachine {
             self.context.shared_state.runtime_settings.set_custom_server_address(&server_address);
         }
 
-        match crate::CloudClient::new(&self.context.shared_state.server_address())
-            .probe(
-                self.context.shared_state.runtime_settings.retries() as u64,
-                self.context.shared_state.firmware.as_cloud_metadata(),
-            )
-            .await?
-        {
+        match self.context.shared_state.probe().await? {
             ProbeResponse::ExtraPoll(s) => Ok(address::ProbeResponse::Delayed(s)),
 
             ProbeResponse::NoUpdate => {
@@ -236,6 +837,7 @@ impl StateMachine {
 
                 // Store timestamp of last polling
                 self.context.shared_state.runtime_settings.set_last_polling(Utc::now())?;
+                self.context.shared_state.trigger = Some(audit::Trigger::ApiProbe);
                 self.state = State::Validation(Validation { package, sign });
                 Ok(address::ProbeResponse::Available)
             }
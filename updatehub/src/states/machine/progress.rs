@@ -0,0 +1,129 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::EventBus;
+use crate::object::{self, Info};
+use pkg_schema::Object;
+use sdk::api::{
+    events::Event,
+    progress::{Progress, Stage},
+};
+use std::sync::{Arc, Mutex};
+
+/// Progress of the object being downloaded or installed. It is shared by
+/// the agent API and the states, as the state machine doesn't handle
+/// requests while the update is downloaded or installed.
+#[derive(Clone, Debug, Default)]
+pub struct ProgressTracker {
+    current: Arc<Mutex<Option<Progress>>>,
+    events: EventBus,
+}
+
+impl PartialEq for ProgressTracker {
+    fn eq(&self, other: &Self) -> bool {
+        self.current() == other.current()
+    }
+}
+
+impl ProgressTracker {
+    /// Creates a tracker publishing the progress changes to the `events`.
+    pub(crate) fn new(events: EventBus) -> Self {
+        ProgressTracker { current: Arc::default(), events }
+    }
+
+    /// Starts tracking the `object`, at the `index` of the `count` objects
+    /// of the package.
+    pub(crate) fn start(&self, stage: Stage, index: usize, count: usize, object: &Object) {
+        let progress = Progress {
+            stage,
+            object: object.filename().to_owned(),
+            mode: object::mode(object).to_owned(),
+            index,
+            count,
+            done: 0,
+            total: object.len(),
+            percentage: 0,
+        };
+        *self.current.lock().unwrap() = Some(progress.clone());
+        self.events.publish(Event::Progress { progress });
+    }
+
+    /// Updates the bytes of the current object handled so far.
+    pub(crate) fn update(&self, done: u64) {
+        let mut current = self.current.lock().unwrap();
+        if let Some(progress) = current.as_mut() {
+            let done = done.min(progress.total);
+            let percentage = match progress.total {
+                0 => 100,
+                total => (done * 100 / total) as u8,
+            };
+
+            // The download progress is sampled even when it hasn't changed.
+            if (progress.done, progress.percentage) != (done, percentage) {
+                progress.done = done;
+                progress.percentage = percentage;
+                self.events.publish(Event::Progress { progress: progress.clone() });
+            }
+        }
+    }
+
+    /// Marks the current object as completely handled.
+    pub(crate) fn finish(&self) {
+        self.update(u64::max_value());
+    }
+
+    pub(crate) fn clear(&self) {
+        *self.current.lock().unwrap() = None;
+    }
+
+    pub(crate) fn current(&self) -> Option<Progress> {
+        self.current.lock().unwrap().clone()
+    }
+
+    /// Progress in the format reported to the server.
+    pub(crate) fn current_for_cloud(&self) -> Option<cloud::api::Progress> {
+        self.current().map(|progress| cloud::api::Progress {
+            object: progress.object,
+            mode: progress.mode,
+            index: progress.index,
+            count: progress.count,
+            done: progress.done,
+            total: progress.total,
+            percentage: progress.percentage,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        firmware::installation_set::Set,
+        update_package::{tests::get_update_package, UpdatePackageExt},
+    };
+    use pretty_assertions::assert_eq;
+    use sdk::api::info::runtime_settings::InstallationSet;
+
+    #[test]
+    fn track_object() {
+        let tracker = ProgressTracker::default();
+        let update_package = get_update_package();
+        let object = &update_package.objects(Set(InstallationSet::A))[0];
+        assert_eq!(tracker.current(), None);
+
+        tracker.start(Stage::Download, 0, 1, object);
+        tracker.update(object.len() / 2);
+        let progress = tracker.current().unwrap();
+        assert_eq!(progress.stage, Stage::Download);
+        assert_eq!(progress.object, object.filename());
+        assert_eq!(progress.done, object.len() / 2);
+        assert_eq!(progress.percentage, (object.len() / 2 * 100 / object.len()) as u8);
+
+        tracker.finish();
+        assert_eq!(tracker.current().unwrap().percentage, 100);
+
+        tracker.clear();
+        assert_eq!(tracker.current(), None);
+    }
+}
@@ -0,0 +1,31 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use std::sync::{
+    atomic::{AtomicBool, Ordering},
+    Arc,
+};
+
+/// Stops the state machine once the update can be resumed from where it
+/// is, as when the agent is stopped. It is shared by the signal handler
+/// and the states, as the state machine doesn't handle requests while the
+/// update is downloaded or installed.
+#[derive(Clone, Debug, Default)]
+pub struct Shutdown(Arc<AtomicBool>);
+
+impl PartialEq for Shutdown {
+    fn eq(&self, other: &Self) -> bool {
+        self.is_requested() == other.is_requested()
+    }
+}
+
+impl Shutdown {
+    pub(crate) fn request(&self) {
+        self.0.store(true, Ordering::SeqCst);
+    }
+
+    pub(crate) fn is_requested(&self) -> bool {
+        self.0.load(Ordering::SeqCst)
+    }
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use std::sync::{
+    atomic::{AtomicBool, Ordering},
+    Arc,
+};
+
+/// Cancels the update in progress. It is shared by the agent API and the
+/// states, as the state machine doesn't handle requests while the update
+/// is downloaded or installed.
+#[derive(Clone, Debug, Default)]
+pub struct UpdateCancel {
+    cancellable: Arc<AtomicBool>,
+    requested: Arc<AtomicBool>,
+}
+
+impl PartialEq for UpdateCancel {
+    fn eq(&self, other: &Self) -> bool {
+        self.is_requested() == other.is_requested()
+    }
+}
+
+impl UpdateCancel {
+    /// Sets whether the current state can be canceled, dropping any
+    /// request left once it can't.
+    pub(crate) fn set_cancellable(&self, cancellable: bool) {
+        self.cancellable.store(cancellable, Ordering::SeqCst);
+        if !cancellable {
+            self.requested.store(false, Ordering::SeqCst);
+        }
+    }
+
+    /// Requests the update to be canceled, returning false if there is no
+    /// update to be canceled.
+    pub(crate) fn request(&self) -> bool {
+        if !self.cancellable.load(Ordering::SeqCst) {
+            return false;
+        }
+        self.requested.store(true, Ordering::SeqCst);
+        true
+    }
+
+    pub(crate) fn is_requested(&self) -> bool {
+        self.requested.load(Ordering::SeqCst)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn cancel_only_cancellable_states() {
+        let cancel = UpdateCancel::default();
+        assert!(!cancel.request());
+        assert!(!cancel.is_requested());
+
+        cancel.set_cancellable(true);
+        assert!(cancel.request());
+        assert!(cancel.is_requested());
+
+        cancel.set_cancellable(false);
+        assert!(!cancel.is_requested());
+    }
+}
@@ -4,8 +4,18 @@
 
 #[macro_use]
 mod macros;
+mod await_approval;
+mod await_boot_confirmation;
+mod await_go_ahead;
+mod await_maintenance_window;
+mod await_network;
+mod await_power;
+mod await_reboot;
+mod await_reboot_lock;
 mod direct_download;
 mod download;
+mod download_paused;
+mod dry_run;
 mod entry_point;
 mod error;
 pub(crate) mod install;
@@ -16,28 +26,44 @@ mod prepare_download;
 mod prepare_local_install;
 mod probe;
 mod reboot;
+mod rollback;
 mod validation;
 
 #[cfg(test)]
 mod tests;
 
+pub(crate) use self::prepare_local_install::upload_dir;
+
 use self::{
-    direct_download::DirectDownload, download::Download, entry_point::EntryPoint, error::Error,
-    install::Install, park::Park, poll::Poll, prepare_download::PrepareDownload,
+    await_approval::AwaitApproval, await_boot_confirmation::AwaitBootConfirmation,
+    await_go_ahead::AwaitGoAhead, await_maintenance_window::AwaitMaintenanceWindow,
+    await_network::AwaitNetwork, await_power::AwaitPower, await_reboot::AwaitReboot,
+    await_reboot_lock::AwaitRebootLock, direct_download::DirectDownload, download::Download,
+    download_paused::DownloadPaused, entry_point::EntryPoint, error::Error, install::Install,
+    park::Park, poll::Poll, prepare_download::PrepareDownload,
     prepare_local_install::PrepareLocalInstall, probe::Probe, reboot::Reboot,
     validation::Validation,
 };
 use crate::{
     firmware::{self, Metadata, Transition},
-    http_api,
+    gateway, http_api, mirror, object,
     runtime_settings::RuntimeSettings,
+    self_test,
     settings::Settings,
+    utils,
 };
+use async_std::prelude::FutureExt;
 use async_trait::async_trait;
+use sdk::api::info::runtime_settings::UpdateOutcome;
 use slog_scope::{error, info, warn};
 use std::path::Path;
 use thiserror::Error;
 
+// Lines of the log sent along the details of a failed update.
+const ERROR_LOG_LINES: usize = 20;
+// Times an interrupted update is resumed before it is dropped.
+const MAX_RESUME_ATTEMPTS: u32 = 3;
+
 pub type Result<T> = std::result::Result<T, TransitionError>;
 
 #[derive(Debug, Error)]
@@ -48,6 +74,30 @@ pub enum TransitionError {
     #[error("signature not found")]
     SignatureNotFound,
 
+    #[error("update canceled")]
+    Canceled,
+
+    #[error("'{mode}' install mode is unavailable, missing: {}", missing.join(", "))]
+    MissingCapabilities { mode: String, missing: Vec<String> },
+
+    #[error(
+        "not enough space to download the update in {dir:?}: {required} bytes required, \
+         {available} bytes available"
+    )]
+    NotEnoughDownloadSpace { dir: std::path::PathBuf, required: u64, available: u64 },
+
+    #[error("install aborted as the environment is out of limits: {0}")]
+    EnvironmentAlarm(String),
+
+    #[error("install of {0} has not finished within {1:?}")]
+    InstallTimeout(String, std::time::Duration),
+
+    #[error("download has not finished within {0:?}")]
+    DownloadTimeout(std::time::Duration),
+
+    #[error("agent is busy in the '{0}' state")]
+    Busy(String),
+
     #[error(transparent)]
     Firmware(#[from] crate::firmware::Error),
 
@@ -57,6 +107,9 @@ pub enum TransitionError {
     #[error(transparent)]
     RuntimeSettings(#[from] crate::runtime_settings::Error),
 
+    #[error(transparent)]
+    Settings(#[from] crate::settings::Error),
+
     #[error(transparent)]
     UpdatePackage(#[from] crate::update_package::Error),
 
@@ -66,6 +119,9 @@ pub enum TransitionError {
     #[error(transparent)]
     Uncompress(#[from] compress_tools::Error),
 
+    #[error(transparent)]
+    Utils(#[from] crate::utils::Error),
+
     #[error("serde error: {0}")]
     SerdeJson(#[from] serde_json::error::Error),
 
@@ -79,6 +135,76 @@ pub enum TransitionError {
     Process(#[from] easy_process::Error),
 }
 
+impl TransitionError {
+    fn sources(&self) -> impl Iterator<Item = &(dyn std::error::Error + 'static)> {
+        std::iter::successors(Some(self as &(dyn std::error::Error + 'static)), |e| e.source())
+    }
+
+    /// Error number of the system call which has failed, if any.
+    fn errno(&self) -> Option<i32> {
+        self.sources().find_map(|e| {
+            if let Some(e) = e.downcast_ref::<std::io::Error>() {
+                return e.raw_os_error();
+            }
+            match e.downcast_ref::<nix::Error>() {
+                Some(nix::Error::Sys(errno)) => Some(*errno as i32),
+                _ => None,
+            }
+        })
+    }
+
+    /// Exit code of the script, or tool, which has failed, if any.
+    fn exit_code(&self) -> Option<i32> {
+        let status = match self {
+            TransitionError::Installation(crate::object::Error::ScriptFailed(status))
+            | TransitionError::Firmware(firmware::Error::HookFailed(_, status, _))
+            | TransitionError::Utils(utils::Error::HookFailed(_, status)) => Some(*status),
+            _ => self.sources().find_map(|e| match e.downcast_ref::<easy_process::Error>() {
+                Some(easy_process::Error::Failure(status, _)) => Some(*status),
+                _ => None,
+            }),
+        };
+        status.and_then(|status| status.code())
+    }
+
+    /// Class of the failure, so the server can tell apart the updates
+    /// which have been given up on from the ones which have failed.
+    fn class(&self) -> Option<String> {
+        match self {
+            TransitionError::InstallTimeout(..) | TransitionError::DownloadTimeout(_) => {
+                Some("timeout".to_owned())
+            }
+            _ => None,
+        }
+    }
+}
+
+/// Gathers what the device was doing when the update has failed in the
+/// `state`, so the server can aggregate the failure causes.
+fn error_details(
+    shared_state: &machine::SharedState,
+    state: &str,
+    error: &TransitionError,
+    log: &str,
+) -> cloud::api::ErrorDetails {
+    let progress = shared_state.progress.current();
+    let lines = log.lines().collect::<Vec<_>>();
+    cloud::api::ErrorDetails {
+        state: state.to_owned(),
+        object_index: progress.as_ref().map(|p| p.index),
+        object_mode: progress.map(|p| p.mode),
+        errno: error.errno(),
+        exit_code: error.exit_code(),
+        class: error.class(),
+        log: lines[lines.len().saturating_sub(ERROR_LOG_LINES)..]
+            .iter()
+            .map(|line| (*line).to_owned())
+            .collect(),
+        free_space: utils::fs::available_space(&shared_state.settings.update.download_dir).ok(),
+        battery: utils::environment::battery_capacity(),
+    }
+}
+
 #[async_trait(?Send)]
 trait StateChangeImpl {
     async fn handle(
@@ -100,14 +226,33 @@ trait StateChangeImpl {
     fn is_preemptive_state(&self) -> bool {
         false
     }
+
+    /// States downloading or installing an update should overwrite this
+    /// to return true. That way, the system is kept from suspending
+    /// while they run.
+    fn is_inhibiting_suspend(&self) -> bool {
+        false
+    }
+
+    /// States of an update which can still be canceled, without touching
+    /// the active installation set, should overwrite this to return true.
+    fn is_cancellable(&self) -> bool {
+        false
+    }
 }
 
 #[async_trait(?Send)]
 trait ProgressReporter: Sized + StateChangeImpl {
     fn package_uid(&self) -> String;
+    fn update_metadata(&self) -> &[u8];
     fn report_enter_state_name(&self) -> &'static str;
     fn report_leave_state_name(&self) -> &'static str;
 
+    /// Variables set in the environment of the state hooks.
+    fn hooks_environment(&self, _: &machine::SharedState) -> Result<Vec<(&'static str, String)>> {
+        Ok(Vec::default())
+    }
+
     async fn handle_and_report_progress(
         self,
         shared_state: &mut machine::SharedState,
@@ -115,38 +260,70 @@ trait ProgressReporter: Sized + StateChangeImpl {
         let server = shared_state.server_address().to_owned();
         let firmware = &shared_state.firmware.clone();
         let package_uid = &self.package_uid();
+        let name = self.name();
         let enter_state = self.report_enter_state_name();
         let leave_state = self.report_leave_state_name();
-        let api = crate::CloudClient::new(&server);
+        let package_server = match shared_state.settings.network.fallback_servers.is_empty() {
+            true => None,
+            false => Some(server.clone()),
+        };
+        let api =
+            &crate::CloudClient::new(&server)
+                .with_update_chain(shared_state.runtime_settings.update_chain().map(|chain| {
+                    cloud::api::UpdateChain { step: chain.step, length: chain.length }
+                }))
+                .with_package_server(package_server.as_deref());
+        let retry = &shared_state.settings.retry.clone();
 
-        let report = |state, previous_state, error_message, current_log| {
-            api.report(
-                state,
-                firmware.as_cloud_metadata(),
-                package_uid,
-                previous_state,
-                error_message,
-                current_log,
-            )
+        let report = |state, previous_state| {
+            utils::retry::with_backoff(retry, move || {
+                api.report(
+                    state,
+                    firmware.as_cloud_metadata(),
+                    package_uid,
+                    previous_state,
+                    None,
+                    None,
+                    utils::resource_usage::current(),
+                )
+            })
         };
 
-        if let Err(e) = report(enter_state, None, None, None).await {
+        if let Err(e) = report(enter_state, None).await {
             warn!("report failed: {}", e);
         }
         match self.handle(shared_state).await {
+            // A paused download, or an install interrupted as the agent
+            // is stopped, is yet to complete, so it isn't reported as left.
+            Ok((state @ State::DownloadPaused(_), trans))
+            | Ok((state @ State::Install(_), trans)) => Ok((state, trans)),
             Ok((state, trans)) => {
-                if let Err(e) = report(leave_state, None, None, None).await {
+                if let Err(e) = report(leave_state, None).await {
                     warn!("report failed: {}", e);
                 };
                 Ok((state, trans))
             }
+            Err(TransitionError::Canceled) => {
+                if let Err(e) = report("canceled", Some(enter_state)).await {
+                    warn!("report failed: {}", e);
+                }
+                Err(TransitionError::Canceled)
+            }
             Err(e) => {
-                if let Err(e) = report(
-                    "error",
-                    Some(enter_state),
-                    Some(e.to_string()),
-                    Some(crate::logger::get_memory_log()),
-                )
+                let current_log = crate::logger::get_memory_log();
+                let details = error_details(shared_state, name, &e, &current_log);
+                let error_message = e.to_string();
+                if let Err(e) = utils::retry::with_backoff(retry, || {
+                    api.report_error(
+                        firmware.as_cloud_metadata(),
+                        package_uid,
+                        enter_state,
+                        error_message.clone(),
+                        Some(current_log.clone()),
+                        utils::resource_usage::current(),
+                        &details,
+                    )
+                })
                 .await
                 {
                     warn!("report failed: {}", e);
@@ -164,7 +341,24 @@ trait ProgressReporter: Sized + StateChangeImpl {
             firmware::state_change_callback(&shared_state.settings.firmware.metadata, self.name())?;
 
         match transition {
-            Transition::Continue => Ok(self.handle_and_report_progress(shared_state).await?),
+            Transition::Continue => {
+                shared_state.runtime_settings.set_transaction_state(self.name())?;
+                let hooks = shared_state.settings.hooks.clone();
+                let (name, metadata) = (self.name(), self.update_metadata().to_vec());
+                let env = self.hooks_environment(shared_state)?;
+                utils::hooks::run(&hooks, name, utils::hooks::Phase::Pre, &metadata, &env)?;
+
+                let (state, transition) = self.handle_and_report_progress(shared_state).await?;
+                // A paused download, or an interrupted install, runs its
+                // hooks again once resumed.
+                match state {
+                    State::DownloadPaused(_) | State::Install(_) => return Ok((state, transition)),
+                    _ => {}
+                }
+                utils::hooks::run(&hooks, name, utils::hooks::Phase::Post, &metadata, &env)?;
+
+                Ok((state, transition))
+            }
             Transition::Cancel => {
                 Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate))
             }
@@ -172,44 +366,257 @@ trait ProgressReporter: Sized + StateChangeImpl {
     }
 }
 
+/// Reports the update as canceled from states which don't report their
+/// progress, failing the transition so the update is dropped.
+async fn cancel_update(
+    shared_state: &machine::SharedState,
+    package_uid: &str,
+    state: &str,
+) -> Result<(State, machine::StepTransition)> {
+    let server = shared_state.server_address().to_owned();
+    if let Err(e) = crate::CloudClient::new(&server)
+        .report(
+            "canceled",
+            shared_state.firmware.as_cloud_metadata(),
+            package_uid,
+            Some(state),
+            None,
+            None,
+            utils::resource_usage::current(),
+        )
+        .await
+    {
+        warn!("report failed: {}", e);
+    }
+
+    Err(TransitionError::Canceled)
+}
+
+/// Probes the server for a newer package while the downloaded one awaits
+/// to be installed, when the policy is to replace it. The stale package is
+/// reported as superseded, so both of them show up in the update history.
+async fn check_superseded(
+    shared_state: &mut machine::SharedState,
+    update_package: &crate::update_package::UpdatePackage,
+    state: &str,
+) -> Option<State> {
+    use crate::update_package::UpdatePackageExt;
+
+    superseding_interval(&shared_state.settings)?;
+    let server = shared_state.server_address().to_owned();
+    let probe = crate::CloudClient::new(&server)
+        .with_delta_bases(utils::delta::installed_objects(&shared_state.settings.delta))
+        .probe(
+            shared_state.runtime_settings.retries() as u64,
+            shared_state.firmware.as_cloud_metadata(),
+        )
+        .await;
+    let (package, sign) = match probe {
+        Ok(cloud::api::ProbeResponse::Update(package, sign)) => (package, sign),
+        Ok(_) => return None,
+        Err(e) => {
+            warn!("failed to probe for a newer update: {}", e);
+            return None;
+        }
+    };
+
+    let package_uid = update_package.package_uid();
+    if package.package_uid() == package_uid {
+        return None;
+    }
+
+    info!("update {} superseded by {}", package_uid, package.package_uid());
+    if let Err(e) = crate::CloudClient::new(&server)
+        .report(
+            "superseded",
+            shared_state.firmware.as_cloud_metadata(),
+            &package_uid,
+            Some(state),
+            None,
+            None,
+            None,
+        )
+        .await
+    {
+        warn!("report failed: {}", e);
+    }
+    if let Err(e) = shared_state.runtime_settings.end_transaction() {
+        error!("failed to drop the update transaction: {}", e);
+    }
+
+    // The stale objects are removed once the newer package is downloaded.
+    Some(State::Validation(Validation { package, sign }))
+}
+
+/// How often the server is probed for a newer package while the
+/// downloaded one awaits to be installed, if it is to be replaced by it.
+fn superseding_interval(settings: &Settings) -> Option<std::time::Duration> {
+    use sdk::api::info::settings::SupersedePolicy;
+
+    match settings.update.supersede_policy {
+        SupersedePolicy::Finish => None,
+        SupersedePolicy::Replace => settings.polling.interval.to_std().ok(),
+    }
+}
+
+/// Whether the object is written to its target as it is downloaded,
+/// instead of being downloaded first. The objects of encrypted packages
+/// are decrypted from the download directory, and the privileged
+/// installer only takes the objects found there, so those are always
+/// downloaded.
+fn is_streamed(settings: &Settings, encrypted: bool, obj: &pkg_schema::Object) -> bool {
+    settings.download.streaming
+        && !encrypted
+        && !utils::privsep::is_separated()
+        && object::is_streamable(obj)
+}
+
+/// Counts a new attempt of resuming the update left by a previous run,
+/// if any. As the update itself may be what makes the agent crash, it is
+/// dropped once it has been resumed too many times without completing,
+/// and the install it has left is reverted.
+fn count_resume_attempt(runtime_settings: &mut RuntimeSettings) -> Result<()> {
+    match runtime_settings.count_transaction_attempt()? {
+        Some(attempts) if attempts > MAX_RESUME_ATTEMPTS => {
+            error!(
+                "update has been resumed {} times without completing, dropping it",
+                MAX_RESUME_ATTEMPTS
+            );
+            runtime_settings.end_transaction()?;
+        }
+        _ => {}
+    }
+    Ok(())
+}
+
+/// Resumes the update left by a previous run, interrupted by a crash or
+/// a power loss. It is validated again and the objects already downloaded
+/// are kept, while the installation starts over, as the inactive
+/// installation set may be in any state.
+fn resume_transaction(runtime_settings: &mut RuntimeSettings) -> State {
+    let transaction = match runtime_settings.transaction() {
+        Some(transaction) => transaction.clone(),
+        None => return State::new(),
+    };
+
+    info!(
+        "resuming update interrupted on {} state, with {} objects installed (attempt {} of {})",
+        transaction.state,
+        transaction.installed_objects.len(),
+        transaction.attempts,
+        MAX_RESUME_ATTEMPTS
+    );
+    let update =
+        cloud::api::UpdatePackage::parse(transaction.package.as_bytes()).and_then(|package| {
+            let sign = transaction.signature.as_deref().map(cloud::api::Signature::from_base64_str);
+            Ok((package, sign.transpose()?))
+        });
+    match update {
+        Ok((package, sign)) => State::Validation(Validation { package, sign }),
+        Err(e) => {
+            warn!("failed to resume the update: {}", e);
+            if let Err(e) = runtime_settings.end_transaction() {
+                error!("failed to drop the update: {}", e);
+            }
+            State::new()
+        }
+    }
+}
+
 #[derive(Debug, PartialEq)]
 enum State {
     Park(Park),
+    AwaitBootConfirmation(AwaitBootConfirmation),
     EntryPoint(EntryPoint),
     Poll(Poll),
     Probe(Probe),
     Validation(Validation),
     PrepareDownload(PrepareDownload),
     Download(Download),
+    DownloadPaused(DownloadPaused),
+    AwaitNetwork(AwaitNetwork),
+    AwaitApproval(AwaitApproval),
+    AwaitGoAhead(AwaitGoAhead),
+    AwaitMaintenanceWindow(AwaitMaintenanceWindow),
+    AwaitPower(AwaitPower),
     Install(Install),
+    AwaitRebootLock(AwaitRebootLock),
+    AwaitReboot(AwaitReboot),
     Reboot(Reboot),
     DirectDownload(DirectDownload),
     PrepareLocalInstall(PrepareLocalInstall),
     Error(Error),
 }
 
+// Returns whether the installation booted into is still to be
+// confirmed.
 fn handle_startup_callbacks(
     settings: &Settings,
     runtime_settings: &mut RuntimeSettings,
-) -> crate::Result<()> {
+) -> crate::Result<bool> {
     if let Some(expected_set) = runtime_settings.update.upgrade_to_installation {
         info!("booting from a recent installation");
+        let package_uid = runtime_settings.applied_package_uid();
+        let max_failed_activations = settings.boot_confirmation.max_failed_activations;
+        let mut failure_counted = false;
         if expected_set == firmware::installation_set::active()?.0 {
             match firmware::validate_callback(&settings.firmware.metadata)? {
                 Transition::Cancel => {
                     warn!("validate callback has failed");
+                    runtime_settings.add_activation_failure(
+                        firmware::installation_set::Set(expected_set),
+                        package_uid.clone(),
+                        max_failed_activations,
+                    )?;
+                    failure_counted = true;
                     firmware::installation_set::swap_active()?;
                     warn!("swapped active installation set and running rollback");
                     firmware::rollback_callback(&settings.firmware.metadata)?;
+                    runtime_settings.set_update_result(
+                        UpdateOutcome::RolledBack,
+                        runtime_settings.applied_package_uid(),
+                        None,
+                    )?;
+                    runtime_settings.finish_update_chain_step(false)?;
                     runtime_settings.reset_installation_settings()?;
-                    easy_process::run("reboot")?;
+                    easy_process::run(&utils::privsep::reboot_command(settings))?;
+                }
+                Transition::Continue if settings.boot_confirmation.enabled => {
+                    info!("waiting for the installation to be confirmed");
+                    return Ok(true);
                 }
                 Transition::Continue => firmware::installation_set::validate()?,
             }
         }
+        // Booting into the previous installation set means the bootloader
+        // has rolled the update back.
+        let booted = expected_set == firmware::installation_set::active()?.0;
+        if booted {
+            if let Some(package) = runtime_settings.commit_security_version()? {
+                utils::privsep::store_security_version(settings, &package)?;
+            }
+        }
+        if !booted && !failure_counted {
+            runtime_settings.add_activation_failure(
+                firmware::installation_set::Set(expected_set),
+                package_uid,
+                max_failed_activations,
+            )?;
+        }
+        runtime_settings.set_update_result(
+            if booted { UpdateOutcome::Installed } else { UpdateOutcome::RolledBack },
+            runtime_settings.applied_package_uid(),
+            None,
+        )?;
+        runtime_settings.finish_update_chain_step(booted)?;
         runtime_settings.reset_installation_settings()?;
+        // The node being left cordoned must not keep the agent from
+        // starting, as it would never be uncordoned otherwise.
+        if let Err(e) = utils::kubernetes::uncordon(&settings.kubernetes) {
+            error!("failed to uncordon the kubernetes node: {}", e);
+        }
     }
-    Ok(())
+    Ok(false)
 }
 
 #[async_trait(?Send)]
@@ -232,6 +639,14 @@ impl StateChangeImpl for State {
     fn is_preemptive_state(&self) -> bool {
         self.inner_state().is_handling_download()
     }
+
+    fn is_inhibiting_suspend(&self) -> bool {
+        self.inner_state().is_inhibiting_suspend()
+    }
+
+    fn is_cancellable(&self) -> bool {
+        self.inner_state().is_cancellable()
+    }
 }
 
 impl State {
@@ -246,6 +661,7 @@ impl State {
         match self {
             State::Error(s) => s.handle(shared_state).await,
             State::Park(s) => s.handle(shared_state).await,
+            State::AwaitBootConfirmation(s) => s.handle(shared_state).await,
             State::EntryPoint(s) => s.handle(shared_state).await,
             State::Poll(s) => s.handle(shared_state).await,
             State::Probe(s) => s.handle(shared_state).await,
@@ -253,7 +669,15 @@ impl State {
             State::PrepareDownload(s) => s.handle(shared_state).await,
             State::DirectDownload(s) => s.handle(shared_state).await,
             State::PrepareLocalInstall(s) => s.handle(shared_state).await,
+            State::AwaitNetwork(s) => s.handle(shared_state).await,
+            State::AwaitApproval(s) => s.handle(shared_state).await,
+            State::AwaitGoAhead(s) => s.handle(shared_state).await,
+            State::AwaitMaintenanceWindow(s) => s.handle(shared_state).await,
+            State::AwaitPower(s) => s.handle(shared_state).await,
+            State::AwaitRebootLock(s) => s.handle(shared_state).await,
+            State::AwaitReboot(s) => s.handle(shared_state).await,
             State::Download(s) => s.handle_with_callback_and_report_progress(shared_state).await,
+            State::DownloadPaused(s) => s.handle(shared_state).await,
             State::Install(s) => s.handle_with_callback_and_report_progress(shared_state).await,
             State::Reboot(s) => s.handle_with_callback_and_report_progress(shared_state).await,
         }
@@ -263,6 +687,7 @@ impl State {
         match self {
             State::Error(s) => s,
             State::Park(s) => s,
+            State::AwaitBootConfirmation(s) => s,
             State::EntryPoint(s) => s,
             State::Poll(s) => s,
             State::Probe(s) => s,
@@ -271,12 +696,341 @@ impl State {
             State::DirectDownload(s) => s,
             State::PrepareLocalInstall(s) => s,
             State::Download(s) => s,
+            State::DownloadPaused(s) => s,
+            State::AwaitNetwork(s) => s,
+            State::AwaitApproval(s) => s,
+            State::AwaitGoAhead(s) => s,
+            State::AwaitMaintenanceWindow(s) => s,
+            State::AwaitPower(s) => s,
             State::Install(s) => s,
+            State::AwaitRebootLock(s) => s,
+            State::AwaitReboot(s) => s,
             State::Reboot(s) => s,
         }
     }
 }
 
+// Exercises the supported install modes, reporting the non-functional
+// ones so they are known before an update fails because of them.
+async fn report_self_test(
+    settings: &Settings,
+    runtime_settings: &RuntimeSettings,
+    firmware: &Metadata,
+) {
+    let failures = self_test::run(&settings.update.supported_install_modes);
+    if failures.is_empty() {
+        return;
+    }
+
+    let message = failures
+        .iter()
+        .map(|(mode, reason)| format!("{}: {}", mode, reason))
+        .collect::<Vec<_>>()
+        .join("; ");
+    let server =
+        runtime_settings.custom_server_address().unwrap_or(&settings.network.server_address);
+    if let Err(e) = crate::CloudClient::new(server)
+        .report(
+            "self-test-failed",
+            firmware.as_cloud_metadata(),
+            "",
+            None,
+            Some(message),
+            None,
+            None,
+        )
+        .await
+    {
+        warn!("report failed: {}", e);
+    }
+}
+
+// The quarantines are reported once the agent starts, as the device may
+// have been rebooted right after the failure.
+async fn report_quarantines(
+    settings: &Settings,
+    runtime_settings: &mut RuntimeSettings,
+    firmware: &Metadata,
+) {
+    let server = runtime_settings
+        .custom_server_address()
+        .unwrap_or(&settings.network.server_address)
+        .to_owned();
+    for failures in runtime_settings.unreported_quarantines() {
+        let set = firmware::installation_set::Set(failures.installation_set);
+        if let Err(e) = crate::CloudClient::new(&server)
+            .report(
+                "quarantined",
+                firmware.as_cloud_metadata(),
+                failures.package_uid.as_deref().unwrap_or_default(),
+                None,
+                Some(format!(
+                    "installation set {} quarantined after {} failed activations",
+                    set, failures.count
+                )),
+                None,
+                None,
+            )
+            .await
+        {
+            warn!("report failed: {}", e);
+            continue;
+        }
+        if let Err(e) = runtime_settings.set_quarantine_reported(set) {
+            warn!("failed to record the quarantine as reported: {}", e);
+        }
+    }
+}
+
+// Resolves the address to listen at. The IPv6 wildcard address also
+// accepts the IPv4 connections, but the IPv4 one is taken instead when the
+// kernel has no IPv6 support.
+fn listen_addrs(listen_socket: &str) -> std::io::Result<Vec<std::net::SocketAddr>> {
+    use std::net::{Ipv4Addr, SocketAddr, TcpListener, ToSocketAddrs};
+
+    let addrs = listen_socket.to_socket_addrs()?;
+    Ok(addrs
+        .map(|addr| match addr {
+            SocketAddr::V6(v6)
+                if v6.ip().is_unspecified() && TcpListener::bind("[::]:0").is_err() =>
+            {
+                SocketAddr::from((Ipv4Addr::UNSPECIFIED, v6.port()))
+            }
+            addr => addr,
+        })
+        .collect())
+}
+
+// Serves the downloaded objects to the LAN peers, advertising it while
+// the returned advertiser is held.
+fn start_mirror(settings: &Settings) -> crate::Result<Option<mirror::Advertiser>> {
+    let download_dir = settings.update.download_dir.clone();
+    let listen_socket = settings.mirror.listen_socket.clone();
+    let server = actix_web::HttpServer::new(move || {
+        actix_web::App::new().configure(|cfg| mirror::Mirror::configure(cfg, download_dir.clone()))
+    })
+    .bind(&listen_addrs(&listen_socket)?[..])?;
+
+    let port = server.addrs().first().map(std::net::SocketAddr::port).unwrap_or_default();
+    actix_rt::spawn(async move {
+        if let Err(e) = server.run().await {
+            error!("objects mirror has stopped: {}", e);
+        }
+    });
+
+    match mirror::Advertiser::start(port) {
+        Ok(advertiser) => Ok(Some(advertiser)),
+        Err(e) => {
+            error!("failed to advertise objects mirror: {}", e);
+            Ok(None)
+        }
+    }
+}
+
+// Serves the server API to the LAN devices which have no access to the
+// server.
+fn start_gateway(settings: &Settings) -> crate::Result<()> {
+    let gateway = gateway::Gateway::new(
+        settings.network.server_address.clone(),
+        settings.gateway.cache_dir.clone(),
+    );
+    std::fs::create_dir_all(&settings.gateway.cache_dir)?;
+    let server = actix_web::HttpServer::new(move || {
+        actix_web::App::new().configure(|cfg| gateway::Gateway::configure(cfg, gateway.clone()))
+    })
+    .bind(&listen_addrs(&settings.gateway.listen_socket)?[..])?;
+
+    info!("serving as gateway on {}", settings.gateway.listen_socket);
+    actix_rt::spawn(async move {
+        if let Err(e) = server.run().await {
+            error!("gateway has stopped: {}", e);
+        }
+    });
+    Ok(())
+}
+
+// Reloads the configuration file on SIGHUP, as sent by `systemctl reload`.
+async fn reload_on_hangup(addr: machine::Addr) {
+    use actix_rt::signal::unix::{signal, SignalKind};
+
+    let mut hangups = match signal(SignalKind::hangup()) {
+        Ok(hangups) => hangups,
+        Err(e) => {
+            error!("failed to handle SIGHUP: {}", e);
+            return;
+        }
+    };
+    while hangups.recv().await.is_some() {
+        info!("reloading the configuration on SIGHUP");
+        match addr.request_reload_config().await {
+            Ok(response) if !response.restart_required.is_empty() => warn!(
+                "restart the agent to apply the changed settings: {}",
+                response.restart_required.join(", ")
+            ),
+            Ok(_) => {}
+            Err(e) => error!("failed to reload the configuration: {}", e),
+        }
+    }
+}
+
+// Stops the agent on SIGTERM or SIGINT, as sent by `systemctl stop` when
+// the agent is upgraded or the device rebooted. The update in progress is
+// given the `grace_period` to reach a point it can be resumed from, the
+// object being installed being finished and the download paused.
+async fn stop_on_signal(
+    addr: machine::Addr,
+    machine_stopped: async_std::sync::Receiver<()>,
+    server: actix_web::dev::Server,
+    grace_period: std::time::Duration,
+) {
+    use actix_rt::signal::unix::{signal, SignalKind};
+
+    let (mut terminations, mut interruptions) =
+        match (signal(SignalKind::terminate()), signal(SignalKind::interrupt())) {
+            (Ok(terminations), Ok(interruptions)) => (terminations, interruptions),
+            (Err(e), _) | (_, Err(e)) => {
+                error!("failed to handle SIGTERM and SIGINT: {}", e);
+                return;
+            }
+        };
+    async {
+        terminations.recv().await;
+    }
+    .race(async {
+        interruptions.recv().await;
+    })
+    .await;
+
+    info!("stopping, the update in progress is given {:?} to be checkpointed", grace_period);
+    addr.request_shutdown().await;
+    let checkpointed = async { machine_stopped.recv().await.is_ok() }
+        .race(async {
+            utils::boottime::sleep(grace_period).await;
+            false
+        })
+        .await;
+    if !checkpointed {
+        warn!("the update in progress hasn't been checkpointed within {:?}", grace_period);
+    }
+    server.stop(true).await;
+}
+
+/// Installs the local `update_file` without the agent running, as from
+/// removable media or at the factory, going through the same checks and
+/// install as the agent does. The device is only rebooted into the new
+/// installation when `reboot` is set.
+pub async fn install(config: &Path, update_file: &Path, reboot: bool) -> crate::Result<()> {
+    crate::logger::start_memory_logging();
+    let settings = Settings::load(config)?;
+    crate::logger::configure(&settings.log);
+    utils::container::check_environment(&settings.container)?;
+    if settings.simulation.enabled {
+        crate::simulation::prepare(&settings.simulation)?;
+    }
+    let mut runtime_settings = RuntimeSettings::load(&settings.storage.runtime_settings)?;
+    if !settings.storage.read_only {
+        runtime_settings.enable_persistency();
+    }
+    utils::uboot_env::configure(&settings.firmware);
+    utils::verification::set_kernel_hashing(settings.update.kernel_hashing);
+    utils::audit_trail::configure(&settings.audit_trail);
+    utils::anti_rollback::load(&settings.anti_rollback, &mut runtime_settings)?;
+    firmware::configure_hooks(&settings.firmware);
+    firmware::installation_set::configure(&settings.active_inactive);
+    let mut firmware = firmware_metadata(&settings)?;
+    firmware.device_attributes =
+        firmware::device_attributes(&settings.firmware.metadata, &settings.device_attributes);
+    firmware.channel = settings.update.channel.clone();
+    configure_key_storage(&settings.key_storage, &mut firmware)?;
+    configure_tls(&settings.tls)?;
+    configure_proxy(&settings.network)?;
+
+    let state =
+        State::PrepareLocalInstall(PrepareLocalInstall { update_file: update_file.to_owned() });
+    let machine =
+        machine::StateMachine::new(state, settings, runtime_settings, firmware, config.to_owned());
+    let events = machine.address().events();
+    actix_rt::spawn(async move {
+        while let Ok(event) = events.recv().await {
+            if let sdk::api::events::Event::Progress { progress } = event {
+                info!(
+                    "{:?} {} ({}/{}): {}%",
+                    progress.stage,
+                    progress.object,
+                    progress.index + 1,
+                    progress.count,
+                    progress.percentage
+                );
+            }
+        }
+    });
+
+    match machine.run_update(reboot).await {
+        Some(e) => Err(crate::Error::UpdateFailed(e)),
+        None => Ok(()),
+    }
+}
+
+// The simulated device takes its metadata from the settings instead of
+// the metadata hooks.
+fn firmware_metadata(settings: &Settings) -> firmware::Result<Metadata> {
+    if settings.simulation.enabled {
+        return Metadata::simulated(&settings.simulation, &settings.firmware.metadata);
+    }
+    Metadata::from_path(&settings.firmware.metadata)
+}
+
+// The proxy URL may hold its credentials, so it may refer to a secret
+// holding it instead.
+fn configure_proxy(network: &sdk::api::info::settings::Network) -> crate::Result<()> {
+    let proxy = network.proxy.as_deref().map(utils::secret::resolve).transpose()?;
+    cloud::configure_proxy(proxy.as_deref(), &network.no_proxy)?;
+    Ok(())
+}
+
+// The keys kept in tokens are loaded along with the TLS connector and
+// the package verification, so the PIN is set before them.
+fn configure_key_storage(
+    key_storage: &sdk::api::info::settings::KeyStorage,
+    firmware: &mut Metadata,
+) -> crate::Result<()> {
+    let pin = key_storage.pin.as_deref().map(utils::secret::resolve).transpose()?;
+    cloud::configure_token_pin(pin);
+    if let Some(ref trust_anchor) = key_storage.trust_anchor {
+        info!("verifying update packages with the key kept in token: {}", trust_anchor);
+        firmware.pub_key = Some(trust_anchor.into());
+    }
+    Ok(())
+}
+
+fn configure_tls(tls: &sdk::api::info::settings::Tls) -> crate::Result<()> {
+    if tls.ca_bundle.is_some()
+        || tls.client_certificate.is_some()
+        || !tls.pinned_public_keys.is_empty()
+        || tls.crl_file.is_some()
+        || tls.require_ocsp_stapling
+    {
+        let key = match (&tls.client_certificate, &tls.client_key) {
+            (Some(_), Some(key)) => key.clone(),
+            (Some(certificate), None) => certificate.to_string_lossy().into_owned(),
+            (None, _) => String::default(),
+        };
+        let identity = tls.client_certificate.as_deref().map(|c| (c, key.as_str()));
+        let revocation = cloud::Revocation {
+            crl_file: tls.crl_file.clone(),
+            require_ocsp_stapling: tls.require_ocsp_stapling,
+        };
+        cloud::configure_tls(
+            tls.ca_bundle.as_deref(),
+            identity,
+            &tls.pinned_public_keys,
+            &revocation,
+        )?;
+    }
+
+    Ok(())
+}
+
 /// Runs the state machine up to completion handling all procing
 /// states without extra manual work.
 ///
@@ -308,31 +1062,210 @@ impl State {
 /// # Ok(())
 /// # }
 /// ```
-pub async fn run(settings: &Path) -> crate::Result<()> {
+pub async fn run(config: &Path) -> crate::Result<()> {
     crate::logger::start_memory_logging();
-    let settings = Settings::load(settings)?;
-    let listen_socket = settings.network.listen_socket.clone();
+    if let Err(e) = utils::agent_update::check_pending() {
+        warn!("unable to check the updated agent: {}", e);
+    }
+    let mut settings = Settings::load(config)?;
+    utils::agent_update::watch_health(
+        settings.update.agent_health_timeout.to_std().unwrap_or_default(),
+    );
     let mut runtime_settings = RuntimeSettings::load(&settings.storage.runtime_settings)?;
     if !settings.storage.read_only {
         runtime_settings.enable_persistency();
     }
-    let firmware = Metadata::from_path(&settings.firmware.metadata)?;
+    for (key, value) in runtime_settings.settings.iter() {
+        if let Err(e) = settings.set(key, value) {
+            warn!("ignoring the {} setting changed through the agent api: {}", key, e);
+        }
+    }
+    crate::logger::configure(&settings.log);
+    utils::container::check_environment(&settings.container)?;
+    if settings.simulation.enabled {
+        crate::simulation::prepare(&settings.simulation)?;
+    }
+    utils::uboot_env::configure(&settings.firmware);
+    utils::verification::set_kernel_hashing(settings.update.kernel_hashing);
+    utils::audit_trail::configure(&settings.audit_trail);
+    utils::anti_rollback::load(&settings.anti_rollback, &mut runtime_settings)?;
+    let listen_socket = settings.network.listen_socket.clone();
+    let mut local_api = settings.local_api.clone();
+    local_api.auth_token =
+        local_api.auth_token.as_deref().map(utils::secret::resolve).transpose()?;
+    firmware::configure_hooks(&settings.firmware);
+    firmware::installation_set::configure(&settings.active_inactive);
+    let mut firmware = firmware_metadata(&settings)?;
+    firmware.device_attributes =
+        firmware::device_attributes(&settings.firmware.metadata, &settings.device_attributes);
+    firmware.channel = settings.update.channel.clone();
+    configure_key_storage(&settings.key_storage, &mut firmware)?;
+    configure_tls(&settings.tls)?;
+    configure_proxy(&settings.network)?;
+
+    // The device left for the application to reboot into the update
+    // hasn't booted into it yet when only the agent has been restarted.
+    let awaiting_reboot = utils::boottime::boot_id()
+        .map_or(false, |boot_id| runtime_settings.is_reboot_required(&boot_id));
+    let booting_from_update =
+        !awaiting_reboot && runtime_settings.update.upgrade_to_installation.is_some();
+    let awaiting_confirmation = if awaiting_reboot {
+        false
+    } else {
+        match handle_startup_callbacks(&settings, &mut runtime_settings) {
+            Ok(awaiting_confirmation) => awaiting_confirmation,
+            Err(e) => {
+                error!("Failed to handle startup callbacks: {}", e);
+                false
+            }
+        }
+    };
+
+    if let Err(e) = count_resume_attempt(&mut runtime_settings) {
+        error!("Failed to count the resume attempt of the update: {}", e);
+    }
+
+    // The targets partially written by an install interrupted by a power
+    // loss are restored. The ones completely written are only kept when
+    // the install is going to be resumed, which skips them.
+    let resumed = match (runtime_settings.transaction(), runtime_settings.journal()) {
+        (Some(transaction), Some(journal)) => transaction.package == journal.package,
+        _ => false,
+    };
+    if let Err(e) = install::revert_journal(&settings, &mut runtime_settings, resumed) {
+        error!("Failed to revert the interrupted install: {}", e);
+    }
+    if let Err(e) = install::remove_decrypted_objects(&settings.update.download_dir) {
+        error!("Failed to remove the objects left decrypted: {}", e);
+    }
+
+    // The objects staged for the read-only targets are applied once the
+    // install they are part of has finished, and the device rebooted.
+    if runtime_settings.journal().is_none() {
+        if let Err(e) = utils::read_only::apply_pending(&settings.update.pending_dir) {
+            error!("Failed to apply the pending objects: {}", e);
+        }
+    }
+
+    // Nothing facing the network has run so far.
+    if settings.privilege_separation.enabled {
+        utils::privsep::start(&settings.privilege_separation, config)?;
+    }
+
+    if booting_from_update {
+        if let Some(ref url) = settings.cluster.lock_url {
+            info!("releasing reboot lock");
+            if let Err(e) = cloud::release_lock(url, firmware.as_cloud_metadata()).await {
+                error!("Failed to release reboot lock: {}", e);
+            }
+        }
+    }
 
-    if let Err(e) = handle_startup_callbacks(&settings, &mut runtime_settings) {
-        error!("Failed to handle startup callbacks: {}", e);
+    if settings.self_test.enabled {
+        report_self_test(&settings, &runtime_settings, &firmware).await;
     }
+    report_quarantines(&settings, &mut runtime_settings, &firmware).await;
 
-    let machine = machine::StateMachine::new(State::new(), settings, runtime_settings, firmware);
+    // The advertisement lasts for as long as the agent runs.
+    let _advertiser = if settings.mirror.serve { start_mirror(&settings)? } else { None };
+    if settings.gateway.serve {
+        start_gateway(&settings)?;
+    }
+
+    let state = if awaiting_reboot {
+        info!("awaiting the application to reboot the device into the update");
+        State::AwaitReboot(AwaitReboot { update_package: None })
+    } else if awaiting_confirmation {
+        // The deadline is kept across the agent restarts, so they don't
+        // give the installation more time to be confirmed.
+        let remaining =
+            runtime_settings.confirmation_remaining(settings.boot_confirmation.timeout)?;
+        let remaining = remaining.to_std().unwrap_or_default();
+        State::AwaitBootConfirmation(AwaitBootConfirmation {
+            deadline: std::time::Instant::now() + remaining,
+            health: utils::health_check::Report::default(),
+        })
+    } else {
+        resume_transaction(&mut runtime_settings)
+    };
+    let grace_period = settings.update.shutdown_grace_period.to_std().unwrap_or_default();
+    let job_bridge = settings.job_bridge.clone();
+    let push = settings.push.clone();
+    let removable_media = settings.removable_media.clone();
+    let dbus = settings.dbus.clone();
+    // Brokers reject the clients connected with an id already in use, so
+    // it is unique to the device.
+    let push_client_id = format!(
+        "updatehub-{}",
+        &utils::sha256sum(format!("{:?}", firmware.device_identity).as_bytes())[..13]
+    );
+    let machine =
+        machine::StateMachine::new(state, settings, runtime_settings, firmware, config.to_owned());
     let addr = machine.address();
-    actix_rt::spawn(machine.start());
+    let (stopped, machine_stopped) = async_std::sync::channel(1);
+    actix_rt::spawn(async move {
+        machine.start().await;
+        stopped.send(()).await;
+    });
+    actix_rt::spawn(reload_on_hangup(addr.clone()));
+    if let Some(interval) = utils::systemd::watchdog_interval() {
+        actix_rt::spawn(utils::systemd::watchdog(interval));
+    }
 
-    actix_web::HttpServer::new(move || {
-        actix_web::App::new().configure(|cfg| http_api::API::configure(cfg, addr.clone()))
-    })
-    .bind(listen_socket.clone())
-    .unwrap_or_else(|_| panic!("Failed to bind listen socket, {:?}, for HTTP API", listen_socket,))
-    .run()
-    .await?;
+    if job_bridge.provider.is_some() {
+        actix_rt::spawn(crate::job_bridge::run(job_bridge, addr.clone()));
+    }
+
+    if push.broker.is_some() {
+        actix_rt::spawn(crate::push::run(push, push_client_id, addr.clone()));
+    }
+
+    if !removable_media.mount_points.is_empty() {
+        actix_rt::spawn(crate::removable_media::run(removable_media, addr.clone()));
+    }
+
+    if dbus.enabled {
+        actix_rt::spawn(crate::dbus::run(dbus, addr.clone()));
+    }
+
+    let unix_socket = local_api.unix_socket.clone();
+    let unix_socket_mode = local_api.unix_socket_mode;
+    let unix_socket_only = local_api.unix_socket_only;
+    // The jobs are shared by the server workers, so they are run in the
+    // order they were submitted, whichever worker has received them.
+    let jobs = crate::job_queue::JobQueue::start(addr.clone());
+    let shutdown_addr = addr.clone();
+    // The signals are handled by ourselves, so the agent isn't stopped
+    // before the update in progress is.
+    let mut server = actix_web::HttpServer::new(move || {
+        actix_web::App::new()
+            .configure(|cfg| http_api::API::configure(cfg, addr.clone(), jobs.clone(), &local_api))
+    });
+    if !unix_socket_only {
+        let addrs = listen_addrs(&listen_socket);
+        server = addrs.and_then(|addrs| server.bind(&addrs[..])).unwrap_or_else(|_| {
+            panic!("Failed to bind listen socket, {:?}, for HTTP API", listen_socket,)
+        });
+    }
+    if let Some(path) = unix_socket {
+        use std::os::unix::fs::PermissionsExt;
+
+        // The socket left behind by a previous run would make the bind
+        // fail.
+        if path.exists() {
+            std::fs::remove_file(&path)?;
+        }
+        server = server.bind_uds(&path)?;
+        if let Some(mode) = unix_socket_mode {
+            std::fs::set_permissions(&path, std::fs::Permissions::from_mode(mode))?;
+        }
+        info!("serving the agent API on {:?}", path);
+    }
+    let server = server.disable_signals().run();
+    actix_rt::spawn(stop_on_signal(shutdown_addr, machine_stopped, server.clone(), grace_period));
+    utils::systemd::ready();
+    utils::agent_update::confirm();
+    server.await?;
 
     info!("actix System has stopped");
     Ok(())
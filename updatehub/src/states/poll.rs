@@ -6,8 +6,9 @@ use super::{
     machine::{self, SharedState},
     Probe, Result, State, StateChangeImpl,
 };
-use chrono::Utc;
-use slog_scope::{debug, info};
+use crate::utils;
+use chrono::{Duration, Utc};
+use slog_scope::{debug, info, warn};
 
 #[derive(Debug, PartialEq)]
 pub(super) struct Poll {}
@@ -31,24 +32,52 @@ impl StateChangeImpl for Poll {
     ) -> Result<(State, machine::StepTransition)> {
         crate::logger::start_memory_logging();
 
-        let interval = shared_state.settings.polling.interval;
-        let delay = interval
-            - Utc::now().signed_duration_since(shared_state.runtime_settings.last_polling());
+        let polling = &shared_state.settings.polling;
+        let interval =
+            jittered(polling.interval, polling.jitter_percentage, utils::retry::random_factor());
+        let delay = interval - shared_state.runtime_settings.since_last_polling(Utc::now());
 
+        // The last polling seeming to be in the future means the wall
+        // clock has been stepped back since, with no way to tell when it
+        // has really been, so it is taken as due.
         if delay > interval || delay.num_seconds() < 0 {
             info!("forcing to Probe state as we are in time");
             return Ok((State::Probe(Probe {}), machine::StepTransition::Immediate));
         }
 
+        // Devices powering down between duty cycles must be awake for
+        // the next probe.
+        if let Err(e) =
+            utils::rtc::schedule_wakeup(&shared_state.settings.rtc_wake, Utc::now() + delay)
+        {
+            warn!("failed to program the wake alarm: {}", e);
+        }
+
         debug!("moving to Probe state after delay.");
         Ok((State::Probe(Probe {}), machine::StepTransition::Delayed(delay.to_std().unwrap())))
     }
 }
 
+// The interval is randomly shortened or lengthened, where `factor` is a
+// value from -1 to 1, so the devices of a fleet don't probe in sync.
+fn jittered(interval: Duration, percentage: u8, factor: f64) -> Duration {
+    let jitter = f64::from(percentage.min(100)) / 100.0 * factor;
+    Duration::milliseconds((interval.num_milliseconds() as f64 * (1.0 + jitter)) as i64)
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
-    use chrono::{Duration, Utc};
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn jitter_interval() {
+        let interval = Duration::hours(1);
+        assert_eq!(jittered(interval, 0, 1.0), interval);
+        assert_eq!(jittered(interval, 10, 1.0), Duration::minutes(66));
+        assert_eq!(jittered(interval, 10, -1.0), Duration::minutes(54));
+        assert_eq!(jittered(interval, 200, -1.0), Duration::zero());
+    }
 
     #[actix_rt::test]
     async fn normal_delay() {
@@ -67,6 +96,23 @@ mod tests {
         }
     }
 
+    #[actix_rt::test]
+    async fn wall_clock_stepped_since_last_probe() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.runtime_settings.set_last_polling(Utc::now()).unwrap();
+        shared_state.runtime_settings.polling.last = Utc::now() - Duration::days(365 * 50);
+
+        let (machine, trans) =
+            State::Poll(Poll {}).move_to_next_state(&mut shared_state).await.unwrap();
+
+        assert_state!(machine, Probe);
+        match trans {
+            machine::StepTransition::Delayed(_) => {}
+            _ => panic!("Unexpected StepTransition: {:?}", trans),
+        }
+    }
+
     #[actix_rt::test]
     async fn update_in_time() {
         let setup = crate::tests::TestEnvironment::build().finish();
@@ -4,14 +4,26 @@
 
 use super::{
     machine::{self, SharedState},
-    Download, Result, State, StateChangeImpl,
+    Download, Result, State, StateChangeImpl, TransitionError,
 };
 use crate::{
     firmware::installation_set,
+    mirror,
     object::{self, Info},
     update_package::{UpdatePackage, UpdatePackageExt},
+    utils,
 };
-use slog_scope::error;
+use async_std::prelude::FutureExt;
+use chrono::NaiveTime;
+use sdk::api::info::settings as api;
+use slog_scope::{error, info, warn};
+use std::{
+    fs, io,
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+const RATE_LIMIT_CHECK_INTERVAL: Duration = Duration::from_secs(60);
 
 #[derive(Debug, PartialEq)]
 pub(super) struct PrepareDownload {
@@ -28,10 +40,24 @@ impl StateChangeImpl for PrepareDownload {
         true
     }
 
+    fn is_cancellable(&self) -> bool {
+        true
+    }
+
     async fn handle(
         self,
         shared_state: &mut SharedState,
     ) -> Result<(State, machine::StepTransition)> {
+        if shared_state.update_cancel.is_requested() {
+            return super::cancel_update(
+                shared_state,
+                &self.update_package.package_uid(),
+                self.name(),
+            )
+            .await;
+        }
+
+        utils::resource_usage::start();
         let installation_set = installation_set::inactive()?;
         let download_dir = shared_state.settings.update.download_dir.to_owned();
 
@@ -41,11 +67,14 @@ impl StateChangeImpl for PrepareDownload {
             &shared_state.settings,
         )?;
 
-        // Get shasums of missing or incomplete objects
-        let shasum_list: Vec<_> = self
+        // Get shasums and sizes of missing or incomplete objects, leaving
+        // out the ones streamed to their targets on install
+        let encrypted = self.update_package.inner.encryption.is_some();
+        let object_list: Vec<_> = self
             .update_package
             .objects(installation_set)
             .iter()
+            .filter(|o| !super::is_streamed(&shared_state.settings, encrypted, o))
             .filter(|o| {
                 let obj_status = o
                     .status(&download_dir)
@@ -56,24 +85,119 @@ impl StateChangeImpl for PrepareDownload {
                 obj_status == object::info::Status::Missing
                     || obj_status == object::info::Status::Incomplete
             })
-            .map(|obj| obj.sha256sum().to_owned())
+            .map(|obj| (obj.sha256sum().to_owned(), obj.len()))
             .collect();
 
+        fs::create_dir_all(&download_dir)?;
+        check_download_space(&download_dir, &object_list, &shared_state.settings.download)?;
+
         // Get ownership of remaining data that will be sent to new thread
         let server = shared_state.server_address().to_owned();
         let product_uid = shared_state.firmware.product_uid.to_owned();
         let package_uid = self.update_package.package_uid();
+        let settings = shared_state.settings.download.clone();
+        let rate_limit =
+            cloud::RateLimit::new(rate_limit_at(&settings, chrono::Local::now().time()));
+        let delta = shared_state.settings.delta.clone();
+        let discover_mirrors = shared_state.settings.mirror.discover;
+        let retry = shared_state.settings.retry.clone();
+        let control = shared_state.download_control.clone();
         let (mut sndr, recv) = tokio::sync::mpsc::channel(1);
 
         // Download the missing or incomplete objects
+        control.start();
+        follow_rate_limit_schedule(settings.clone(), rate_limit.clone(), control.clone());
         actix_rt::spawn(async move {
-            let api = crate::CloudClient::new(&server);
+            let api = crate::CloudClient::new(&server)
+                .with_rate_limit(rate_limit.clone())
+                .with_delta_bases(utils::delta::installed_objects(&delta));
+            let mirrors = if discover_mirrors { mirror::discover() } else { Vec::default() };
             let mut results = Vec::default();
-            for shasum in shasum_list.iter() {
-                results.push(
-                    api.download_object(&product_uid, &package_uid, &download_dir, &shasum).await,
-                );
+            for (shasum, size) in object_list.iter() {
+                let res = loop {
+                    let download = async {
+                        if mirror::download_object(
+                            &mirrors,
+                            &product_uid,
+                            &package_uid,
+                            &download_dir,
+                            &shasum,
+                        )
+                        .await
+                        {
+                            return Ok(());
+                        }
+
+                        if is_segmented(*size, &settings) {
+                            return download_segmented(
+                                &server,
+                                &product_uid,
+                                &package_uid,
+                                &download_dir,
+                                &shasum,
+                                *size,
+                                &settings,
+                                &rate_limit,
+                                &control,
+                            )
+                            .await
+                            .and_then(|_| verify(&download_dir, &shasum));
+                        }
+
+                        match utils::retry::with_backoff(&retry, || {
+                            api.download_object(&product_uid, &package_uid, &download_dir, &shasum)
+                        })
+                        .await
+                        {
+                            Ok(cloud::api::ObjectDownload::Delta { base }) => {
+                                match utils::delta::apply(&delta, &download_dir, &shasum, &base) {
+                                    Ok(()) => verify(&download_dir, &shasum),
+                                    Err(e) => {
+                                        warn!(
+                                            "fail applying delta, downloading whole object: {}",
+                                            e
+                                        );
+                                        match crate::CloudClient::new(&server)
+                                            .with_rate_limit(rate_limit.clone())
+                                            .download_object(
+                                                &product_uid,
+                                                &package_uid,
+                                                &download_dir,
+                                                &shasum,
+                                            )
+                                            .await
+                                        {
+                                            Ok(cloud::api::ObjectDownload::Verified) => Ok(()),
+                                            Ok(_) => verify(&download_dir, &shasum),
+                                            Err(e) => Err(e),
+                                        }
+                                    }
+                                }
+                            }
+                            Ok(cloud::api::ObjectDownload::Verified) => Ok(()),
+                            Ok(cloud::api::ObjectDownload::Full) => verify(&download_dir, &shasum),
+                            Err(e) => Err(e),
+                        }
+                    };
+
+                    // Pausing drops the object download, keeping what was
+                    // written so far, which is resumed from where it stopped.
+                    let interrupted = async {
+                        control.interrupted().await;
+                        None
+                    };
+                    match async { Some(download.await) }.race(interrupted).await {
+                        Some(res) => break res,
+                        None if control.resumed().await => info!("resuming download of {}", shasum),
+                        None => {
+                            info!("download cancelled");
+                            return;
+                        }
+                    }
+                };
+                results.push(res);
             }
+            control.finish();
             sndr.send(results).await.expect("unable to send response about object downlod");
         });
 
@@ -87,3 +211,348 @@ impl StateChangeImpl for PrepareDownload {
         ))
     }
 }
+
+// Objects not verified while downloaded, as the ones rebuilt from a
+// delta or from segments, are hashed once complete.
+fn verify(download_dir: &Path, object: &str) -> cloud::Result<()> {
+    let file = download_dir.join(object);
+    if !utils::verification::verify(&file, object)? {
+        error!("object {} doesn't match its sha256sum, removing it", object);
+        fs::remove_file(file)?;
+        return Err(cloud::Error::ChecksumMismatch(object.to_owned()));
+    }
+    Ok(())
+}
+
+// Fails early if the objects still to be downloaded don't fit in the
+// download directory, instead of failing in the middle of the download.
+// The segmented objects also need room for the segment being appended
+// when they are joined.
+fn check_download_space(
+    download_dir: &Path,
+    objects: &[(String, u64)],
+    settings: &api::Download,
+) -> Result<()> {
+    let len = |path: PathBuf| fs::metadata(path).map(|m| m.len()).unwrap_or(0);
+    let required: u64 = objects
+        .iter()
+        .map(|(shasum, size)| {
+            if !is_segmented(*size, settings) {
+                return size.saturating_sub(len(download_dir.join(shasum)));
+            }
+            let downloaded: u64 =
+                (0..settings.segments).map(|i| len(segment_path(download_dir, shasum, i))).sum();
+            size.saturating_sub(downloaded).saturating_add(segment_size(*size, settings))
+        })
+        .sum();
+    let available = utils::fs::available_space(download_dir)?;
+
+    if required > available {
+        error!(
+            "not enough space in {:?}: {} bytes required, {} bytes available",
+            download_dir, required, available
+        );
+        return Err(TransitionError::NotEnoughDownloadSpace {
+            dir: download_dir.to_owned(),
+            required,
+            available,
+        });
+    }
+
+    Ok(())
+}
+
+fn is_segmented(size: u64, settings: &api::Download) -> bool {
+    settings.segments > 1 && size >= settings.segmented_min_size
+}
+
+fn segment_size(size: u64, settings: &api::Download) -> u64 {
+    (size + settings.segments as u64 - 1) / settings.segments as u64
+}
+
+fn segment_path(download_dir: &Path, object: &str, segment: usize) -> PathBuf {
+    download_dir.join(format!("{}.part{}", object, segment))
+}
+
+// Downloads the object using concurrent ranged requests, one for each
+// segment. Every segment is written to its own file, so it can be resumed
+// independently, and they are joined once all of them are downloaded.
+async fn download_segmented(
+    server: &str,
+    product_uid: &str,
+    package_uid: &str,
+    download_dir: &Path,
+    object: &str,
+    size: u64,
+    settings: &api::Download,
+    rate_limit: &cloud::RateLimit,
+    control: &machine::DownloadControl,
+) -> cloud::Result<()> {
+    let segment_size = segment_size(size, settings);
+    let segments: Vec<_> = (0..settings.segments as u64)
+        .map(|i| (i * segment_size, std::cmp::min((i + 1) * segment_size, size)))
+        .filter(|(start, end)| start < end)
+        .enumerate()
+        .map(|(i, (start, end))| (segment_path(download_dir, object, i), start, end - 1))
+        .collect();
+
+    // The segments a join interrupted before has already appended to the
+    // first one aren't downloaded again.
+    let joined =
+        segments.first().and_then(|(part, ..)| fs::metadata(part).ok()).map_or(0, |m| m.len());
+    let (appended, segments): (Vec<_>, Vec<_>) =
+        segments.into_iter().enumerate().partition(|(i, (_, _, end))| *i > 0 && *end < joined);
+    for (_, (part, ..)) in appended {
+        if let Err(e) = fs::remove_file(&part) {
+            if e.kind() != io::ErrorKind::NotFound {
+                return Err(e.into());
+            }
+        }
+        remove_validator(&part)?;
+    }
+    let segments: Vec<_> = segments.into_iter().map(|(_, segment)| segment).collect();
+
+    // The rate limit is shared by all segments.
+    let rate_limit = rate_limit.shared_by(segments.len());
+
+    fs::create_dir_all(download_dir)?;
+    let (sndr, mut recv) = tokio::sync::mpsc::channel(segments.len());
+    for (part, start, end) in segments.iter().cloned() {
+        let mut sndr = sndr.clone();
+        let server = server.to_owned();
+        let product_uid = product_uid.to_owned();
+        let package_uid = package_uid.to_owned();
+        let object = object.to_owned();
+        let retries = settings.segment_retries;
+        let control = control.clone();
+        let rate_limit = rate_limit.clone();
+
+        actix_rt::spawn(async move {
+            let api = crate::CloudClient::new(&server).with_rate_limit(rate_limit);
+            let mut res = Ok(());
+            for attempt in 0..=retries {
+                // The segment is left as is when the download is
+                // interrupted, and resumed along with the object.
+                let download = async {
+                    Some(
+                        api.download_object_range(
+                            &product_uid,
+                            &package_uid,
+                            &object,
+                            start,
+                            end,
+                            &part,
+                        )
+                        .await,
+                    )
+                };
+                let interrupted = async {
+                    control.interrupted().await;
+                    None
+                };
+                res = match download.race(interrupted).await {
+                    Some(res) => res,
+                    None => return,
+                };
+                match res {
+                    Ok(()) => break,
+                    Err(ref e) => warn!(
+                        "fail downloading segment {:?} (attempt {} of {}): {}",
+                        part,
+                        attempt + 1,
+                        retries + 1,
+                        e
+                    ),
+                }
+            }
+            sndr.send(res).await.expect("unable to send response about segment download");
+        });
+    }
+    drop(sndr);
+
+    let mut results = Vec::default();
+    while let Some(res) = recv.recv().await {
+        results.push(res);
+    }
+    results.into_iter().try_for_each(|res| res)?;
+
+    let parts: Vec<_> = segments.into_iter().map(|(part, start, _)| (part, start)).collect();
+    join_segments(&download_dir.join(object), &parts)?;
+
+    Ok(())
+}
+
+// Applies the rate limit of the schedule windows starting or ending
+// while the objects are downloaded.
+fn follow_rate_limit_schedule(
+    settings: api::Download,
+    rate_limit: cloud::RateLimit,
+    control: machine::DownloadControl,
+) {
+    if settings.rate_limit_schedule.is_empty() {
+        return;
+    }
+
+    actix_rt::spawn(async move {
+        loop {
+            async_std::task::sleep(RATE_LIMIT_CHECK_INTERVAL).await;
+            if !control.is_running() && !control.is_paused() {
+                break;
+            }
+            rate_limit.set(rate_limit_at(&settings, chrono::Local::now().time()));
+        }
+    });
+}
+
+// Finds the download rate limit in use at `now`, which is the one of
+// the first schedule window containing it or the default otherwise.
+pub(super) fn rate_limit_at(settings: &api::Download, now: NaiveTime) -> Option<u64> {
+    settings
+        .rate_limit_schedule
+        .iter()
+        .find(|w| utils::maintenance::contains(w.start, w.end, now))
+        .map_or(settings.rate_limit, |w| w.rate_limit)
+}
+
+// The segments are appended to the first one, each being removed once
+// appended, so only one of them is ever held twice.
+// Each one is appended at its offset in the object, so what an interrupted
+// join has left of it is overwritten when the join is done again.
+fn join_segments(object: &Path, parts: &[(PathBuf, u64)]) -> io::Result<()> {
+    let ((first, _), rest) = match parts.split_first() {
+        Some(parts) => parts,
+        None => return Ok(()),
+    };
+    let mut output = fs::OpenOptions::new().append(true).open(first)?;
+    for (part, offset) in rest {
+        output.set_len(*offset)?;
+        io::copy(&mut fs::File::open(part)?, &mut output)?;
+        output.sync_data()?;
+        fs::remove_file(part)?;
+        remove_validator(part)?;
+    }
+    output.sync_all()?;
+    remove_validator(first)?;
+    fs::rename(first, object)
+}
+
+fn remove_validator(part: &Path) -> io::Result<()> {
+    let mut validator = part.as_os_str().to_owned();
+    validator.push(".etag");
+    match fs::remove_file(validator) {
+        Err(e) if e.kind() != io::ErrorKind::NotFound => Err(e),
+        _ => Ok(()),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::cloud_mock;
+    use pretty_assertions::assert_eq;
+
+    #[actix_rt::test]
+    async fn segmented_download() {
+        let download_dir = tempfile::tempdir().unwrap();
+        let settings = api::Download {
+            segments: 3,
+            segmented_min_size: 0,
+            segment_retries: 0,
+            ..api::Download::default()
+        };
+        cloud_mock::set_download_data(b"0123456789".to_vec());
+        let control = machine::DownloadControl::default();
+        control.start();
+
+        download_segmented(
+            "http://localhost",
+            "product",
+            "package",
+            download_dir.path(),
+            "object",
+            10,
+            &settings,
+            &cloud::RateLimit::default(),
+            &control,
+        )
+        .await
+        .unwrap();
+
+        assert_eq!(fs::read(download_dir.path().join("object")).unwrap(), b"0123456789");
+        assert_eq!(fs::read_dir(download_dir.path()).unwrap().count(), 1, "segments not removed");
+    }
+
+    #[actix_rt::test]
+    async fn resume_interrupted_join() {
+        let settings = api::Download {
+            segments: 3,
+            segmented_min_size: 0,
+            segment_retries: 0,
+            ..api::Download::default()
+        };
+        cloud_mock::set_download_data(b"0123456789".to_vec());
+        let control = machine::DownloadControl::default();
+        control.start();
+
+        // Interrupted while appending the second segment, and after
+        // appending it
+        for (first, second) in &[("012345", Some("4567")), ("01234567", None)] {
+            let download_dir = tempfile::tempdir().unwrap();
+            fs::write(segment_path(download_dir.path(), "object", 0), first).unwrap();
+            if let Some(second) = second {
+                fs::write(segment_path(download_dir.path(), "object", 1), second).unwrap();
+            }
+
+            download_segmented(
+                "http://localhost",
+                "product",
+                "package",
+                download_dir.path(),
+                "object",
+                10,
+                &settings,
+                &cloud::RateLimit::default(),
+                &control,
+            )
+            .await
+            .unwrap();
+
+            assert_eq!(fs::read(download_dir.path().join("object")).unwrap(), b"0123456789");
+            assert_eq!(fs::read_dir(download_dir.path()).unwrap().count(), 1);
+        }
+    }
+
+    #[test]
+    fn not_enough_download_space() {
+        let download_dir = tempfile::tempdir().unwrap();
+        let objects = vec![("object".to_string(), u64::max_value())];
+
+        let settings = api::Download::default();
+
+        match check_download_space(download_dir.path(), &objects, &settings) {
+            Err(TransitionError::NotEnoughDownloadSpace { required, .. }) => {
+                assert_eq!(required, u64::max_value())
+            }
+            res => panic!("Unexpected result: {:?}", res),
+        }
+        assert!(check_download_space(download_dir.path(), &[], &settings).is_ok());
+    }
+
+    #[test]
+    fn scheduled_rate_limit() {
+        let settings = api::Download {
+            rate_limit: Some(1024),
+            rate_limit_schedule: vec![api::RateLimitWindow {
+                start: NaiveTime::from_hms(22, 0, 0),
+                end: NaiveTime::from_hms(6, 0, 0),
+                rate_limit: None,
+            }],
+            ..api::Download::default()
+        };
+
+        assert_eq!(rate_limit_at(&settings, NaiveTime::from_hms(12, 0, 0)), Some(1024));
+        assert_eq!(rate_limit_at(&settings, NaiveTime::from_hms(23, 0, 0)), None);
+        assert_eq!(rate_limit_at(&settings, NaiveTime::from_hms(5, 59, 59)), None);
+        assert_eq!(rate_limit_at(&settings, NaiveTime::from_hms(6, 0, 0)), Some(1024));
+    }
+}
@@ -4,11 +4,12 @@
 
 use super::{
     machine::{self, SharedState},
-    Install, Result, State, StateChangeImpl,
+    AwaitPower, Result, State, StateChangeImpl,
 };
 use crate::{
     firmware::installation_set,
     update_package::{Signature, UpdatePackage, UpdatePackageExt},
+    utils,
 };
 use slog_scope::{debug, info, trace};
 use std::{
@@ -17,6 +18,12 @@ use std::{
     path::PathBuf,
 };
 
+/// Where the packages uploaded through the agent API are kept until they
+/// are installed.
+pub(crate) fn upload_dir() -> PathBuf {
+    std::env::temp_dir().join("updatehub-uploads")
+}
+
 #[derive(Debug, PartialEq)]
 pub(super) struct PrepareLocalInstall {
     pub(super) update_file: PathBuf,
@@ -28,18 +35,28 @@ impl StateChangeImpl for PrepareLocalInstall {
         "prepare_local_install"
     }
 
+    fn is_inhibiting_suspend(&self) -> bool {
+        true
+    }
+
     async fn handle(
         self,
         shared_state: &mut SharedState,
     ) -> Result<(State, machine::StepTransition)> {
         info!("prepare local install: {}", self.update_file.display());
+        utils::resource_usage::start();
         let dest_path = shared_state.settings.update.download_dir.clone();
         std::fs::create_dir_all(&dest_path)?;
 
         let mut metadata = Vec::with_capacity(1024);
-        let mut source = fs::File::open(self.update_file)?;
-        compress_tools::uncompress_archive_file(&mut source, &mut metadata, "metadata")?;
-        let update_package = UpdatePackage::parse(&metadata)?;
+        let mut source = fs::File::open(&self.update_file)?;
+        utils::archive::uncompress_archive_file(
+            &self.update_file,
+            &mut source,
+            &mut metadata,
+            "metadata",
+        )?;
+        let mut update_package = UpdatePackage::parse(&metadata)?;
         trace!("successfuly uncompressed metadata file");
 
         if let Some(key) = shared_state.firmware.pub_key.as_ref() {
@@ -51,6 +68,7 @@ impl StateChangeImpl for PrepareLocalInstall {
                     let sign = Signature::from_base64_str(&sign)?;
                     debug!("validating signature");
                     sign.validate(key, &update_package)?;
+                    update_package.signature = Some(sign);
                 }
                 Err(compress_tools::Error::FileNotFound) => {
                     return Err(super::TransitionError::SignatureNotFound);
@@ -58,6 +76,10 @@ impl StateChangeImpl for PrepareLocalInstall {
                 Err(e) => return Err(e.into()),
             }
         }
+        update_package.compatible_with(&shared_state.firmware)?;
+        update_package.check_security_version(shared_state.runtime_settings.security_version())?;
+        update_package.apply_install_mode_defaults(&shared_state.settings.install_modes);
+        update_package.retain_role_objects(shared_state.settings.update.role.as_deref());
 
         for object in update_package
             .objects(installation_set::active()?)
@@ -70,6 +92,11 @@ impl StateChangeImpl for PrepareLocalInstall {
             compress_tools::uncompress_archive_file(&mut source, &mut target, object)?;
         }
 
+        // The uploaded packages are no longer needed once extracted.
+        if self.update_file.starts_with(upload_dir()) {
+            fs::remove_file(&self.update_file)?;
+        }
+
         debug!("update package extracted: {:?}", update_package);
 
         update_package.clear_unrelated_files(
@@ -78,6 +105,11 @@ impl StateChangeImpl for PrepareLocalInstall {
             &shared_state.settings,
         )?;
 
-        Ok((State::Install(Install { update_package }), machine::StepTransition::Immediate))
+        // Local installs skip the maintenance windows, but still wait for
+        // enough power.
+        Ok((
+            AwaitPower::install(update_package, &shared_state.settings),
+            machine::StepTransition::Immediate,
+        ))
     }
 }
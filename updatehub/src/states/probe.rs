@@ -4,11 +4,12 @@
 
 use super::{
     machine::{self, SharedState},
-    EntryPoint, Result, State, StateChangeImpl, Validation,
+    EntryPoint, Result, State, StateChangeImpl, TransitionError, Validation,
 };
 use chrono::Utc;
 use cloud::api::ProbeResponse;
-use slog_scope::{debug, error, info};
+use sdk::api::{audit::Trigger, info::runtime_settings::DesiredPackage};
+use slog_scope::{debug, error, info, warn};
 use std::time::Duration;
 
 #[derive(Debug, PartialEq)]
@@ -29,18 +30,32 @@ impl StateChangeImpl for Probe {
         self,
         shared_state: &mut SharedState,
     ) -> Result<(State, machine::StepTransition)> {
-        let server_address = shared_state.server_address();
-
-        let probe = match crate::CloudClient::new(&server_address)
-            .probe(
-                shared_state.runtime_settings.retries() as u64,
-                shared_state.firmware.as_cloud_metadata(),
-            )
-            .await
-        {
-            Err(cloud::Error::Http(e)) if e.is::<awc::http::uri::InvalidUri>() => {
+        shared_state.refresh_identity()?;
+        shared_state.refresh_device_attributes();
+
+        // The device can't be probed before it has its credentials.
+        if let Err(e) = shared_state.enroll().await {
+            error!("Enrollment failed: {}", e);
+            shared_state.runtime_settings.inc_retries();
+            return Ok((
+                State::Probe(self),
+                machine::StepTransition::Delayed(Duration::from_secs(1)),
+            ));
+        }
+
+        let probe = match shared_state.probe().await {
+            Err(TransitionError::Client(cloud::Error::Http(e)))
+                if e.is::<awc::http::uri::InvalidUri>() =>
+            {
                 return Err(cloud::Error::Http(e).into());
             }
+            Err(e @ TransitionError::RuntimeSettings(_)) => return Err(e),
+            // The server is shedding load, so the probe isn't counted as
+            // a failed one.
+            Err(TransitionError::Client(cloud::Error::RetryAfter(delay))) => {
+                warn!("server is busy, probing again in {} seconds", delay.as_secs());
+                return Ok((State::Probe(self), machine::StepTransition::Delayed(delay)));
+            }
             Err(e) => {
                 error!("Probe failed: {}", e);
                 shared_state.runtime_settings.inc_retries();
@@ -52,6 +67,9 @@ impl StateChangeImpl for Probe {
             Ok(probe) => probe,
         };
         shared_state.runtime_settings.clear_retries();
+        if let Err(e) = shared_state.apply_server_settings().await {
+            warn!("failed to apply the settings pushed by the server: {}", e);
+        }
 
         match probe {
             ProbeResponse::NoUpdate => {
@@ -59,6 +77,7 @@ impl StateChangeImpl for Probe {
 
                 // Store timestamp of last polling
                 shared_state.runtime_settings.set_last_polling(Utc::now())?;
+                shared_state.runtime_settings.set_desired_package(None)?;
                 Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate))
             }
 
@@ -73,7 +92,12 @@ impl StateChangeImpl for Probe {
             ProbeResponse::Update(package, sign) => {
                 // Store timestamp of last polling
                 shared_state.runtime_settings.set_last_polling(Utc::now())?;
+                shared_state.runtime_settings.set_desired_package(Some(DesiredPackage {
+                    package_uid: package.package_uid(),
+                    version: package.inner.version.clone(),
+                }))?;
 
+                shared_state.trigger = Some(Trigger::Poll);
                 info!("update received.");
                 Ok((
                     State::Validation(Validation { package, sign }),
@@ -115,6 +139,45 @@ mod tests {
         assert_state!(machine, EntryPoint);
     }
 
+    #[actix_rt::test]
+    async fn apply_server_settings() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        cloud_mock::setup_fake_response(cloud_mock::FakeResponse::NoUpdate);
+        cloud_mock::set_settings_delta(br#"{"polling.interval": "2h"}"#.to_vec());
+
+        State::Probe(Probe {}).move_to_next_state(&mut shared_state).await.unwrap();
+        assert_eq!(shared_state.settings.polling.interval, chrono::Duration::hours(2));
+        assert_eq!(
+            shared_state.runtime_settings.settings.get("polling.interval").map(String::as_str),
+            Some("2h")
+        );
+
+        // Settings out of the server reach are refused as a whole
+        cloud_mock::set_settings_delta(
+            br#"{"polling.interval": "3h", "network.server_address": "http://foo"}"#.to_vec(),
+        );
+        State::Probe(Probe {}).move_to_next_state(&mut shared_state).await.unwrap();
+        assert_eq!(shared_state.settings.polling.interval, chrono::Duration::hours(2));
+    }
+
+    #[actix_rt::test]
+    async fn remember_answering_server() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.settings.network.fallback_servers = vec!["https://cloud.example.com".into()];
+        shared_state.runtime_settings.polling.active_server =
+            Some("https://removed.example.com".into());
+        assert_eq!(shared_state.server_address(), shared_state.settings.network.server_address);
+        cloud_mock::setup_fake_response(cloud_mock::FakeResponse::NoUpdate);
+
+        State::Probe(Probe {}).move_to_next_state(&mut shared_state).await.unwrap();
+        assert_eq!(
+            shared_state.runtime_settings.active_server(),
+            Some(shared_state.settings.network.server_address.as_str())
+        );
+    }
+
     #[actix_rt::test]
     async fn update_available() {
         let setup = crate::tests::TestEnvironment::build().finish();
@@ -124,6 +187,10 @@ mod tests {
         let machine = State::Probe(Probe {}).move_to_next_state(&mut shared_state).await.unwrap().0;
 
         assert_state!(machine, Validation);
+        assert_eq!(
+            shared_state.runtime_settings.desired_package().map(|d| d.package_uid.clone()),
+            Some(crate::update_package::tests::get_update_package().package_uid())
+        );
     }
 
     #[actix_rt::test]
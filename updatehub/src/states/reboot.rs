@@ -6,8 +6,13 @@ use super::{
     machine::{self, SharedState},
     EntryPoint, ProgressReporter, Result, State, StateChangeImpl,
 };
-use crate::update_package::UpdatePackage;
-use slog_scope::{info, warn};
+use crate::{
+    firmware::installation_set,
+    object,
+    update_package::{UpdatePackage, UpdatePackageExt},
+    utils,
+};
+use slog_scope::info;
 
 #[derive(Debug, PartialEq)]
 pub(super) struct Reboot {
@@ -19,6 +24,10 @@ impl ProgressReporter for Reboot {
         self.update_package.package_uid()
     }
 
+    fn update_metadata(&self) -> &[u8] {
+        &self.update_package.raw
+    }
+
     fn report_enter_state_name(&self) -> &'static str {
         "rebooting"
     }
@@ -34,12 +43,20 @@ impl StateChangeImpl for Reboot {
         "reboot"
     }
 
-    async fn handle(self, _: &mut SharedState) -> Result<(State, machine::StepTransition)> {
-        info!("triggering reboot");
-        let output = easy_process::run("reboot")?;
-        if !output.stdout.is_empty() || !output.stderr.is_empty() {
-            warn!("  reboot output: stdout: {}, stderr: {}", output.stdout, output.stderr);
+    async fn handle(
+        self,
+        shared_state: &mut SharedState,
+    ) -> Result<(State, machine::StepTransition)> {
+        // The packages only updating the agent restart it instead.
+        let installation_set = installation_set::inactive()?;
+        if object::is_agent_only(self.update_package.objects(installation_set)) {
+            utils::agent_update::restart()?;
         }
+
+        utils::kubernetes::drain(&shared_state.settings.kubernetes)?;
+
+        info!("triggering reboot");
+        utils::privsep::reboot(&shared_state.settings)?;
         Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate))
     }
 }
@@ -0,0 +1,215 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{machine::SharedState, Result};
+use crate::{
+    firmware::{self, installation_set},
+    utils,
+};
+use sdk::api::{
+    info::runtime_settings::{InstallationRecord, UpdateOutcome},
+    rollback::{Check, CheckStatus, Response},
+};
+use slog_scope::{info, warn};
+use std::path::Path;
+
+/// Checks the inactive installation set can be rolled back into: it
+/// must not be quarantined, it must have a record of what has been
+/// installed into it, the regions written then must be unchanged and the
+/// device bootability probe, if any, must accept it.
+pub(super) fn check(shared_state: &SharedState) -> Result<Response> {
+    let set = installation_set::inactive()?;
+    info!("checking installation set {} for rollback", set);
+    let record = shared_state.runtime_settings.installation_record(set).cloned();
+
+    let checks = vec![
+        check_quarantine(shared_state, set),
+        check_record(record.as_ref()),
+        check_regions(record.as_ref()),
+        check_bootability(&shared_state.settings.firmware.metadata, set),
+    ];
+    let ready = checks.iter().all(|check| check.status != CheckStatus::Failed);
+
+    Ok(Response { installation_set: set.0, record, checks, ready, executed: false })
+}
+
+/// Swaps the active installation set and reboots into it, reporting the
+/// rollback of `package_uid` to the server with the `message`.
+pub(super) async fn rollback(
+    shared_state: &mut SharedState,
+    package_uid: String,
+    message: String,
+) -> Result<()> {
+    let settings = &shared_state.settings;
+
+    utils::privsep::swap_active()?;
+    warn!("swapped active installation set and running rollback");
+    firmware::rollback_callback(&settings.firmware.metadata)?;
+    shared_state.runtime_settings.set_update_result(
+        UpdateOutcome::RolledBack,
+        Some(package_uid.clone()),
+        None,
+    )?;
+    shared_state.runtime_settings.finish_update_chain_step(false)?;
+    shared_state.runtime_settings.reset_installation_settings()?;
+
+    let server = shared_state.server_address().to_owned();
+    if let Err(e) = crate::CloudClient::new(&server)
+        .report(
+            "rolled-back",
+            shared_state.firmware.as_cloud_metadata(),
+            &package_uid,
+            None,
+            Some(message),
+            None,
+            None,
+        )
+        .await
+    {
+        warn!("report failed: {}", e);
+    }
+
+    utils::privsep::reboot(settings)?;
+    Ok(())
+}
+
+fn check_quarantine(shared_state: &SharedState, set: installation_set::Set) -> Check {
+    if shared_state.runtime_settings.is_quarantined(set) {
+        return failed(
+            "quarantine",
+            "quarantined after failing to be activated repeatedly".to_owned(),
+        );
+    }
+    passed("quarantine", "not quarantined".to_owned())
+}
+
+fn check_record(record: Option<&InstallationRecord>) -> Check {
+    match record {
+        Some(record) => passed(
+            "record",
+            format!("{} ({}) installed at {}", record.version, record.package_uid, record.time),
+        ),
+        None => failed("record", "nothing has been recorded as installed into it".to_owned()),
+    }
+}
+
+fn check_regions(record: Option<&InstallationRecord>) -> Check {
+    let regions = match record {
+        Some(record) if !record.regions.is_empty() => &record.regions,
+        _ => return skipped("checksum", "no region recorded to be checked".to_owned()),
+    };
+
+    for region in regions {
+        match utils::sha256sum_region(&region.target, region.offset, region.size) {
+            Ok(sha256sum) if sha256sum == region.sha256sum => {}
+            Ok(_) => {
+                return failed(
+                    "checksum",
+                    format!("{} has changed at offset {}", region.target.display(), region.offset),
+                )
+            }
+            Err(e) => {
+                return failed(
+                    "checksum",
+                    format!("failed to read {}: {}", region.target.display(), e),
+                )
+            }
+        }
+    }
+    passed("checksum", format!("{} regions match", regions.len()))
+}
+
+fn check_bootability(metadata: &Path, set: installation_set::Set) -> Check {
+    match firmware::bootability_probe(metadata, set) {
+        Some(Ok(())) => passed("bootability", "accepted by the bootability probe".to_owned()),
+        Some(Err(e)) => failed("bootability", e.to_string()),
+        None => skipped("bootability", "device has no bootability probe".to_owned()),
+    }
+}
+
+fn passed(name: &str, detail: String) -> Check {
+    Check { name: name.to_owned(), status: CheckStatus::Passed, detail: Some(detail) }
+}
+
+fn failed(name: &str, detail: String) -> Check {
+    Check { name: name.to_owned(), status: CheckStatus::Failed, detail: Some(detail) }
+}
+
+fn skipped(name: &str, detail: String) -> Check {
+    Check { name: name.to_owned(), status: CheckStatus::Skipped, detail: Some(detail) }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use sdk::api::info::runtime_settings::{InstallationSet, InstalledRegion};
+    use std::fs;
+
+    fn statuses(response: &Response) -> Vec<CheckStatus> {
+        response.checks.iter().map(|check| check.status).collect()
+    }
+
+    #[test]
+    fn check_inactive_set() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+
+        let response = check(&shared_state).unwrap();
+        assert_eq!(response.installation_set, InstallationSet::B);
+        assert_eq!(
+            statuses(&response),
+            vec![
+                CheckStatus::Passed,
+                CheckStatus::Failed,
+                CheckStatus::Skipped,
+                CheckStatus::Skipped
+            ]
+        );
+        assert!(!response.ready);
+
+        let dir = tempfile::tempdir().unwrap();
+        let target = dir.path().join("device");
+        fs::write(&target, "headerimage").unwrap();
+        shared_state
+            .runtime_settings
+            .record_installation(InstallationRecord {
+                installation_set: InstallationSet::B,
+                package_uid: "package".to_owned(),
+                version: "1.0".to_owned(),
+                time: chrono::Utc::now(),
+                regions: vec![InstalledRegion {
+                    target: target.clone(),
+                    offset: 6,
+                    size: 5,
+                    sha256sum: utils::sha256sum(b"image"),
+                }],
+            })
+            .unwrap();
+
+        let response = check(&shared_state).unwrap();
+        assert_eq!(
+            statuses(&response),
+            vec![
+                CheckStatus::Passed,
+                CheckStatus::Passed,
+                CheckStatus::Passed,
+                CheckStatus::Skipped
+            ]
+        );
+        assert!(response.ready);
+
+        fs::write(&target, "headerbroke").unwrap();
+        let response = check(&shared_state).unwrap();
+        assert_eq!(response.checks[2].status, CheckStatus::Failed);
+        assert!(!response.ready);
+
+        fs::write(&target, "headerimage").unwrap();
+        let set = installation_set::Set(InstallationSet::B);
+        shared_state.runtime_settings.add_activation_failure(set, None, 1).unwrap();
+        let response = check(&shared_state).unwrap();
+        assert_eq!(response.checks[0].status, CheckStatus::Failed);
+        assert!(!response.ready);
+    }
+}
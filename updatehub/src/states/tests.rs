@@ -79,3 +79,20 @@ fn startup_on_wrong_install_set() {
         Ok(content) => panic!("Output file should be empty, instead we have: {}", content),
     }
 }
+
+#[test]
+fn error_causes() {
+    use std::os::unix::process::ExitStatusExt;
+
+    let err = TransitionError::from(io::Error::from_raw_os_error(28));
+    assert_eq!((err.errno(), err.exit_code()), (Some(28), None));
+
+    let err = TransitionError::from(crate::utils::Error::from(io::Error::from_raw_os_error(5)));
+    assert_eq!(err.errno(), Some(5));
+
+    let status = std::process::ExitStatus::from_raw(2 << 8);
+    let err = TransitionError::from(crate::object::Error::ScriptFailed(status));
+    assert_eq!((err.errno(), err.exit_code()), (None, Some(2)));
+
+    assert_eq!(TransitionError::Canceled.exit_code(), None);
+}
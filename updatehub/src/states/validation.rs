@@ -4,10 +4,19 @@
 
 use super::{
     machine::{self, SharedState},
-    EntryPoint, PrepareDownload, Result, State, StateChangeImpl,
+    AwaitApproval, EntryPoint, Result, State, StateChangeImpl,
 };
-use crate::update_package::UpdatePackageExt;
-use slog_scope::{debug, error, info, trace};
+use crate::{
+    capabilities,
+    firmware::installation_set,
+    update_package::{self, UpdatePackageExt},
+    utils,
+};
+use sdk::api::{
+    audit::Trigger,
+    info::runtime_settings::{PendingPackage, UpdateChain},
+};
+use slog_scope::{debug, error, info, trace, warn};
 
 #[derive(Debug, PartialEq)]
 pub(super) struct Validation {
@@ -27,12 +36,15 @@ impl StateChangeImpl for Validation {
     }
 
     async fn handle(
-        self,
+        mut self,
         shared_state: &mut SharedState,
     ) -> Result<(State, machine::StepTransition)> {
         if let Some(key) = shared_state.firmware.pub_key.as_ref() {
             match self.sign.as_ref() {
                 Some(sign) => {
+                    if let Err(e) = utils::time_sync::sync_clock(&shared_state.settings.time_sync) {
+                        warn!("unable to sync the clock: {}", e);
+                    }
                     debug!("validating signature");
                     sign.validate(key, &self.package)?;
                 }
@@ -44,7 +56,40 @@ impl StateChangeImpl for Validation {
         }
 
         // Ensure the package is compatible
-        self.package.compatible_with(&shared_state.firmware)?;
+        if let Err(e) = self.package.compatible_with(&shared_state.firmware) {
+            if let update_package::Error::IncompatibleAgent { .. } = e {
+                error!("{}", e);
+                report_incompatible_agent(shared_state, &self.package.package_uid(), &e).await;
+
+                // The package is sent again once probed after the agent
+                // has been updated.
+                if let Some(url) = shared_state.settings.update.agent_update_url.clone() {
+                    info!("updating the agent before installing the update package");
+                    shared_state.runtime_settings.queue_package(PendingPackage::Url(url))?;
+                    return Ok((
+                        State::EntryPoint(EntryPoint {}),
+                        machine::StepTransition::Immediate,
+                    ));
+                }
+            }
+            return Err(e.into());
+        }
+
+        // Refuse downgrading the device into known vulnerabilities
+        self.package.check_security_version(shared_state.runtime_settings.security_version())?;
+
+        // The objects meant for other devices of the machine are ignored.
+        self.package.apply_install_mode_defaults(&shared_state.settings.install_modes);
+        self.package.retain_role_objects(shared_state.settings.update.role.as_deref());
+
+        // Refuse packages the agent is not able to install
+        let objects = self.package.objects(installation_set::inactive()?);
+        if let Some((mode, missing)) =
+            capabilities::find_missing(&shared_state.capabilities, objects)
+        {
+            error!("update package requires unavailable '{}' install mode", mode);
+            return Err(super::TransitionError::MissingCapabilities { mode, missing });
+        }
 
         if shared_state
             .runtime_settings
@@ -54,16 +99,66 @@ impl StateChangeImpl for Validation {
         {
             info!("not downloading update package, the same package has already been installed.");
             Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate))
+        } else if !self.package.inner.mandatory && quota_exceeded(shared_state) {
+            // The package is probed again on the next polls, being
+            // downloaded once the quota is renewed.
+            info!("deferring the download, the monthly data quota has been exceeded");
+            Ok((State::EntryPoint(EntryPoint {}), machine::StepTransition::Immediate))
         } else {
             trace!("moving to PrepareDownload state to process the update package.");
+            shared_state.begin_attempt(
+                self.package.package_uid(),
+                &self.package.inner.version,
+                Trigger::Poll,
+            )?;
+            shared_state.runtime_settings.begin_transaction(
+                &self.package.raw,
+                self.sign.as_ref().map(cloud::api::Signature::to_base64),
+            )?;
+            // The installer validates the signature again before touching
+            // the device.
+            self.package.signature = self.sign;
+            let chain = self.package.chain.map(|chain| {
+                info!("installing step {} of {} of the update chain", chain.step, chain.length);
+                UpdateChain { step: chain.step, length: chain.length }
+            });
+            shared_state.runtime_settings.set_update_chain(chain)?;
             Ok((
-                State::PrepareDownload(PrepareDownload { update_package: self.package }),
+                AwaitApproval::download(self.package, &shared_state.settings),
                 machine::StepTransition::Immediate,
             ))
         }
     }
 }
 
+fn quota_exceeded(shared_state: &SharedState) -> bool {
+    shared_state.settings.download.monthly_quota.map_or(false, |quota| {
+        shared_state.runtime_settings.bandwidth_usage(chrono::Utc::now()) >= quota
+    })
+}
+
+async fn report_incompatible_agent(
+    shared_state: &SharedState,
+    package_uid: &str,
+    error: &update_package::Error,
+) {
+    let server = shared_state.server_address().to_owned();
+    if let Err(e) = crate::CloudClient::new(&server)
+        .report(
+            "error",
+            shared_state.firmware.as_cloud_metadata(),
+            package_uid,
+            Some("validation"),
+            Some(error.to_string()),
+            None,
+            None,
+        )
+        .await
+    {
+        warn!("report failed: {}", e);
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -101,6 +196,123 @@ mod tests {
         }
     }
 
+    #[actix_rt::test]
+    async fn incompatible_agent() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        let mut package = get_update_package();
+        package.inner.requires_agent = Some(">= 999".to_owned());
+
+        let res = State::Validation(Validation { package, sign: None })
+            .move_to_next_state(&mut shared_state)
+            .await;
+        match res {
+            Err(TransitionError::UpdatePackage(update_package::Error::IncompatibleAgent {
+                ..
+            })) => {}
+            res => panic!("Unexpected result from transition: {:?}", res),
+        }
+    }
+
+    #[actix_rt::test]
+    async fn refuse_security_downgrade() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.runtime_settings.set_security_version(2).unwrap();
+        let mut package = get_update_package();
+        package.inner.security_version = 1;
+
+        let res = State::Validation(Validation { package, sign: None })
+            .move_to_next_state(&mut shared_state)
+            .await;
+        match res {
+            Err(TransitionError::UpdatePackage(update_package::Error::SecurityVersionTooLow {
+                version: 1,
+                current: 2,
+            })) => {}
+            res => panic!("Unexpected result from transition: {:?}", res),
+        }
+
+        // An authorized downgrade is accepted
+        let mut package = get_update_package();
+        package.inner.security_version = 1;
+        package.inner.allow_downgrade = true;
+        let machine = State::Validation(Validation { package, sign: None })
+            .move_to_next_state(&mut shared_state)
+            .await
+            .unwrap()
+            .0;
+        assert_state!(machine, PrepareDownload);
+    }
+
+    #[actix_rt::test]
+    async fn update_agent_first() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.settings.update.agent_update_url =
+            Some("https://example.com/agent.uhupkg".to_owned());
+        let mut package = get_update_package();
+        package.inner.requires_agent = Some(">= 999".to_owned());
+
+        let machine = State::Validation(Validation { package, sign: None })
+            .move_to_next_state(&mut shared_state)
+            .await
+            .unwrap()
+            .0;
+        assert_state!(machine, EntryPoint);
+        assert_eq!(
+            shared_state.runtime_settings.take_pending_package().unwrap(),
+            Some(PendingPackage::Url("https://example.com/agent.uhupkg".to_owned()))
+        );
+    }
+
+    #[actix_rt::test]
+    async fn defer_over_quota() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.settings.download.monthly_quota = Some(1024);
+        shared_state.runtime_settings.add_bandwidth(1024, 0, chrono::Utc::now()).unwrap();
+
+        let machine = State::Validation(Validation { package: get_update_package(), sign: None })
+            .move_to_next_state(&mut shared_state)
+            .await
+            .unwrap()
+            .0;
+        assert_state!(machine, EntryPoint);
+
+        let mut package = get_update_package();
+        package.inner.mandatory = true;
+        let machine = State::Validation(Validation { package, sign: None })
+            .move_to_next_state(&mut shared_state)
+            .await
+            .unwrap()
+            .0;
+        assert_state!(machine, PrepareDownload);
+    }
+
+    #[actix_rt::test]
+    async fn missing_capabilities() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let mut shared_state = setup.gen_shared_state();
+        shared_state.capabilities.insert(
+            "test".to_owned(),
+            sdk::api::info::Capability { available: false, missing: vec!["tool".to_owned()] },
+        );
+        let package = get_update_package();
+        let sign = None;
+
+        let res = State::Validation(Validation { package, sign })
+            .move_to_next_state(&mut shared_state)
+            .await;
+        match res {
+            Err(TransitionError::MissingCapabilities { mode, missing }) => {
+                assert_eq!(mode, "test");
+                assert_eq!(missing, vec!["tool".to_owned()]);
+            }
+            res => panic!("Unexpected result from transition: {:?}", res),
+        }
+    }
+
     #[actix_rt::test]
     async fn skip_same_package_uid() {
         let setup = crate::tests::TestEnvironment::build().finish();
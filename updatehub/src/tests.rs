@@ -44,6 +44,16 @@ impl TestEnvironment {
             settings: self.settings.data.clone(),
             runtime_settings: self.runtime_settings.data.clone(),
             firmware: self.firmware.data.clone(),
+            download_control: Default::default(),
+            update_cancel: Default::default(),
+            shutdown: Default::default(),
+            progress: Default::default(),
+            events: Default::default(),
+            capabilities: Default::default(),
+            approval: None,
+            go_ahead: None,
+            trigger: None,
+            enrollment: Default::default(),
         }
     }
 }
@@ -0,0 +1,76 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Error;
+
+/// Checks the agent `version` satisfies the package `requirement`, the
+/// minimum version required, optionally prefixed with `>=`.
+pub(super) fn check(requirement: &str, version: &str) -> Result<(), Error> {
+    let required = requirement.trim().trim_start_matches(">=").trim();
+    let minimum = components(required);
+    if minimum.is_empty() {
+        return Err(Error::InvalidAgentRequirement(requirement.to_owned()));
+    }
+
+    if components(version) < minimum {
+        return Err(Error::IncompatibleAgent {
+            required: required.to_owned(),
+            current: version.to_owned(),
+        });
+    }
+
+    Ok(())
+}
+
+// Takes the leading numeric components of the version, so the `git
+// describe` suffix is ignored and "2.0.1-3-gabcdef" is taken as 2.0.1.
+fn components(version: &str) -> Vec<u64> {
+    let numeric = version
+        .trim_start_matches('v')
+        .split(|c: char| c != '.' && !c.is_ascii_digit())
+        .next()
+        .unwrap_or_default();
+    let mut components = numeric
+        .split('.')
+        .take_while(|c| !c.is_empty())
+        .filter_map(|c| c.parse().ok())
+        .collect::<Vec<u64>>();
+
+    // Trailing zeros don't change the version, so 2.1 is the same as 2.1.0.
+    while components.last() == Some(&0) {
+        components.pop();
+    }
+    components
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn parse_components() {
+        assert_eq!(components("2.0.1"), vec![2, 0, 1]);
+        assert_eq!(components("v2.1.0-3-gabcdef-dirty"), vec![2, 1]);
+        assert_eq!(components("foo"), Vec::<u64>::new());
+    }
+
+    #[test]
+    fn minimum_version() {
+        assert!(check(">= 2.0", "2.0.0").is_ok());
+        assert!(check("2.0.1", "2.1.0-3-gabcdef").is_ok());
+
+        match check(">=2.1", "2.0.9") {
+            Err(Error::IncompatibleAgent { required, current }) => {
+                assert_eq!(required, "2.1");
+                assert_eq!(current, "2.0.9");
+            }
+            res => panic!("Unexpected result: {:?}", res),
+        }
+        match check(">= latest", "2.0.0") {
+            Err(Error::InvalidAgentRequirement(_)) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+    }
+}
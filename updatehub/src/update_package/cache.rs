@@ -0,0 +1,164 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Objects of previous packages kept in the download directory, where
+//! they are stored by their sha256sum, so packages sharing objects, as
+//! layered application and root filesystem releases, don't download them
+//! again. The cached objects are collected once they exceed the size or
+//! age limits, so the download partition doesn't fill up.
+
+use nix::sys::{
+    stat::{utimensat, UtimensatFlags},
+    time::{TimeSpec, TimeSpecLike},
+};
+use sdk::api::info::settings::Download;
+use slog_scope::{debug, info};
+use std::{
+    fs, io,
+    path::Path,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+/// Whether the file is a complete object, named by its sha256sum, which
+/// can be kept for later packages.
+pub(super) fn is_object(name: &str) -> bool {
+    name.len() == 64 && name.bytes().all(|b| b.is_ascii_digit() || (b'a'..=b'f').contains(&b))
+}
+
+/// Marks the object as used now. The last use is kept as the access time,
+/// leaving the modification time the verified checksums are tied to.
+pub(super) fn touch(object: &Path) -> io::Result<()> {
+    let modified = fs::metadata(object)?.modified()?;
+    let to_io = |e: nix::Error| io::Error::new(io::ErrorKind::Other, e);
+    utimensat(
+        None,
+        object,
+        &timespec(SystemTime::now()),
+        &timespec(modified),
+        UtimensatFlags::FollowSymlink,
+    )
+    .map_err(to_io)
+}
+
+/// Removes the cached objects, other than the ones `in_use`, unused for
+/// longer than the maximum age, followed by the least recently used ones
+/// until the cache fits its maximum size.
+pub(super) fn collect(
+    dir: &Path,
+    in_use: &[&str],
+    settings: &Download,
+    now: SystemTime,
+) -> io::Result<()> {
+    let mut cached = Vec::default();
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        let name = entry.file_name().to_string_lossy().into_owned();
+        let metadata = entry.metadata()?;
+        if !metadata.is_file() || !is_object(&name) || in_use.contains(&name.as_str()) {
+            continue;
+        }
+        let used = metadata.accessed().or_else(|_| metadata.modified())?;
+        cached.push((entry.path(), metadata.len(), used));
+    }
+
+    let max_age = settings.cache_max_age.to_std().unwrap_or_default();
+    let (expired, mut kept): (Vec<_>, Vec<_>) = cached
+        .into_iter()
+        .partition(|(_, _, used)| now.duration_since(*used).unwrap_or_default() > max_age);
+    let mut removed = expired;
+
+    // The most recently used objects are kept.
+    kept.sort_by(|(_, _, a), (_, _, b)| b.cmp(a));
+    let mut size = 0;
+    for (path, len, used) in kept {
+        size += len;
+        if size > settings.cache_max_size {
+            removed.push((path, len, used));
+        }
+    }
+
+    let freed = removed.iter().map(|(_, len, _)| len).sum::<u64>();
+    for (path, ..) in &removed {
+        debug!("removing cached object {:?}", path);
+        fs::remove_file(path)?;
+    }
+    if !removed.is_empty() {
+        info!("removed {} cached objects, freeing {} bytes", removed.len(), freed);
+    }
+
+    Ok(())
+}
+
+fn timespec(time: SystemTime) -> TimeSpec {
+    TimeSpec::nanoseconds(time.duration_since(UNIX_EPOCH).unwrap_or_default().as_nanos() as i64)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use std::time::Duration;
+
+    fn sha(c: char) -> String {
+        std::iter::repeat(c).take(64).collect()
+    }
+
+    fn used(path: &Path, at: SystemTime) {
+        let modified = fs::metadata(path).unwrap().modified().unwrap();
+        utimensat(None, path, &timespec(at), &timespec(modified), UtimensatFlags::FollowSymlink)
+            .unwrap();
+    }
+
+    #[test]
+    fn object_names() {
+        assert!(is_object(&sha('a')));
+        assert!(!is_object(&format!("{}.etag", sha('a'))));
+        assert!(!is_object(&sha('A')));
+        assert!(!is_object("metadata"));
+    }
+
+    #[test]
+    fn touch_keeps_modification_time() {
+        let dir = tempfile::tempdir().unwrap();
+        let object = dir.path().join(sha('a'));
+        fs::write(&object, b"object").unwrap();
+        let modified = fs::metadata(&object).unwrap().modified().unwrap();
+        used(&object, UNIX_EPOCH);
+
+        touch(&object).unwrap();
+        let metadata = fs::metadata(&object).unwrap();
+        assert_eq!(metadata.modified().unwrap(), modified);
+        assert!(metadata.accessed().unwrap() > UNIX_EPOCH);
+    }
+
+    #[test]
+    fn collect_by_age_and_size() {
+        let dir = tempfile::tempdir().unwrap();
+        let now = SystemTime::now();
+        let day = Duration::from_secs(24 * 60 * 60);
+        for (c, age) in &[('a', 0), ('b', 1), ('c', 2), ('d', 40), ('e', 40)] {
+            let object = dir.path().join(sha(*c));
+            fs::write(&object, [0; 10]).unwrap();
+            used(&object, now - day * *age);
+        }
+        fs::write(dir.path().join("metadata"), b"").unwrap();
+
+        let settings = Download {
+            cache_max_size: 20,
+            cache_max_age: chrono::Duration::days(30),
+            ..Download::default()
+        };
+        collect(dir.path(), &[&sha('e')], &settings, now).unwrap();
+
+        let mut left = fs::read_dir(dir.path())
+            .unwrap()
+            .map(|e| e.unwrap().file_name().to_string_lossy().into_owned())
+            .collect::<Vec<_>>();
+        left.sort();
+        assert_eq!(left, vec![sha('a'), sha('b'), sha('e'), "metadata".to_owned()]);
+
+        collect(dir.path(), &[], &Download::default(), now).unwrap();
+        assert_eq!(fs::read_dir(dir.path()).unwrap().count(), 1);
+    }
+}
@@ -2,6 +2,8 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
+mod agent_version;
+mod cache;
 mod supported_hardware;
 
 use self::supported_hardware::SupportedHardwareExt;
@@ -10,10 +12,20 @@ use crate::{
     object::{self, Info},
     settings::Settings,
 };
-use pkg_schema::Object;
-use sdk::api::info::runtime_settings::InstallationSet;
+use pkg_schema::{definitions::Erase, Object};
+use sdk::api::{
+    dry_run::Downtime,
+    info::{
+        runtime_settings::InstallationSet,
+        settings::{InstallModes, RawErase},
+    },
+};
 use slog_scope::error;
-use std::{fs, io, path::Path};
+use std::{
+    fs, io,
+    path::Path,
+    time::{Duration, SystemTime},
+};
 use thiserror::Error;
 use walkdir::WalkDir;
 
@@ -32,17 +44,49 @@ pub enum Error {
     #[error(transparent)]
     CloudSDK(#[from] cloud::Error),
 
-    #[error("Incompatible with hardware: {0}")]
-    IncompatibleHardware(String),
+    #[error("Incompatible with hardware: {hardware}, the package supports {supported}")]
+    IncompatibleHardware { hardware: String, supported: String },
+
+    #[error("Invalid supported hardware pattern: {0}")]
+    InvalidHardwarePattern(String),
+
+    #[error("Incompatible with agent version {current}, {required} or newer is required")]
+    IncompatibleAgent { required: String, current: String },
+
+    #[error("Invalid agent version requirement: {0}")]
+    InvalidAgentRequirement(String),
+
+    #[error("Security version {version} is lower than the device's {current}")]
+    SecurityVersionTooLow { version: u64, current: u64 },
+
+    #[error("Script executable {0} isn't an object of the package")]
+    UnknownScriptExecutable(String),
 }
 
 pub(crate) trait UpdatePackageExt {
     fn compatible_with(&self, firmware: &Metadata) -> Result<()>;
 
+    fn check_security_version(&self, current: u64) -> Result<()>;
+
     fn objects(&self, installation_set: Set) -> &Vec<Object>;
 
     fn objects_mut(&mut self, installation_set: Set) -> &mut Vec<Object>;
 
+    fn retain_role_objects(&mut self, role: Option<&str>);
+
+    fn apply_install_mode_defaults(&mut self, defaults: &InstallModes);
+
+    fn estimated_downtime(&self, settings: &Settings, installation_set: Set) -> Downtime;
+
+    fn download_timeout(&self, settings: &Settings) -> Duration;
+
+    fn install_timeout(
+        &self,
+        settings: &Settings,
+        installation_set: Set,
+        object: &Object,
+    ) -> Duration;
+
     fn filter_objects(
         &self,
         settings: &Settings,
@@ -60,7 +104,23 @@ pub(crate) trait UpdatePackageExt {
 
 impl UpdatePackageExt for UpdatePackage {
     fn compatible_with(&self, firmware: &Metadata) -> Result<()> {
-        self.inner.supported_hardware.compatible_with(&firmware.hardware)
+        self.inner.supported_hardware.compatible_with(&firmware.hardware)?;
+        if let Some(requirement) = &self.inner.requires_agent {
+            agent_version::check(requirement, crate::version())?;
+        }
+        check_script_executables(&self.inner.objects.0)?;
+        check_script_executables(&self.inner.objects.1)?;
+        Ok(())
+    }
+
+    /// Refuses the package if it would downgrade the device to a lower
+    /// security version, unless the downgrade is allowed by it.
+    fn check_security_version(&self, current: u64) -> Result<()> {
+        let version = self.inner.security_version;
+        if version < current && !self.inner.allow_downgrade {
+            return Err(Error::SecurityVersionTooLow { version, current });
+        }
+        Ok(())
     }
 
     fn objects(&self, installation_set: Set) -> &Vec<Object> {
@@ -77,6 +137,93 @@ impl UpdatePackageExt for UpdatePackage {
         }
     }
 
+    /// Drops the objects meant for devices of other roles, so a package
+    /// serves a machine composed of several boards.
+    fn retain_role_objects(&mut self, role: Option<&str>) {
+        let for_role = |object: &Object| {
+            let roles = object::roles(object);
+            roles.is_empty() || role.map_or(false, |role| roles.iter().any(|r| r == role))
+        };
+        self.inner.objects.0.retain(for_role);
+        self.inner.objects.1.retain(for_role);
+    }
+
+    /// Takes the install modes defaults of the device for the settings
+    /// the objects leave unset in the package metadata. The objects are
+    /// matched to their metadata by position, so it must be done before
+    /// they are filtered.
+    fn apply_install_mode_defaults(&mut self, defaults: &InstallModes) {
+        let metadata = serde_json::from_slice::<serde_json::Value>(&self.raw).unwrap_or_default();
+        let sets = vec![&mut self.inner.objects.0, &mut self.inner.objects.1];
+        for (set, objects) in sets.into_iter().enumerate() {
+            for (idx, object) in objects.iter_mut().enumerate() {
+                let unset = |field: &str| metadata["objects"][set][idx].get(field).is_none();
+                apply_mode_defaults(object, defaults, unset);
+            }
+        }
+    }
+
+    /// Time the objects are given to be downloaded, as set by the package
+    /// or, otherwise, by the device. A zero timeout never expires.
+    fn download_timeout(&self, settings: &Settings) -> Duration {
+        match self.inner.download_timeout {
+            Some(secs) => Duration::from_secs(secs),
+            None => settings.download.timeout.to_std().unwrap_or_default(),
+        }
+    }
+
+    /// Time the `object` is given to be installed, as set by the object,
+    /// by the package or, otherwise, by the device. A zero timeout never
+    /// expires.
+    fn install_timeout(
+        &self,
+        settings: &Settings,
+        installation_set: Set,
+        object: &Object,
+    ) -> Duration {
+        // The objects may have been filtered since the package has been
+        // parsed, so they are matched to their metadata by content.
+        let metadata = serde_json::from_slice::<serde_json::Value>(&self.raw).unwrap_or_default();
+        let set = match installation_set.0 {
+            InstallationSet::A => 0,
+            InstallationSet::B => 1,
+        };
+        let object_timeout = metadata["objects"][set]
+            .as_array()
+            .and_then(|objects| {
+                objects.iter().find(|o| {
+                    o["sha256sum"] == object.sha256sum() && o["filename"] == object.filename()
+                })
+            })
+            .and_then(|o| o["install-timeout"].as_u64());
+        match object_timeout.or(self.inner.install_timeout) {
+            Some(secs) => Duration::from_secs(secs),
+            None => settings.update.install_timeout.to_std().unwrap_or_default(),
+        }
+    }
+
+    /// Estimates how long the device is unavailable while the package is
+    /// installed and activated: the install of the objects which aren't
+    /// installed live, the reboot and the time the new installation has
+    /// to be confirmed in.
+    fn estimated_downtime(&self, settings: &Settings, installation_set: Set) -> Downtime {
+        let rate = settings.downtime.install_rate.max(1);
+        let size = self
+            .objects(installation_set)
+            .iter()
+            .filter(|o| !settings.downtime.live_modes.iter().any(|mode| mode == object::mode(o)))
+            .map(Info::required_install_size)
+            .sum::<u64>();
+        let install = size / rate + if size % rate == 0 { 0 } else { 1 };
+        let reboot = settings.downtime.reboot.num_seconds().max(0) as u64;
+        let soak = match settings.boot_confirmation.enabled {
+            true => settings.boot_confirmation.timeout.num_seconds().max(0) as u64,
+            false => 0,
+        };
+
+        Downtime { install, reboot, soak, total: install + reboot + soak }
+    }
+
     fn filter_objects(
         &self,
         settings: &Settings,
@@ -102,7 +249,12 @@ impl UpdatePackageExt for UpdatePackage {
         installation_set: Set,
         settings: &Settings,
     ) -> io::Result<()> {
-        // Prune left over objects from previous installations
+        let in_use =
+            self.objects(installation_set).iter().map(object::Info::sha256sum).collect::<Vec<_>>();
+
+        // Prune left over files from previous installations, keeping the
+        // validators and segments used to resume the download of the
+        // current objects, and the complete objects, which are cached
         for entry in WalkDir::new(dir)
             .follow_links(true)
             .min_depth(1)
@@ -110,16 +262,24 @@ impl UpdatePackageExt for UpdatePackage {
             .filter_entry(|e| e.file_type().is_file())
             .filter_map(std::result::Result::ok)
             .filter(|e| {
-                !self
-                    .objects(installation_set)
-                    .iter()
-                    .map(object::Info::sha256sum)
-                    .any(|x| x == e.file_name())
+                let name = e.file_name().to_string_lossy();
+                !cache::is_object(&name)
+                    && !in_use.iter().any(|x| name == *x || name.starts_with(&format!("{}.", x)))
             })
         {
             fs::remove_file(entry.path())?;
         }
 
+        // The objects of the package found in the cache are reused, while
+        // the other cached ones are collected
+        for sha256sum in &in_use {
+            let object = dir.join(sha256sum);
+            if object.exists() {
+                cache::touch(&object)?;
+            }
+        }
+        cache::collect(dir, &in_use, &settings.download, SystemTime::now())?;
+
         // Cleanup metadata and signature for older local local installation
         for file in &[dir.join("metadata"), dir.join("signature")] {
             if file.exists() {
@@ -132,8 +292,67 @@ impl UpdatePackageExt for UpdatePackage {
             self.filter_objects(&settings, installation_set, object::info::Status::Corrupted)
         {
             fs::remove_file(dir.join(object.sha256sum()))?;
+
+            let validator = dir.join(format!("{}.etag", object.sha256sum()));
+            if validator.exists() {
+                fs::remove_file(validator)?;
+            }
         }
 
         Ok(())
     }
 }
+
+// The executable of a script object is taken from the objects of its
+// installation set, by its checksum, so only the executables the package
+// has been signed with are run.
+fn check_script_executables(objects: &[Object]) -> Result<()> {
+    for obj in objects {
+        if let Object::Script(script) = obj {
+            if !objects.iter().any(|o| o.sha256sum() == script.executable) {
+                return Err(Error::UnknownScriptExecutable(script.executable.clone()));
+            }
+        }
+    }
+    Ok(())
+}
+
+fn apply_mode_defaults(object: &mut Object, defaults: &InstallModes, unset: impl Fn(&str) -> bool) {
+    match object {
+        Object::Copy(o) => {
+            if let (true, Some(options)) = (unset("mount-options"), &defaults.copy.mount_options) {
+                o.mount_options = options.clone();
+            }
+        }
+        Object::Flash(o) => {
+            if o.erase.is_none() {
+                o.erase = defaults.flash.erase;
+            }
+        }
+        Object::Raw(o) => {
+            if let (true, Some(chunk_size)) = (unset("chunk-size"), defaults.raw.chunk_size) {
+                o.chunk_size = pkg_schema::definitions::ChunkSize(chunk_size);
+            }
+            if o.erase.is_none() {
+                o.erase = defaults.raw.erase.map(|erase| match erase {
+                    RawErase::None => Erase::None,
+                    RawErase::Discard => Erase::Discard,
+                    RawErase::WriteZeroes => Erase::WriteZeroes,
+                });
+            }
+        }
+        Object::Tarball(o) => {
+            if let (true, Some(options)) = (unset("mount-options"), &defaults.tarball.mount_options)
+            {
+                o.mount_options = options.clone();
+            }
+        }
+        Object::Agent(_)
+        | Object::DiskImage(_)
+        | Object::Fpga(_)
+        | Object::Imxkobs(_)
+        | Object::Script(_)
+        | Object::Test(_)
+        | Object::Ubifs(_) => {}
+    }
+}
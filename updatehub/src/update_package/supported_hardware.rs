@@ -4,7 +4,10 @@
 
 use super::Error;
 
-pub(crate) use pkg_schema::SupportedHardware;
+pub(crate) use pkg_schema::{Hardware, SupportedHardware};
+
+// Separates the hardware name from its revision, in the device hardware.
+const REVISION_SEPARATOR: &str = "-rev";
 
 pub(crate) trait SupportedHardwareExt {
     fn compatible_with(&self, hardware: &str) -> Result<(), Error>;
@@ -12,16 +15,150 @@ pub(crate) trait SupportedHardwareExt {
 
 impl SupportedHardwareExt for SupportedHardware {
     fn compatible_with(&self, hardware: &str) -> Result<(), Error> {
-        let hardware = hardware.to_string();
-        let compatible = match self {
-            SupportedHardware::Any => true,
-            SupportedHardware::HardwareList(l) => l.contains(&hardware),
+        let list = match self {
+            SupportedHardware::Any => return Ok(()),
+            SupportedHardware::HardwareList(l) => l,
         };
 
-        if !compatible {
-            return Err(Error::IncompatibleHardware(hardware));
+        for supported in list {
+            if matches_hardware(supported, hardware)? {
+                return Ok(());
+            }
         }
 
-        Ok(())
+        Err(Error::IncompatibleHardware {
+            hardware: hardware.to_owned(),
+            supported: list.iter().map(describe).collect::<Vec<_>>().join(", "),
+        })
+    }
+}
+
+fn matches_hardware(supported: &Hardware, hardware: &str) -> Result<bool, Error> {
+    match supported {
+        Hardware::Name(name) if name.starts_with('/') && name.ends_with('/') && name.len() > 1 => {
+            matches_pattern(&format!("^(?:{})$", &name[1..name.len() - 1]), name, hardware)
+        }
+        Hardware::Name(name) if name.contains(|c: char| c == '*' || c == '?' || c == '[') => {
+            matches_pattern(&glob_to_regex(name), name, hardware)
+        }
+        Hardware::Name(name) => Ok(name == hardware),
+        Hardware::Revisions { hardware: name, revisions } => {
+            let prefix = format!("{}{}", name, REVISION_SEPARATOR);
+            if !hardware.starts_with(&prefix) {
+                return Ok(false);
+            }
+            let revision = &hardware[prefix.len()..];
+            Ok(revisions.iter().any(|r| matches_revision(r, revision)))
+        }
+    }
+}
+
+fn matches_pattern(regex: &str, pattern: &str, hardware: &str) -> Result<bool, Error> {
+    let re = regex::Regex::new(regex)
+        .map_err(|e| Error::InvalidHardwarePattern(format!("{}: {}", pattern, e)))?;
+    Ok(re.is_match(hardware))
+}
+
+// A numeric range, as `2-4`, holds its bounds, while anything else is
+// matched as is.
+fn matches_revision(supported: &str, revision: &str) -> bool {
+    let mut bounds = supported.splitn(2, '-');
+    let range = (bounds.next(), bounds.next(), revision.parse::<u64>());
+    if let (Some(first), Some(last), Ok(revision)) = range {
+        if let (Ok(first), Ok(last)) = (first.parse::<u64>(), last.parse::<u64>()) {
+            return first <= revision && revision <= last;
+        }
+    }
+    supported == revision
+}
+
+fn glob_to_regex(glob: &str) -> String {
+    let mut re = String::from("^");
+    let mut in_class = false;
+    let mut chars = glob.chars().peekable();
+    while let Some(c) = chars.next() {
+        match (in_class, c) {
+            (false, '*') => re.push_str(".*"),
+            (false, '?') => re.push('.'),
+            (false, '[') => {
+                in_class = true;
+                re.push('[');
+                if chars.peek() == Some(&'!') {
+                    chars.next();
+                    re.push('^');
+                }
+            }
+            (true, ']') => {
+                in_class = false;
+                re.push(']');
+            }
+            (true, '\\') | (true, '[') => {
+                re.push('\\');
+                re.push(c);
+            }
+            (true, c) => re.push(c),
+            (false, c) => re.push_str(&regex::escape(&c.to_string())),
+        }
+    }
+    re.push('$');
+    re
+}
+
+fn describe(supported: &Hardware) -> String {
+    match supported {
+        Hardware::Name(name) => name.clone(),
+        Hardware::Revisions { hardware, revisions } => {
+            format!("{} (revisions {})", hardware, revisions.join(", "))
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn supported(list: Vec<Hardware>) -> SupportedHardware {
+        SupportedHardware::HardwareList(list)
+    }
+
+    #[test]
+    fn match_names_and_patterns() {
+        assert!(SupportedHardware::Any.compatible_with("board").is_ok());
+        assert!(supported(vec!["board".into()]).compatible_with("board").is_ok());
+        assert!(supported(vec!["board".into()]).compatible_with("board-2").is_err());
+
+        let glob = supported(vec!["board-rev[2-4]".into(), "other-*".into()]);
+        assert!(glob.compatible_with("board-rev3").is_ok());
+        assert!(glob.compatible_with("board-rev5").is_err());
+        assert!(glob.compatible_with("other-board").is_ok());
+        assert!(supported(vec!["board.?".into()]).compatible_with("boardx1").is_err());
+
+        let regex = supported(vec!["/board-rev(1|[3-9])/".into()]);
+        assert!(regex.compatible_with("board-rev7").is_ok());
+        assert!(regex.compatible_with("board-rev2").is_err());
+        assert!(regex.compatible_with("board-rev77").is_err());
+        assert!(supported(vec!["/board(/".into()]).compatible_with("board").is_err());
+    }
+
+    #[test]
+    fn match_revisions() {
+        let revisions = supported(vec![Hardware::Revisions {
+            hardware: "board".to_owned(),
+            revisions: vec!["1".to_owned(), "3-12".to_owned(), "b".to_owned()],
+        }]);
+        assert!(revisions.compatible_with("board-rev1").is_ok());
+        assert!(revisions.compatible_with("board-rev10").is_ok());
+        assert!(revisions.compatible_with("board-revb").is_ok());
+        assert!(revisions.compatible_with("board-rev2").is_err());
+        assert!(revisions.compatible_with("other-rev1").is_err());
+
+        match revisions.compatible_with("board-rev13") {
+            Err(Error::IncompatibleHardware { hardware, supported }) => {
+                assert_eq!(hardware, "board-rev13");
+                assert_eq!(supported, "board (revisions 1, 3-12, b)");
+            }
+            res => panic!("Unexpected result: {:?}", res),
+        }
     }
 }
@@ -116,3 +116,144 @@ fn complete_object_file() {
         1
     );
 }
+
+#[test]
+fn retain_objects_for_role() {
+    let mut json = get_update_json(SHA256SUM);
+    let object = json["objects"][0][0].clone();
+    let mut display = object.clone();
+    display["filename"] = json!("display");
+    display["roles"] = json!(["display-unit"]);
+    let mut compute = object.clone();
+    compute["filename"] = json!("compute");
+    compute["roles"] = json!(["compute-unit"]);
+    json["objects"][0] = json!([object, display, compute]);
+    let package = UpdatePackage::parse(&json.to_string().into_bytes()).unwrap();
+    let filenames = |package: &UpdatePackage| {
+        package
+            .objects(Set(InstallationSet::A))
+            .iter()
+            .map(|o| o.filename().to_owned())
+            .collect::<Vec<_>>()
+    };
+
+    let mut display_unit = UpdatePackage::parse(&package.raw).unwrap();
+    display_unit.retain_role_objects(Some("display-unit"));
+    assert_eq!(filenames(&display_unit), vec!["testfile", "display"]);
+
+    let mut no_role = UpdatePackage::parse(&package.raw).unwrap();
+    no_role.retain_role_objects(None);
+    assert_eq!(filenames(&no_role), vec!["testfile"]);
+}
+
+#[test]
+fn estimate_downtime() {
+    let package = get_update_package();
+    let mut settings = Settings::default();
+    settings.downtime.install_rate = 4;
+    settings.downtime.reboot = chrono::Duration::seconds(30);
+
+    let downtime = package.estimated_downtime(&settings, Set(InstallationSet::A));
+    assert_eq!(downtime, Downtime { install: 3, reboot: 30, soak: 0, total: 33 });
+
+    // The objects installed live don't keep the device unavailable
+    settings.downtime.live_modes = vec!["test".to_owned()];
+    settings.boot_confirmation.enabled = true;
+    settings.boot_confirmation.timeout = chrono::Duration::minutes(5);
+    let downtime = package.estimated_downtime(&settings, Set(InstallationSet::A));
+    assert_eq!(downtime, Downtime { install: 0, reboot: 30, soak: 300, total: 330 });
+}
+
+#[test]
+fn install_mode_defaults() {
+    let mut json = get_update_json(SHA256SUM);
+    let raw = json!({
+        "mode": "raw",
+        "filename": "rootfs",
+        "target-type": "device",
+        "target": "/dev/sda1",
+        "sha256sum": SHA256SUM,
+        "size": 10
+    });
+    let mut tuned = raw.clone();
+    tuned["chunk-size"] = json!(512);
+    tuned["erase"] = json!("none");
+    json["objects"][0] = json!([raw, tuned]);
+    let mut package = UpdatePackage::parse(&json.to_string().into_bytes()).unwrap();
+    let mut defaults = InstallModes::default();
+    defaults.raw.chunk_size = Some(4096);
+    defaults.raw.erase = Some(sdk::api::info::settings::RawErase::Discard);
+
+    package.apply_install_mode_defaults(&defaults);
+    let modes = package
+        .objects(Set(InstallationSet::A))
+        .iter()
+        .map(|o| match o {
+            Object::Raw(o) => (o.chunk_size.0, o.erase),
+            o => panic!("Unexpected object: {:?}", o),
+        })
+        .collect::<Vec<_>>();
+    // The package metadata takes precedence over the device defaults
+    assert_eq!(
+        modes,
+        vec![
+            (4096, Some(pkg_schema::definitions::Erase::Discard)),
+            (512, Some(pkg_schema::definitions::Erase::None))
+        ]
+    );
+}
+
+#[test]
+fn object_and_package_timeouts() {
+    let mut json = get_update_json(SHA256SUM);
+    json["install-timeout"] = json!(120);
+    json["objects"][0][0]["install-timeout"] = json!(30);
+    let package = UpdatePackage::parse(&json.to_string().into_bytes()).unwrap();
+    let mut settings = Settings::default();
+    settings.update.install_timeout = chrono::Duration::seconds(600);
+    settings.download.timeout = chrono::Duration::seconds(900);
+
+    // The object takes precedence over the package, which takes precedence
+    // over the device
+    let object = &package.objects(Set(InstallationSet::A))[0];
+    assert_eq!(
+        package.install_timeout(&settings, Set(InstallationSet::A), object),
+        Duration::from_secs(30)
+    );
+    let object = &package.objects(Set(InstallationSet::B))[0];
+    assert_eq!(
+        package.install_timeout(&settings, Set(InstallationSet::B), object),
+        Duration::from_secs(120)
+    );
+    assert_eq!(package.download_timeout(&settings), Duration::from_secs(900));
+
+    let package = get_update_package();
+    assert_eq!(
+        package.install_timeout(&settings, Set(InstallationSet::B), object),
+        Duration::from_secs(600)
+    );
+}
+
+#[test]
+fn script_executable_from_package() {
+    let mut json = get_update_json(SHA256SUM);
+    let script = json!({
+        "mode": "script",
+        "filename": "firmware.bin",
+        "sha256sum": SHA256SUM,
+        "size": 10,
+        "executable": SHA256SUM
+    });
+    json["objects"][0] = json!([script]);
+    let package = UpdatePackage::parse(&json.to_string().into_bytes()).unwrap();
+    assert!(check_script_executables(package.objects(Set(InstallationSet::A))).is_ok());
+
+    // The executable must be taken from the objects of the package
+    let unknown = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855";
+    json["objects"][0][0]["executable"] = json!(unknown);
+    let package = UpdatePackage::parse(&json.to_string().into_bytes()).unwrap();
+    match check_script_executables(package.objects(Set(InstallationSet::A))) {
+        Err(Error::UnknownScriptExecutable(executable)) => assert_eq!(executable, unknown),
+        res => panic!("Unexpected result: {:?}", res),
+    }
+}
@@ -0,0 +1,260 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Replacement of the running agent by the binary of an update package.
+//! The new binary is only swapped in once it answers a handshake, and the
+//! previous one is restored when the new agent doesn't become healthy.
+
+use super::{Error, Result};
+use lazy_static::lazy_static;
+use slog_scope::{error, info, warn};
+use std::{
+    env,
+    ffi::CString,
+    fs,
+    io::{self, Read},
+    os::unix::{ffi::OsStringExt, fs::PermissionsExt},
+    path::{Path, PathBuf},
+    process::{Command, Stdio},
+    thread,
+    time::{Duration, Instant},
+};
+
+const HANDSHAKE_TIMEOUT: Duration = Duration::from_secs(30);
+// Starts of the updated agent, each ended by a crash, before it is
+// rolled back.
+const MAX_STARTS: u32 = 3;
+/// Status the agent exits with to be restarted by the service manager,
+/// when it can't restart itself.
+pub(crate) const RESTART_EXIT_STATUS: i32 = 75;
+
+lazy_static! {
+    // Taken before the binary is replaced, as the link to the running
+    // executable points to the removed file afterwards.
+    static ref EXECUTABLE: Option<PathBuf> = env::current_exe().ok();
+}
+
+/// Line the agent answers the handshake for the `nonce` with.
+pub fn handshake_reply(nonce: &str) -> String {
+    format!("updatehub-agent-check {} {}", nonce, crate::version())
+}
+
+/// Replaces the running agent by the binary at `source`, once it has
+/// answered the handshake. The running agent is kept until the new one
+/// is confirmed as healthy.
+pub(crate) fn replace(source: &Path) -> Result<()> {
+    let executable = executable()?;
+    let staging = sibling(&executable, "new");
+    fs::copy(source, &staging)?;
+    fs::set_permissions(&staging, fs::Permissions::from_mode(0o755))?;
+    fs::File::open(&staging)?.sync_all()?;
+    if let Err(e) = handshake(&staging) {
+        let _ = fs::remove_file(&staging);
+        return Err(e);
+    }
+
+    let backup = sibling(&executable, "previous");
+    if backup.exists() {
+        fs::remove_file(&backup)?;
+    }
+    fs::hard_link(&executable, &backup)?;
+    fs::write(sibling(&executable, "pending"), "0")?;
+    fs::rename(&staging, &executable)?;
+    if let Some(dir) = executable.parent() {
+        fs::File::open(dir)?.sync_all()?;
+    }
+    info!("agent binary {:?} has been replaced", executable);
+
+    Ok(())
+}
+
+/// Counts the starts of an agent which has just been replaced, rolling
+/// it back once it has failed to become healthy too many times.
+pub(crate) fn check_pending() -> Result<()> {
+    let executable = executable()?;
+    let marker = sibling(&executable, "pending");
+    let starts = match fs::read_to_string(&marker) {
+        Ok(starts) => starts.trim().parse::<u32>().unwrap_or(MAX_STARTS),
+        Err(e) if e.kind() == io::ErrorKind::NotFound => return Ok(()),
+        Err(e) => return Err(e.into()),
+    };
+
+    if starts >= MAX_STARTS {
+        error!("updated agent has failed to start {} times, rolling it back", starts);
+        return rollback(&executable);
+    }
+    fs::write(&marker, (starts + 1).to_string())?;
+    Ok(())
+}
+
+/// Rolls the updated agent back when it isn't confirmed as healthy in
+/// `timeout`. It is watched from its own thread, so a stuck agent is
+/// rolled back too.
+pub(crate) fn watch_health(timeout: Duration) {
+    let executable = match executable() {
+        Ok(executable) => executable,
+        Err(_) => return,
+    };
+    if !sibling(&executable, "pending").exists() {
+        return;
+    }
+
+    info!("waiting up to {} seconds for the updated agent to become healthy", timeout.as_secs());
+    thread::spawn(move || {
+        thread::sleep(timeout);
+        if sibling(&executable, "pending").exists() {
+            error!("updated agent hasn't become healthy in time, rolling it back");
+            if let Err(e) = rollback(&executable) {
+                error!("failed to roll the agent back: {}", e);
+            }
+        }
+    });
+}
+
+/// Keeps the updated agent, now it is healthy.
+pub(crate) fn confirm() {
+    let executable = match executable() {
+        Ok(executable) => executable,
+        Err(_) => return,
+    };
+    let marker = sibling(&executable, "pending");
+    if !marker.exists() {
+        return;
+    }
+
+    info!("updated agent is healthy");
+    for file in &[marker, sibling(&executable, "previous")] {
+        if let Err(e) = fs::remove_file(file) {
+            warn!("failed to remove {:?}: {}", file, e);
+        }
+    }
+}
+
+/// Restarts the agent from its binary. The process is kept, so the
+/// service manager doesn't see it exiting, unless the privileges are
+/// separated: the agent couldn't start the installer again, so it exits
+/// to be restarted by the service manager, and the installer exits along
+/// once its socket is closed.
+pub(crate) fn restart() -> Result<()> {
+    if super::privsep::is_separated() {
+        info!("exiting for the service manager to restart the agent");
+        std::process::exit(RESTART_EXIT_STATUS);
+    }
+
+    let executable = cstring(executable()?.into_os_string().into_vec())?;
+    let args = env::args_os().map(|arg| cstring(arg.into_vec())).collect::<Result<Vec<_>>>()?;
+    info!("restarting the agent");
+    nix::unistd::execv(&executable, &args)?;
+    unreachable!("execv only returns on failure");
+}
+
+fn rollback(executable: &Path) -> Result<()> {
+    fs::rename(sibling(executable, "previous"), executable)?;
+    fs::remove_file(sibling(executable, "pending"))?;
+    restart()
+}
+
+// Runs the `binary` asking it to answer with a random nonce, which only a
+// working agent does.
+fn handshake(binary: &Path) -> Result<()> {
+    let mut nonce = [0; 16];
+    openssl::rand::rand_bytes(&mut nonce)?;
+    let nonce = super::hex_encode(&nonce);
+
+    let mut child = Command::new(binary)
+        .args(&["agent-check", &nonce])
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .spawn()?;
+    let started = Instant::now();
+    let status = loop {
+        if let Some(status) = child.try_wait()? {
+            break status;
+        }
+        if started.elapsed() > HANDSHAKE_TIMEOUT {
+            let _ = child.kill();
+            let _ = child.wait();
+            return Err(Error::AgentCheckFailed("handshake has timed out".to_owned()));
+        }
+        thread::sleep(Duration::from_millis(100));
+    };
+
+    let mut output = String::new();
+    child.stdout.take().expect("stdout is piped").read_to_string(&mut output)?;
+    let reply = output.lines().last().unwrap_or_default();
+    if !status.success() || !reply.starts_with(&format!("updatehub-agent-check {} ", nonce)) {
+        return Err(Error::AgentCheckFailed(format!("unexpected handshake reply: {}", reply)));
+    }
+    info!("new agent has answered the handshake: {}", reply);
+
+    Ok(())
+}
+
+fn executable() -> Result<PathBuf> {
+    EXECUTABLE.clone().ok_or_else(|| {
+        io::Error::new(io::ErrorKind::NotFound, "unable to find the agent executable").into()
+    })
+}
+
+// The files are kept along the binary, as `.updatehub.new`, so they are
+// renamed within the same filesystem.
+fn sibling(executable: &Path, suffix: &str) -> PathBuf {
+    let name = executable.file_name().unwrap_or_default().to_string_lossy();
+    executable.with_file_name(format!(".{}.{}", name, suffix))
+}
+
+fn cstring(bytes: Vec<u8>) -> Result<CString> {
+    CString::new(bytes).map_err(|e| io::Error::new(io::ErrorKind::InvalidInput, e).into())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn handshake_with_binary() {
+        let dir = tempfile::tempdir().unwrap();
+        let binary = dir.path().join("updatehub");
+        fs::write(&binary, "#!/bin/sh\necho \"updatehub-agent-check $2 2.0.0\"\n").unwrap();
+        fs::set_permissions(&binary, fs::Permissions::from_mode(0o755)).unwrap();
+        handshake(&binary).unwrap();
+
+        fs::write(&binary, "#!/bin/sh\necho \"updatehub-agent-check wrong 2.0.0\"\n").unwrap();
+        match handshake(&binary) {
+            Err(Error::AgentCheckFailed(_)) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+    }
+
+    #[test]
+    fn restart_through_service_manager() {
+        // The agent exits to be restarted, so it is restarted from a child
+        // running this same test.
+        if env::var_os("UPDATEHUB_TEST_RESTART").is_some() {
+            let (agent, _installer) = std::os::unix::net::UnixStream::pair().unwrap();
+            crate::utils::privsep::attach(agent);
+            let _ = restart();
+            unreachable!("agent has been restarted in place");
+        }
+
+        let status = Command::new(env::current_exe().unwrap())
+            .args(&["utils::agent_update::tests::restart_through_service_manager", "--exact"])
+            .env("UPDATEHUB_TEST_RESTART", "1")
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .status()
+            .unwrap();
+        assert_eq!(status.code(), Some(RESTART_EXIT_STATUS));
+    }
+
+    #[test]
+    fn files_along_the_binary() {
+        assert_eq!(
+            sibling(Path::new("/usr/bin/updatehub"), "pending"),
+            PathBuf::from("/usr/bin/.updatehub.pending")
+        );
+    }
+}
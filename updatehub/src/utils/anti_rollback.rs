@@ -0,0 +1,109 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Security version of the device, below which update packages are
+//! refused. Besides the runtime settings, it may be kept in a bootloader
+//! variable and in a TPM NV index, out of reach of the root filesystem,
+//! the highest of them being taken.
+
+use super::{uboot_env, Result};
+use crate::runtime_settings::RuntimeSettings;
+use sdk::api::info::settings::AntiRollback;
+use slog_scope::{info, warn};
+use std::fs;
+
+/// Raises the security version of the `runtime_settings` to the one kept
+/// out of them, so it isn't lowered by the runtime settings being lost.
+pub(crate) fn load(
+    settings: &AntiRollback,
+    runtime_settings: &mut RuntimeSettings,
+) -> crate::runtime_settings::Result<()> {
+    let stored = [read_bootloader(settings), read_tpm(settings)]
+        .iter()
+        .filter_map(|version| match version {
+            Ok(version) => *version,
+            Err(e) => {
+                warn!("failed to read the security version: {}", e);
+                None
+            }
+        })
+        .max();
+
+    match stored {
+        Some(version) if version > runtime_settings.security_version() => {
+            info!("raising the security version to {}", version);
+            runtime_settings.set_security_version(version)
+        }
+        _ => Ok(()),
+    }
+}
+
+/// Keeps the security `version` out of the runtime settings, once the
+/// update has been booted into.
+pub(crate) fn store(settings: &AntiRollback, version: u64) -> Result<()> {
+    if let Some(ref variable) = settings.bootloader_variable {
+        uboot_env::set(variable, &version.to_string())?;
+    }
+    if let Some(ref index) = settings.tpm_nv_index {
+        let file = tempfile::NamedTempFile::new()?;
+        fs::write(file.path(), version.to_be_bytes())?;
+        easy_process::run(&format!("tpm2_nvwrite {} -i {:?}", index, file.path()))?;
+    }
+    Ok(())
+}
+
+fn read_bootloader(settings: &AntiRollback) -> Result<Option<u64>> {
+    let variable = match settings.bootloader_variable {
+        Some(ref variable) => variable,
+        None => return Ok(None),
+    };
+
+    // The variable is unset until the first update is committed.
+    Ok(uboot_env::get(variable)?.and_then(|version| version.trim().parse().ok()))
+}
+
+fn read_tpm(settings: &AntiRollback) -> Result<Option<u64>> {
+    let index = match settings.tpm_nv_index {
+        Some(ref index) => index,
+        None => return Ok(None),
+    };
+
+    let file = tempfile::NamedTempFile::new()?;
+    easy_process::run(&format!("tpm2_nvread {} -s 8 -o {:?}", index, file.path()))?;
+    let data = fs::read(file.path())?;
+    Ok(data.get(..8).map(|data| {
+        let mut buf = [0; 8];
+        buf.copy_from_slice(data);
+        u64::from_be_bytes(buf)
+    }))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn load_stored_version() {
+        uboot_env::tests::fake_env();
+        uboot_env::set("security_version", "5").unwrap();
+
+        let mut runtime_settings = RuntimeSettings::default();
+        runtime_settings.set_security_version(2).unwrap();
+        load(&AntiRollback::default(), &mut runtime_settings).unwrap();
+        assert_eq!(runtime_settings.security_version(), 2);
+
+        let settings = AntiRollback {
+            bootloader_variable: Some("security_version".to_owned()),
+            tpm_nv_index: None,
+        };
+        load(&settings, &mut runtime_settings).unwrap();
+        assert_eq!(runtime_settings.security_version(), 5);
+
+        // It is never lowered by the stored one
+        runtime_settings.set_security_version(7).unwrap();
+        load(&settings, &mut runtime_settings).unwrap();
+        assert_eq!(runtime_settings.security_version(), 7);
+    }
+}
@@ -0,0 +1,613 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use lazy_static::lazy_static;
+use sdk::api::info::settings::Extraction;
+use slog_scope::{debug, warn};
+use std::{
+    ffi::{CStr, CString, OsStr},
+    fmt,
+    fs::File,
+    io::{self, Read, Seek, SeekFrom, Write},
+    os::{
+        raw::{c_char, c_int, c_void},
+        unix::ffi::OsStrExt,
+    },
+    path::{Component, Path, PathBuf},
+    ptr,
+    sync::RwLock,
+};
+
+lazy_static! {
+    // Set from the extraction settings before installing, as the
+    // installers are not given the settings.
+    static ref LIMITS: RwLock<Extraction> = RwLock::default();
+}
+
+/// Failure of libarchive along with where it has happened, so a
+/// corrupted package can be told apart from a failure of the device
+/// from the report alone.
+#[derive(Debug)]
+pub struct ArchiveError {
+    /// What was being done with the archive.
+    pub operation: &'static str,
+    pub archive: PathBuf,
+    /// Entry being extracted, when a single entry is extracted.
+    pub entry: Option<String>,
+    /// Bytes of the archive read until the failure. As libarchive reads
+    /// ahead, the failure is within the last block read.
+    pub processed: u64,
+    /// Error number of the system call which has failed, if any.
+    pub errno: Option<i32>,
+    pub error: compress_tools::Error,
+}
+
+impl fmt::Display for ArchiveError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "{} of {:?}", self.operation, self.archive)?;
+        if let Some(entry) = &self.entry {
+            write!(f, " (entry {:?})", entry)?;
+        }
+        write!(f, " has failed after {} bytes", self.processed)?;
+        if let Some(errno) = self.errno {
+            write!(f, " (errno {})", errno)?;
+        }
+        write!(f, ": {}", self.error)
+    }
+}
+
+impl std::error::Error for ArchiveError {}
+
+/// Uncompresses the data of the `archive`, read from `input`, into
+/// `output`, returning how many bytes have been written.
+pub(crate) fn uncompress_data<R: Read, W: Write>(
+    archive: &Path,
+    input: R,
+    output: W,
+) -> Result<usize> {
+    let mut input = CountingReader { inner: input, read: 0 };
+    compress_tools::uncompress_data(&mut input, output)
+        .map_err(|e| archive_error("uncompression", archive, None, input.read, e))
+}
+
+pub(crate) fn set_limits(limits: &Extraction) {
+    *LIMITS.write().expect("poisoned extraction limits lock") = limits.clone();
+}
+
+/// Extracts the `archive` into `dest`, within the extraction limits.
+/// Every entry is checked as it is extracted, so none is written outside
+/// `dest`, either by its own path or through a symlink on the way to it,
+/// be it extracted before or already found on the target filesystem.
+/// Those are only logged when lenient paths are enabled, for legacy
+/// packages.
+pub(crate) fn uncompress_archive(
+    archive: &Path,
+    dest: &Path,
+    ownership: compress_tools::Ownership,
+) -> Result<()> {
+    let limits = LIMITS.read().expect("poisoned extraction limits lock").clone();
+    extract(&limits, archive, dest, ownership)
+}
+
+fn extract(
+    limits: &Extraction,
+    archive: &Path,
+    dest: &Path,
+    ownership: compress_tools::Ownership,
+) -> Result<()> {
+    let limit = expansion_limit(limits, archive)?;
+    let mut extractor = Extractor::open(archive, ownership)
+        .map_err(|e| archive_error("extraction", archive, None, 0, e.into()))?;
+    let fail = |extractor: &Extractor, entry: Option<&Path>, e: io::Error| {
+        let entry = entry.map(|e| e.to_string_lossy().into_owned());
+        archive_error("extraction", archive, entry.as_deref(), extractor.processed(), e.into())
+    };
+
+    let mut count = 0;
+    let mut written = 0;
+    while let Some(entry) = extractor.next_entry().map_err(|e| fail(&extractor, None, e))? {
+        count += 1;
+        if let Some(max) = limits.max_entries.filter(|max| count > *max) {
+            return Err(Error::ExtractionLimitExceeded(format!(
+                "{:?} has more than {} entries",
+                archive, max
+            )));
+        }
+
+        let path = normalize(&entry.path);
+        check_entry(limits, archive, dest, &path, &entry)?;
+        extractor
+            .write_entry(&dest.join(&path), entry.hardlink.map(|l| dest.join(normalize(&l))))
+            .map_err(|e| fail(&extractor, Some(&path), e))?;
+        while let Some(len) = extractor.copy_data().map_err(|e| fail(&extractor, Some(&path), e))? {
+            written += len as u64;
+            check_expansion(archive, written, limit)?;
+        }
+        extractor.finish_entry().map_err(|e| fail(&extractor, Some(&path), e))?;
+    }
+    extractor.close().map_err(|e| fail(&extractor, None, e))?;
+
+    debug!("{:?} expands to {} bytes", archive, written);
+    Ok(())
+}
+
+// Checks the entry is extracted inside `dest`. As the symlinks are
+// followed on extraction, the directories on the way to the entry are
+// resolved on the target as it is by then.
+fn check_entry(
+    limits: &Extraction,
+    archive: &Path,
+    dest: &Path,
+    path: &Path,
+    entry: &Entry,
+) -> Result<()> {
+    // Directories already in place, or symlinks to them, are kept.
+    let through = if entry.is_dir { Some(path) } else { path.parent() };
+    let escapes = !is_contained(path)
+        || entry.hardlink.as_ref().map_or(false, |l| !is_contained(l))
+        || !super::fs::resolves_beneath(dest, through.unwrap_or_else(|| Path::new("")))?;
+
+    if escapes {
+        if !limits.lenient_paths {
+            return Err(Error::UnsafeArchivePath(path.display().to_string()));
+        }
+        warn!("{:?} entry of {:?} is extracted outside the target", path, archive);
+    }
+
+    Ok(())
+}
+
+/// Extracts the `entry` of the `archive`, read from `input`, into
+/// `output`, returning how many bytes have been written.
+pub(crate) fn uncompress_archive_file<R: Read + Seek, W: Write>(
+    archive: &Path,
+    input: R,
+    output: W,
+    entry: &str,
+) -> Result<usize> {
+    let mut input = CountingReader { inner: input, read: 0 };
+    compress_tools::uncompress_archive_file(&mut input, output, entry)
+        .map_err(|e| archive_error("extraction", archive, Some(entry), input.read, e))
+}
+
+fn archive_error(
+    operation: &'static str,
+    archive: &Path,
+    entry: Option<&str>,
+    processed: u64,
+    error: compress_tools::Error,
+) -> Error {
+    let errno = match &error {
+        compress_tools::Error::Io(e) => e.raw_os_error(),
+        _ => None,
+    };
+    let error = ArchiveError {
+        operation,
+        archive: archive.to_owned(),
+        entry: entry.map(ToOwned::to_owned),
+        processed,
+        errno,
+        error,
+    };
+    warn!("{}", error);
+    Error::Archive(error)
+}
+
+/// Checks the compressed `source` doesn't expand beyond the limits,
+/// returning its uncompressed size. The content is discarded as soon as
+/// a limit is exceeded, so the check itself can't exhaust the device.
+pub(crate) fn check_compressed(limits: &Extraction, source: &Path) -> Result<u64> {
+    let limit = expansion_limit(limits, source)?;
+    let mut sink = LimitedSink { inner: io::sink(), written: 0, limit };
+    let res = compress_tools::uncompress_data(&mut File::open(source)?, &mut sink);
+    check_expansion(source, sink.written, limit)?;
+    res?;
+
+    debug!("{:?} expands to {} bytes", source, sink.written);
+    Ok(sink.written)
+}
+
+fn expansion_limit(limits: &Extraction, source: &Path) -> Result<u64> {
+    let compressed = source.metadata()?.len();
+    Ok(std::cmp::min(
+        limits.max_uncompressed_size.unwrap_or(u64::MAX),
+        limits.max_expansion_ratio.map_or(u64::MAX, |ratio| compressed.saturating_mul(ratio)),
+    ))
+}
+
+fn check_expansion(source: &Path, written: u64, limit: u64) -> Result<()> {
+    if written > limit {
+        return Err(Error::ExtractionLimitExceeded(format!(
+            "{:?} expands beyond {} bytes",
+            source, limit
+        )));
+    }
+    Ok(())
+}
+
+// Whether the entry is kept inside the directory it is extracted into.
+fn is_contained(entry: &Path) -> bool {
+    entry.components().all(|c| match c {
+        Component::Normal(_) | Component::CurDir => true,
+        Component::RootDir | Component::Prefix(_) | Component::ParentDir => false,
+    })
+}
+
+// Drops the `.` components, so entries can be compared to each other.
+fn normalize(entry: &Path) -> PathBuf {
+    entry.components().filter(|c| *c != Component::CurDir).collect()
+}
+
+struct CountingReader<R> {
+    inner: R,
+    read: u64,
+}
+
+impl<R: Read> Read for CountingReader<R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = self.inner.read(buf)?;
+        self.read += n as u64;
+        Ok(n)
+    }
+}
+
+// libarchive may skip over the entries it doesn't need, so the count
+// follows the position in the archive.
+impl<R: Seek> Seek for CountingReader<R> {
+    fn seek(&mut self, pos: SeekFrom) -> io::Result<u64> {
+        self.read = self.inner.seek(pos)?;
+        Ok(self.read)
+    }
+}
+
+struct LimitedSink<W> {
+    inner: W,
+    written: u64,
+    limit: u64,
+}
+
+impl<W: Write> Write for LimitedSink<W> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.written += buf.len() as u64;
+        if self.written > self.limit {
+            return Err(io::Error::new(io::ErrorKind::Other, "extraction limit exceeded"));
+        }
+        self.inner.write_all(buf)?;
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.inner.flush()
+    }
+}
+
+/// Entry of an archive, as told by its header.
+struct Entry {
+    path: PathBuf,
+    hardlink: Option<PathBuf>,
+    is_dir: bool,
+}
+
+// Size of the blocks the archive is read in.
+const BLOCK_SIZE: usize = 10240;
+
+// Taken from archive.h and archive_entry.h.
+const ARCHIVE_EOF: c_int = 1;
+const ARCHIVE_OK: c_int = 0;
+const ARCHIVE_WARN: c_int = -20;
+const ARCHIVE_EXTRACT_OWNER: c_int = 0x0001;
+const ARCHIVE_EXTRACT_PERM: c_int = 0x0002;
+const ARCHIVE_EXTRACT_TIME: c_int = 0x0004;
+const ARCHIVE_EXTRACT_ACL: c_int = 0x0020;
+const ARCHIVE_EXTRACT_FFLAGS: c_int = 0x0040;
+const ARCHIVE_EXTRACT_XATTR: c_int = 0x0080;
+const AE_IFMT: libc::mode_t = 0o170000;
+const AE_IFDIR: libc::mode_t = 0o040000;
+
+// Extracts the archive an entry at a time, so every entry can be checked
+// before being written. compress-tools only extracts archives as a whole,
+// so libarchive, which it is built on, is used directly.
+struct Extractor {
+    reader: *mut c_void,
+    writer: *mut c_void,
+    entry: *mut c_void,
+}
+
+impl Extractor {
+    fn open(archive: &Path, ownership: compress_tools::Ownership) -> io::Result<Self> {
+        let path = CString::new(archive.as_os_str().as_bytes())?;
+        let mut flags = ARCHIVE_EXTRACT_TIME
+            | ARCHIVE_EXTRACT_PERM
+            | ARCHIVE_EXTRACT_ACL
+            | ARCHIVE_EXTRACT_FFLAGS
+            | ARCHIVE_EXTRACT_XATTR;
+        if let compress_tools::Ownership::Preserve = ownership {
+            flags |= ARCHIVE_EXTRACT_OWNER;
+        }
+
+        unsafe {
+            let extractor = Extractor {
+                reader: archive_read_new(),
+                writer: archive_write_disk_new(),
+                entry: ptr::null_mut(),
+            };
+            if extractor.reader.is_null() || extractor.writer.is_null() {
+                return Err(io::Error::new(io::ErrorKind::Other, "failed to allocate the archive"));
+            }
+            check(extractor.reader, archive_read_support_filter_all(extractor.reader))?;
+            check(extractor.reader, archive_read_support_format_all(extractor.reader))?;
+            check(extractor.writer, archive_write_disk_set_options(extractor.writer, flags))?;
+            check(extractor.writer, archive_write_disk_set_standard_lookup(extractor.writer))?;
+            check(
+                extractor.reader,
+                archive_read_open_filename(extractor.reader, path.as_ptr(), BLOCK_SIZE),
+            )?;
+            Ok(extractor)
+        }
+    }
+
+    fn next_entry(&mut self) -> io::Result<Option<Entry>> {
+        unsafe {
+            if check(self.reader, archive_read_next_header(self.reader, &mut self.entry))?
+                == ARCHIVE_EOF
+            {
+                return Ok(None);
+            }
+            Ok(Some(Entry {
+                path: c_path(archive_entry_pathname(self.entry)).unwrap_or_default(),
+                hardlink: c_path(archive_entry_hardlink(self.entry)),
+                is_dir: archive_entry_filetype(self.entry) & AE_IFMT == AE_IFDIR,
+            }))
+        }
+    }
+
+    // Writes the header of the current entry, as found at `path`.
+    fn write_entry(&mut self, path: &Path, hardlink: Option<PathBuf>) -> io::Result<()> {
+        let path = CString::new(path.as_os_str().as_bytes())?;
+        let hardlink = hardlink.map(|l| CString::new(l.as_os_str().as_bytes())).transpose()?;
+        unsafe {
+            archive_entry_set_pathname(self.entry, path.as_ptr());
+            if let Some(hardlink) = hardlink {
+                archive_entry_set_hardlink(self.entry, hardlink.as_ptr());
+            }
+            check(self.writer, archive_write_header(self.writer, self.entry))?;
+        }
+        Ok(())
+    }
+
+    // Copies the next block of the current entry, returning its length,
+    // or `None` once the entry has been copied whole.
+    fn copy_data(&mut self) -> io::Result<Option<usize>> {
+        let mut buf = ptr::null();
+        let mut len = 0;
+        let mut offset = 0;
+        unsafe {
+            let status = archive_read_data_block(self.reader, &mut buf, &mut len, &mut offset);
+            if check(self.reader, status)? == ARCHIVE_EOF {
+                return Ok(None);
+            }
+            if archive_write_data_block(self.writer, buf, len, offset) < ARCHIVE_WARN as isize {
+                return Err(last_error(self.writer));
+            }
+        }
+        Ok(Some(len))
+    }
+
+    fn finish_entry(&mut self) -> io::Result<()> {
+        unsafe { check(self.writer, archive_write_finish_entry(self.writer)).map(drop) }
+    }
+
+    fn close(&mut self) -> io::Result<()> {
+        unsafe { check(self.writer, archive_write_close(self.writer)).map(drop) }
+    }
+
+    // Bytes of the archive read so far.
+    fn processed(&self) -> u64 {
+        unsafe { archive_filter_bytes(self.reader, -1).max(0) as u64 }
+    }
+}
+
+impl Drop for Extractor {
+    fn drop(&mut self) {
+        unsafe {
+            if !self.reader.is_null() {
+                archive_read_free(self.reader);
+            }
+            if !self.writer.is_null() {
+                archive_write_free(self.writer);
+            }
+        }
+    }
+}
+
+// The warnings are only logged, as libarchive goes on after them.
+unsafe fn check(archive: *mut c_void, status: c_int) -> io::Result<c_int> {
+    match status {
+        ARCHIVE_WARN => {
+            warn!("{}", error_string(archive));
+            Ok(status)
+        }
+        s if s < ARCHIVE_OK => Err(last_error(archive)),
+        s => Ok(s),
+    }
+}
+
+unsafe fn last_error(archive: *mut c_void) -> io::Error {
+    match archive_errno(archive) {
+        errno if errno > 0 && errno != libc::EILSEQ => io::Error::from_raw_os_error(errno),
+        // The format errors, and the ones not of a system call, are only
+        // told by their message.
+        _ => io::Error::new(io::ErrorKind::InvalidData, error_string(archive)),
+    }
+}
+
+unsafe fn error_string(archive: *mut c_void) -> String {
+    let message = archive_error_string(archive);
+    if message.is_null() {
+        return "unknown archive error".to_owned();
+    }
+    CStr::from_ptr(message).to_string_lossy().into_owned()
+}
+
+unsafe fn c_path(s: *const c_char) -> Option<PathBuf> {
+    if s.is_null() {
+        return None;
+    }
+    Some(PathBuf::from(OsStr::from_bytes(CStr::from_ptr(s).to_bytes())))
+}
+
+extern "C" {
+    fn archive_read_new() -> *mut c_void;
+    fn archive_read_support_filter_all(a: *mut c_void) -> c_int;
+    fn archive_read_support_format_all(a: *mut c_void) -> c_int;
+    fn archive_read_open_filename(a: *mut c_void, filename: *const c_char, block: usize) -> c_int;
+    fn archive_read_next_header(a: *mut c_void, entry: *mut *mut c_void) -> c_int;
+    fn archive_read_data_block(
+        a: *mut c_void,
+        buf: *mut *const c_void,
+        len: *mut usize,
+        offset: *mut i64,
+    ) -> c_int;
+    fn archive_read_free(a: *mut c_void) -> c_int;
+    fn archive_filter_bytes(a: *mut c_void, filter: c_int) -> i64;
+    fn archive_write_disk_new() -> *mut c_void;
+    fn archive_write_disk_set_options(a: *mut c_void, flags: c_int) -> c_int;
+    fn archive_write_disk_set_standard_lookup(a: *mut c_void) -> c_int;
+    fn archive_write_header(a: *mut c_void, entry: *mut c_void) -> c_int;
+    fn archive_write_data_block(
+        a: *mut c_void,
+        buf: *const c_void,
+        len: usize,
+        offset: i64,
+    ) -> isize;
+    fn archive_write_finish_entry(a: *mut c_void) -> c_int;
+    fn archive_write_close(a: *mut c_void) -> c_int;
+    fn archive_write_free(a: *mut c_void) -> c_int;
+    fn archive_errno(a: *mut c_void) -> c_int;
+    fn archive_error_string(a: *mut c_void) -> *const c_char;
+    fn archive_entry_pathname(entry: *mut c_void) -> *const c_char;
+    fn archive_entry_set_pathname(entry: *mut c_void, path: *const c_char);
+    fn archive_entry_hardlink(entry: *mut c_void) -> *const c_char;
+    fn archive_entry_set_hardlink(entry: *mut c_void, path: *const c_char);
+    fn archive_entry_filetype(entry: *mut c_void) -> libc::mode_t;
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use flate2::{write::GzEncoder, Compression};
+
+    fn gzip(path: &Path, content: &[u8]) {
+        let mut encoder = GzEncoder::new(File::create(path).unwrap(), Compression::best());
+        encoder.write_all(content).unwrap();
+        encoder.finish().unwrap();
+    }
+
+    #[test]
+    fn reject_expansion_beyond_limits() {
+        let dir = tempfile::tempdir().unwrap();
+        let source = dir.path().join("object.gz");
+        gzip(&source, &vec![0; 1024 * 1024]);
+
+        let limits = Extraction::default();
+        assert_eq!(check_compressed(&limits, &source).unwrap(), 1024 * 1024);
+
+        let limits = Extraction { max_expansion_ratio: Some(10), ..Extraction::default() };
+        assert!(check_compressed(&limits, &source).is_err());
+
+        let limits = Extraction { max_uncompressed_size: Some(1024), ..Extraction::default() };
+        assert!(check_compressed(&limits, &source).is_err());
+    }
+
+    #[test]
+    fn archive_error_context() {
+        let dir = tempfile::tempdir().unwrap();
+        let source = dir.path().join("object.gz");
+        let mut content = Vec::new();
+        let mut encoder = GzEncoder::new(&mut content, Compression::best());
+        encoder.write_all(&vec![0; 1024 * 1024]).unwrap();
+        encoder.finish().unwrap();
+        // Truncates the stream, as a partially downloaded object.
+        content.truncate(content.len() / 2);
+        std::fs::write(&source, &content).unwrap();
+
+        let err = uncompress_data(&source, File::open(&source).unwrap(), io::sink()).unwrap_err();
+        match err {
+            Error::Archive(e) => {
+                assert_eq!(e.operation, "uncompression");
+                assert_eq!(e.archive, source);
+                assert!(e.processed > 0 && e.processed <= content.len() as u64);
+                assert!(e.to_string().contains(&format!("after {} bytes", e.processed)));
+            }
+            e => panic!("unexpected error: {}", e),
+        }
+    }
+
+    #[test]
+    fn entries_containment() {
+        assert!(is_contained(Path::new("etc/passwd")));
+        assert!(is_contained(Path::new("./etc/passwd")));
+        assert!(!is_contained(Path::new("/etc/passwd")));
+        assert!(!is_contained(Path::new("etc/../../passwd")));
+    }
+
+    fn tarball(path: &Path, symlink: Option<&Path>, file: &str) {
+        let mut builder = tar::Builder::new(File::create(path).unwrap());
+        if let Some(symlink) = symlink {
+            let mut header = tar::Header::new_gnu();
+            header.set_entry_type(tar::EntryType::Symlink);
+            header.set_size(0);
+            builder.append_link(&mut header, "etc", symlink).unwrap();
+        }
+
+        let mut header = tar::Header::new_gnu();
+        header.set_size(4);
+        builder.append_data(&mut header, file, &b"root"[..]).unwrap();
+        builder.finish().unwrap();
+    }
+
+    fn extract_to_tempdir(limits: &Extraction, source: &Path) -> Result<()> {
+        let dest = tempfile::tempdir().unwrap();
+        extract(limits, source, dest.path(), compress_tools::Ownership::Ignore)
+    }
+
+    #[test]
+    fn reject_entries_through_symlinks() {
+        let dir = tempfile::tempdir().unwrap();
+        let outside = tempfile::tempdir().unwrap();
+        let source = dir.path().join("tree.tar");
+
+        tarball(&source, Some(outside.path()), "etc/passwd");
+        assert!(extract_to_tempdir(&Extraction::default(), &source).is_err());
+        assert!(!outside.path().join("passwd").exists());
+        let limits = Extraction { lenient_paths: true, ..Extraction::default() };
+        assert!(extract_to_tempdir(&limits, &source).is_ok());
+        assert!(outside.path().join("passwd").exists());
+
+        tarball(&source, Some(outside.path()), "passwd");
+        assert!(extract_to_tempdir(&Extraction::default(), &source).is_ok());
+        let limits = Extraction { max_entries: Some(1), ..Extraction::default() };
+        assert!(extract_to_tempdir(&limits, &source).is_err());
+    }
+
+    #[test]
+    fn reject_entries_through_target_symlinks() {
+        let dir = tempfile::tempdir().unwrap();
+        let outside = tempfile::tempdir().unwrap();
+        let source = dir.path().join("tree.tar");
+        tarball(&source, None, "etc/passwd");
+
+        let dest = tempfile::tempdir().unwrap();
+        std::os::unix::fs::symlink(outside.path(), dest.path().join("etc")).unwrap();
+        let res = extract(
+            &Extraction::default(),
+            &source,
+            dest.path(),
+            compress_tools::Ownership::Ignore,
+        );
+        assert!(res.is_err());
+        assert!(!outside.path().join("passwd").exists());
+    }
+}
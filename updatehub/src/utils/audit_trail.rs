@@ -0,0 +1,184 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Update attempts, appended to a file as JSON lines once their outcome
+//! is known, for the devices which must account for what has been
+//! installed on them. The file is rotated once it grows over its size.
+
+use lazy_static::lazy_static;
+use sdk::api::{audit, info::settings::AuditTrail};
+use slog_scope::{info, warn};
+use std::{
+    fs::{self, OpenOptions},
+    io::{self, BufRead, BufReader, Write},
+    path::{Path, PathBuf},
+    sync::RwLock,
+};
+
+lazy_static! {
+    static ref SETTINGS: RwLock<Option<AuditTrail>> = RwLock::default();
+}
+
+/// Sets where, and how, the update attempts are recorded. Nothing is
+/// recorded until it is configured.
+pub(crate) fn configure(settings: &AuditTrail) {
+    *SETTINGS.write().expect("poisoned audit trail lock") = Some(settings.clone());
+}
+
+fn settings() -> Option<AuditTrail> {
+    SETTINGS.read().expect("poisoned audit trail lock").clone().filter(|s| s.path.is_some())
+}
+
+/// Appends the `entry` to the audit trail.
+pub(crate) fn record(entry: &audit::Entry) {
+    let settings = match settings() {
+        Some(settings) => settings,
+        None => return,
+    };
+    info!(
+        "recording update {} as {:?} to the audit trail",
+        entry.attempt.package_uid, entry.outcome
+    );
+    if let Err(e) = append(&settings, entry) {
+        warn!("failed to record the update to the audit trail: {}", e);
+    }
+}
+
+/// Entries of the audit trail matching the `request`, from the oldest
+/// to the newest.
+pub(crate) fn entries(request: &audit::Request) -> io::Result<Vec<audit::Entry>> {
+    let settings = match settings() {
+        Some(settings) => settings,
+        None => return Ok(Vec::default()),
+    };
+    read(&settings, request)
+}
+
+fn append(settings: &AuditTrail, entry: &audit::Entry) -> io::Result<()> {
+    let path = settings.path.as_ref().expect("audit trail has no path");
+    let mut line = serde_json::to_vec(entry)?;
+    line.push(b'\n');
+
+    let size = fs::metadata(path).map(|m| m.len()).unwrap_or_default();
+    if size > 0 && size + line.len() as u64 > settings.max_size {
+        rotate(path, settings.rotations)?;
+    }
+
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    let mut file = OpenOptions::new().create(true).append(true).open(path)?;
+    file.write_all(&line)?;
+    file.sync_data()
+}
+
+// The oldest file is dropped, as the others are shifted by one.
+fn rotate(path: &Path, rotations: usize) -> io::Result<()> {
+    if rotations == 0 {
+        return fs::remove_file(path);
+    }
+    for idx in (1..rotations).rev() {
+        let from = rotated(path, idx);
+        if from.exists() {
+            fs::rename(&from, rotated(path, idx + 1))?;
+        }
+    }
+    fs::rename(path, rotated(path, 1))
+}
+
+fn rotated(path: &Path, idx: usize) -> PathBuf {
+    let mut name = path.as_os_str().to_owned();
+    name.push(format!(".{}", idx));
+    name.into()
+}
+
+fn read(settings: &AuditTrail, request: &audit::Request) -> io::Result<Vec<audit::Entry>> {
+    let path = settings.path.as_ref().expect("audit trail has no path");
+    let files =
+        (1..=settings.rotations).rev().map(|idx| rotated(path, idx)).chain(Some(path.clone()));
+
+    let mut entries = Vec::default();
+    for file in files {
+        let file = match fs::File::open(&file) {
+            Ok(file) => file,
+            Err(e) if e.kind() == io::ErrorKind::NotFound => continue,
+            Err(e) => return Err(e),
+        };
+        for line in BufReader::new(file).lines() {
+            // A line left half written by a power cut is skipped.
+            let entry: audit::Entry = match serde_json::from_str(&line?) {
+                Ok(entry) => entry,
+                Err(_) => continue,
+            };
+            if request.package_uid.as_ref().map_or(true, |uid| *uid == entry.attempt.package_uid) {
+                entries.push(entry);
+            }
+        }
+    }
+
+    if let Some(limit) = request.limit {
+        let skip = entries.len().saturating_sub(limit);
+        entries.drain(..skip);
+    }
+    Ok(entries)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use sdk::api::info::runtime_settings::UpdateOutcome;
+
+    fn entry(package_uid: &str) -> audit::Entry {
+        audit::Entry {
+            attempt: audit::Attempt {
+                package_uid: package_uid.to_owned(),
+                version_from: "1.0".to_owned(),
+                version_to: "1.1".to_owned(),
+                trigger: audit::Trigger::Poll,
+                started_at: chrono::Utc::now(),
+                objects: vec![audit::ObjectResult {
+                    sha256sum: "c775e7b7".to_owned(),
+                    filename: "rootfs.ext4".to_owned(),
+                    mode: "raw".to_owned(),
+                    status: audit::ObjectStatus::Installed,
+                    duration: Some(42),
+                }],
+            },
+            outcome: UpdateOutcome::Installed,
+            finished_at: chrono::Utc::now(),
+            duration: 300,
+            error: None,
+        }
+    }
+
+    #[test]
+    fn append_and_rotate() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("audit.log");
+        let size = serde_json::to_vec(&entry("a")).unwrap().len() as u64 + 1;
+        let settings = AuditTrail { path: Some(path.clone()), max_size: size * 2, rotations: 1 };
+
+        for uid in &["a", "b", "c", "d", "e"] {
+            append(&settings, &entry(uid)).unwrap();
+        }
+        assert!(rotated(&path, 1).exists());
+        assert!(!rotated(&path, 2).exists());
+
+        // The oldest entry has been dropped along with its file
+        let uids = |request: &audit::Request| {
+            read(&settings, request)
+                .unwrap()
+                .into_iter()
+                .map(|e| e.attempt.package_uid)
+                .collect::<Vec<_>>()
+        };
+        assert_eq!(uids(&audit::Request::default()), ["c", "d", "e"]);
+        assert_eq!(uids(&audit::Request { package_uid: None, limit: Some(2) }), ["d", "e"]);
+        assert_eq!(uids(&audit::Request { package_uid: Some("d".to_owned()), limit: None }), ["d"]);
+
+        fs::OpenOptions::new().append(true).open(&path).unwrap().write_all(b"{\"pack").unwrap();
+        assert_eq!(read(&settings, &audit::Request::default()).unwrap().len(), 3);
+    }
+}
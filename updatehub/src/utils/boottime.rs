@@ -0,0 +1,110 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use slog_scope::{debug, warn};
+use std::{io, os::unix::io::RawFd, time::Duration};
+
+// Longest time slept between checks of the timer, which bounds how late
+// an expiration during a system suspend is noticed after resuming.
+const MAX_STEP: Duration = Duration::from_secs(30);
+
+/// Sleeps for `duration` measured on `CLOCK_BOOTTIME`, so the time the
+/// system has spent suspended is accounted for. A timer expired while
+/// suspended is handled right after resuming.
+pub(crate) async fn sleep(duration: Duration) {
+    let timer = match TimerFd::new(duration) {
+        Ok(timer) => timer,
+        Err(e) => {
+            warn!("failed to create boottime timer, using monotonic clock: {}", e);
+            return async_std::task::sleep(duration).await;
+        }
+    };
+
+    loop {
+        match timer.remaining() {
+            Ok(remaining) if remaining == Duration::from_secs(0) => break,
+            Ok(remaining) => async_std::task::sleep(std::cmp::min(remaining, MAX_STEP)).await,
+            Err(e) => {
+                warn!("failed to read boottime timer: {}", e);
+                break;
+            }
+        }
+    }
+    debug!("boottime timer has expired");
+}
+
+/// Time elapsed since the boot, suspended time included, which isn't
+/// affected by the wall clock being set.
+pub(crate) fn elapsed() -> io::Result<chrono::Duration> {
+    let mut spec: libc::timespec = unsafe { std::mem::zeroed() };
+    if unsafe { libc::clock_gettime(libc::CLOCK_BOOTTIME, &mut spec) } < 0 {
+        return Err(io::Error::last_os_error());
+    }
+
+    Ok(chrono::Duration::seconds(spec.tv_sec as i64)
+        + chrono::Duration::nanoseconds(spec.tv_nsec as i64))
+}
+
+/// Id of the current boot, which the kernel changes on every boot.
+pub(crate) fn boot_id() -> io::Result<String> {
+    Ok(std::fs::read_to_string("/proc/sys/kernel/random/boot_id")?.trim().to_owned())
+}
+
+struct TimerFd(RawFd);
+
+impl TimerFd {
+    fn new(duration: Duration) -> io::Result<Self> {
+        let fd = unsafe {
+            libc::timerfd_create(libc::CLOCK_BOOTTIME, libc::TFD_CLOEXEC | libc::TFD_NONBLOCK)
+        };
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+        let timer = TimerFd(fd);
+
+        // A zeroed value disarms the timer, so it is armed with at least
+        // a nanosecond.
+        let duration = std::cmp::max(duration, Duration::from_nanos(1));
+        let spec = libc::itimerspec {
+            it_interval: libc::timespec { tv_sec: 0, tv_nsec: 0 },
+            it_value: libc::timespec {
+                tv_sec: duration.as_secs() as libc::time_t,
+                tv_nsec: duration.subsec_nanos() as libc::c_long,
+            },
+        };
+        if unsafe { libc::timerfd_settime(timer.0, 0, &spec, std::ptr::null_mut()) } < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        Ok(timer)
+    }
+
+    fn remaining(&self) -> io::Result<Duration> {
+        let mut spec: libc::itimerspec = unsafe { std::mem::zeroed() };
+        if unsafe { libc::timerfd_gettime(self.0, &mut spec) } < 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        Ok(Duration::new(spec.it_value.tv_sec as u64, spec.it_value.tv_nsec as u32))
+    }
+}
+
+impl Drop for TimerFd {
+    fn drop(&mut self) {
+        unsafe { libc::close(self.0) };
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Instant;
+
+    #[actix_rt::test]
+    async fn sleep_for_duration() {
+        let start = Instant::now();
+        sleep(Duration::from_millis(50)).await;
+        assert!(start.elapsed() >= Duration::from_millis(50));
+    }
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use pkg_schema::{
+    definitions::{FpgaTarget, TargetType},
+    Object,
+};
+use sdk::api::info::settings::Container;
+use slog_scope::{debug, error};
+use std::path::{Path, PathBuf};
+
+/// Checks if the container settings are usable, so a misconfigured
+/// container is detected when the agent starts instead of during an
+/// update.
+pub(crate) fn check_environment(settings: &Container) -> Result<()> {
+    if let Some(ref root) = settings.host_root {
+        if !root.join("dev").is_dir() {
+            error!("host root {:?} does not look like the host root filesystem", root);
+            return Err(Error::InvalidHostRoot(root.to_owned()));
+        }
+    }
+
+    if settings.nsenter {
+        super::fs::is_executable_in_path("nsenter")?;
+
+        // nsenter needs the host PID namespace to find the host init.
+        if let Err(e) = easy_process::run(&host_command(settings, "true")) {
+            error!("unable to enter the host namespaces, is the host PID namespace shared?");
+            return Err(e.into());
+        }
+    }
+
+    Ok(())
+}
+
+/// Wraps `cmd` so it is run inside the host namespaces, when enabled.
+pub(crate) fn host_command(settings: &Container, cmd: &str) -> String {
+    if settings.nsenter {
+        format!("nsenter --target 1 --mount --uts --ipc --net --pid -- {}", cmd)
+    } else {
+        cmd.to_owned()
+    }
+}
+
+/// Resolves the `path` relative to the host root filesystem.
+pub(crate) fn host_path(settings: &Container, path: &Path) -> PathBuf {
+    match settings.host_root {
+        Some(ref root) => root.join(path.strip_prefix("/").unwrap_or(path)),
+        None => path.to_owned(),
+    }
+}
+
+/// Resolves the device targets of the `object` relative to the host
+/// root filesystem.
+pub(crate) fn resolve_object_targets(settings: &Container, object: &mut Object) {
+    if settings.host_root.is_none() {
+        return;
+    }
+
+    let resolve_target = |target: &mut TargetType| {
+        if let TargetType::Device(ref mut p) = target {
+            *p = host_path(settings, p);
+            debug!("device target resolved to {:?}", p);
+        }
+    };
+
+    match object {
+        Object::Copy(o) => resolve_target(&mut o.target_type),
+        Object::Raw(o) => resolve_target(&mut o.target_type),
+        Object::Tarball(o) => resolve_target(&mut o.target),
+        Object::DiskImage(o) => resolve_target(&mut o.target),
+        Object::Fpga(o) => {
+            if let FpgaTarget::Device(ref mut p) = o.target {
+                *p = host_path(settings, p);
+            }
+        }
+        Object::Imxkobs(o) => {
+            for p in o.chip_0_device_path.iter_mut().chain(o.chip_1_device_path.iter_mut()) {
+                *p = host_path(settings, p);
+            }
+        }
+        Object::Agent(_)
+        | Object::Flash(_)
+        | Object::Script(_)
+        | Object::Test(_)
+        | Object::Ubifs(_) => {}
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn command_with_nsenter() {
+        let settings = Container { host_root: None, nsenter: true };
+        assert_eq!(
+            host_command(&settings, "reboot"),
+            "nsenter --target 1 --mount --uts --ipc --net --pid -- reboot"
+        );
+        assert_eq!(host_command(&Container::default(), "reboot"), "reboot");
+    }
+
+    #[test]
+    fn path_with_host_root() {
+        let settings = Container { host_root: Some(PathBuf::from("/host")), nsenter: false };
+        assert_eq!(
+            host_path(&settings, Path::new("/dev/mmcblk0p2")),
+            Path::new("/host/dev/mmcblk0p2")
+        );
+        assert_eq!(host_path(&Container::default(), Path::new("/dev/sda")), Path::new("/dev/sda"));
+    }
+
+    #[test]
+    fn invalid_host_root() {
+        let dir = tempfile::tempdir().unwrap();
+        let settings = Container { host_root: Some(dir.path().to_owned()), nsenter: false };
+        assert!(check_environment(&settings).is_err());
+
+        std::fs::create_dir(dir.path().join("dev")).unwrap();
+        assert!(check_environment(&settings).is_ok());
+    }
+}
@@ -3,7 +3,10 @@
 // SPDX-License-Identifier: Apache-2.0
 
 use super::{Error, Result};
-use crate::utils::mtd;
+use crate::utils::{
+    lvm, mtd,
+    target::{self, Target},
+};
 use pkg_schema::definitions::{
     target_permissions::{Gid, Uid},
     TargetType,
@@ -18,6 +21,9 @@ pub(crate) trait TargetTypeExt {
 
     /// Gets device's path for mounting.
     fn get_target(&self) -> Result<PathBuf>;
+
+    /// Gets the backend to write into the target.
+    fn target(&self) -> Result<Box<dyn Target>>;
 }
 
 impl TargetTypeExt for TargetType {
@@ -46,6 +52,13 @@ impl TargetTypeExt for TargetType {
                 }
                 &self
             }
+            TargetType::LVMVolume(v) => {
+                let dev = lvm::target_device_from_lvm_volume(v)?;
+                if dev.metadata()?.permissions().readonly() {
+                    return Err(Error::MissingWritePermission(dev));
+                }
+                &self
+            }
         })
     }
 
@@ -54,8 +67,13 @@ impl TargetTypeExt for TargetType {
             TargetType::Device(p) => Ok(p.clone()),
             TargetType::UBIVolume(s) => mtd::target_device_from_ubi_volume_name(s),
             TargetType::MTDName(s) => mtd::target_device_from_mtd_name(s),
+            TargetType::LVMVolume(s) => lvm::target_device_from_lvm_volume(s),
         }
     }
+
+    fn target(&self) -> Result<Box<dyn Target>> {
+        target::from_type(self)
+    }
 }
 
 /// Utility funtions for [Gid](pkg_schema::definitions::target_permissions::Gid)
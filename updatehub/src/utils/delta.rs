@@ -0,0 +1,149 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use sdk::api::info::settings::Delta;
+use slog_scope::{debug, info};
+use std::{fs, io::Read, path::Path};
+
+const BSDIFF_MAGIC: &[u8] = b"BSDIFF40";
+
+/// Lists the sha256sum of the installed objects kept as delta bases.
+/// It is empty when deltas are disabled.
+pub(crate) fn installed_objects(settings: &Delta) -> Vec<String> {
+    let base_dir = match settings.base_dir {
+        Some(ref dir) => dir,
+        None => return Vec::default(),
+    };
+
+    fs::read_dir(base_dir)
+        .map(|entries| {
+            entries
+                .filter_map(std::result::Result::ok)
+                .filter(|e| e.path().is_file())
+                .filter_map(|e| e.file_name().into_string().ok())
+                .collect()
+        })
+        .unwrap_or_default()
+}
+
+/// Rebuilds the `object` in the `download_dir` applying its downloaded
+/// patch over the installed `base` object. The patch is removed either
+/// way.
+pub(crate) fn apply(settings: &Delta, download_dir: &Path, object: &str, base: &str) -> Result<()> {
+    let patch = download_dir.join(format!("{}.delta", object));
+    let res = match settings.base_dir {
+        Some(ref base_dir) => {
+            info!("applying delta for {} over {}", object, base);
+            let (base, object) = (base_dir.join(base), download_dir.join(object));
+            let cmd = if is_bsdiff(&patch)? {
+                format!("bspatch {} {} {}", base.display(), object.display(), patch.display())
+            } else {
+                format!(
+                    "zstd -d -f --long=31 --patch-from={} {} -o {}",
+                    base.display(),
+                    patch.display(),
+                    object.display()
+                )
+            };
+            easy_process::run(&cmd).map(|_| ()).map_err(Into::into)
+        }
+        None => Err(super::Error::DeltaBaseNotFound(base.to_owned())),
+    };
+
+    fs::remove_file(patch)?;
+    res
+}
+
+// Patches generated by bsdiff are identified by their magic, the others
+// are taken as zstd ones.
+fn is_bsdiff(patch: &Path) -> Result<bool> {
+    let mut magic = [0; 8];
+    let len = fs::File::open(patch)?.read(&mut magic)?;
+    Ok(magic[..len] == BSDIFF_MAGIC[..])
+}
+
+/// Keeps the installed `objects` as bases for the deltas of the next
+/// updates, replacing the ones of the previous update.
+pub(crate) fn retain_installed<'a>(
+    settings: &Delta,
+    download_dir: &Path,
+    objects: impl Iterator<Item = &'a str>,
+) -> Result<()> {
+    let base_dir = match settings.base_dir {
+        Some(ref dir) => dir,
+        None => return Ok(()),
+    };
+
+    fs::create_dir_all(base_dir)?;
+    for entry in fs::read_dir(base_dir)? {
+        fs::remove_file(entry?.path())?;
+    }
+
+    for object in objects {
+        debug!("keeping {} as delta base", object);
+        fs::copy(download_dir.join(object), base_dir.join(object))?;
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn keep_installed_objects() {
+        let download_dir = tempfile::tempdir().unwrap();
+        let base_dir = tempfile::tempdir().unwrap();
+        let settings = Delta { base_dir: Some(base_dir.path().to_owned()) };
+        fs::write(base_dir.path().join("old"), b"old").unwrap();
+        fs::write(download_dir.path().join("new"), b"new").unwrap();
+
+        retain_installed(&settings, download_dir.path(), vec!["new"].into_iter()).unwrap();
+        assert_eq!(installed_objects(&settings), vec!["new".to_string()]);
+        assert!(installed_objects(&Delta::default()).is_empty());
+    }
+
+    #[test]
+    fn apply_patch() {
+        let (_handle, calls) = create_echo_bins(&["zstd"]).unwrap();
+        let download_dir = tempfile::tempdir().unwrap();
+        let settings = Delta { base_dir: Some("/data/bases".into()) };
+        let patch = download_dir.path().join("new.delta");
+        fs::write(&patch, b"patch").unwrap();
+
+        apply(&settings, download_dir.path(), "new", "old").unwrap();
+        assert!(!patch.exists());
+        assert_eq!(
+            fs::read_to_string(calls).unwrap(),
+            format!(
+                "zstd -d -f --long=31 --patch-from=/data/bases/old {} -o {}\n",
+                patch.display(),
+                download_dir.path().join("new").display()
+            )
+        );
+    }
+
+    #[test]
+    fn apply_bsdiff_patch() {
+        let (_handle, calls) = create_echo_bins(&["bspatch"]).unwrap();
+        let download_dir = tempfile::tempdir().unwrap();
+        let settings = Delta { base_dir: Some("/data/bases".into()) };
+        let patch = download_dir.path().join("new.delta");
+        fs::write(&patch, b"BSDIFF40patch").unwrap();
+
+        apply(&settings, download_dir.path(), "new", "old").unwrap();
+        assert_eq!(
+            fs::read_to_string(calls).unwrap(),
+            format!(
+                "bspatch /data/bases/old {} {}\n",
+                download_dir.path().join("new").display(),
+                patch.display()
+            )
+        );
+    }
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use slog_scope::{debug, warn};
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+/// eMMC hardware boot partition (`mmcblkXbootY`).
+#[derive(Debug, PartialEq)]
+pub(crate) struct BootPartition {
+    device: PathBuf,
+    index: u8,
+    force_ro: PathBuf,
+}
+
+/// Keeps the boot partition writable while alive, restoring the
+/// read-only protection when dropped.
+pub(crate) struct Unlocked<'a>(&'a BootPartition);
+
+impl BootPartition {
+    /// Returns the boot partition information if the `target` points to
+    /// an eMMC hardware boot partition.
+    pub(crate) fn from_target(target: &Path) -> Option<Self> {
+        let target = fs::canonicalize(target).unwrap_or_else(|_| target.to_owned());
+        let name = target.file_name()?.to_str()?;
+        let re = regex::Regex::new(r"^(?P<dev>mmcblk\d+)boot(?P<index>[01])$").unwrap();
+        let captures = re.captures(name)?;
+        let device = captures.name("dev")?.as_str();
+
+        Some(BootPartition {
+            device: Path::new("/dev").join(device),
+            index: captures.name("index")?.as_str().parse().ok()?,
+            force_ro: Path::new("/sys/block").join(name).join("force_ro"),
+        })
+    }
+
+    /// Disables the read-only protection of the boot partition until
+    /// the returned guard is dropped.
+    pub(crate) fn unlock(&self) -> Result<Unlocked<'_>> {
+        debug!("disabling read-only protection of {:?}", self.force_ro);
+        fs::write(&self.force_ro, "0")?;
+        Ok(Unlocked(self))
+    }
+
+    /// Enables the boot partition as the one used by the eMMC to boot.
+    pub(crate) fn enable(&self) -> Result<()> {
+        debug!("enabling boot partition {} of {:?}", self.index, self.device);
+        // The mmc-utils partition numbering starts at 1 for boot0.
+        easy_process::run(&format!(
+            "mmc bootpart enable {} 0 {}",
+            self.index + 1,
+            self.device.display()
+        ))?;
+        Ok(())
+    }
+}
+
+impl Drop for Unlocked<'_> {
+    fn drop(&mut self) {
+        debug!("restoring read-only protection of {:?}", self.0.force_ro);
+        if let Err(e) = fs::write(&self.0.force_ro, "1") {
+            warn!("failed to restore read-only protection of {:?}: {}", self.0.force_ro, e);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn boot_partition_from_target() {
+        assert_eq!(
+            BootPartition::from_target(Path::new("/dev/mmcblk1boot1")),
+            Some(BootPartition {
+                device: PathBuf::from("/dev/mmcblk1"),
+                index: 1,
+                force_ro: PathBuf::from("/sys/block/mmcblk1boot1/force_ro"),
+            })
+        );
+        assert_eq!(BootPartition::from_target(Path::new("/dev/mmcblk1p1")), None);
+        assert_eq!(BootPartition::from_target(Path::new("/dev/sdb")), None);
+    }
+
+    #[test]
+    fn unlock_restores_protection() {
+        let dir = tempfile::tempdir().unwrap();
+        let force_ro = dir.path().join("force_ro");
+        fs::write(&force_ro, "1").unwrap();
+        let part = BootPartition { device: PathBuf::from("/dev/mmcblk0"), index: 0, force_ro };
+
+        let guard = part.unlock().unwrap();
+        assert_eq!(fs::read_to_string(&part.force_ro).unwrap(), "0");
+        drop(guard);
+        assert_eq!(fs::read_to_string(&part.force_ro).unwrap(), "1");
+    }
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use openssl::{
+    encrypt::Decrypter,
+    pkey::PKey,
+    rsa::Padding,
+    symm::{Cipher, Crypter, Mode},
+};
+use pkg_schema::{EncryptedObject, Encryption, EncryptionAlgorithm};
+use slog_scope::debug;
+use std::{
+    fs,
+    io::{Read, Write},
+    path::{Path, PathBuf},
+};
+
+const CHUNK_SIZE: usize = 64 * 1024;
+const KEY_SIZE: usize = 32;
+
+/// Prefix of the private directories the objects are decrypted into.
+pub(crate) const DECRYPTED_PREFIX: &str = "decrypted-";
+
+/// Content key of an encrypted package, which the objects payloads are
+/// encrypted with.
+pub(crate) struct ContentKey {
+    key: Vec<u8>,
+    cipher: Cipher,
+}
+
+impl std::fmt::Debug for ContentKey {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("ContentKey")
+    }
+}
+
+/// Unwraps the content key of the package with the device private key
+/// in `private_key`.
+pub(crate) fn unwrap_key(encryption: &Encryption, private_key: &Path) -> Result<ContentKey> {
+    let cipher = match encryption.algorithm {
+        EncryptionAlgorithm::Aes256Gcm => Cipher::aes_256_gcm(),
+    };
+    let wrapped = decode("wrapped-key", &encryption.wrapped_key)?;
+
+    let private_key = PKey::private_key_from_pem(&fs::read(private_key)?)?;
+    let mut decrypter = Decrypter::new(&private_key)?;
+    decrypter.set_rsa_padding(Padding::PKCS1_OAEP)?;
+    let mut key = vec![0; decrypter.decrypt_len(&wrapped)?];
+    let len = decrypter
+        .decrypt(&wrapped, &mut key)
+        .map_err(|_| Error::Decryption("content key isn't wrapped for this device".to_owned()))?;
+    key.truncate(len);
+    if key.len() != KEY_SIZE {
+        return Err(Error::Decryption(format!("invalid content key size: {}", key.len())));
+    }
+
+    Ok(ContentKey { key, cipher })
+}
+
+/// Decrypts the object `sha256sum` from `source_dir` into `dest_dir`,
+/// where it is kept under the same name. The payload is decrypted a
+/// chunk at a time, and the output is removed if it fails to be
+/// authenticated.
+pub(crate) fn decrypt_object(
+    key: &ContentKey,
+    object: &EncryptedObject,
+    sha256sum: &str,
+    source_dir: &Path,
+    dest_dir: &Path,
+) -> Result<PathBuf> {
+    let dest = dest_dir.join(sha256sum);
+    debug!("decrypting object {} into {:?}", sha256sum, dest);
+
+    let res =
+        decrypt(key, object, fs::File::open(source_dir.join(sha256sum))?, fs::File::create(&dest)?);
+    if res.is_err() {
+        let _ = fs::remove_file(&dest);
+    }
+    res.map(|_| dest)
+}
+
+fn decrypt(
+    key: &ContentKey,
+    object: &EncryptedObject,
+    mut input: impl Read,
+    mut output: impl Write,
+) -> Result<()> {
+    let iv = decode("iv", &object.iv)?;
+    let tag = decode("tag", &object.tag)?;
+
+    let mut crypter = Crypter::new(key.cipher, Mode::Decrypt, &key.key, Some(&iv))?;
+    crypter.set_tag(&tag)?;
+
+    let mut buf = vec![0; CHUNK_SIZE];
+    let mut out = vec![0; CHUNK_SIZE + key.cipher.block_size()];
+    loop {
+        let len = input.read(&mut buf)?;
+        if len == 0 {
+            break;
+        }
+        let len = crypter.update(&buf[..len], &mut out)?;
+        output.write_all(&out[..len])?;
+    }
+
+    let len = crypter
+        .finalize(&mut out)
+        .map_err(|_| Error::Decryption("object failed to be authenticated".to_owned()))?;
+    output.write_all(&out[..len])?;
+    output.flush()?;
+
+    Ok(())
+}
+
+fn decode(name: &str, value: &str) -> Result<Vec<u8>> {
+    super::hex_decode(value).ok_or_else(|| Error::Decryption(format!("invalid {}", name)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::utils::hex_encode;
+    use openssl::{encrypt::Encrypter, rsa::Rsa, symm};
+    use pretty_assertions::assert_eq;
+    use std::collections::BTreeMap;
+
+    #[test]
+    fn decrypt_objects() {
+        let dir = tempfile::tempdir().unwrap();
+        let rsa = Rsa::generate(2048).unwrap();
+        let private_key = dir.path().join("key.pem");
+        fs::write(&private_key, rsa.private_key_to_pem().unwrap()).unwrap();
+        let public_key = PKey::from_rsa(rsa).unwrap();
+
+        let content_key = [7; KEY_SIZE];
+        let mut encrypter = Encrypter::new(&public_key).unwrap();
+        encrypter.set_rsa_padding(Padding::PKCS1_OAEP).unwrap();
+        let mut wrapped = vec![0; encrypter.encrypt_len(&content_key).unwrap()];
+        let len = encrypter.encrypt(&content_key, &mut wrapped).unwrap();
+        wrapped.truncate(len);
+
+        let payload = vec![42; 3 * CHUNK_SIZE + 5];
+        let iv = [1; 12];
+        let mut tag = [0; 16];
+        let encrypted = symm::encrypt_aead(
+            Cipher::aes_256_gcm(),
+            &content_key,
+            Some(&iv),
+            &[],
+            &payload,
+            &mut tag,
+        )
+        .unwrap();
+        let source_dir = dir.path().join("download");
+        let dest_dir = dir.path().join("decrypted");
+        fs::create_dir(&source_dir).unwrap();
+        fs::create_dir(&dest_dir).unwrap();
+        fs::write(source_dir.join("object"), &encrypted).unwrap();
+
+        let object = EncryptedObject { iv: hex_encode(&iv), tag: hex_encode(&tag) };
+        let encryption = Encryption {
+            algorithm: EncryptionAlgorithm::Aes256Gcm,
+            wrapped_key: hex_encode(&wrapped),
+            objects: BTreeMap::default(),
+        };
+        let key = unwrap_key(&encryption, &private_key).unwrap();
+        let dest = decrypt_object(&key, &object, "object", &source_dir, &dest_dir).unwrap();
+        assert_eq!(fs::read(dest).unwrap(), payload);
+
+        // Tampered payloads are refused and not left behind
+        let mut tampered = encrypted;
+        tampered[0] ^= 1;
+        fs::write(source_dir.join("object"), &tampered).unwrap();
+        assert!(decrypt_object(&key, &object, "object", &source_dir, &dest_dir).is_err());
+        assert!(!dest_dir.join("object").exists());
+
+        // The key must be wrapped for this device
+        let other = dir.path().join("other.pem");
+        fs::write(&other, Rsa::generate(2048).unwrap().private_key_to_pem().unwrap()).unwrap();
+        assert!(unwrap_key(&encryption, &other).is_err());
+    }
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use sdk::api::info::settings::Environment;
+use slog_scope::debug;
+use std::{fs, path::Path, process::Command};
+
+const POWER_SUPPLY_DIR: &str = "/sys/class/power_supply";
+
+/// Checks the device environment is within the limits for the update to
+/// be installed, returning why it isn't otherwise.
+pub(crate) fn check(settings: &Environment) -> Result<Option<String>> {
+    if let Some(limit) = settings.max_temperature {
+        for (zone, temperature) in temperatures(&settings.thermal_zones_dir)? {
+            if temperature > limit {
+                return Ok(Some(format!(
+                    "{} is at {:.1}°C, above the {:.1}°C limit",
+                    zone, temperature, limit
+                )));
+            }
+        }
+    }
+
+    if let Some(script) = &settings.check_script {
+        let output = Command::new(script).output()?;
+        if !output.status.success() {
+            let reason = String::from_utf8_lossy(&output.stdout).trim().to_owned();
+            if reason.is_empty() {
+                return Ok(Some(format!("{} has reported an alarm", script.display())));
+            }
+            return Ok(Some(reason));
+        }
+    }
+
+    Ok(None)
+}
+
+// The kernel gives the temperature of each thermal zone in millidegrees
+// Celsius.
+fn temperatures(dir: &Path) -> Result<Vec<(String, f64)>> {
+    if !dir.exists() {
+        return Ok(Vec::default());
+    }
+
+    let mut temperatures = Vec::default();
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        let zone = path.file_name().map(|n| n.to_string_lossy().into_owned()).unwrap_or_default();
+        if !zone.starts_with("thermal_zone") {
+            continue;
+        }
+
+        match fs::read_to_string(path.join("temp")).ok().and_then(|t| t.trim().parse::<i64>().ok())
+        {
+            Some(temperature) => temperatures.push((zone, temperature as f64 / 1000.0)),
+            None => debug!("skipping {:?} as its temperature is unavailable", path),
+        }
+    }
+    temperatures.sort_by(|a, b| a.0.cmp(&b.0));
+
+    Ok(temperatures)
+}
+
+/// Charge of the device battery, in percent, if it has one.
+pub(crate) fn battery_capacity() -> Option<u8> {
+    battery_capacity_in(Path::new(POWER_SUPPLY_DIR))
+}
+
+fn battery_capacity_in(dir: &Path) -> Option<u8> {
+    let mut supplies = fs::read_dir(dir).ok()?.filter_map(|entry| entry.ok()).collect::<Vec<_>>();
+    supplies.sort_by_key(|entry| entry.file_name());
+    supplies.into_iter().map(|entry| entry.path()).find_map(|supply| {
+        let kind = fs::read_to_string(supply.join("type")).ok()?;
+        if kind.trim() != "Battery" {
+            return None;
+        }
+        fs::read_to_string(supply.join("capacity")).ok()?.trim().parse().ok()
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use std::os::unix::fs::PermissionsExt;
+
+    fn create_zone(dir: &Path, zone: &str, temperature: &str) {
+        let zone = dir.join(zone);
+        fs::create_dir(&zone).unwrap();
+        fs::write(zone.join("temp"), temperature).unwrap();
+    }
+
+    #[test]
+    fn thermal_limit() {
+        let dir = tempfile::tempdir().unwrap();
+        create_zone(dir.path(), "thermal_zone0", "45000\n");
+        create_zone(dir.path(), "thermal_zone1", "81500\n");
+        fs::create_dir(dir.path().join("cooling_device0")).unwrap();
+
+        let mut settings = Environment {
+            max_temperature: Some(90.0),
+            thermal_zones_dir: dir.path().to_owned(),
+            ..Environment::default()
+        };
+        assert_eq!(check(&settings).unwrap(), None);
+
+        settings.max_temperature = Some(80.0);
+        assert_eq!(
+            check(&settings).unwrap(),
+            Some("thermal_zone1 is at 81.5°C, above the 80.0°C limit".to_owned())
+        );
+    }
+
+    #[test]
+    fn battery() {
+        let dir = tempfile::tempdir().unwrap();
+        assert_eq!(battery_capacity_in(dir.path()), None);
+
+        for (supply, kind, capacity) in &[("AC", "Mains", None), ("BAT0", "Battery", Some("87\n"))]
+        {
+            let supply = dir.path().join(supply);
+            fs::create_dir(&supply).unwrap();
+            fs::write(supply.join("type"), format!("{}\n", kind)).unwrap();
+            if let Some(capacity) = capacity {
+                fs::write(supply.join("capacity"), capacity).unwrap();
+            }
+        }
+        assert_eq!(battery_capacity_in(dir.path()), Some(87));
+    }
+
+    #[test]
+    fn check_script_alarm() {
+        let dir = tempfile::tempdir().unwrap();
+        let script = dir.path().join("check");
+        fs::write(&script, "#!/bin/sh\necho humidity is too high\nexit 1\n").unwrap();
+        fs::set_permissions(&script, fs::Permissions::from_mode(0o755)).unwrap();
+
+        let settings = Environment { check_script: Some(script), ..Environment::default() };
+        assert_eq!(check(&settings).unwrap(), Some("humidity is too high".to_owned()));
+    }
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Programming of the FPGAs through the Linux FPGA manager framework.
+//! The bitstream is staged in the firmware directory, as the manager
+//! loads it by name through the firmware loader, and programmed by
+//! writing its name to the `firmware` attribute of the manager, as the
+//! Xilinx kernels expose it.
+
+use super::{Error, Result};
+use slog_scope::{debug, info};
+use std::{
+    fs,
+    path::{Path, PathBuf},
+};
+
+const MANAGERS_DIR: &str = "/sys/class/fpga_manager";
+const FIRMWARE_DIR: &str = "/lib/firmware";
+
+// Flag of the manager for the partial reconfiguration, as defined by
+// `FPGA_MGR_PARTIAL_RECONFIG` in the kernel.
+const PARTIAL_RECONFIG_FLAG: u32 = 1;
+
+/// sysfs directory of the FPGA `manager`, as `fpga0`.
+pub(crate) fn manager_dir(manager: &str) -> Result<PathBuf> {
+    find_manager(Path::new(MANAGERS_DIR), manager)
+}
+
+/// Programs the FPGA of the `manager` with the bitstream in `source`,
+/// only reconfiguring a region of it when `partial`. The FPGA is checked
+/// to be operating afterwards.
+pub(crate) fn program(manager: &str, source: &Path, sha256sum: &str, partial: bool) -> Result<()> {
+    program_with(
+        Path::new(MANAGERS_DIR),
+        Path::new(FIRMWARE_DIR),
+        manager,
+        source,
+        sha256sum,
+        partial,
+    )
+}
+
+fn find_manager(managers_dir: &Path, manager: &str) -> Result<PathBuf> {
+    if manager.is_empty() || manager.contains('/') || manager == ".." {
+        return Err(Error::NoFpgaManager(manager.to_owned()));
+    }
+    let dir = managers_dir.join(manager);
+    if !dir.join("firmware").exists() {
+        return Err(Error::NoFpgaManager(manager.to_owned()));
+    }
+    Ok(dir)
+}
+
+fn program_with(
+    managers_dir: &Path,
+    firmware_dir: &Path,
+    manager: &str,
+    source: &Path,
+    sha256sum: &str,
+    partial: bool,
+) -> Result<()> {
+    let dir = find_manager(managers_dir, manager)?;
+
+    // The staged bitstream is named after its content, so a bitstream left
+    // behind by an interrupted install is overwritten by the next one.
+    let name = format!("updatehub-{}.bin", sha256sum);
+    let staged = firmware_dir.join(&name);
+    fs::create_dir_all(firmware_dir)?;
+    fs::copy(source, &staged)?;
+
+    let res = (|| {
+        let flags = if partial { PARTIAL_RECONFIG_FLAG } else { 0 };
+        fs::write(dir.join("flags"), flags.to_string())?;
+
+        info!("programming FPGA {} with {}", manager, name);
+        fs::write(dir.join("firmware"), &name)?;
+
+        let state = fs::read_to_string(dir.join("state"))?;
+        debug!("FPGA {} state is {}", manager, state.trim());
+        if state.trim() != "operating" {
+            return Err(Error::FpgaNotOperating(format!("{}: {}", manager, state.trim())));
+        }
+        Ok(())
+    })();
+
+    fs::remove_file(&staged)?;
+    res
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn fake_manager(state: &str) -> (tempfile::TempDir, PathBuf) {
+        let dir = tempfile::tempdir().unwrap();
+        let manager = dir.path().join("managers/fpga0");
+        fs::create_dir_all(&manager).unwrap();
+        fs::write(manager.join("firmware"), "").unwrap();
+        fs::write(manager.join("flags"), "0").unwrap();
+        fs::write(manager.join("state"), format!("{}\n", state)).unwrap();
+        let source = dir.path().join("bitstream");
+        fs::write(&source, b"bitstream").unwrap();
+        (dir, source)
+    }
+
+    #[test]
+    fn invalid_managers() {
+        let (dir, _) = fake_manager("operating");
+        let managers = dir.path().join("managers");
+        assert!(find_manager(&managers, "fpga0").is_ok());
+        for manager in &["", "..", "../managers/fpga0", "fpga1"] {
+            match find_manager(&managers, manager) {
+                Err(Error::NoFpgaManager(_)) => {}
+                res => panic!("Unexpected result: {:?}", res),
+            }
+        }
+    }
+
+    #[test]
+    fn program_fpga() {
+        let (dir, source) = fake_manager("operating");
+        let managers = dir.path().join("managers");
+        let firmware = dir.path().join("firmware");
+
+        program_with(&managers, &firmware, "fpga0", &source, "abc", true).unwrap();
+        assert_eq!(
+            fs::read_to_string(managers.join("fpga0/firmware")).unwrap(),
+            "updatehub-abc.bin"
+        );
+        assert_eq!(fs::read_to_string(managers.join("fpga0/flags")).unwrap(), "1");
+        assert!(!firmware.join("updatehub-abc.bin").exists());
+    }
+
+    #[test]
+    fn fpga_not_operating() {
+        let (dir, source) = fake_manager("write error");
+        let managers = dir.path().join("managers");
+        let firmware = dir.path().join("firmware");
+
+        match program_with(&managers, &firmware, "fpga0", &source, "abc", false) {
+            Err(Error::FpgaNotOperating(_)) => {}
+            res => panic!("Unexpected result: {:?}", res),
+        }
+        assert!(!firmware.join("updatehub-abc.bin").exists());
+    }
+}
@@ -4,23 +4,79 @@
 
 use super::{Error, Result};
 use crate::utils::definitions::IdExt;
+use nix::{fcntl::OFlag, sys::stat::Mode};
 use pkg_schema::definitions::{
     target_permissions::{Gid, Uid},
     Filesystem,
 };
-use std::{io, path::Path};
+use slog_scope::{debug, warn};
+use std::{
+    ffi::CString,
+    fs::File,
+    io,
+    os::unix::{
+        ffi::OsStrExt,
+        io::{AsRawFd, FromRawFd},
+    },
+    path::{Component, Path},
+    sync::atomic::{AtomicBool, Ordering},
+};
 use sys_mount::{Mount, Unmount, UnmountDrop};
 
+// Set from the extraction settings before installing, as the installers
+// are not given the settings.
+static LENIENT_PATHS: AtomicBool = AtomicBool::new(false);
+
+// Not yet exposed by libc, taken from linux/openat2.h.
+const SYS_OPENAT2: libc::c_long = 437;
+const RESOLVE_NO_MAGICLINKS: u64 = 0x02;
+const RESOLVE_BENEATH: u64 = 0x08;
+
+#[repr(C)]
+struct OpenHow {
+    flags: u64,
+    mode: u64,
+    resolve: u64,
+}
+
 pub(crate) fn ensure_disk_space(target: &Path, required: u64) -> Result<()> {
+    if required > available_space(target)? {
+        return Err(Error::NotEnoughSpace);
+    }
+    Ok(())
+}
+
+pub(crate) fn available_space(target: &Path) -> Result<u64> {
     let stat = nix::sys::statvfs::statvfs(target)?;
 
     // stat fields might be 32 or 64 bytes depending on host arch
-    let available = stat.block_size() as u64 * stat.blocks_free() as u64;
+    Ok(stat.block_size() as u64 * stat.blocks_free() as u64)
+}
 
-    if required > available {
-        return Err(Error::NotEnoughSpace);
+/// Reserves the blocks of the `file` up to `size`, so it is written
+/// unfragmented and running out of space fails before anything is
+/// written. The file size is kept, as the given size may be an estimate.
+/// Filesystems without fallocate support are left to allocate the blocks
+/// as the file is written.
+pub(crate) fn preallocate(file: &File, size: u64) -> Result<()> {
+    use nix::{
+        errno::Errno,
+        fcntl::{fallocate, FallocateFlags},
+    };
+
+    if size == 0 {
+        return Ok(());
+    }
+
+    match fallocate(file.as_raw_fd(), FallocateFlags::FALLOC_FL_KEEP_SIZE, 0, size as libc::off_t) {
+        Ok(_) => Ok(()),
+        Err(nix::Error::Sys(Errno::ENOSPC)) => Err(Error::NotEnoughSpace),
+        Err(nix::Error::Sys(Errno::EOPNOTSUPP)) | Err(nix::Error::Sys(Errno::ENOSYS)) => {
+            debug!("filesystem doesn't support preallocation, skipping it");
+            Ok(())
+        }
+        Err(e) => Err(e.into()),
     }
-    Ok(())
 }
 
 pub(crate) fn is_executable_in_path(cmd: &str) -> Result<()> {
@@ -98,3 +154,142 @@ pub(crate) fn chown(path: &Path, uid: &Option<Uid>, gid: &Option<Gid>) -> Result
         gid.as_ref().map(|id| nix::unistd::Gid::from_raw(id.as_u32())),
     )?)
 }
+
+/// Bytes the block `device` has written since the system booted, as
+/// reported by the kernel. Other devices, as MTD and UBI volumes, don't
+/// report it.
+pub(crate) fn written_bytes(device: &Path) -> Option<u64> {
+    let device = device.canonicalize().ok()?;
+    let stat = std::fs::read_to_string(
+        Path::new("/sys/class/block").join(device.file_name()?).join("stat"),
+    )
+    .ok()?;
+
+    // The seventh field is the number of 512 bytes sectors written.
+    stat.split_whitespace().nth(6)?.parse::<u64>().ok().map(|sectors| sectors * 512)
+}
+
+pub(crate) fn set_lenient_paths(lenient: bool) {
+    LENIENT_PATHS.store(lenient, Ordering::Relaxed);
+}
+
+/// Opens `path`, relative to `root`, making sure it is resolved inside
+/// `root`, so neither `..` nor absolute symlinks found on the target
+/// filesystem make it escape to the host. The kernel does the resolution
+/// when `openat2` is available, otherwise the path is resolved before
+/// being opened.
+pub(crate) fn open_beneath(root: &Path, path: &Path, flags: OFlag) -> Result<File> {
+    let flags = flags | OFlag::O_CLOEXEC;
+    match openat2_beneath(root, path, flags) {
+        Err(e) if e.raw_os_error() == Some(libc::ENOSYS) => {
+            if !resolves_beneath(root, path)? {
+                path_escapes(root, path)?;
+            }
+        }
+        Err(e) if e.raw_os_error() == Some(libc::EXDEV) => path_escapes(root, path)?,
+        res => return Ok(res?),
+    }
+
+    let fd = nix::fcntl::open(&root.join(path), flags, Mode::from_bits_truncate(0o666))?;
+    Ok(unsafe { File::from_raw_fd(fd) })
+}
+
+fn openat2_beneath(root: &Path, path: &Path, flags: OFlag) -> io::Result<File> {
+    let dir = File::open(root)?;
+    let path = if path.as_os_str().is_empty() { Path::new(".") } else { path };
+    let path = CString::new(path.as_os_str().as_bytes())?;
+    let how = OpenHow {
+        flags: flags.bits() as u64,
+        mode: 0o666,
+        resolve: RESOLVE_BENEATH | RESOLVE_NO_MAGICLINKS,
+    };
+
+    let fd = unsafe {
+        libc::syscall(
+            SYS_OPENAT2,
+            dir.as_raw_fd(),
+            path.as_ptr(),
+            &how as *const OpenHow,
+            std::mem::size_of::<OpenHow>(),
+        )
+    };
+    if fd < 0 {
+        return Err(io::Error::last_os_error());
+    }
+
+    Ok(unsafe { File::from_raw_fd(fd as i32) })
+}
+
+/// Resolves the path in userspace, as for kernels lacking openat2,
+/// telling whether it is kept beneath `root`. The path may not exist yet,
+/// so its deepest existing ancestor is resolved instead.
+pub(crate) fn resolves_beneath(root: &Path, path: &Path) -> io::Result<bool> {
+    if path.components().any(|c| c == Component::ParentDir) {
+        return Ok(false);
+    }
+
+    let root = root.canonicalize()?;
+    let mut target = root.join(path);
+    loop {
+        match target.canonicalize() {
+            Ok(resolved) => return Ok(resolved.starts_with(&root)),
+            // Dangling symlinks can't be followed to check where they
+            // point to.
+            Err(_) if target.symlink_metadata().is_ok() => return Ok(false),
+            Err(_) => match target.parent() {
+                Some(parent) => target = parent.to_owned(),
+                None => return Ok(false),
+            },
+        }
+    }
+}
+
+fn path_escapes(root: &Path, path: &Path) -> Result<()> {
+    if LENIENT_PATHS.load(Ordering::Relaxed) {
+        warn!("{:?} resolves outside {:?}, allowed as lenient paths are enabled", path, root);
+        return Ok(());
+    }
+
+    Err(Error::PathEscapesTarget(root.join(path)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::symlink;
+
+    #[test]
+    fn open_inside_root() {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::create_dir(dir.path().join("etc")).unwrap();
+        symlink("etc", dir.path().join("link")).unwrap();
+
+        let flags = OFlag::O_RDWR | OFlag::O_CREAT;
+        open_beneath(dir.path(), Path::new("etc/file"), flags).unwrap();
+        open_beneath(dir.path(), Path::new("link/file"), flags).unwrap();
+        assert!(dir.path().join("etc/file").exists());
+    }
+
+    #[test]
+    fn reject_escaping_paths() {
+        let dir = tempfile::tempdir().unwrap();
+        let outside = tempfile::tempdir().unwrap();
+        symlink(outside.path(), dir.path().join("abs")).unwrap();
+
+        let flags = OFlag::O_RDWR | OFlag::O_CREAT;
+        assert!(open_beneath(dir.path(), Path::new("abs/file"), flags).is_err());
+        assert!(open_beneath(dir.path(), Path::new("../file"), flags).is_err());
+        assert!(!outside.path().join("file").exists());
+
+        assert!(!resolves_beneath(dir.path(), Path::new("abs/file")).unwrap());
+        assert!(resolves_beneath(dir.path(), Path::new("file")).unwrap());
+    }
+
+    #[test]
+    fn preallocate_file() {
+        let file = tempfile::tempfile().unwrap();
+        preallocate(&file, 0).unwrap();
+        preallocate(&file, 4096).unwrap();
+        assert_eq!(file.metadata().unwrap().len(), 0);
+    }
+}
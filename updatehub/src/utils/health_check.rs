@@ -0,0 +1,230 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Health checks the installation just booted into must pass to be
+//! confirmed. Each check is a command or an HTTP request, run until it
+//! passes or runs out of retries, and the report of all of them tells
+//! whether the installation is confirmed or rolled back.
+
+use sdk::api::info::settings::{BootConfirmation, HealthCheck};
+use slog_scope::{info, warn};
+use std::{
+    process::{Command, Stdio},
+    time::{Duration, Instant},
+};
+
+// Interval the commands are polled at while they are waited for.
+const POLL_INTERVAL: Duration = Duration::from_millis(100);
+
+/// Aggregate result of the checks run so far.
+#[derive(Debug, PartialEq)]
+pub(crate) enum Verdict {
+    /// All the checks have passed.
+    Passed,
+    /// Some checks are yet to pass, with retries left.
+    Pending,
+    /// Some check has run out of retries.
+    Failed,
+}
+
+/// Results of the checks, kept across their runs.
+#[derive(Debug, Default, PartialEq)]
+pub(crate) struct Report {
+    results: Vec<CheckResult>,
+}
+
+#[derive(Debug, PartialEq)]
+struct CheckResult {
+    name: String,
+    passed: bool,
+    failures: u32,
+    error: Option<String>,
+}
+
+/// Checks the installation must pass, the `health_check` executable
+/// being taken as one of them, retried until the timeout.
+pub(crate) fn checks(settings: &BootConfirmation) -> Vec<HealthCheck> {
+    settings
+        .health_check
+        .iter()
+        .map(|path| HealthCheck {
+            name: "health-check".to_owned(),
+            command: Some(path.to_string_lossy().into_owned()),
+            url: None,
+            retries: 0,
+            timeout: settings.timeout,
+        })
+        .chain(settings.health_checks.iter().cloned())
+        .collect()
+}
+
+impl Report {
+    /// Runs the `checks` which haven't passed yet, nor run out of
+    /// retries, once each.
+    pub(crate) async fn run(&mut self, checks: &[HealthCheck]) -> Verdict {
+        if self.results.len() != checks.len() {
+            self.results = checks
+                .iter()
+                .map(|check| CheckResult {
+                    name: check.name.clone(),
+                    passed: false,
+                    failures: 0,
+                    error: None,
+                })
+                .collect();
+        }
+
+        for (check, result) in checks.iter().zip(self.results.iter_mut()) {
+            if result.passed || is_exhausted(check, result) {
+                continue;
+            }
+            match run_check(check).await {
+                Ok(()) => {
+                    info!("health check '{}' has passed", check.name);
+                    result.passed = true;
+                }
+                Err(e) => {
+                    warn!("health check '{}' has failed: {}", check.name, e);
+                    result.failures += 1;
+                    result.error = Some(e);
+                }
+            }
+        }
+
+        if checks.iter().zip(&self.results).any(|(check, result)| is_exhausted(check, result)) {
+            Verdict::Failed
+        } else if self.results.iter().all(|result| result.passed) {
+            Verdict::Passed
+        } else {
+            Verdict::Pending
+        }
+    }
+
+    /// Describes the result of each check, as reported on rollback.
+    pub(crate) fn summary(&self) -> String {
+        self.results
+            .iter()
+            .map(|result| match (&result.error, result.passed) {
+                (_, true) => format!("{}: passed", result.name),
+                (None, false) => format!("{}: not run", result.name),
+                (Some(e), false) => {
+                    format!("{}: failed {} times, last with: {}", result.name, result.failures, e)
+                }
+            })
+            .collect::<Vec<_>>()
+            .join("; ")
+    }
+}
+
+fn is_exhausted(check: &HealthCheck, result: &CheckResult) -> bool {
+    !result.passed && check.retries != 0 && result.failures >= check.retries
+}
+
+async fn run_check(check: &HealthCheck) -> Result<(), String> {
+    let timeout = check.timeout.to_std().unwrap_or_default();
+    match (&check.command, &check.url) {
+        (Some(command), None) => run_command(command, timeout).await,
+        (None, Some(url)) => request(url, timeout).await,
+        _ => Err("either a command or an url must be checked".to_owned()),
+    }
+}
+
+// The command is killed if it doesn't finish in time, so a hung check
+// doesn't hold the confirmation back.
+async fn run_command(command: &str, timeout: Duration) -> Result<(), String> {
+    let mut child = Command::new("sh")
+        .args(&["-c", command])
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()
+        .map_err(|e| e.to_string())?;
+
+    let deadline = Instant::now() + timeout;
+    loop {
+        match child.try_wait() {
+            Ok(Some(status)) if status.success() => return Ok(()),
+            Ok(Some(status)) => return Err(format!("exited with {}", status)),
+            Ok(None) if Instant::now() >= deadline => {
+                let _ = child.kill();
+                let _ = child.wait();
+                return Err(format!("has not finished within {:?}", timeout));
+            }
+            Ok(None) => async_std::task::sleep(POLL_INTERVAL).await,
+            Err(e) => return Err(e.to_string()),
+        }
+    }
+}
+
+async fn request(url: &str, timeout: Duration) -> Result<(), String> {
+    let response = awc::Client::builder()
+        .timeout(timeout)
+        .finish()
+        .get(url)
+        .send()
+        .await
+        .map_err(|e| e.to_string())?;
+    if response.status().is_success() {
+        Ok(())
+    } else {
+        Err(format!("replied with {}", response.status()))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn command(name: &str, command: &str, retries: u32) -> HealthCheck {
+        HealthCheck {
+            name: name.to_owned(),
+            command: Some(command.to_owned()),
+            url: None,
+            retries,
+            timeout: chrono::Duration::seconds(5),
+        }
+    }
+
+    #[actix_rt::test]
+    async fn all_checks_pass() {
+        let checks = [command("true", "true", 1), command("exit", "exit 0", 0)];
+        let mut report = Report::default();
+        assert_eq!(report.run(&checks).await, Verdict::Passed);
+        assert_eq!(report.summary(), "true: passed; exit: passed");
+    }
+
+    #[actix_rt::test]
+    async fn check_out_of_retries() {
+        let checks = [command("true", "true", 0), command("false", "false", 2)];
+        let mut report = Report::default();
+        assert_eq!(report.run(&checks).await, Verdict::Pending);
+        assert_eq!(report.run(&checks).await, Verdict::Failed);
+        assert_eq!(
+            report.summary(),
+            "true: passed; false: failed 2 times, last with: exited with exit code: 1"
+        );
+    }
+
+    #[actix_rt::test]
+    async fn command_timeout() {
+        let check =
+            HealthCheck { timeout: chrono::Duration::zero(), ..command("sleep", "sleep 5", 1) };
+        let mut report = Report::default();
+        assert_eq!(report.run(&[check]).await, Verdict::Failed);
+    }
+
+    #[test]
+    fn legacy_health_check() {
+        let settings = BootConfirmation {
+            health_check: Some("/usr/share/updatehub/health-check".into()),
+            health_checks: vec![command("app", "true", 3)],
+            ..BootConfirmation::default()
+        };
+        let checks = checks(&settings);
+        assert_eq!(checks.len(), 2);
+        assert_eq!(checks[0].command.as_deref(), Some("/usr/share/updatehub/health-check"));
+        assert_eq!(checks[0].retries, 0);
+    }
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use sdk::api::info::settings::Hooks;
+use slog_scope::{debug, error, info, warn};
+use std::{
+    fmt, fs,
+    io::Write,
+    os::unix::fs::PermissionsExt,
+    path::{Path, PathBuf},
+    process::{Command, Stdio},
+};
+
+/// Whether the hooks run before or after the state.
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub(crate) enum Phase {
+    Pre,
+    Post,
+}
+
+impl fmt::Display for Phase {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(match self {
+            Phase::Pre => "pre",
+            Phase::Post => "post",
+        })
+    }
+}
+
+/// Runs the hooks of the `state`, in lexical order, passing the update
+/// `metadata` on their stdin and the state `env` in their environment. A
+/// failing hook is only logged, unless the settings ask to abort on
+/// failures.
+pub(crate) fn run(
+    settings: &Hooks,
+    state: &str,
+    phase: Phase,
+    metadata: &[u8],
+    env: &[(&str, String)],
+) -> Result<()> {
+    for hook in hooks(&settings.directory.join(format!("{}.d", state)))? {
+        info!("running {} hook {:?}", phase, hook);
+        match run_hook(&hook, phase, metadata, env) {
+            Ok(()) => {}
+            Err(e) if settings.abort_on_failure => return Err(e),
+            Err(e) => warn!("ignoring failed hook: {}", e),
+        }
+    }
+
+    Ok(())
+}
+
+fn hooks(dir: &Path) -> Result<Vec<PathBuf>> {
+    if !dir.exists() {
+        return Ok(Vec::default());
+    }
+
+    let mut hooks = Vec::default();
+    for entry in fs::read_dir(dir)? {
+        let path = entry?.path();
+        if path.is_file() && path.metadata()?.permissions().mode() & 0o111 != 0 {
+            hooks.push(path);
+        } else {
+            debug!("skipping {:?} as it is not executable", path);
+        }
+    }
+    hooks.sort();
+
+    Ok(hooks)
+}
+
+fn run_hook(hook: &Path, phase: Phase, metadata: &[u8], env: &[(&str, String)]) -> Result<()> {
+    let mut child = Command::new(hook)
+        .arg(phase.to_string())
+        .envs(env.iter().cloned())
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+
+    // The metadata is fed from another thread so the hook doesn't block
+    // writing to a full stdout pipe. Hooks not reading it are fine.
+    let mut stdin = child.stdin.take().expect("stdin is piped");
+    let metadata = metadata.to_vec();
+    let writer = std::thread::spawn(move || {
+        let _ = stdin.write_all(&metadata);
+    });
+
+    let output = child.wait_with_output()?;
+    writer.join().expect("metadata writer has panicked");
+    for line in String::from_utf8_lossy(&output.stdout).lines() {
+        info!("{} (stdout): {}", hook.display(), line);
+    }
+    for line in String::from_utf8_lossy(&output.stderr).lines() {
+        error!("{} (stderr): {}", hook.display(), line);
+    }
+
+    if !output.status.success() {
+        return Err(Error::HookFailed(hook.to_owned(), output.status));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn create_hook(dir: &Path, name: &str, script: &str) {
+        let hook = dir.join(name);
+        fs::write(&hook, format!("#!/bin/sh\n{}\n", script)).unwrap();
+        fs::set_permissions(&hook, fs::Permissions::from_mode(0o755)).unwrap();
+    }
+
+    #[test]
+    fn run_hooks_in_order() {
+        let dir = tempfile::tempdir().unwrap();
+        let hooks_dir = dir.path().join("install.d");
+        let output = dir.path().join("output");
+        fs::create_dir(&hooks_dir).unwrap();
+        create_hook(&hooks_dir, "20-second", &format!("echo $1 $FOO >> {:?}", output));
+        create_hook(&hooks_dir, "10-first", &format!("cat >> {:?}", output));
+        fs::write(hooks_dir.join("30-disabled"), "").unwrap();
+
+        let settings = Hooks { directory: dir.path().to_owned(), abort_on_failure: true };
+        run(&settings, "install", Phase::Pre, b"{}\n", &[("FOO", "bar".to_owned())]).unwrap();
+        run(&settings, "download", Phase::Pre, b"{}\n", &[]).unwrap();
+        assert_eq!(fs::read_to_string(&output).unwrap(), "{}\npre bar\n");
+    }
+
+    #[test]
+    fn failing_hook() {
+        let dir = tempfile::tempdir().unwrap();
+        let hooks_dir = dir.path().join("reboot.d");
+        fs::create_dir(&hooks_dir).unwrap();
+        create_hook(&hooks_dir, "fail", "exit 1");
+
+        let mut settings = Hooks { directory: dir.path().to_owned(), abort_on_failure: false };
+        run(&settings, "reboot", Phase::Post, b"", &[]).unwrap();
+        settings.abort_on_failure = true;
+        assert!(run(&settings, "reboot", Phase::Post, b"", &[]).is_err());
+    }
+}
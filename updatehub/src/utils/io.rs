@@ -2,13 +2,40 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
+use nix::fcntl::{fcntl, FcntlArg, OFlag};
+use slog_scope::{debug, warn};
 use std::{
-    io::{BufReader, BufWriter, Read, Seek, Write},
-    os::unix::io::AsRawFd,
+    fs::{File, OpenOptions},
+    io::{self, BufReader, BufWriter, Read, Seek, Write},
+    os::unix::{
+        fs::{FileExt, OpenOptionsExt},
+        io::AsRawFd,
+    },
+    path::{Path, PathBuf},
+    sync::atomic::{AtomicBool, Ordering},
     time::Duration,
 };
 use timeout_readwrite::{TimeoutReader, TimeoutWriter};
 
+// Alignment of the direct I/O buffers and offsets, a multiple of the
+// logical block size of the storage devices.
+const DIRECT_IO_ALIGNMENT: usize = 4096;
+
+// Size of the blocks compared by the differential writes, as the pages
+// of most flash devices.
+const DIFFERENTIAL_BLOCK_SIZE: usize = 4096;
+
+static DIRECT_IO: AtomicBool = AtomicBool::new(false);
+
+/// Sets whether the raw objects are written bypassing the page cache.
+pub(crate) fn set_direct_io(enabled: bool) {
+    DIRECT_IO.store(enabled, Ordering::Relaxed);
+}
+
+pub(crate) fn is_direct_io() -> bool {
+    DIRECT_IO.load(Ordering::Relaxed)
+}
+
 pub(crate) fn timed_buf_reader<R>(chunk_size: usize, reader: R) -> BufReader<TimeoutReader<R>>
 where
     R: Read + Seek + AsRawFd,
@@ -22,3 +49,330 @@ where
 {
     BufWriter::with_capacity(chunk_size, TimeoutWriter::new(writer, Duration::from_secs(5)))
 }
+
+/// Writes the same data to the primary writer and to its mirrors, so it
+/// is produced once for all of them. The primary errors are returned,
+/// while a failing mirror is only dropped, the others being written on.
+pub(crate) struct TeeWriter<W> {
+    primary: W,
+    mirrors: Vec<(PathBuf, Option<W>)>,
+}
+
+impl<W: Write> TeeWriter<W> {
+    pub(crate) fn new(primary: W, mirrors: Vec<(PathBuf, W)>) -> Self {
+        TeeWriter {
+            primary,
+            mirrors: mirrors.into_iter().map(|(path, writer)| (path, Some(writer))).collect(),
+        }
+    }
+
+    /// Mirrors which have failed to be written.
+    pub(crate) fn failed_mirrors(&self) -> Vec<&PathBuf> {
+        self.mirrors.iter().filter(|(_, writer)| writer.is_none()).map(|(path, _)| path).collect()
+    }
+
+    fn for_each_mirror(&mut self, mut f: impl FnMut(&mut W) -> io::Result<()>) {
+        for (path, mirror) in self.mirrors.iter_mut() {
+            if let Some(Err(e)) = mirror.as_mut().map(&mut f) {
+                warn!("failed to write mirror {:?}, skipping it: {}", path, e);
+                *mirror = None;
+            }
+        }
+    }
+}
+
+impl<W: Write> Write for TeeWriter<W> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        // The whole buffer is written, so the mirrors are kept in step
+        // with the primary.
+        self.primary.write_all(buf)?;
+        self.for_each_mirror(|mirror| mirror.write_all(buf));
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.primary.flush()?;
+        self.for_each_mirror(Write::flush);
+        Ok(())
+    }
+}
+
+/// Writes a file opened with `O_DIRECT`, bypassing the page cache, so
+/// the objects written don't evict the cache of the applications. The
+/// data is gathered in an aligned buffer and written in whole blocks, but
+/// for its tail which is written once the direct I/O is turned off.
+pub(crate) struct DirectWriter {
+    file: File,
+    offset: u64,
+    buf: AlignedBuf,
+}
+
+impl DirectWriter {
+    /// Opens the `path` to be written from `offset`, unless it doesn't
+    /// take direct I/O, as the filesystems without support for it or the
+    /// offsets out of alignment.
+    pub(crate) fn open(path: &Path, offset: u64, chunk_size: usize) -> io::Result<Option<Self>> {
+        if offset % DIRECT_IO_ALIGNMENT as u64 != 0 {
+            debug!("offset {} is unaligned, not using direct I/O for {:?}", offset, path);
+            return Ok(None);
+        }
+
+        match OpenOptions::new().write(true).custom_flags(libc::O_DIRECT).open(path) {
+            Ok(file) => Ok(Some(Self::new(file, offset, chunk_size))),
+            Err(e) if e.raw_os_error() == Some(libc::EINVAL) => {
+                debug!("{:?} doesn't support direct I/O", path);
+                Ok(None)
+            }
+            Err(e) => Err(e),
+        }
+    }
+
+    fn new(file: File, offset: u64, chunk_size: usize) -> Self {
+        DirectWriter { file, offset, buf: AlignedBuf::new(chunk_size) }
+    }
+
+    fn write_blocks(&mut self) -> io::Result<()> {
+        let len = self.buf.len - self.buf.len % DIRECT_IO_ALIGNMENT;
+        if len == 0 {
+            return Ok(());
+        }
+        self.file.write_all_at(&self.buf.filled()[..len], self.offset)?;
+        self.offset += len as u64;
+        self.buf.consume(len);
+        Ok(())
+    }
+
+    fn disable_direct_io(&self) -> io::Result<()> {
+        let to_io = |e: nix::Error| io::Error::new(io::ErrorKind::Other, e);
+        let fd = self.file.as_raw_fd();
+        let flags = OFlag::from_bits_truncate(fcntl(fd, FcntlArg::F_GETFL).map_err(to_io)?);
+        fcntl(fd, FcntlArg::F_SETFL(flags - OFlag::O_DIRECT)).map_err(to_io)?;
+        Ok(())
+    }
+}
+
+impl Write for DirectWriter {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let spare = self.buf.spare();
+        let len = spare.len().min(buf.len());
+        spare[..len].copy_from_slice(&buf[..len]);
+        self.buf.len += len;
+        if self.buf.spare().is_empty() {
+            self.write_blocks()?;
+        }
+        Ok(len)
+    }
+
+    // The tail left, not filling a block, can't be written directly. The
+    // writes after it go through the page cache, as they are unaligned.
+    fn flush(&mut self) -> io::Result<()> {
+        self.write_blocks()?;
+        if self.buf.len > 0 {
+            self.disable_direct_io()?;
+            self.file.write_all_at(self.buf.filled(), self.offset)?;
+            self.offset += self.buf.len as u64;
+            self.buf.len = 0;
+        }
+        Ok(())
+    }
+}
+
+impl Drop for DirectWriter {
+    fn drop(&mut self) {
+        let _ = self.flush();
+    }
+}
+
+/// Writes a file only where its content differs, so rewriting a large
+/// file which has barely changed, as a database, takes and wears the
+/// flash only as much as the changed blocks. The data is compared with
+/// the file a block at a time, at the same offsets, and the file is cut
+/// to the length written once finished.
+pub(crate) struct DifferentialWriter {
+    file: File,
+    offset: u64,
+    block: Vec<u8>,
+    current: Vec<u8>,
+    blocks: u64,
+    rewritten: u64,
+}
+
+impl DifferentialWriter {
+    pub(crate) fn new(file: File) -> Self {
+        DifferentialWriter {
+            file,
+            offset: 0,
+            block: Vec::with_capacity(DIFFERENTIAL_BLOCK_SIZE),
+            current: vec![0; DIFFERENTIAL_BLOCK_SIZE],
+            blocks: 0,
+            rewritten: 0,
+        }
+    }
+
+    /// Writes the data left and truncates the file past it.
+    pub(crate) fn finish(&mut self) -> io::Result<()> {
+        self.flush()?;
+        self.file.set_len(self.offset)
+    }
+
+    /// Number of blocks written and of those which have been rewritten.
+    pub(crate) fn stats(&self) -> (u64, u64) {
+        (self.blocks, self.rewritten)
+    }
+
+    fn write_block(&mut self) -> io::Result<()> {
+        let len = self.block.len();
+        if len == 0 {
+            return Ok(());
+        }
+
+        let current = &mut self.current[..len];
+        let mut read = 0;
+        while read < len {
+            match self.file.read_at(&mut current[read..], self.offset + read as u64)? {
+                0 => break,
+                n => read += n,
+            }
+        }
+        if read != len || current[..] != self.block[..] {
+            self.file.write_all_at(&self.block, self.offset)?;
+            self.rewritten += 1;
+        }
+
+        self.blocks += 1;
+        self.offset += len as u64;
+        self.block.clear();
+        Ok(())
+    }
+}
+
+impl Write for DifferentialWriter {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let len = (DIFFERENTIAL_BLOCK_SIZE - self.block.len()).min(buf.len());
+        self.block.extend_from_slice(&buf[..len]);
+        if self.block.len() == DIFFERENTIAL_BLOCK_SIZE {
+            self.write_block()?;
+        }
+        Ok(len)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.write_block()
+    }
+}
+
+/// Buffer whose data starts at an aligned address, as direct I/O takes.
+struct AlignedBuf {
+    data: Vec<u8>,
+    start: usize,
+    capacity: usize,
+    len: usize,
+}
+
+impl AlignedBuf {
+    fn new(capacity: usize) -> Self {
+        let capacity = match capacity % DIRECT_IO_ALIGNMENT {
+            0 if capacity > 0 => capacity,
+            rem => capacity + DIRECT_IO_ALIGNMENT - rem,
+        };
+        // The data is never grown, so it keeps its address.
+        let data = vec![0; capacity + DIRECT_IO_ALIGNMENT];
+        let start = data.as_ptr().align_offset(DIRECT_IO_ALIGNMENT);
+        AlignedBuf { data, start, capacity, len: 0 }
+    }
+
+    fn filled(&self) -> &[u8] {
+        &self.data[self.start..self.start + self.len]
+    }
+
+    fn spare(&mut self) -> &mut [u8] {
+        &mut self.data[self.start + self.len..self.start + self.capacity]
+    }
+
+    // The data left is moved to the start, keeping it aligned.
+    fn consume(&mut self, len: usize) {
+        self.data.copy_within(self.start + len..self.start + self.len, self.start);
+        self.len -= len;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    struct Failing;
+
+    impl Write for Failing {
+        fn write(&mut self, _: &[u8]) -> io::Result<usize> {
+            Err(io::Error::new(io::ErrorKind::Other, "broken device"))
+        }
+
+        fn flush(&mut self) -> io::Result<()> {
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn isolate_failing_mirrors() {
+        let mut tee = TeeWriter::new(
+            Box::new(Vec::new()) as Box<dyn Write>,
+            vec![
+                (PathBuf::from("/dev/mirror1"), Box::new(Failing) as Box<dyn Write>),
+                (PathBuf::from("/dev/mirror2"), Box::new(io::sink())),
+            ],
+        );
+        tee.write_all(b"object").unwrap();
+        tee.flush().unwrap();
+        assert_eq!(tee.failed_mirrors(), vec![&PathBuf::from("/dev/mirror1")]);
+
+        let mut tee = TeeWriter::new(Failing, Vec::default());
+        assert!(tee.write_all(b"object").is_err());
+    }
+
+    #[test]
+    fn differential_writes() {
+        let mut file = tempfile::tempfile().unwrap();
+        let mut content = vec![0xaa; 4 * DIFFERENTIAL_BLOCK_SIZE];
+        file.write_all(&content).unwrap();
+        content[DIFFERENTIAL_BLOCK_SIZE + 10] = 0x55;
+        content.truncate(3 * DIFFERENTIAL_BLOCK_SIZE + 100);
+
+        let mut writer = DifferentialWriter::new(file.try_clone().unwrap());
+        for chunk in content.chunks(3000) {
+            writer.write_all(chunk).unwrap();
+        }
+        writer.finish().unwrap();
+        assert_eq!(writer.stats(), (4, 1));
+
+        let mut written = Vec::default();
+        file.seek(io::SeekFrom::Start(0)).unwrap();
+        file.read_to_end(&mut written).unwrap();
+        assert_eq!(written, content);
+    }
+
+    #[test]
+    fn direct_writes() {
+        let mut file = tempfile::tempfile().unwrap();
+        file.write_all(&[0xff; 3 * DIRECT_IO_ALIGNMENT]).unwrap();
+        let content = (0..10_000).map(|i| (i % 251) as u8).collect::<Vec<_>>();
+
+        let mut writer =
+            DirectWriter::new(file.try_clone().unwrap(), DIRECT_IO_ALIGNMENT as u64, 5000);
+        assert_eq!(writer.buf.filled().as_ptr() as usize % DIRECT_IO_ALIGNMENT, 0);
+        for chunk in content.chunks(3000) {
+            writer.write_all(chunk).unwrap();
+        }
+        writer.flush().unwrap();
+        assert_eq!(writer.offset, (DIRECT_IO_ALIGNMENT + content.len()) as u64);
+
+        let mut written = Vec::default();
+        file.seek(io::SeekFrom::Start(0)).unwrap();
+        file.read_to_end(&mut written).unwrap();
+        assert_eq!(&written[..DIRECT_IO_ALIGNMENT], &[0xff; DIRECT_IO_ALIGNMENT][..]);
+        assert_eq!(
+            &written[DIRECT_IO_ALIGNMENT..DIRECT_IO_ALIGNMENT + content.len()],
+            &content[..]
+        );
+    }
+}
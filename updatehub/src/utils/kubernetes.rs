@@ -0,0 +1,85 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use sdk::api::info::settings::Kubernetes;
+use slog_scope::info;
+
+/// Cordons and drains the local node so its workloads are moved before
+/// the device reboots. Nothing is done if no kubeconfig is set.
+pub(crate) fn drain(settings: &Kubernetes) -> Result<()> {
+    if let Some(cmd) = kubectl(settings, "drain")? {
+        info!("draining kubernetes node before reboot");
+        easy_process::run(&format!(
+            "{} --ignore-daemonsets --delete-local-data --timeout={}s",
+            cmd,
+            settings.drain_timeout.num_seconds()
+        ))?;
+    }
+
+    Ok(())
+}
+
+/// Allows the local node to receive workloads again once the update
+/// has been committed. Nothing is done if no kubeconfig is set.
+pub(crate) fn uncordon(settings: &Kubernetes) -> Result<()> {
+    if let Some(cmd) = kubectl(settings, "uncordon")? {
+        info!("uncordoning kubernetes node after update");
+        easy_process::run(&cmd)?;
+    }
+
+    Ok(())
+}
+
+fn kubectl(settings: &Kubernetes, action: &str) -> Result<Option<String>> {
+    let kubeconfig = match settings.kubeconfig {
+        Some(ref kubeconfig) => kubeconfig,
+        None => return Ok(None),
+    };
+    let node = match settings.node_name {
+        Some(ref node) => node.clone(),
+        None => {
+            let mut buf = [0u8; 64];
+            nix::unistd::gethostname(&mut buf)?.to_string_lossy().into_owned()
+        }
+    };
+
+    Ok(Some(format!("kubectl --kubeconfig {} {} {}", kubeconfig.display(), action, node)))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use chrono::Duration;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn drain_and_uncordon() {
+        let (_handle, calls) = create_echo_bins(&["kubectl"]).unwrap();
+        let settings = Kubernetes {
+            kubeconfig: Some("/etc/rancher/k3s/k3s.yaml".into()),
+            node_name: Some("edge-01".to_string()),
+            drain_timeout: Duration::minutes(5),
+        };
+
+        drain(&settings).unwrap();
+        uncordon(&settings).unwrap();
+        assert_eq!(
+            std::fs::read_to_string(calls).unwrap(),
+            "kubectl --kubeconfig /etc/rancher/k3s/k3s.yaml drain edge-01 --ignore-daemonsets \
+             --delete-local-data --timeout=300s\n\
+             kubectl --kubeconfig /etc/rancher/k3s/k3s.yaml uncordon edge-01\n"
+        );
+    }
+
+    #[test]
+    fn disabled_without_kubeconfig() {
+        let (_handle, calls) = create_echo_bins(&["kubectl"]).unwrap();
+
+        drain(&Kubernetes::default()).unwrap();
+        uncordon(&Kubernetes::default()).unwrap();
+        assert!(!calls.exists());
+    }
+}
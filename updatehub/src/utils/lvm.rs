@@ -0,0 +1,104 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! LVM logical volumes as targets, named as `vg/lv`. The volumes are
+//! activated before they are used, and may be snapshotted before they are
+//! written, so they can be reverted by merging the snapshot back.
+
+use super::{Error, Result};
+use slog_scope::{debug, info};
+use std::path::{Path, PathBuf};
+
+// Appended to the name of the volume for its snapshot.
+const SNAPSHOT_SUFFIX: &str = "_updatehub";
+
+/// Activates the logical `volume`, returning its device.
+pub(crate) fn target_device_from_lvm_volume(volume: &str) -> Result<PathBuf> {
+    let (vg, lv) = split_volume(volume)?;
+    easy_process::run(&format!("lvchange --activate y {}/{}", vg, lv))?;
+
+    let device = Path::new("/dev").join(vg).join(lv);
+    if !device.exists() {
+        return Err(Error::DeviceDoesNotExist);
+    }
+    Ok(device)
+}
+
+/// Snapshots the logical `volume`, so it can be reverted once written. A
+/// snapshot left from a previous install is dropped first.
+pub(crate) fn create_snapshot(volume: &str) -> Result<()> {
+    let (vg, lv) = split_volume(volume)?;
+    if snapshot_exists(vg, lv) {
+        remove_snapshot(volume)?;
+    }
+
+    info!("creating snapshot of LVM volume {}", volume);
+    // The snapshot is as large as the volume, so it never overflows,
+    // however much of the volume is written.
+    easy_process::run(&format!(
+        "lvcreate --snapshot --extents 100%ORIGIN --name {}{} {}/{}",
+        lv, SNAPSHOT_SUFFIX, vg, lv
+    ))?;
+    Ok(())
+}
+
+/// Reverts the logical `volume` to its snapshot, which is dropped once
+/// merged. The merge is deferred until the volume is next activated when
+/// it is in use.
+pub(crate) fn merge_snapshot(volume: &str) -> Result<()> {
+    let (vg, lv) = split_volume(volume)?;
+    info!("merging snapshot of LVM volume {}", volume);
+    easy_process::run(&format!("lvconvert --merge {}/{}{}", vg, lv, SNAPSHOT_SUFFIX))?;
+    Ok(())
+}
+
+/// Drops the snapshot of the logical `volume`, keeping what has been
+/// written to it.
+pub(crate) fn remove_snapshot(volume: &str) -> Result<()> {
+    let (vg, lv) = split_volume(volume)?;
+    if !snapshot_exists(vg, lv) {
+        debug!("LVM volume {} has no snapshot to remove", volume);
+        return Ok(());
+    }
+
+    info!("removing snapshot of LVM volume {}", volume);
+    easy_process::run(&format!("lvremove --yes {}/{}{}", vg, lv, SNAPSHOT_SUFFIX))?;
+    Ok(())
+}
+
+fn snapshot_exists(vg: &str, lv: &str) -> bool {
+    easy_process::run(&format!("lvs --noheadings {}/{}{}", vg, lv, SNAPSHOT_SUFFIX)).is_ok()
+}
+
+// The names are passed to the LVM tools, so only the characters LVM
+// allows in them are accepted.
+fn split_volume(volume: &str) -> Result<(&str, &str)> {
+    let valid = |name: &str| {
+        !name.is_empty()
+            && name != "."
+            && name != ".."
+            && !name.starts_with('-')
+            && name.chars().all(|c| c.is_ascii_alphanumeric() || "+_.-".contains(c))
+    };
+    match volume.split('/').collect::<Vec<_>>()[..] {
+        [vg, lv] if valid(vg) && valid(lv) => Ok((vg, lv)),
+        _ => Err(Error::InvalidLvmVolume(volume.to_owned())),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn volume_names() {
+        assert_eq!(split_volume("vg0/rootfs_b").unwrap(), ("vg0", "rootfs_b"));
+        assert!(split_volume("rootfs_b").is_err());
+        assert!(split_volume("vg0/rootfs/b").is_err());
+        assert!(split_volume("vg0/-rootfs").is_err());
+        assert!(split_volume("vg0/rootfs;reboot").is_err());
+        assert!(split_volume("vg0/").is_err());
+    }
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use chrono::{FixedOffset, NaiveTime, Utc};
+use sdk::api::info::settings::{Maintenance, MaintenanceWindow};
+use slog_scope::warn;
+use std::time::Duration;
+
+const SECONDS_PER_DAY: i64 = 24 * 60 * 60;
+
+/// Whether `now` is within the window starting at `start` and ending at
+/// `end`, which crosses midnight when `end` is before `start`.
+pub(crate) fn contains(start: NaiveTime, end: NaiveTime, now: NaiveTime) -> bool {
+    if start <= end {
+        start <= now && now < end
+    } else {
+        now >= start || now < end
+    }
+}
+
+/// Time left until the next of the `windows` opens. It is `None` when
+/// there are no windows or one of them is already open.
+pub(crate) fn until_window(
+    settings: &Maintenance,
+    windows: &[MaintenanceWindow],
+) -> Option<Duration> {
+    wait_at(windows, now(settings))
+}
+
+fn wait_at(windows: &[MaintenanceWindow], now: NaiveTime) -> Option<Duration> {
+    if windows.is_empty() || windows.iter().any(|w| contains(w.start, w.end, now)) {
+        return None;
+    }
+
+    windows
+        .iter()
+        .map(|w| {
+            Duration::from_secs((w.start - now).num_seconds().rem_euclid(SECONDS_PER_DAY) as u64)
+        })
+        .min()
+}
+
+fn now(settings: &Maintenance) -> NaiveTime {
+    match settings.utc_offset.as_deref().map(|offset| (offset, parse_offset(offset))) {
+        Some((_, Some(offset))) => Utc::now().with_timezone(&offset).time(),
+        Some((offset, None)) => {
+            warn!("invalid utc offset {:?}, using the local time", offset);
+            chrono::Local::now().time()
+        }
+        None => chrono::Local::now().time(),
+    }
+}
+
+// Parses offsets as `+02:00` or `-03:30`.
+fn parse_offset(offset: &str) -> Option<FixedOffset> {
+    let sign = match offset.get(..1)? {
+        "+" => 1,
+        "-" => -1,
+        _ => return None,
+    };
+    let mut parts = offset[1..].splitn(2, ':');
+    let hours: i32 = parts.next()?.parse().ok()?;
+    let minutes: i32 = parts.next()?.parse().ok()?;
+    if minutes >= 60 {
+        return None;
+    }
+
+    FixedOffset::east_opt(sign * (hours * 3600 + minutes * 60))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    fn time(h: u32, m: u32) -> NaiveTime {
+        NaiveTime::from_hms(h, m, 0)
+    }
+
+    #[test]
+    fn wait_for_next_window() {
+        let windows = vec![
+            MaintenanceWindow { start: time(2, 0), end: time(4, 0) },
+            MaintenanceWindow { start: time(23, 0), end: time(0, 30) },
+        ];
+
+        assert_eq!(wait_at(&[], time(12, 0)), None);
+        assert_eq!(wait_at(&windows, time(3, 0)), None);
+        assert_eq!(wait_at(&windows, time(0, 15)), None);
+        assert_eq!(wait_at(&windows, time(22, 0)), Some(Duration::from_secs(3600)));
+        assert_eq!(wait_at(&windows, time(1, 0)), Some(Duration::from_secs(3600)));
+        assert_eq!(wait_at(&windows, time(4, 0)), Some(Duration::from_secs(19 * 3600)));
+    }
+
+    #[test]
+    fn parse_utc_offset() {
+        assert_eq!(parse_offset("-03:00"), FixedOffset::west_opt(3 * 3600));
+        assert_eq!(parse_offset("+05:30"), FixedOffset::east_opt(5 * 3600 + 30 * 60));
+        assert_eq!(parse_offset("03:00"), None);
+        assert_eq!(parse_offset("+03:75"), None);
+        assert_eq!(parse_offset("UTC"), None);
+    }
+}
@@ -2,10 +2,43 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
+pub(crate) mod agent_update;
+pub(crate) mod anti_rollback;
+pub(crate) mod archive;
+pub(crate) mod audit_trail;
+pub(crate) mod boottime;
+pub(crate) mod container;
 pub(crate) mod definitions;
+pub(crate) mod delta;
+pub(crate) mod emmc;
+pub(crate) mod encryption;
+pub(crate) mod environment;
+pub(crate) mod fpga;
 pub(crate) mod fs;
+pub(crate) mod health_check;
+pub(crate) mod hooks;
 pub(crate) mod io;
+pub(crate) mod kubernetes;
+pub(crate) mod lvm;
+pub(crate) mod maintenance;
 pub(crate) mod mtd;
+pub(crate) mod network;
+pub(crate) mod notifier;
+pub(crate) mod partition_table;
+pub(crate) mod power;
+pub(crate) mod privsep;
+pub(crate) mod read_only;
+pub(crate) mod resource_usage;
+pub(crate) mod retry;
+pub(crate) mod rtc;
+pub(crate) mod secret;
+pub(crate) mod status_indicator;
+pub(crate) mod suspend_inhibitor;
+pub(crate) mod systemd;
+pub(crate) mod target;
+pub(crate) mod time_sync;
+pub(crate) mod uboot_env;
+pub(crate) mod verification;
 
 use thiserror::Error;
 
@@ -22,6 +55,9 @@ pub enum Error {
     #[error("Uncompress error: {0}")]
     Uncompress(#[from] compress_tools::Error),
 
+    #[error("Archive error: {0}")]
+    Archive(#[from] archive::ArchiveError),
+
     #[error("Process error: {0}")]
     Process(#[from] easy_process::Error),
 
@@ -31,6 +67,12 @@ pub enum Error {
     #[error("Target device does not exists")]
     DeviceDoesNotExist,
 
+    #[error("Target device isn't mounted")]
+    DeviceNotMounted,
+
+    #[error("No overlay has {0:?} as its lower directory")]
+    NoOverlay(std::path::PathBuf),
+
     #[error("User doesn't have write permission on target device: {0}")]
     MissingWritePermission(std::path::PathBuf),
 
@@ -43,8 +85,77 @@ pub enum Error {
     #[error("Unable to find match for mtd device: {0}")]
     NoMtdDevice(String),
 
+    #[error("Unable to find FPGA manager: {0}")]
+    NoFpgaManager(String),
+
+    #[error("FPGA isn't operating after programmed: {0}")]
+    FpgaNotOperating(String),
+
+    #[error("Invalid LVM logical volume: {0}")]
+    InvalidLvmVolume(String),
+
+    #[error("Invalid sysfs attribute: {0:?}")]
+    InvalidSysfsAttribute(std::path::PathBuf),
+
+    #[error("Target geometry doesn't match the image: {0}")]
+    GeometryMismatch(String),
+
+    #[error("Invalid partition table: {0}")]
+    InvalidPartitionTable(String),
+
+    #[error("Partition isn't laid out in the image as in the target: {0}")]
+    PartitionMismatch(String),
+
     #[error("Not enough storage space for installation")]
     NotEnoughSpace,
+
+    #[error("Invalid host root filesystem: {0}")]
+    InvalidHostRoot(std::path::PathBuf),
+
+    #[error("Delta base object not found: {0}")]
+    DeltaBaseNotFound(String),
+
+    #[error("Extraction limit exceeded: {0}")]
+    ExtractionLimitExceeded(String),
+
+    #[error("Archive entry would be extracted outside the target: {0}")]
+    UnsafeArchivePath(String),
+
+    #[error("Path resolves outside the target: {0:?}")]
+    PathEscapesTarget(std::path::PathBuf),
+
+    #[error("Hook {0:?} has failed: {1}")]
+    HookFailed(std::path::PathBuf, std::process::ExitStatus),
+
+    #[error("Invalid time server reply: {0}")]
+    InvalidTimeReply(String),
+
+    #[error("Invalid secret: {0}")]
+    InvalidSecret(String),
+
+    #[error("Decryption error: {0}")]
+    Decryption(String),
+
+    #[error("OpenSSL error: {0}")]
+    OpenSsl(#[from] openssl::error::ErrorStack),
+
+    #[error("Firmware error: {0}")]
+    Firmware(#[from] crate::firmware::Error),
+
+    #[error("Unknown user or group: {0}")]
+    UnknownUser(String),
+
+    #[error("Privileged installer error: {0}")]
+    PrivilegedInstaller(String),
+
+    #[error("Invalid update package: {0}")]
+    InvalidPackage(String),
+
+    #[error("Invalid U-Boot environment: {0}")]
+    InvalidUbootEnvironment(String),
+
+    #[error("New agent has failed its check: {0}")]
+    AgentCheckFailed(String),
 }
 
 /// Encode a bytes stream in hex
@@ -52,7 +163,17 @@ pub(crate) fn hex_encode(data: &[u8]) -> String {
     data.iter().map(|c| format!("{:02x}", c)).collect()
 }
 
+/// Decode a hex string into bytes
+pub(crate) fn hex_decode(data: &str) -> Option<Vec<u8>> {
+    if data.len() % 2 != 0 {
+        return None;
+    }
+    (0..data.len()).step_by(2).map(|i| u8::from_str_radix(data.get(i..i + 2)?, 16).ok()).collect()
+}
+
 /// Get sha256sum hash from a byte stream
 pub(crate) fn sha256sum(data: &[u8]) -> String {
     hex_encode(&openssl::sha::sha256(data))
 }
+
+pub(crate) use verification::{sha256sum_file, sha256sum_region};
@@ -2,12 +2,14 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-pub(crate) use self::ffi::is_nand;
+pub(crate) use self::ffi::{erase, is_nand};
 use super::{Error, Result};
+use pkg_schema::definitions::FlashGeometry;
+use slog_scope::info;
 use std::{
     fs,
     io::{BufRead, BufReader},
-    path::PathBuf,
+    path::{Path, PathBuf},
 };
 
 pub(crate) fn target_device_from_ubi_volume_name(volume: &str) -> Result<PathBuf> {
@@ -58,9 +60,140 @@ pub(crate) fn target_device_from_mtd_name(name: &str) -> Result<PathBuf> {
         .ok_or_else(|| Error::NoMtdDevice(name.to_owned()))
 }
 
+/// Ensures the UBI volume exists and is at least `size` bytes long,
+/// creating it on `ubi_device` or resizing it when needed.
+pub(crate) fn ensure_ubi_volume(volume: &str, size: u64, ubi_device: &Path) -> Result<()> {
+    let re = regex::Regex::new(r"^ubi(?P<dev>\d+)_(?P<id>\d+)$").unwrap();
+
+    match target_device_from_ubi_volume_name(volume) {
+        Ok(target) => {
+            let name = target.file_name().and_then(|n| n.to_str()).unwrap_or_default();
+            let re_match =
+                re.captures(name).ok_or_else(|| Error::NoUbiVolume(volume.to_owned()))?;
+            let current = ubi_volume_size(name)?;
+            if current >= size {
+                return Ok(());
+            }
+
+            info!("resizing UBI volume '{}' from {} to {} bytes", volume, current, size);
+            ffi::resize_volume(
+                &PathBuf::from(format!("/dev/ubi{}", &re_match["dev"])),
+                re_match["id"].parse().map_err(|_| Error::NoUbiVolume(volume.to_owned()))?,
+                size,
+            )
+        }
+        Err(Error::NoUbiVolume(_)) => {
+            info!("creating UBI volume '{}' with {} bytes on {:?}", volume, size, ubi_device);
+            ffi::create_volume(ubi_device, volume, size)
+        }
+        Err(e) => Err(e),
+    }
+}
+
+fn ubi_volume_size(name: &str) -> Result<u64> {
+    let read = |attr: &str| -> Result<u64> {
+        let path = Path::new("/sys/class/ubi").join(name).join(attr);
+        fs::read_to_string(&path)?.trim().parse().map_err(|_| Error::NoUbiVolume(name.to_owned()))
+    };
+
+    Ok(read("reserved_ebs")? * read("usable_eb_size")?)
+}
+
+/// Flash geometry of a MTD device or UBI volume, as reported by the
+/// kernel.
+#[derive(Debug, Default, PartialEq)]
+pub(crate) struct Geometry {
+    pub(crate) peb_size: u64,
+    pub(crate) min_io_size: u64,
+    pub(crate) sub_page_size: u64,
+    /// Only known for the UBI devices and volumes.
+    pub(crate) leb_size: Option<u64>,
+    /// Only known for the UBI volumes.
+    pub(crate) leb_count: Option<u64>,
+}
+
+/// Reads the geometry of the MTD, UBI device or UBI volume `device`.
+pub(crate) fn geometry(device: &Path) -> Result<Geometry> {
+    read_geometry(Path::new("/sys/class"), device)
+}
+
+fn read_geometry(sysfs: &Path, device: &Path) -> Result<Geometry> {
+    let name = device.file_name().and_then(|n| n.to_str()).unwrap_or_default();
+    if name.starts_with("mtd") {
+        return read_mtd_geometry(sysfs, name);
+    }
+    if !name.starts_with("ubi") {
+        return Err(Error::NoMtdDevice(name.to_owned()));
+    }
+
+    // The volumes are named after their UBI device, as ubi0_1.
+    let ubi_device = sysfs.join("ubi").join(name.split('_').next().unwrap_or_default());
+    let mtd = format!("mtd{}", read_attribute(&ubi_device, "mtd_num")?);
+    let mut geometry = read_mtd_geometry(sysfs, &mtd)?;
+    geometry.leb_size = Some(read_attribute(&ubi_device, "eraseblock_size")?);
+    if name.contains('_') {
+        let volume = sysfs.join("ubi").join(name);
+        geometry.leb_size = Some(read_attribute(&volume, "usable_eb_size")?);
+        geometry.leb_count = Some(read_attribute(&volume, "reserved_ebs")?);
+    }
+
+    Ok(geometry)
+}
+
+fn read_mtd_geometry(sysfs: &Path, name: &str) -> Result<Geometry> {
+    let mtd = sysfs.join("mtd").join(name);
+    Ok(Geometry {
+        peb_size: read_attribute(&mtd, "erasesize")?,
+        min_io_size: read_attribute(&mtd, "writesize")?,
+        sub_page_size: read_attribute(&mtd, "subpagesize")?,
+        leb_size: None,
+        leb_count: None,
+    })
+}
+
+fn read_attribute(dir: &Path, attribute: &str) -> Result<u64> {
+    let path = dir.join(attribute);
+    fs::read_to_string(&path)?.trim().parse().map_err(|_| Error::InvalidSysfsAttribute(path))
+}
+
+/// Checks the `geometry` of the target matches the one the image has
+/// been built for, reporting all the mismatches at once.
+pub(crate) fn check_geometry(expected: &FlashGeometry, geometry: &Geometry) -> Result<()> {
+    let sizes = [
+        ("PEB size", expected.peb_size, Some(geometry.peb_size)),
+        ("LEB size", expected.leb_size, geometry.leb_size),
+        ("minimum I/O unit size", expected.min_io_size, Some(geometry.min_io_size)),
+        ("sub-page size", expected.sub_page_size, Some(geometry.sub_page_size)),
+    ];
+    let mut mismatches = sizes
+        .iter()
+        .filter_map(|(name, expected, actual)| match (expected, actual) {
+            (Some(expected), Some(actual)) if expected != actual => Some(format!(
+                "{} is {} bytes on the target, but the image requires {} bytes",
+                name, actual, expected
+            )),
+            _ => None,
+        })
+        .collect::<Vec<_>>();
+
+    if let (Some(expected), Some(actual)) = (expected.max_leb_count, geometry.leb_count) {
+        if expected > actual {
+            mismatches.push(format!(
+                "volume holds {} LEBs, but the image may grow up to {} LEBs",
+                actual, expected
+            ));
+        }
+    }
+
+    if mismatches.is_empty() {
+        return Ok(());
+    }
+    Err(Error::GeometryMismatch(mismatches.join("; ")))
+}
+
 mod ffi {
     use crate::utils::Result;
-    use nix::ioctl_read;
+    use nix::{ioctl_read, ioctl_write_ptr};
     use std::{mem::MaybeUninit, os::unix::io::AsRawFd, path::Path};
 
     // From https://github.com/torvalds/linux/blob/master/include/uapi/mtd/mtd-abi.h
@@ -82,6 +215,72 @@ mod ffi {
 
     ioctl_read!(mtd_get_info, MEMGETINFO, MEMGETINFO_MODE, mtd_info_user);
 
+    const MEMERASE_MODE: u8 = 2;
+
+    #[repr(C)]
+    pub struct erase_info_user {
+        start: u32,
+        length: u32,
+    }
+
+    ioctl_write_ptr!(mtd_erase, MEMGETINFO, MEMERASE_MODE, erase_info_user);
+
+    // From https://github.com/torvalds/linux/blob/master/include/uapi/mtd/ubi-user.h
+    const UBI_IOC_MAGIC: u8 = b'o';
+    const UBI_IOCMKVOL_MODE: u8 = 0;
+    const UBI_IOCRSVOL_MODE: u8 = 2;
+    const UBI_VOL_NUM_AUTO: i32 = -1;
+    const UBI_DYNAMIC_VOLUME: i8 = 3;
+    const UBI_MAX_VOLUME_NAME: usize = 127;
+
+    #[repr(C, packed)]
+    pub struct ubi_mkvol_req {
+        vol_id: i32,
+        alignment: i32,
+        bytes: i64,
+        vol_type: i8,
+        flags: u8,
+        name_len: i16,
+        padding2: [i8; 4],
+        name: [u8; UBI_MAX_VOLUME_NAME + 1],
+    }
+
+    #[repr(C, packed)]
+    pub struct ubi_rsvol_req {
+        bytes: i64,
+        vol_id: i32,
+    }
+
+    ioctl_write_ptr!(ubi_mkvol, UBI_IOC_MAGIC, UBI_IOCMKVOL_MODE, ubi_mkvol_req);
+    ioctl_write_ptr!(ubi_rsvol, UBI_IOC_MAGIC, UBI_IOCRSVOL_MODE, ubi_rsvol_req);
+
+    pub fn create_volume(ubi_device: &Path, name: &str, size: u64) -> Result<()> {
+        let device = std::fs::File::open(ubi_device)?;
+        let mut req = ubi_mkvol_req {
+            vol_id: UBI_VOL_NUM_AUTO,
+            alignment: 1,
+            bytes: size as i64,
+            vol_type: UBI_DYNAMIC_VOLUME,
+            flags: 0,
+            name_len: name.len().min(UBI_MAX_VOLUME_NAME) as i16,
+            padding2: [0; 4],
+            name: [0; UBI_MAX_VOLUME_NAME + 1],
+        };
+        let len = req.name_len as usize;
+        req.name[..len].copy_from_slice(&name.as_bytes()[..len]);
+
+        unsafe { ubi_mkvol(device.as_raw_fd(), &req)? };
+        Ok(())
+    }
+
+    pub fn resize_volume(ubi_device: &Path, vol_id: i32, size: u64) -> Result<()> {
+        let device = std::fs::File::open(ubi_device)?;
+        let req = ubi_rsvol_req { bytes: size as i64, vol_id };
+
+        unsafe { ubi_rsvol(device.as_raw_fd(), &req)? };
+        Ok(())
+    }
+
     pub fn is_nand(device: &Path) -> Result<bool> {
         let device = std::fs::File::open(device)?;
         let info = unsafe {
@@ -92,6 +291,16 @@ mod ffi {
 
         Ok(info.kind == MTD_NANDFLASH || info.kind == MTD_MLCNANDFLASH)
     }
+
+    /// Erases the `length` bytes at `start` of the MTD `device`, which
+    /// must be aligned to its erase blocks.
+    pub fn erase(device: &Path, start: u64, length: u64) -> Result<()> {
+        let device = std::fs::OpenOptions::new().write(true).open(device)?;
+        let req = erase_info_user { start: start as u32, length: length as u32 };
+
+        unsafe { mtd_erase(device.as_raw_fd(), &req)? };
+        Ok(())
+    }
 }
 
 #[cfg(test)]
@@ -250,4 +459,69 @@ pub(crate) mod tests {
             PathBuf::from("/dev/ubi0_12")
         );
     }
+
+    fn fake_sysfs(dir: &Path) {
+        let write = |path: &str, value: &str| {
+            let path = dir.join(path);
+            fs::create_dir_all(path.parent().unwrap()).unwrap();
+            fs::write(path, format!("{}\n", value)).unwrap();
+        };
+        write("mtd/mtd2/erasesize", "131072");
+        write("mtd/mtd2/writesize", "2048");
+        write("mtd/mtd2/subpagesize", "2048");
+        write("ubi/ubi0/mtd_num", "2");
+        write("ubi/ubi0/eraseblock_size", "126976");
+        write("ubi/ubi0_1/usable_eb_size", "126976");
+        write("ubi/ubi0_1/reserved_ebs", "100");
+    }
+
+    #[test]
+    fn read_target_geometry() {
+        let sysfs = tempfile::tempdir().unwrap();
+        fake_sysfs(sysfs.path());
+
+        let expected = Geometry {
+            peb_size: 131_072,
+            min_io_size: 2048,
+            sub_page_size: 2048,
+            leb_size: Some(126_976),
+            leb_count: Some(100),
+        };
+        assert_eq!(read_geometry(sysfs.path(), Path::new("/dev/ubi0_1")).unwrap(), expected);
+        assert_eq!(
+            read_geometry(sysfs.path(), Path::new("/dev/mtd2")).unwrap(),
+            Geometry { leb_size: None, leb_count: None, ..expected }
+        );
+        assert!(read_geometry(sysfs.path(), Path::new("/dev/sda1")).is_err());
+    }
+
+    #[test]
+    fn geometry_mismatch() {
+        let geometry = Geometry {
+            peb_size: 131_072,
+            min_io_size: 2048,
+            sub_page_size: 2048,
+            leb_size: Some(126_976),
+            leb_count: Some(100),
+        };
+
+        let mut expected = FlashGeometry {
+            peb_size: Some(131_072),
+            leb_size: Some(126_976),
+            max_leb_count: Some(100),
+            ..FlashGeometry::default()
+        };
+        assert!(check_geometry(&expected, &geometry).is_ok());
+
+        expected.min_io_size = Some(512);
+        expected.max_leb_count = Some(200);
+        match check_geometry(&expected, &geometry) {
+            Err(Error::GeometryMismatch(report)) => assert_eq!(
+                report,
+                "minimum I/O unit size is 2048 bytes on the target, but the image requires 512 \
+                 bytes; volume holds 100 LEBs, but the image may grow up to 200 LEBs"
+            ),
+            res => panic!("Unexpected result: {:?}", res),
+        }
+    }
 }
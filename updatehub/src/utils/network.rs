@@ -0,0 +1,248 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Detection of the connection the device reaches the server through, so
+//! the downloads can be restricted to some connection types.
+
+use super::Result;
+use sdk::api::info::settings::{Download, NetworkDetection, NetworkInterface, NetworkType};
+use slog_scope::{debug, warn};
+use std::{fs, path::Path};
+
+const SYSFS_NET: &str = "/sys/class/net";
+const ARPHRD_ETHER: &str = "1";
+const ARPHRD_PPP: &str = "512";
+
+/// Connection the traffic is routed through.
+#[derive(Debug, Default, PartialEq)]
+pub(crate) struct Connection {
+    pub(crate) interface: Option<String>,
+    pub(crate) kind: Option<NetworkType>,
+    pub(crate) metered: bool,
+}
+
+/// Returns the current connection when the updates may not be downloaded
+/// over it. A connection which can't be detected is never allowed.
+pub(crate) fn disallowed_connection(settings: &Download) -> Option<Connection> {
+    if settings.allowed_networks.is_empty() {
+        return None;
+    }
+
+    let connection = current(settings).unwrap_or_else(|e| {
+        warn!("unable to detect the network connection: {}", e);
+        Connection::default()
+    });
+    debug!("connected through {:?}", connection);
+    if is_allowed(settings, &connection) {
+        None
+    } else {
+        Some(connection)
+    }
+}
+
+fn is_allowed(settings: &Download, connection: &Connection) -> bool {
+    connection.kind.map_or(false, |kind| settings.allowed_networks.contains(&kind))
+        && (settings.allow_metered || !connection.metered)
+}
+
+fn current(settings: &Download) -> Result<Connection> {
+    let interface = default_route_interface(&fs::read_to_string("/proc/net/route")?);
+    let mut connection = match settings.network_detection {
+        NetworkDetection::Interfaces => Connection {
+            kind: interface.as_deref().and_then(|i| sysfs_kind(Path::new(SYSFS_NET), i)),
+            interface,
+            metered: false,
+        },
+        NetworkDetection::NetworkManager => match interface {
+            Some(interface) => {
+                let output = easy_process::run(&format!(
+                    "nmcli -t -f GENERAL.TYPE,GENERAL.METERED device show {}",
+                    interface
+                ))?;
+                let (kind, metered) = network_manager_kind(&output.stdout);
+                Connection { interface: Some(interface), kind, metered }
+            }
+            None => Connection::default(),
+        },
+        NetworkDetection::Connman => {
+            let output = easy_process::run("connmanctl services")?;
+            Connection { interface, kind: connman_kind(&output.stdout), metered: false }
+        }
+    };
+
+    if let Some(kind) = connection
+        .interface
+        .as_deref()
+        .and_then(|i| configured_kind(&settings.network_interfaces, i))
+    {
+        connection.kind = Some(kind);
+    }
+    Ok(connection)
+}
+
+// The default route with the lowest metric is the one used.
+fn default_route_interface(routes: &str) -> Option<String> {
+    routes
+        .lines()
+        .skip(1)
+        .filter_map(|line| match line.split_whitespace().collect::<Vec<_>>()[..] {
+            [iface, "00000000", _, flags, _, _, metric, "00000000", ..] => {
+                let up = u32::from_str_radix(flags, 16).map_or(false, |flags| flags & 0x1 != 0);
+                Some((iface, metric.parse::<u32>().ok()?)).filter(|_| up)
+            }
+            _ => None,
+        })
+        .min_by_key(|(_, metric)| *metric)
+        .map(|(iface, _)| iface.to_owned())
+}
+
+fn sysfs_kind(sysfs: &Path, interface: &str) -> Option<NetworkType> {
+    let dir = sysfs.join(interface);
+    let uevent = fs::read_to_string(dir.join("uevent")).unwrap_or_default();
+    match uevent.lines().find(|line| line.starts_with("DEVTYPE=")) {
+        Some("DEVTYPE=wlan") => return Some(NetworkType::Wifi),
+        Some("DEVTYPE=wwan") => return Some(NetworkType::Cellular),
+        _ => {}
+    }
+    if dir.join("wireless").exists() {
+        return Some(NetworkType::Wifi);
+    }
+    match fs::read_to_string(dir.join("type")).ok()?.trim() {
+        ARPHRD_ETHER => Some(NetworkType::Ethernet),
+        ARPHRD_PPP => Some(NetworkType::Cellular),
+        _ => None,
+    }
+}
+
+fn configured_kind(interfaces: &[NetworkInterface], interface: &str) -> Option<NetworkType> {
+    interfaces
+        .iter()
+        .find(|configured| {
+            if configured.name.ends_with('*') {
+                interface.starts_with(configured.name.trim_end_matches('*'))
+            } else {
+                configured.name == interface
+            }
+        })
+        .map(|configured| configured.kind)
+}
+
+// Parses the `nmcli -t` output, as `GENERAL.TYPE:wifi`.
+fn network_manager_kind(output: &str) -> (Option<NetworkType>, bool) {
+    let mut kind = None;
+    let mut metered = false;
+    for line in output.lines() {
+        match line.splitn(2, ':').collect::<Vec<_>>()[..] {
+            ["GENERAL.TYPE", "ethernet"] => kind = Some(NetworkType::Ethernet),
+            ["GENERAL.TYPE", "wifi"] => kind = Some(NetworkType::Wifi),
+            ["GENERAL.TYPE", "gsm"] | ["GENERAL.TYPE", "cdma"] | ["GENERAL.TYPE", "modem"] => {
+                kind = Some(NetworkType::Cellular)
+            }
+            // Guessed values are reported as `yes (guessed)`.
+            ["GENERAL.METERED", value] => metered = value.starts_with("yes"),
+            _ => {}
+        }
+    }
+    (kind, metered)
+}
+
+// Parses the `connmanctl services` output, whose lines start with the
+// service flags, as `*AO Wired  ethernet_0800270b6e2e_cable`. The online
+// service is the one the traffic is routed through.
+fn connman_kind(output: &str) -> Option<NetworkType> {
+    let service = output.lines().find(|line| line.get(..4).map_or(false, |f| f.contains('O')))?;
+    match service.split_whitespace().last()?.split('_').next()? {
+        "ethernet" => Some(NetworkType::Ethernet),
+        "wifi" => Some(NetworkType::Wifi),
+        "cellular" => Some(NetworkType::Cellular),
+        _ => None,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn default_route() {
+        let routes =
+            "Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\tMTU\tWindow\tIRTT\n\
+                      wwan0\t00000000\t0100A8C0\t0003\t0\t0\t700\t00000000\t0\t0\t0\n\
+                      eth0\t00000000\t0101A8C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n\
+                      eth0\t0001A8C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n";
+        assert_eq!(default_route_interface(routes), Some("eth0".to_owned()));
+        assert_eq!(default_route_interface(routes.lines().next().unwrap()), None);
+    }
+
+    #[test]
+    fn interface_kind_from_sysfs() {
+        let sysfs = tempfile::tempdir().unwrap();
+        for (iface, uevent, kind) in &[
+            ("eth0", "INTERFACE=eth0", "1"),
+            ("wlan0", "DEVTYPE=wlan", "1"),
+            ("wwan0", "DEVTYPE=wwan", "1"),
+            ("ppp0", "", "512"),
+        ] {
+            fs::create_dir(sysfs.path().join(iface)).unwrap();
+            fs::write(sysfs.path().join(iface).join("uevent"), uevent).unwrap();
+            fs::write(sysfs.path().join(iface).join("type"), kind).unwrap();
+        }
+
+        assert_eq!(sysfs_kind(sysfs.path(), "eth0"), Some(NetworkType::Ethernet));
+        assert_eq!(sysfs_kind(sysfs.path(), "wlan0"), Some(NetworkType::Wifi));
+        assert_eq!(sysfs_kind(sysfs.path(), "wwan0"), Some(NetworkType::Cellular));
+        assert_eq!(sysfs_kind(sysfs.path(), "ppp0"), Some(NetworkType::Cellular));
+        assert_eq!(sysfs_kind(sysfs.path(), "tun0"), None);
+    }
+
+    #[test]
+    fn interface_kind_from_settings() {
+        let interfaces = vec![
+            NetworkInterface { name: "usb0".to_owned(), kind: NetworkType::Cellular },
+            NetworkInterface { name: "br*".to_owned(), kind: NetworkType::Ethernet },
+        ];
+        assert_eq!(configured_kind(&interfaces, "usb0"), Some(NetworkType::Cellular));
+        assert_eq!(configured_kind(&interfaces, "usb1"), None);
+        assert_eq!(configured_kind(&interfaces, "br-lan"), Some(NetworkType::Ethernet));
+    }
+
+    #[test]
+    fn connection_kind_from_managers() {
+        assert_eq!(
+            network_manager_kind("GENERAL.TYPE:wifi\nGENERAL.METERED:yes (guessed)\n"),
+            (Some(NetworkType::Wifi), true)
+        );
+        assert_eq!(
+            network_manager_kind("GENERAL.TYPE:gsm\nGENERAL.METERED:no\n"),
+            (Some(NetworkType::Cellular), false)
+        );
+        assert_eq!(
+            connman_kind(
+                "*AR Home                 wifi_dc85de828967_68756773616d_managed_psk\n\
+                 *AO Wired                ethernet_0800270b6e2e_cable\n"
+            ),
+            Some(NetworkType::Ethernet)
+        );
+        assert_eq!(
+            connman_kind("    Other                wifi_dc85de828967_4f74686572_managed_psk\n"),
+            None
+        );
+    }
+
+    #[test]
+    fn allowed_connections() {
+        let settings = Download {
+            allowed_networks: vec![NetworkType::Ethernet, NetworkType::Wifi],
+            ..Download::default()
+        };
+        let wifi = |metered| Connection { interface: None, kind: Some(NetworkType::Wifi), metered };
+
+        assert!(is_allowed(&settings, &wifi(false)));
+        assert!(!is_allowed(&settings, &wifi(true)));
+        assert!(is_allowed(&Download { allow_metered: true, ..settings.clone() }, &wifi(true)));
+        assert!(!is_allowed(&settings, &Connection::default()));
+        assert_eq!(disallowed_connection(&Download::default()), None);
+    }
+}
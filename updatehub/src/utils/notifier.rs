@@ -0,0 +1,129 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{status_indicator::Indicator, Result};
+use sdk::api::info::settings::Settings;
+use slog_scope::warn;
+use std::{fs, path::PathBuf};
+
+/// Gives the operator feedback about the agent's state. It is notified
+/// every time the state machine changes its state.
+pub(crate) trait Notifier {
+    fn notify(&mut self, state: &str) -> Result<()>;
+}
+
+/// Builds the notifiers enabled in the settings.
+pub(crate) fn from_settings(settings: &Settings) -> Vec<Box<dyn Notifier>> {
+    let mut notifiers: Vec<Box<dyn Notifier>> = Vec::default();
+
+    match Indicator::new(&settings.status_indicator) {
+        Ok(Some(indicator)) => notifiers.push(Box::new(indicator)),
+        Ok(None) => {}
+        Err(e) => warn!("failed to setup the status indicator: {}", e),
+    }
+
+    // The state is the service status when run by systemd.
+    if std::env::var_os("NOTIFY_SOCKET").is_some() {
+        notifiers.push(Box::new(super::systemd::Status));
+    }
+
+    let settings = &settings.notification;
+    if let Some(ref device) = settings.lcd_device {
+        notifiers.push(Box::new(Lcd(device.clone())));
+    }
+    if settings.beeper {
+        notifiers.push(Box::new(Beeper));
+    }
+    if settings.desktop {
+        notifiers.push(Box::new(Desktop));
+    }
+
+    notifiers
+}
+
+fn message(state: &str) -> Option<&'static str> {
+    match state {
+        "prepare_download" | "download" | "direct_download" => Some("Downloading update"),
+        "prepare_local_install" | "install" => Some("Installing update"),
+        "reboot" => Some("Rebooting to apply update"),
+        "await_reboot" => Some("Reboot to apply update"),
+        "error" => Some("Update failed"),
+        _ => None,
+    }
+}
+
+/// Character LCD, as the ones handled by the kernel `charlcd` driver,
+/// showing a short message.
+struct Lcd(PathBuf);
+
+impl Notifier for Lcd {
+    fn notify(&mut self, state: &str) -> Result<()> {
+        // The form feed clears the display before writing the message.
+        fs::write(&self.0, format!("\x0c{}\n", message(state).unwrap_or_default()))?;
+        Ok(())
+    }
+}
+
+/// PC speaker beeping once when installing, twice when rebooting and
+/// three times on error.
+struct Beeper;
+
+impl Notifier for Beeper {
+    fn notify(&mut self, state: &str) -> Result<()> {
+        let repeat = match state {
+            "install" => 1,
+            "reboot" => 2,
+            "error" => 3,
+            _ => return Ok(()),
+        };
+
+        easy_process::run(&format!("beep -f 1000 -l 100 -d 100 -r {}", repeat))?;
+        Ok(())
+    }
+}
+
+/// Desktop notification, for kiosk builds.
+struct Desktop;
+
+impl Notifier for Desktop {
+    fn notify(&mut self, state: &str) -> Result<()> {
+        if let Some(message) = message(state) {
+            easy_process::run(&format!("notify-send UpdateHub '{}'", message))?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn lcd_message() {
+        let dir = tempfile::tempdir().unwrap();
+        let device = dir.path().join("lcd");
+        let mut lcd = Lcd(device.clone());
+
+        lcd.notify("install").unwrap();
+        assert_eq!(fs::read_to_string(&device).unwrap(), "\x0cInstalling update\n");
+
+        lcd.notify("entry_point").unwrap();
+        assert_eq!(fs::read_to_string(&device).unwrap(), "\x0c\n");
+    }
+
+    #[test]
+    fn beeper_and_desktop() {
+        let (_handle, calls) = create_echo_bins(&["beep", "notify-send"]).unwrap();
+
+        Beeper.notify("poll").unwrap();
+        Beeper.notify("error").unwrap();
+        Desktop.notify("error").unwrap();
+        assert_eq!(
+            fs::read_to_string(calls).unwrap(),
+            "beep -f 1000 -l 100 -d 100 -r 3\nnotify-send UpdateHub Update failed\n"
+        );
+    }
+}
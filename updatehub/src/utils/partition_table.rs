@@ -0,0 +1,450 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Partition tables of the disks and of their images, either MBR, of
+//! which only the primary partitions are taken, or GPT. The table of an
+//! image is written to the disk once the partitions have been, the GPT
+//! backup being moved to the end of the disk, so the disk keeps its
+//! previous table until the new one is complete.
+
+use super::{Error, Result};
+use pkg_schema::definitions;
+use slog_scope::{debug, warn};
+use std::{
+    fs::File,
+    io::{self, Read, Seek, SeekFrom, Write},
+    ops::Range,
+    os::unix::{fs::FileTypeExt, io::AsRawFd},
+};
+
+const MBR_SIZE: u64 = 512;
+const MBR_SIGNATURE: [u8; 2] = [0x55, 0xaa];
+const MBR_ENTRIES_OFFSET: usize = 446;
+const MBR_ENTRY_SIZE: usize = 16;
+const GPT_PROTECTIVE_TYPE: u8 = 0xee;
+const GPT_SIGNATURE: &[u8] = b"EFI PART";
+// The GPT header is in the second logical sector, whose size is probed
+// as the image may be built for the 4K native disks.
+const SECTOR_SIZES: [u64; 2] = [512, 4096];
+const MAX_ENTRIES_LEN: u64 = 1024 * 1024;
+
+/// Partition of the table, as its range of the disk.
+#[derive(Clone, Debug, PartialEq)]
+pub(crate) struct Partition {
+    pub(crate) number: u32,
+    /// GPT partition name, empty on the MBR ones.
+    pub(crate) name: String,
+    pub(crate) start: u64,
+    pub(crate) size: u64,
+}
+
+impl Partition {
+    pub(crate) fn range(&self) -> Range<u64> {
+        self.start..self.start + self.size
+    }
+}
+
+#[derive(Debug, PartialEq)]
+pub(crate) struct PartitionTable {
+    pub(crate) partitions: Vec<Partition>,
+    sector_size: u64,
+    // The table as in the start of the disk, along with the MBR sector,
+    // whose boot code is kept.
+    head: Vec<u8>,
+    gpt: Option<Gpt>,
+}
+
+#[derive(Debug, PartialEq)]
+struct Gpt {
+    alternate_lba: u64,
+    entries_lba: u64,
+    entries_len: u64,
+}
+
+impl PartitionTable {
+    /// Partition the `selector` refers to, if it is in the table.
+    pub(crate) fn find(&self, selector: &definitions::Partition) -> Option<&Partition> {
+        self.partitions.iter().find(|p| match selector {
+            definitions::Partition::Number(n) => p.number == *n,
+            definitions::Partition::Name(name) => p.name == *name,
+        })
+    }
+
+    /// Region of the start of the disk the table is kept in.
+    pub(crate) fn primary_region(&self) -> Range<u64> {
+        0..self.head.len() as u64
+    }
+
+    /// Region of the disk the GPT backup is kept in, which is at its end.
+    pub(crate) fn backup_region(&self) -> Option<Range<u64>> {
+        self.gpt.as_ref().map(|gpt| self.backup_region_at(gpt.alternate_lba))
+    }
+
+    fn backup_region_at(&self, last_lba: u64) -> Range<u64> {
+        let entries_sectors = self.entries_sectors();
+        (last_lba - entries_sectors) * self.sector_size..(last_lba + 1) * self.sector_size
+    }
+
+    fn entries_sectors(&self) -> u64 {
+        match &self.gpt {
+            Some(gpt) => (gpt.entries_len + self.sector_size - 1) / self.sector_size,
+            None => 0,
+        }
+    }
+
+    /// Writes the table to the `disk` of `disk_size` bytes, the GPT
+    /// backup first and the primary table last, being synced after each.
+    pub(crate) fn write(&self, disk: &mut File, disk_size: u64) -> Result<()> {
+        let mut head = self.head.clone();
+        let gpt = match &self.gpt {
+            Some(gpt) => gpt,
+            None => {
+                disk.seek(SeekFrom::Start(0))?;
+                disk.write_all(&head)?;
+                return Ok(disk.sync_all()?);
+            }
+        };
+
+        let last_lba = disk_size / self.sector_size - 1;
+        let ss = self.sector_size as usize;
+        let entries_start = (gpt.entries_lba * self.sector_size) as usize;
+        let entries = head[entries_start..entries_start + gpt.entries_len as usize].to_vec();
+
+        // The protective partition spans the whole disk, as far as the
+        // MBR can tell.
+        if let Some(entry) = (0..4)
+            .map(|i| MBR_ENTRIES_OFFSET + i * MBR_ENTRY_SIZE)
+            .find(|entry| head[entry + 4] == GPT_PROTECTIVE_TYPE)
+        {
+            let size = std::cmp::min(last_lba, u64::from(std::u32::MAX)) as u32;
+            head[entry + 12..entry + 16].copy_from_slice(&size.to_le_bytes());
+        }
+
+        let mut backup = head[ss..2 * ss].to_vec();
+        let backup_region = self.backup_region_at(last_lba);
+        set_u64(&mut backup, 24, last_lba);
+        set_u64(&mut backup, 32, 1);
+        set_u64(&mut backup, 72, backup_region.start / self.sector_size);
+        update_header_crc(&mut backup);
+        set_u64(&mut head[ss..2 * ss], 32, last_lba);
+        update_header_crc(&mut head[ss..2 * ss]);
+
+        debug!("writing GPT backup at {}", backup_region.start);
+        disk.seek(SeekFrom::Start(backup_region.start))?;
+        disk.write_all(&entries)?;
+        disk.seek(SeekFrom::Start(backup_region.end - self.sector_size))?;
+        disk.write_all(&backup)?;
+        disk.sync_all()?;
+
+        debug!("writing GPT primary table");
+        disk.seek(SeekFrom::Start(0))?;
+        disk.write_all(&head)?;
+        Ok(disk.sync_all()?)
+    }
+}
+
+/// Reads the partition table of the disk or image in `file`.
+pub(crate) fn read(file: &mut File) -> Result<PartitionTable> {
+    let mbr = read_at(file, 0, MBR_SIZE)?;
+    if mbr[510..512] != MBR_SIGNATURE {
+        return Err(Error::InvalidPartitionTable("missing MBR signature".to_owned()));
+    }
+
+    let entries = (0..4)
+        .map(|i| &mbr[MBR_ENTRIES_OFFSET + i * MBR_ENTRY_SIZE..][..MBR_ENTRY_SIZE])
+        .collect::<Vec<_>>();
+    if entries.iter().any(|e| e[4] == GPT_PROTECTIVE_TYPE) {
+        return read_gpt(file);
+    }
+
+    let partitions = entries
+        .iter()
+        .enumerate()
+        .filter(|(_, e)| e[4] != 0)
+        .map(|(i, e)| Partition {
+            number: i as u32 + 1,
+            name: String::default(),
+            start: u64::from(u32_at(e, 8)) * MBR_SIZE,
+            size: u64::from(u32_at(e, 12)) * MBR_SIZE,
+        })
+        .collect();
+    Ok(PartitionTable { partitions, sector_size: MBR_SIZE, head: mbr, gpt: None })
+}
+
+fn read_gpt(file: &mut File) -> Result<PartitionTable> {
+    let sector_size = SECTOR_SIZES
+        .iter()
+        .copied()
+        .find(|ss| {
+            read_at(file, *ss, GPT_SIGNATURE.len() as u64)
+                .map(|sig| sig == GPT_SIGNATURE)
+                .unwrap_or(false)
+        })
+        .ok_or_else(|| Error::InvalidPartitionTable("missing GPT header".to_owned()))?;
+
+    let header = read_at(file, sector_size, sector_size)?;
+    let mut check = header.clone();
+    update_header_crc(&mut check);
+    if check != header {
+        return Err(Error::InvalidPartitionTable("GPT header checksum mismatch".to_owned()));
+    }
+
+    let entries_lba = u64_at(&header, 72);
+    let entries_count = u64::from(u32_at(&header, 80));
+    let entry_size = u64::from(u32_at(&header, 84));
+    let entries_len = entries_count * entry_size;
+    let alternate_lba = u64_at(&header, 32);
+    // The entries are usually 16KiB long, those taking much longer being
+    // refused as the whole table is kept in memory.
+    if entry_size < 128
+        || entries_lba < 2
+        || entries_len > MAX_ENTRIES_LEN
+        || alternate_lba <= entries_lba + entries_len / sector_size
+    {
+        return Err(Error::InvalidPartitionTable("invalid GPT entries".to_owned()));
+    }
+
+    let head = read_at(file, 0, entries_lba * sector_size + entries_len)?;
+    let entries = &head[(entries_lba * sector_size) as usize..];
+    if crc32(entries) != u32_at(&header, 88) {
+        return Err(Error::InvalidPartitionTable("GPT entries checksum mismatch".to_owned()));
+    }
+
+    let partitions = entries
+        .chunks(entry_size as usize)
+        .enumerate()
+        .filter(|(_, e)| e[..16].iter().any(|b| *b != 0))
+        .map(|(i, e)| {
+            let first_lba = u64_at(e, 32);
+            let last_lba = u64_at(e, 40);
+            let name = e[56..128]
+                .chunks(2)
+                .map(|c| u16::from_le_bytes([c[0], c[1]]))
+                .take_while(|c| *c != 0)
+                .collect::<Vec<_>>();
+            Partition {
+                number: i as u32 + 1,
+                name: String::from_utf16_lossy(&name),
+                start: first_lba * sector_size,
+                size: (last_lba + 1).saturating_sub(first_lba) * sector_size,
+            }
+        })
+        .collect();
+
+    let gpt = Gpt { alternate_lba, entries_lba, entries_len };
+    Ok(PartitionTable { partitions, sector_size, head, gpt: Some(gpt) })
+}
+
+/// Copies the first `len` bytes of the `source` to the `target`, leaving
+/// the `skip` regions of the target as they are.
+pub(crate) fn copy_regions(
+    source: &mut File,
+    target: &mut File,
+    len: u64,
+    skip: &[Range<u64>],
+) -> Result<()> {
+    let mut skip = skip.to_vec();
+    skip.sort_by_key(|r| r.start);
+
+    let mut cursor = 0;
+    for region in skip {
+        copy_range(source, target, cursor..std::cmp::min(region.start, len))?;
+        cursor = std::cmp::max(cursor, region.end);
+    }
+    copy_range(source, target, cursor..len)
+}
+
+fn copy_range(source: &mut File, target: &mut File, range: Range<u64>) -> Result<()> {
+    if range.start >= range.end {
+        return Ok(());
+    }
+    debug!("copying {} bytes at {}", range.end - range.start, range.start);
+    source.seek(SeekFrom::Start(range.start))?;
+    target.seek(SeekFrom::Start(range.start))?;
+    let copied = io::copy(&mut source.take(range.end - range.start), target)?;
+    if copied != range.end - range.start {
+        return Err(io::Error::from(io::ErrorKind::UnexpectedEof).into());
+    }
+    Ok(())
+}
+
+/// Asks the kernel to re-read the partition table of the `disk`, which
+/// it refuses while any of its partitions is in use, the new table being
+/// taken on the next boot then.
+pub(crate) fn reread(disk: &File) {
+    match disk.metadata() {
+        Ok(metadata) if metadata.file_type().is_block_device() => {}
+        _ => return,
+    }
+    if let Err(e) = unsafe { ffi::blk_rrpart(disk.as_raw_fd()) } {
+        warn!("failed to re-read the partition table, it is taken on the next boot: {}", e);
+    }
+}
+
+fn read_at(file: &mut File, offset: u64, len: u64) -> Result<Vec<u8>> {
+    let mut buf = vec![0; len as usize];
+    file.seek(SeekFrom::Start(offset))?;
+    file.read_exact(&mut buf)?;
+    Ok(buf)
+}
+
+fn u32_at(buf: &[u8], offset: usize) -> u32 {
+    let mut bytes = [0; 4];
+    bytes.copy_from_slice(&buf[offset..offset + 4]);
+    u32::from_le_bytes(bytes)
+}
+
+fn u64_at(buf: &[u8], offset: usize) -> u64 {
+    let mut bytes = [0; 8];
+    bytes.copy_from_slice(&buf[offset..offset + 8]);
+    u64::from_le_bytes(bytes)
+}
+
+fn set_u64(buf: &mut [u8], offset: usize, value: u64) {
+    buf[offset..offset + 8].copy_from_slice(&value.to_le_bytes());
+}
+
+// The header checksum is computed over its `header_size` bytes, with the
+// checksum itself zeroed.
+fn update_header_crc(header: &mut [u8]) {
+    let header_size = std::cmp::min(u32_at(header, 12) as usize, header.len());
+    header[16..20].copy_from_slice(&[0; 4]);
+    let crc = crc32(&header[..header_size]);
+    header[16..20].copy_from_slice(&crc.to_le_bytes());
+}
+
+// CRC-32 as used by GPT, the same of Ethernet and zlib.
+fn crc32(data: &[u8]) -> u32 {
+    let mut crc = !0u32;
+    for byte in data {
+        crc ^= u32::from(*byte);
+        for _ in 0..8 {
+            crc = if crc & 1 != 0 { (crc >> 1) ^ 0xedb8_8320 } else { crc >> 1 };
+        }
+    }
+    !crc
+}
+
+mod ffi {
+    use nix::{ioctl_none_bad, request_code_none};
+
+    ioctl_none_bad!(blk_rrpart, request_code_none!(0x12, 95));
+}
+
+#[cfg(test)]
+pub(crate) mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    /// Builds a GPT disk image of `sectors` 512 bytes sectors with the
+    /// `partitions`, given as their name and first and last sectors.
+    pub(crate) fn gpt_image(sectors: u64, partitions: &[(&str, u64, u64)]) -> Vec<u8> {
+        let mut image = vec![0; (sectors * 512) as usize];
+
+        image[MBR_ENTRIES_OFFSET + 4] = GPT_PROTECTIVE_TYPE;
+        image[MBR_ENTRIES_OFFSET + 8..MBR_ENTRIES_OFFSET + 12].copy_from_slice(&1u32.to_le_bytes());
+        image[510..512].copy_from_slice(&MBR_SIGNATURE);
+
+        let mut entries = vec![0; 128 * 128];
+        for (i, (name, first, last)) in partitions.iter().enumerate() {
+            let entry = &mut entries[i * 128..(i + 1) * 128];
+            entry[0] = 0xaf;
+            entry[16] = i as u8 + 1;
+            set_u64(entry, 32, *first);
+            set_u64(entry, 40, *last);
+            for (j, c) in name.encode_utf16().enumerate() {
+                entry[56 + j * 2..58 + j * 2].copy_from_slice(&c.to_le_bytes());
+            }
+        }
+
+        let header = &mut image[512..1024];
+        header[..8].copy_from_slice(GPT_SIGNATURE);
+        header[8..12].copy_from_slice(&0x0001_0000u32.to_le_bytes());
+        header[12..16].copy_from_slice(&92u32.to_le_bytes());
+        set_u64(header, 24, 1);
+        set_u64(header, 32, sectors - 1);
+        set_u64(header, 40, 34);
+        set_u64(header, 48, sectors - 34);
+        set_u64(header, 72, 2);
+        header[80..84].copy_from_slice(&128u32.to_le_bytes());
+        header[84..88].copy_from_slice(&128u32.to_le_bytes());
+        header[88..92].copy_from_slice(&crc32(&entries).to_le_bytes());
+        update_header_crc(header);
+        image[1024..1024 + entries.len()].copy_from_slice(&entries);
+
+        let last = ((sectors - 1) * 512) as usize;
+        let mut backup = image[512..1024].to_vec();
+        set_u64(&mut backup, 24, sectors - 1);
+        set_u64(&mut backup, 32, 1);
+        set_u64(&mut backup, 72, sectors - 33);
+        update_header_crc(&mut backup);
+        image[last - entries.len()..last].copy_from_slice(&entries);
+        image[last..].copy_from_slice(&backup);
+
+        image
+    }
+
+    #[test]
+    fn checksum() {
+        assert_eq!(crc32(b"123456789"), 0xcbf4_3926);
+    }
+
+    #[test]
+    fn mbr_table() {
+        let mut image = vec![0; 4096];
+        image[MBR_ENTRIES_OFFSET + 4] = 0x83;
+        image[MBR_ENTRIES_OFFSET + 8..MBR_ENTRIES_OFFSET + 12].copy_from_slice(&2u32.to_le_bytes());
+        image[MBR_ENTRIES_OFFSET + 12..MBR_ENTRIES_OFFSET + 16]
+            .copy_from_slice(&4u32.to_le_bytes());
+        image[510..512].copy_from_slice(&MBR_SIGNATURE);
+        let mut file = tempfile::tempfile().unwrap();
+        file.write_all(&image).unwrap();
+
+        let table = read(&mut file).unwrap();
+        assert_eq!(
+            table.partitions,
+            vec![Partition { number: 1, name: String::default(), start: 1024, size: 2048 }]
+        );
+        assert_eq!(table.primary_region(), 0..512);
+        assert_eq!(table.backup_region(), None);
+    }
+
+    #[test]
+    fn gpt_table() {
+        let mut file = tempfile::tempfile().unwrap();
+        file.write_all(&gpt_image(128, &[("boot", 34, 63), ("data", 64, 94)])).unwrap();
+
+        let table = read(&mut file).unwrap();
+        assert_eq!(
+            table.find(&definitions::Partition::Name("data".to_owned())),
+            Some(&Partition {
+                number: 2,
+                name: "data".to_owned(),
+                start: 64 * 512,
+                size: 31 * 512
+            })
+        );
+        assert_eq!(table.primary_region(), 0..34 * 512);
+        assert_eq!(table.backup_region(), Some(95 * 512..128 * 512));
+
+        // The table written to a larger disk has its backup at the disk end.
+        let mut disk = tempfile::tempfile().unwrap();
+        disk.set_len(256 * 512).unwrap();
+        table.write(&mut disk, 256 * 512).unwrap();
+        let written = read(&mut disk).unwrap();
+        assert_eq!(written.partitions, table.partitions);
+        assert_eq!(written.backup_region(), Some(223 * 512..256 * 512));
+    }
+
+    #[test]
+    fn copy_skipping_regions() {
+        let mut source = tempfile::tempfile().unwrap();
+        source.write_all(b"0123456789").unwrap();
+        let mut target = tempfile::tempfile().unwrap();
+        target.write_all(b"abcdefghijkl").unwrap();
+
+        copy_regions(&mut source, &mut target, 10, &[6..8, 0..2]).unwrap();
+        assert_eq!(read_at(&mut target, 0, 12).unwrap(), b"ab2345gh89kl");
+    }
+}
@@ -0,0 +1,121 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Power condition the destructive steps of an update, installing and
+//! rebooting, are deferred on, so a device running out of battery isn't
+//! left half updated.
+
+use super::{Error, Result};
+use sdk::api::info::settings::Power;
+use slog_scope::{debug, warn};
+use std::{fs, path::Path, process::Command};
+
+/// Whether a power condition is set.
+pub(crate) fn is_gated(settings: &Power) -> bool {
+    settings.battery_capacity_path.is_some()
+        || settings.external_power_path.is_some()
+        || settings.condition_script.is_some()
+}
+
+/// Whether the power condition passes for the `action`, as `install`. It
+/// doesn't when the power status can't be read.
+pub(crate) fn condition_passes(settings: &Power, action: &str) -> bool {
+    if !is_supplied(settings) {
+        return false;
+    }
+
+    match settings.condition_script {
+        Some(ref script) => match Command::new(script).arg(action).status() {
+            Ok(status) => {
+                debug!("power condition script has exited with {}", status);
+                status.success()
+            }
+            Err(e) => {
+                warn!("failed to run the power condition script {:?}: {}", script, e);
+                false
+            }
+        },
+        None => true,
+    }
+}
+
+fn is_supplied(settings: &Power) -> bool {
+    if settings.battery_capacity_path.is_none() && settings.external_power_path.is_none() {
+        return true;
+    }
+
+    if let Some(ref path) = settings.external_power_path {
+        match read_attribute(path) {
+            Ok(online) if online == 1 => return true,
+            Ok(_) => debug!("running without external power"),
+            Err(e) => warn!("unable to read the external power status: {}", e),
+        }
+    }
+
+    match settings.battery_capacity_path {
+        Some(ref path) => match read_attribute(path) {
+            Ok(level) => {
+                debug!("battery charge is at {}%", level);
+                level >= u64::from(settings.min_battery_level)
+            }
+            Err(e) => {
+                warn!("unable to read the battery charge: {}", e);
+                false
+            }
+        },
+        None => false,
+    }
+}
+
+fn read_attribute(path: &Path) -> Result<u64> {
+    fs::read_to_string(path)?
+        .trim()
+        .parse()
+        .map_err(|_| Error::InvalidSysfsAttribute(path.to_owned()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::os::unix::fs::PermissionsExt;
+
+    #[test]
+    fn battery_and_external_power() {
+        let dir = tempfile::tempdir().unwrap();
+        let capacity = dir.path().join("capacity");
+        let online = dir.path().join("online");
+        fs::write(&capacity, "5\n").unwrap();
+        fs::write(&online, "0\n").unwrap();
+        let mut settings = Power {
+            battery_capacity_path: Some(capacity.clone()),
+            min_battery_level: 30,
+            external_power_path: Some(online.clone()),
+            ..Power::default()
+        };
+
+        assert!(!condition_passes(&settings, "install"));
+        fs::write(&online, "1\n").unwrap();
+        assert!(condition_passes(&settings, "install"));
+        fs::write(&online, "0\n").unwrap();
+        fs::write(&capacity, "30\n").unwrap();
+        assert!(condition_passes(&settings, "install"));
+
+        settings.battery_capacity_path = Some(dir.path().join("missing"));
+        assert!(!condition_passes(&settings, "install"));
+        assert!(condition_passes(&Power::default(), "install"));
+    }
+
+    #[test]
+    fn condition_script() {
+        let dir = tempfile::tempdir().unwrap();
+        let script = dir.path().join("power-condition");
+        fs::write(&script, "#!/bin/sh\n[ \"$1\" = reboot ]\n").unwrap();
+        fs::set_permissions(&script, fs::Permissions::from_mode(0o755)).unwrap();
+        let settings = Power { condition_script: Some(script), ..Power::default() };
+
+        assert!(is_gated(&settings));
+        assert!(!condition_passes(&settings, "install"));
+        assert!(condition_passes(&settings, "reboot"));
+    }
+}
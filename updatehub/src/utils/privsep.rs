@@ -0,0 +1,732 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Privilege separation of the agent. Before any code facing the network
+//! runs, as the cloud client, the downloader and the local API, the agent
+//! spawns a privileged installer and drops its own privileges. From then
+//! on, the installer is the only process touching the block devices and
+//! the bootloader environment, serving the agent a request at a time over
+//! a socketpair.
+//!
+//! The installer doesn't trust the agent: it only reads its own settings
+//! file, validates the signature of the package metadata before parsing
+//! it itself, checks the objects it is asked to install against it and
+//! decrypts the encrypted ones on its own.
+
+use super::{Error, Result};
+use crate::{
+    firmware::{
+        self,
+        installation_set::{self, Set},
+    },
+    object::{self, Installer},
+    settings::Settings,
+    update_package::{Signature, UpdatePackage, UpdatePackageExt},
+    utils::{self, encryption::DECRYPTED_PREFIX},
+};
+use lazy_static::lazy_static;
+use nix::unistd::{self, Group, User};
+use pkg_schema::{Encryption, Object};
+use sdk::api::info::{
+    runtime_settings::{InstallationSet, SignedPackage},
+    settings::PrivilegeSeparation,
+};
+use serde::{Deserialize, Serialize};
+use slog_scope::{debug, error, info, warn};
+use std::{
+    io::{self, BufRead, BufReader, Write},
+    os::unix::{
+        io::{AsRawFd, FromRawFd, RawFd},
+        net::UnixStream,
+        process::CommandExt,
+    },
+    path::{Path, PathBuf},
+    process::Command,
+    sync::Mutex,
+};
+
+/// Descriptor the installer inherits its end of the socketpair as.
+pub(crate) const INSTALLER_FD: RawFd = 3;
+
+lazy_static! {
+    static ref INSTALLER: Mutex<Option<BufReader<UnixStream>>> = Mutex::new(None);
+}
+
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+#[serde(rename_all = "snake_case", tag = "request")]
+enum Request {
+    Install {
+        package: SignedPackage,
+        installation_set: InstallationSet,
+        index: usize,
+        dir: PathBuf,
+        verify: bool,
+    },
+    Backup {
+        package: SignedPackage,
+        installation_set: InstallationSet,
+        index: usize,
+        dir: PathBuf,
+    },
+    Restore {
+        package: SignedPackage,
+        installation_set: InstallationSet,
+        index: usize,
+        dir: PathBuf,
+    },
+    DropBackup {
+        package: SignedPackage,
+        installation_set: InstallationSet,
+        index: usize,
+        dir: PathBuf,
+    },
+    SwapActive,
+    Validate,
+    StoreSecurityVersion {
+        package: SignedPackage,
+    },
+    Reboot,
+}
+
+/// Answer to a request. The progress of the object being installed is
+/// sent before it, as the installer reports it.
+#[derive(Debug, Deserialize, PartialEq, Serialize)]
+struct Response {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    progress: Option<u8>,
+    error: Option<String>,
+}
+
+/// Spawns the privileged installer, as this same executable started with
+/// the `config` file, and drops the privileges of the agent, which
+/// delegates the privileged operations to the installer from then on.
+pub(crate) fn start(settings: &PrivilegeSeparation, config: &Path) -> Result<()> {
+    let (agent, installer) = UnixStream::pair()?;
+    let fd = installer.as_raw_fd();
+
+    let mut cmd = Command::new(std::env::current_exe()?);
+    cmd.arg("installer").arg("--config").arg(config);
+    unsafe {
+        cmd.pre_exec(move || {
+            // The socket is closed on exec, unlike its duplicate.
+            let res = if fd == INSTALLER_FD {
+                libc::fcntl(fd, libc::F_SETFD, 0)
+            } else {
+                libc::dup2(fd, INSTALLER_FD)
+            };
+            if res < 0 {
+                return Err(io::Error::last_os_error());
+            }
+            Ok(())
+        });
+    }
+    let child = cmd.spawn()?;
+    drop(installer);
+    info!("started the privileged installer (pid {})", child.id());
+
+    *INSTALLER.lock().expect("poisoned installer lock") = Some(BufReader::new(agent));
+    drop_privileges(settings)
+}
+
+/// Delegates the privileged operations to the installer on the other end
+/// of the `agent` socket, as if it had been started.
+#[cfg(test)]
+pub(crate) fn attach(agent: UnixStream) {
+    *INSTALLER.lock().expect("poisoned installer lock") = Some(BufReader::new(agent));
+}
+
+/// Whether the privileged operations are delegated to the installer.
+pub(crate) fn is_separated() -> bool {
+    INSTALLER.lock().expect("poisoned installer lock").is_some()
+}
+
+/// Installs the object `index` of the `installation_set` objects of the
+/// `package` from `dir`, reading it back from its target when `verify` is
+/// set. The object is taken from the metadata as the installer takes it,
+/// so it can be installed from any thread. The installer takes the
+/// encrypted objects from the download directory, decrypting them itself.
+pub(crate) fn install_object(
+    settings: &Settings,
+    package: &SignedPackage,
+    installation_set: Set,
+    index: usize,
+    dir: &Path,
+    verify: bool,
+) -> object::Result<()> {
+    if is_separated() {
+        return Ok(request(&Request::Install {
+            package: package.clone(),
+            installation_set: installation_set.0,
+            index,
+            dir: dir.to_owned(),
+            verify,
+        })?);
+    }
+
+    let (_, obj, dir) = requested_object(settings, package, installation_set, index, dir)
+        .map_err(|e| io::Error::new(io::ErrorKind::InvalidInput, e))?;
+    install(&obj, &dir, verify)
+}
+
+/// Backs the region the object `index` of the `installation_set` objects
+/// overwrites up into `dir`, so it can be restored.
+pub(crate) fn backup_object(
+    package: &SignedPackage,
+    installation_set: Set,
+    index: usize,
+    obj: &Object,
+    dir: &Path,
+) -> object::Result<()> {
+    if is_separated() {
+        return Ok(request(&Request::Backup {
+            package: package.clone(),
+            installation_set: installation_set.0,
+            index,
+            dir: dir.to_owned(),
+        })?);
+    }
+    object::transaction::backup(obj, dir)
+}
+
+/// Restores the region the object `index` of the `installation_set`
+/// objects has overwritten from its backup in `dir`.
+pub(crate) fn restore_object(
+    package: &SignedPackage,
+    installation_set: Set,
+    index: usize,
+    obj: &Object,
+    dir: &Path,
+) -> object::Result<()> {
+    if is_separated() {
+        return Ok(request(&Request::Restore {
+            package: package.clone(),
+            installation_set: installation_set.0,
+            index,
+            dir: dir.to_owned(),
+        })?);
+    }
+    object::transaction::restore(obj, dir)
+}
+
+/// Drops the backup in `dir` of the object `index` of the
+/// `installation_set` objects, once the install is done.
+pub(crate) fn drop_backup(
+    package: &SignedPackage,
+    installation_set: Set,
+    index: usize,
+    obj: &Object,
+    dir: &Path,
+) -> object::Result<()> {
+    if is_separated() {
+        return Ok(request(&Request::DropBackup {
+            package: package.clone(),
+            installation_set: installation_set.0,
+            index,
+            dir: dir.to_owned(),
+        })?);
+    }
+    object::transaction::drop_backup(obj, dir)
+}
+
+/// Swaps the active installation set, so the other is booted into.
+pub(crate) fn swap_active() -> Result<()> {
+    if is_separated() {
+        return request(&Request::SwapActive);
+    }
+    Ok(installation_set::swap_active()?)
+}
+
+/// Validates the active installation set, so it keeps being booted into.
+pub(crate) fn validate() -> Result<()> {
+    if is_separated() {
+        return request(&Request::Validate);
+    }
+    Ok(installation_set::validate()?)
+}
+
+/// Keeps the security version of the `package` out of the runtime
+/// settings, once the package is validated, as the runtime settings may
+/// have been tampered with.
+pub(crate) fn store_security_version(settings: &Settings, package: &SignedPackage) -> Result<()> {
+    if is_separated() {
+        return request(&Request::StoreSecurityVersion { package: package.clone() });
+    }
+    let version = validated_package(settings, package)?.inner.security_version;
+    utils::anti_rollback::store(&settings.anti_rollback, version)
+}
+
+/// Reboots the device.
+pub(crate) fn reboot(settings: &Settings) -> Result<()> {
+    if settings.simulation.enabled {
+        return crate::simulation::reboot(&settings.simulation);
+    }
+    if is_separated() {
+        return request(&Request::Reboot);
+    }
+    let output = easy_process::run(&reboot_command(settings))?;
+    if !output.stdout.is_empty() || !output.stderr.is_empty() {
+        warn!("  reboot output: stdout: {}, stderr: {}", output.stdout, output.stderr);
+    }
+    Ok(())
+}
+
+/// Command rebooting the device, the custom one when it is set, run in
+/// the host namespaces when the agent is in a container.
+pub(crate) fn reboot_command(settings: &Settings) -> String {
+    utils::container::host_command(
+        &settings.container,
+        settings.reboot.command.as_deref().unwrap_or("reboot"),
+    )
+}
+
+/// Serves the requests of the agent, on the socket inherited as
+/// `INSTALLER_FD`, until the agent closes it.
+pub fn serve(config: &Path) -> crate::Result<()> {
+    // Only the settings file is read, as the settings changed through
+    // the agent API are kept by the unprivileged agent.
+    let settings = Settings::load(config)?;
+    installation_set::configure(&settings.active_inactive);
+    utils::uboot_env::configure(&settings.firmware);
+    utils::verification::set_kernel_hashing(settings.update.kernel_hashing);
+    let stream = unsafe { UnixStream::from_raw_fd(INSTALLER_FD) };
+    serve_on(&settings, stream)?;
+    info!("agent has closed the installer socket, exiting");
+    Ok(())
+}
+
+fn serve_on(settings: &Settings, stream: UnixStream) -> io::Result<()> {
+    let mut writer = stream.try_clone()?;
+    let progress = stream.try_clone()?;
+    object::set_progress_sink(Some(Box::new(move |percentage| {
+        let response = Response { progress: Some(percentage), error: None };
+        if let Err(e) = send_response(&mut &progress, &response) {
+            warn!("failed to send the install progress: {}", e);
+        }
+    })));
+
+    for line in BufReader::new(stream).lines() {
+        let res = serde_json::from_str(&line?)
+            .map_err(|e| format!("invalid request: {}", e))
+            .and_then(|req| handle(settings, req));
+        if let Err(ref e) = res {
+            error!("installer request has failed: {}", e);
+        }
+        send_response(&mut writer, &Response { progress: None, error: res.err() })?;
+    }
+    Ok(())
+}
+
+fn send_response(writer: &mut impl Write, response: &Response) -> io::Result<()> {
+    serde_json::to_writer(&mut *writer, response)?;
+    writer.write_all(b"\n")
+}
+
+fn handle(settings: &Settings, req: Request) -> std::result::Result<(), String> {
+    debug!("installer request: {:?}", req);
+    match req {
+        Request::Install { package, installation_set, index, dir, verify } => {
+            install_requested(settings, &package, Set(installation_set), index, &dir, verify)
+        }
+        Request::Backup { package, installation_set, index, dir } => {
+            let (_, obj, dir) =
+                requested_object(settings, &package, Set(installation_set), index, &dir)?;
+            object::transaction::backup(&obj, &dir).map_err(|e| e.to_string())
+        }
+        Request::Restore { package, installation_set, index, dir } => {
+            let (_, obj, dir) =
+                requested_object(settings, &package, Set(installation_set), index, &dir)?;
+            object::transaction::restore(&obj, &dir).map_err(|e| e.to_string())
+        }
+        Request::DropBackup { package, installation_set, index, dir } => {
+            let (_, obj, dir) =
+                requested_object(settings, &package, Set(installation_set), index, &dir)?;
+            object::transaction::drop_backup(&obj, &dir).map_err(|e| e.to_string())
+        }
+        Request::SwapActive => installation_set::swap_active().map_err(|e| e.to_string()),
+        Request::Validate => installation_set::validate().map_err(|e| e.to_string()),
+        Request::StoreSecurityVersion { package } => {
+            store_security_version(settings, &package).map_err(|e| e.to_string())
+        }
+        Request::Reboot => reboot(settings).map_err(|e| e.to_string()),
+    }
+}
+
+fn install_requested(
+    settings: &Settings,
+    package: &SignedPackage,
+    installation_set: Set,
+    index: usize,
+    dir: &Path,
+    verify: bool,
+) -> std::result::Result<(), String> {
+    let (package, obj, dir) = requested_object(settings, package, installation_set, index, dir)?;
+    utils::io::set_direct_io(settings.update.direct_io);
+    utils::fs::set_lenient_paths(settings.extraction.lenient_paths);
+    utils::archive::set_limits(&settings.extraction);
+    utils::read_only::set_pending_dir(&settings.update.pending_dir);
+
+    // The encrypted objects are checked as they have been downloaded,
+    // their plain text being authenticated as they are decrypted.
+    let sha256sum = object::Info::sha256sum(&obj);
+    if utils::sha256sum_file(&dir.join(sha256sum)).map_err(|e| e.to_string())? != sha256sum {
+        return Err(format!("object {} doesn't match its checksum", sha256sum));
+    }
+    match package.inner.encryption {
+        Some(ref encryption) if encryption.objects.contains_key(sha256sum) => {
+            let plain = decrypt_object(settings, encryption, &obj, &dir)?;
+            object::check_extraction_limits(&obj, plain.path(), &settings.extraction)
+                .and_then(|_| install(&obj, plain.path(), verify))
+                .map_err(|e| e.to_string())
+        }
+        _ => install(&obj, &dir, verify).map_err(|e| e.to_string()),
+    }
+}
+
+// Decrypts the `obj` from `dir` into a private directory, removed once
+// it is dropped, or when the agent starts again if it is interrupted.
+fn decrypt_object(
+    settings: &Settings,
+    encryption: &Encryption,
+    obj: &Object,
+    dir: &Path,
+) -> std::result::Result<tempfile::TempDir, String> {
+    let private_key = firmware::decryption_key(&settings.firmware.metadata)
+        .ok_or("package is encrypted but device has no key")?;
+    let key = utils::encryption::unwrap_key(encryption, &private_key).map_err(|e| e.to_string())?;
+    let plain = tempfile::Builder::new()
+        .prefix(DECRYPTED_PREFIX)
+        .tempdir_in(&settings.update.download_dir)
+        .map_err(|e| e.to_string())?;
+
+    let sha256sum = object::Info::sha256sum(obj);
+    info!("decrypting object {}", sha256sum);
+    utils::encryption::decrypt_object(
+        &key,
+        &encryption.objects[sha256sum],
+        sha256sum,
+        dir,
+        plain.path(),
+    )
+    .map_err(|e| e.to_string())?;
+    Ok(plain)
+}
+
+// Takes the object `index` from the validated package metadata, as the
+// agent has taken it, along with the package and the directory the
+// request refers to, which must be in the download directory.
+fn requested_object(
+    settings: &Settings,
+    package: &SignedPackage,
+    installation_set: Set,
+    index: usize,
+    dir: &Path,
+) -> std::result::Result<(UpdatePackage, Object, PathBuf), String> {
+    // Only the objects downloaded by the agent are taken.
+    let download_dir = settings.update.download_dir.canonicalize().map_err(|e| e.to_string())?;
+    let dir = dir.canonicalize().map_err(|e| e.to_string())?;
+    if !dir.starts_with(&download_dir) {
+        return Err(format!("{:?} is out of the download directory", dir));
+    }
+
+    let mut package = validated_package(settings, package).map_err(|e| e.to_string())?;
+    // The objects are taken as the agent has taken them.
+    package.apply_install_mode_defaults(&settings.install_modes);
+    package.retain_role_objects(settings.update.role.as_deref());
+    let objects = package.objects_mut(installation_set);
+    if index >= objects.len() {
+        return Err(format!("package has no object {}", index));
+    }
+    let mut obj = objects.swap_remove(index);
+    utils::container::resolve_object_targets(&settings.container, &mut obj);
+    crate::simulation::resolve_object_targets(&settings.simulation, &mut obj);
+
+    Ok((package, obj, dir))
+}
+
+// Parses the package metadata once its signature is validated with the
+// key of the device, when it has one, as the agent has validated it.
+fn validated_package(settings: &Settings, package: &SignedPackage) -> Result<UpdatePackage> {
+    if let Some(key) = firmware::pub_key(&settings.firmware.metadata) {
+        let signature = package
+            .signature
+            .as_deref()
+            .ok_or_else(|| Error::InvalidPackage("missing signature".to_owned()))?;
+        Signature::from_base64_str(signature)
+            .and_then(|signature| signature.verify(&key, package.package.as_bytes()))
+            .map_err(|e| Error::InvalidPackage(e.to_string()))?;
+    }
+    UpdatePackage::parse(package.package.as_bytes())
+        .map_err(|e| Error::InvalidPackage(e.to_string()))
+}
+
+fn install(obj: &Object, dir: &Path, verify: bool) -> object::Result<()> {
+    obj.install(dir)?;
+    if verify {
+        info!("reading the object back from its target");
+        obj.verify(dir)?;
+    }
+    Ok(())
+}
+
+fn request(req: &Request) -> Result<()> {
+    let mut installer = INSTALLER.lock().expect("poisoned installer lock");
+    let installer = installer.as_mut().expect("privileges aren't separated");
+
+    let mut line =
+        serde_json::to_string(req).map_err(|e| Error::PrivilegedInstaller(e.to_string()))?;
+    line.push('\n');
+    installer.get_mut().write_all(line.as_bytes())?;
+
+    let response = loop {
+        line.clear();
+        if installer.read_line(&mut line)? == 0 {
+            return Err(Error::PrivilegedInstaller("installer has exited".to_owned()));
+        }
+        let response: Response =
+            serde_json::from_str(&line).map_err(|e| Error::PrivilegedInstaller(e.to_string()))?;
+        match response.progress {
+            Some(percentage) => object::report_progress(percentage),
+            None => break response,
+        }
+    };
+    match response.error {
+        Some(e) => Err(Error::PrivilegedInstaller(e)),
+        None => Ok(()),
+    }
+}
+
+fn drop_privileges(settings: &PrivilegeSeparation) -> Result<()> {
+    let user = User::from_name(&settings.user)?
+        .ok_or_else(|| Error::UnknownUser(settings.user.clone()))?;
+    let gid = match settings.group {
+        Some(ref group) => {
+            Group::from_name(group)?.ok_or_else(|| Error::UnknownUser(group.clone()))?.gid
+        }
+        None => user.gid,
+    };
+
+    unistd::setgroups(&[gid])?;
+    unistd::setgid(gid)?;
+    unistd::setuid(user.uid)?;
+    if unsafe { libc::prctl(libc::PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) } != 0 {
+        return Err(io::Error::last_os_error().into());
+    }
+    seccomp::deny_privileged_syscalls()?;
+
+    info!("dropped privileges, running as {}", settings.user);
+    Ok(())
+}
+
+mod seccomp {
+    use slog_scope::warn;
+    use std::io;
+
+    const BPF_LD_W_ABS: u16 = 0x20;
+    const BPF_JEQ_K: u16 = 0x15;
+    const BPF_JGE_K: u16 = 0x35;
+    const BPF_RET_K: u16 = 0x06;
+    const SECCOMP_SET_MODE_FILTER: libc::c_long = 1;
+    const SECCOMP_FILTER_FLAG_TSYNC: libc::c_long = 1;
+    const SECCOMP_RET_ALLOW: u32 = 0x7fff_0000;
+    const SECCOMP_RET_ERRNO: u32 = 0x0005_0000;
+    // Offsets of the fields of the seccomp_data given to the filter.
+    const SYSCALL_NR: u32 = 0;
+    const SYSCALL_ARCH: u32 = 4;
+
+    #[cfg(target_arch = "x86_64")]
+    const AUDIT_ARCH: Option<u32> = Some(0xc000_003e);
+    #[cfg(target_arch = "aarch64")]
+    const AUDIT_ARCH: Option<u32> = Some(0xc000_00b7);
+    #[cfg(target_arch = "arm")]
+    const AUDIT_ARCH: Option<u32> = Some(0x4000_0028);
+    #[cfg(not(any(target_arch = "x86_64", target_arch = "aarch64", target_arch = "arm")))]
+    const AUDIT_ARCH: Option<u32> = None;
+
+    // The x32 syscalls share the x86_64 architecture, being told apart
+    // by this bit of their number.
+    #[cfg(target_arch = "x86_64")]
+    const X32_SYSCALL_BIT: Option<u32> = Some(0x4000_0000);
+    #[cfg(not(target_arch = "x86_64"))]
+    const X32_SYSCALL_BIT: Option<u32> = None;
+
+    // Syscalls only the installer has a use for, refused to the agent
+    // even if it regains the privileges somehow.
+    const DENIED: &[libc::c_long] = &[
+        libc::SYS_mount,
+        libc::SYS_umount2,
+        libc::SYS_pivot_root,
+        libc::SYS_swapon,
+        libc::SYS_swapoff,
+        libc::SYS_reboot,
+        libc::SYS_kexec_load,
+        libc::SYS_init_module,
+        libc::SYS_finit_module,
+        libc::SYS_delete_module,
+        libc::SYS_ptrace,
+        libc::SYS_process_vm_writev,
+    ];
+
+    /// Installs a filter, on every thread of the process, refusing the
+    /// `DENIED` syscalls with EPERM.
+    pub(super) fn deny_privileged_syscalls() -> io::Result<()> {
+        let arch = match AUDIT_ARCH {
+            Some(arch) => arch,
+            None => {
+                warn!("syscall filtering isn't supported on this architecture");
+                return Ok(());
+            }
+        };
+        let deny = SECCOMP_RET_ERRNO | libc::EPERM as u32;
+
+        let mut filter = vec![
+            stmt(BPF_LD_W_ABS, SYSCALL_ARCH),
+            jump(BPF_JEQ_K, arch, 1, 0),
+            stmt(BPF_RET_K, deny),
+            stmt(BPF_LD_W_ABS, SYSCALL_NR),
+        ];
+        if let Some(bit) = X32_SYSCALL_BIT {
+            filter.push(jump(BPF_JGE_K, bit, 0, 1));
+            filter.push(stmt(BPF_RET_K, deny));
+        }
+        for nr in DENIED {
+            filter.push(jump(BPF_JEQ_K, *nr as u32, 0, 1));
+            filter.push(stmt(BPF_RET_K, deny));
+        }
+        filter.push(stmt(BPF_RET_K, SECCOMP_RET_ALLOW));
+
+        let prog = libc::sock_fprog { len: filter.len() as u16, filter: filter.as_mut_ptr() };
+        let res = unsafe {
+            libc::syscall(
+                libc::SYS_seccomp,
+                SECCOMP_SET_MODE_FILTER,
+                SECCOMP_FILTER_FLAG_TSYNC,
+                &prog as *const libc::sock_fprog,
+            )
+        };
+        if res != 0 {
+            return Err(io::Error::last_os_error());
+        }
+        Ok(())
+    }
+
+    fn stmt(code: u16, k: u32) -> libc::sock_filter {
+        libc::sock_filter { code, jt: 0, jf: 0, k }
+    }
+
+    fn jump(code: u16, k: u32, jt: u8, jf: u8) -> libc::sock_filter {
+        libc::sock_filter { code, jt, jf, k }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::update_package::tests::get_update_package;
+    use pretty_assertions::assert_eq;
+    use std::fs;
+
+    fn send(stream: &mut BufReader<UnixStream>, req: &Request) -> Response {
+        let mut line = serde_json::to_string(req).unwrap();
+        line.push('\n');
+        stream.get_mut().write_all(line.as_bytes()).unwrap();
+        line.clear();
+        stream.read_line(&mut line).unwrap();
+        serde_json::from_str(&line).unwrap()
+    }
+
+    #[test]
+    fn installer_checks_requests() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let settings = setup.settings.data.clone();
+        let package = get_update_package();
+        let signed = SignedPackage {
+            package: String::from_utf8(package.raw.clone()).unwrap(),
+            signature: None,
+        };
+        let (agent, installer) = UnixStream::pair().unwrap();
+        let server = std::thread::spawn(move || serve_on(&settings, installer).unwrap());
+        let mut agent = BufReader::new(agent);
+
+        // Objects out of the download directory are refused
+        let outside = tempfile::tempdir().unwrap();
+        let res = send(
+            &mut agent,
+            &Request::Install {
+                package: signed.clone(),
+                installation_set: InstallationSet::A,
+                index: 0,
+                dir: outside.path().to_owned(),
+                verify: false,
+            },
+        );
+        assert!(res.error.unwrap().contains("out of the download directory"));
+
+        // And so are the ones not matching the package
+        let download_dir = &setup.settings.data.update.download_dir;
+        fs::create_dir_all(download_dir).unwrap();
+        let sha256sum = object::Info::sha256sum(&package.objects(Set(InstallationSet::A))[0]);
+        fs::write(download_dir.join(sha256sum), "tampered").unwrap();
+        let res = send(
+            &mut agent,
+            &Request::Install {
+                package: signed.clone(),
+                installation_set: InstallationSet::A,
+                index: 0,
+                dir: download_dir.clone(),
+                verify: false,
+            },
+        );
+        assert!(res.error.unwrap().contains("doesn't match its checksum"));
+
+        let res = send(
+            &mut agent,
+            &Request::Install {
+                package: signed,
+                installation_set: InstallationSet::A,
+                index: 7,
+                dir: download_dir.clone(),
+                verify: false,
+            },
+        );
+        assert_eq!(res.error.as_deref(), Some("package has no object 7"));
+
+        drop(agent);
+        server.join().unwrap();
+    }
+
+    #[test]
+    fn installer_validates_signature() {
+        let setup = crate::tests::TestEnvironment::build().finish();
+        let settings = setup.settings.data.clone();
+        fs::write(settings.firmware.metadata.join("key.pub"), "key").unwrap();
+        let package = get_update_package();
+        let (agent, installer) = UnixStream::pair().unwrap();
+        let server = std::thread::spawn(move || serve_on(&settings, installer).unwrap());
+        let mut agent = BufReader::new(agent);
+        let download_dir = setup.settings.data.update.download_dir.clone();
+
+        // Unsigned packages are refused once the device has a key
+        let mut signed =
+            SignedPackage { package: String::from_utf8(package.raw).unwrap(), signature: None };
+        let res = send(
+            &mut agent,
+            &Request::Install {
+                package: signed.clone(),
+                installation_set: InstallationSet::A,
+                index: 0,
+                dir: download_dir.clone(),
+                verify: false,
+            },
+        );
+        assert!(res.error.unwrap().contains("missing signature"));
+
+        // And so are the ones not matching their signature
+        signed.signature = Some("Zm9yZ2Vk".to_owned());
+        let res = send(&mut agent, &Request::StoreSecurityVersion { package: signed });
+        assert!(res.error.is_some());
+
+        drop(agent);
+        server.join().unwrap();
+    }
+}
@@ -0,0 +1,345 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Targets which are mounted read-only, as the root filesystem of the
+//! modern images, possibly as the lower directory of an overlay. The
+//! objects are written to them as the package asks: remounting the target
+//! read-write while it is written, writing to the upper directory of the
+//! overlay or staging the object in the pending directory, which is
+//! applied to the target once the device has rebooted.
+
+use super::{Error, Result};
+use lazy_static::lazy_static;
+use nix::mount::MsFlags;
+use pkg_schema::definitions::{Filesystem, ReadOnly};
+use slog_scope::{error, info, warn};
+use std::{
+    fs,
+    os::unix::fs::{MetadataExt, PermissionsExt},
+    path::{Path, PathBuf},
+    sync::RwLock,
+};
+
+lazy_static! {
+    // Set from the update settings before installing, as the installers
+    // are not given the settings.
+    static ref PENDING_DIR: RwLock<PathBuf> =
+        RwLock::new(PathBuf::from("/var/lib/updatehub/pending"));
+}
+
+/// Mount of a filesystem, as listed in `/proc/self/mountinfo`.
+#[derive(Debug, PartialEq)]
+struct MountInfo {
+    device: (u64, u64),
+    root: PathBuf,
+    mount_point: PathBuf,
+    read_only: bool,
+    fstype: String,
+    super_options: String,
+}
+
+pub(crate) fn set_pending_dir(dir: &Path) {
+    *PENDING_DIR.write().unwrap() = dir.to_owned();
+}
+
+/// Runs `f` with the directory the object is read back from, as it has
+/// been written to the `device` in the `read_only` way.
+pub(crate) fn read_map<F, T>(
+    device: &Path,
+    fs: Filesystem,
+    options: &str,
+    read_only: Option<ReadOnly>,
+    f: F,
+) -> Result<T>
+where
+    F: FnOnce(&Path) -> T,
+{
+    match read_only {
+        None => super::fs::mount_map(device, fs, options, f),
+        Some(ReadOnly::Remount) => match mount_of(device)? {
+            Some(mount) => Ok(f(&mount.mount_point)),
+            None => super::fs::mount_map(device, fs, options, f),
+        },
+        Some(ReadOnly::UpperDir) => Ok(f(&upper_dir(device)?)),
+        Some(ReadOnly::Pending) => Ok(f(&pending_path(device))),
+    }
+}
+
+/// Runs `f` with the directory the object is written to for the `device`
+/// to be updated in the `read_only` way. The directory `dir`, relative to
+/// it, is created when the object is written aside of the target, taking
+/// the permissions and ownership of the target directories.
+pub(crate) fn write_map<F, T>(
+    device: &Path,
+    fs: Filesystem,
+    options: &str,
+    read_only: Option<ReadOnly>,
+    dir: &Path,
+    f: F,
+) -> Result<T>
+where
+    F: FnOnce(&Path) -> T,
+{
+    match read_only {
+        None => super::fs::mount_map(device, fs, options, f),
+        Some(ReadOnly::Remount) => {
+            let mount = match mount_of(device)? {
+                Some(mount) => mount,
+                // The target isn't in use, so it is mounted as usual.
+                None => return super::fs::mount_map(device, fs, options, f),
+            };
+            if !mount.read_only {
+                return Ok(f(&mount.mount_point));
+            }
+
+            info!("remounting {:?} read-write", mount.mount_point);
+            remount(&mount.mount_point, false)?;
+            let res = f(&mount.mount_point);
+            info!("remounting {:?} read-only", mount.mount_point);
+            remount(&mount.mount_point, true)?;
+            Ok(res)
+        }
+        Some(ReadOnly::UpperDir) => {
+            let mount = mount_of(device)?.ok_or(Error::DeviceNotMounted)?;
+            let upper = upper_dir(device)?;
+            mirror_dirs(&mount.mount_point, &upper, dir)?;
+            Ok(f(&upper))
+        }
+        Some(ReadOnly::Pending) => {
+            let staging = pending_path(device);
+            fs::create_dir_all(&staging)?;
+            if let Some(mount) = mount_of(device)? {
+                mirror_dirs(&mount.mount_point, &staging, dir)?;
+            } else {
+                fs::create_dir_all(staging.join(dir))?;
+            }
+            Ok(f(&staging))
+        }
+    }
+}
+
+/// Applies the objects staged in the pending directory to their targets,
+/// which are remounted read-write meanwhile, as the device has rebooted
+/// since they have been installed.
+pub(crate) fn apply_pending(dir: &Path) -> Result<()> {
+    let entries = match fs::read_dir(dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(()),
+        Err(e) => return Err(e.into()),
+    };
+
+    for entry in entries {
+        let staging = entry?.path();
+        let device = match staging.file_name().map(|name| unescape_device(&name.to_string_lossy()))
+        {
+            Some(device) => device,
+            None => continue,
+        };
+        let mount = match mount_of(&device)? {
+            Some(mount) => mount,
+            None => {
+                warn!("{:?} isn't mounted, keeping its pending objects", device);
+                continue;
+            }
+        };
+
+        info!("applying the pending objects of {:?} to {:?}", device, mount.mount_point);
+        if mount.read_only {
+            remount(&mount.mount_point, false)?;
+        }
+        // The ownership and permissions of the staged files are kept.
+        let res = easy_process::run(&format!(
+            "cp -a {}/. {}",
+            staging.display(),
+            mount.mount_point.display()
+        ));
+        nix::unistd::sync();
+        if mount.read_only {
+            remount(&mount.mount_point, true)?;
+        }
+        match res {
+            Ok(_) => fs::remove_dir_all(&staging)?,
+            Err(e) => error!("failed to apply the pending objects of {:?}: {}", device, e),
+        }
+    }
+
+    Ok(())
+}
+
+/// Drops the objects staged in the pending directory, as the install
+/// they are part of has been reverted.
+pub(crate) fn drop_pending(dir: &Path) -> Result<()> {
+    match fs::remove_dir_all(dir) {
+        Err(e) if e.kind() != std::io::ErrorKind::NotFound => Err(e.into()),
+        _ => Ok(()),
+    }
+}
+
+fn remount(mount_point: &Path, read_only: bool) -> Result<()> {
+    let mut flags = MsFlags::MS_REMOUNT;
+    if read_only {
+        flags |= MsFlags::MS_RDONLY;
+    }
+    nix::mount::mount(None::<&str>, mount_point, None::<&str>, flags, None::<&str>)?;
+    Ok(())
+}
+
+// The objects are staged in a directory named after their device, as
+// `dev!mmcblk0p2`, the tree of the target being reproduced in it.
+fn pending_path(device: &Path) -> PathBuf {
+    let name = device.to_string_lossy().trim_start_matches('/').replace('/', "!");
+    PENDING_DIR.read().unwrap().join(name)
+}
+
+fn unescape_device(name: &str) -> PathBuf {
+    Path::new("/").join(name.replace('!', "/"))
+}
+
+// The whole filesystem of the device is mounted, not only a directory of
+// it bound somewhere else.
+fn mount_of(device: &Path) -> Result<Option<MountInfo>> {
+    let rdev = fs::metadata(device)?.rdev();
+    let rdev = (nix::sys::stat::major(rdev), nix::sys::stat::minor(rdev));
+    Ok(mounts()?.into_iter().find(|m| m.device == rdev && m.root == Path::new("/")))
+}
+
+// The upper directory of the overlay whose lower directories include the
+// mount point of the `device`. Written while the overlay is mounted, the
+// changes may only be seen through it once it is mounted again.
+fn upper_dir(device: &Path) -> Result<PathBuf> {
+    let mount = mount_of(device)?.ok_or(Error::DeviceNotMounted)?;
+    mounts()?
+        .into_iter()
+        .filter(|m| m.fstype == "overlay")
+        .find_map(|m| {
+            let option = |name: &str| {
+                m.super_options.split(',').find_map(|o| {
+                    let mut kv = o.splitn(2, '=');
+                    if kv.next() == Some(name) {
+                        kv.next().map(str::to_owned)
+                    } else {
+                        None
+                    }
+                })
+            };
+            let lower = option("lowerdir")?;
+            if lower.split(':').any(|dir| Path::new(dir) == mount.mount_point) {
+                option("upperdir").map(PathBuf::from)
+            } else {
+                None
+            }
+        })
+        .ok_or(Error::NoOverlay(mount.mount_point))
+}
+
+// Creates `dir` under `root`, with the permissions and ownership of the
+// same directories of `target`, so they aren't changed once merged with
+// or applied to the target.
+fn mirror_dirs(target: &Path, root: &Path, dir: &Path) -> Result<()> {
+    let mut relative = PathBuf::new();
+    for component in dir.components() {
+        relative.push(component);
+        let path = root.join(&relative);
+        if path.exists() {
+            continue;
+        }
+        fs::create_dir(&path)?;
+        if let Ok(metadata) = fs::metadata(target.join(&relative)) {
+            fs::set_permissions(&path, fs::Permissions::from_mode(metadata.mode()))?;
+            nix::unistd::chown(
+                &path,
+                Some(nix::unistd::Uid::from_raw(metadata.uid())),
+                Some(nix::unistd::Gid::from_raw(metadata.gid())),
+            )?;
+        }
+    }
+    Ok(())
+}
+
+fn mounts() -> Result<Vec<MountInfo>> {
+    Ok(parse_mountinfo(&fs::read_to_string("/proc/self/mountinfo")?))
+}
+
+// Lines are as `36 35 98:0 / /mnt rw,noatime master:1 - ext4 /dev/sda1
+// rw,errors=continue`, the optional fields being ended by the `-`.
+fn parse_mountinfo(content: &str) -> Vec<MountInfo> {
+    content
+        .lines()
+        .filter_map(|line| {
+            let fields = line.split_whitespace().collect::<Vec<_>>();
+            let separator = fields.iter().position(|f| *f == "-")?;
+            let mut device = fields.get(2)?.splitn(2, ':').map(|n| n.parse::<u64>().ok());
+            Some(MountInfo {
+                device: (device.next()??, device.next()??),
+                root: PathBuf::from(unescape(fields.get(3)?)),
+                mount_point: PathBuf::from(unescape(fields.get(4)?)),
+                read_only: fields.get(5)?.split(',').any(|o| o == "ro"),
+                fstype: (*fields.get(separator + 1)?).to_owned(),
+                super_options: unescape(fields.get(separator + 3).unwrap_or(&"")),
+            })
+        })
+        .collect()
+}
+
+// The spaces, tabs, new lines and backslashes are escaped as octal.
+fn unescape(field: &str) -> String {
+    let mut unescaped = String::with_capacity(field.len());
+    let mut chars = field.chars();
+    while let Some(c) = chars.next() {
+        if c == '\\' {
+            let code = chars.by_ref().take(3).collect::<String>();
+            match u8::from_str_radix(&code, 8) {
+                Ok(byte) => unescaped.push(byte as char),
+                Err(_) => {
+                    unescaped.push(c);
+                    unescaped.push_str(&code);
+                }
+            }
+        } else {
+            unescaped.push(c);
+        }
+    }
+    unescaped
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn mountinfo() {
+        let mounts = parse_mountinfo(
+            "25 1 179:2 / /media/rfs/ro ro,relatime - ext4 /dev/mmcblk0p2 ro\n\
+             26 1 0:22 / / rw,relatime shared:1 - overlay overlay \
+             rw,lowerdir=/media/rfs/ro,upperdir=/media/rfs/rw/upper,workdir=/media/rfs/rw/work\n\
+             27 26 179:3 /data /srv/my\\040data rw - ext4 /dev/mmcblk0p3 rw\n",
+        );
+        assert_eq!(mounts.len(), 3);
+        assert_eq!(
+            mounts[0],
+            MountInfo {
+                device: (179, 2),
+                root: PathBuf::from("/"),
+                mount_point: PathBuf::from("/media/rfs/ro"),
+                read_only: true,
+                fstype: "ext4".to_owned(),
+                super_options: "ro".to_owned(),
+            }
+        );
+        assert_eq!(mounts[1].fstype, "overlay");
+        assert!(!mounts[1].read_only);
+        assert_eq!(mounts[2].mount_point, PathBuf::from("/srv/my data"));
+    }
+
+    #[test]
+    fn pending_devices() {
+        let staging = pending_path(Path::new("/dev/mmcblk0p2"));
+        assert_eq!(staging.file_name().unwrap(), "dev!mmcblk0p2");
+        assert_eq!(
+            unescape_device(&staging.file_name().unwrap().to_string_lossy()),
+            PathBuf::from("/dev/mmcblk0p2")
+        );
+    }
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use cloud::api::ResourceUsage;
+use lazy_static::lazy_static;
+use slog_scope::{debug, warn};
+use std::{fs, io, path::Path, sync::Mutex};
+
+#[derive(Clone, Copy, Debug)]
+struct Counters {
+    cpu_time: u64,
+    bytes_written: u64,
+}
+
+lazy_static! {
+    // Counters taken when the current update has started.
+    static ref BASELINE: Mutex<Option<Counters>> = Mutex::new(None);
+}
+
+/// Starts measuring the resources used by the agent for a new update.
+pub(crate) fn start() {
+    // Resets the peak RSS, so the previous updates aren't accounted. It is
+    // supported as of Linux 4.0.
+    if let Err(e) = fs::write("/proc/self/clear_refs", "5") {
+        debug!("unable to reset the peak rss: {}", e);
+    }
+
+    match counters() {
+        Ok(counters) => *BASELINE.lock().expect("resource usage lock is poisoned") = Some(counters),
+        Err(e) => warn!("failed to measure the resource usage: {}", e),
+    }
+}
+
+/// Resources used since the current update has started, if any.
+pub(crate) fn current() -> Option<ResourceUsage> {
+    let baseline = (*BASELINE.lock().expect("resource usage lock is poisoned"))?;
+    match counters().and_then(|counters| Ok((counters, peak_rss()?))) {
+        Ok((counters, peak_rss)) => Some(ResourceUsage {
+            peak_rss,
+            cpu_time: counters.cpu_time.saturating_sub(baseline.cpu_time),
+            bytes_written: counters.bytes_written.saturating_sub(baseline.bytes_written),
+        }),
+        Err(e) => {
+            warn!("failed to measure the resource usage: {}", e);
+            None
+        }
+    }
+}
+
+fn counters() -> io::Result<Counters> {
+    let mut usage = unsafe { std::mem::zeroed::<libc::rusage>() };
+    if unsafe { libc::getrusage(libc::RUSAGE_SELF, &mut usage) } != 0 {
+        return Err(io::Error::last_os_error());
+    }
+
+    let millis = |t: libc::timeval| t.tv_sec as u64 * 1000 + t.tv_usec as u64 / 1000;
+    Ok(Counters {
+        cpu_time: millis(usage.ru_utime) + millis(usage.ru_stime),
+        bytes_written: proc_field(Path::new("/proc/self/io"), "write_bytes")?,
+    })
+}
+
+fn peak_rss() -> io::Result<u64> {
+    // The value is given in kB.
+    Ok(proc_field(Path::new("/proc/self/status"), "VmHWM")? * 1024)
+}
+
+// Parses the first number of the `key` line of the `/proc` file, as in
+// `VmHWM:     1024 kB`.
+fn proc_field(path: &Path, key: &str) -> io::Result<u64> {
+    fs::read_to_string(path)?
+        .lines()
+        .filter_map(|line| {
+            let mut parts = line.splitn(2, ':');
+            match (parts.next(), parts.next()) {
+                (Some(k), Some(value)) if k == key => value.split_whitespace().next(),
+                _ => None,
+            }
+        })
+        .next()
+        .and_then(|value| value.parse().ok())
+        .ok_or_else(|| {
+            io::Error::new(io::ErrorKind::InvalidData, format!("{} not found in {:?}", key, path))
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_proc_field() {
+        let dir = tempfile::tempdir().unwrap();
+        let status = dir.path().join("status");
+        fs::write(&status, "Name:\tupdatehub\nVmHWM:\t    2048 kB\n").unwrap();
+
+        assert_eq!(proc_field(&status, "VmHWM").unwrap(), 2048);
+        assert!(proc_field(&status, "VmRSS").is_err());
+    }
+
+    #[test]
+    fn measure_usage() {
+        start();
+        let usage = current().unwrap();
+        assert!(usage.peak_rss > 0);
+    }
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use sdk::api::info::settings::Retry;
+use slog_scope::warn;
+use std::{future::Future, time::Duration};
+
+/// Runs the request built by `f` up to the configured number of
+/// attempts, backing off between them, or for as long as the server has
+/// asked to. Errors which are not transient, as client errors, are
+/// returned right away.
+pub(crate) async fn with_backoff<F, Fut, T>(settings: &Retry, mut f: F) -> cloud::Result<T>
+where
+    F: FnMut() -> Fut,
+    Fut: Future<Output = cloud::Result<T>>,
+{
+    let mut attempt = 1;
+    loop {
+        match f().await {
+            Err(e) if attempt < settings.max_attempts && e.is_transient() => {
+                let delay = match e {
+                    cloud::Error::RetryAfter(after) => {
+                        std::cmp::max(after, delay(settings, attempt, random_factor()))
+                    }
+                    _ => delay(settings, attempt, random_factor()),
+                };
+                warn!(
+                    "request failed, retrying in {:?} ({}/{}): {}",
+                    delay, attempt, settings.max_attempts, e
+                );
+                super::boottime::sleep(delay).await;
+                attempt += 1;
+            }
+            res => return res,
+        }
+    }
+}
+
+// Delay before the attempt following `attempt`, where `factor` is a value
+// from -1 to 1 used to apply the jitter.
+fn delay(settings: &Retry, attempt: u32, factor: f64) -> Duration {
+    let base = settings.backoff_base.to_std().unwrap_or_default();
+    let ceiling = settings.backoff_ceiling.to_std().unwrap_or_default();
+    let delay = std::cmp::min(base * 2u32.saturating_pow(attempt - 1), ceiling);
+    let jitter = settings.jitter.max(0.0).min(1.0) * factor;
+
+    delay.mul_f64(1.0 + jitter)
+}
+
+/// Random value from -1 to 1, used to apply the jitter.
+pub(crate) fn random_factor() -> f64 {
+    let mut buf = [0; 4];
+    match openssl::rand::rand_bytes(&mut buf) {
+        Ok(()) => f64::from(u32::from_le_bytes(buf)) / f64::from(u32::MAX) * 2.0 - 1.0,
+        Err(_) => 0.0,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use std::cell::Cell;
+
+    fn settings(max_attempts: u32) -> Retry {
+        Retry {
+            max_attempts,
+            backoff_base: chrono::Duration::milliseconds(1),
+            backoff_ceiling: chrono::Duration::milliseconds(4),
+            jitter: 0.5,
+        }
+    }
+
+    #[test]
+    fn exponential_delay() {
+        let settings = settings(5);
+        assert_eq!(delay(&settings, 1, 0.0), Duration::from_millis(1));
+        assert_eq!(delay(&settings, 2, 0.0), Duration::from_millis(2));
+        assert_eq!(delay(&settings, 5, 0.0), Duration::from_millis(4));
+        assert_eq!(delay(&settings, 2, 1.0), Duration::from_millis(3));
+        assert_eq!(delay(&settings, 2, -1.0), Duration::from_millis(1));
+    }
+
+    #[actix_rt::test]
+    async fn retry_transient_errors() {
+        let attempts = &Cell::new(0);
+        let res = with_backoff(&settings(3), || async move {
+            attempts.set(attempts.get() + 1);
+            Err::<(), _>(cloud::Error::InvalidStatusResponse(
+                awc::http::StatusCode::SERVICE_UNAVAILABLE,
+            ))
+        })
+        .await;
+        assert!(res.is_err());
+        assert_eq!(attempts.get(), 3);
+    }
+
+    #[actix_rt::test]
+    async fn client_errors_are_not_retried() {
+        let attempts = &Cell::new(0);
+        let res = with_backoff(&settings(3), || async move {
+            attempts.set(attempts.get() + 1);
+            Err::<(), _>(cloud::Error::InvalidStatusResponse(awc::http::StatusCode::NOT_FOUND))
+        })
+        .await;
+        assert!(res.is_err());
+        assert_eq!(attempts.get(), 1);
+    }
+
+    #[actix_rt::test]
+    async fn retry_after_requested_delay() {
+        let attempts = &Cell::new(0);
+        let started = std::time::Instant::now();
+        let res = with_backoff(&settings(2), || async move {
+            attempts.set(attempts.get() + 1);
+            Err::<(), _>(cloud::Error::RetryAfter(Duration::from_millis(50)))
+        })
+        .await;
+        assert!(res.is_err());
+        assert_eq!(attempts.get(), 2);
+        assert!(started.elapsed() >= Duration::from_millis(50));
+    }
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use chrono::{DateTime, Utc};
+use sdk::api::info::settings::RtcWake;
+use slog_scope::info;
+
+/// Programs the RTC wake alarm so the device is powered on in time for
+/// the next probe, powering it off when configured to. Nothing is done
+/// if the wake alarm is disabled.
+pub(crate) fn schedule_wakeup(settings: &RtcWake, wake_at: DateTime<Utc>) -> Result<()> {
+    if !settings.enabled {
+        return Ok(());
+    }
+
+    let mode = if settings.power_off {
+        info!("powering off until {}", wake_at);
+        "off"
+    } else {
+        info!("programming wake alarm to {}", wake_at);
+        "no"
+    };
+
+    easy_process::run(&format!(
+        "rtcwake -d {} -m {} -t {}",
+        settings.device,
+        mode,
+        wake_at.timestamp()
+    ))?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use chrono::TimeZone;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn power_off_until_wakeup() {
+        let (_handle, calls) = create_echo_bins(&["rtcwake"]).unwrap();
+        let settings = RtcWake { enabled: true, device: "rtc1".to_string(), power_off: true };
+
+        schedule_wakeup(&RtcWake::default(), Utc.timestamp(1_600_000_000, 0)).unwrap();
+        schedule_wakeup(&settings, Utc.timestamp(1_600_000_000, 0)).unwrap();
+        assert_eq!(
+            std::fs::read_to_string(calls).unwrap(),
+            "rtcwake -d rtc1 -m off -t 1600000000\n"
+        );
+    }
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{notifier::Notifier, Result};
+use sdk::api::info::settings::StatusIndicator;
+use slog_scope::debug;
+use std::{
+    fs,
+    path::{Path, PathBuf},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc,
+    },
+    thread,
+    time::Duration,
+};
+
+/// Pattern shown to indicate the agent's state.
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Pattern {
+    Off,
+    SlowBlink,
+    FastBlink,
+    Solid,
+}
+
+impl Pattern {
+    fn for_state(name: &str) -> Self {
+        match name {
+            "prepare_download" | "download" | "direct_download" => Pattern::SlowBlink,
+            "prepare_local_install" | "install" => Pattern::FastBlink,
+            "error" => Pattern::Solid,
+            _ => Pattern::Off,
+        }
+    }
+
+    // The on and off delays, in milliseconds, of blinking patterns.
+    fn delays(self) -> Option<(u64, u64)> {
+        match self {
+            Pattern::SlowBlink => Some((500, 500)),
+            Pattern::FastBlink => Some((100, 100)),
+            Pattern::Off | Pattern::Solid => None,
+        }
+    }
+}
+
+/// Drives a LED or a GPIO line, through sysfs, to give visual feedback
+/// on headless devices.
+pub(crate) struct Indicator {
+    output: Output,
+    pattern: Pattern,
+}
+
+enum Output {
+    /// LED class device, which blinks using the kernel timer trigger.
+    Led(PathBuf),
+    /// GPIO line value, which blinks from a thread toggling it.
+    Gpio { value: PathBuf, blinker: Option<Blinker> },
+}
+
+struct Blinker {
+    stop: Arc<AtomicBool>,
+    handle: thread::JoinHandle<()>,
+}
+
+impl Indicator {
+    pub(crate) fn new(settings: &StatusIndicator) -> Result<Option<Self>> {
+        Self::with_sysfs(Path::new("/sys/class"), settings)
+    }
+
+    fn with_sysfs(sysfs: &Path, settings: &StatusIndicator) -> Result<Option<Self>> {
+        let output = if let Some(ref led) = settings.led {
+            Output::Led(sysfs.join("leds").join(led))
+        } else if let Some(gpio) = settings.gpio {
+            let line = sysfs.join("gpio").join(format!("gpio{}", gpio));
+            if !line.exists() {
+                debug!("exporting gpio {} for status indication", gpio);
+                fs::write(sysfs.join("gpio/export"), gpio.to_string())?;
+            }
+            fs::write(line.join("direction"), "out")?;
+            Output::Gpio { value: line.join("value"), blinker: None }
+        } else {
+            return Ok(None);
+        };
+
+        let mut indicator = Indicator { output, pattern: Pattern::Solid };
+        indicator.set(Pattern::Off)?;
+        Ok(Some(indicator))
+    }
+
+    fn set(&mut self, pattern: Pattern) -> Result<()> {
+        if self.pattern == pattern {
+            return Ok(());
+        }
+        debug!("setting status indicator to {:?}", pattern);
+
+        match self.output {
+            Output::Led(ref led) => match pattern.delays() {
+                Some((on, off)) => {
+                    fs::write(led.join("trigger"), "timer")?;
+                    fs::write(led.join("delay_on"), on.to_string())?;
+                    fs::write(led.join("delay_off"), off.to_string())?;
+                }
+                None => {
+                    fs::write(led.join("trigger"), "none")?;
+                    let brightness = match pattern {
+                        Pattern::Solid => fs::read_to_string(led.join("max_brightness"))?,
+                        _ => "0".to_owned(),
+                    };
+                    fs::write(led.join("brightness"), brightness.trim())?;
+                }
+            },
+            Output::Gpio { ref value, ref mut blinker } => {
+                if let Some(blinker) = blinker.take() {
+                    blinker.stop();
+                }
+
+                match pattern.delays() {
+                    Some((on, off)) => *blinker = Some(Blinker::start(value.clone(), on, off)),
+                    None => fs::write(value, if pattern == Pattern::Solid { "1" } else { "0" })?,
+                }
+            }
+        }
+
+        self.pattern = pattern;
+        Ok(())
+    }
+}
+
+impl Notifier for Indicator {
+    fn notify(&mut self, state: &str) -> Result<()> {
+        self.set(Pattern::for_state(state))
+    }
+}
+
+impl Drop for Indicator {
+    fn drop(&mut self) {
+        if let Output::Gpio { blinker: Some(_), .. } = self.output {
+            let _ = self.set(Pattern::Off);
+        }
+    }
+}
+
+impl Blinker {
+    fn start(value: PathBuf, on: u64, off: u64) -> Self {
+        let stop = Arc::new(AtomicBool::new(false));
+        let handle = {
+            let stop = stop.clone();
+            thread::spawn(move || {
+                while !stop.load(Ordering::Relaxed) {
+                    let _ = fs::write(&value, "1");
+                    thread::sleep(Duration::from_millis(on));
+                    let _ = fs::write(&value, "0");
+                    thread::sleep(Duration::from_millis(off));
+                }
+            })
+        };
+
+        Blinker { stop, handle }
+    }
+
+    fn stop(self) {
+        self.stop.store(true, Ordering::Relaxed);
+        let _ = self.handle.join();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn led_patterns() {
+        let sysfs = tempfile::tempdir().unwrap();
+        let led = sysfs.path().join("leds/status");
+        fs::create_dir_all(&led).unwrap();
+        fs::write(led.join("max_brightness"), "255\n").unwrap();
+
+        let settings = StatusIndicator { led: Some("status".to_string()), gpio: None };
+        let mut indicator = Indicator::with_sysfs(sysfs.path(), &settings).unwrap().unwrap();
+        assert_eq!(fs::read_to_string(led.join("brightness")).unwrap(), "0");
+
+        indicator.set(Pattern::for_state("download")).unwrap();
+        assert_eq!(fs::read_to_string(led.join("trigger")).unwrap(), "timer");
+        assert_eq!(fs::read_to_string(led.join("delay_on")).unwrap(), "500");
+
+        indicator.set(Pattern::for_state("error")).unwrap();
+        assert_eq!(fs::read_to_string(led.join("trigger")).unwrap(), "none");
+        assert_eq!(fs::read_to_string(led.join("brightness")).unwrap(), "255");
+    }
+
+    #[test]
+    fn gpio_solid() {
+        let sysfs = tempfile::tempdir().unwrap();
+        let line = sysfs.path().join("gpio/gpio17");
+        fs::create_dir_all(&line).unwrap();
+
+        let settings = StatusIndicator { led: None, gpio: Some(17) };
+        let mut indicator = Indicator::with_sysfs(sysfs.path(), &settings).unwrap().unwrap();
+        assert_eq!(fs::read_to_string(line.join("direction")).unwrap(), "out");
+
+        indicator.set(Pattern::Solid).unwrap();
+        assert_eq!(fs::read_to_string(line.join("value")).unwrap(), "1");
+    }
+
+    #[test]
+    fn disabled_without_output() {
+        assert!(Indicator::new(&StatusIndicator::default()).unwrap().is_none());
+    }
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::Result;
+use slog_scope::{debug, warn};
+use std::{
+    path::{Path, PathBuf},
+    process::{Child, Command, Stdio},
+};
+
+/// Keeps the system from suspending while it is held. The lock is
+/// released when dropped.
+pub(crate) enum SuspendInhibitor {
+    /// systemd-logind inhibitor lock, held for as long as the
+    /// `systemd-inhibit` process is running.
+    Logind(Child),
+    /// Custom hook called with `acquire` and `release` arguments.
+    Hook(PathBuf),
+}
+
+impl SuspendInhibitor {
+    pub(crate) fn acquire(hook: Option<&Path>) -> Result<Self> {
+        match hook {
+            Some(hook) => {
+                debug!("inhibiting system suspend using {:?} hook", hook);
+                easy_process::run(&format!("{} acquire", hook.display()))?;
+                Ok(SuspendInhibitor::Hook(hook.to_owned()))
+            }
+            None => {
+                debug!("inhibiting system suspend using systemd-logind");
+                super::fs::is_executable_in_path("systemd-inhibit")?;
+
+                // The lock is held while `cat` is running, so closing its
+                // stdin is enough to release it.
+                let child = Command::new("systemd-inhibit")
+                    .args(&[
+                        "--what=sleep",
+                        "--who=updatehub",
+                        "--why=Update in progress",
+                        "--mode=block",
+                        "cat",
+                    ])
+                    .stdin(Stdio::piped())
+                    .stdout(Stdio::null())
+                    .spawn()?;
+                Ok(SuspendInhibitor::Logind(child))
+            }
+        }
+    }
+}
+
+impl Drop for SuspendInhibitor {
+    fn drop(&mut self) {
+        debug!("releasing system suspend inhibitor");
+        match self {
+            SuspendInhibitor::Logind(child) => {
+                drop(child.stdin.take());
+                if let Err(e) = child.wait() {
+                    warn!("failed to release systemd-logind inhibitor lock: {}", e);
+                }
+            }
+            SuspendInhibitor::Hook(hook) => {
+                if let Err(e) = easy_process::run(&format!("{} release", hook.display())) {
+                    warn!("failed to run suspend inhibitor hook: {}", e);
+                }
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::object::installer::tests::create_echo_bins;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn hook_is_called_on_acquire_and_release() {
+        let (handle, calls) = create_echo_bins(&["inhibit-hook"]).unwrap();
+        let hook = handle.path().join("inhibit-hook");
+
+        let inhibitor = SuspendInhibitor::acquire(Some(&hook)).unwrap();
+        assert_eq!(std::fs::read_to_string(&calls).unwrap(), "inhibit-hook acquire\n");
+
+        drop(inhibitor);
+        assert_eq!(
+            std::fs::read_to_string(&calls).unwrap(),
+            "inhibit-hook acquire\ninhibit-hook release\n"
+        );
+    }
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! Integration with systemd services of `Type=notify`. The agent tells
+//! systemd when it is ready, which state it is in and, when the service
+//! has a watchdog, that it is still alive.
+
+use super::{notifier::Notifier, Result};
+use nix::{
+    sys::socket::{self, AddressFamily, MsgFlags, SockAddr, SockFlag, SockType, UnixAddr},
+    unistd,
+};
+use slog_scope::{debug, warn};
+use std::{env, ffi::OsString, os::unix::ffi::OsStrExt, time::Duration};
+
+/// Sends the `message`, as `READY=1`, to systemd. Nothing is done when
+/// the agent isn't run by it as a notify service.
+pub(crate) fn notify(message: &str) -> Result<()> {
+    match env::var_os("NOTIFY_SOCKET") {
+        Some(path) => send(&path, message),
+        None => Ok(()),
+    }
+}
+
+/// Tells systemd the agent has been initialized, so the units ordered
+/// after it are started.
+pub(crate) fn ready() {
+    if let Err(e) = notify("READY=1") {
+        warn!("failed to notify systemd of the agent readiness: {}", e);
+    }
+}
+
+/// Interval the watchdog must be pet at, when the service has one set
+/// for the agent.
+pub(crate) fn watchdog_interval() -> Option<Duration> {
+    watchdog_interval_from(
+        env::var("WATCHDOG_USEC").ok().as_deref(),
+        env::var("WATCHDOG_PID").ok().as_deref(),
+        unistd::getpid().as_raw(),
+    )
+}
+
+/// Pets the watchdog.
+pub(crate) fn pet_watchdog() {
+    if let Err(e) = notify("WATCHDOG=1") {
+        warn!("failed to pet the systemd watchdog: {}", e);
+    }
+}
+
+/// Pets the watchdog at half its `interval`, so a missed deadline is
+/// only caused by the agent being stuck. It runs on the agent's runtime,
+/// so it stops being pet as soon as the runtime is blocked.
+pub(crate) async fn watchdog(interval: Duration) {
+    debug!("petting the systemd watchdog every {:?}", interval / 2);
+    loop {
+        pet_watchdog();
+        super::boottime::sleep(interval / 2).await;
+    }
+}
+
+/// Reports the agent state as the service status.
+pub(crate) struct Status;
+
+impl Notifier for Status {
+    fn notify(&mut self, state: &str) -> Result<()> {
+        notify(&format!("STATUS={}", state))
+    }
+}
+
+fn watchdog_interval_from(usec: Option<&str>, pid: Option<&str>, own: i32) -> Option<Duration> {
+    // The watchdog may be meant for another process of the service.
+    if pid.map_or(false, |pid| pid.parse::<i32>().ok() != Some(own)) {
+        return None;
+    }
+    usec.and_then(|usec| usec.parse::<u64>().ok())
+        .filter(|usec| *usec > 0)
+        .map(Duration::from_micros)
+}
+
+// Socket paths starting with '@' are in the abstract namespace.
+fn send(path: &OsString, message: &str) -> Result<()> {
+    let path = path.as_bytes();
+    let addr = match path.split_first() {
+        Some((b'@', name)) => UnixAddr::new_abstract(name)?,
+        _ => UnixAddr::new(path)?,
+    };
+
+    let fd = socket::socket(AddressFamily::Unix, SockType::Datagram, SockFlag::SOCK_CLOEXEC, None)?;
+    let res = socket::sendto(fd, message.as_bytes(), &SockAddr::Unix(addr), MsgFlags::empty());
+    let _ = unistd::close(fd);
+    res?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+    use std::os::unix::net::UnixDatagram;
+
+    #[test]
+    fn watchdog_interval_for_the_agent() {
+        assert_eq!(
+            watchdog_interval_from(Some("30000000"), None, 10),
+            Some(Duration::from_secs(30))
+        );
+        assert_eq!(
+            watchdog_interval_from(Some("30000000"), Some("10"), 10),
+            Some(Duration::from_secs(30))
+        );
+        assert_eq!(watchdog_interval_from(Some("30000000"), Some("11"), 10), None);
+        assert_eq!(watchdog_interval_from(Some("0"), None, 10), None);
+        assert_eq!(watchdog_interval_from(None, None, 10), None);
+    }
+
+    #[test]
+    fn send_to_socket() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("notify");
+        let socket = UnixDatagram::bind(&path).unwrap();
+
+        send(&path.into_os_string(), "STATUS=idle").unwrap();
+
+        let mut buf = [0; 64];
+        let len = socket.recv(&mut buf).unwrap();
+        assert_eq!(&buf[..len], b"STATUS=idle");
+    }
+}
@@ -0,0 +1,296 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{definitions::TargetTypeExt, Result};
+use nix::fcntl::{flock, FlockArg};
+use pkg_schema::definitions::{Erase, TargetType};
+use slog_scope::debug;
+use std::{
+    fs::{self, File, OpenOptions},
+    os::unix::{fs::FileTypeExt, io::AsRawFd},
+    path::{Path, PathBuf},
+};
+
+// Discarded ranges are aligned to it, a multiple of the sector size.
+const DISCARD_ALIGNMENT: u64 = 4096;
+
+/// Where an object is written into. It hides the kind of the target from
+/// the install modes, so they don't need to handle each one of them.
+pub(crate) trait Target {
+    /// Path of the target, as given to the external tools.
+    fn path(&self) -> &Path;
+
+    /// Size of the target, in bytes.
+    fn size(&self) -> Result<u64>;
+
+    /// Erases the target content, so it can be written from scratch.
+    fn discard(&self) -> Result<()>;
+
+    /// Prepares the `len` bytes from `offset` to be written over, so the
+    /// target doesn't keep their previous content around.
+    fn reserve(&self, _file: &File, _offset: u64, _len: u64) -> Result<()> {
+        Ok(())
+    }
+
+    /// Erases the `len` bytes from `offset` with the `method`, before the
+    /// object is written over them. The targets which can't be erased are
+    /// written over as they are.
+    fn erase(&self, _file: &File, _offset: u64, _len: u64, method: Erase) -> Result<()> {
+        debug!("{:?} doesn't support {:?} erasing", self.path(), method);
+        Ok(())
+    }
+
+    /// Opens the target for reading and writing.
+    fn open(&self) -> Result<File> {
+        Ok(OpenOptions::new().read(true).write(true).open(self.path())?)
+    }
+
+    /// Flushes the data written to `file` down to the target.
+    fn sync(&self, file: &File) -> Result<()> {
+        Ok(file.sync_all()?)
+    }
+
+    /// Keeps other processes from writing to the target, until the
+    /// returned lock is dropped.
+    fn lock(&self) -> Result<Lock> {
+        let file = File::open(self.path())?;
+        flock(file.as_raw_fd(), FlockArg::LockExclusiveNonblock)?;
+        Ok(Lock(file))
+    }
+}
+
+/// Exclusive lock of a target, released once dropped.
+pub(crate) struct Lock(File);
+
+/// Gets the target backend of the `target_type`.
+pub(crate) fn from_type(target_type: &TargetType) -> Result<Box<dyn Target>> {
+    let path = target_type.get_target()?;
+    Ok(match target_type {
+        TargetType::MTDName(_) => Box::new(MtdDevice(path)),
+        TargetType::UBIVolume(_) => Box::new(UbiVolume(path)),
+        TargetType::Device(_) | TargetType::LVMVolume(_) => from_path(path)?,
+    })
+}
+
+fn from_path(path: PathBuf) -> Result<Box<dyn Target>> {
+    let file_type = path.metadata()?.file_type();
+    let name = path.file_name().and_then(|n| n.to_str()).unwrap_or_default().to_owned();
+    Ok(if file_type.is_block_device() {
+        match sys_block(&path).map(|sys| sys.join("loop/backing_file")) {
+            Some(backing_file) if backing_file.exists() => {
+                let backing_file = fs::read_to_string(backing_file)?.trim().into();
+                Box::new(LoopDevice { path, backing_file })
+            }
+            _ => Box::new(BlockDevice(path)),
+        }
+    } else if file_type.is_char_device() && name.starts_with("mtd") {
+        Box::new(MtdDevice(path))
+    } else if file_type.is_char_device() && name.starts_with("ubi") {
+        Box::new(UbiVolume(path))
+    } else {
+        Box::new(RegularFile(path))
+    })
+}
+
+// Sysfs directory of the block device.
+fn sys_block(device: &Path) -> Option<PathBuf> {
+    let device = device.canonicalize().ok()?;
+    Some(Path::new("/sys/class/block").join(device.file_name()?))
+}
+
+// Reads a number from a sysfs attribute.
+fn sys_attr(path: &Path) -> Result<u64> {
+    fs::read_to_string(path)?.trim().parse().map_err(|_| {
+        std::io::Error::new(std::io::ErrorKind::InvalidData, format!("invalid {:?}", path)).into()
+    })
+}
+
+pub(crate) struct BlockDevice(PathBuf);
+
+impl Target for BlockDevice {
+    fn path(&self) -> &Path {
+        &self.0
+    }
+
+    fn size(&self) -> Result<u64> {
+        let mut size = 0;
+        unsafe { ffi::blk_getsize64(File::open(&self.0)?.as_raw_fd(), &mut size)? };
+        Ok(size)
+    }
+
+    fn discard(&self) -> Result<()> {
+        let size = self.size()?;
+        discard_range(&self.0, &self.open()?, 0, size)
+    }
+
+    fn reserve(&self, file: &File, offset: u64, len: u64) -> Result<()> {
+        self.erase(file, offset, len, Erase::Discard)
+    }
+
+    // Only the whole sectors within the range are erased, the others are
+    // written over by the object anyway.
+    fn erase(&self, file: &File, offset: u64, len: u64, method: Erase) -> Result<()> {
+        let start = (offset + DISCARD_ALIGNMENT - 1) / DISCARD_ALIGNMENT * DISCARD_ALIGNMENT;
+        let end = (offset + len) / DISCARD_ALIGNMENT * DISCARD_ALIGNMENT;
+        if end <= start {
+            return Ok(());
+        }
+        match method {
+            Erase::None => Ok(()),
+            Erase::Discard => discard_range(&self.0, file, start, end - start),
+            // The kernel writes the zeroes itself when the device can't.
+            Erase::WriteZeroes => {
+                debug!("zeroing {} bytes of {:?} at {}", end - start, self.0, start);
+                unsafe { ffi::blk_zeroout(file.as_raw_fd(), &[start, end - start])? };
+                Ok(())
+            }
+        }
+    }
+}
+
+fn discard_range(path: &Path, device: &File, offset: u64, len: u64) -> Result<()> {
+    // Not all devices support discarding, and their content is going to
+    // be overwritten anyway.
+    match unsafe { ffi::blk_discard(device.as_raw_fd(), &[offset, len]) } {
+        Err(nix::Error::Sys(nix::errno::Errno::EOPNOTSUPP)) => {
+            debug!("{:?} doesn't support discard", path);
+        }
+        res => {
+            res?;
+        }
+    }
+    Ok(())
+}
+
+/// Block device backed by a regular file.
+pub(crate) struct LoopDevice {
+    path: PathBuf,
+    backing_file: PathBuf,
+}
+
+impl Target for LoopDevice {
+    fn path(&self) -> &Path {
+        &self.path
+    }
+
+    fn size(&self) -> Result<u64> {
+        BlockDevice(self.path.clone()).size()
+    }
+
+    fn discard(&self) -> Result<()> {
+        BlockDevice(self.path.clone()).discard()
+    }
+
+    fn reserve(&self, file: &File, offset: u64, len: u64) -> Result<()> {
+        BlockDevice(self.path.clone()).reserve(file, offset, len)
+    }
+
+    fn erase(&self, file: &File, offset: u64, len: u64, method: Erase) -> Result<()> {
+        BlockDevice(self.path.clone()).erase(file, offset, len, method)
+    }
+
+    fn sync(&self, file: &File) -> Result<()> {
+        file.sync_all()?;
+        // The data only reaches the storage once the backing file is
+        // synced as well.
+        match File::open(&self.backing_file) {
+            Ok(backing_file) => backing_file.sync_all()?,
+            Err(e) => debug!("unable to sync {:?}: {}", self.backing_file, e),
+        }
+        Ok(())
+    }
+}
+
+pub(crate) struct MtdDevice(PathBuf);
+
+impl Target for MtdDevice {
+    fn path(&self) -> &Path {
+        &self.0
+    }
+
+    fn size(&self) -> Result<u64> {
+        let name = self.0.file_name().unwrap_or_default();
+        sys_attr(&Path::new("/sys/class/mtd").join(name).join("size"))
+    }
+
+    fn discard(&self) -> Result<()> {
+        easy_process::run(&format!("flash_erase {:?} 0 0", self.0))?;
+        Ok(())
+    }
+}
+
+pub(crate) struct UbiVolume(PathBuf);
+
+impl Target for UbiVolume {
+    fn path(&self) -> &Path {
+        &self.0
+    }
+
+    fn size(&self) -> Result<u64> {
+        let name = self.0.file_name().unwrap_or_default();
+        sys_attr(&Path::new("/sys/class/ubi").join(name).join("data_bytes"))
+    }
+
+    fn discard(&self) -> Result<()> {
+        easy_process::run(&format!("ubiupdatevol {} -t", self.0.display()))?;
+        Ok(())
+    }
+}
+
+pub(crate) struct RegularFile(PathBuf);
+
+impl Target for RegularFile {
+    fn path(&self) -> &Path {
+        &self.0
+    }
+
+    fn size(&self) -> Result<u64> {
+        Ok(self.0.metadata()?.len())
+    }
+
+    fn discard(&self) -> Result<()> {
+        Ok(self.open()?.set_len(0)?)
+    }
+
+    fn reserve(&self, file: &File, offset: u64, len: u64) -> Result<()> {
+        super::fs::preallocate(file, offset + len)
+    }
+}
+
+mod ffi {
+    use nix::{ioctl_read_bad, ioctl_write_ptr_bad, request_code_none, request_code_read};
+
+    // From https://github.com/torvalds/linux/blob/master/include/uapi/linux/fs.h
+    // The size is always 64 bits long, despite being encoded as a size_t.
+    ioctl_write_ptr_bad!(blk_discard, request_code_none!(0x12, 119), [u64; 2]);
+    ioctl_write_ptr_bad!(blk_zeroout, request_code_none!(0x12, 127), [u64; 2]);
+    ioctl_read_bad!(
+        blk_getsize64,
+        request_code_read!(0x12, 114, std::mem::size_of::<usize>()),
+        u64
+    );
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn regular_file_target() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("image");
+        fs::write(&path, vec![0; 1024]).unwrap();
+
+        let target = from_type(&TargetType::Device(path.clone())).unwrap();
+        assert_eq!(target.path(), path);
+        assert_eq!(target.size().unwrap(), 1024);
+
+        let _lock = target.lock().unwrap();
+        assert!(target.lock().is_err());
+
+        target.discard().unwrap();
+        assert_eq!(target.size().unwrap(), 0);
+    }
+}
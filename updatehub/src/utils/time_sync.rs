@@ -0,0 +1,198 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use super::{Error, Result};
+use chrono::{DateTime, Duration, TimeZone, Utc};
+use lazy_static::lazy_static;
+use sdk::api::info::settings::TimeSync;
+use slog_scope::{debug, info, warn};
+use std::{
+    io,
+    net::{SocketAddr, UdpSocket},
+    sync::Mutex,
+    time::Instant,
+};
+
+const NTP_PORT: u16 = 123;
+const PACKET_SIZE: usize = 48;
+// Seconds from the NTP epoch, 1900, to the Unix epoch.
+const UNIX_OFFSET: i64 = 2_208_988_800;
+const QUERY_TIMEOUT: std::time::Duration = std::time::Duration::from_secs(5);
+
+lazy_static! {
+    static ref LAST_SYNC: Mutex<Option<Instant>> = Mutex::default();
+}
+
+/// Corrects the clock from the first of the configured SNTP servers
+/// which answers, when it is off by more than the allowed offset. The
+/// servers are queried at most once per sync interval, and nothing is
+/// done if none is configured.
+pub(crate) fn sync_clock(settings: &TimeSync) -> Result<()> {
+    if settings.servers.is_empty() {
+        return Ok(());
+    }
+
+    {
+        let mut last_sync = LAST_SYNC.lock().unwrap();
+        let interval = settings.interval.to_std().unwrap_or_default();
+        if last_sync.map_or(false, |last| last.elapsed() < interval) {
+            return Ok(());
+        }
+        *last_sync = Some(Instant::now());
+    }
+
+    let mut last_error = None;
+    for server in &settings.servers {
+        match query(server) {
+            Ok(offset) => {
+                debug!("clock is off by {}ms from {}", offset.num_milliseconds(), server);
+                if offset.num_milliseconds().abs() > settings.max_offset.num_milliseconds() {
+                    info!(
+                        "correcting the clock by {}ms from {}",
+                        offset.num_milliseconds(),
+                        server
+                    );
+                    set_clock(Utc::now() + offset)?;
+                }
+                return Ok(());
+            }
+            Err(e) => {
+                warn!("failed to query the time from {}: {}", server, e);
+                last_error = Some(e);
+            }
+        }
+    }
+
+    Err(last_error.unwrap_or_else(|| Error::InvalidTimeReply("no server".to_owned())))
+}
+
+// Returns how far the local clock is behind the server one, from the
+// first of its addresses which answers.
+fn query(server: &str) -> Result<Duration> {
+    let (host, port) = cloud::net::split_host_port(server, NTP_PORT)
+        .map_err(|_| io::Error::new(io::ErrorKind::InvalidInput, "invalid server port"))?;
+
+    let mut last_error = None;
+    for addr in cloud::net::resolve(host, port)? {
+        match query_address(addr) {
+            Ok(offset) => return Ok(offset),
+            Err(e) => {
+                debug!("failed to query the time from {}: {}", addr, e);
+                last_error = Some(e);
+            }
+        }
+    }
+    Err(last_error.unwrap_or_else(|| Error::InvalidTimeReply("no address".to_owned())))
+}
+
+fn query_address(addr: SocketAddr) -> Result<Duration> {
+    let socket = UdpSocket::bind(if addr.is_ipv4() { "0.0.0.0:0" } else { "[::]:0" })?;
+    socket.set_read_timeout(Some(QUERY_TIMEOUT))?;
+    socket.connect(addr)?;
+
+    // Leap indicator unset, version 4 and client mode.
+    let mut request = [0; PACKET_SIZE];
+    request[0] = 0x23;
+    let sent = Utc::now();
+    request[40..].copy_from_slice(&to_timestamp(sent));
+    socket.send(&request)?;
+
+    let mut reply = [0; PACKET_SIZE];
+    if socket.recv(&mut reply)? < PACKET_SIZE {
+        return Err(Error::InvalidTimeReply("truncated packet".to_owned()));
+    }
+    let received = Utc::now();
+    offset(&request, &reply, received)
+}
+
+fn offset(request: &[u8], reply: &[u8], received: DateTime<Utc>) -> Result<Duration> {
+    if reply[0] & 0x07 != 4 {
+        return Err(Error::InvalidTimeReply("not a server reply".to_owned()));
+    }
+    // Stratum 0 is used on the kiss-o'-death replies.
+    if reply[1] == 0 {
+        return Err(Error::InvalidTimeReply("server refused the query".to_owned()));
+    }
+    if reply[24..32] != request[40..48] {
+        return Err(Error::InvalidTimeReply("reply doesn't match the query".to_owned()));
+    }
+
+    let sent = from_timestamp(&request[40..48]);
+    let server_received = from_timestamp(&reply[32..40]);
+    let server_sent = from_timestamp(&reply[40..48]);
+    Ok(((server_received - sent) + (server_sent - received)) / 2)
+}
+
+fn to_timestamp(time: DateTime<Utc>) -> [u8; 8] {
+    let seconds = (time.timestamp() + UNIX_OFFSET) as u32;
+    let fraction = ((u64::from(time.timestamp_subsec_nanos()) << 32) / 1_000_000_000) as u32;
+    let mut timestamp = [0; 8];
+    timestamp[..4].copy_from_slice(&seconds.to_be_bytes());
+    timestamp[4..].copy_from_slice(&fraction.to_be_bytes());
+    timestamp
+}
+
+fn from_timestamp(timestamp: &[u8]) -> DateTime<Utc> {
+    let seconds = u32::from_be_bytes([timestamp[0], timestamp[1], timestamp[2], timestamp[3]]);
+    let fraction = u32::from_be_bytes([timestamp[4], timestamp[5], timestamp[6], timestamp[7]]);
+    let nanos = (u64::from(fraction) * 1_000_000_000) >> 32;
+    Utc.timestamp(i64::from(seconds) - UNIX_OFFSET, nanos as u32)
+}
+
+fn set_clock(time: DateTime<Utc>) -> Result<()> {
+    let spec = libc::timespec {
+        tv_sec: time.timestamp() as libc::time_t,
+        tv_nsec: time.timestamp_subsec_nanos() as libc::c_long,
+    };
+    if unsafe { libc::clock_settime(libc::CLOCK_REALTIME, &spec) } != 0 {
+        return Err(io::Error::last_os_error().into());
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    #[test]
+    fn query_offset() {
+        let server = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let addr = server.local_addr().unwrap();
+        std::thread::spawn(move || {
+            let mut request = [0; PACKET_SIZE];
+            let (_, client) = server.recv_from(&mut request).unwrap();
+            let now = Utc::now() + Duration::seconds(100);
+            let mut reply = [0; PACKET_SIZE];
+            reply[0] = 0x24;
+            reply[1] = 2;
+            reply[24..32].copy_from_slice(&request[40..48]);
+            reply[32..40].copy_from_slice(&to_timestamp(now));
+            reply[40..48].copy_from_slice(&to_timestamp(now));
+            server.send_to(&reply, client).unwrap();
+        });
+
+        let offset = query(&addr.to_string()).unwrap();
+        assert!((offset - Duration::seconds(100)).num_milliseconds().abs() < 1000);
+    }
+
+    #[test]
+    fn reject_invalid_reply() {
+        let request = [0x23; PACKET_SIZE];
+        let mut reply = [0; PACKET_SIZE];
+        reply[0] = 0x24;
+        reply[24..32].copy_from_slice(&request[40..48]);
+        assert!(offset(&request, &reply, Utc::now()).is_err());
+
+        reply[1] = 2;
+        reply[0] = 0x23;
+        assert!(offset(&request, &reply, Utc::now()).is_err());
+    }
+
+    #[test]
+    fn timestamp_roundtrip() {
+        let time = Utc.timestamp(1_600_000_000, 500_000_000);
+        assert_eq!(from_timestamp(&to_timestamp(time)), time);
+    }
+}
@@ -0,0 +1,346 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//! U-Boot environment, read and written as `fw_printenv` and `fw_setenv`
+//! do, from the locations given in `fw_env.config`. A redundant
+//! environment is written to the copy which isn't in use, with newer
+//! flags, so U-Boot keeps booting with the previous copy if the new one
+//! is left half written.
+
+use super::{Error, Result};
+use lazy_static::lazy_static;
+use sdk::api::info::settings::Firmware;
+use slog_scope::{debug, warn};
+use std::{
+    collections::BTreeMap,
+    fs::{self, OpenOptions},
+    io::{Read, Seek, SeekFrom, Write},
+    path::{Path, PathBuf},
+    sync::RwLock,
+};
+
+lazy_static! {
+    static ref CONFIG: RwLock<PathBuf> = RwLock::new(Firmware::default().uboot_env_config);
+}
+
+/// Sets the `fw_env.config` the environment is found by.
+pub(crate) fn configure(settings: &Firmware) {
+    *CONFIG.write().expect("poisoned U-Boot environment lock") = settings.uboot_env_config.clone();
+}
+
+/// Reads the variable `name`, which may be unset.
+pub(crate) fn get(name: &str) -> Result<Option<String>> {
+    Ok(Environment::load()?.vars.remove(name))
+}
+
+/// Sets the variable `name` to `value`, writing the environment.
+pub(crate) fn set(name: &str, value: &str) -> Result<()> {
+    let mut env = Environment::load()?;
+    env.vars.insert(name.to_owned(), value.to_owned());
+    env.save()
+}
+
+/// Where a copy of the environment is kept, as a line of `fw_env.config`.
+#[derive(Debug, PartialEq)]
+struct Location {
+    device: PathBuf,
+    offset: u64,
+    size: usize,
+    sector_size: Option<u64>,
+}
+
+impl Location {
+    fn read(&self) -> Result<Vec<u8>> {
+        let mut device = fs::File::open(&self.device)?;
+        device.seek(SeekFrom::Start(self.offset))?;
+        let mut buf = vec![0; self.size];
+        device.read_exact(&mut buf)?;
+        Ok(buf)
+    }
+
+    // The flash sectors must be erased before being written.
+    fn write(&self, data: &[u8]) -> Result<()> {
+        let is_mtd = self
+            .device
+            .file_name()
+            .map(|name| name.to_string_lossy().starts_with("mtd"))
+            .unwrap_or_default();
+        if is_mtd {
+            let length = self.sector_size.unwrap_or(self.size as u64);
+            super::mtd::erase(&self.device, self.offset, length)?;
+        }
+
+        let mut device = OpenOptions::new().write(true).open(&self.device)?;
+        device.seek(SeekFrom::Start(self.offset))?;
+        device.write_all(data)?;
+        device.sync_all()?;
+        Ok(())
+    }
+}
+
+struct Environment {
+    locations: Vec<Location>,
+    vars: BTreeMap<String, String>,
+    // Copy in use, and its flags, for the redundant environments.
+    current: usize,
+    flags: u8,
+}
+
+impl Environment {
+    fn load() -> Result<Self> {
+        let config = CONFIG.read().expect("poisoned U-Boot environment lock").clone();
+        Self::load_from(&config)
+    }
+
+    fn load_from(config: &Path) -> Result<Self> {
+        let locations = parse_config(&fs::read_to_string(config)?)?;
+        let redundant = locations.len() == 2;
+
+        let mut copies = Vec::with_capacity(locations.len());
+        for (idx, location) in locations.iter().enumerate() {
+            let copy = parse(&location.read()?, redundant);
+            if copy.is_none() {
+                warn!("U-Boot environment at {:?} has a bad CRC", location.device);
+            }
+            copies.push(copy.map(|(flags, vars)| (idx, flags, vars)));
+        }
+
+        let (current, flags, vars) = match (copies.pop(), copies.pop()) {
+            (Some(Some(b)), Some(Some(a))) if is_newer(b.1, a.1) => b,
+            (Some(_), Some(Some(a))) => a,
+            (Some(Some(b)), Some(None)) => b,
+            (Some(Some(a)), None) => a,
+            _ => return Err(Error::InvalidUbootEnvironment("no valid copy".to_owned())),
+        };
+        debug!("using U-Boot environment copy {} with flags {}", current, flags);
+
+        Ok(Environment { locations, vars, current, flags })
+    }
+
+    fn save(&mut self) -> Result<()> {
+        if self.locations.len() == 1 {
+            let location = &self.locations[0];
+            return location.write(&serialize(&self.vars, location.size, None)?);
+        }
+
+        let target = 1 - self.current;
+        let flags = self.flags.wrapping_add(1);
+        let location = &self.locations[target];
+        location.write(&serialize(&self.vars, location.size, Some(flags))?)?;
+        self.current = target;
+        self.flags = flags;
+        Ok(())
+    }
+}
+
+// Each line holds the device, the offset, the size of the environment
+// and, optionally, the size of the flash sectors and their count.
+fn parse_config(config: &str) -> Result<Vec<Location>> {
+    let mut locations = Vec::default();
+    for line in config.lines().map(str::trim) {
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+
+        let invalid = || Error::InvalidUbootEnvironment(format!("invalid config line: {}", line));
+        let fields = line.split_whitespace().collect::<Vec<_>>();
+        if fields.len() < 3 {
+            return Err(invalid());
+        }
+        locations.push(Location {
+            device: fields[0].into(),
+            offset: parse_number(fields[1]).ok_or_else(invalid)?,
+            size: parse_number(fields[2]).ok_or_else(invalid)? as usize,
+            sector_size: match fields.get(3) {
+                Some(size) => Some(parse_number(size).ok_or_else(invalid)?),
+                None => None,
+            },
+        });
+    }
+
+    if locations.is_empty() || locations.len() > 2 {
+        return Err(Error::InvalidUbootEnvironment(format!(
+            "expected one or two locations, found {}",
+            locations.len()
+        )));
+    }
+    Ok(locations)
+}
+
+fn parse_number(s: &str) -> Option<u64> {
+    if s.starts_with("0x") || s.starts_with("0X") {
+        return u64::from_str_radix(&s[2..], 16).ok();
+    }
+    s.parse().ok()
+}
+
+fn header_size(redundant: bool) -> usize {
+    if redundant {
+        5
+    } else {
+        4
+    }
+}
+
+// The CRC covers the variables, which follow the flags byte of the
+// redundant environments.
+fn parse(buf: &[u8], redundant: bool) -> Option<(u8, BTreeMap<String, String>)> {
+    let header = header_size(redundant);
+    if buf.len() <= header {
+        return None;
+    }
+    let crc = u32::from_le_bytes([buf[0], buf[1], buf[2], buf[3]]);
+    let data = &buf[header..];
+    if crc32(data) != crc {
+        return None;
+    }
+
+    let mut vars = BTreeMap::default();
+    for entry in data.split(|b| *b == 0).take_while(|entry| !entry.is_empty()) {
+        let entry = String::from_utf8_lossy(entry);
+        let mut parts = entry.splitn(2, '=');
+        if let (Some(name), Some(value)) = (parts.next(), parts.next()) {
+            vars.insert(name.to_owned(), value.to_owned());
+        }
+    }
+    Some((if redundant { buf[4] } else { 0 }, vars))
+}
+
+fn serialize(vars: &BTreeMap<String, String>, size: usize, flags: Option<u8>) -> Result<Vec<u8>> {
+    let header = header_size(flags.is_some());
+    let mut data = Vec::with_capacity(size);
+    for (name, value) in vars {
+        data.extend_from_slice(name.as_bytes());
+        data.push(b'=');
+        data.extend_from_slice(value.as_bytes());
+        data.push(0);
+    }
+    data.push(0);
+    if data.len() > size.saturating_sub(header) {
+        return Err(Error::InvalidUbootEnvironment("variables don't fit in it".to_owned()));
+    }
+    data.resize(size - header, 0);
+
+    let mut buf = crc32(&data).to_le_bytes().to_vec();
+    buf.extend(flags);
+    buf.extend(data);
+    Ok(buf)
+}
+
+// U-Boot takes the copy of greater flags, the counter wrapping around.
+fn is_newer(flags: u8, other: u8) -> bool {
+    match (flags, other) {
+        (0, 255) => true,
+        (255, 0) => false,
+        (flags, other) => flags > other,
+    }
+}
+
+fn crc32(data: &[u8]) -> u32 {
+    let mut crc = !0u32;
+    for byte in data {
+        crc ^= u32::from(*byte);
+        for _ in 0..8 {
+            crc = if crc & 1 != 0 { (crc >> 1) ^ 0xedb8_8320 } else { crc >> 1 };
+        }
+    }
+    !crc
+}
+
+#[cfg(test)]
+pub(crate) mod tests {
+    use super::*;
+    use pretty_assertions::assert_eq;
+
+    const SIZE: usize = 0x2000;
+
+    lazy_static! {
+        static ref FAKE_ENV: tempfile::TempDir = {
+            let dir = tempfile::tempdir().unwrap();
+            write_redundant_env(dir.path());
+            configure(&Firmware {
+                uboot_env_config: dir.path().join("fw_env.config"),
+                ..Firmware::default()
+            });
+            dir
+        };
+    }
+
+    /// Makes the environment a redundant one, kept in a temporary
+    /// directory, shared by all the tests.
+    pub(crate) fn fake_env() {
+        lazy_static::initialize(&FAKE_ENV);
+    }
+
+    fn write_redundant_env(dir: &Path) {
+        let mut vars = BTreeMap::default();
+        vars.insert("bootcmd".to_owned(), "run distro_bootcmd".to_owned());
+        fs::write(dir.join("env"), serialize(&vars, SIZE, Some(1)).unwrap()).unwrap();
+        fs::write(dir.join("env-redund"), vec![0xff; SIZE]).unwrap();
+        fs::write(
+            dir.join("fw_env.config"),
+            format!(
+                "# device offset size\n{0}/env 0x0 {1:#x}\n{0}/env-redund 0 {1}\n",
+                dir.display(),
+                SIZE
+            ),
+        )
+        .unwrap();
+    }
+
+    #[test]
+    fn checksum() {
+        assert_eq!(crc32(b"123456789"), 0xcbf4_3926);
+    }
+
+    #[test]
+    fn flags() {
+        assert!(is_newer(2, 1));
+        assert!(!is_newer(1, 2));
+        assert!(is_newer(0, 255));
+        assert!(!is_newer(255, 0));
+    }
+
+    #[test]
+    fn config() {
+        let locations = parse_config("/dev/mtd1 0x0 0x10000 0x20000\n").unwrap();
+        assert_eq!(
+            locations,
+            [Location {
+                device: "/dev/mtd1".into(),
+                offset: 0,
+                size: 0x10000,
+                sector_size: Some(0x20000),
+            }]
+        );
+        assert!(parse_config("# nothing\n").is_err());
+        assert!(parse_config("/dev/mmcblk0 0x4000\n").is_err());
+    }
+
+    #[test]
+    fn redundant_environment() {
+        let dir = tempfile::tempdir().unwrap();
+        write_redundant_env(dir.path());
+        let config = dir.path().join("fw_env.config");
+
+        let mut env = Environment::load_from(&config).unwrap();
+        assert_eq!((env.current, env.flags), (0, 1));
+        assert_eq!(env.vars["bootcmd"], "run distro_bootcmd");
+
+        // The copy not in use is written, and then taken
+        env.vars.insert("verity_root_hash".to_owned(), "4392712b".to_owned());
+        env.save().unwrap();
+        let env = Environment::load_from(&config).unwrap();
+        assert_eq!((env.current, env.flags), (1, 2));
+        assert_eq!(env.vars["verity_root_hash"], "4392712b");
+
+        // A half written copy leaves the previous one in use
+        let mut data = fs::read(dir.path().join("env-redund")).unwrap();
+        data[100] ^= 0xff;
+        fs::write(dir.path().join("env-redund"), data).unwrap();
+        let env = Environment::load_from(&config).unwrap();
+        assert_eq!((env.current, env.flags), (0, 1));
+        assert!(env.vars.get("verity_root_hash").is_none());
+    }
+}
@@ -0,0 +1,462 @@
+// Copyright (C) 2020 O.S. Systems Sofware LTDA
+//
+// SPDX-License-Identifier: Apache-2.0
+
+use lazy_static::lazy_static;
+use nix::{
+    fcntl::{self, PosixFadviseAdvice},
+    sys::{
+        mman::{self, MapFlags, MmapAdvise, ProtFlags},
+        socket,
+    },
+};
+use openssl::sha::Sha256;
+use slog_scope::debug;
+use std::{
+    collections::HashMap,
+    fs::{self, File},
+    io::{self, Read, Seek, SeekFrom, Write},
+    os::unix::io::{AsRawFd, FromRawFd},
+    path::{Path, PathBuf},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        mpsc, Mutex,
+    },
+    thread,
+    time::SystemTime,
+};
+use walkdir::WalkDir;
+
+/// Size of the windows the hashed files are mapped in, so the large
+/// slots don't take as much address space as their size.
+const WINDOW_SIZE: u64 = 16 * 1024 * 1024;
+
+// Buffers of the files which can't be mapped, read ahead of the hashing.
+const READ_SIZE: usize = 1024 * 1024;
+const PIPELINE_DEPTH: usize = 3;
+
+static KERNEL_HASHING: AtomicBool = AtomicBool::new(false);
+
+// Identifies the file content verified, so any change to the file drops
+// the verification.
+#[derive(Clone, Debug, PartialEq)]
+struct Stamp {
+    path: PathBuf,
+    len: u64,
+    modified: SystemTime,
+}
+
+impl Stamp {
+    fn of(path: &Path) -> io::Result<Self> {
+        let metadata = path.metadata()?;
+        Ok(Stamp { path: path.to_owned(), len: metadata.len(), modified: metadata.modified()? })
+    }
+}
+
+lazy_static! {
+    // Objects already verified, by their sha256sum.
+    static ref VERIFIED: Mutex<HashMap<String, Stamp>> = Mutex::new(HashMap::default());
+}
+
+/// Checks the file in `path` matches the `sha256sum`. The file is only
+/// hashed if it has not been verified yet or has changed since, so the
+/// retried updates don't hash the large objects again.
+pub(crate) fn verify(path: &Path, sha256sum: &str) -> io::Result<bool> {
+    let stamp = Stamp::of(path)?;
+    if VERIFIED.lock().expect("verification lock is poisoned").get(sha256sum) == Some(&stamp) {
+        debug!("{:?} has already been verified", path);
+        return Ok(true);
+    }
+
+    if sha256sum_file(path)? != sha256sum {
+        forget(sha256sum);
+        return Ok(false);
+    }
+
+    // The file could have changed while hashed, so it is only recorded
+    // if it is still the same.
+    if Stamp::of(path)? == stamp {
+        VERIFIED.lock().expect("verification lock is poisoned").insert(sha256sum.to_owned(), stamp);
+    }
+    Ok(true)
+}
+
+/// Writer hashing the data written into it, so a stream is hashed
+/// without being stored.
+pub(crate) struct HashWriter(Sha256);
+
+impl HashWriter {
+    pub(crate) fn new() -> Self {
+        HashWriter(Sha256::new())
+    }
+
+    pub(crate) fn finish(self) -> String {
+        super::hex_encode(&self.0.finish())
+    }
+}
+
+impl Write for HashWriter {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        self.0.update(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Drops the cached pages of the file in `path`, so it is read back from
+/// the storage instead of from memory.
+pub(crate) fn drop_cache(path: &Path) -> io::Result<()> {
+    let file = File::open(path)?;
+    file.sync_all()?;
+    fcntl::posix_fadvise(file.as_raw_fd(), 0, 0, PosixFadviseAdvice::POSIX_FADV_DONTNEED)
+        .map_err(|e| io::Error::new(io::ErrorKind::Other, e))?;
+    Ok(())
+}
+
+/// Compares the regular files and symlinks of the `expected` tree with
+/// the ones of the `actual` tree, returning the first one which is
+/// missing or different in it.
+pub(crate) fn compare_trees(expected: &Path, actual: &Path) -> io::Result<Option<PathBuf>> {
+    for entry in WalkDir::new(expected) {
+        let entry = entry?;
+        let relative = entry.path().strip_prefix(expected).expect("entry is inside the tree");
+        let other = actual.join(relative);
+        let file_type = entry.file_type();
+        let same = if file_type.is_file() {
+            other.is_file() && sha256sum_file(entry.path())? == sha256sum_file(&other)?
+        } else if file_type.is_symlink() {
+            fs::read_link(&other).ok() == Some(fs::read_link(entry.path())?)
+        } else {
+            continue;
+        };
+        if !same {
+            return Ok(Some(relative.to_owned()));
+        }
+    }
+    Ok(None)
+}
+
+/// Sets whether the objects are hashed through the kernel crypto API,
+/// when it is available.
+pub(crate) fn set_kernel_hashing(enabled: bool) {
+    KERNEL_HASHING.store(enabled, Ordering::Relaxed);
+}
+
+/// Hashes the file in `path`, which may be a block device. It is mapped
+/// in bounded windows, the next one being read ahead while the current
+/// one is hashed, and is only read when it can't be mapped.
+pub(crate) fn sha256sum_file(path: &Path) -> io::Result<String> {
+    let mut file = File::open(path)?;
+    // Block devices have no length in their metadata.
+    let len = file.seek(SeekFrom::End(0))?;
+    file.seek(SeekFrom::Start(0))?;
+
+    let mut hasher = Hasher::new();
+    if len == 0 || !hash_mapped(&file, len, WINDOW_SIZE, &mut hasher)? {
+        hash_read(file, None, &mut hasher)?;
+    }
+    hasher.finish()
+}
+
+/// Hashes the `size` bytes at `offset` of the file in `path`, which may
+/// be a block device, failing if the file ends before them.
+pub(crate) fn sha256sum_region(path: &Path, offset: u64, size: u64) -> io::Result<String> {
+    let mut file = File::open(path)?;
+    file.seek(SeekFrom::Start(offset))?;
+
+    let mut hasher = Hasher::new();
+    hash_read(file, Some(size), &mut hasher)?;
+    hasher.finish()
+}
+
+/// Hasher of the objects, through the kernel crypto API when enabled and
+/// available, so the hashing is offloaded to the hardware engines of the
+/// SoCs which have them.
+enum Hasher {
+    Software(Sha256),
+    Kernel(KernelHasher),
+}
+
+impl Hasher {
+    fn new() -> Self {
+        if KERNEL_HASHING.load(Ordering::Relaxed) {
+            match KernelHasher::new() {
+                Ok(hasher) => return Hasher::Kernel(hasher),
+                Err(e) => debug!("kernel crypto API is unavailable, hashing in software: {}", e),
+            }
+        }
+        Hasher::Software(Sha256::new())
+    }
+
+    fn update(&mut self, data: &[u8]) -> io::Result<()> {
+        match self {
+            Hasher::Software(hasher) => {
+                hasher.update(data);
+                Ok(())
+            }
+            Hasher::Kernel(hasher) => hasher.update(data),
+        }
+    }
+
+    fn finish(self) -> io::Result<String> {
+        let digest = match self {
+            Hasher::Software(hasher) => hasher.finish(),
+            Hasher::Kernel(hasher) => hasher.finish()?,
+        };
+        Ok(super::hex_encode(&digest))
+    }
+}
+
+/// SHA-256 of the kernel crypto API, taken through an `AF_ALG` socket.
+/// The kernel picks the implementation of highest priority, which is the
+/// hardware engine when there is one.
+struct KernelHasher(File);
+
+impl KernelHasher {
+    fn new() -> io::Result<Self> {
+        let to_io = |e: nix::Error| io::Error::new(io::ErrorKind::Other, e);
+        let socket = socket::socket(
+            socket::AddressFamily::Alg,
+            socket::SockType::SeqPacket,
+            socket::SockFlag::SOCK_CLOEXEC,
+            None,
+        )
+        .map_err(to_io)?;
+        // The socket is only needed to accept the operation from.
+        let socket = unsafe { File::from_raw_fd(socket) };
+        socket::bind(
+            socket.as_raw_fd(),
+            &socket::SockAddr::Alg(socket::AlgAddr::new("hash", "sha256")),
+        )
+        .map_err(to_io)?;
+        let op = socket::accept(socket.as_raw_fd()).map_err(to_io)?;
+        Ok(KernelHasher(unsafe { File::from_raw_fd(op) }))
+    }
+
+    // The data is told to be followed by more, so the digest is only
+    // finished once it is read.
+    fn update(&mut self, mut data: &[u8]) -> io::Result<()> {
+        while !data.is_empty() {
+            let n = socket::send(self.0.as_raw_fd(), data, socket::MsgFlags::MSG_MORE)
+                .map_err(|e| io::Error::new(io::ErrorKind::Other, e))?;
+            data = &data[n..];
+        }
+        Ok(())
+    }
+
+    fn finish(mut self) -> io::Result<[u8; 32]> {
+        let mut digest = [0; 32];
+        self.0.read_exact(&mut digest)?;
+        Ok(digest)
+    }
+}
+
+// The file is read by a thread of its own, so the next buffers are read
+// while the current one is hashed. The read ends with the file or, when
+// `size` is given, once as many bytes are read, failing if the file ends
+// before them.
+fn hash_read(mut file: File, size: Option<u64>, hasher: &mut Hasher) -> io::Result<()> {
+    let (filled_tx, filled_rx) = mpsc::sync_channel::<io::Result<(Vec<u8>, usize)>>(PIPELINE_DEPTH);
+    let (empty_tx, empty_rx) = mpsc::channel::<Vec<u8>>();
+    for _ in 0..PIPELINE_DEPTH {
+        empty_tx.send(vec![0; READ_SIZE]).expect("hashing pipeline is closed");
+    }
+
+    let reader = thread::spawn(move || {
+        let mut left = size;
+        while let Ok(mut buf) = empty_rx.recv() {
+            let res = match left {
+                Some(ref mut left) => {
+                    let n = std::cmp::min(*left, buf.len() as u64) as usize;
+                    file.read_exact(&mut buf[..n]).map(|_| {
+                        *left -= n as u64;
+                        n
+                    })
+                }
+                None => file.read(&mut buf),
+            };
+            let done = res.as_ref().map_or(true, |n| *n == 0);
+            if filled_tx.send(res.map(|n| (buf, n))).is_err() || done {
+                break;
+            }
+        }
+    });
+
+    let mut res = Ok(());
+    for chunk in filled_rx.iter() {
+        let (buf, n) = match chunk {
+            Ok((_, 0)) => break,
+            Ok(chunk) => chunk,
+            Err(e) => {
+                res = Err(e);
+                break;
+            }
+        };
+        if let Err(e) = hasher.update(&buf[..n]) {
+            res = Err(e);
+            break;
+        }
+        // The reader may be done already.
+        let _ = empty_tx.send(buf);
+    }
+
+    // Closing the channels stops the reader, if the hashing has failed.
+    drop(filled_rx);
+    drop(empty_tx);
+    reader.join().expect("hashing reader has panicked");
+    res
+}
+
+// Returns false when the file can't be mapped, as with the character
+// devices, leaving the `hasher` untouched. The `window` must be a
+// multiple of the page size.
+fn hash_mapped(file: &File, len: u64, window: u64, hasher: &mut Hasher) -> io::Result<bool> {
+    let mut offset = 0;
+    while offset < len {
+        let size = std::cmp::min(window, len - offset) as usize;
+        let addr = match unsafe {
+            mman::mmap(
+                std::ptr::null_mut(),
+                size,
+                ProtFlags::PROT_READ,
+                MapFlags::MAP_PRIVATE,
+                file.as_raw_fd(),
+                offset as libc::off_t,
+            )
+        } {
+            Ok(addr) => addr,
+            Err(_) if offset == 0 => return Ok(false),
+            Err(e) => return Err(io::Error::new(io::ErrorKind::Other, e)),
+        };
+
+        // The advices are only hints, so failing to give them is harmless.
+        // The next window is read while this one is hashed.
+        let _ = unsafe { mman::madvise(addr, size, MmapAdvise::MADV_SEQUENTIAL) };
+        let next = offset + size as u64;
+        if next < len {
+            let _ = fcntl::posix_fadvise(
+                file.as_raw_fd(),
+                next as libc::off_t,
+                std::cmp::min(window, len - next) as libc::off_t,
+                PosixFadviseAdvice::POSIX_FADV_WILLNEED,
+            );
+        }
+        let res = hasher.update(unsafe { std::slice::from_raw_parts(addr as *const u8, size) });
+        unsafe { mman::munmap(addr, size) }.map_err(|e| io::Error::new(io::ErrorKind::Other, e))?;
+        res?;
+        offset += size as u64;
+    }
+
+    Ok(true)
+}
+
+/// Drops the verification of the object, as when it is removed.
+pub(crate) fn forget(sha256sum: &str) {
+    VERIFIED.lock().expect("verification lock is poisoned").remove(sha256sum);
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn compare_file_trees() {
+        let expected = tempfile::tempdir().unwrap();
+        let actual = tempfile::tempdir().unwrap();
+        for dir in &[&expected, &actual] {
+            fs::create_dir(dir.path().join("etc")).unwrap();
+            fs::write(dir.path().join("etc/hostname"), "device").unwrap();
+            std::os::unix::fs::symlink("hostname", dir.path().join("etc/name")).unwrap();
+        }
+        fs::write(actual.path().join("extra"), "left over").unwrap();
+        assert_eq!(compare_trees(expected.path(), actual.path()).unwrap(), None);
+
+        fs::write(actual.path().join("etc/hostname"), "broken").unwrap();
+        assert_eq!(
+            compare_trees(expected.path(), actual.path()).unwrap(),
+            Some(PathBuf::from("etc/hostname"))
+        );
+    }
+
+    #[test]
+    fn invalidate_on_change() {
+        let dir = tempfile::tempdir().unwrap();
+        let object = dir.path().join("object");
+        fs::write(&object, "content").unwrap();
+        let sha256sum = crate::utils::sha256sum(b"content");
+
+        assert!(verify(&object, &sha256sum).unwrap());
+        assert!(VERIFIED.lock().unwrap().contains_key(&sha256sum));
+        assert!(verify(&object, &sha256sum).unwrap());
+
+        fs::write(&object, "changed content").unwrap();
+        assert!(!verify(&object, &sha256sum).unwrap());
+        assert!(!VERIFIED.lock().unwrap().contains_key(&sha256sum));
+    }
+
+    #[test]
+    fn hash_in_windows() {
+        let dir = tempfile::tempdir().unwrap();
+        let object = dir.path().join("object");
+        let content = (0..(5 * 1024 * 1024 / 2)).map(|i| i as u8).collect::<Vec<_>>();
+        fs::write(&object, &content).unwrap();
+
+        let file = File::open(&object).unwrap();
+        let mut hasher = Hasher::new();
+        assert!(hash_mapped(&file, content.len() as u64, 1024 * 1024, &mut hasher).unwrap());
+        assert_eq!(hasher.finish().unwrap(), crate::utils::sha256sum(&content));
+        assert_eq!(sha256sum_file(&object).unwrap(), crate::utils::sha256sum(&content));
+
+        fs::write(&object, "").unwrap();
+        assert_eq!(sha256sum_file(&object).unwrap(), crate::utils::sha256sum(b""));
+    }
+
+    #[test]
+    fn hash_region() {
+        let dir = tempfile::tempdir().unwrap();
+        let object = dir.path().join("object");
+        fs::write(&object, "headercontenttrailer").unwrap();
+
+        assert_eq!(sha256sum_region(&object, 6, 7).unwrap(), crate::utils::sha256sum(b"content"));
+        assert!(sha256sum_region(&object, 18, 7).is_err());
+    }
+
+    #[test]
+    fn pipelined_read() {
+        let dir = tempfile::tempdir().unwrap();
+        let object = dir.path().join("object");
+        let content = (0..(READ_SIZE * 4 + 17)).map(|i| (i % 251) as u8).collect::<Vec<_>>();
+        fs::write(&object, &content).unwrap();
+
+        let mut hasher = Hasher::new();
+        hash_read(File::open(&object).unwrap(), None, &mut hasher).unwrap();
+        assert_eq!(hasher.finish().unwrap(), crate::utils::sha256sum(&content));
+
+        let mut hasher = Hasher::new();
+        let region = (READ_SIZE * 2) as u64;
+        hash_read(File::open(&object).unwrap(), Some(region), &mut hasher).unwrap();
+        assert_eq!(hasher.finish().unwrap(), crate::utils::sha256sum(&content[..region as usize]));
+    }
+
+    #[test]
+    fn kernel_hashing() {
+        // Not all kernels have the crypto API for the user space.
+        let mut hasher = match KernelHasher::new() {
+            Ok(hasher) => hasher,
+            Err(_) => return,
+        };
+        hasher.update(b"headercontent").unwrap();
+        hasher.update(b"trailer").unwrap();
+        assert_eq!(
+            crate::utils::hex_encode(&hasher.finish().unwrap()),
+            crate::utils::sha256sum(b"headercontenttrailer")
+        );
+        assert_eq!(
+            crate::utils::hex_encode(&KernelHasher::new().unwrap().finish().unwrap()),
+            crate::utils::sha256sum(b"")
+        );
+    }
+}